@@ -11,7 +11,11 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	crypto_acme "golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
@@ -23,8 +27,10 @@ import (
 )
 
 var (
-	manager *autocert.Manager
-	l       = zlog.Module("acme")
+	manager  *autocert.Manager
+	pemFiles []string
+	pemCerts atomic.Pointer[[]tls.Certificate]
+	l        = zlog.Module("acme")
 )
 
 // cache is like autocert.DirCache, but ensures that certificates end with .pem.
@@ -70,8 +76,8 @@ func Setup(db zdb.DB, flag string, dev bool) (*tls.Config, http.HandlerFunc, uin
 		listen    uint8
 		listenTLS = true
 		secure    = true
-		certs     []tls.Certificate
 	)
+	pemFiles = nil
 	for _, f := range s {
 		switch {
 		default:
@@ -89,23 +95,7 @@ func Setup(db zdb.DB, flag string, dev bool) (*tls.Config, http.HandlerFunc, uin
 		case f == "rdr":
 			listen += zhttp.ServeRedirect
 		case strings.HasSuffix(f, ".pem"):
-			cert, err := tls.LoadX509KeyPair(f, f)
-			if err != nil {
-				panic(err)
-			}
-			if len(cert.Certificate) == 0 {
-				panic(fmt.Sprintf("no certificates in %q", f))
-			}
-			if len(cert.Certificate) > 1 {
-				panic(fmt.Sprintf("multiple certificates in %q", f))
-			}
-
-			leaf, err := x509.ParseCertificate(cert.Certificate[0])
-			if err != nil {
-				panic(err)
-			}
-			cert.Leaf = leaf
-			certs = append(certs, cert)
+			pemFiles = append(pemFiles, f)
 		case strings.HasPrefix(f, "acme"):
 			dir := "acme-secrets"
 			if c := strings.Index(f, ":"); c > -1 {
@@ -139,24 +129,37 @@ func Setup(db zdb.DB, flag string, dev bool) (*tls.Config, http.HandlerFunc, uin
 		}
 	}
 
+	if len(pemFiles) > 0 {
+		certs, err := loadPEM(pemFiles)
+		if err != nil {
+			panic(err)
+		}
+		pemCerts.Store(&certs)
+	}
+
 	if manager == nil {
 		if !listenTLS {
 			return nil, nil, listen, secure
 		}
-		if len(certs) == 0 {
+		if len(pemFiles) == 0 {
 			panic("-tls: no acme and no certificates")
 		}
 		return &tls.Config{
 			PreferServerCipherSuites: true,
 			MinVersion:               tls.VersionTLS12,
-			Certificates:             certs,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if c := getPEM(hello); c != nil {
+					return c, nil
+				}
+				return &(*pemCerts.Load())[0], nil // Same as crypto/tls if nothing matches.
+			},
 		}, nil, listen, secure
 	}
 
 	var tlsc *tls.Config
 	if listenTLS {
 		tlsc = manager.TLSConfig()
-		if len(certs) > 0 {
+		if len(pemFiles) > 0 {
 			// The standard GetCertificate() prefers ACME over the .pem files, but
 			// this isn't what we want for goatcounter.com since we have a
 			// DNS-verified *.goatcounter.com ACME certificate that we want to load
@@ -166,10 +169,8 @@ func Setup(db zdb.DB, flag string, dev bool) (*tls.Config, http.HandlerFunc, uin
 			// a bit tricky and not really something that needs to be part of
 			// GoatCounter.
 			tlsc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				for _, c := range certs {
-					if c.Leaf.VerifyHostname(hello.ServerName) == nil {
-						return &c, nil
-					}
+				if c := getPEM(hello); c != nil {
+					return c, nil
 				}
 				return manager.GetCertificate(hello)
 			}
@@ -179,6 +180,62 @@ func Setup(db zdb.DB, flag string, dev bool) (*tls.Config, http.HandlerFunc, uin
 	return tlsc, manager.HTTPHandler(nil).ServeHTTP, listen, secure
 }
 
+// loadPEM loads the TLS certificate and key from the files; every file should
+// have one certificate and its key.
+func loadPEM(files []string) ([]tls.Certificate, error) {
+	certs := make([]tls.Certificate, 0, len(files))
+	for _, f := range files {
+		cert, err := tls.LoadX509KeyPair(f, f)
+		if err != nil {
+			return nil, err
+		}
+		if len(cert.Certificate) == 0 {
+			return nil, fmt.Errorf("no certificates in %q", f)
+		}
+		if len(cert.Certificate) > 1 {
+			return nil, fmt.Errorf("multiple certificates in %q", f)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", f, err)
+		}
+		cert.Leaf = leaf
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// getPEM gets the certificate from the .pem files for the hostname, or nil if
+// there is none.
+func getPEM(hello *tls.ClientHelloInfo) *tls.Certificate {
+	certs := pemCerts.Load()
+	if certs == nil {
+		return nil
+	}
+	for i := range *certs {
+		if (*certs)[i].Leaf.VerifyHostname(hello.ServerName) == nil {
+			return &(*certs)[i]
+		}
+	}
+	return nil
+}
+
+// ReloadCerts reloads the .pem files from the -tls flag; the new certificates
+// are used for new connections. The current certificates are kept if any of
+// the files can't be loaded.
+func ReloadCerts() (bool, error) {
+	if len(pemFiles) == 0 {
+		return false, nil
+	}
+	certs, err := loadPEM(pemFiles)
+	if err != nil {
+		return false, fmt.Errorf("acme.ReloadCerts: %w", err)
+	}
+	pemCerts.Store(&certs)
+	return true, nil
+}
+
 // Enabled reports if ACME is enabled.
 func Enabled() bool {
 	return manager != nil
@@ -186,15 +243,30 @@ func Enabled() bool {
 
 func Reset() {
 	manager = nil
+	pemFiles = nil
+	pemCerts.Store(nil)
 }
 
 // Make a new certificate for the domain.
 func Make(ctx context.Context, domain string) error {
+	_, err := MakeStatus(ctx, domain)
+	return err
+}
+
+// Status of a domain's certificate.
+type Status struct {
+	DNSOK   bool       // Domain points to this server.
+	Expires *time.Time // Expiry of the certificate; nil if there isn't one.
+}
+
+// MakeStatus makes a new certificate for the domain like Make(), and reports
+// the status of the DNS and certificate.
+func MakeStatus(ctx context.Context, domain string) (Status, error) {
 	if manager == nil {
 		panic("acme.MakeCert: no manager, use Setup() first")
 	}
 	if !validForwarding(ctx, domain) {
-		return nil
+		return Status{}, nil
 	}
 
 	hello := &tls.ClientHelloInfo{
@@ -211,9 +283,52 @@ func Make(ctx context.Context, domain string) error {
 		},
 	}
 
-	_, err := manager.GetCertificate(hello)
+	cert, err := manager.GetCertificate(hello)
 	if err != nil {
-		return fmt.Errorf("acme.Make: %w", err) // No multiline output with zgo.at/errors
+		return Status{DNSOK: true}, fmt.Errorf("acme.Make: %w", err) // No multiline output with zgo.at/errors
+	}
+	st := Status{DNSOK: true}
+	if cert.Leaf != nil {
+		st.Expires = &cert.Leaf.NotAfter
+	}
+	return st, nil
+}
+
+// Prune removes certificates from the cache for all domains not in keep.
+func Prune(ctx context.Context, keep []string) error {
+	if manager == nil {
+		panic("acme.Prune: no manager, use Setup() first")
+	}
+	c, ok := manager.Cache.(cache)
+	if !ok {
+		return nil
+	}
+
+	ls, err := os.ReadDir(string(c.dc))
+	if err != nil {
+		return fmt.Errorf("acme.Prune: %w", err)
+	}
+	for _, f := range ls {
+		// The key is "domain" (stored as "domain.pem") or "domain+rsa"; skip
+		// the account key and anything else.
+		key, ok := strings.CutSuffix(f.Name(), ".pem")
+		domain := key
+		if !ok {
+			domain, ok = strings.CutSuffix(f.Name(), "+rsa")
+			key = f.Name()
+		}
+		if !ok || f.IsDir() || strings.Contains(domain, "+") {
+			continue
+		}
+		if slices.ContainsFunc(keep, func(k string) bool { return strings.EqualFold(k, domain) }) {
+			continue
+		}
+
+		l.Printf("removing certificate for %q", domain)
+		err := c.Delete(ctx, key)
+		if err != nil {
+			return fmt.Errorf("acme.Prune: %w", err)
+		}
 	}
 	return nil
 }
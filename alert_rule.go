@@ -0,0 +1,266 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/ztime"
+)
+
+// Alert rule kinds.
+const (
+	AlertCount   = "count"   // More than Threshold pageviews in the last hour.
+	AlertAverage = "average" // More than Threshold times the hourly average of the last 7 days.
+	AlertNoData  = "nodata"  // No pageviews in the last Threshold hours.
+)
+
+// AlertNoDataBaseline is the minimum number of pageviews a site would normally
+// get in the window for a no-data alert to be sent, based on the average of the
+// 7 days before that. Sites with sparse traffic may not get any pageviews for a
+// day or so, and that's not a problem with the integration.
+const AlertNoDataBaseline = 5
+
+// AlertRule sends a notification when there is a traffic spike.
+type AlertRule struct {
+	ID     int64 `db:"alert_rule_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"`
+	UserID int64 `db:"user_id" json:"-"` // User to notify.
+
+	Kind      string  `db:"kind" json:"kind"`
+	Threshold float64 `db:"threshold" json:"threshold"`
+
+	// Don't notify again for this many minutes after the alert fired; not used
+	// for no-data alerts.
+	Cooldown int `db:"cooldown" json:"cooldown"`
+
+	// Also deliver to the user's webhooks.
+	Webhook zbool.Bool `db:"webhook" json:"webhook"`
+
+	// No-data alert was sent and there haven't been any pageviews since.
+	Firing zbool.Bool `db:"firing" json:"firing"`
+
+	LastFiredAt *time.Time `db:"last_fired_at" json:"last_fired_at"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (r *AlertRule) Defaults(ctx context.Context) {
+	r.SiteID = MustGetSite(ctx).ID
+	if r.UserID == 0 {
+		r.UserID = GetUser(ctx).ID
+	}
+	if r.Cooldown == 0 {
+		r.Cooldown = 360
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = ztime.Now()
+	}
+}
+
+func (r *AlertRule) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", r.SiteID)
+	v.Required("user_id", r.UserID)
+	v.Include("kind", r.Kind, []string{AlertCount, AlertAverage, AlertNoData})
+	v.Range("cooldown", int64(r.Cooldown), 10, 7*24*60)
+	switch {
+	case r.Kind == AlertCount && (r.Threshold < 1 || r.Threshold != math.Trunc(r.Threshold)):
+		v.Append("threshold", "must be a whole number of at least 1")
+	case r.Kind == AlertAverage && r.Threshold < 1.1:
+		v.Append("threshold", "must be at least 1.1")
+	case r.Kind == AlertNoData && (r.Threshold < 1 || r.Threshold > 30*24 || r.Threshold != math.Trunc(r.Threshold)):
+		v.Append("threshold", "must be a whole number of hours between 1 and 720")
+	case r.Threshold > 1e9:
+		v.Append("threshold", "too large")
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (r *AlertRule) Insert(ctx context.Context) error {
+	if r.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	r.Defaults(ctx)
+	err := r.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.ID, err = zdb.InsertID(ctx, "alert_rule_id",
+		`insert into alert_rules (site_id, user_id, kind, threshold, cooldown, webhook, created_at) values (?)`,
+		[]any{r.SiteID, r.UserID, r.Kind, r.Threshold, r.Cooldown, r.Webhook, r.CreatedAt})
+	return errors.Wrap(err, "AlertRule.Insert")
+}
+
+func (r *AlertRule) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, r, `/* AlertRule.ByID */
+		select * from alert_rules where alert_rule_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "AlertRule.ByID %d", id)
+}
+
+func (r *AlertRule) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* AlertRule.Delete */ delete from alert_rules where alert_rule_id=$1 and site_id=$2`,
+		r.ID, MustGetSite(ctx).ID)
+	return errors.Wrapf(err, "AlertRule.Delete %d", r.ID)
+}
+
+// Fired records that the alert was sent.
+//
+// No-data alerts are marked as firing until Resolved() is called.
+func (r *AlertRule) Fired(ctx context.Context) error {
+	now := ztime.Now()
+	firing := zbool.Bool(r.Kind == AlertNoData)
+	err := zdb.Exec(ctx, `update alert_rules set last_fired_at=$1, firing=$2 where alert_rule_id=$3`,
+		now, firing, r.ID)
+	if err != nil {
+		return errors.Wrapf(err, "AlertRule.Fired %d", r.ID)
+	}
+	r.LastFiredAt, r.Firing = &now, firing
+	return nil
+}
+
+// Resolved records that there are pageviews again after a no-data alert.
+func (r *AlertRule) Resolved(ctx context.Context) error {
+	err := zdb.Exec(ctx, `update alert_rules set firing=0 where alert_rule_id=$1`, r.ID)
+	if err != nil {
+		return errors.Wrapf(err, "AlertRule.Resolved %d", r.ID)
+	}
+	r.Firing = false
+	return nil
+}
+
+// InCooldown reports if the alert was sent less than Cooldown minutes ago.
+//
+// No-data alerts don't have a cooldown: they're sent once, and not again until
+// they're resolved.
+func (r AlertRule) InCooldown(now time.Time) bool {
+	if r.Kind == AlertNoData {
+		return false
+	}
+	return r.LastFiredAt != nil && now.Sub(*r.LastFiredAt) < time.Duration(r.Cooldown)*time.Minute
+}
+
+// AlertCheck is the result of checking an alert rule.
+type AlertCheck struct {
+	Pageviews int     // Pageviews in the last hour, or the window for no-data alerts.
+	Average   float64 // Average pageviews per hour in the 7 days before that.
+
+	// Pageviews need to exceed this to trigger the alert. For no-data alerts
+	// this is the expected number of pageviews in the window, which needs to be
+	// at least AlertNoDataBaseline.
+	Limit     float64
+	Triggered bool
+}
+
+// Check if there are more pageviews than the rule allows.
+//
+// The hit_counts are stored per hour, so the pageviews for "the last hour" are
+// the pageviews in the current hour plus the part of the previous hour that's
+// in the last 60 minutes, assuming the previous hour's pageviews were evenly
+// spread. Pageviews that aren't persisted yet are added from the Memstore.
+//
+// No-data alerts are triggered if there are no pageviews in the last Threshold
+// hours, and the site normally gets at least AlertNoDataBaseline pageviews in
+// that time.
+func (r AlertRule) Check(ctx context.Context, now time.Time) (AlertCheck, error) {
+	if r.Kind == AlertNoData {
+		return r.checkNoData(ctx, now)
+	}
+
+	var (
+		cur  = now.UTC().Truncate(time.Hour)
+		prev = cur.Add(-time.Hour)
+		week = cur.Add(-7*24*time.Hour - time.Hour)
+		c    struct {
+			Cur  int `db:"cur"`
+			Prev int `db:"prev"`
+			Week int `db:"week"`
+		}
+	)
+	err := zdb.Get(ctx, &c, `/* AlertRule.Check */
+		select
+			coalesce(sum(case when hour >= :cur then views else 0 end), 0) as cur,
+			coalesce(sum(case when hour >= :prev and hour < :cur then views else 0 end), 0) as prev,
+			coalesce(sum(case when hour < :prev then views else 0 end), 0) as week
+		from hit_counts
+		where site_id = :site and hour >= :week
+	`, map[string]any{"site": r.SiteID, "cur": cur, "prev": prev, "week": week})
+	if err != nil {
+		return AlertCheck{}, errors.Wrapf(err, "AlertRule.Check %d", r.ID)
+	}
+
+	frac := 1 - now.Sub(cur).Minutes()/60
+	check := AlertCheck{
+		Pageviews: c.Cur + int(math.Round(float64(c.Prev)*frac)) + Memstore.CountSince(r.SiteID, now.Add(-time.Hour)),
+		Average:   float64(c.Week) / (7 * 24),
+	}
+	switch r.Kind {
+	case AlertCount:
+		check.Limit = r.Threshold
+	case AlertAverage:
+		// Use at least 1 so that a site with hardly any traffic doesn't alert
+		// on every pageview.
+		check.Limit = r.Threshold * max(check.Average, 1)
+	}
+	check.Triggered = float64(check.Pageviews) > check.Limit
+	return check, nil
+}
+
+func (r AlertRule) checkNoData(ctx context.Context, now time.Time) (AlertCheck, error) {
+	var (
+		window = time.Duration(r.Threshold) * time.Hour
+		start  = now.UTC().Add(-window).Truncate(time.Hour)
+		week   = start.Add(-7 * 24 * time.Hour)
+		c      struct {
+			Cur  int `db:"cur"`
+			Week int `db:"week"`
+		}
+	)
+	err := zdb.Get(ctx, &c, `/* AlertRule.checkNoData */
+		select
+			coalesce(sum(case when hour >= :start then views else 0 end), 0) as cur,
+			coalesce(sum(case when hour < :start then views else 0 end), 0) as week
+		from hit_counts
+		where site_id = :site and hour >= :week
+	`, map[string]any{"site": r.SiteID, "start": start, "week": week})
+	if err != nil {
+		return AlertCheck{}, errors.Wrapf(err, "AlertRule.checkNoData %d", r.ID)
+	}
+
+	check := AlertCheck{
+		Pageviews: c.Cur + Memstore.CountSince(r.SiteID, now.Add(-window)),
+		Average:   float64(c.Week) / (7 * 24),
+	}
+	check.Limit = check.Average * r.Threshold
+	check.Triggered = check.Pageviews == 0 && check.Limit >= AlertNoDataBaseline
+	return check, nil
+}
+
+type AlertRules []AlertRule
+
+// List all alert rules for this site.
+func (r *AlertRules) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, r,
+		`/* AlertRules.List */ select * from alert_rules where site_id=$1 order by alert_rule_id`,
+		MustGetSite(ctx).ID), "AlertRules.List")
+}
+
+// UnscopedListActive lists the alert rules for all active sites.
+func (r *AlertRules) UnscopedListActive(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, r, `/* AlertRules.UnscopedListActive */
+		select alert_rules.* from alert_rules
+		join sites using (site_id)
+		where sites.state = $1
+		order by alert_rule_id`, StateActive), "AlertRules.UnscopedListActive")
+}
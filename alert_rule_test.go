@@ -0,0 +1,114 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+)
+
+func TestAlertRuleCheck(t *testing.T) {
+	ctx := gctest.DB(t)
+	now := time.Date(2019, 6, 17, 12, 30, 0, 0, time.UTC)
+
+	hits := func(n int, t time.Time) []Hit {
+		h := make([]Hit, n)
+		for i := range h {
+			h[i] = Hit{Path: "/a", FirstVisit: true, CreatedAt: t}
+		}
+		return h
+	}
+
+	// 168 pageviews in the last week: an average of 1 per hour.
+	gctest.StoreHits(ctx, t, false, hits(84, now.Add(-3*24*time.Hour))...)
+	gctest.StoreHits(ctx, t, false, hits(84, now.Add(-6*24*time.Hour))...)
+	// Half of the previous hour is in the last hour: 5, plus 4 in this hour.
+	gctest.StoreHits(ctx, t, false, hits(10, now.Add(-80*time.Minute))...)
+	gctest.StoreHits(ctx, t, false, hits(4, now.Add(-10*time.Minute))...)
+	// Not persisted yet.
+	Memstore.Append(Hit{Site: MustGetSite(ctx).ID, Session: TestSession, Path: "/a", CreatedAt: now.Add(-time.Minute)},
+		Hit{Site: MustGetSite(ctx).ID, Session: TestSession, Path: "/a", CreatedAt: now.Add(-time.Minute), Bot: 1})
+	t.Cleanup(func() { gctest.StoreHits(ctx, t, false) })
+
+	tests := []struct {
+		kind      string
+		threshold float64
+		wantLimit float64
+		want      bool
+	}{
+		{AlertCount, 9, 9, true},
+		{AlertCount, 10, 10, false},
+		{AlertAverage, 9, 9, true},
+		{AlertAverage, 10, 10, false},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			r := AlertRule{SiteID: MustGetSite(ctx).ID, Kind: tt.kind, Threshold: tt.threshold}
+			have, err := r.Check(ctx, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := AlertCheck{Pageviews: 10, Average: 1, Limit: tt.wantLimit, Triggered: tt.want}
+			if have != want {
+				t.Errorf("\nhave: %+v\nwant: %+v", have, want)
+			}
+		})
+	}
+}
+
+func TestAlertRuleCooldown(t *testing.T) {
+	now := time.Date(2019, 6, 17, 12, 30, 0, 0, time.UTC)
+	fired := now.Add(-30 * time.Minute)
+	r := AlertRule{Cooldown: 60, LastFiredAt: &fired}
+
+	if !r.InCooldown(now) {
+		t.Error("not in cooldown after 30 minutes")
+	}
+	if r.InCooldown(now.Add(30 * time.Minute)) {
+		t.Error("in cooldown after 60 minutes")
+	}
+	if (AlertRule{Cooldown: 60}).InCooldown(now) {
+		t.Error("in cooldown without LastFiredAt")
+	}
+	if (AlertRule{Kind: AlertNoData, Cooldown: 60, LastFiredAt: &fired}).InCooldown(now) {
+		t.Error("nodata alert in cooldown")
+	}
+}
+
+func TestAlertRuleCheckNoData(t *testing.T) {
+	ctx := gctest.DB(t)
+	now := time.Date(2019, 6, 17, 12, 30, 0, 0, time.UTC)
+
+	// 84 pageviews in the week before the last 24 hours: 0.5 per hour.
+	hits := make([]Hit, 84)
+	for i := range hits {
+		hits[i] = Hit{Path: "/a", FirstVisit: true, CreatedAt: now.Add(-3 * 24 * time.Hour)}
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	check := func(t *testing.T, threshold float64, want AlertCheck) {
+		t.Helper()
+		r := AlertRule{SiteID: MustGetSite(ctx).ID, Kind: AlertNoData, Threshold: threshold}
+		have, err := r.Check(ctx, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("\nhave: %+v\nwant: %+v", have, want)
+		}
+	}
+
+	// Expect 12 pageviews in 24 hours.
+	check(t, 24, AlertCheck{Pageviews: 0, Average: 0.5, Limit: 12, Triggered: true})
+	// Only 3 in 6 hours, which is below the baseline.
+	check(t, 6, AlertCheck{Pageviews: 0, Average: 0.5, Limit: 3, Triggered: false})
+
+	gctest.StoreHits(ctx, t, false, Hit{Path: "/a", FirstVisit: true, CreatedAt: now.Add(-2 * time.Hour)})
+	check(t, 24, AlertCheck{Pageviews: 1, Average: 0.5, Limit: 12, Triggered: false})
+}
@@ -28,6 +28,7 @@ const (
 	APIPermSiteCreate                // 16
 	APIPermSiteUpdate                // 32
 	APIPermStats                     // 64
+	APIPermPurge                     // 128
 )
 
 type APIToken struct {
@@ -84,6 +85,11 @@ func (t APIToken) PermissionFlags(only ...zint.Bitflag64) []PermissionFlag {
 			Label: "Update sites",
 			Flag:  APIPermSiteUpdate,
 		},
+		{
+			Label: "Delete data",
+			Help:  "Permanently delete pageviews and stats with the /api/v0/purge endpoints",
+			Flag:  APIPermPurge,
+		},
 	}
 
 	if len(only) == 0 {
@@ -117,6 +123,9 @@ func (t APIToken) FormatPermissions() string {
 	if t.Permissions.Has(APIPermSiteUpdate) {
 		all = append(all, "site-update")
 	}
+	if t.Permissions.Has(APIPermPurge) {
+		all = append(all, "purge")
+	}
 	return "'" + strings.Join(all, "', '") + "'"
 }
 
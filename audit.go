@@ -0,0 +1,286 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/json"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// AuditRetention is how long audit entries are kept.
+const AuditRetention = 365 * 24 * time.Hour
+
+// Audit actions.
+const (
+	AuditSiteCreate      = "site.create"
+	AuditSiteUpdate      = "site.update"
+	AuditSiteCode        = "site.code"
+	AuditSiteDelete      = "site.delete"
+	AuditSiteRestore     = "site.restore"
+	AuditSiteTransfer    = "site.transfer"     // Transfer started.
+	AuditSiteTransferIn  = "site.transfer-in"  // Transfer accepted, on the new account.
+	AuditSiteTransferOut = "site.transfer-out" // Transfer accepted, on the old account.
+	AuditSiteDisable     = "site.disable"      // Counting disabled or enabled by the instance admin.
+	AuditSiteWarn        = "site.warn"         // Warning email sent by the instance admin.
+	AuditSiteBulk        = "site.bulk"         // Summary of a bulk action, on the instance admin's account.
+	AuditUserCreate      = "user.create"
+	AuditUserUpdate      = "user.update"
+	AuditUserDelete      = "user.delete"
+	AuditUserPassword    = "user.password"
+	AuditUserEmail       = "user.email"
+	AuditUserMFA         = "user.mfa"
+	AuditInviteCreate    = "invite.create"
+	AuditInviteRevoke    = "invite.revoke"
+	AuditAPITokenCreate  = "apitoken.create"
+	AuditAPITokenDelete  = "apitoken.delete"
+	AuditShareLinkCreate = "sharelink.create"
+	AuditShareLinkRevoke = "sharelink.revoke"
+	AuditSessionPurge    = "session.purge"  // Pageviews for sessions removed; doesn't include the session IDs.
+	AuditPageviewPurge   = "pageview.purge" // Pageviews in a date range removed.
+	AuditRefPurge        = "ref.purge"      // Referrer removed from the stats.
+)
+
+var AuditActions = []string{AuditSiteCreate, AuditSiteUpdate, AuditSiteCode,
+	AuditSiteDelete, AuditSiteRestore, AuditSiteTransfer, AuditSiteTransferIn, AuditSiteTransferOut,
+	AuditSiteDisable, AuditSiteWarn, AuditSiteBulk,
+	AuditUserCreate, AuditUserUpdate, AuditUserDelete, AuditUserPassword,
+	AuditUserEmail, AuditUserMFA, AuditInviteCreate, AuditInviteRevoke,
+	AuditAPITokenCreate, AuditAPITokenDelete, AuditShareLinkCreate, AuditShareLinkRevoke,
+	AuditSessionPurge, AuditPageviewPurge, AuditRefPurge}
+
+// AuditEntry is a change to the settings, users, or API tokens of an account.
+//
+// Entries are never updated; they're only removed after AuditRetention.
+type AuditEntry struct {
+	ID         int64  `db:"audit_entry_id" json:"id"`
+	SiteID     int64  `db:"site_id" json:"-"` // Always the account ID.
+	UserID     int64  `db:"user_id" json:"user_id"`
+	APITokenID *int64 `db:"api_token_id" json:"api_token_id"`
+
+	// Email of the user at the time of the change, as the user may be deleted
+	// or change their email.
+	Actor string `db:"actor" json:"actor"`
+
+	Action    string    `db:"action" json:"action"`
+	Target    string    `db:"target" json:"target"`
+	Diff      AuditDiff `db:"diff" json:"diff"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// AuditChange is the old and new value of a field.
+type AuditChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+func (c AuditChange) OldString() string { return auditString(c.Old) }
+func (c AuditChange) NewString() string { return auditString(c.New) }
+
+func auditString(v any) string {
+	if v == nil {
+		return "–"
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	j, _ := json.Marshal(v)
+	return string(j)
+}
+
+// AuditDiff is a list of changed fields, as dotted paths of the JSON
+// representation (e.g. "settings.ignore_ips").
+type AuditDiff map[string]AuditChange
+
+func (d AuditDiff) Value() (driver.Value, error) { return json.Marshal(d) }
+
+func (d *AuditDiff) Scan(v any) error {
+	switch vv := v.(type) {
+	case []byte:
+		return json.Unmarshal(vv, d)
+	case string:
+		return json.Unmarshal([]byte(vv), d)
+	default:
+		return fmt.Errorf("AuditDiff.Scan: unsupported type: %T", v)
+	}
+}
+
+// Never store the values of fields with these words in the name. Most of
+// these should already be excluded with `json:"-"`, but better safe than
+// sorry.
+var auditRedact = []string{"password", "token", "secret"}
+
+const auditRedacted = "[redacted]"
+
+// NewAuditDiff gets all fields that differ between old and new. Either can be
+// nil, for example when creating something.
+//
+// Fields are compared on their JSON representation, so fields with `json:"-"`
+// are never included. Nested objects are compared per-field, but arrays are
+// compared as a whole.
+func NewAuditDiff(old, new any) AuditDiff {
+	var o, n map[string]any
+	auditFlatten(&o, "", old)
+	auditFlatten(&n, "", new)
+
+	d := make(AuditDiff)
+	for k, v := range n {
+		if ov, ok := o[k]; !ok || !reflect.DeepEqual(ov, v) {
+			d[k] = AuditChange{Old: o[k], New: v}
+		}
+	}
+	for k, v := range o {
+		if _, ok := n[k]; !ok {
+			d[k] = AuditChange{Old: v}
+		}
+	}
+
+	for k, c := range d {
+		l := strings.ToLower(k)
+		for _, r := range auditRedact {
+			if strings.Contains(l, r) {
+				if c.Old != nil {
+					c.Old = auditRedacted
+				}
+				if c.New != nil {
+					c.New = auditRedacted
+				}
+				d[k] = c
+				break
+			}
+		}
+	}
+	return d
+}
+
+// AuditSnapshot gets the JSON representation of v, for use as the old value in
+// NewAuditDiff() when v will be modified in-place.
+func AuditSnapshot(v any) json.RawMessage {
+	j, err := json.Marshal(v)
+	if err != nil {
+		zlog.Error(err)
+	}
+	return j
+}
+
+func auditFlatten(dst *map[string]any, prefix string, v any) {
+	if *dst == nil {
+		*dst = make(map[string]any)
+	}
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+		return
+	}
+	if prefix == "" {
+		j, err := json.Marshal(v)
+		if err != nil {
+			zlog.Error(err)
+			return
+		}
+		var m map[string]any
+		if json.Unmarshal(j, &m) != nil {
+			return
+		}
+		v = m
+	}
+
+	m, ok := v.(map[string]any)
+	if !ok {
+		(*dst)[prefix] = v
+		return
+	}
+	for k, vv := range m {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		if vv == nil {
+			(*dst)[k] = nil
+			continue
+		}
+		auditFlatten(dst, k, vv)
+	}
+}
+
+// Audit adds an entry to the audit log, with the user and site from the
+// context.
+//
+// Errors are logged rather than returned, as the change itself was already
+// made.
+func Audit(ctx context.Context, action, target string, old, new any) {
+	u := GetUser(ctx)
+	e := AuditEntry{
+		SiteID: MustGetSite(ctx).IDOrParent(),
+		UserID: u.ID,
+		Actor:  u.Email,
+		Action: action,
+		Target: target,
+		Diff:   NewAuditDiff(old, new),
+	}
+	if t := GetAPIToken(ctx); t != nil {
+		e.APITokenID = &t.ID
+		e.Actor += " (API token ‘" + t.Name + "’)"
+	}
+
+	err := e.Insert(ctx)
+	if err != nil {
+		zlog.Fields(zlog.F{"action": action, "target": target}).Error(err)
+	}
+}
+
+// Insert a new entry.
+func (e *AuditEntry) Insert(ctx context.Context) error {
+	if e.ID > 0 {
+		return errors.New("AuditEntry.Insert: ID > 0")
+	}
+	if e.Diff == nil {
+		e.Diff = AuditDiff{}
+	}
+	e.CreatedAt = ztime.Now()
+
+	var err error
+	e.ID, err = zdb.InsertID(ctx, "audit_entry_id",
+		`insert into audit_entries (site_id, user_id, api_token_id, actor, action, target, diff, created_at) values (?)`,
+		[]any{e.SiteID, e.UserID, e.APITokenID, e.Actor, e.Action, e.Target, e.Diff, e.CreatedAt})
+	return errors.Wrap(err, "AuditEntry.Insert")
+}
+
+type AuditEntries []AuditEntry
+
+// List entries for this account, newest first. Only entries for the user ID
+// actor and the action are listed if they're not 0 or "". Only entries with an
+// ID lower than before are listed if it's not 0.
+func (e *AuditEntries) List(ctx context.Context, actor int64, action string, before int64, limit int) (bool, error) {
+	err := zdb.Select(ctx, e, "load:audit.List", map[string]any{
+		"site":   MustGetSite(ctx).IDOrParent(),
+		"actor":  actor,
+		"action": action,
+		"before": before,
+		"limit":  limit + 1,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "AuditEntries.List")
+	}
+
+	more := len(*e) > limit
+	if more {
+		*e = (*e)[:len(*e)-1]
+	}
+	return more, nil
+}
+
+// DeleteOld deletes all entries older than AuditRetention.
+func (e *AuditEntries) DeleteOld(ctx context.Context) error {
+	err := zdb.Exec(ctx, `delete from audit_entries where created_at < $1`,
+		ztime.Now().Add(-AuditRetention))
+	return errors.Wrap(err, "AuditEntries.DeleteOld")
+}
@@ -0,0 +1,64 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/zstd/zjson"
+)
+
+func TestNewAuditDiff(t *testing.T) {
+	type nested struct {
+		A string `json:"a"`
+		B int    `json:"b"`
+	}
+	type obj struct {
+		Name     string   `json:"name"`
+		List     []string `json:"list"`
+		Nested   nested   `json:"nested"`
+		Password string   `json:"password"`
+		APIToken string   `json:"api_token"`
+		Hidden   string   `json:"-"`
+	}
+
+	tests := []struct {
+		name     string
+		old, new any
+		want     string
+	}{
+		{"same", obj{Name: "x"}, obj{Name: "x"}, `{}`},
+		{"changed",
+			obj{Name: "x", List: []string{"a"}, Nested: nested{"a", 1}},
+			obj{Name: "y", List: []string{"a", "b"}, Nested: nested{"a", 2}},
+			`{"list":{"old":["a"],"new":["a","b"]},"name":{"old":"x","new":"y"},"nested.b":{"old":1,"new":2}}`},
+		{"create", nil, nested{"a", 1},
+			`{"a":{"old":null,"new":"a"},"b":{"old":null,"new":1}}`},
+		{"removed", map[string]int{"a": 1, "b": 2}, map[string]int{"a": 1},
+			`{"b":{"old":2,"new":null}}`},
+		{"redact",
+			obj{Password: "hunter2", Hidden: "old", APIToken: ""},
+			obj{Password: "hunter3", Hidden: "new", APIToken: "s3cret"},
+			`{"api_token":{"old":"[redacted]","new":"[redacted]"},"password":{"old":"[redacted]","new":"[redacted]"}}`},
+		{"snapshot", AuditSnapshot(nested{"a", 1}), nested{"b", 1},
+			`{"a":{"old":"a","new":"b"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have := string(zjson.MustMarshal(NewAuditDiff(tt.old, tt.new)))
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+			for _, s := range []string{"hunter", "s3cret"} {
+				if strings.Contains(have, s) {
+					t.Errorf("contains %q", s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// BackupCodeCount is the number of backup codes that are generated.
+const BackupCodeCount = 10
+
+// BackupCode can be used once instead of a TOTP token, in case the
+// authenticator app is lost.
+//
+// Only a hash of the code is stored; the codes are shown once after generating
+// them.
+type BackupCode struct {
+	ID     int64 `db:"backup_code_id" json:"-"`
+	SiteID int64 `db:"site_id" json:"-"` // Always the account ID.
+	UserID int64 `db:"user_id" json:"-"`
+
+	Code      string     `db:"code" json:"-"` // SHA-256 hash; a random value once used.
+	UsedAt    *time.Time `db:"used_at" json:"used_at"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
+
+var backupCodeEnc = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// normalizeBackupCode removes spaces and dashes, so that "abcde-fghij" and
+// "ABCDE FGHIJ" are accepted.
+func normalizeBackupCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
+
+func hashBackupCode(code string) string {
+	h := sha256.Sum256([]byte(normalizeBackupCode(code)))
+	return hex.EncodeToString(h[:])
+}
+
+type BackupCodes []BackupCode
+
+// Generate a new set of backup codes for the user, replacing any existing
+// codes.
+//
+// The codes are returned formatted as "abcde-fghij"; they can't be retrieved
+// later.
+func (c *BackupCodes) Generate(ctx context.Context, userID int64) ([]string, error) {
+	var (
+		account = MustGetSite(ctx).IDOrParent()
+		now     = ztime.Now()
+		codes   = make([]string, 0, BackupCodeCount)
+		rows    = make(BackupCodes, 0, BackupCodeCount)
+	)
+	for range BackupCodeCount {
+		b := make([]byte, 6)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "BackupCodes.Generate")
+		}
+		code := backupCodeEnc.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		rows = append(rows, BackupCode{SiteID: account, UserID: userID, Code: hashBackupCode(code), CreatedAt: now})
+	}
+
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from backup_codes where user_id=$1 and site_id=$2`, userID, account)
+		if err != nil {
+			return err
+		}
+		ins := zdb.NewBulkInsert(ctx, "backup_codes", []string{"site_id", "user_id", "code", "created_at"})
+		for _, r := range rows {
+			ins.Values(r.SiteID, r.UserID, r.Code, r.CreatedAt)
+		}
+		return ins.Finish()
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "BackupCodes.Generate")
+	}
+	*c = rows
+	return codes, nil
+}
+
+// ListUser lists all backup codes for a user, including used ones.
+func (c *BackupCodes) ListUser(ctx context.Context, userID int64) error {
+	return errors.Wrap(zdb.Select(ctx, c, `/* BackupCodes.ListUser */
+		select * from backup_codes where user_id=$1 and site_id=$2 order by backup_code_id`,
+		userID, MustGetSite(ctx).IDOrParent()), "BackupCodes.ListUser")
+}
+
+// Remaining gets the number of unused codes.
+func (c BackupCodes) Remaining() int {
+	var n int
+	for _, cc := range c {
+		if cc.UsedAt == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Use a backup code for the user, marking it as used.
+//
+// This reports if the code was valid; codes can only be used once.
+func (c *BackupCodes) Use(ctx context.Context, userID int64, code string) (bool, error) {
+	var (
+		account = MustGetSite(ctx).IDOrParent()
+		// The hash is replaced with a random value that's unique to this
+		// request, so we can check if the update was made by this request
+		// (and not another one using the same code at the same time).
+		used  = "used-" + zcrypto.Secret128()
+		valid bool
+	)
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `update backup_codes set code=$1, used_at=$2
+			where user_id=$3 and site_id=$4 and code=$5 and used_at is null`,
+			used, ztime.Now(), userID, account, hashBackupCode(code))
+		if err != nil {
+			return err
+		}
+		var n int
+		err = zdb.Get(ctx, &n, `select count(*) from backup_codes where user_id=$1 and code=$2`, userID, used)
+		valid = n > 0
+		return err
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "BackupCodes.Use")
+	}
+	return valid, nil
+}
+
+// DeleteUser deletes all backup codes for a user.
+func (c *BackupCodes) DeleteUser(ctx context.Context, userID int64) error {
+	err := zdb.Exec(ctx, `delete from backup_codes where user_id=$1 and site_id=$2`,
+		userID, MustGetSite(ctx).IDOrParent())
+	return errors.Wrap(err, "BackupCodes.DeleteUser")
+}
@@ -0,0 +1,90 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+)
+
+func TestBackupCodes(t *testing.T) {
+	ctx := gctest.DB(t)
+	u := MustGetUser(ctx)
+
+	use := func(t *testing.T, code string, want bool) {
+		t.Helper()
+		ok, err := (&BackupCodes{}).Use(ctx, u.ID, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("Use(%q) = %t; want %t", code, ok, want)
+		}
+	}
+	remaining := func(t *testing.T, want int) {
+		t.Helper()
+		var codes BackupCodes
+		err := codes.ListUser(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := codes.Remaining(); r != want {
+			t.Fatalf("remaining: %d; want %d", r, want)
+		}
+	}
+
+	codes, err := (&BackupCodes{}).Generate(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != BackupCodeCount {
+		t.Fatalf("len: %d", len(codes))
+	}
+	remaining(t, BackupCodeCount)
+
+	t.Run("once", func(t *testing.T) {
+		use(t, codes[0], true)
+		use(t, codes[0], false)
+		remaining(t, BackupCodeCount-1)
+
+		// Formatting is ignored.
+		use(t, strings.ToUpper(strings.ReplaceAll(codes[1], "-", " ")), true)
+		remaining(t, BackupCodeCount-2)
+
+		use(t, "aaaaa-aaaaa", false)
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		ok, err := (&BackupCodes{}).Use(ctx, u.ID+1, codes[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("used code from other user")
+		}
+	})
+
+	t.Run("regenerate", func(t *testing.T) {
+		newCodes, err := (&BackupCodes{}).Generate(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining(t, BackupCodeCount)
+
+		use(t, codes[3], false)
+		use(t, newCodes[3], true)
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		err := u.DisableTOTP(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining(t, 0)
+	})
+}
@@ -7,23 +7,30 @@ package goatcounter
 import (
 	"context"
 	"fmt"
+	"slices"
 	"time"
 
+	"zgo.at/blackmail"
 	"zgo.at/errors"
+	"zgo.at/guru"
 	"zgo.at/zcache"
 	"zgo.at/zdb"
 	"zgo.at/zstd/zjson"
 	"zgo.at/zstd/zruntime"
+	"zgo.at/zstd/ztime"
 )
 
 type BosmangStat struct {
 	ID        int64     `db:"site_id"`
 	Codes     string    `db:"codes"`
+	Tags      Strings   `db:"tags"`
 	Email     string    `db:"email"`
 	CreatedAt time.Time `db:"created_at"`
 	LastMonth int       `db:"last_month"`
 	Total     int       `db:"total"`
 	Avg       int       `db:"avg"`
+	Quota     int       `db:"quota"`
+	QuotaUsed int       `db:"quota_used"`
 }
 
 type BosmangStats []BosmangStat
@@ -34,6 +41,203 @@ func (a *BosmangStats) List(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "BosmangStats.List")
 	}
+	for i := range *a {
+		(*a)[i].Tags = NormalizeTags((*a)[i].Tags)
+	}
+	return nil
+}
+
+// Tagged gets the stats for all accounts where at least one site has the given
+// tag.
+func (a BosmangStats) Tagged(tag string) BosmangStats {
+	tagged := make(BosmangStats, 0, len(a))
+	for _, s := range a {
+		if slices.Contains(s.Tags, tag) {
+			tagged = append(tagged, s)
+		}
+	}
+	return tagged
+}
+
+// BosmangSite is a site in the overview of all sites on this instance.
+type BosmangSite struct {
+	ID           int64        `db:"site_id" json:"id"`
+	Parent       *int64       `db:"parent" json:"parent"`
+	Code         string       `db:"code" json:"code"`
+	Cname        *string      `db:"cname" json:"cname"`
+	CnameSetupAt *time.Time   `db:"cname_setup_at" json:"cname_setup_at"`
+	Settings     SiteSettings `db:"settings" json:"-"`
+	CreatedAt    time.Time    `db:"created_at" json:"created_at"`
+
+	// Email of the first user in the account.
+	Owner string `db:"owner" json:"owner"`
+
+	// Pageviews since the start of the month (in UTC), and the total number
+	// of visits ever.
+	ThisMonth int `db:"this_month" json:"this_month"`
+	Total     int `db:"total" json:"total"`
+
+	// Hour of the last received pageview; nil if there are none.
+	LastHitAt *time.Time `db:"-" json:"last_hit_at"`
+
+	// max(hour) has no type in SQLite, so it's returned as a string.
+	LastHit *string `db:"last_hit" json:"-"`
+
+	// Counting was disabled by the instance admin.
+	DisabledAt *time.Time `db:"disabled_at" json:"disabled_at"`
+}
+
+// DomainStatus gets the status of the custom domain: "none", "pending" (not
+// verified yet), or "ok".
+func (s BosmangSite) DomainStatus() string {
+	switch {
+	case s.Cname == nil:
+		return "none"
+	case s.CnameSetupAt == nil:
+		return "pending"
+	default:
+		return "ok"
+	}
+}
+
+type BosmangSites []BosmangSite
+
+// List all active sites on this instance, with usage.
+//
+// This only uses hit_counts, so it stays fast with many sites.
+func (a *BosmangSites) List(ctx context.Context) error {
+	month := ztime.Now().UTC()
+	month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	err := zdb.Select(ctx, a, "load:bosmang.ListSites", map[string]any{
+		"month": month,
+		"state": StateActive,
+	})
+	if err != nil {
+		return errors.Wrap(err, "BosmangSites.List")
+	}
+
+	for i := range *a {
+		s := &(*a)[i]
+		if s.LastHit == nil {
+			continue
+		}
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+			if t, err := time.Parse(layout, *s.LastHit); err == nil {
+				s.LastHitAt = &t
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Inactive gets all sites without pageviews in the last n months. Sites that
+// were created in that period are never included.
+func (a BosmangSites) Inactive(months int) BosmangSites {
+	cutoff := ztime.Now().AddDate(0, -months, 0)
+	inactive := make(BosmangSites, 0, len(a))
+	for _, s := range a {
+		if s.CreatedAt.Before(cutoff) && (s.LastHitAt == nil || s.LastHitAt.Before(cutoff)) {
+			inactive = append(inactive, s)
+		}
+	}
+	return inactive
+}
+
+// Bulk actions the instance admin can run on sites.
+const (
+	BulkDisable = "disable" // Disable counting.
+	BulkEnable  = "enable"  // Enable counting again.
+	BulkDelete  = "delete"  // Soft-delete; can still be restored by the site.
+	BulkWarn    = "warn"    // Email a warning to the site admins.
+)
+
+var BulkActions = []string{BulkDisable, BulkEnable, BulkDelete, BulkWarn}
+
+// BulkResult is the result of running a bulk action.
+type BulkResult struct {
+	Action string           `json:"action"`
+	Done   []int64          `json:"done"`
+	Failed map[int64]string `json:"failed"` // Site ID → error.
+}
+
+func (r BulkResult) String() string {
+	return fmt.Sprintf("%s: %d sites done, %d failed", r.Action, len(r.Done), len(r.Failed))
+}
+
+// BulkSites runs a bulk action on the given sites, as the user in the context.
+// msg is only used for BulkWarn, and may be empty.
+//
+// Errors for a site are recorded in the result and don't stop the other sites.
+// Every change is added to the audit log of the site's account, and a summary
+// to the audit log of the current account.
+func BulkSites(ctx context.Context, action string, ids []int64, msg string) (BulkResult, error) {
+	if !slices.Contains(BulkActions, action) {
+		return BulkResult{}, guru.Errorf(400, "unknown action: %q", action)
+	}
+
+	res := BulkResult{Action: action, Done: make([]int64, 0, len(ids)), Failed: make(map[int64]string)}
+	for _, id := range ids {
+		err := bulkSite(ctx, action, id, msg)
+		if err != nil {
+			res.Failed[id] = err.Error()
+			continue
+		}
+		res.Done = append(res.Done, id)
+	}
+
+	Audit(ctx, AuditSiteBulk, res.String(), nil, res)
+	return res, nil
+}
+
+func bulkSite(ctx context.Context, action string, id int64, msg string) error {
+	var site Site
+	err := site.ByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	var (
+		target  = site.Display(ctx)
+		siteCtx = WithSite(ctx, &site)
+	)
+	switch action {
+	case BulkDisable, BulkEnable:
+		old := site.DisabledAt
+		err := site.SetDisabled(ctx, action == BulkDisable)
+		if err != nil {
+			return err
+		}
+		Audit(siteCtx, AuditSiteDisable, target,
+			map[string]any{"disabled_at": old}, map[string]any{"disabled_at": site.DisabledAt})
+	case BulkDelete:
+		err := site.Delete(ctx, false)
+		if err != nil {
+			return err
+		}
+		Audit(siteCtx, AuditSiteDelete, target, nil, nil)
+	case BulkWarn:
+		var users Users
+		err := users.BySite(ctx, site.IDOrParent())
+		if err != nil {
+			return err
+		}
+		admins := users.Admins()
+		if len(admins) == 0 {
+			return errors.New("no admin users to send the warning to")
+		}
+		for _, u := range admins {
+			err := blackmail.Send("GoatCounter: message about "+target,
+				blackmail.From("GoatCounter", Config(ctx).EmailFrom),
+				blackmail.To(u.Email),
+				blackmail.BodyMustText(TplEmailSiteWarning{ctx, site, u, msg}.Render))
+			if err != nil {
+				return err
+			}
+		}
+		Audit(siteCtx, AuditSiteWarn, target, nil, map[string]any{"message": msg})
+	}
 	return nil
 }
 
@@ -0,0 +1,150 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"zgo.at/blackmail"
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestBosmangSitesList(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2026-10-16 12:00:00")
+
+	site := MustGetSite(ctx)
+	other := Site{Parent: &site.ID, Code: "other"}
+	err := other.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := ztime.Now()
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: now},
+		Hit{Path: "/a", CreatedAt: now},
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: now.AddDate(0, -1, 0)},
+	)
+
+	var sites BosmangSites
+	err = sites.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sites) != 2 {
+		t.Fatalf("len = %d", len(sites))
+	}
+
+	s := sites[0]
+	have := fmt.Sprintf("%d %s month=%d total=%d domain=%s", s.ID, s.Owner, s.ThisMonth, s.Total, s.DomainStatus())
+	want := fmt.Sprintf("%d %s month=2 total=2 domain=pending", site.ID, MustGetUser(ctx).Email)
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	if s.LastHitAt == nil || !s.LastHitAt.Equal(now.Truncate(time.Hour)) {
+		t.Errorf("LastHitAt: %v", s.LastHitAt)
+	}
+
+	s = sites[1]
+	if s.ID != other.ID || s.Owner != MustGetUser(ctx).Email || s.Total != 0 || s.LastHitAt != nil || s.DomainStatus() != "none" {
+		t.Errorf("wrong second site: %+v", s)
+	}
+}
+
+func TestBulkSites(t *testing.T) {
+	blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter,
+		blackmail.MailerOut(new(bytes.Buffer)))
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	other := Site{Parent: &site.ID, Code: "other"}
+	err := other.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(t *testing.T, action string, wantDone int) {
+		t.Helper()
+		res, err := BulkSites(ctx, action, []int64{other.ID, 9999}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Done) != wantDone || len(res.Failed) != 1 || res.Failed[9999] == "" {
+			t.Fatalf("wrong result: %+v", res)
+		}
+	}
+
+	t.Run("disable", func(t *testing.T) {
+		run(t, BulkDisable, 1)
+
+		var s Site
+		err := s.ByID(ctx, other.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.DisabledAt == nil {
+			t.Fatal("DisabledAt not set")
+		}
+
+		run(t, BulkEnable, 1)
+		err = s.ByID(ctx, other.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.DisabledAt != nil {
+			t.Fatal("DisabledAt still set")
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		run(t, BulkWarn, 1)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		run(t, BulkDelete, 1)
+
+		var s Site
+		err := s.ByIDState(ctx, other.ID, StateDeleted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		run(t, BulkDelete, 0)
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		var entries AuditEntries
+		_, err := entries.List(ctx, 0, "", 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var have []string
+		for _, e := range entries {
+			if e.Actor != MustGetUser(ctx).Email {
+				t.Errorf("wrong actor: %q", e.Actor)
+			}
+			have = append(have, e.Action)
+		}
+		want := []string{"site.bulk", "site.bulk", "site.delete", "site.bulk", "site.warn",
+			"site.bulk", "site.disable", "site.bulk", "site.disable"}
+		if !slices.Equal(have, want) {
+			t.Errorf("\nhave: %v\nwant: %v", have, want)
+		}
+	})
+
+	t.Run("unknown action", func(t *testing.T) {
+		_, err := BulkSites(ctx, "explode", []int64{other.ID}, "")
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
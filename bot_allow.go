@@ -0,0 +1,199 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// BotAllowRule counts requests that would otherwise be flagged as a bot as
+// regular pageviews, with a label.
+//
+// A rule is stored as "label: condition", where the condition is an IP address
+// or CIDR, a case-insensitive substring of the User-Agent header, or a regular
+// expression for the User-Agent header if it's surrounded by slashes. Two
+// conditions can be combined with "&", in which case both must match:
+//
+//	Uptime monitor: UptimeRobot
+//	Feed fetcher:   /^PartnerFeed\// & 198.51.100.0/24
+type BotAllowRule struct {
+	Label string
+
+	line   string
+	ua     string
+	re     *regexp.Regexp
+	prefix netip.Prefix
+	err    error
+}
+
+// BotAllow is a list of BotAllowRule, stored as one rule per line.
+//
+// The site's IP and User-Agent blocklists take precedence over this, and this
+// takes precedence over all other bot detection:
+//
+//	IPBlock, UABlock > BotAllow > isbot, IsSupplementBot(), count.js
+type BotAllow []BotAllowRule
+
+func (r BotAllowRule) String() string { return r.line }
+
+func (r BotAllowRule) match(ua string, addr netip.Addr) bool {
+	if r.err != nil {
+		return false
+	}
+	if r.prefix.IsValid() && (!addr.IsValid() || !r.prefix.Contains(addr)) {
+		return false
+	}
+	if r.re != nil && !r.re.MatchString(ua) {
+		return false
+	}
+	if r.ua != "" && !strings.Contains(strings.ToLower(ua), strings.ToLower(r.ua)) {
+		return false
+	}
+	return true
+}
+
+func (l BotAllow) String() string {
+	s := make([]string, 0, len(l))
+	for _, r := range l {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+func (l BotAllow) Value() (driver.Value, error)  { return l.String(), nil }
+func (l BotAllow) MarshalText() ([]byte, error)  { return []byte(l.String()), nil }
+func (l *BotAllow) UnmarshalText(v []byte) error { return l.Scan(v) }
+
+// Scan the rules; this never returns an error, so that a bad rule doesn't
+// prevent loading the settings. Use Validate() to check the rules.
+func (l *BotAllow) Scan(v any) error {
+	if v == nil {
+		return nil
+	}
+
+	lines := strings.Split(fmt.Sprintf("%s", v), "\n")
+	rules := make(BotAllow, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		rules = append(rules, parseBotAllowRule(line))
+	}
+	*l = rules
+	return nil
+}
+
+func parseBotAllowRule(line string) BotAllowRule {
+	r := BotAllowRule{line: line}
+	label, conds, ok := strings.Cut(line, ":")
+	r.Label = strings.TrimSpace(label)
+	if !ok || r.Label == "" || strings.TrimSpace(conds) == "" {
+		r.err = fmt.Errorf("%q: must be as \"label: condition\"", line)
+		return r
+	}
+	if len(r.Label) > 50 {
+		r.err = fmt.Errorf("%q: label can be at most 50 characters", line)
+		return r
+	}
+
+	for _, c := range strings.Split(conds, "&") {
+		c = strings.TrimSpace(c)
+		switch {
+		case c == "":
+			r.err = fmt.Errorf("%q: empty condition", line)
+		case len(c) > 1 && c[0] == '/' && c[len(c)-1] == '/':
+			if r.re != nil || r.ua != "" {
+				r.err = fmt.Errorf("%q: can have only one User-Agent pattern", line)
+				break
+			}
+			var err error
+			r.re, err = regexp.Compile("(?i)" + c[1:len(c)-1])
+			if err != nil {
+				r.err = fmt.Errorf("%q: %w", line, err)
+			}
+		default:
+			if isIPOrPrefix(c) {
+				p, err := parseIPBlock(c)
+				switch {
+				case err != nil:
+					r.err = fmt.Errorf("%q: %w", line, err)
+				case r.prefix.IsValid():
+					r.err = fmt.Errorf("%q: can have only one network", line)
+				}
+				r.prefix = p
+				break
+			}
+			if r.re != nil || r.ua != "" {
+				r.err = fmt.Errorf("%q: can have only one User-Agent pattern", line)
+				break
+			}
+			if len(c) < 3 {
+				r.err = fmt.Errorf("%q: User-Agent pattern must be at least 3 characters", line)
+				break
+			}
+			r.ua = c
+		}
+		if r.err != nil {
+			return r
+		}
+	}
+
+	// Matching every regular browser would count all bots with a browser
+	// User-Agent, which is probably not what anyone wants.
+	if !r.prefix.IsValid() {
+		for _, b := range uaBlockBrowsers {
+			if r.match(b, netip.Addr{}) {
+				r.err = fmt.Errorf("%q: matches regular browsers such as %q", line, b)
+				break
+			}
+		}
+	}
+	return r
+}
+
+func isIPOrPrefix(s string) bool {
+	if _, err := netip.ParseAddr(s); err == nil {
+		return true
+	}
+	_, err := netip.ParsePrefix(s)
+	return err == nil
+}
+
+// Validate reports the first rule that failed to parse.
+func (l BotAllow) Validate() error {
+	for _, r := range l {
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+// Match gets the label of the first rule that matches the User-Agent header
+// and IP address; the address may include a port.
+func (l BotAllow) Match(ua, ip string) (string, bool) {
+	if len(l) == 0 {
+		return "", false
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		if ap, err := netip.ParseAddrPort(ip); err == nil {
+			addr = ap.Addr()
+		}
+	}
+	addr = addr.Unmap()
+	for _, r := range l {
+		if r.match(ua, addr) {
+			return r.Label, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,88 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+)
+
+func TestBotAllowMatch(t *testing.T) {
+	var rules BotAllow
+	rules.Scan(`
+		# Comment
+		Uptime: UptimeRobot
+		Partner: /^PartnerBot\// & 198.51.100.0/24
+		Office: 2001:db8::/32
+	`)
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ua, ip, want string
+	}{
+		{"Mozilla/5.0+(compatible; UptimeRobot/2.0)", "192.0.2.1", "Uptime"},
+		{"mozilla/5.0+(compatible; uptimerobot/2.0)", "", "Uptime"},
+		{"PartnerBot/1.0", "198.51.100.7", "Partner"},
+		{"PartnerBot/1.0", "198.51.100.7:4242", "Partner"},
+		{"PartnerBot/1.0", "::ffff:198.51.100.7", "Partner"},
+		{"curl/8.0", "[2001:db8::1]:4242", "Office"},
+
+		{"PartnerBot/1.0", "192.0.2.1", ""},
+		{"PartnerBot/1.0", "", ""},
+		{"Mozilla/5.0 PartnerBot/1.0", "198.51.100.7", ""},
+		{"curl/8.0", "2001:db9::1", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ua+" "+tt.ip, func(t *testing.T) {
+			have, ok := rules.Match(tt.ua, tt.ip)
+			if have != tt.want || ok != (tt.want != "") {
+				t.Errorf("\nhave: %q %t\nwant: %q", have, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestBotAllowValidate(t *testing.T) {
+	tests := []struct {
+		in, wantErr string
+	}{
+		{"", ""},
+		{"Uptime: UptimeRobot\nOffice: 192.0.2.1", ""},
+		{"Partner: /^PartnerBot/ & 198.51.100.0/24", ""},
+		{"UptimeRobot", `must be as "label: condition"`},
+		{": UptimeRobot", `must be as "label: condition"`},
+		{"Uptime:", `must be as "label: condition"`},
+		{"Uptime: UptimeRobot &", "empty condition"},
+		{"Uptime: ab", "must be at least 3 characters"},
+		{"Uptime: /(/", "missing closing )"},
+		{"Uptime: UptimeRobot & /^Uptime/", "only one User-Agent pattern"},
+		{"Office: 192.0.2.0/24 & 198.51.100.0/24", "only one network"},
+		{"Office: 192.0.2.1/24", "has host bits set"},
+		{"Browsers: Mozilla", "matches regular browsers"},
+		{"Browsers: Mozilla & 192.0.2.0/24", ""},
+		{strings.Repeat("x", 51) + ": UptimeRobot", "at most 50 characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var rules BotAllow
+			err := rules.Scan(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = rules.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("wrong error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zstd/ztime"
+)
+
+// BotSupplement is the bot code for pageviews that matched the supplemental
+// bot list set with InitBotData().
+const BotSupplement = 102
+
+// BotDataStatus is the status of the supplemental bot list.
+type BotDataStatus struct {
+	Source     string    // File or URL; empty if there is no supplemental list.
+	Version    string    // From the "version" line, or the ETag or mtime if there isn't one.
+	ETag       string    // ETag of the last download, for URLs.
+	UserAgents int       // Number of User-Agent patterns.
+	Networks   int       // Number of IP networks.
+	LoadedAt   time.Time // When the current list was loaded.
+	CheckedAt  time.Time // Last time the source was checked for changes.
+	Error      string    // Error from the last check; the previous list is kept.
+}
+
+type botDataList struct {
+	ua      []*regexp.Regexp
+	ip      ipTrie
+	version string
+	nets    int
+}
+
+var (
+	botData       atomic.Pointer[botDataList]
+	botDataMu     sync.Mutex
+	botDataStatus BotDataStatus
+	botDataMtime  time.Time
+	botDataClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// Maximum size of the supplemental bot list.
+const botDataMaxSize = 8 << 20
+
+// InitBotData sets the file or http(s) URL to load a supplemental bot list
+// from, in addition to the detection built in to GoatCounter.
+//
+// The list has one entry per line; blank lines and lines starting with # are
+// ignored:
+//
+//	version 2026-10-16        Version to show on the server management page.
+//	ua      ^acme-crawler/    Regular expression for the User-Agent header.
+//	ip      192.0.2.0/24      IP address or network in CIDR notation.
+//
+// The built-in detection takes precedence; this only flags pageviews that
+// aren't already detected as a bot, and never clears a detected bot.
+//
+// Only the built-in detection is used if src is an empty string.
+func InitBotData(ctx context.Context, src string) error {
+	botDataMu.Lock()
+	defer botDataMu.Unlock()
+	botDataStatus, botDataMtime = BotDataStatus{Source: src}, time.Time{}
+	botData.Store(nil)
+
+	if src == "" {
+		return nil
+	}
+	_, err := loadBotData(ctx)
+	return err
+}
+
+// ReloadBotData reloads the list set with InitBotData() if it was modified
+// since it was loaded. It does nothing if there is no such list.
+//
+// The previous list is kept if the new one can't be loaded or has any invalid
+// entries.
+func ReloadBotData(ctx context.Context) (bool, error) {
+	botDataMu.Lock()
+	defer botDataMu.Unlock()
+	if botDataStatus.Source == "" {
+		return false, nil
+	}
+	return loadBotData(ctx)
+}
+
+// BotDataInfo gets the status of the supplemental bot list.
+func BotDataInfo() BotDataStatus {
+	botDataMu.Lock()
+	defer botDataMu.Unlock()
+	return botDataStatus
+}
+
+// IsSupplementBot reports if the User-Agent header or IP address matches the
+// supplemental bot list; the address may include a port.
+func IsSupplementBot(ua, ip string) bool {
+	l := botData.Load()
+	if l == nil {
+		return false
+	}
+
+	if ip != "" {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			if ap, err := netip.ParseAddrPort(ip); err == nil {
+				addr = ap.Addr()
+			}
+		}
+		if addr.IsValid() && l.ip.contains(addr.Unmap()) {
+			return true
+		}
+	}
+	if ua != "" {
+		for _, re := range l.ua {
+			if re.MatchString(ua) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func loadBotData(ctx context.Context) (bool, error) {
+	botDataStatus.CheckedAt = ztime.Now()
+	reloaded, err := func() (bool, error) {
+		var (
+			data  []byte
+			etag  string
+			mtime time.Time
+			err   error
+		)
+		if strings.HasPrefix(botDataStatus.Source, "http://") || strings.HasPrefix(botDataStatus.Source, "https://") {
+			data, etag, err = fetchBotData(ctx)
+		} else {
+			data, mtime, err = readBotData()
+		}
+		if err != nil || data == nil {
+			return false, err
+		}
+
+		l, err := parseBotData(data)
+		if err != nil {
+			return false, err
+		}
+		if l.version == "" {
+			l.version = etag
+			if !mtime.IsZero() {
+				l.version = mtime.UTC().Format(time.RFC3339)
+			}
+		}
+
+		// Only set these once it's loaded, so that an invalid list is retried
+		// rather than being seen as not modified.
+		botDataStatus.ETag, botDataMtime = etag, mtime
+		botData.Store(l)
+		botDataStatus.Version, botDataStatus.LoadedAt = l.version, ztime.Now()
+		botDataStatus.UserAgents, botDataStatus.Networks = len(l.ua), l.nets
+		return true, nil
+	}()
+	if err != nil {
+		err = errors.Wrapf(err, "loadBotData: %s", botDataStatus.Source)
+		botDataStatus.Error = err.Error()
+		return false, err
+	}
+	botDataStatus.Error = ""
+	return reloaded, nil
+}
+
+// Read the file; returns nil if it wasn't modified.
+func readBotData() ([]byte, time.Time, error) {
+	st, err := os.Stat(botDataStatus.Source)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if st.ModTime().Equal(botDataMtime) {
+		return nil, time.Time{}, nil
+	}
+	if st.Size() > botDataMaxSize {
+		return nil, time.Time{}, fmt.Errorf("larger than %d bytes", botDataMaxSize)
+	}
+
+	data, err := os.ReadFile(botDataStatus.Source)
+	return data, st.ModTime(), err
+}
+
+// Download the list; returns nil if it wasn't modified.
+func fetchBotData(ctx context.Context) ([]byte, string, error) {
+	r, err := http.NewRequestWithContext(ctx, "GET", botDataStatus.Source, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	r.Header.Set("User-Agent", "GoatCounter/"+Version+" (+https://www.goatcounter.com)")
+	if botDataStatus.ETag != "" && botData.Load() != nil {
+		r.Header.Set("If-None-Match", botDataStatus.ETag)
+	}
+
+	resp, err := botDataClient.Do(r)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, "", nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("%s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, botDataMaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > botDataMaxSize {
+		return nil, "", fmt.Errorf("larger than %d bytes", botDataMaxSize)
+	}
+
+	return data, resp.Header.Get("ETag"), nil
+}
+
+func parseBotData(data []byte) (*botDataList, error) {
+	var (
+		l    = new(botDataList)
+		scan = bufio.NewScanner(bytes.NewReader(data))
+		n    int
+	)
+	for scan.Scan() {
+		n++
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		kind, v := line, ""
+		if i := strings.IndexAny(line, " \t"); i > -1 {
+			kind, v = line[:i], strings.TrimSpace(line[i:])
+		}
+		if v == "" {
+			return nil, fmt.Errorf("line %d: no value for %q", n, kind)
+		}
+		switch kind {
+		case "version":
+			l.version = v
+		case "ua":
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			for _, b := range uaBlockBrowsers {
+				if re.MatchString(b) {
+					return nil, fmt.Errorf("line %d: %q matches regular browsers such as %q", n, v, b)
+				}
+			}
+			l.ua = append(l.ua, re)
+		case "ip":
+			p, err := parseIPBlock(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			l.ip.insert(p)
+			l.nets++
+		default:
+			return nil, fmt.Errorf("line %d: unknown type %q; must be version, ua, or ip", n, kind)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.ua) == 0 && l.nets == 0 {
+		return nil, errors.New("no entries")
+	}
+	return l, nil
+}
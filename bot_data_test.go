@@ -0,0 +1,175 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBotDataFile(t *testing.T) {
+	t.Cleanup(func() { InitBotData(context.Background(), "") })
+	ctx := context.Background()
+
+	tmp := filepath.Join(t.TempDir(), "botdata")
+	err := os.WriteFile(tmp, []byte("# Comment\n\nversion 1\nua\t^acme-crawler/\nip  192.0.2.0/24\nip 2001:db8::1\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = InitBotData(ctx, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ua, ip string
+		want   bool
+	}{
+		{"acme-crawler/1.0", "", true},
+		{"", "192.0.2.42", true},
+		{"", "192.0.2.42:1234", true},
+		{"", "[2001:db8::1]:1234", true},
+		{"", "::ffff:192.0.2.1", true},
+
+		{"Mozilla/5.0 acme-crawler/1.0", "", false},
+		{"", "192.0.3.1", false},
+		{"", "2001:db8::2", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ua+tt.ip, func(t *testing.T) {
+			if have := IsSupplementBot(tt.ua, tt.ip); have != tt.want {
+				t.Errorf("\nhave: %t\nwant: %t", have, tt.want)
+			}
+		})
+	}
+
+	st := BotDataInfo()
+	if st.Version != "1" || st.UserAgents != 1 || st.Networks != 2 || st.Error != "" {
+		t.Errorf("%#v", st)
+	}
+
+	reloaded, err := ReloadBotData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded {
+		t.Error("reloaded while the file didn't change")
+	}
+
+	// Invalid entry: keep the previous list.
+	err = os.WriteFile(tmp, []byte("version 2\nua acme\nua (unclosed\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(tmp, time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err = ReloadBotData(ctx)
+	if err == nil || !strings.Contains(err.Error(), "line 3") || reloaded {
+		t.Fatalf("reloaded=%t; err=%v", reloaded, err)
+	}
+	if !IsSupplementBot("acme-crawler/1.0", "") || IsSupplementBot("acme", "") {
+		t.Error("previous list not kept")
+	}
+	if st := BotDataInfo(); st.Version != "1" || st.Error == "" {
+		t.Errorf("%#v", st)
+	}
+}
+
+func TestBotDataURL(t *testing.T) {
+	t.Cleanup(func() { InitBotData(context.Background(), "") })
+	ctx := context.Background()
+
+	var (
+		body     = "ua ^acme-crawler/\n"
+		etag     = `"v1"`
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	err := InitBotData(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSupplementBot("acme-crawler/1.0", "") {
+		t.Error("not loaded")
+	}
+	if st := BotDataInfo(); st.Version != `"v1"` || st.ETag != `"v1"` {
+		t.Errorf("%#v", st)
+	}
+
+	reloaded, err := ReloadBotData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded || requests != 2 {
+		t.Errorf("reloaded=%t; requests=%d", reloaded, requests)
+	}
+
+	// Matches regular browsers: reject.
+	body, etag = "version 2\nua Mozilla\n", `"v2"`
+	reloaded, err = ReloadBotData(ctx)
+	if err == nil || !strings.Contains(err.Error(), "regular browsers") || reloaded {
+		t.Fatalf("reloaded=%t; err=%v", reloaded, err)
+	}
+	if !IsSupplementBot("acme-crawler/1.0", "") {
+		t.Error("previous list not kept")
+	}
+
+	body, etag = "version 3\nua ^other-crawler/\n", `"v3"`
+	reloaded, err = ReloadBotData(ctx)
+	if err != nil || !reloaded {
+		t.Fatalf("reloaded=%t; err=%v", reloaded, err)
+	}
+	if IsSupplementBot("acme-crawler/1.0", "") || !IsSupplementBot("other-crawler/1.0", "") {
+		t.Error("new list not loaded")
+	}
+	if st := BotDataInfo(); st.Version != "3" || st.ETag != `"v3"` || st.Error != "" {
+		t.Errorf("%#v", st)
+	}
+}
+
+func TestParseBotData(t *testing.T) {
+	tests := []struct {
+		in, wantErr string
+	}{
+		{"ua ^x/\nip 192.0.2.0/24", ""},
+		{"", "no entries"},
+		{"# only a comment\nversion 1", "no entries"},
+		{"ua", `line 1: no value for "ua"`},
+		{"ua ^x/\nfoo bar", `line 2: unknown type "foo"`},
+		{"ip 192.0.2.1/24", "has host bits set"},
+		{"ip example.com", "not a valid IP address"},
+		{"ua Firefox", "matches regular browsers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := parseBotData([]byte(tt.in))
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("wrong error: %v", err)
+			}
+		})
+	}
+}
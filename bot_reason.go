@@ -0,0 +1,85 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"fmt"
+	"slices"
+
+	"zgo.at/isbot"
+)
+
+// BotIgnoreIP is the code for pageviews from an address in the site's IP
+// ignore list. These are never stored, so this code is only used in BotReason.
+const BotIgnoreIP = 103
+
+// BotReason is how a pageview is classified, and why.
+type BotReason struct {
+	Bot     int    `json:"bot"`             // Bot code; 0 if this is a regular pageview.
+	Name    string `json:"name"`            // Readable name for the bot code; empty if this is a regular pageview.
+	Client  bool   `json:"client"`          // Detected in the browser by count.js, rather than on the server.
+	Counted bool   `json:"counted"`         // Counted as a regular pageview.
+	Stored  bool   `json:"stored"`          // Stored at all; ignored pageviews don't show up in the bot stats either.
+	Reason  string `json:"reason"`          // Human-readable explanation.
+	Rule    string `json:"rule,omitempty"`  // Pattern in the User-Agent blocklist this matched.
+	Label   string `json:"label,omitempty"` // Label of the rule in the bot allowlist this matched.
+}
+
+// String gets the reason with the bot code, for the X-Goatcounter header.
+func (b BotReason) String() string {
+	if b.Bot == 0 {
+		return b.Reason
+	}
+	return fmt.Sprintf("%s (b=%d)", b.Reason, b.Bot)
+}
+
+// ClassifyBot classifies a pageview for this site.
+//
+// The detected bot is what isbot detected from the request, and client is the
+// bot code count.js sent, if any. In order, the pageview is:
+//
+//   - ignored if it's a prefetch or the address is in IgnoreIPs;
+//   - a bot if it's in the IPBlock or UABlock;
+//   - a regular pageview with a label if it's in BotAllow;
+//   - a bot if it was detected by isbot, IsSupplementBot(), or count.js;
+//   - a regular pageview otherwise.
+func (s Site) ClassifyBot(ua, ip string, detected isbot.Result, client int) BotReason {
+	bot := func(code int, reason string, args ...any) BotReason {
+		return BotReason{Bot: code, Name: BotName(code), Client: IsClientBot(code), Stored: true,
+			Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	switch {
+	case detected == isbot.BotPrefetch:
+		b := bot(int(detected), "ignored because it was fetched with the browser’s prefetch algorithm")
+		b.Stored = false
+		return b
+	case ip != "" && slices.Contains(s.Settings.IgnoreIPs, ip):
+		b := bot(BotIgnoreIP, "ignored because %q is in the IP ignore list", ip)
+		b.Stored = false
+		return b
+	case s.Settings.IPBlock.Contains(ip):
+		return bot(BotIPBlock, "flagged as bot because %q is in the IP blocklist", ip)
+	}
+	if rule, ok := s.Settings.UABlock.Match(ua); ok {
+		b := bot(BotUABlock, "flagged as bot because the User-Agent matches %q in the User-Agent blocklist", rule)
+		b.Rule = rule
+		return b
+	}
+	if label, ok := s.Settings.BotAllow.Match(ua, ip); ok {
+		return BotReason{Counted: true, Stored: true, Label: label,
+			Reason: fmt.Sprintf("counted as a regular pageview because it matches %q in the bot allowlist", label)}
+	}
+
+	switch {
+	case isbot.Is(detected):
+		return bot(int(detected), "flagged as bot by the User-Agent or headers: %s", BotName(int(detected)))
+	case IsSupplementBot(ua, ip):
+		return bot(BotSupplement, "flagged as bot because it matches the supplemental bot list")
+	case IsClientBot(client):
+		return bot(client, "flagged as bot by count.js: %s", BotName(client))
+	}
+	return BotReason{Counted: true, Stored: true, Reason: "counted as a regular pageview"}
+}
@@ -0,0 +1,198 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// How long to keep the bot stats for; see SiteSettings.BotRetention.
+const (
+	BotRetentionDefault = 30
+	BotRetentionMax     = 365
+)
+
+// Bot codes count.js sends in the "b" parameter, for signals that can only be
+// detected in the browser. These are in the range isbot reserves for
+// client-side detection (BotClientMin to BotClientMax); anything else is
+// rejected.
+const (
+	BotClientPhantom   = 150 // PhantomJS globals.
+	BotClientNightmare = 151 // Nightmare globals.
+	BotClientSelenium  = 152 // Selenium globals on the document.
+	BotClientWebDriver = 153 // navigator.webdriver is set.
+	BotClientPuppeteer = 154 // Puppeteer, Playwright, or ChromeDriver globals.
+	BotClientHeadless  = 155 // No plugins or languages while a regular browser would have them.
+	BotClientPrerender = 156 // Page is prerendered and not yet visible; see Hit.Prerender.
+
+	BotClientMin = 150
+	BotClientMax = 199
+)
+
+// IsClientBot reports if this is a bot code detected by count.js, rather than
+// on the server.
+func IsClientBot(bot int) bool { return bot >= BotClientMin && bot <= BotClientMax }
+
+// Names for the bot codes stored in Hit.Bot; most of these are from isbot.
+var botNames = map[int]string{
+	2:                  "Prefetch",
+	3:                  "Link in User-Agent",
+	4:                  "Client library",
+	5:                  "Known bot",
+	6:                  "User-Agent looks like a bot",
+	7:                  "Short User-Agent",
+	BotUABlock:         "User-Agent blocklist",
+	BotIPBlock:         "IP blocklist",
+	BotSupplement:      "Supplemental bot list",
+	BotIgnoreIP:        "IP ignore list",
+	BotClientPhantom:   "PhantomJS",
+	BotClientNightmare: "Nightmare",
+	BotClientSelenium:  "Selenium",
+	BotClientWebDriver: "WebDriver",
+	BotClientPuppeteer: "Puppeteer or Playwright",
+	BotClientHeadless:  "Headless browser",
+	BotClientPrerender: "Prerendered, never shown",
+}
+
+// BotName gets a readable name for the bot code.
+func BotName(bot int) string {
+	if n, ok := botNames[bot]; ok {
+		return n
+	}
+	return fmt.Sprintf("Other (%d)", bot)
+}
+
+type (
+	// BotStats are the pageviews that were flagged as a bot. These are never
+	// included in any of the other stats.
+	BotStats struct {
+		Total int           `json:"total"` // Total number of pageviews from bots.
+		Days  []BotStatDay  `json:"days"`  // Pageviews per day; days without any pageviews are omitted.
+		Bots  []BotStatBot  `json:"bots"`  // Pageviews per bot code, most pageviews first.
+		Paths []BotStatPath `json:"paths"` // Most requested paths.
+
+		// Most common User-Agent headers; this is always empty if the site
+		// doesn't collect the User-Agent.
+		UserAgents []BotStatUA `json:"user_agents"`
+	}
+
+	// BotStatDay are the bot pageviews for a single day.
+	BotStatDay struct {
+		Day   string       `json:"day"`   // Day these statistics are for {date}.
+		Count int          `json:"count"` // Total number of pageviews.
+		Bots  []BotStatBot `json:"bots"`  // Pageviews per bot code.
+	}
+
+	// BotStatBot is the number of pageviews for a bot code.
+	BotStatBot struct {
+		Bot    int    `db:"bot" json:"bot"`     // Bot code; see the "bot" field when counting pageviews.
+		Name   string `db:"-" json:"name"`      // Readable name.
+		Client bool   `db:"-" json:"client"`    // Detected in the browser by count.js, rather than on the server.
+		Count  int    `db:"count" json:"count"` // Number of pageviews.
+	}
+
+	// BotStatPath is the number of bot pageviews for a path.
+	BotStatPath struct {
+		PathID int64  `db:"path_id" json:"path_id"` // Path ID.
+		Path   string `db:"path" json:"path"`       // Path name.
+		Count  int    `db:"count" json:"count"`     // Number of pageviews.
+	}
+
+	// BotStatUA is the number of bot pageviews for a User-Agent header.
+	BotStatUA struct {
+		UserAgent string `db:"user_agent" json:"user_agent"` // User-Agent header.
+		Bot       int    `db:"bot" json:"bot"`               // Bot code.
+		Name      string `db:"-" json:"name"`                // Readable name for the bot code.
+		Count     int    `db:"count" json:"count"`           // Number of pageviews.
+	}
+)
+
+func newBotStatBot(bot, count int) BotStatBot {
+	return BotStatBot{Bot: bot, Name: BotName(bot), Client: IsClientBot(bot), Count: count}
+}
+
+// List the bot stats in the range, with at most limit paths and User-Agents.
+func (s *BotStats) List(ctx context.Context, rng ztime.Range, limit int) error {
+	site := MustGetSite(ctx)
+	args := map[string]any{
+		"site":  site.ID,
+		"start": rng.Start.Format("2006-01-02"),
+		"end":   rng.End.Format("2006-01-02"),
+		"limit": limit,
+	}
+
+	var days []struct {
+		Day   time.Time `db:"day"`
+		Bot   int       `db:"bot"`
+		Count int       `db:"count"`
+	}
+	err := zdb.Select(ctx, &days, `/* BotStats.List */
+		select day, bot, sum(count) as count from bot_stats
+		where site_id = :site and day >= :start and day <= :end
+		group by day, bot
+		order by day asc, bot asc`, args)
+	if err != nil {
+		return errors.Wrap(err, "BotStats.List")
+	}
+
+	st := BotStats{Days: []BotStatDay{}, Bots: []BotStatBot{}, Paths: []BotStatPath{}, UserAgents: []BotStatUA{}}
+	totals := make(map[int]int)
+	for _, d := range days {
+		day := d.Day.Format("2006-01-02")
+		if len(st.Days) == 0 || st.Days[len(st.Days)-1].Day != day {
+			st.Days = append(st.Days, BotStatDay{Day: day})
+		}
+		last := &st.Days[len(st.Days)-1]
+		last.Count += d.Count
+		last.Bots = append(last.Bots, newBotStatBot(d.Bot, d.Count))
+		totals[d.Bot] += d.Count
+		st.Total += d.Count
+	}
+	for bot, n := range totals {
+		st.Bots = append(st.Bots, newBotStatBot(bot, n))
+	}
+	slices.SortFunc(st.Bots, func(a, b BotStatBot) int {
+		if a.Count == b.Count {
+			return a.Bot - b.Bot
+		}
+		return b.Count - a.Count
+	})
+
+	err = zdb.Select(ctx, &st.Paths, `/* BotStats.List */
+		select bot_stats.path_id, paths.path, sum(count) as count from bot_stats
+		join paths using (path_id)
+		where bot_stats.site_id = :site and day >= :start and day <= :end
+		group by bot_stats.path_id, paths.path
+		order by count desc, paths.path asc
+		limit :limit`, args)
+	if err != nil {
+		return errors.Wrap(err, "BotStats.List")
+	}
+
+	if site.Settings.Collect.Has(CollectUserAgent) {
+		err = zdb.Select(ctx, &st.UserAgents, `/* BotStats.List */
+			select user_agent, bot, sum(count) as count from bot_ua_stats
+			where site_id = :site and day >= :start and day <= :end
+			group by user_agent, bot
+			order by count desc, user_agent asc
+			limit :limit`, args)
+		if err != nil {
+			return errors.Wrap(err, "BotStats.List")
+		}
+		for i := range st.UserAgents {
+			st.UserAgents[i].Name = BotName(st.UserAgents[i].Bot)
+		}
+	}
+
+	*s = st
+	return nil
+}
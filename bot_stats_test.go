@@ -0,0 +1,78 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestBotStatsList(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2026-10-16 12:00:00")
+
+	now := ztime.Now()
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/a", CreatedAt: now, Bot: 5, UserAgentHeader: "Googlebot/2.1"},
+		Hit{Path: "/a", CreatedAt: now, Bot: 5, UserAgentHeader: "Googlebot/2.1"},
+		Hit{Path: "/b", CreatedAt: now, Bot: BotUABlock, UserAgentHeader: "SyntheticMonitor/1.0"},
+		Hit{Path: "/b", CreatedAt: now.AddDate(0, 0, -1), Bot: 150, UserAgentHeader: "PhantomJS/2.1"},
+		Hit{Path: "/c", CreatedAt: now},
+	)
+
+	rng := ztime.NewRange(now.AddDate(0, 0, -7)).To(now)
+	var stats BotStats
+	err := stats.List(ctx, rng, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{
+		"total": 4,
+		"days": [
+			{"day": "2026-10-15", "count": 1, "bots": [{"bot": 150, "name": "PhantomJS", "count": 1}]},
+			{"day": "2026-10-16", "count": 3, "bots": [
+				{"bot": 5, "name": "Known bot", "count": 2},
+				{"bot": 100, "name": "User-Agent blocklist", "count": 1}]}
+		],
+		"bots": [
+			{"bot": 5, "name": "Known bot", "count": 2},
+			{"bot": 100, "name": "User-Agent blocklist", "count": 1},
+			{"bot": 150, "name": "PhantomJS", "count": 1}
+		],
+		"paths": [
+			{"path_id": 1, "path": "/a", "count": 2},
+			{"path_id": 2, "path": "/b", "count": 2}
+		],
+		"user_agents": [
+			{"user_agent": "Googlebot/2.1", "bot": 5, "name": "Known bot", "count": 2},
+			{"user_agent": "PhantomJS/2.1", "bot": 150, "name": "PhantomJS", "count": 1},
+			{"user_agent": "SyntheticMonitor/1.0", "bot": 100, "name": "User-Agent blocklist", "count": 1}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(stats), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+
+	// Only the classification if the site doesn't collect the User-Agent.
+	site := MustGetSite(ctx)
+	site.Settings.Collect.Clear(CollectUserAgent)
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stats.List(ctx, rng, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 4 || len(stats.Bots) != 3 || len(stats.Paths) != 1 || len(stats.UserAgents) != 0 {
+		t.Errorf("%#v", stats)
+	}
+}
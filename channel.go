@@ -0,0 +1,283 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/z18n"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Traffic source channels.
+const (
+	ChannelSearch   = "search"
+	ChannelSocial   = "social"
+	ChannelCampaign = "campaign"
+	ChannelReferral = "referral"
+	ChannelDirect   = "direct"
+)
+
+// Channels are all channels, in the order they're displayed.
+var Channels = []string{ChannelSearch, ChannelSocial, ChannelCampaign, ChannelReferral, ChannelDirect}
+
+// Built-in list of referrers for the search and social channels.
+//
+// Keys are either a domain, which also matches all subdomains, or the
+// (lower-case) name of a generated or "other" referrer such as "google" or
+// "com.facebook.katana".
+var channels = map[string]string{
+	"google":                        ChannelSearch, // Grouped google.com, google.nl, etc.
+	"google.com":                    ChannelSearch,
+	"yahoo":                         ChannelSearch, // Grouped search.yahoo.com
+	"search.yahoo.com":              ChannelSearch,
+	"baidu":                         ChannelSearch,
+	"bing.com":                      ChannelSearch,
+	"duckduckgo.com":                ChannelSearch,
+	"ecosia.org":                    ChannelSearch,
+	"kagi.com":                      ChannelSearch,
+	"qwant.com":                     ChannelSearch,
+	"search.brave.com":              ChannelSearch,
+	"startpage.com":                 ChannelSearch,
+	"yandex.com":                    ChannelSearch,
+	"yandex.ru":                     ChannelSearch,
+	"com.microsoft.bing":            ChannelSearch,
+	"com.duckduckgo.mobile.android": ChannelSearch,
+
+	"hacker news":                  ChannelSocial, // Grouped news.ycombinator.com, hn.algolia.com, etc.
+	"news.ycombinator.com":         ChannelSocial,
+	"twitter.com":                  ChannelSocial,
+	"x.com":                        ChannelSocial,
+	"t.co":                         ChannelSocial,
+	"facebook.com":                 ChannelSocial,
+	"facebook":                     ChannelSocial,
+	"facebook messenger":           ChannelSocial,
+	"com.facebook.katana":          ChannelSocial,
+	"reddit.com":                   ChannelSocial,
+	"com.andrewshu.android.reddit": ChannelSocial,
+	"linkedin.com":                 ChannelSocial,
+	"linkedin":                     ChannelSocial,
+	"lnkd.in":                      ChannelSocial,
+	"instagram.com":                ChannelSocial,
+	"threads.net":                  ChannelSocial,
+	"bsky.app":                     ChannelSocial,
+	"mastodon.social":              ChannelSocial,
+	"lobste.rs":                    ChannelSocial,
+	"youtube.com":                  ChannelSocial,
+	"pinterest.com":                ChannelSocial,
+	"tiktok.com":                   ChannelSocial,
+	"vk.com":                       ChannelSocial,
+	"weibo.com":                    ChannelSocial,
+}
+
+var (
+	channelList  atomic.Pointer[map[string]string]
+	channelMu    sync.Mutex
+	channelPath  string
+	channelMtime time.Time
+)
+
+// RefChannel gets the traffic source channel for a referrer:
+//
+//   - campaigns are ChannelCampaign;
+//   - no referrer (shown as "(unknown)" in the referrers) is ChannelDirect;
+//   - referrers on the channel list are ChannelSearch or ChannelSocial;
+//   - everything else is ChannelReferral.
+func RefChannel(ref string, scheme *string) string {
+	if scheme != nil && *scheme == *RefSchemeCampaign {
+		return ChannelCampaign
+	}
+	if ref == "" {
+		return ChannelDirect
+	}
+
+	list := channelList.Load()
+	if list == nil {
+		list = &channels
+	}
+
+	ref = strings.ToLower(ref)
+	if !isURLRef(scheme) {
+		if c, ok := (*list)[ref]; ok {
+			return c
+		}
+		return ChannelReferral
+	}
+
+	host, _, _ := strings.Cut(ref, "/")
+	for host != "" {
+		if c, ok := (*list)[host]; ok {
+			return c
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return ChannelReferral
+}
+
+// ChannelName gets the translated name for a channel.
+func ChannelName(ctx context.Context, c string) string {
+	switch c {
+	case ChannelSearch:
+		return z18n.T(ctx, "label/channel-search|Search")
+	case ChannelSocial:
+		return z18n.T(ctx, "label/channel-social|Social")
+	case ChannelCampaign:
+		return z18n.T(ctx, "label/channel-campaign|Campaign")
+	case ChannelReferral:
+		return z18n.T(ctx, "label/channel-referral|Referral")
+	case ChannelDirect:
+		return z18n.T(ctx, "label/channel-direct|Direct")
+	}
+	return ""
+}
+
+// InitChannels sets the path to a file with extra referrers for the search
+// and social channels, in addition to the built-in list.
+//
+// The file has one "domain => channel" per line, where the channel is
+// "search", "social", or "referral" (to override the built-in list); blank
+// lines and lines starting with # are ignored. Subdomains of a listed domain
+// are also matched.
+//
+// Only the built-in list is used if path is an empty string.
+func InitChannels(path string) error {
+	channelMu.Lock()
+	defer channelMu.Unlock()
+	channelPath, channelMtime = path, time.Time{}
+	channelList.Store(nil)
+
+	if path == "" {
+		return nil
+	}
+	_, err := loadChannels()
+	return err
+}
+
+// ReloadChannels reloads the file set with InitChannels() if it was modified
+// since it was loaded. It does nothing if there is no such file.
+func ReloadChannels() (bool, error) {
+	channelMu.Lock()
+	defer channelMu.Unlock()
+	if channelPath == "" {
+		return false, nil
+	}
+	return loadChannels()
+}
+
+func loadChannels() (bool, error) {
+	st, err := os.Stat(channelPath)
+	if err != nil {
+		return false, errors.Wrap(err, "loadChannels")
+	}
+	if st.ModTime().Equal(channelMtime) {
+		return false, nil
+	}
+
+	fp, err := os.ReadFile(channelPath)
+	if err != nil {
+		return false, errors.Wrap(err, "loadChannels")
+	}
+
+	list := maps.Clone(channels)
+	scan := bufio.NewScanner(bytes.NewReader(fp))
+	for scan.Scan() {
+		l := strings.ToLower(strings.TrimSpace(scan.Text()))
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		d, c, ok := strings.Cut(l, "=>")
+		d, c = strings.TrimSpace(d), strings.TrimSpace(c)
+		if !ok || d == "" || !slices.Contains([]string{ChannelSearch, ChannelSocial, ChannelReferral}, c) {
+			return false, fmt.Errorf("loadChannels: %s: %q: must be as \"domain => channel\", where channel is search, social, or referral",
+				channelPath, scan.Text())
+		}
+		list[d] = c
+	}
+	if err := scan.Err(); err != nil {
+		return false, errors.Wrapf(err, "loadChannels: %s", channelPath)
+	}
+
+	channelList.Store(&list)
+	channelMtime = st.ModTime()
+	return true, nil
+}
+
+// listChannelRefs lists the visitors for all referrers with their channel.
+//
+// This uses the same data and filters as ListTopRefs with hideSpam, so the
+// totals are always the same.
+func listChannelRefs(ctx context.Context, rng ztime.Range, pathFilter []int64) ([]HitStat, []string, error) {
+	site := MustGetSite(ctx)
+	var refs []HitStat
+	err := zdb.Select(ctx, &refs, "load:ref.ListChannels", map[string]any{
+		"site":       site.ID,
+		"start":      rng.Start,
+		"end":        rng.End,
+		"filter":     pathFilter,
+		"ref":        site.LinkDomainURL(false) + "%",
+		"has_domain": site.LinkDomain != "",
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := make([]string, 0, len(refs))
+	for _, r := range refs {
+		ch = append(ch, RefChannel(r.Name, r.RefScheme))
+	}
+	return refs, ch, nil
+}
+
+// ListChannels lists the visitor count for every channel.
+//
+// This always returns all channels, in the order of Channels.
+func (h *HitStats) ListChannels(ctx context.Context, rng ztime.Range, pathFilter []int64) error {
+	refs, ch, err := listChannelRefs(ctx, rng, pathFilter)
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListChannels")
+	}
+
+	h.Stats = make([]HitStat, 0, len(Channels))
+	for _, c := range Channels {
+		h.Stats = append(h.Stats, HitStat{ID: c, Name: ChannelName(ctx, c)})
+	}
+	for i, r := range refs {
+		h.Stats[slices.Index(Channels, ch[i])].Count += r.Count
+	}
+	return nil
+}
+
+// ListChannel lists all referrers for one channel.
+func (h *HitStats) ListChannel(ctx context.Context, channel string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	if !slices.Contains(Channels, channel) {
+		return errors.Errorf("HitStats.ListChannel: invalid value for channel: %#v", channel)
+	}
+
+	refs, ch, err := listChannelRefs(ctx, rng, pathFilter)
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListChannel")
+	}
+
+	stats := make([]HitStat, 0, len(refs))
+	for i, r := range refs {
+		if ch[i] == channel {
+			stats = append(stats, r)
+		}
+	}
+	h.paginate(stats, limit, offset)
+	return nil
+}
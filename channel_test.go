@@ -0,0 +1,170 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestRefChannel(t *testing.T) {
+	tests := []struct {
+		ref    string
+		scheme *string
+		want   string
+	}{
+		// No referrer is shown as "(unknown)" in the referrers.
+		{"", nil, ChannelDirect},
+		{"", RefSchemeHTTP, ChannelDirect},
+
+		{"Google", RefSchemeGenerated, ChannelSearch},
+		{"Hacker News", RefSchemeGenerated, ChannelSocial},
+		{"Email", RefSchemeGenerated, ChannelReferral},
+		{"duckduckgo.com", RefSchemeHTTP, ChannelSearch},
+		{"www.bing.com/search", RefSchemeHTTP, ChannelSearch},
+		{"www.reddit.com/r/golang", RefSchemeHTTP, ChannelSocial},
+		{"notreddit.com/r/golang", RefSchemeHTTP, ChannelReferral},
+		{"com.facebook.katana", RefSchemeOther, ChannelSocial},
+		{"example.com/page", RefSchemeHTTP, ChannelReferral},
+		{"spam.example.com", RefSchemeSpam, ChannelReferral},
+		{"newsletter", RefSchemeCampaign, ChannelCampaign},
+		{"www.google.com", RefSchemeCampaign, ChannelCampaign},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			have := RefChannel(tt.ref, tt.scheme)
+			if have != tt.want {
+				t.Errorf("have %q; want %q", have, tt.want)
+			}
+		})
+	}
+
+	t.Run("file", func(t *testing.T) {
+		tmp := filepath.Join(t.TempDir(), "channels")
+		err := os.WriteFile(tmp, []byte("# Comment\nseznam.cz => search\n\nreddit.com  =>  referral\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = InitChannels(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer InitChannels("")
+
+		if c := RefChannel("search.seznam.cz/?q=x", RefSchemeHTTP); c != ChannelSearch {
+			t.Errorf("seznam.cz: %q", c)
+		}
+		if c := RefChannel("www.reddit.com/r/golang", RefSchemeHTTP); c != ChannelReferral {
+			t.Errorf("reddit.com: %q", c)
+		}
+		if c := RefChannel("duckduckgo.com", RefSchemeHTTP); c != ChannelSearch {
+			t.Errorf("duckduckgo.com: %q", c)
+		}
+
+		err = os.WriteFile(tmp, []byte("seznam.cz => searchengine\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = InitChannels(tmp)
+		if !ztest.ErrorContains(err, `"seznam.cz => searchengine": must be as "domain => channel"`) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestListChannels(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := ztime.Now()
+	gctest.StoreHits(ctx, t, false,
+		Hit{CreatedAt: now, FirstVisit: true, Ref: "https://www.google.com/search?q=x"},
+		Hit{CreatedAt: now, FirstVisit: true, Ref: "https://duckduckgo.com"},
+		Hit{CreatedAt: now, FirstVisit: true, Ref: "https://old.reddit.com/r/golang"},
+		Hit{CreatedAt: now, FirstVisit: true, Ref: "https://example.com/page"},
+		Hit{CreatedAt: now, FirstVisit: true, Ref: "https://example.com/page"},
+		Hit{CreatedAt: now, FirstVisit: false, Ref: "https://example.com/other"},
+		Hit{CreatedAt: now, FirstVisit: true, Query: "?utm_source=newsletter"},
+		Hit{CreatedAt: now, FirstVisit: true},
+		Hit{CreatedAt: now, FirstVisit: true},
+		Hit{CreatedAt: now, FirstVisit: true, Bot: 3},
+	)
+
+	rng := ztime.NewRange(now).To(now)
+	var have HitStats
+	err := have.ListChannels(ctx, rng, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+		"more": false,
+		"stats": [
+			{"count": 2, "id": "search",   "name": "Search"},
+			{"count": 1, "id": "social",   "name": "Social"},
+			{"count": 1, "id": "campaign", "name": "Campaign"},
+			{"count": 2, "id": "referral", "name": "Referral"},
+			{"count": 2, "id": "direct",   "name": "Direct"}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+
+	// Should be the same as the referrers widget.
+	var refs HitStats
+	err = refs.ListTopRefs(ctx, rng, nil, true, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var haveTotal, wantTotal int
+	for _, s := range have.Stats {
+		haveTotal += s.Count
+	}
+	for _, s := range refs.Stats {
+		wantTotal += s.Count
+	}
+	if haveTotal != wantTotal {
+		t.Errorf("total for channels is %d, but %d for referrers", haveTotal, wantTotal)
+	}
+
+	// "(unknown)" in the referrers is direct.
+	have = HitStats{}
+	err = have.ListChannel(ctx, ChannelDirect, rng, nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{
+		"more": false,
+		"stats": [
+			{"count": 2, "name": ""}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+
+	have = HitStats{}
+	err = have.ListChannel(ctx, ChannelReferral, rng, nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{
+		"more": false,
+		"stats": [
+			{"count": 2, "name": "example.com/page", "ref_scheme": "h"},
+			{"count": 0, "name": "example.com/other", "ref_scheme": "h"}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
@@ -6,7 +6,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
@@ -114,6 +116,19 @@ create and update commands:
                     top navigation
                     Can be as ID ("1") or vhost ("stats.example.com").
 
+        Only for "update":
+
+            -quota            Monthly pageview quota; 0 means no quota. The
+                              site's admins are emailed when 80% and 100% of
+                              the quota is used. The quota resets on the first
+                              of the month in the site's timezone.
+
+            -quota-action     What to do once the quota is used up:
+
+                                  count    Keep counting pageviews (default).
+                                  reject   Reject pageviews at /count with
+                                           429 Too Many Requests.
+
         Only or "create", as a convenience to create a new user:
 
             -user.email*      Your email address. Will be required to login.
@@ -121,7 +136,15 @@ create and update commands:
                               that will re-use the same users as the linked
                               site).
 
-            -user.password*   Password to log in; will be asked interactively if omitted.
+            -user.password*   Password to log in; will be asked interactively if
+                              omitted and stdin is a terminal.
+
+            -user.password-env
+                              Read the password from this environment variable
+                              instead.
+
+            -user.reset-link  Don't set a password, but print a link to set one.
+                              The link is valid for 7 days.
 
     Flags for "user":
 
@@ -131,14 +154,41 @@ create and update commands:
 
         -access*    Access to give this user:
 
-                        readonly    Can't change any settings.
-                        settings    Can change settings, except site/user
-                                    management.
-                        admin       Full access.
+                        readonly    Viewer; can't change any settings.
+                        settings    Editor; can change settings, except
+                                    site/user management.
+                        admin       Full access, except deleting the
+                                    account.
+                        owner       Full access.
                         superuser   Full access, including the "server
                                     management" page.
 
-        -password   Password; will be asked interactively if omitted.
+        -password   Password; will be asked interactively if omitted and stdin
+                    is a terminal.
+
+        Only for "create":
+
+            -password-env     Read the password from this environment variable
+                              instead.
+
+            -reset-link       Don't set a password, but print a link to set one.
+                              The link is valid for 7 days.
+
+    Flags for "create site" and "create user":
+
+        -if-not-exists  Don't error if there is already a site for -vhost, or a
+                        user with this -email for the site, but print it and
+                        exit with 0. Nothing is changed for existing sites and
+                        users.
+
+        -format         Output format for the created or existing site and
+                        user: "text" (default) or "json"; for example:
+
+                            {"created":true,"site_id":2,"code":"serve-...",
+                             "cname":"stats.example.com","user_id":2,
+                             "email":"martin@example.com"}
+
+                        "reset_link" is added if -reset-link is used.
 
     Flags for "apitoken":
 
@@ -154,6 +204,7 @@ create and update commands:
                         site_read    Reading site information.
                         site_create  Creating new sites.
                         site_update  Updating existing sites.
+                        purge        Permanently deleting pageviews.
 
 migrate command:
 
@@ -168,6 +219,17 @@ migrate command:
 
         -show       Only show the SQL it would execute, but don't run anything.
 
+        -plan       Show the pending migrations with their SQL, and if they're
+                    destructive (e.g. rewrite or remove data), but don't run
+                    anything. Shows all pending migrations if no migrations are
+                    given.
+
+        -confirm    Run migrations that are marked as destructive; without
+                    this it refuses to run them.
+
+        -status     Show the pending migrations and the progress of the
+                    backfills, but don't run anything.
+
     Positional arguments are names of the migration, either as just the name
     ("2020-01-05-2-x") or as the file path ("./db/migrate/2020-01-05-2-x.sql").
 
@@ -178,9 +240,18 @@ migrate command:
                     there are pending migrations, or 0 if there aren't.
         list        List all migrations; pending migrations are prefixed with
                     "pending: ". Always exits with 0.
+        backfill    Run the backfills of migrations to completion.
+
+    Some migrations change the schema and then fill in the data in the
+    background (a "backfill"), as this can take a long time on larger
+    instances. This is run in batches every minute by "goatcounter serve", and
+    everything works while it's still running, but data from before the
+    migration may be incomplete until it's done. Use "-status" to see the
+    progress, or "backfill" to run them now.
 
     Note: you can also use -automigrate flag for the serve command to run migrations
-    on startup.
+    on startup; this won't run destructive migrations unless
+    -automigrate-destructive is also given.
 
 newdb command:
 
@@ -236,6 +307,102 @@ query command:
         unknown-ua      List all User-Agent headers that do not have full
                         browser/system associated with them.
 
+partition-hits command:
+
+    Convert the hits table to a table partitioned by month, on PostgreSQL only.
+    The data retention will then drop entire months rather than deleting
+    pageviews, which is a lot faster for large tables, and queries for a
+    date range only need to read the months in that range.
+
+    This copies all pageviews to the new table and locks the hits table while
+    doing so, which can take a long time: stop "goatcounter serve" first, and
+    make sure there's enough disk space for a second copy of the hits table.
+
+    Partitions for the upcoming months are created by "goatcounter serve".
+
+backup command:
+
+    Make a consistent backup of the database, which is safe to do while
+    GoatCounter is running; don't copy the SQLite database file with cp, as
+    that may give a corrupted copy.
+
+    For SQLite this makes a copy with "vacuum into" and compresses it with gzip.
+    For PostgreSQL this runs pg_dump, which needs to be in PATH, and writes a
+    dump in the (compressed) custom format.
+
+    -o, -output  File to write the backup to. The metadata (GoatCounter
+                 version, schema version, and row counts) is written to
+                 <file>.json; restore needs both files.
+
+restore command:
+
+    Restore a backup made with the backup command to the database in -db. The
+    backup must be for the same database engine, and can't be from a newer
+    GoatCounter version. Run "goatcounter db migrate all" afterwards if it's
+    from an older version.
+
+    For PostgreSQL this runs pg_restore, which needs to be in PATH. The
+    database must exist.
+
+    -i, -input   Backup file to restore.
+
+    -force       Overwrite the database if it already exists and isn't empty.
+
+copy command:
+
+    Copy everything from one database to a new database, including all
+    settings, users, API tokens, and sessions. This can be used to move from
+    SQLite to PostgreSQL, or back. The -db flag is ignored.
+
+    The source database needs to be at the same version as this GoatCounter;
+    run "goatcounter db migrate all" first if it isn't. Stop "goatcounter serve"
+    while copying, as pageviews stored in the meanwhile won't be copied.
+
+    -from        Database to copy from, in the same format as -db.
+
+    -to          Database to copy to, in the same format as -db. This is
+                 created if it doesn't exist yet. It's an error if it already
+                 has any sites.
+
+    For example:
+
+        $ goatcounter db copy -from sqlite+db/goatcounter.sqlite3 \
+            -to 'postgresql+dbname=goatcounter'
+
+dump-site command:
+
+    Dump a single site with all its data to a file, which can be loaded in
+    another GoatCounter with load-site. This includes the site settings,
+    pageviews, paths, and statistics, as well as the users and API tokens of
+    the site's account (including the dashboard settings). It doesn't include
+    custom domains, sessions, passkeys, invites, exports, or the audit log.
+
+    -site        Site to dump, as the ID, code, or vhost.
+
+    -o, -output  File to write the dump to. This is gzip'd JSON.
+
+load-site command:
+
+    Load a site from a file made with dump-site. The site gets new IDs for
+    everything, and is added as a new account. The database needs to be at the
+    same version as the database the dump was made from; run "goatcounter db
+    migrate all" on both first if it isn't.
+
+    It's an error if a site with the same code or vhost already exists; use
+    -code and -cname to load it under a different name.
+
+    -i, -input   File to load.
+
+    -code        Code for the site; the default is the code from the dump.
+
+    -cname       Vhost for the site; the default is the vhost from the dump.
+                 Use -cname= to not set a vhost.
+
+    For example:
+
+        $ goatcounter db dump-site -db sqlite+old.sqlite3 -site stats.example.com -o site.gz
+        $ goatcounter db load-site -db 'postgresql+dbname=goatcounter' -i site.gz
+
 Detailed documentation on the -db flag:
 
     GoatCounter can use SQLite and PostgreSQL. All commands accept the -db flag
@@ -281,6 +448,14 @@ SQLite notes:
 
         -db 'sqlite+mydb.sqlite?_journal_mode=delete&_busy_timeout=0&_cache_size=-2000'
 
+    "goatcounter serve" checkpoints the WAL and reclaims the space of deleted
+    pageviews every 6 hours (see -sqlite-maintenance). The space is only
+    reclaimed if "auto_vacuum" is set to "incremental", which is the default for
+    new databases; for older databases you need to run this once (this rewrites
+    the entire database, so stop GoatCounter first):
+
+        $ goatcounter db query -format=exec 'vacuum'
+
 PostgreSQL notes:
 
     PostgreSQL provides better performance for large instances. If you have
@@ -341,7 +516,13 @@ const helpDBCommands = `List of commands:
      schema-sqlite      Print the SQLite schema.
      schema-pgsql       Print the PostgreSQL schema.
      test               Test if the database exists.
-     query              Run a query.`
+     query              Run a query.
+     partition-hits     Partition the hits table by month (PostgreSQL only).
+     backup             Make a backup of the database.
+     restore            Restore a backup made with "backup".
+     copy               Copy all data to a new database (e.g. SQLite to PostgreSQL).
+     dump-site          Dump a single site to a file.
+     load-site          Load a site from "dump-site", e.g. on another server.`
 
 const helpDBShort = "\n" + helpDBCommands + `
 
@@ -399,6 +580,18 @@ start:
 		return cmdDBMigrate(f, dbConnect, debug, createdb)
 	case "query":
 		return cmdDBQuery(f, dbConnect, debug, createdb)
+	case "partition-hits":
+		return cmdDBPartitionHits(f, dbConnect, debug, createdb)
+	case "backup":
+		return cmdDBBackup(f, dbConnect, debug)
+	case "restore":
+		return cmdDBRestore(f, dbConnect, debug)
+	case "copy":
+		return cmdDBCopy(f, debug)
+	case "dump-site":
+		return cmdDBDumpSite(f, dbConnect, debug)
+	case "load-site":
+		return cmdDBLoadSite(f, dbConnect, debug, createdb)
 	case "show":
 		return cmdDBShow(f, cmd, dbConnect, debug, createdb)
 	case "delete":
@@ -672,13 +865,22 @@ func cmdDBSite(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool
 		find  *[]string
 		email stringFlag
 		pwd   stringFlag
+		opts  createOpts
+		quota interface {
+			Int() int
+			Set() bool
+		}
+		quotaAction stringFlag
 	)
 	if cmd == "update" {
 		find = f.StringList(nil, "find").Pointer()
+		quota = f.Int(0, "quota")
+		quotaAction = f.String("", "quota-action")
 	}
 	if cmd == "create" {
 		email = f.String("", "user.email", "email")
 		pwd = f.String("", "user.password", "password")
+		opts = createFlags(f, "user.")
 	}
 	db, ctx, err := dbParseFlag(f, dbConnect, debug, createdb)
 	if err != nil {
@@ -691,12 +893,12 @@ func cmdDBSite(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool
 	}
 
 	if cmd == "create" {
-		return cmdDBSiteCreate(ctx, vhost.String(), email.String(), link.String(), pwd.String())
+		return cmdDBSiteCreate(ctx, vhost.String(), email.String(), link.String(), pwd.String(), opts)
 	}
-	return cmdDBSiteUpdate(ctx, *find, vhost, link)
+	return cmdDBSiteUpdate(ctx, *find, vhost, link, quota.Set(), quota.Int(), quotaAction)
 }
 
-func cmdDBSiteCreate(ctx context.Context, vhost, email, link, pwd string) error {
+func cmdDBSiteCreate(ctx context.Context, vhost, email, link, pwd string, opts createOpts) error {
 	v := zvalidate.New()
 	v.Required("-vhost", vhost)
 	v.Domain("-vhost", vhost)
@@ -704,31 +906,46 @@ func cmdDBSiteCreate(ctx context.Context, vhost, email, link, pwd string) error
 		v.Required("-user.email", email)
 		v.Email("-user.email", email)
 	}
+	opts.validate(v)
 	if v.HasErrors() {
 		return v
 	}
 
-	err := (&goatcounter.Site{}).ByHost(ctx, vhost)
+	var exists goatcounter.Site
+	err := exists.ByHost(ctx, vhost)
 	if err == nil {
-		return fmt.Errorf("there is already a site for the host %q", vhost)
+		if !*opts.ifNotExists {
+			return fmt.Errorf("there is already a site for the host %q", vhost)
+		}
+		r := createResult{SiteID: exists.ID, Code: exists.Code, Cname: vhost}
+		if email != "" {
+			var u goatcounter.User
+			err := u.ByEmail(goatcounter.WithSite(ctx, &exists), email)
+			if err != nil && !zdb.ErrNoRows(err) {
+				return err
+			}
+			r.UserID, r.Email = u.ID, u.Email
+		}
+		return r.print(*opts.format, "site")
 	}
 
 	var account goatcounter.Site
 	if link != "" {
 		account, err = findParent(ctx, link)
 		if err != nil {
-			return nil
+			return err
 		}
 	}
 
-	if link == "" && pwd == "" {
-		pwd, err = zli.AskPassword(8)
+	if link == "" {
+		pwd, err = opts.password("-user.", pwd)
 		if err != nil {
 			return err
 		}
 	}
 
-	return zdb.TX(ctx, func(ctx context.Context) error {
+	r := createResult{Created: true}
+	err = zdb.TX(ctx, func(ctx context.Context) error {
 		s := goatcounter.Site{
 			Code:  "serve-" + zcrypto.Secret64(),
 			Cname: &vhost,
@@ -740,26 +957,32 @@ func cmdDBSiteCreate(ctx context.Context, vhost, email, link, pwd string) error
 		if err != nil {
 			return err
 		}
+		r.SiteID, r.Code, r.Cname = s.ID, s.Code, vhost
 
 		if link == "" { // Create user as well.
-			err = (&goatcounter.User{
+			u := goatcounter.User{
 				Site:          s.ID,
 				Email:         email,
-				Password:      []byte(pwd),
 				EmailVerified: true,
 				Settings:      s.UserDefaults,
 				Access:        goatcounter.UserAccesses{"all": goatcounter.AccessSuperuser},
-			}).Insert(ctx, false)
+			}
+			r.ResetLink, err = opts.insertUser(goatcounter.WithSite(ctx, &s), &u, pwd)
 			if err != nil {
 				return err
 			}
+			r.UserID, r.Email = u.ID, u.Email
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return r.print(*opts.format, "site")
 }
 
 func cmdDBSiteUpdate(ctx context.Context, find []string,
-	vhost, link stringFlag,
+	vhost, link stringFlag, quotaSet bool, quota int, quotaAction stringFlag,
 ) error {
 
 	v := zvalidate.New()
@@ -796,6 +1019,20 @@ func cmdDBSiteUpdate(ctx context.Context, find []string,
 					return err
 				}
 			}
+
+			if quotaSet || quotaAction.Set() {
+				q, a := s.Quota, s.QuotaAction
+				if quotaSet {
+					q = quota
+				}
+				if quotaAction.Set() {
+					a = quotaAction.String()
+				}
+				err := s.UpdateQuotaSettings(ctx, q, a)
+				if err != nil {
+					return err
+				}
+			}
 		}
 
 		return nil
@@ -814,6 +1051,119 @@ func findParent(ctx context.Context, link string) (goatcounter.Site, error) {
 	return s, err
 }
 
+// createOpts are the flags shared between "create site" and "create user".
+type createOpts struct {
+	pwdEnv      *string
+	resetLink   *bool
+	ifNotExists *bool
+	format      *string
+}
+
+// createFlags adds the flags for createOpts; the password flags are prefixed
+// with prefix.
+func createFlags(f zli.Flags, prefix string) createOpts {
+	return createOpts{
+		pwdEnv:      f.String("", prefix+"password-env").Pointer(),
+		resetLink:   f.Bool(false, prefix+"reset-link").Pointer(),
+		ifNotExists: f.Bool(false, "if-not-exists").Pointer(),
+		format:      f.String("text", "format").Pointer(),
+	}
+}
+
+func (o createOpts) validate(v *zvalidate.Validator) {
+	v.Include("-format", *o.format, []string{"text", "json"})
+}
+
+// password gets the password for a new user: from the -password flag, from the
+// environment variable in -password-env, or interactively if stdin is a
+// terminal. The password is empty if -reset-link is set.
+func (o createOpts) password(prefix, pwd string) (string, error) {
+	switch {
+	case *o.resetLink:
+		if pwd != "" || *o.pwdEnv != "" {
+			return "", fmt.Errorf("can't set %[1]sreset-link with %[1]spassword or %[1]spassword-env", prefix)
+		}
+		return "", nil
+	case *o.pwdEnv != "":
+		if pwd != "" {
+			return "", fmt.Errorf("can't set both %[1]spassword and %[1]spassword-env", prefix)
+		}
+		pwd = os.Getenv(*o.pwdEnv)
+		if pwd == "" {
+			return "", fmt.Errorf("%spassword-env: environment variable %q is not set or empty", prefix, *o.pwdEnv)
+		}
+		return pwd, nil
+	case pwd != "":
+		return pwd, nil
+	}
+
+	if st, err := os.Stdin.Stat(); err != nil || st.Mode()&os.ModeCharDevice == 0 {
+		return "", fmt.Errorf("no password: use %[1]spassword, %[1]spassword-env, or %[1]sreset-link "+
+			"(can't ask interactively as stdin is not a terminal)", prefix)
+	}
+	return zli.AskPassword(8)
+}
+
+// insertUser inserts the user with the password, or with no password and an
+// invite link to set one if -reset-link is set.
+//
+// The site must be in the context.
+func (o createOpts) insertUser(ctx context.Context, u *goatcounter.User, pwd string) (string, error) {
+	if !*o.resetLink {
+		u.Password = []byte(pwd)
+		return "", u.Insert(ctx, false)
+	}
+
+	err := u.Insert(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	err = u.InviteToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	return goatcounter.MustGetSite(ctx).URL(ctx) + "/user/reset/" + *u.LoginRequest, nil
+}
+
+// createResult is the output of "create site" and "create user".
+type createResult struct {
+	Created   bool   `json:"created"`
+	SiteID    int64  `json:"site_id"`
+	Code      string `json:"code"`
+	Cname     string `json:"cname,omitempty"`
+	UserID    int64  `json:"user_id,omitempty"`
+	Email     string `json:"email,omitempty"`
+	ResetLink string `json:"reset_link,omitempty"`
+}
+
+func (r createResult) print(format, what string) error {
+	if format == "json" {
+		j, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(zli.Stdout, string(j))
+		return nil
+	}
+
+	state := "created"
+	if !r.Created {
+		state = "already exists"
+	}
+	if what == "site" {
+		fmt.Fprintf(zli.Stdout, "site %d %s: code=%s cname=%s\n", r.SiteID, state, r.Code, r.Cname)
+		if r.UserID > 0 {
+			fmt.Fprintf(zli.Stdout, "user %d %s: email=%s\n", r.UserID, state, r.Email)
+		}
+	} else {
+		fmt.Fprintf(zli.Stdout, "user %d %s: email=%s site=%d\n", r.UserID, state, r.Email, r.SiteID)
+	}
+	if r.ResetLink != "" {
+		fmt.Fprintf(zli.Stdout, "set the password at: %s\n", r.ResetLink)
+	}
+	return nil
+}
+
 func cmdDBUser(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool) error {
 	var (
 		site   = f.String("", "site")
@@ -821,10 +1171,14 @@ func cmdDBUser(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool
 		access = f.String("", "access")
 		pwd    = f.String("", "password")
 		find   *[]string
+		opts   createOpts
 	)
 	if cmd == "update" {
 		find = f.StringList(nil, "find").Pointer()
 	}
+	if cmd == "create" {
+		opts = createFlags(f, "")
+	}
 	db, ctx, err := dbParseFlag(f, dbConnect, debug, createdb)
 	if err != nil {
 		return err
@@ -832,20 +1186,21 @@ func cmdDBUser(f zli.Flags, cmd string, dbConnect, debug *string, createdb *bool
 	defer db.Close()
 
 	if cmd == "create" {
-		return cmdDBUserCreate(ctx, site.String(), email.String(), access.String(), pwd.String())
+		return cmdDBUserCreate(ctx, site.String(), email.String(), access.String(), pwd.String(), opts)
 	}
 	return cmdDBUserUpdate(ctx, *find, site, email, access, pwd)
 }
 
 func cmdDBUserCreate(ctx context.Context,
-	findSite, email, access, pwd string,
+	findSite, email, access, pwd string, opts createOpts,
 ) error {
 
 	v := zvalidate.New()
 	v.Required("-site", findSite)
 	v.Required("-email", email)
 	v.Required("-access", access)
-	v.Include("-access", access, []string{"readonly", "settings", "admin", "superuser"})
+	v.Include("-access", access, []string{"readonly", "settings", "admin", "owner", "superuser"})
+	opts.validate(v)
 	if v.HasErrors() {
 		return v
 	}
@@ -855,21 +1210,43 @@ func cmdDBUserCreate(ctx context.Context,
 	if err != nil {
 		return err
 	}
+	ctx = goatcounter.WithSite(ctx, &site)
 
-	if pwd == "" {
-		pwd, err = zli.AskPassword(8)
-		if err != nil {
-			return err
+	var exists goatcounter.User
+	err = exists.ByEmail(ctx, email)
+	if err == nil {
+		if !*opts.ifNotExists {
+			return fmt.Errorf("there is already a user with the email %q for site %d", email, site.ID)
 		}
+		return createResult{SiteID: site.ID, Code: site.Code, Cname: ztype.Deref(site.Cname, ""),
+			UserID: exists.ID, Email: exists.Email}.print(*opts.format, "user")
+	}
+	if !zdb.ErrNoRows(err) {
+		return err
 	}
 
-	return (&goatcounter.User{
+	pwd, err = opts.password("-", pwd)
+	if err != nil {
+		return err
+	}
+
+	u := goatcounter.User{
 		Site:     site.ID,
 		Email:    email,
-		Password: []byte(pwd),
 		Settings: site.UserDefaults,
 		Access:   getAccess(access),
-	}).Insert(ctx, false)
+	}
+	r := createResult{Created: true, SiteID: site.ID, Code: site.Code, Cname: ztype.Deref(site.Cname, "")}
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		var err error
+		r.ResetLink, err = opts.insertUser(ctx, &u, pwd)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.UserID, r.Email = u.ID, u.Email
+	return r.print(*opts.format, "user")
 }
 
 func cmdDBUserUpdate(ctx context.Context, find []string,
@@ -938,6 +1315,7 @@ func getAccess(a string) goatcounter.UserAccesses {
 			"readonly":  goatcounter.AccessReadOnly,
 			"settings":  goatcounter.AccessSettings,
 			"admin":     goatcounter.AccessAdmin,
+			"owner":     goatcounter.AccessOwner,
 			"superuser": goatcounter.AccessSuperuser,
 		}[a],
 	}
@@ -1056,6 +1434,7 @@ func getPerm(permFlag string) (zint.Bitflag64, error) {
 			"site_read":   goatcounter.APIPermSiteRead,
 			"site_create": goatcounter.APIPermSiteCreate,
 			"site_update": goatcounter.APIPermSiteUpdate,
+			"purge":       goatcounter.APIPermPurge,
 		}[p]
 		if !ok {
 			return 0, fmt.Errorf("-perm: invalid value %q", p)
@@ -1064,3 +1443,25 @@ func getPerm(permFlag string) (zint.Bitflag64, error) {
 	}
 	return perm, nil
 }
+
+func cmdDBPartitionHits(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+	zlog.Config.SetDebug(*debug)
+
+	db, ctx, err := connectDB(*dbConnect, "", nil, *createdb, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	names, err := goatcounter.PartitionHits(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(zli.Stdout, "partitioned the hits table; created %d partitions:\n\t%s\n",
+		len(names), strings.Join(names, "\n\t"))
+	return nil
+}
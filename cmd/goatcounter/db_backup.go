@@ -0,0 +1,436 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/db/migrate/gomig"
+	"zgo.at/zdb"
+	"zgo.at/zdb/drivers"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+)
+
+// backupMeta is the metadata for a backup, which is stored next to it as
+// <file>.json.
+type backupMeta struct {
+	Version    string           `json:"version"` // GoatCounter version.
+	Dialect    string           `json:"dialect"`
+	Created    time.Time        `json:"created"`
+	Schema     string           `json:"schema"` // Last migration.
+	Migrations []string         `json:"migrations"`
+	Rows       map[string]int64 `json:"rows"`
+}
+
+func cmdDBBackup(f zli.Flags, dbConnect, debug *string) error {
+	var (
+		output = f.String("", "o", "output")
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+	zlog.Config.SetDebug(*debug)
+
+	if output.String() == "" {
+		return errors.New("need -o")
+	}
+	if _, err := os.Stat(output.String()); err == nil {
+		return fmt.Errorf("-o: %q already exists", output.String())
+	}
+
+	db, ctx, err := connectDB(*dbConnect, "", nil, false, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var meta backupMeta
+	switch db.SQLDialect() {
+	case zdb.DialectSQLite:
+		meta, err = backupSQLite(ctx, output.String())
+	case zdb.DialectPostgreSQL:
+		meta, err = backupPostgreSQL(ctx, *dbConnect, output.String())
+	default:
+		err = fmt.Errorf("backup not supported for %s", db.SQLDialect())
+	}
+	if err != nil {
+		os.Remove(output.String())
+		return err
+	}
+
+	j, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(output.String()+".json", append(j, '\n'), 0o600)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(zli.Stdout, "wrote %s and %s.json; schema %s, %d pageviews\n",
+		output.String(), output.String(), meta.Schema, meta.Rows["hits"])
+	return nil
+}
+
+// backupSQLite copies the database with "vacuum into", which is safe to use
+// while GoatCounter is running, and compresses the copy.
+func backupSQLite(ctx context.Context, output string) (backupMeta, error) {
+	tmp, err := os.MkdirTemp(filepath.Dir(output), ".goatcounter-backup-")
+	if err != nil {
+		return backupMeta{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	cp := filepath.Join(tmp, "goatcounter.sqlite3")
+	err = zdb.Exec(ctx, `vacuum into '`+strings.ReplaceAll(cp, "'", "''")+`'`)
+	if err != nil {
+		return backupMeta{}, errors.Wrap(err, "vacuum into")
+	}
+
+	// Read the metadata from the copy, so it's always consistent with what's
+	// in the backup.
+	copyDB, err := zdb.Connect(ctx, zdb.ConnectOptions{Connect: "sqlite3+" + cp})
+	if err != nil {
+		return backupMeta{}, err
+	}
+	meta, err := readBackupMeta(zdb.WithDB(ctx, copyDB))
+	copyDB.Close()
+	if err != nil {
+		return backupMeta{}, err
+	}
+
+	return meta, gzipFile(cp, output)
+}
+
+// backupPostgreSQL runs pg_dump in a snapshot exported from a transaction, so
+// the row counts match what's in the dump.
+func backupPostgreSQL(ctx context.Context, connect, output string) (backupMeta, error) {
+	if _, err := exec.LookPath("pg_dump"); err != nil {
+		return backupMeta{}, errors.New("pg_dump not found in PATH; it's needed to make backups of PostgreSQL databases")
+	}
+
+	var meta backupMeta
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `set transaction isolation level repeatable read`)
+		if err != nil {
+			return err
+		}
+		var snapshot string
+		err = zdb.Get(ctx, &snapshot, `select pg_export_snapshot()`)
+		if err != nil {
+			return err
+		}
+
+		meta, err = readBackupMeta(ctx)
+		if err != nil {
+			return err
+		}
+
+		cmd := exec.CommandContext(ctx, "pg_dump", append(pgConnect(connect),
+			"--format=custom", "--no-owner", "--no-privileges",
+			"--snapshot="+snapshot, "--file="+output)...)
+		cmd.Stderr = zli.Stderr
+		return errors.Wrap(cmd.Run(), "pg_dump")
+	})
+	return meta, err
+}
+
+func readBackupMeta(ctx context.Context) (backupMeta, error) {
+	meta := backupMeta{
+		Version: goatcounter.Version,
+		Dialect: zdb.SQLDialect(ctx).String(),
+		Created: time.Now().UTC().Round(time.Second),
+		Rows:    make(map[string]int64),
+	}
+
+	err := zdb.Select(ctx, &meta.Migrations, `select name from version order by name`)
+	if err != nil {
+		return meta, errors.Wrap(err, "reading migrations")
+	}
+	if len(meta.Migrations) > 0 {
+		meta.Schema = meta.Migrations[len(meta.Migrations)-1]
+	}
+
+	meta.Rows, err = countRows(ctx)
+	return meta, err
+}
+
+// listTables lists all tables, except for the partitions of a table.
+func listTables(ctx context.Context) ([]string, error) {
+	query := `select name from sqlite_master where type = 'table' and name not like 'sqlite_%' order by name`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		query = `select relname from pg_class
+			where relkind in ('r', 'p') and not relispartition and relnamespace = current_schema()::regnamespace
+			order by relname`
+	}
+	var tables []string
+	err := zdb.Select(ctx, &tables, query)
+	return tables, errors.Wrap(err, "listing tables")
+}
+
+// countRows counts the rows in all tables; partitions are counted in the
+// parent table.
+func countRows(ctx context.Context) (map[string]int64, error) {
+	tables, err := listTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make(map[string]int64, len(tables))
+	for _, t := range tables {
+		var n int64
+		err := zdb.Get(ctx, &n, `select count(*) from "`+t+`"`)
+		if err != nil {
+			return nil, errors.Wrapf(err, "counting rows in %q", t)
+		}
+		rows[t] = n
+	}
+	return rows, nil
+}
+
+func cmdDBRestore(f zli.Flags, dbConnect, debug *string) error {
+	var (
+		input = f.String("", "i", "input")
+		force = f.Bool(false, "force")
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+	zlog.Config.SetDebug(*debug)
+
+	if input.String() == "" {
+		return errors.New("need -i")
+	}
+
+	var meta backupMeta
+	j, err := os.ReadFile(input.String() + ".json")
+	if err != nil {
+		return fmt.Errorf("reading metadata: %w", err)
+	}
+	err = json.Unmarshal(j, &meta)
+	if err != nil {
+		return fmt.Errorf("reading metadata: %w", err)
+	}
+
+	known, err := knownMigrations()
+	if err != nil {
+		return err
+	}
+	var unknown []string
+	for _, m := range meta.Migrations {
+		if !slices.Contains(known, m) {
+			unknown = append(unknown, m)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("backup was made with a newer GoatCounter version (%s) and has unknown migrations:\n\t%s",
+			meta.Version, strings.Join(unknown, "\n\t"))
+	}
+
+	engine, _, _ := strings.Cut(*dbConnect, "+")
+	switch engine {
+	case "sqlite", "sqlite3":
+		err = restoreSQLite(*dbConnect, input.String(), meta, force.Bool())
+	case "postgres", "postgresql":
+		err = restorePostgreSQL(*dbConnect, input.String(), meta, force.Bool())
+	default:
+		err = fmt.Errorf("restore not supported for %q", engine)
+	}
+	if err != nil {
+		return err
+	}
+
+	db, ctx, err := connectDB(*dbConnect, "", nil, false, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := countRows(ctx)
+	if err != nil {
+		return err
+	}
+	var diff []string
+	for t, n := range meta.Rows {
+		if rows[t] != n {
+			diff = append(diff, fmt.Sprintf("%s: %d rows; backup has %d", t, rows[t], n))
+		}
+	}
+	if len(diff) > 0 {
+		sort.Strings(diff)
+		return fmt.Errorf("restored database doesn't match the backup:\n\t%s", strings.Join(diff, "\n\t"))
+	}
+
+	fmt.Fprintf(zli.Stdout, "restored backup from %s; schema %s, %d pageviews\n",
+		meta.Created.Format(time.DateTime), meta.Schema, meta.Rows["hits"])
+	return nil
+}
+
+func restoreSQLite(connect, input string, meta backupMeta, force bool) error {
+	if meta.Dialect != zdb.DialectSQLite.String() {
+		return fmt.Errorf("can't restore a %s backup to SQLite", meta.Dialect)
+	}
+
+	_, file, _ := strings.Cut(connect, "+")
+	file, _, _ = strings.Cut(strings.TrimPrefix(file, "file:"), "?")
+	if st, err := os.Stat(file); err == nil && st.Size() > 0 {
+		if !force {
+			return fmt.Errorf("database %q already exists and isn't empty; add -force to overwrite it", file)
+		}
+		for _, f := range []string{file, file + "-wal", file + "-shm"} {
+			err := os.Remove(f)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	fp, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		return fmt.Errorf("reading %q: %w", input, err)
+	}
+
+	tmp := file + ".restore"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, gz)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("reading %q: %w", input, err)
+	}
+	return os.Rename(tmp, file)
+}
+
+func restorePostgreSQL(connect, input string, meta backupMeta, force bool) error {
+	if meta.Dialect != zdb.DialectPostgreSQL.String() {
+		return fmt.Errorf("can't restore a %s backup to PostgreSQL", meta.Dialect)
+	}
+	if _, err := exec.LookPath("pg_restore"); err != nil {
+		return errors.New("pg_restore not found in PATH; it's needed to restore PostgreSQL databases")
+	}
+
+	var (
+		ctx   = context.Background()
+		empty bool
+	)
+	db, err := zdb.Connect(ctx, zdb.ConnectOptions{Connect: connect})
+	var cErr *drivers.NotExistError
+	switch {
+	case errors.As(err, &cErr) && cErr.DB == "":
+		empty = true
+	case err != nil:
+		return err
+	default:
+		var n int
+		err := db.Get(ctx, &n, `select count(*) from pg_class
+			where relkind in ('r', 'p') and relnamespace = current_schema()::regnamespace`)
+		db.Close()
+		if err != nil {
+			return err
+		}
+		empty = n == 0
+	}
+	if !empty && !force {
+		return errors.New("database already exists and isn't empty; add -force to overwrite it")
+	}
+
+	args := append(pgConnect(connect), "--no-owner", "--no-privileges", "--exit-on-error", "--single-transaction")
+	if !empty {
+		args = append(args, "--clean", "--if-exists")
+	}
+	cmd := exec.Command("pg_restore", append(args, input)...)
+	cmd.Stderr = zli.Stderr
+	return errors.Wrap(cmd.Run(), "pg_restore")
+}
+
+// pgConnect gets the -db connection string as pg_dump/pg_restore flags; the
+// PG* environment variables are used if it's empty.
+func pgConnect(connect string) []string {
+	_, c, _ := strings.Cut(connect, "+")
+	if c == "" {
+		return nil
+	}
+	return []string{"--dbname=" + c}
+}
+
+var reSchemaVersion = regexp.MustCompile(`(?m)^\s*\('(\d{4}-\d\d-\d\d-[^']+)'\)`)
+
+// knownMigrations lists all migrations this version of GoatCounter knows about:
+// the ones in db/migrate, the Go migrations, and the older ones that are only
+// in the version table of the schema.
+func knownMigrations() ([]string, error) {
+	schema, err := fs.ReadFile(goatcounter.DB, "db/schema.gotxt")
+	if err != nil {
+		return nil, err
+	}
+	ls, err := fs.ReadDir(goatcounter.DB, "db/migrate")
+	if err != nil {
+		return nil, err
+	}
+
+	var known []string
+	for _, m := range reSchemaVersion.FindAllSubmatch(schema, -1) {
+		known = append(known, string(m[1]))
+	}
+	for _, f := range ls {
+		if !f.IsDir() {
+			known = append(known, migrationName(f.Name()))
+		}
+	}
+	for k := range gomig.Migrations {
+		known = append(known, k)
+	}
+	return known, nil
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err2 := gz.Close(); err == nil {
+		err = err2
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
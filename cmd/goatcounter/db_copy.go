@@ -0,0 +1,351 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+)
+
+// Tables to copy first, so that a partial copy makes some sense; there are no
+// foreign keys, so the order doesn't matter otherwise.
+var copyFirst = []string{"sites", "site_domains", "users", "api_tokens",
+	"paths", "refs", "browsers", "systems", "sizes", "campaigns"}
+
+type copyColumn struct {
+	Name string `db:"name"`
+	Type string `db:"type"`
+}
+
+func cmdDBCopy(f zli.Flags, debug *string) error {
+	var (
+		from = f.String("", "from")
+		to   = f.String("", "to")
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+	zlog.Config.SetDebug(*debug)
+
+	if from.String() == "" || to.String() == "" {
+		return errors.New("need -from and -to")
+	}
+	if from.String() == to.String() {
+		return errors.New("-from and -to are the same database")
+	}
+
+	src, srcCtx, err := connectDB(from.String(), "", nil, false, false)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	defer src.Close()
+	dst, dstCtx, err := connectDB(to.String(), "", []string{"pending"}, true, false)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+	defer dst.Close()
+
+	var n int
+	err = zdb.Get(dstCtx, &n, `select count(*) from sites`)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+	if n > 0 {
+		return errors.New("-to: database isn't empty; it must be a new database")
+	}
+
+	var srcVersion, dstVersion []string
+	err = zdb.Select(srcCtx, &srcVersion, `select name from version order by name`)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	err = zdb.Select(dstCtx, &dstVersion, `select name from version order by name`)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+	if !slices.Equal(srcVersion, dstVersion) {
+		return errors.New("-from: the database isn't at the same version as this GoatCounter; " +
+			`run "goatcounter db migrate all" first, or use the same GoatCounter version that it was created with`)
+	}
+
+	srcRows, err := countRows(srcCtx)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	dstRows, err := countRows(dstCtx)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+
+	// The version table is already identical, and all other tables are
+	// cleared before copying, as the new database has some default rows.
+	tables := make([]string, 0, len(dstRows))
+	for t := range dstRows {
+		if t != "version" {
+			tables = append(tables, t)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		ii, jj := slices.Index(copyFirst, tables[i]), slices.Index(copyFirst, tables[j])
+		if ii == -1 {
+			ii = len(copyFirst)
+		}
+		if jj == -1 {
+			jj = len(copyFirst)
+		}
+		if ii != jj {
+			return ii < jj
+		}
+		return tables[i] < tables[j]
+	})
+
+	for _, t := range tables {
+		if _, ok := srcRows[t]; !ok {
+			return fmt.Errorf("-from: table %q doesn't exist", t)
+		}
+		err := copyTable(srcCtx, dstCtx, t, srcRows[t])
+		if err != nil {
+			return fmt.Errorf("copying %q: %w", t, err)
+		}
+	}
+
+	err = setSequences(dstCtx)
+	if err != nil {
+		return err
+	}
+
+	dstRows, err = countRows(dstCtx)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+	var diff []string
+	for _, t := range tables {
+		if srcRows[t] != dstRows[t] {
+			diff = append(diff, fmt.Sprintf("%s: %d rows; -from has %d", t, dstRows[t], srcRows[t]))
+		}
+	}
+	if len(diff) > 0 {
+		return fmt.Errorf("copy doesn't match the source:\n\t%s", strings.Join(diff, "\n\t"))
+	}
+
+	fmt.Fprintf(zli.Stdout, "copied %d tables; all row counts match\n", len(tables))
+	return nil
+}
+
+// copyTable copies all rows of a table in batches; every batch is committed
+// separately.
+func copyTable(srcCtx, dstCtx context.Context, table string, total int64) error {
+	var (
+		srcDialect = zdb.SQLDialect(srcCtx)
+		dstDialect = zdb.SQLDialect(dstCtx)
+	)
+
+	cols, err := tableColumns(dstCtx, table)
+	if err != nil {
+		return err
+	}
+	srcCols, err := tableColumns(srcCtx, table)
+	if err != nil {
+		return err
+	}
+
+	var (
+		sel   = make([]string, 0, len(cols))
+		names = make([]string, 0, len(cols))
+	)
+	for _, c := range cols {
+		names = append(names, `"`+c.Name+`"`)
+		s := `"` + c.Name + `"`
+		// Get JSON from PostgreSQL as text, rather than a decoded value.
+		if srcDialect == zdb.DialectPostgreSQL {
+			if i := slices.IndexFunc(srcCols, func(sc copyColumn) bool { return sc.Name == c.Name }); i > -1 &&
+				strings.HasPrefix(srcCols[i].Type, "json") {
+				s += "::text"
+			}
+		}
+		sel = append(sel, s)
+	}
+
+	err = zdb.Exec(dstCtx, `delete from "`+table+`"`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := zdb.MustGetDB(srcCtx).DBSQL().QueryContext(srcCtx,
+		`select `+strings.Join(sel, ", ")+` from "`+table+`"`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		batch    = max(1, 5_000/len(cols))
+		values   = make([]any, 0, batch*len(cols))
+		copied   int64
+		override string
+	)
+	if dstDialect == zdb.DialectPostgreSQL {
+		var identity bool
+		err := zdb.Get(dstCtx, &identity, `select exists(select 1 from information_schema.columns
+			where table_schema = current_schema() and table_name = $1 and is_identity = 'YES')`, table)
+		if err != nil {
+			return err
+		}
+		if identity {
+			override = " overriding system value"
+		}
+	}
+
+	insert := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		var (
+			b     strings.Builder
+			nrows = len(values) / len(cols)
+		)
+		b.WriteString(`insert into "` + table + `" (` + strings.Join(names, ", ") + `)` + override + ` values `)
+		for i := 0; i < nrows; i++ {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteByte('(')
+			for j := range cols {
+				if j > 0 {
+					b.WriteString(", ")
+				}
+				if dstDialect == zdb.DialectPostgreSQL {
+					b.WriteString("$" + strconv.Itoa(i*len(cols)+j+1))
+				} else {
+					b.WriteByte('?')
+				}
+			}
+			b.WriteByte(')')
+		}
+		_, err := zdb.MustGetDB(dstCtx).DBSQL().ExecContext(dstCtx, b.String(), values...)
+		if err != nil {
+			return err
+		}
+		copied += int64(nrows)
+		values = values[:0]
+
+		if total > 0 {
+			zli.Erase()
+			fmt.Fprintf(zli.Stdout, "\r%s: %d/%d rows", table, copied, total)
+		}
+		return nil
+	}
+
+	scan := make([]any, len(cols))
+	for rows.Next() {
+		row := make([]any, len(cols))
+		for i := range row {
+			scan[i] = &row[i]
+		}
+		err := rows.Scan(scan...)
+		if err != nil {
+			return err
+		}
+		for i, c := range cols {
+			values = append(values, convertValue(row[i], c.Type, dstDialect))
+		}
+		if len(values) >= batch*len(cols) {
+			err := insert()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	err = insert()
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		fmt.Fprintln(zli.Stdout)
+	}
+	return nil
+}
+
+// convertValue converts a value from the source database to what the
+// destination column expects.
+func convertValue(v any, typ string, dialect zdb.Dialect) any {
+	typ = strings.ToLower(typ)
+	switch vv := v.(type) {
+	case time.Time:
+		if dialect == zdb.DialectSQLite {
+			if typ == "date" {
+				return vv.UTC().Format("2006-01-02")
+			}
+			return vv.UTC().Format("2006-01-02 15:04:05")
+		}
+	case []byte:
+		if typ != "blob" && typ != "bytea" {
+			return string(vv)
+		}
+	case string:
+		if typ == "blob" || typ == "bytea" {
+			return []byte(vv)
+		}
+	}
+	return v
+}
+
+// tableColumns gets all columns of a table, except generated columns.
+func tableColumns(ctx context.Context, table string) ([]copyColumn, error) {
+	query := `select name, type from pragma_table_info($1)`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		query = `select column_name as name, data_type as type from information_schema.columns
+			where table_schema = current_schema() and table_name = $1 and is_generated = 'NEVER'
+			order by ordinal_position`
+	}
+	var cols []copyColumn
+	err := zdb.Select(ctx, &cols, query, table)
+	if err == nil && len(cols) == 0 {
+		err = fmt.Errorf("no columns for %q", table)
+	}
+	return cols, err
+}
+
+// setSequences sets the sequences for all ID columns to the highest ID, so new
+// rows don't get an ID that's already used. SQLite does this automatically.
+func setSequences(ctx context.Context) error {
+	if zdb.SQLDialect(ctx) != zdb.DialectPostgreSQL {
+		return nil
+	}
+
+	var seqs []struct {
+		Table  string `db:"table_name"`
+		Column string `db:"column_name"`
+	}
+	err := zdb.Select(ctx, &seqs, `select table_name, column_name from information_schema.columns
+		where table_schema = current_schema() and (is_identity = 'YES' or column_default like 'nextval(%')`)
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		err := zdb.Exec(ctx, `select setval(pg_get_serial_sequence($1, $2),
+			coalesce((select max("`+s.Column+`") from "`+s.Table+`"), 0) + 1, false)`,
+			s.Table, s.Column)
+		if err != nil {
+			return fmt.Errorf("setting sequence for %s.%s: %w", s.Table, s.Column, err)
+		}
+	}
+	return nil
+}
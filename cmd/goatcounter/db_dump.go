@@ -0,0 +1,719 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+)
+
+// A site dump is a gzip'd stream of JSON values: first a siteDumpHeader, and
+// then for every table a siteDumpTable followed by the rows as arrays, in the
+// same order as the columns.
+type (
+	siteDumpHeader struct {
+		Version    string    `json:"version"` // GoatCounter version.
+		Created    time.Time `json:"created"`
+		Migrations []string  `json:"migrations"`
+		SiteID     int64     `json:"site_id"`
+		Code       string    `json:"code"`
+		Cname      *string   `json:"cname"`
+	}
+	siteDumpTable struct {
+		Table   string   `json:"table"`
+		Columns []string `json:"columns"`
+	}
+)
+
+var (
+	// Columns that refer to a row in another table. These rows get a new ID
+	// when loading, and all columns that refer to them are remapped.
+	dumpRefs = map[string]string{
+		"site_id":     "sites",
+		"user_id":     "users",
+		"path_id":     "paths",
+		"campaign_id": "campaigns",
+		"campaign":    "campaigns", // hits.campaign
+		"ref_id":      "refs",
+		"browser_id":  "browsers",
+		"system_id":   "systems",
+		"size_id":     "sizes",
+	}
+
+	// Tables shared between all sites; only the rows that the site refers to
+	// are dumped, and they're matched to existing rows when loading.
+	dumpShared = []string{"refs", "browsers", "systems", "sizes"}
+
+	// Tables that are per-account rather than per-site; the rows for the
+	// site's account are dumped.
+	dumpAccount = []string{"users", "api_tokens"}
+
+	// Tables that aren't dumped as they only make sense on the instance they
+	// were created on, or are a log of what happened there.
+	dumpSkip = []string{"site_domains", "site_transfers", "invites",
+		"email_changes", "backup_codes", "passkeys", "login_sessions",
+		"audit_entries", "webhook_deliveries", "exports", "purges"}
+
+	// Tables to dump first, as the other tables refer to them.
+	dumpFirst = []string{"sites", "users", "refs", "browsers", "systems", "sizes", "paths", "campaigns"}
+)
+
+func cmdDBDumpSite(f zli.Flags, dbConnect, debug *string) error {
+	var (
+		site   = f.String("", "site")
+		output = f.String("", "o", "output")
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+	zlog.Config.SetDebug(*debug)
+
+	if site.String() == "" {
+		return errors.New("need -site")
+	}
+	if output.String() == "" {
+		return errors.New("need -o")
+	}
+	if _, err := os.Stat(output.String()); err == nil {
+		return fmt.Errorf("-o: %q already exists", output.String())
+	}
+
+	db, ctx, err := connectDB(*dbConnect, "", nil, false, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var s goatcounter.Site
+	err = s.Find(ctx, site.String())
+	if zdb.ErrNoRows(err) {
+		err = s.ByCode(ctx, site.String())
+	}
+	if err != nil {
+		return fmt.Errorf("-site: %w", err)
+	}
+
+	fp, err := os.OpenFile(output.String(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	n, err := dumpSite(ctx, fp, s)
+	if err == nil {
+		err = fp.Close()
+	}
+	if err != nil {
+		fp.Close()
+		os.Remove(output.String())
+		return err
+	}
+
+	fmt.Fprintf(zli.Stdout, "dumped site %q with %d pageviews to %q\n", s.Code, n, output.String())
+	return nil
+}
+
+// dumpSite writes the site dump to w, returning the number of pageviews.
+func dumpSite(ctx context.Context, w io.Writer, s goatcounter.Site) (int64, error) {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	hdr := siteDumpHeader{
+		Version: goatcounter.Version,
+		Created: time.Now().UTC().Round(time.Second),
+		SiteID:  s.ID,
+		Code:    s.Code,
+		Cname:   s.Cname,
+	}
+	err := zdb.Select(ctx, &hdr.Migrations, `select name from version order by name`)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading migrations")
+	}
+	err = enc.Encode(hdr)
+	if err != nil {
+		return 0, err
+	}
+
+	tables, cols, err := dumpTables(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		site    = strconv.FormatInt(s.ID, 10)
+		account = strconv.FormatInt(s.IDOrParent(), 10)
+		hits    int64
+	)
+	for _, t := range tables {
+		where := `site_id = ` + site
+		switch {
+		case slices.Contains(dumpAccount, t):
+			where = `site_id = ` + account
+		case slices.Contains(dumpShared, t):
+			// Only the rows that the site refers to.
+			id := cols[t][0].Name
+			sub := []string{"select null"}
+			for _, tt := range tables {
+				if slices.Contains(dumpShared, tt) || slices.Contains(dumpAccount, tt) {
+					continue
+				}
+				for _, c := range cols[tt] {
+					if dumpRefs[c.Name] == t {
+						sub = append(sub, `select "`+c.Name+`" from "`+tt+`" where site_id = `+site)
+					}
+				}
+			}
+			where = `"` + id + `" in (` + strings.Join(sub, " union ") + `)`
+		}
+
+		n, err := dumpTable(ctx, enc, t, cols[t], where)
+		if err != nil {
+			return 0, fmt.Errorf("dumping %q: %w", t, err)
+		}
+		if t == "hits" {
+			hits = n
+		}
+	}
+	return hits, gz.Close()
+}
+
+// dumpTables gets all tables to dump, in the order to dump them.
+func dumpTables(ctx context.Context) ([]string, map[string][]copyColumn, error) {
+	all, err := listTables(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		tables = make([]string, 0, len(all))
+		cols   = make(map[string][]copyColumn)
+	)
+	for _, t := range all {
+		if slices.Contains(dumpSkip, t) {
+			continue
+		}
+		c, err := tableColumns(ctx, t)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !slices.Contains(dumpShared, t) && !slices.ContainsFunc(c, func(c copyColumn) bool { return c.Name == "site_id" }) {
+			continue
+		}
+
+		// Make sure we know what to do with all IDs, so new tables don't
+		// silently end up with IDs that refer to the wrong rows.
+		id := dumpID(t, c)
+		for _, cc := range c {
+			if cc.Name != id && strings.HasSuffix(cc.Name, "_id") && dumpRefs[cc.Name] == "" {
+				return nil, nil, fmt.Errorf("%s.%s: don't know which table this refers to", t, cc.Name)
+			}
+		}
+
+		tables, cols[t] = append(tables, t), c
+	}
+
+	sort.SliceStable(tables, func(i, j int) bool {
+		ii, jj := slices.Index(dumpFirst, tables[i]), slices.Index(dumpFirst, tables[j])
+		if ii == -1 {
+			ii = len(dumpFirst)
+		}
+		if jj == -1 {
+			jj = len(dumpFirst)
+		}
+		return ii < jj
+	})
+	return tables, cols, nil
+}
+
+// dumpID gets the ID column for the table, or "" if there isn't any.
+func dumpID(table string, cols []copyColumn) string {
+	for col, t := range dumpRefs {
+		if t == table && col != "campaign" {
+			return col
+		}
+	}
+	if len(cols) > 0 && strings.HasSuffix(cols[0].Name, "_id") && dumpRefs[cols[0].Name] == "" {
+		return cols[0].Name
+	}
+	return ""
+}
+
+func dumpTable(ctx context.Context, enc *json.Encoder, table string, cols []copyColumn, where string) (int64, error) {
+	var (
+		sel   = make([]string, 0, len(cols))
+		names = make([]string, 0, len(cols))
+	)
+	for _, c := range cols {
+		names = append(names, c.Name)
+		s := `"` + c.Name + `"`
+		// Get JSON from PostgreSQL as text, rather than a decoded value.
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL && strings.HasPrefix(c.Type, "json") {
+			s += "::text"
+		}
+		sel = append(sel, s)
+	}
+
+	err := enc.Encode(siteDumpTable{Table: table, Columns: names})
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := zdb.MustGetDB(ctx).DBSQL().QueryContext(ctx,
+		`select `+strings.Join(sel, ", ")+` from "`+table+`" where `+where)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var (
+		n    int64
+		row  = make([]any, len(cols))
+		scan = make([]any, len(cols))
+	)
+	for i := range row {
+		scan[i] = &row[i]
+	}
+	for rows.Next() {
+		err := rows.Scan(scan...)
+		if err != nil {
+			return 0, err
+		}
+		for i, c := range cols {
+			// []byte is encoded as base64, which is what we want for blobs
+			// only.
+			if b, ok := row[i].([]byte); ok && !isBlob(c.Type) {
+				row[i] = string(b)
+			}
+		}
+		err = enc.Encode(row)
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func cmdDBLoadSite(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
+	var (
+		input = f.String("", "i", "input")
+		code  = f.String("", "code")
+		cname = f.String("", "cname")
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+	zlog.Config.SetDebug(*debug)
+
+	if input.String() == "" {
+		return errors.New("need -i")
+	}
+
+	fp, err := os.Open(input.String())
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(fp))
+	if err != nil {
+		return fmt.Errorf("-i: %w", err)
+	}
+	dec := json.NewDecoder(gz)
+	dec.UseNumber()
+
+	var hdr siteDumpHeader
+	err = dec.Decode(&hdr)
+	if err != nil {
+		return fmt.Errorf("-i: reading header: %w", err)
+	}
+
+	db, ctx, err := connectDB(*dbConnect, "", nil, *createdb, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var version []string
+	err = zdb.Select(ctx, &version, `select name from version order by name`)
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(hdr.Migrations, version) {
+		return fmt.Errorf("-i: the dump is from GoatCounter %s with a different database version; "+
+			`run "goatcounter db migrate all" on both databases, or use the same GoatCounter version`, hdr.Version)
+	}
+
+	l := siteLoader{
+		hdr:     hdr,
+		code:    hdr.Code,
+		cname:   hdr.Cname,
+		ids:     make(map[string]map[int64]int64),
+		rows:    make(map[string]int64),
+		skipped: make(map[string]int64),
+	}
+	if code.Set() {
+		l.code = code.String()
+	}
+	if c := cname.String(); cname.Set() {
+		l.cname = &c
+		if c == "" {
+			l.cname = nil
+		}
+	}
+
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		err := l.checkSite(ctx)
+		if err != nil {
+			return err
+		}
+		return l.load(ctx, dec)
+	})
+	if err != nil {
+		return err
+	}
+	err = setSequences(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(zli.Stdout, "loaded site %q as %q (ID %d) with %d pageviews\n",
+		hdr.Code, l.code, l.ids["sites"][hdr.SiteID], l.rows["hits"])
+	skipped := make([]string, 0, len(l.skipped))
+	for t := range l.skipped {
+		skipped = append(skipped, t)
+	}
+	sort.Strings(skipped)
+	for _, t := range skipped {
+		fmt.Fprintf(zli.Stdout, "skipped %d rows in %q that refer to rows that aren't in the dump\n", l.skipped[t], t)
+	}
+	return nil
+}
+
+type siteLoader struct {
+	hdr     siteDumpHeader
+	code    string
+	cname   *string
+	ids     map[string]map[int64]int64 // Table → old ID → new ID.
+	rows    map[string]int64
+	skipped map[string]int64
+}
+
+func (l siteLoader) checkSite(ctx context.Context) error {
+	var n int
+	err := zdb.Get(ctx, &n, `select count(*) from sites where lower(code) = lower(?)`, l.code)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("a site with the code %q already exists; use -code to load it with a different code", l.code)
+	}
+
+	if l.cname != nil {
+		err := zdb.Get(ctx, &n, `select count(*) from sites where lower(cname) = lower(?)`, *l.cname)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("a site with the cname %q already exists; use -cname to load it with a different cname", *l.cname)
+		}
+	}
+	return nil
+}
+
+func (l siteLoader) load(ctx context.Context, dec *json.Decoder) error {
+	var (
+		table  string
+		cols   []string
+		types  map[string]string
+		id     = -1
+		values func(...any)
+		finish = func() error { return nil }
+	)
+	for {
+		var v any
+		err := dec.Decode(&v)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("-i: %w", err)
+		}
+
+		switch vv := v.(type) {
+		default:
+			return fmt.Errorf("-i: unexpected value after %q: %v", table, v)
+
+		case map[string]any: // Start of a new table.
+			err := finish()
+			if err != nil {
+				return fmt.Errorf("loading %q: %w", table, err)
+			}
+
+			j, _ := json.Marshal(vv)
+			var t siteDumpTable
+			err = json.Unmarshal(j, &t)
+			if err != nil || t.Table == "" {
+				return fmt.Errorf("-i: invalid table header: %s", j)
+			}
+			table, cols = t.Table, t.Columns
+
+			dst, err := tableColumns(ctx, table)
+			if err != nil {
+				return err
+			}
+			types = make(map[string]string, len(dst))
+			for _, c := range dst {
+				types[c.Name] = c.Type
+			}
+			for _, c := range cols {
+				if _, ok := types[c]; !ok {
+					return fmt.Errorf("-i: column %s.%s doesn't exist", table, c)
+				}
+			}
+
+			dstCols := cols
+			id = slices.Index(cols, dumpID(table, dst))
+			if id > -1 {
+				dstCols = slices.Delete(slices.Clone(cols), id, id+1)
+			}
+			// Only start the insert for tables with rows inserted in bulk.
+			tbl := table
+			finish = func() error { return nil }
+			values = func(v ...any) {
+				ins := zdb.NewBulkInsert(ctx, tbl, dstCols)
+				ins.Values(v...)
+				values, finish = func(v ...any) { ins.Values(v...) }, ins.Finish
+			}
+
+		case []any: // Row.
+			if table == "" || len(vv) != len(cols) {
+				return fmt.Errorf("-i: row doesn't match the columns for %q: %v", table, vv)
+			}
+			ok, err := l.row(ctx, table, cols, types, id, vv, values)
+			if err != nil {
+				return fmt.Errorf("loading %q: %w", table, err)
+			}
+			if ok {
+				l.rows[table]++
+			} else {
+				l.skipped[table]++
+			}
+		}
+	}
+
+	err := finish()
+	if err != nil {
+		return fmt.Errorf("loading %q: %w", table, err)
+	}
+	if _, ok := l.ids["sites"][l.hdr.SiteID]; !ok {
+		return errors.New("-i: no site in the dump")
+	}
+	return nil
+}
+
+// row loads a single row; it returns false if the row was skipped because it
+// refers to a row that's not in the dump.
+func (l siteLoader) row(ctx context.Context, table string, cols []string, types map[string]string,
+	id int, row []any, values func(...any),
+) (bool, error) {
+	dialect := zdb.SQLDialect(ctx)
+	for i, c := range cols {
+		v, err := loadValue(row[i], types[c], dialect)
+		if err != nil {
+			return false, fmt.Errorf("column %q: %w", c, err)
+		}
+		row[i] = v
+
+		ref, ok := dumpRefs[c]
+		if !ok || i == id || v == nil {
+			continue
+		}
+		// All rows are for the loaded site, including the rows for the
+		// account (which may be another site).
+		if c == "site_id" {
+			row[i] = l.ids["sites"][l.hdr.SiteID]
+			continue
+		}
+		old, ok := v.(int64)
+		if !ok {
+			return false, fmt.Errorf("column %q: not an ID: %v", c, v)
+		}
+		newID, ok := l.ids[ref][old]
+		if !ok {
+			return false, nil
+		}
+		row[i] = newID
+	}
+
+	switch table {
+	case "sites":
+		for i, c := range cols {
+			switch c {
+			case "code":
+				row[i] = l.code
+			case "cname":
+				row[i] = nil
+				if l.cname != nil {
+					row[i] = *l.cname
+				}
+			case "parent":
+				row[i] = nil
+			}
+		}
+	case "users":
+		// The access can be set per site ID; only keep the access for this
+		// site, as all other sites aren't in the dump.
+		if i := slices.Index(cols, "access"); i > -1 {
+			a, err := l.access(row[i])
+			if err != nil {
+				return false, err
+			}
+			row[i] = a
+		}
+	}
+
+	if id == -1 {
+		values(row...)
+		return true, nil
+	}
+
+	oldID, ok := row[id].(int64)
+	if !ok {
+		return false, fmt.Errorf("column %q: not an ID: %v", cols[id], row[id])
+	}
+	var (
+		insCols = slices.Delete(slices.Clone(cols), id, id+1)
+		insVals = slices.Delete(slices.Clone(row), id, id+1)
+	)
+
+	// Rows that nothing refers to can be inserted in bulk.
+	if !slices.Contains(dumpFirst, table) {
+		values(insVals...)
+		return true, nil
+	}
+
+	var (
+		newID int64
+		err   error
+	)
+	if slices.Contains(dumpShared, table) {
+		newID, err = findShared(ctx, table, cols[id], insCols, insVals)
+		if err != nil {
+			return false, err
+		}
+	}
+	if newID == 0 {
+		quoted := make([]string, 0, len(insCols))
+		for _, c := range insCols {
+			quoted = append(quoted, `"`+c+`"`)
+		}
+		newID, err = zdb.InsertID(ctx, cols[id],
+			`insert into "`+table+`" (`+strings.Join(quoted, ", ")+`) values (?)`, insVals)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if l.ids[table] == nil {
+		l.ids[table] = make(map[int64]int64)
+	}
+	l.ids[table][oldID] = newID
+	return true, nil
+}
+
+func (l siteLoader) access(v any) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	var (
+		access map[string]string
+		keep   = make(map[string]string)
+	)
+	err := json.Unmarshal([]byte(s), &access)
+	if err != nil {
+		return nil, fmt.Errorf("column \"access\": %w", err)
+	}
+	if a, ok := access["all"]; ok {
+		keep["all"] = a
+	}
+	if a, ok := access[strconv.FormatInt(l.hdr.SiteID, 10)]; ok {
+		keep[strconv.FormatInt(l.ids["sites"][l.hdr.SiteID], 10)] = a
+	}
+	j, err := json.Marshal(keep)
+	return string(j), err
+}
+
+// findShared finds the ID of an existing row in one of the shared tables, or
+// returns 0 if there is none.
+func findShared(ctx context.Context, table, idCol string, cols []string, vals []any) (int64, error) {
+	var (
+		where = make([]string, 0, len(cols))
+		args  = make([]any, 0, len(cols))
+	)
+	for i, c := range cols {
+		switch {
+		case vals[i] == nil:
+			where = append(where, `"`+c+`" is null`)
+		case table == "refs" && c == "ref": // Unique index is on lower(ref).
+			where, args = append(where, `lower("ref") = lower(?)`), append(args, vals[i])
+		default:
+			where, args = append(where, `"`+c+`" = ?`), append(args, vals[i])
+		}
+	}
+
+	var id int64
+	err := zdb.Get(ctx, &id, `select "`+idCol+`" from "`+table+`" where `+
+		strings.Join(where, " and ")+` order by "`+idCol+`" limit 1`, args...)
+	if zdb.ErrNoRows(err) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// loadValue converts a value from the JSON in a dump to what the column
+// expects.
+func loadValue(v any, typ string, dialect zdb.Dialect) (any, error) {
+	typ = strings.ToLower(typ)
+	switch vv := v.(type) {
+	case json.Number:
+		if i, err := vv.Int64(); err == nil {
+			return i, nil
+		}
+		return vv.Float64()
+	case string:
+		switch {
+		case isBlob(typ):
+			return base64.StdEncoding.DecodeString(vv)
+		case typ == "date" || strings.HasPrefix(typ, "timestamp"):
+			if t, err := time.Parse(time.RFC3339Nano, vv); err == nil {
+				return convertValue(t, typ, dialect), nil
+			}
+		}
+	}
+	return convertValue(v, typ, dialect), nil
+}
+
+func isBlob(typ string) bool {
+	typ = strings.ToLower(typ)
+	return typ == "blob" || typ == "bytea"
+}
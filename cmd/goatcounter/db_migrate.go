@@ -5,9 +5,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
@@ -21,22 +26,25 @@ import (
 
 func cmdDBMigrate(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
 	var (
-		dev  = f.Bool(false, "dev")
-		test = f.Bool(false, "test")
-		show = f.Bool(false, "show")
+		dev     = f.Bool(false, "dev")
+		test    = f.Bool(false, "test")
+		show    = f.Bool(false, "show")
+		plan    = f.Bool(false, "plan")
+		confirm = f.Bool(false, "confirm")
+		status  = f.Bool(false, "status")
 	)
 	err := f.Parse()
 	if err != nil {
 		return err
 	}
 
-	if len(f.Args) == 0 {
+	if len(f.Args) == 0 && !plan.Bool() && !status.Bool() {
 		return errors.New("need a migration or command")
 	}
 
 	zlog.Config.SetDebug(*debug)
 
-	db, _, err := connectDB(*dbConnect, "", nil, *createdb, false)
+	db, ctx, err := connectDB(*dbConnect, "", nil, *createdb, false)
 	if err != nil {
 		return err
 	}
@@ -54,11 +62,26 @@ func cmdDBMigrate(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
 	m.Test(test.Bool())
 	m.Show(show.Set())
 
-	if zslice.ContainsAny(f.Args, "pending", "list") {
-		have, ran, err := m.List()
-		if err != nil {
-			return err
+	have, ran, err := m.List()
+	if err != nil {
+		return err
+	}
+	pending := pendingMigrations(db, fsys, have, ran)
+	if plan.Bool() {
+		printPlan(pending, len(f.Args) == 0 || slices.Contains(f.Args, "all"), f.Args)
+		return nil
+	}
+	if status.Bool() {
+		return printStatus(ctx, pending)
+	}
+	if slices.Contains(f.Args, "backfill") {
+		if len(pending) > 0 {
+			return errors.New("there are pending migrations; run them first")
 		}
+		return runBackfills(ctx)
+	}
+
+	if zslice.ContainsAny(f.Args, "pending", "list") {
 		diff := zslice.Difference(have, ran)
 		pending := "no pending migrations"
 		if len(diff) > 0 {
@@ -82,5 +105,187 @@ func cmdDBMigrate(f zli.Flags, dbConnect, debug *string, createdb *bool) error {
 		return nil
 	}
 
+	if !confirm.Bool() && !show.Set() && !test.Bool() {
+		d := destructive(pending, slices.Contains(f.Args, "all"), f.Args)
+		if len(d) > 0 {
+			return fmt.Errorf("%s\nReview with -plan, and add -confirm to run", d)
+		}
+	}
+
 	return m.Run(f.Args...)
 }
+
+// autoMigrate runs all pending migrations for -automigrate, refusing to run
+// destructive ones unless allowDestructive is set.
+func autoMigrate(db zdb.DB, dev, allowDestructive bool) error {
+	fsys, err := zfs.EmbedOrDir(goatcounter.DB, "", dev)
+	if err != nil {
+		return err
+	}
+	m, err := zdb.NewMigrate(db, fsys, gomig.Migrations)
+	if err != nil {
+		return err
+	}
+
+	have, ran, err := m.List()
+	if err != nil {
+		return err
+	}
+	if !allowDestructive {
+		if d := destructive(pendingMigrations(db, fsys, have, ran), true, nil); d != "" {
+			return fmt.Errorf("-automigrate: not running %s\n"+
+				"Run them with \"goatcounter db migrate -confirm all\", or add -automigrate-destructive", d)
+		}
+	}
+	return m.Run("all")
+}
+
+// Migrations can be marked as destructive with a "-- destructive: reason"
+// comment; Go migrations are marked in gomig.Destructive.
+var reDestructive = regexp.MustCompile(`(?m)^--\s*destructive:\s*(.+?)\s*$`)
+
+type migration struct {
+	Name        string
+	File        string // Empty for Go migrations.
+	SQL         string
+	Destructive string // Reason it's destructive; empty if it's not.
+}
+
+// pendingMigrations gets all migrations that haven't run yet.
+func pendingMigrations(db zdb.DB, fsys fs.FS, have, ran []string) []migration {
+	dialect := "sqlite"
+	if db.SQLDialect() == zdb.DialectPostgreSQL {
+		dialect = "postgres"
+	}
+
+	var pending []migration
+	for _, name := range zslice.Difference(have, ran) {
+		mig := migration{Name: name}
+		if _, ok := gomig.Migrations[name]; ok {
+			mig.Destructive = gomig.Destructive[name]
+			pending = append(pending, mig)
+			continue
+		}
+
+	files:
+		for _, f := range []string{name + ".sql", name + ".gotxt", name + "-" + dialect + ".sql", name + "-" + dialect + ".gotxt"} {
+			for _, dir := range []string{"db/migrate", "migrate"} {
+				b, err := fs.ReadFile(fsys, path.Join(dir, f))
+				if err == nil {
+					mig.File, mig.SQL = f, string(b)
+					break files
+				}
+			}
+		}
+		if s := reDestructive.FindStringSubmatch(mig.SQL); s != nil {
+			mig.Destructive = s[1]
+		}
+		pending = append(pending, mig)
+	}
+	return pending
+}
+
+// migrationName gets the migration name from a name or path as accepted on the
+// commandline.
+func migrationName(n string) string {
+	n = path.Base(n)
+	for _, s := range []string{".sql", ".gotxt", "-sqlite", "-postgres"} {
+		n = strings.TrimSuffix(n, s)
+	}
+	return n
+}
+
+func selected(mig migration, all bool, names []string) bool {
+	return all || slices.ContainsFunc(names, func(n string) bool { return migrationName(n) == migrationName(mig.Name) })
+}
+
+// destructive gets an error message for all selected destructive migrations,
+// or an empty string if there are none.
+func destructive(pending []migration, all bool, names []string) string {
+	var d []string
+	for _, mig := range pending {
+		if mig.Destructive != "" && selected(mig, all, names) {
+			d = append(d, fmt.Sprintf("\t%s: %s", mig.Name, mig.Destructive))
+		}
+	}
+	if len(d) == 0 {
+		return ""
+	}
+	return "destructive migrations:\n" + strings.Join(d, "\n")
+}
+
+func printPlan(pending []migration, all bool, names []string) {
+	var n int
+	for _, mig := range pending {
+		if !selected(mig, all, names) {
+			continue
+		}
+		n++
+
+		class := "non-destructive"
+		if mig.Destructive != "" {
+			class = "DESTRUCTIVE: " + mig.Destructive
+		}
+		fmt.Fprintf(zli.Stdout, "%s (%s)\n", mig.Name, class)
+		if mig.File == "" {
+			fmt.Fprintln(zli.Stdout, "\tGo migration")
+		} else {
+			fmt.Fprintf(zli.Stdout, "\t%s\n", strings.ReplaceAll(strings.TrimSpace(mig.SQL), "\n", "\n\t"))
+		}
+		fmt.Fprintln(zli.Stdout)
+	}
+	if n == 0 {
+		fmt.Fprintln(zli.Stdout, "no pending migrations")
+	}
+}
+
+func printStatus(ctx context.Context, pending []migration) error {
+	fmt.Fprintf(zli.Stdout, "%d pending migrations\n", len(pending))
+	for _, mig := range pending {
+		fmt.Fprintf(zli.Stdout, "\t%s\n", mig.Name)
+	}
+
+	list, err := gomig.ListBackfills(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(zli.Stdout, "\n%d backfills\n", len(list))
+	for _, p := range list {
+		fmt.Fprintf(zli.Stdout, "\t%s: %s\n", p.Name, backfillStatus(p))
+	}
+	return nil
+}
+
+func backfillStatus(p gomig.BackfillProgress) string {
+	switch {
+	case p.Done:
+		return fmt.Sprintf("done; processed %d, finished at %s", p.Processed, p.Updated.Format(time.DateTime))
+	case p.Updated.IsZero():
+		return "not started"
+	default:
+		return fmt.Sprintf("in progress; processed %d, at %q, last batch at %s",
+			p.Processed, p.Cursor, p.Updated.Format(time.DateTime))
+	}
+}
+
+// runBackfills runs all backfills to completion; the progress is stored after
+// every batch, so it can be interrupted and started again.
+func runBackfills(ctx context.Context) error {
+	for {
+		done, err := gomig.RunBackfills(ctx, 500, time.Now().Add(10*time.Second))
+		if err != nil {
+			return err
+		}
+
+		list, err := gomig.ListBackfills(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range list {
+			fmt.Fprintf(zli.Stdout, "%s: %s\n", p.Name, backfillStatus(p))
+		}
+		if done {
+			return nil
+		}
+	}
+}
@@ -5,11 +5,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/db/migrate/gomig"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zdb"
 	"zgo.at/zli"
@@ -98,6 +107,388 @@ func TestDBMigrate(t *testing.T) {
 	}
 }
 
+func TestDBMigratePlan(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "-plan")
+	wantExit(t, exit, out, 0)
+	if out.String() != "no pending migrations\n" {
+		t.Error(out.String())
+	}
+
+	fsys := fstest.MapFS{
+		"db/migrate/2020-01-01-1-a.sql":   {Data: []byte("-- destructive: drops x\ndrop table x;\n")},
+		"db/migrate/2020-01-01-2-b.gotxt": {Data: []byte("create table y (y int);\n")},
+	}
+	pending := pendingMigrations(zdb.MustGetDB(ctx), fsys, []string{"2020-01-01-1-a", "2020-01-01-2-b", "2020-01-01-3-c"}, []string{"2020-01-01-3-c"})
+	if len(pending) != 2 || pending[0].Destructive != "drops x" || pending[1].Destructive != "" || pending[1].File != "2020-01-01-2-b.gotxt" {
+		t.Fatalf("%#v", pending)
+	}
+
+	if d := destructive(pending, true, nil); !strings.Contains(d, "2020-01-01-1-a: drops x") {
+		t.Errorf("all: %q", d)
+	}
+	if d := destructive(pending, false, []string{"./db/migrate/2020-01-01-2-b.gotxt"}); d != "" {
+		t.Errorf("b: %q", d)
+	}
+	if d := destructive(pending, false, []string{"db/migrate/2020-01-01-1-a.sql"}); d == "" {
+		t.Errorf("a: %q", d)
+	}
+}
+
+func TestDBMigrateBackfill(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+
+	ins := zdb.NewBulkInsert(ctx, "size_stats", []string{"site_id", "path_id", "day", "width", "count"})
+	ins.Values(1, 1, "2020-01-01", 1920, 3)
+	ins.Values(1, 1, "2020-01-01", 1440, 2)
+	ins.Values(1, 1, "2020-01-01", 400, 4)
+	ins.Values(1, 1, "2020-01-02", 800, 1)
+	ins.Values(1, 1, "2020-01-02", 0, 2)
+	ins.Values(1, 1, "2020-01-03", 1920, 1)
+	ins.Values(1, 1, "2020-01-05", 1920, 7) // After the migration.
+	err := ins.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zdb.Exec(ctx, `insert into device_stats (site_id, path_id, day, device, count) values
+		(1, 1, '2020-01-03', 'mobile', 99), (1, 1, '2020-01-05', 'desktop', 8)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zdb.Exec(ctx, `insert into store (key, value) values
+		('backfill:2026-10-16-07-device-stats', '{"started":"2020-01-03T12:00:00Z"}')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	{ // Batches
+		p := gomig.BackfillProgress{Started: time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC)}
+		n, done, err := gomig.DeviceStats(ctx, &p, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 || done || p.Cursor != "1/2020-01-02" {
+			t.Fatalf("n=%d; done=%t; cursor=%q", n, done, p.Cursor)
+		}
+		n, done, err = gomig.DeviceStats(ctx, &p, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || !done || p.Cursor != "1/2020-01-03" {
+			t.Fatalf("n=%d; done=%t; cursor=%q", n, done, p.Cursor)
+		}
+	}
+
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "-status")
+	wantExit(t, exit, out, 0)
+	if !strings.Contains(out.String(), "2026-10-16-07-device-stats: not started") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "backfill")
+	wantExit(t, exit, out, 0)
+	out.Reset()
+
+	runCmd(t, exit, "db", "migrate", "-db="+dbc, "-status")
+	wantExit(t, exit, out, 0)
+	if !strings.Contains(out.String(), "2026-10-16-07-device-stats: done; processed 3") {
+		t.Error(out.String())
+	}
+
+	have := zdb.DumpString(ctx, `select substr(cast(day as varchar), 1, 10) as day, device, count
+		from device_stats order by day, device`)
+	want := `
+		day         device   count
+		2020-01-01  desktop  5
+		2020-01-01  mobile   4
+		2020-01-02  tablet   1
+		2020-01-02  unknown  2
+		2020-01-03  desktop  1
+		2020-01-05  desktop  8`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestDBBackup(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/a"}, goatcounter.Hit{Path: "/b"})
+
+	tmp := t.TempDir()
+	backup := tmp + "/backup"
+	restore := "sqlite+" + tmp + "/restore.sqlite3"
+	if pgSQL {
+		dbname := "goatcounter_test_restore_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		err := exec.Command("createdb", dbname).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { exec.Command("dropdb", dbname).Run() })
+		restore = "postgresql+dbname=" + dbname
+	}
+
+	runCmd(t, exit, "db", "backup", "-db="+dbc, "-o="+backup)
+	wantExit(t, exit, out, 0)
+	if !strings.Contains(out.String(), "2 pageviews") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	var meta backupMeta
+	j, err := os.ReadFile(backup + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(j, &meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Rows["hits"] != 2 || meta.Rows["sites"] != 1 || meta.Schema == "" || meta.Version != goatcounter.Version {
+		t.Errorf("%s", j)
+	}
+
+	runCmd(t, exit, "db", "backup", "-db="+dbc, "-o="+backup)
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), "already exists") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "restore", "-db="+restore, "-i="+backup)
+	wantExit(t, exit, out, 0)
+	if !strings.Contains(out.String(), "restored backup") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	{
+		db, err := zdb.Connect(context.Background(), zdb.ConnectOptions{Connect: restore})
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := zdb.DumpString(zdb.WithDB(context.Background(), db), `select path from paths order by path`)
+		db.Close()
+		want := `
+			path
+			/a
+			/b`
+		if d := zdb.Diff(have, want); d != "" {
+			t.Error(d)
+		}
+	}
+
+	// Don't overwrite without -force.
+	runCmd(t, exit, "db", "restore", "-db="+restore, "-i="+backup)
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), "add -force") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "restore", "-db="+restore, "-i="+backup, "-force")
+	wantExit(t, exit, out, 0)
+	out.Reset()
+
+	// Backup from a newer version.
+	meta.Migrations = append(meta.Migrations, "9999-01-01-1-future")
+	j, _ = json.Marshal(meta)
+	err = os.WriteFile(backup+".json", j, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, exit, "db", "restore", "-db="+restore, "-i="+backup, "-force")
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), "9999-01-01-1-future") {
+		t.Error(out.String())
+	}
+}
+
+func TestDBCopy(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", Ref: "https://example.com"},
+		goatcounter.Hit{Path: "/b", Size: []float64{1920, 1080, 1}},
+		goatcounter.Hit{Path: "/a", Event: true})
+	runCmd(t, exit, "db", "create", "apitoken", "-db="+dbc, "-user=1", "-perm=count", "-name=test")
+	wantExit(t, exit, out, 0)
+	out.Reset()
+
+	// Copy to the other engine and back, or to SQLite and back to SQLite if
+	// we're not testing PostgreSQL.
+	tmp := t.TempDir()
+	via, back := "sqlite+"+tmp+"/via.sqlite3", "sqlite+"+tmp+"/back.sqlite3"
+	if pgSQL {
+		dbname := "goatcounter_test_copy_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		err := exec.Command("createdb", dbname).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { exec.Command("dropdb", dbname).Run() })
+		back = "postgresql+dbname=" + dbname
+	}
+
+	runCmd(t, exit, "db", "copy", "-from="+dbc, "-to="+via)
+	wantExit(t, exit, out, 0)
+	if !strings.Contains(out.String(), "all row counts match") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "copy", "-from="+via, "-to="+back)
+	wantExit(t, exit, out, 0)
+	out.Reset()
+
+	backDB, err := zdb.Connect(context.Background(), zdb.ConnectOptions{Connect: back})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backDB.Close()
+	backCtx := zdb.WithDB(context.Background(), backDB)
+
+	for _, q := range []string{
+		`select site_id, cname, settings, created_at from sites order by site_id`,
+		`select user_id, site_id, email, access, created_at from users order by user_id`,
+		`select api_token_id, site_id, user_id, name, token, permissions from api_tokens order by api_token_id`,
+		`select path_id, site_id, path, event from paths order by path_id`,
+		`select ref_id, ref, ref_scheme from refs order by ref_id`,
+		`select size_id, width, height, scale, size from sizes order by size_id`,
+		`select hit_id, site_id, path_id, ref_id, session, size_id, created_at from hits order by hit_id`,
+		`select site_id, path_id, hour, total from hit_counts order by site_id, path_id, hour`,
+		`select site_id, path_id, day, stats from hit_stats order by site_id, path_id, day`,
+	} {
+		want, have := zdb.DumpString(ctx, q), zdb.DumpString(backCtx, q)
+		if d := zdb.Diff(have, want); d != "" {
+			t.Errorf("%s\n%s", q, d)
+		}
+	}
+
+	// New rows don't collide with the copied IDs.
+	var id int64
+	err = backDB.Get(backCtx, &id, `select max(path_id) from paths`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := zdb.InsertID(backCtx, "path_id", `insert into paths (site_id, path) values (1, '/new')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID <= id {
+		t.Errorf("new path_id %d <= %d", newID, id)
+	}
+
+	// Refuse to copy to a database that's not empty.
+	runCmd(t, exit, "db", "copy", "-from="+dbc, "-to="+back)
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), "isn't empty") {
+		t.Error(out.String())
+	}
+}
+
+func TestDBDumpSite(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+
+	now := ztime.Now()
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", Ref: "https://example.com", CreatedAt: now},
+		goatcounter.Hit{Path: "/b", Size: []float64{1920, 1080, 1}, CreatedAt: now},
+		goatcounter.Hit{Path: "/a", CreatedAt: now.Add(-24 * time.Hour)},
+		goatcounter.Hit{Path: "/e", Event: true, CreatedAt: now})
+	runCmd(t, exit, "db", "create", "apitoken", "-db="+dbc, "-user=1", "-perm=count", "-name=test")
+	wantExit(t, exit, out, 0)
+	out.Reset()
+
+	totals := func(ctx context.Context, code string) string {
+		t.Helper()
+		var site goatcounter.Site
+		err := site.ByCode(ctx, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var users goatcounter.Users
+		err = users.BySite(ctx, site.ID)
+		if err != nil || len(users) != 1 {
+			t.Fatalf("%d users: %v", len(users), err)
+		}
+		ctx = goatcounter.WithUser(goatcounter.WithSite(ctx, &site), &users[0])
+
+		tc, err := goatcounter.GetTotalCount(ctx, ztime.NewRange(now.Add(-48*time.Hour)).To(now), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []struct {
+			Path  string `db:"path"`
+			Total int    `db:"total"`
+			Ref   string `db:"ref"`
+		}
+		err = zdb.Select(ctx, &paths, `select path, sum(total) as total, ref from ref_counts
+			join paths using (path_id) join refs using (ref_id)
+			where ref_counts.site_id = $1 group by path, ref order by path, ref`, site.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tokens []string
+		err = zdb.Select(ctx, &tokens, `select token from api_tokens where site_id = $1 and user_id = $2`,
+			site.ID, users[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%+v\n%+v\n%d tokens\n%s", tc, paths, len(tokens), users[0].Email)
+	}
+	want := totals(ctx, "gctest")
+
+	dump := t.TempDir() + "/site.gz"
+	runCmd(t, exit, "db", "dump-site", "-db="+dbc, "-site=gctest", "-o="+dump)
+	wantExit(t, exit, out, 0)
+	if !strings.Contains(out.String(), "with 4 pageviews") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	// Load to the same database; needs a new code and cname.
+	runCmd(t, exit, "db", "load-site", "-db="+dbc, "-i="+dump)
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), "use -code") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "load-site", "-db="+dbc, "-i="+dump, "-code=copy")
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), "use -cname") {
+		t.Error(out.String())
+	}
+	out.Reset()
+
+	runCmd(t, exit, "db", "load-site", "-db="+dbc, "-i="+dump, "-code=copy", "-cname=copy.localhost")
+	wantExit(t, exit, out, 0)
+	if !strings.Contains(out.String(), `as "copy"`) || !strings.Contains(out.String(), "with 4 pageviews") {
+		t.Error(out.String())
+	}
+	out.Reset()
+	if have := totals(ctx, "copy"); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	// Load to a new database.
+	other := "sqlite+" + t.TempDir() + "/other.sqlite3"
+	runCmd(t, exit, "db", "load-site", "-db="+other, "-createdb", "-i="+dump)
+	wantExit(t, exit, out, 0)
+	out.Reset()
+
+	otherDB, otherCtx, err := connectDB(other, "", nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherDB.Close()
+	if have := totals(otherCtx, "gctest"); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
 func TestDBSite(t *testing.T) {
 	exit, _, out, ctx, dbc := startTest(t)
 
@@ -357,6 +748,110 @@ func TestDBUser(t *testing.T) {
 	}
 }
 
+func TestDBCreateIfNotExists(t *testing.T) {
+	exit, _, out, ctx, dbc := startTest(t)
+	t.Setenv("GCTEST_PASSWORD", "password")
+
+	run := func(wantCode int, kind string, args ...string) createResult {
+		t.Helper()
+		out.Reset()
+		runCmd(t, exit, "db", append([]string{"create", kind, "-db=" + dbc}, args...)...)
+		wantExit(t, exit, out, wantCode)
+		if wantCode != 0 {
+			return createResult{}
+		}
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		var r createResult
+		err := json.Unmarshal([]byte(lines[len(lines)-1]), &r)
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		return r
+	}
+	count := func() string {
+		t.Helper()
+		return zdb.DumpString(ctx, `select
+			(select count(*) from sites) as sites,
+			(select count(*) from users) as users`)
+	}
+
+	{ // site
+		args := []string{"-if-not-exists", "-format=json",
+			"-vhost=stats.stats", "-user.email=foo@foo.foo", "-user.password-env=GCTEST_PASSWORD"}
+		first := run(0, "site", args...)
+		second := run(0, "site", args...)
+
+		if !first.Created || second.Created {
+			t.Errorf("created: first=%t second=%t", first.Created, second.Created)
+		}
+		if first.SiteID == 0 || first.UserID == 0 || first.Cname != "stats.stats" || first.Email != "foo@foo.foo" {
+			t.Errorf("wrong result: %#v", first)
+		}
+		second.Created = true
+		if second != first {
+			t.Errorf("\nfirst:  %#v\nsecond: %#v", first, second)
+		}
+		if d := zdb.Diff(count(), "sites  users\n2      2"); d != "" {
+			t.Error(d)
+		}
+
+		run(1, "site", args[1:]...)
+		if !strings.Contains(out.String(), `already a site for the host "stats.stats"`) {
+			t.Error(out.String())
+		}
+
+		var u goatcounter.User
+		err := u.ByEmail(goatcounter.WithSite(ctx, &goatcounter.Site{ID: first.SiteID}), "foo@foo.foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := u.CorrectPassword("password"); !ok {
+			t.Error("password not set from -user.password-env")
+		}
+	}
+
+	{ // user
+		args := []string{"-if-not-exists", "-format=json",
+			"-site=1", "-email=new@new.new", "-access=readonly", "-reset-link"}
+		first := run(0, "user", args...)
+		second := run(0, "user", args...)
+
+		if !first.Created || second.Created {
+			t.Errorf("created: first=%t second=%t", first.Created, second.Created)
+		}
+		if first.SiteID != 1 || first.UserID == 0 || first.Email != "new@new.new" ||
+			!strings.Contains(first.ResetLink, "/user/reset/invite-") {
+			t.Errorf("wrong result: %#v", first)
+		}
+		if second.ResetLink != "" {
+			t.Errorf("reset link for existing user: %q", second.ResetLink)
+		}
+		second.Created, second.ResetLink = true, first.ResetLink
+		if second != first {
+			t.Errorf("\nfirst:  %#v\nsecond: %#v", first, second)
+		}
+		if d := zdb.Diff(count(), "sites  users\n2      3"); d != "" {
+			t.Error(d)
+		}
+
+		run(1, "user", args[1:]...)
+		if !strings.Contains(out.String(), `already a user with the email "new@new.new"`) {
+			t.Error(out.String())
+		}
+	}
+
+	{ // Text output.
+		out.Reset()
+		runCmd(t, exit, "db", "create", "user", "-db="+dbc, "-if-not-exists",
+			"-site=1", "-email=new@new.new", "-access=readonly")
+		wantExit(t, exit, out, 0)
+		if !strings.Contains(out.String(), "already exists: email=new@new.new site=1") {
+			t.Error(out.String())
+		}
+	}
+}
+
 func TestDBAPIToken(t *testing.T) {
 	exit, _, out, ctx, dbc := startTest(t)
 
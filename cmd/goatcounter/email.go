@@ -0,0 +1,174 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/dkim"
+	"zgo.at/goatcounter/v2/mailer"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+	"zgo.at/zvalidate"
+)
+
+const usageEmail = `
+Send email with the configured transport.
+
+Commands:
+
+  test <address>  Send a test email to this address, to check if the email
+                  settings work. Errors from the SMTP server or email API are
+                  printed, and the exit code is 1 if the email can't be sent.
+
+Flags:
+
+  -debug       Modules to debug, comma-separated or 'all' for all modules.
+               See "goatcounter help debug" for a list of modules.
+
+  -smtp, -email-api, -email-api-key, -email-from, -dkim-key, -dkim-domain,
+  -dkim-selector
+               Send email with these settings; this is the same as the flags
+               for "goatcounter serve".
+`
+
+func cmdEmail(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+	defer func() { ready <- struct{}{} }()
+
+	var (
+		debug       = f.String("", "debug").Pointer()
+		smtp        = f.String(blackmail.ConnectWriter, "smtp").Pointer()
+		emailAPI    = f.String("", "email-api").Pointer()
+		emailAPIKey = f.String("", "email-api-key").Pointer()
+		from        = f.String("", "email-from").Pointer()
+		dkimKey     = f.String("", "dkim-key").Pointer()
+		dkimDomain  = f.String("", "dkim-domain").Pointer()
+		dkimSel     = f.String("goatcounter", "dkim-selector").Pointer()
+	)
+	cmd, err := f.ShiftCommand()
+	if err != nil && !errors.Is(err, zli.ErrCommandNoneGiven{}) {
+		return err
+	}
+	switch cmd {
+	default:
+		return errors.Errorf("unknown command for \"email\": %q", cmd)
+	case "":
+		return errors.New("\"email\" needs a subcommand; see \"goatcounter help email\"")
+	case "test":
+	}
+
+	err = f.Parse()
+	if err != nil {
+		return err
+	}
+	zlog.Config.SetDebug(*debug)
+
+	if len(f.Args) != 1 {
+		return errors.New("\"email test\" needs exactly one address")
+	}
+	to := f.Args[0]
+
+	v := zvalidate.New()
+	v.Email("address", to)
+	*from = flagFrom(*from, "", &v)
+	w := setupMail(&v, *smtp, *emailAPI, *emailAPIKey, *from, *dkimKey, *dkimDomain, *dkimSel)
+	if v.HasErrors() {
+		return v
+	}
+
+	// Write the message to a buffer first, as blackmail doesn't report errors
+	// from the writer.
+	msg := new(bytes.Buffer)
+	err = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(msg)).Send(
+		"GoatCounter test email",
+		blackmail.From("GoatCounter", *from),
+		blackmail.To(to),
+		blackmail.Bodyf("This is a test email from GoatCounter, sent with the %q transport.\n", w.Transport().Name()))
+	if err != nil {
+		return err
+	}
+	w.Errors = nil // Don't log the error as well as printing it.
+	_, err = w.Write(msg.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if _, ok := w.Transport().(mailer.Print); !ok {
+		fmt.Fprintf(zli.Stdout, "Sent test email to %s with %q\n", to, w.Transport().Name())
+	}
+	return nil
+}
+
+// Writer set up by setupMail(), for setupOutbox().
+var mailWriter *mailer.Writer
+
+// setupMail sets blackmail.DefaultMailer to send all email with the SMTP
+// server or email API from the flags, signing it with DKIM if dkimKey is set.
+//
+// The API key for -email-api can also be set with $GOATCOUNTER_EMAIL_API_KEY,
+// or $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY for SES.
+func setupMail(v *zvalidate.Validator, smtp, api, apiKey, from, dkimKey, dkimDomain, dkimSel string) *mailer.Writer {
+	if apiKey == "" {
+		apiKey = os.Getenv("GOATCOUNTER_EMAIL_API_KEY")
+	}
+	if apiKey == "" && strings.HasPrefix(api, "ses:") && os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		apiKey = os.Getenv("AWS_ACCESS_KEY_ID") + ":" + os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	t, err := mailer.New(smtp, api, apiKey, zli.Stdout)
+	if err != nil {
+		v.Append("-email-api", err.Error())
+		return nil
+	}
+	w := mailer.NewWriter(t)
+	w.Errors = func(err error) {
+		zlog.Module("email").Fields(zlog.F{"transport": t.Name()}).Error(err)
+	}
+
+	// Load the key here so that errors are reported on startup, rather than
+	// when sending the first email.
+	if dkimKey != "" {
+		if dkimDomain == "" {
+			_, dkimDomain, _ = strings.Cut(from, "@")
+		}
+		if dkimDomain == "" {
+			dkimDomain, _ = os.Hostname()
+		}
+		signer, err := dkim.Load(dkimDomain, dkimSel, dkimKey)
+		if err != nil {
+			v.Append("-dkim-key", err.Error())
+		} else {
+			w.Sign = signer.Sign
+		}
+	}
+
+	blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(w))
+	mailWriter = w
+	return w
+}
+
+// setupOutbox stores emails that couldn't be sent in the database, so that
+// they're retried by the cron job.
+func setupOutbox(ctx context.Context) {
+	w := mailWriter
+	if w == nil {
+		return
+	}
+	if _, ok := w.Transport().(mailer.Print); ok {
+		return
+	}
+
+	goatcounter.Config(ctx).Mail = w.Transport()
+	w.Outbox = func(from string, to []string, msg []byte, sendErr error) error {
+		return goatcounter.QueueEmail(ctx, from, to, msg, sendErr)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zgo.at/zli"
+)
+
+func TestEmailTest(t *testing.T) {
+	var (
+		status = 200
+		to     string
+		msg    string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		to = r.FormValue("to")
+		if f, _, err := r.FormFile("message"); err == nil {
+			b, _ := io.ReadAll(f)
+			msg = string(b)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"message": "Domain not found: mg.example.com"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	exit, _, out := zli.Test(t)
+
+	t.Run("stdout", func(t *testing.T) {
+		runCmd(t, exit, "email", "test", "-email-from=test@example.com", "someone@example.net")
+		wantExit(t, exit, out, 0)
+		if !strings.Contains(out.String(), "Subject: GoatCounter test email") {
+			t.Error(out.String())
+		}
+		out.Reset()
+	})
+
+	t.Run("mailgun", func(t *testing.T) {
+		runCmd(t, exit, "email", "test", "-email-from=test@example.com",
+			"-email-api=mailgun:mg.example.com,"+srv.URL, "-email-api-key=key-1",
+			"someone@example.net")
+		wantExit(t, exit, out, 0)
+		if !strings.Contains(out.String(), `Sent test email to someone@example.net with "mailgun"`) {
+			t.Error(out.String())
+		}
+		if to != "someone@example.net" || !strings.Contains(msg, "Subject: GoatCounter test email") {
+			t.Errorf("to=%q; msg=\n%s", to, msg)
+		}
+		out.Reset()
+	})
+
+	t.Run("error", func(t *testing.T) {
+		status = 404
+		runCmd(t, exit, "email", "test", "-email-from=test@example.com",
+			"-email-api=mailgun:mg.example.com,"+srv.URL, "-email-api-key=key-1",
+			"someone@example.net")
+		wantExit(t, exit, out, 1)
+		if !strings.Contains(out.String(), "404 Not Found: Domain not found: mg.example.com") {
+			t.Error(out.String())
+		}
+		out.Reset()
+	})
+
+	t.Run("no key", func(t *testing.T) {
+		t.Setenv("GOATCOUNTER_EMAIL_API_KEY", "")
+		runCmd(t, exit, "email", "test", "-email-api=mailgun:mg.example.com", "someone@example.net")
+		wantExit(t, exit, out, 1)
+		if !strings.Contains(out.String(), "API key is empty") {
+			t.Error(out.String())
+		}
+		out.Reset()
+	})
+}
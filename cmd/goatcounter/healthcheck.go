@@ -0,0 +1,178 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zli"
+	"zgo.at/zlog"
+)
+
+const usageHealthcheck = `
+Check if GoatCounter is up, for use in container health checks and liveness
+probes (e.g. HEALTHCHECK in a Dockerfile).
+
+This requests /status from a running GoatCounter, or pings the database with
+-db, and prints a one-line summary. The check gives up after 5 seconds.
+
+The exit code is 0 if it's healthy, 1 if it's reachable but unhealthy (e.g. an
+error response or a database query that fails), and 2 if it's not reachable at
+all (e.g. nothing listening on the address, or the database can't be opened).
+
+Flags:
+
+  -url         URL of a running GoatCounter; /status is added if there's no
+               path. Use "unix:/path/to/socket" for a GoatCounter listening on
+               a Unix socket. Default: http://127.0.0.1:8080
+
+  -db          Ping this database instead of checking over HTTP:
+               "sqlite+<file>" or "postgres+<connect>"; see "goatcounter help
+               db" for detailed documentation. This is the same connection
+               string as used for "goatcounter serve".
+
+  -debug       Modules to debug, comma-separated or 'all' for all modules.
+               See "goatcounter help debug" for a list of modules.
+
+Examples:
+
+    HEALTHCHECK CMD ["goatcounter", "healthcheck", "-url", "http://127.0.0.1:8080"]
+
+    $ goatcounter healthcheck -db sqlite+/data/goatcounter.sqlite3
+`
+
+// Exit codes for healthcheck.
+const (
+	healthUnhealthy   = 1
+	healthUnreachable = 2
+)
+
+var healthTimeout = 5 * time.Second
+
+func cmdHealthcheck(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
+	defer func() { ready <- struct{}{} }()
+
+	var (
+		u         = f.String("http://127.0.0.1:8080", "url").Pointer()
+		dbConnect = f.String("", "db").Pointer()
+		debug     = f.String("", "debug").Pointer()
+	)
+	err := f.Parse()
+	if err != nil {
+		return err
+	}
+	zlog.Config.SetDebug(*debug)
+
+	var msg string
+	if *dbConnect != "" {
+		msg, err = healthDB(*dbConnect)
+	} else {
+		msg, err = healthHTTP(*u)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(zli.Stdout, msg)
+	return nil
+}
+
+func healthHTTP(u string) (string, error) {
+	client := http.Client{Timeout: healthTimeout}
+	sock, isSock := strings.CutPrefix(u, "unix:")
+	if isSock {
+		if sock == "" {
+			return "", fmt.Errorf("-url: no path after \"unix:\": %q", u)
+		}
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		}
+		u = "http://localhost/status"
+	}
+
+	uu, err := url.Parse(u)
+	if err != nil || uu.Host == "" {
+		return "", fmt.Errorf("-url: not a valid URL: %q", u)
+	}
+	if uu.Path == "" || uu.Path == "/" {
+		uu.Path = "/status"
+	}
+	where := uu.String()
+	if isSock {
+		where = "unix:" + sock
+	}
+
+	start := time.Now()
+	resp, err := client.Get(uu.String())
+	if err != nil {
+		return "", guru.Errorf(healthUnreachable, "unreachable: %s", err)
+	}
+	defer resp.Body.Close()
+	took := time.Since(start).Round(time.Millisecond)
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", guru.Errorf(healthUnreachable, "unreachable: reading response from %s: %s", where, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", guru.Errorf(healthUnhealthy, "unhealthy: %s responded with %q in %s", where, resp.Status, took)
+	}
+
+	var status struct {
+		Version string `json:"version"`
+		Uptime  string `json:"uptime"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil || status.Version == "" {
+		return "", guru.Errorf(healthUnhealthy, "unhealthy: %s doesn't look like GoatCounter's /status", where)
+	}
+	return fmt.Sprintf("healthy: %s responded in %s; version %s, up for %s", where, took, status.Version, status.Uptime), nil
+}
+
+func healthDB(connect string) (string, error) {
+	type result struct {
+		msg string
+		err error
+	}
+	done := make(chan result, 1)
+
+	start := time.Now()
+	go func() {
+		db, ctx, err := connectDB(connect, "", nil, false, false)
+		if err != nil {
+			done <- result{err: guru.Errorf(healthUnreachable, "unreachable: %s", err)}
+			return
+		}
+		defer db.Close()
+
+		ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+		defer cancel()
+		var n int
+		err = zdb.Get(ctx, &n, `select count(*) from version`)
+		if err != nil {
+			done <- result{err: guru.Errorf(healthUnhealthy, "unhealthy: %s", err)}
+			return
+		}
+		done <- result{msg: fmt.Sprintf("healthy: %s database responded in %s",
+			zdb.SQLDialect(ctx), time.Since(start).Round(time.Millisecond))}
+	}()
+
+	select {
+	case r := <-done:
+		return r.msg, r.err
+	case <-time.After(healthTimeout):
+		return "", guru.Errorf(healthUnreachable, "unreachable: no response from the database after %s", healthTimeout)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthcheck(t *testing.T) {
+	stub := func(code int, body string) string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/status" {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(code)
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(s.Close)
+		return s.URL
+	}
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		wantExit int
+		wantOut  string
+	}{
+		{"healthy", stub(200, `{"version":"v2.0.0","uptime":"1h0m0s"}`), 0,
+			"healthy: http://127.0.0.1"},
+		{"error", stub(500, `oops`), healthUnhealthy,
+			`unhealthy: http://127.0.0.1`},
+		{"not goatcounter", stub(200, `<html>`), healthUnhealthy,
+			`doesn't look like GoatCounter`},
+		{"unreachable", closed.URL, healthUnreachable,
+			"unreachable:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exit, _, out, _, _ := startTest(t)
+
+			runCmd(t, exit, "healthcheck", "-url", tt.url)
+			wantExit(t, exit, out, tt.wantExit)
+			if !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("wrong output; want %q\n%s", tt.wantOut, out.String())
+			}
+			if n := strings.Count(strings.TrimSpace(out.String()), "\n"); n > 0 {
+				t.Errorf("more than one line:\n%s", out.String())
+			}
+		})
+	}
+
+	t.Run("db", func(t *testing.T) {
+		exit, _, out, _, dbc := startTest(t)
+
+		runCmd(t, exit, "healthcheck", "-db", dbc)
+		wantExit(t, exit, out, 0)
+		if !strings.Contains(out.String(), "healthy: ") {
+			t.Error(out.String())
+		}
+	})
+
+	t.Run("db unreachable", func(t *testing.T) {
+		exit, _, out, _, _ := startTest(t)
+
+		runCmd(t, exit, "healthcheck", "-db", "sqlite+"+t.TempDir()+"/nonexistent.sqlite3")
+		wantExit(t, exit, out, healthUnreachable)
+		if !strings.Contains(out.String(), "unreachable: ") {
+			t.Error(out.String())
+		}
+	})
+}
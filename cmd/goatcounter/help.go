@@ -34,7 +34,7 @@ func cmdHelp(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		}
 		if a == "all" {
 			topics = []string{"help", "version", "serve", "import",
-				"dashboard", "db", "monitor", "listen", "logfile", "debug"}
+				"dashboard", "db", "monitor", "healthcheck", "email", "listen", "logfile", "debug", "metrics"}
 			break
 		}
 		topics = append(topics, strings.ToLower(a))
@@ -68,17 +68,20 @@ func cmdHelp(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 }
 
 var usage = map[string]string{
-	"":          usageTop,
-	"help":      usageHelp,
-	"serve":     usageServe,
-	"saas":      usageSaas,
-	"monitor":   usageMonitor,
-	"import":    usageImport,
-	"dashboard": usageDashboard,
-	"db":        helpDB,
-	"listen":    helpListen,
-	"logfile":   helpLogfile,
-	"debug":     helpDebug,
+	"":            usageTop,
+	"help":        usageHelp,
+	"serve":       usageServe,
+	"saas":        usageSaas,
+	"monitor":     usageMonitor,
+	"healthcheck": usageHealthcheck,
+	"email":       usageEmail,
+	"import":      usageImport,
+	"dashboard":   usageDashboard,
+	"db":          helpDB,
+	"listen":      helpListen,
+	"logfile":     helpLogfile,
+	"debug":       helpDebug,
+	"metrics":     helpMetrics,
 
 	"version": `
 Show version and build information. This is printed as key=value, separated by
@@ -100,11 +103,14 @@ Commands:
   dashboard    Show dashboard statistics in the terminal.
   db           Modify the database and print database info.
   monitor      Monitor for pageviews.
+  healthcheck  Check if GoatCounter is up, for container health checks.
+  email        Send a test email.
 
 Extra help topics:
   listen       Detailed documentation on -listen and -tls flags.
   logfile      Documentation on importing from logfiles.
   debug        List of modules accepted by the -debug flag.
+  metrics      List of Prometheus metrics for the -metrics flag.
 `
 
 const usageHelp = `
@@ -216,6 +222,45 @@ Proxy Setup:
     want to read "*" but "*.pem" (some proxies ignore invalid certificates, for
     others it's a fatal error).
 
+Unix socket:
+
+    If the proxy runs on the same machine you can also use a Unix socket, so
+    you don't need to pick a port and access is controlled by the file
+    permissions:
+
+        goatcounter serve -listen unix:/run/goatcounter/http.sock -listen-mode 0660
+
+    For example with nginx:
+
+        proxy_pass http://unix:/run/goatcounter/http.sock;
+
+    A stale socket file is removed on startup if nothing is listening on it,
+    and the socket is removed on shutdown. TLS can't be used with a Unix socket:
+    -tls defaults to "proxy", and only "http" and "proxy" are allowed.
+
+    Use "goatcounter healthcheck -url unix:/run/goatcounter/http.sock" to check
+    if it's running.
+
+PROXY protocol:
+
+    Load balancers in TCP mode (such as HAProxy with "mode tcp" or an AWS NLB)
+    don't add a X-Forwarded-For header, so every visitor seems to come from the
+    load balancer. Most can send the client address with the PROXY protocol
+    (v1 or v2) instead, which GoatCounter reads with the -proxy-protocol flag:
+
+        goatcounter serve -proxy-protocol 10.0.0.0/16,2001:db8::/32
+
+    The header is only accepted from these addresses; connections from other
+    addresses that send a PROXY header are rejected, and connections without
+    one are served as usual. Connections on a Unix socket are always accepted.
+    The X-Forwarded-For and X-Real-Ip headers are ignored with -proxy-protocol,
+    as any client can send those.
+
+    Connections from these addresses without a PROXY header are rejected, unless
+    "lenient" is added (e.g. for health checks that don't send one):
+
+        goatcounter serve -proxy-protocol 10.0.0.0/16,lenient
+
 Using a non-standard port:
 
     If you make GoatCounter publicly accessibly on non-standard port (i.e. not
@@ -228,6 +273,47 @@ Using a non-standard port:
     accessible on :9000 or if there's a proxy in front of it redirecting :80 and
     :443 to :9000. Since most people will use the standard ports you need to
     explicitly tell GoatCounter to use a non-standard port.
+
+systemd socket activation:
+
+    GoatCounter can use sockets that are opened by systemd instead of listening
+    on -listen itself, so that it doesn't need any capabilities to use port 80
+    and 443, and connections are queued (rather than refused) while restarting.
+
+    Sockets are picked by their name (FileDescriptorName= in the .socket unit):
+    "https" is used as the -listen socket and "http" for the port 80 redirect
+    (with -tls rdr), or just "http" if TLS isn't served (with -tls http or
+    proxy). A single socket is always used as the -listen socket, whatever the
+    name. The -listen flag is ignored.
+
+    For example, /etc/systemd/system/goatcounter-https.socket:
+
+        [Socket]
+        ListenStream=443
+        FileDescriptorName=https
+        Service=goatcounter.service
+
+        [Install]
+        WantedBy=sockets.target
+
+    And /etc/systemd/system/goatcounter-http.socket:
+
+        [Socket]
+        ListenStream=80
+        FileDescriptorName=http
+        Service=goatcounter.service
+
+        [Install]
+        WantedBy=sockets.target
+
+    And in goatcounter.service:
+
+        [Unit]
+        Requires=goatcounter-https.socket goatcounter-http.socket
+        After=goatcounter-https.socket goatcounter-http.socket
+
+        [Service]
+        ExecStart=/usr/bin/goatcounter serve -tls acme,rdr
 `
 
 const helpDebug = `
@@ -246,7 +332,50 @@ commas.
     import-api     Imports from the API.
     memstore       Storing of pageviews in the database.
     monitor        Additional logs in "goatcounter monitor" .
+    proxy-protocol Connections rejected because of the PROXY header.
     session        Internal "session" generation to track visitors .
     startup        Some additional logs during startup.
     vacuum         Deletion of old deleted sites and old pageviews.
 `
+
+const helpMetrics = `
+Metrics exposed in the Prometheus text format on /metrics with the -metrics flag
+of "goatcounter serve". The names, types, and labels are stable.
+
+There are no labels for sites, as this can be a lot of series and would expose
+which sites are on the server.
+
+    goatcounter_http_requests_total{code}
+        Counter: HTTP requests, by status code.
+    goatcounter_count_requests_total{method}
+        Counter: requests to /count, by HTTP method.
+    goatcounter_memstore_received_total
+        Counter: pageviews added to the memstore, from /count and the API.
+    goatcounter_memstore_pageviews
+        Gauge: pageviews in the memstore that aren't persisted yet.
+    goatcounter_memstore_sessions
+        Gauge: sessions in the memstore.
+    goatcounter_persist_seconds
+        Summary: time to persist the memstore to the database.
+    goatcounter_persist_pageviews_total
+        Counter: pageviews persisted to the database.
+    goatcounter_cron_task_seconds{task}
+        Summary: time to run a background task.
+    goatcounter_cron_task_errors_total{task}
+        Counter: background tasks that returned an error.
+    goatcounter_db_max_connections
+        Gauge: maximum number of open database connections; 0 is unlimited.
+    goatcounter_db_connections{state}
+        Gauge: open database connections, by state: "in_use" or "idle".
+    goatcounter_db_wait_total
+        Counter: times a query waited for a free database connection.
+    goatcounter_db_wait_seconds_total
+        Counter: total time spent waiting for a free database connection.
+
+Example scrape config:
+
+    scrape_configs:
+      - job_name: 'goatcounter'
+        static_configs:
+          - targets: ['localhost:9100']
+`
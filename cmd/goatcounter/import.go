@@ -14,6 +14,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -53,6 +54,10 @@ Overview:
 
         $ goatcounter import -site=.. -follow /var/log/nginx/access.log
 
+    Pageviews from an address in the site's "Blocked networks" setting are
+    recorded as a bot, just like pageviews sent from the browser. This needs
+    $remote_addr or $xff in the log format.
+
     If you're self-hosting GoatCounter it may be useful to (temporarily)
     increase the ratelimit when importing large files:
 
@@ -129,6 +134,12 @@ Flags:
                        -exclude 'path:glob:/private/**' \
                        access_log
 
+  -keep-status Ignore the "redirect" and "status:[..]" exclude patterns, so that
+               lines with any status code are imported for the status code
+               stats. Only 2xx and 304 responses are counted as pageviews;
+               redirects, errors, etc. are only counted in the status code
+               stats.
+
 Environment:
 
   GOATCOUNTER_API_KEY   API key; requires "Record pageviews" permission.
@@ -209,13 +220,14 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 		silent   = f.Bool(false, "silent").Pointer()
 		follow   = f.Bool(false, "follow").Pointer()
 		exclude  = f.StringList(nil, "exclude").Pointer()
+		keepStat = f.Bool(false, "keep-status").Pointer()
 	)
 	err := f.Parse()
 	if err != nil {
 		return err
 	}
 
-	return func(debug, site, format, date, tyme, datetime string, silent, follow bool, exclude []string) error {
+	return func(debug, site, format, date, tyme, datetime string, silent, follow, keepStat bool, exclude []string) error {
 		files := f.Args
 		if len(files) == 0 {
 			return fmt.Errorf("need a filename")
@@ -260,6 +272,12 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 			return err
 		}
 
+		if keepStat {
+			exclude = slices.DeleteFunc(exclude, func(e string) bool {
+				return e == "redirect" || strings.HasPrefix(strings.TrimPrefix(e, "!"), "status:")
+			})
+		}
+
 		switch format {
 		default:
 			err = importLog(fp, ready, stop, url, key, files[0], format, date, tyme, datetime, follow, silent, exclude)
@@ -274,7 +292,7 @@ func cmdImport(f zli.Flags, ready chan<- struct{}, stop chan struct{}) error {
 			err = importCSV(fp, url, key, silent)
 		}
 		return err
-	}(*debug, *site, *format, *date, *tyme, *datetime, *silent, *follow, *exclude)
+	}(*debug, *site, *format, *date, *tyme, *datetime, *silent, *follow, *keepStat, *exclude)
 }
 
 func importCSV(fp io.ReadCloser, url, key string, silent bool) error {
@@ -374,6 +392,7 @@ func importLog(
 			Ref:       line.Referrer(),
 			Query:     line.Query(),
 			UserAgent: line.UserAgent(),
+			Status:    line.Status(),
 		}
 
 		hit.CreatedAt, err = line.Datetime(scan)
@@ -0,0 +1,257 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/acme"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+)
+
+// listenAndServe serves on the sockets passed by systemd, or listens on
+// server.Addr (and port 80 with zhttp.ServeRedirect) if there are none. An
+// address as "unix:/path" listens on a Unix socket, which is removed again on
+// shutdown. The listeners read the PROXY header if -proxy-protocol is set.
+//
+// This works like zhttp.Serve(): a message is sent on the returned channel
+// once the server is set up, and again once it's shut down after SIGTERM,
+// SIGINT, or a message on stop. SIGHUP calls reload() instead.
+func listenAndServe(listenTLS uint8, stop chan struct{}, server *http.Server,
+	sockets map[string]net.Listener, reload func(),
+) (chan struct{}, error) {
+	var (
+		main, rdr net.Listener
+		err       error
+		l         = zlog.Module("startup")
+	)
+	if len(sockets) > 0 {
+		main, rdr, err = pickListeners(sockets, server.TLSConfig != nil)
+		if err != nil {
+			return nil, err
+		}
+		l.Printf("using socket %s from systemd", main.Addr())
+		if listenTLS&zhttp.ServeRedirect == 0 {
+			rdr = nil
+		}
+	} else if sock, ok := strings.CutPrefix(server.Addr, "unix:"); ok {
+		main, err = listenUnix(sock, unixSocketMode)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		main, err = net.Listen("tcp", server.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if listenTLS&zhttp.ServeRedirect != 0 {
+			rdr, err = net.Listen("tcp", ":80")
+			if err != nil {
+				main.Close()
+				return nil, fmt.Errorf("listening on port 80 for the redirect: %w", err)
+			}
+		}
+	}
+
+	if proxyProtocol.enabled() {
+		main = proxyProtocol.listener(main)
+		if rdr != nil {
+			rdr = proxyProtocol.listener(rdr)
+		}
+	}
+
+	if server.ErrorLog == nil {
+		server.ErrorLog = log.New(httpErrorLog{}, "", 0)
+	}
+	var rdrServer *http.Server
+	if rdr != nil {
+		l.Printf("redirecting %s to %s", rdr.Addr(), main.Addr())
+		rdrServer = &http.Server{
+			Handler:  redirectHTTPS(server.Handler, main.Addr()),
+			ErrorLog: server.ErrorLog,
+		}
+	}
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(main, "", "")
+		} else {
+			err = server.Serve(main)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zlog.Error(err)
+		}
+	}()
+	if rdrServer != nil {
+		go func() {
+			err := rdrServer.Serve(rdr)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				zlog.Error(err)
+			}
+		}()
+	}
+
+	ch := make(chan struct{}, 1)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	ch <- struct{}{}
+
+	go func() {
+	wait:
+		for {
+			select {
+			case s := <-sig:
+				if s == syscall.SIGHUP {
+					if reload != nil {
+						reload()
+					}
+					continue
+				}
+				break wait
+			case <-stop:
+				break wait
+			}
+		}
+		signal.Stop(sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if rdrServer != nil {
+			rdrServer.Shutdown(ctx)
+		}
+		err := server.Shutdown(ctx)
+		if err != nil {
+			zlog.Error(err)
+		}
+		ch <- struct{}{}
+	}()
+	return ch, nil
+}
+
+// listenUnix listens on the Unix socket at path; a stale socket file is
+// removed first if nothing is listening on it. The permissions are set to mode
+// if it's not 0.
+//
+// The socket file is removed when the listener is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	st, err := os.Lstat(path)
+	if err == nil {
+		if st.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listening on %q: file exists and is not a socket", path)
+		}
+		c, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listening on %q: something is already listening on this socket", path)
+		}
+		zlog.Module("startup").Printf("removing stale socket %q", path)
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		err = os.Chmod(path, mode)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("setting permissions on %q: %w", path, err)
+		}
+	}
+	return l, nil
+}
+
+// redirectHTTPS redirects to HTTPS on the address, except for the ACME
+// http-01 challenge, which is served by the handler.
+func redirectHTTPS(h http.Handler, addr net.Addr) http.Handler {
+	var port string
+	if a, ok := addr.(*net.TCPAddr); ok && a.Port != 443 {
+		port = ":" + strconv.Itoa(a.Port)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		http.Redirect(w, r, "https://"+host+port+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// httpErrorLog logs errors from net/http, except for TLS handshake errors as
+// they're just noise from clients and scanners.
+type httpErrorLog struct{}
+
+func (httpErrorLog) Write(b []byte) (int, error) {
+	if !strings.Contains(string(b), "TLS handshake error") {
+		zlog.Module("http").Printf("%s", strings.TrimRight(string(b), "\n"))
+	}
+	return len(b), nil
+}
+
+// Flags that can't be reloaded with SIGHUP.
+var noReload = []string{"-listen", "-listen-mode", "-proxy-protocol", "-tls (except the contents of certificate files)",
+	"-db", "-dbconn", "-db-readonly", "-debug", "-smtp", "-email-*", "-dkim-*",
+	"-ratelimit", "-store-every", "-sqlite-maintenance", "-query-timeout"}
+
+// reloadServe reloads the certificate files, GeoIP database, and lists from
+// files, if they changed. Everything that fails to load keeps the current
+// version.
+func reloadServe(ctx context.Context) {
+	l := zlog.Module("reload")
+
+	var reloaded, failed []string
+	for _, r := range []struct {
+		name string
+		fun  func() (bool, error)
+	}{
+		{"TLS certificates", acme.ReloadCerts},
+		{"GeoIP database", goatcounter.ReloadGeoDB},
+		{"supplemental bot list", func() (bool, error) { return goatcounter.ReloadBotData(ctx) }},
+		{"referrer spam list", goatcounter.ReloadRefspam},
+		{"referrer rules", goatcounter.ReloadRefRules},
+		{"traffic channels", goatcounter.ReloadChannels},
+	} {
+		ok, err := r.fun()
+		if err != nil {
+			l.Errorf("SIGHUP: reloading %s failed; keeping the current version: %s", r.name, err)
+			failed = append(failed, r.name)
+			continue
+		}
+		if ok {
+			reloaded = append(reloaded, r.name)
+		}
+	}
+
+	msg := "nothing changed"
+	if len(reloaded) > 0 {
+		msg = "reloaded " + strings.Join(reloaded, ", ")
+	}
+	if len(failed) > 0 {
+		msg += "; failed: " + strings.Join(failed, ", ")
+	}
+	l.Printf("SIGHUP: %s; these flags need a restart to change: %s", msg, strings.Join(noReload, ", "))
+}
@@ -0,0 +1,87 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"zgo.at/goatcounter/v2/handlers"
+	"zgo.at/zlog"
+)
+
+var defaultLogFormat = zlog.Config.Format
+
+// setLogFormat sets the log format for all logs: "text" for the default
+// human-readable format, or "json" for one JSON object per line.
+func setLogFormat(format string) {
+	if format == "json" {
+		zlog.Config.Format = formatJSON
+		handlers.SetJSONRequestLog(true)
+		return
+	}
+	zlog.Config.Format = defaultLogFormat
+	handlers.SetJSONRequestLog(false)
+}
+
+// formatJSON formats a log entry as a single line of JSON, with the keys:
+//
+//	ts       Time in RFC 3339 format, in UTC.
+//	level    "info", "error", or "debug".
+//	module   Module(s), separated by a ".", if any.
+//	msg      The message; for errors this is the first line of the error.
+//	err      The error, if any; without the stack trace.
+//	stack    Stack trace for errors and panics, if any.
+//
+// Fields are added as extra keys; these are prefixed with "field_" if they
+// conflict with any of the above.
+func formatJSON(l zlog.Log) string {
+	rec := map[string]any{
+		"ts":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level": "info",
+	}
+	switch l.Level {
+	case zlog.LevelErr:
+		rec["level"] = "error"
+	case zlog.LevelDbg:
+		rec["level"] = "debug"
+	}
+	if len(l.Modules) > 0 {
+		rec["module"] = strings.Join(l.Modules, ".")
+	}
+
+	msg := l.Msg
+	if l.Err != nil {
+		err, stack, _ := strings.Cut(strings.TrimSpace(l.Err.Error()), "\n")
+		rec["err"] = err
+		if stack = strings.TrimSpace(stack); stack != "" {
+			rec["stack"] = stack
+		}
+		if msg == "" {
+			msg = err
+		}
+	}
+	rec["msg"] = msg
+
+	for k, v := range l.Data {
+		if _, ok := rec[k]; ok {
+			k = "field_" + k
+		}
+		// Not every value can be encoded as JSON (e.g. a func or channel);
+		// log the value as a string rather than losing the entire entry.
+		if _, err := json.Marshal(v); err != nil {
+			v = fmt.Sprintf("%v", v)
+		}
+		rec[k] = v
+	}
+
+	j, err := json.Marshal(rec)
+	if err != nil { // Should never happen.
+		return fmt.Sprintf(`{"level":"error","msg":%q}`, "formatting log entry: "+err.Error())
+	}
+	return string(j)
+}
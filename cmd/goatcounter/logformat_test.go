@@ -0,0 +1,109 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"zgo.at/zlog"
+)
+
+func parseJSONLog(t *testing.T, out string) []map[string]any {
+	t.Helper()
+
+	var recs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if !strings.HasPrefix(line, "{") { // Output from zli, rather than zlog.
+			continue
+		}
+		var rec map[string]any
+		err := json.Unmarshal([]byte(line), &rec)
+		if err != nil {
+			t.Fatalf("%s\n%s", err, line)
+		}
+		if rec["ts"] == nil || rec["level"] == nil {
+			t.Errorf("no ts or level: %s", line)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestLogFormat(t *testing.T) {
+	_, _, out, _, _ := startTest(t)
+	setLogFormat("json")
+	t.Cleanup(func() { setLogFormat("text") })
+
+	zlog.Print("hello")
+	zlog.Module("cron").Field("task", "vacuum").Error(errors.New("oh noes"))
+	func() {
+		defer zlog.Recover()
+		panic("panic!")
+	}()
+
+	recs := parseJSONLog(t, out.String())
+	if len(recs) != 3 {
+		t.Fatalf("want 3 records, have %d:\n%s", len(recs), out)
+	}
+
+	if recs[0]["level"] != "info" || recs[0]["msg"] != "hello" || recs[0]["module"] != nil {
+		t.Errorf("wrong record: %v", recs[0])
+	}
+	if recs[1]["level"] != "error" || recs[1]["module"] != "cron" || recs[1]["task"] != "vacuum" ||
+		recs[1]["err"] != "oh noes" || recs[1]["msg"] != "oh noes" {
+		t.Errorf("wrong record: %v", recs[1])
+	}
+	if recs[2]["level"] != "error" || recs[2]["module"] != "panic" ||
+		!strings.Contains(recs[2]["err"].(string), "panic!") {
+		t.Errorf("wrong record: %v", recs[2])
+	}
+	if s, _ := recs[2]["stack"].(string); !strings.Contains(s, "logformat_test.go") {
+		t.Errorf("no stack: %v", recs[2])
+	}
+}
+
+func TestLogFormatServe(t *testing.T) {
+	exit, _, out, _, dbc := startTest(t)
+	t.Cleanup(func() { setLogFormat("text") })
+
+	ready := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	go runCmdStop(t, exit, ready, stop, "serve",
+		"-db="+dbc,
+		"-debug=req",
+		"-log-format=json",
+		"-listen=localhost:31878",
+		"-tls=http")
+	<-ready
+
+	req, _ := http.NewRequest("GET", "http://localhost:31878/status", nil)
+	req.Host = "gctest.localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	stop <- struct{}{}
+	mainDone.Wait()
+
+	var found bool
+	for _, rec := range parseJSONLog(t, out.String()) {
+		if rec["module"] != "request" {
+			continue
+		}
+		found = true
+		if rec["path"] != "/status" || rec["code"] != 200.0 || rec["method"] != "GET" {
+			t.Errorf("wrong record: %v", rec)
+		}
+	}
+	if !found {
+		t.Errorf("no request log:\n%s", out)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	_ "time/tzdata"
 
 	"zgo.at/errors"
@@ -52,7 +53,7 @@ func cmdMain(f zli.Flags, ready chan<- struct{}, stop chan struct{}) {
 	defer mainDone.Done()
 
 	cmd, err := f.ShiftCommand("help", "version", "serve", "import",
-		"dashboard", "db", "monitor",
+		"dashboard", "db", "monitor", "healthcheck", "email",
 		"saas", "goat")
 	if zslice.ContainsAny(f.Args, "-h", "-help", "--help") {
 		f.Args = append([]string{cmd}, f.Args...)
@@ -86,6 +87,10 @@ func cmdMain(f zli.Flags, ready chan<- struct{}, stop chan struct{}) {
 		run = cmdSaas
 	case "monitor":
 		run = cmdMonitor
+	case "healthcheck":
+		run = cmdHealthcheck
+	case "email":
+		run = cmdEmail
 	case "import":
 		run = cmdImport
 	case "dashboard":
@@ -156,27 +161,77 @@ func cmdMain(f zli.Flags, ready chan<- struct{}, stop chan struct{}) {
 	zli.Exit(0)
 }
 
+// Connection pool settings from the -dbconn flag.
+type dbPool struct {
+	set, lifetimeSet bool
+	open, idle       int
+	lifetime         time.Duration
+}
+
+// parseDBConn parses the -dbconn flag, as max_open,max_idle[,max_lifetime].
+func parseDBConn(dbConn string) (dbPool, error) {
+	var p dbPool
+	if dbConn == "" {
+		return p, nil
+	}
+
+	parts := strings.Split(dbConn, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return p, errors.New("-dbconn flag: must be as max_open,max_idle or max_open,max_idle,max_lifetime")
+	}
+	var err error
+	p.open, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return p, fmt.Errorf("-dbconn flag: %w", err)
+	}
+	p.idle, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return p, fmt.Errorf("-dbconn flag: %w", err)
+	}
+	if len(parts) == 3 {
+		p.lifetime, err = time.ParseDuration(parts[2])
+		if err != nil {
+			return p, fmt.Errorf("-dbconn flag: %w", err)
+		}
+		p.lifetimeSet = true
+	}
+	p.set = true
+	return p, nil
+}
+
+// apply the pool settings, using the defaults for the database engine if the
+// flag wasn't given.
+//
+// SQLite only allows one writer at a time, so more connections just means more
+// waiting on the lock, and opening a connection is cheap. PostgreSQL connections
+// are expensive to open, and the server has a connection limit shared with
+// everything else, so keep fewer idle connections around and recycle them
+// after a while so that a restart or failover of the server is picked up.
+func (p dbPool) apply(db zdb.DB) {
+	if !p.set {
+		p.open, p.idle = 8, 8
+		if db.SQLDialect() == zdb.DialectPostgreSQL {
+			p.open, p.idle, p.lifetime = 16, 4, 30*time.Minute
+		}
+	} else if !p.lifetimeSet && db.SQLDialect() == zdb.DialectPostgreSQL {
+		p.lifetime = 30 * time.Minute
+	}
+
+	sqlDB := db.DBSQL()
+	sqlDB.SetMaxOpenConns(p.open)
+	sqlDB.SetMaxIdleConns(p.idle)
+	sqlDB.SetConnMaxLifetime(p.lifetime)
+}
+
 func connectDB(connect, dbConn string, migrate []string, create, dev bool) (zdb.DB, context.Context, error) {
 	if strings.Contains(connect, "://") && !strings.Contains(connect, "+") {
 		connect = strings.Replace(connect, "://", "+", 1)
 		zlog.Errorf(`WARNING: the connection string for -db changed from "engine://connectString" to "engine+connectString"; the ://-variant will work for now, but will be removed in a future release`)
 	}
 
-	var open, idle int
-	if dbConn != "" {
-		openS, idleS, ok := strings.Cut(dbConn, ",")
-		if !ok {
-			return nil, nil, errors.New("-dbconn flag: must be as max_open,max_idle")
-		}
-		var err error
-		open, err = strconv.Atoi(openS)
-		if err != nil {
-			return nil, nil, fmt.Errorf("-dbconn flag: %w", err)
-		}
-		idle, err = strconv.Atoi(idleS)
-		if err != nil {
-			return nil, nil, fmt.Errorf("-dbconn flag: %w", err)
-		}
+	pool, err := parseDBConn(dbConn)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	fsys, err := zfs.EmbedOrDir(goatcounter.DB, "db", dev)
@@ -192,8 +247,8 @@ func connectDB(connect, dbConn string, migrate []string, create, dev bool) (zdb.
 		Migrate:      migrate,
 		GoMigrations: gomig.Migrations,
 		Create:       create,
-		MaxOpenConns: open,
-		MaxIdleConns: idle,
+		MaxOpenConns: pool.open,
+		MaxIdleConns: pool.idle,
 		MigrateLog:   func(name string) { zlog.Printf("running migration %q", name) },
 	})
 	var pErr *zdb.PendingMigrationsError
@@ -218,6 +273,7 @@ func connectDB(connect, dbConn string, migrate []string, create, dev bool) (zdb.
 	if err != nil {
 		return nil, nil, err
 	}
+	pool.apply(db)
 
 	// Load languages.
 	var c int
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"zgo.at/blackmail"
 	"zgo.at/goatcounter/v2"
@@ -19,6 +20,7 @@ import (
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/zli"
 	"zgo.at/zlog"
+	"zgo.at/zstd/ztest"
 )
 
 var pgSQL = false
@@ -33,6 +35,36 @@ func TestUsageTabs(t *testing.T) {
 	}
 }
 
+func TestParseDBConn(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    dbPool
+		wantErr string
+	}{
+		{"", dbPool{}, ""},
+		{"16,4", dbPool{set: true, open: 16, idle: 4}, ""},
+		{"-1,-1", dbPool{set: true, open: -1, idle: -1}, ""},
+		{"16,4,1h", dbPool{set: true, lifetimeSet: true, open: 16, idle: 4, lifetime: time.Hour}, ""},
+		{"16,4,0", dbPool{set: true, lifetimeSet: true, open: 16, idle: 4}, ""},
+		{"16", dbPool{}, "must be as"},
+		{"16,4,1h,2", dbPool{}, "must be as"},
+		{"x,4", dbPool{}, "invalid syntax"},
+		{"16,4,x", dbPool{}, "invalid duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have, err := parseDBConn(tt.in)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr == "" && have != tt.want {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, tt.want)
+			}
+		})
+	}
+}
+
 var mu sync.Mutex
 
 func startTest(t *testing.T) (
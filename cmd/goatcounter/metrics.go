@@ -0,0 +1,62 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// serveMetrics serves the Prometheus metrics on /metrics at addr, until the
+// returned function is called.
+func serveMetrics(addr string, db zdb.DB) (func(), error) {
+	stats := func(f func(s sql.DBStats) float64) func() float64 {
+		return func() float64 { return f(db.DBSQL().Stats()) }
+	}
+	metrics.Gauge("goatcounter_memstore_pageviews", func() float64 { return float64(goatcounter.Memstore.Len()) })
+	metrics.Gauge("goatcounter_memstore_sessions", func() float64 { return float64(goatcounter.Memstore.SessionsLen()) })
+	metrics.Gauge("goatcounter_db_max_connections", stats(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	metrics.Gauge("goatcounter_db_connections", stats(func(s sql.DBStats) float64 { return float64(s.InUse) }), "state", "in_use")
+	metrics.Gauge("goatcounter_db_connections", stats(func(s sql.DBStats) float64 { return float64(s.Idle) }), "state", "idle")
+	metrics.Gauge("goatcounter_db_wait_total", stats(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	metrics.Gauge("goatcounter_db_wait_seconds_total", stats(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Errorf("-metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := metrics.WritePrometheus(w)
+		if err != nil {
+			zlog.Module("metrics").Error(err)
+		}
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zlog.Module("metrics").Error(err)
+		}
+	}()
+	zlog.Module("startup").Printf("serving Prometheus metrics on http://%s/metrics", l.Addr())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
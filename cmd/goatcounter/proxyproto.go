@@ -0,0 +1,267 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/zlog"
+)
+
+// PROXY protocol support, as sent by HAProxy, AWS NLB, and some other load
+// balancers in TCP mode to pass on the client address:
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+//
+// Both the text format (v1) and binary format (v2) are supported.
+type proxyProto struct {
+	allow   []netip.Prefix
+	lenient bool
+}
+
+var (
+	proxyProtoV1 = []byte("PROXY ")
+	proxyProtoV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyTimeout = 10 * time.Second
+)
+
+// parseProxyProto parses the -proxy-protocol flag: a comma-separated list of
+// IP addresses or CIDR ranges the PROXY header is accepted from, optionally
+// with "strict" (the default) or "lenient".
+func parseProxyProto(flag string) (proxyProto, error) {
+	var p proxyProto
+	for _, f := range strings.Split(flag, ",") {
+		switch f = strings.TrimSpace(f); f {
+		case "":
+		case "strict":
+			p.lenient = false
+		case "lenient":
+			p.lenient = true
+		default:
+			pfx, err := netip.ParsePrefix(f)
+			if err != nil {
+				addr, err2 := netip.ParseAddr(f)
+				if err2 != nil {
+					return p, fmt.Errorf("not a valid IP address or CIDR range: %q", f)
+				}
+				pfx = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			p.allow = append(p.allow, pfx.Masked())
+		}
+	}
+	if len(p.allow) == 0 {
+		return p, errors.New("need at least one IP address or CIDR range to accept the PROXY header from")
+	}
+	return p, nil
+}
+
+func (p proxyProto) enabled() bool { return len(p.allow) > 0 }
+
+// allowed reports if the PROXY header is accepted from this address. This is
+// always true for Unix sockets, as the file permissions control access.
+func (p proxyProto) allowed(addr net.Addr) bool {
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip, _ := netip.AddrFromSlice(a.IP)
+	ip = ip.Unmap()
+	for _, pfx := range p.allow {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listener wraps l to read the PROXY header from new connections.
+func (p proxyProto) listener(l net.Listener) net.Listener {
+	return &proxyListener{Listener: l, proxyProto: p}
+}
+
+type proxyListener struct {
+	net.Listener
+	proxyProto
+}
+
+// Accept a connection. The header is read on the first Read() or RemoteAddr(),
+// so a slow client doesn't block accepting new connections.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, p: l.proxyProto, r: bufio.NewReader(c)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	p      proxyProto
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	remote, err := c.parse()
+	if err != nil {
+		zlog.Module("proxy-protocol").Debugf("rejecting connection from %s: %s", c.Conn.RemoteAddr(), err)
+		c.err = fmt.Errorf("PROXY protocol: %w", err)
+		c.Conn.Close()
+		return
+	}
+	c.remote = remote
+}
+
+// parse the header; this returns nil if the connection doesn't have an address
+// to use (UNKNOWN in v1 and LOCAL in v2, or no header in lenient mode).
+func (c *proxyConn) parse() (net.Addr, error) {
+	// Only peek at the first byte, as a connection without a header may send
+	// less data than the header length.
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	var v2 bool
+	switch first[0] {
+	case proxyProtoV1[0]:
+		b, err := c.r.Peek(len(proxyProtoV1))
+		if err != nil || !bytes.Equal(b, proxyProtoV1) {
+			return c.noHeader()
+		}
+	case proxyProtoV2[0]:
+		b, err := c.r.Peek(len(proxyProtoV2))
+		if err != nil || !bytes.Equal(b, proxyProtoV2) {
+			return c.noHeader()
+		}
+		v2 = true
+	default:
+		return c.noHeader()
+	}
+
+	if !c.p.allowed(c.Conn.RemoteAddr()) {
+		return nil, errors.New("PROXY header from an address not in -proxy-protocol")
+	}
+	if v2 {
+		return parseProxyV2(c.r)
+	}
+	return parseProxyV1(c.r)
+}
+
+func (c *proxyConn) noHeader() (net.Addr, error) {
+	if c.p.lenient || !c.p.allowed(c.Conn.RemoteAddr()) {
+		return nil, nil
+	}
+	return nil, errors.New("no PROXY header")
+}
+
+// parseProxyV1 parses the text header:
+//
+//	PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n
+//	PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n
+//	PROXY UNKNOWN\r\n
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	const maxLen = 107 // From the spec.
+
+	line, err := r.ReadSlice('\n')
+	if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+	if len(line) > maxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not terminated by CRLF")
+	}
+
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header: %q", line)
+	}
+	src, err := netip.ParseAddr(f[2])
+	if err != nil || src.Is4() != (f[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address: %q", f[2])
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port: %q", f[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+// parseProxyV2 parses the binary header: the 12-byte signature, version and
+// command, address family and protocol, length of the rest, and the addresses
+// followed by optional TLVs, which are skipped.
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version: %d", hdr[12]>>4)
+	}
+	cmd, fam := hdr[12]&0x0f, hdr[13]
+	n := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case 0x0: // LOCAL: health checks from the proxy itself.
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command: %d", cmd)
+	}
+
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if n < 12 {
+			return nil, errors.New("v2 header too short for IPv4")
+		}
+		src, _ := netip.AddrFromSlice(body[0:4])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x21: // TCP over IPv6
+		if n < 36 {
+			return nil, errors.New("v2 header too short for IPv6")
+		}
+		src, _ := netip.AddrFromSlice(body[0:16])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[32:34]))), nil
+	default: // UNSPEC, UDP, or Unix socket: no useful address.
+		return nil, nil
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2/handlers"
+)
+
+func TestProxyProto(t *testing.T) {
+	v2 := func(cmd, fam byte, src, dst string, tlv ...byte) string {
+		b := []byte{0x20 | cmd, fam, 0, 0}
+		if src != "" {
+			b = append(b, netip.MustParseAddr(src).AsSlice()...)
+			b = append(b, netip.MustParseAddr(dst).AsSlice()...)
+			b = append(b, 0xdc, 0x04, 0x01, 0xbb) // 56324, 443
+		}
+		b = append(b, tlv...)
+		n := len(b) - 4
+		b[2], b[3] = byte(n>>8), byte(n)
+		return string(proxyProtoV2) + string(b)
+	}
+
+	tests := []struct {
+		name, allow, header string
+		wantAddr            string // Empty for the address of the connection.
+		wantErr             bool
+	}{
+		{"v1 tcp4", "127.0.0.1", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+			"192.0.2.1:56324", false},
+		{"v1 tcp6", "127.0.0.0/8", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			"[2001:db8::1]:56324", false},
+		{"v1 unknown", "127.0.0.1", "PROXY UNKNOWN\r\n",
+			"", false},
+		{"v2 tcp4", "127.0.0.1", v2(0x1, 0x11, "192.0.2.1", "192.0.2.2"),
+			"192.0.2.1:56324", false},
+		{"v2 tcp6 with TLV", "127.0.0.1", v2(0x1, 0x21, "2001:db8::1", "2001:db8::2", 0x04, 0x00, 0x01, 0x00),
+			"[2001:db8::1]:56324", false},
+		{"v2 local", "127.0.0.1", v2(0x0, 0x00, "", ""),
+			"", false},
+
+		{"no header, strict", "127.0.0.1", "",
+			"", true},
+		{"no header, lenient", "127.0.0.1,lenient", "",
+			"", false},
+		{"header from other address", "10.0.0.0/8", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+			"", true},
+		{"v2 header from other address", "10.0.0.0/8", v2(0x1, 0x11, "192.0.2.1", "192.0.2.2"),
+			"", true},
+		{"no header from other address", "10.0.0.0/8", "",
+			"", false},
+
+		{"v1 invalid", "127.0.0.1", "PROXY TCP4 nope\r\n",
+			"", true},
+		{"v1 wrong family", "127.0.0.1", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n",
+			"", true},
+		{"v1 no CRLF", "127.0.0.1", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n",
+			"", true},
+		{"v2 short", "127.0.0.1", v2(0x1, 0x11, "", ""),
+			"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseProxyProto(tt.allow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			l = p.listener(l)
+
+			const payload = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+			go func() {
+				c, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer c.Close()
+				c.Write([]byte(tt.header + payload))
+			}()
+
+			c, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			addr := c.RemoteAddr().String()
+			data, err := io.ReadAll(c)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "PROXY protocol") {
+					t.Fatalf("wrong error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantAddr == "" {
+				if !strings.HasPrefix(addr, "127.0.0.1:") {
+					t.Errorf("wrong address: %q", addr)
+				}
+			} else if addr != tt.wantAddr {
+				t.Errorf("wrong address\nhave: %q\nwant: %q", addr, tt.wantAddr)
+			}
+			if string(data) != payload {
+				t.Errorf("wrong data\nhave: %q\nwant: %q", data, payload)
+			}
+		})
+	}
+}
+
+func TestParseProxyProto(t *testing.T) {
+	tests := []struct {
+		in, want, wantErr string
+	}{
+		{"10.0.0.0/8", "[10.0.0.0/8] false", ""},
+		{"10.1.2.3/8, 2001:db8::1,lenient", "[10.0.0.0/8 2001:db8::1/128] true", ""},
+		{"192.0.2.1,strict", "[192.0.2.1/32] false", ""},
+		{"lenient", "", "need at least one"},
+		{"10.0.0.0/8,nope", "", `not a valid IP address or CIDR range: "nope"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			p, err := parseProxyProto(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := fmt.Sprintf("%v %t", p.allow, p.lenient); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyProtoRealIP(t *testing.T) {
+	p, err := parseProxyProto("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		proxyProto bool
+		want       string
+	}{
+		{true, "192.0.2.1:56324"}, // From the PROXY header.
+		{false, "203.0.113.6"},    // Forged X-Forwarded-For.
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%t", tt.proxyProto), func(t *testing.T) {
+			handlers.SetProxyProtocol(tt.proxyProto)
+			defer handlers.SetProxyProtocol(false)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := &http.Server{Handler: handlers.RealIP()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.RemoteAddr))
+			}))}
+			go srv.Serve(p.listener(l))
+			defer srv.Close()
+
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n" +
+				"GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 203.0.113.6\r\nConnection: close\r\n\r\n"))
+
+			resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			have, _ := io.ReadAll(resp.Body)
+			if !strings.HasPrefix(string(have), tt.want) {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
@@ -5,9 +5,25 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2/cron"
 )
 
 func TestServe(t *testing.T) {
@@ -39,3 +55,218 @@ func TestServe(t *testing.T) {
 	stop <- struct{}{}
 	mainDone.Wait()
 }
+
+func TestServeMetrics(t *testing.T) {
+	exit, _, _, _, dbc := startTest(t)
+
+	ready := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	go runCmdStop(t, exit, ready, stop, "serve",
+		"-db="+dbc,
+		"-listen=localhost:31876",
+		"-metrics=localhost:31877",
+		"-tls=http")
+	<-ready
+	defer func() {
+		stop <- struct{}{}
+		mainDone.Wait()
+	}()
+
+	for _, u := range []string{"/status", "/count?p=/x", "/doesnt-exist"} {
+		req, _ := http.NewRequest("GET", "http://localhost:31876"+u, nil)
+		req.Host = "gctest.localhost"
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	err := cron.TaskPersistAndStat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://localhost:31877/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, b)
+	}
+
+	for _, w := range []string{
+		`goatcounter_http_requests_total{code="200"} `,
+		`goatcounter_http_requests_total{code="404"} `,
+		`goatcounter_count_requests_total{method="GET"} `,
+		"goatcounter_memstore_received_total ",
+		"goatcounter_memstore_pageviews 0\n",
+		"goatcounter_persist_seconds_count ",
+		"goatcounter_persist_pageviews_total ",
+		`goatcounter_db_connections{state="idle"} `,
+		"goatcounter_db_wait_total ",
+	} {
+		if !strings.Contains(string(b), w) {
+			t.Errorf("no %q in:\n%s", w, b)
+		}
+	}
+}
+
+func TestServeUnix(t *testing.T) {
+	exit, _, out, _, dbc := startTest(t)
+
+	// Don't use t.TempDir(), as the path can be too long for a socket.
+	tmp, err := os.MkdirTemp("", "gcsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmp) })
+	sock := filepath.Join(tmp, "http.sock")
+
+	// Stale socket from a previous run that wasn't cleaned up.
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	ready := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	go runCmdStop(t, exit, ready, stop, "serve",
+		"-db="+dbc,
+		"-listen=unix:"+sock,
+		"-listen-mode=0660")
+	<-ready
+
+	st, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0o660 {
+		t.Errorf("wrong mode: %s", st.Mode())
+	}
+
+	msg, err := healthHTTP("unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(msg, "healthy: unix:"+sock) {
+		t.Error(msg)
+	}
+
+	stop <- struct{}{}
+	mainDone.Wait()
+
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on shutdown: %v", err)
+	}
+	if !strings.Contains(out.String(), "removing stale socket") {
+		t.Errorf("stale socket not removed?\n%s", out)
+	}
+
+	out.Reset()
+	// Doesn't use runCmd() as ready isn't sent on errors.
+	runCmdStop(t, exit, make(chan struct{}, 1), nil, "serve", "-db="+dbc, "-listen=unix:"+sock, "-tls=acme")
+	wantExit(t, exit, out, 1)
+	if !strings.Contains(out.String(), `can't use "acme" with a Unix socket`) {
+		t.Error(out.String())
+	}
+}
+
+func TestServeReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGHUP on Windows")
+	}
+	exit, _, out, _, dbc := startTest(t)
+
+	file := filepath.Join(t.TempDir(), "cert.pem")
+	writeCert(t, file, 1)
+
+	ready := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	go runCmdStop(t, exit, ready, stop, "serve",
+		"-db="+dbc,
+		"-debug=all",
+		"-listen=localhost:31875",
+		"-tls="+file)
+	<-ready
+	defer func() {
+		stop <- struct{}{}
+		mainDone.Wait()
+	}()
+
+	serial := func() int64 {
+		c, err := tls.Dial("tcp", "localhost:31875", &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if s := serial(); s != 1 {
+		t.Fatalf("serial %d", s)
+	}
+
+	// Invalid file keeps the old certificate.
+	err := os.WriteFile(file, []byte("not a cert"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hup(t)
+	if s := serial(); s != 1 {
+		t.Fatalf("serial %d", s)
+	}
+
+	writeCert(t, file, 2)
+	hup(t)
+	if s := serial(); s != 2 {
+		t.Fatalf("serial %d\n%s", s, out)
+	}
+}
+
+// hup sends SIGHUP to the current process, and waits for the reload.
+func hup(t *testing.T) {
+	t.Helper()
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Signal(syscall.SIGHUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+}
+
+// writeCert writes a self-signed certificate and key for localhost to path.
+func writeCert(t *testing.T, path string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k})...)
+	err = os.WriteFile(path, b, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
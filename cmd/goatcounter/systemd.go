@@ -0,0 +1,96 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd; 0, 1, and 2 are stdin, stdout, and
+// stderr.
+const listenFDsStart = 3
+
+// systemdListeners gets the sockets passed with systemd socket activation from
+// the LISTEN_FDS and LISTEN_FDNAMES environment variables, by name. This
+// returns nil if there are no sockets.
+//
+// The environment variables are unset, so they're not passed on to child
+// processes.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	nfds := os.Getenv("LISTEN_FDS")
+	if nfds == "" {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil // Meant for another process.
+	}
+	n, err := strconv.Atoi(nfds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS: invalid value %q", nfds)
+	}
+
+	var names []string
+	if fdn := os.Getenv("LISTEN_FDNAMES"); fdn != "" {
+		names = strings.Split(fdn, ":")
+	}
+
+	l := make(map[string]net.Listener, n)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		if _, ok := l[name]; ok {
+			return nil, fmt.Errorf("LISTEN_FDNAMES: socket name %q used more than once", name)
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener() dups the fd.
+		if err != nil {
+			return nil, fmt.Errorf("socket %q (fd %d): %w", name, listenFDsStart+i, err)
+		}
+		l[name] = ln
+	}
+	return l, nil
+}
+
+// pickListeners gets the listener to serve GoatCounter on, and the listener to
+// redirect to it (which may be nil).
+//
+// The socket named "https" is used for the main listener if TLS is served,
+// with "http" to redirect from. Without TLS the main listener is "http". A
+// single socket is always used as the main listener, whatever the name.
+func pickListeners(l map[string]net.Listener, serveTLS bool) (net.Listener, net.Listener, error) {
+	if len(l) == 1 {
+		for _, ln := range l {
+			return ln, nil, nil
+		}
+	}
+
+	main, rdr := l["http"], net.Listener(nil)
+	if serveTLS {
+		main, rdr = l["https"], l["http"]
+	}
+	if main == nil {
+		names := make([]string, 0, len(l))
+		for n := range l {
+			names = append(names, n)
+		}
+		return nil, nil, fmt.Errorf("no socket to serve on in the sockets from systemd %q; set FileDescriptorName= to https or http",
+			names)
+	}
+	return main, rdr, nil
+}
@@ -0,0 +1,122 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"zgo.at/zli"
+)
+
+// Run "serve" with the sockets from systemd; this is run in a new process from
+// TestSystemdListeners(), as the sockets must be file descriptor 3 and onwards.
+func TestSystemdChild(t *testing.T) {
+	dbc := os.Getenv("GCTEST_SYSTEMD_CHILD")
+	if dbc == "" {
+		t.Skip("only run from TestSystemdListeners")
+	}
+
+	exit, _, _ := zli.Test(t)
+	ready := make(chan struct{}, 1)
+	runCmdStop(t, exit, ready, make(chan struct{}), "serve",
+		"-db="+dbc,
+		"-listen=localhost:1", // Should be ignored.
+		"-tls=http")
+	if *exit != 0 {
+		t.Fatalf("exit %d", *exit)
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no socket activation on Windows")
+	}
+	_, _, _, _, dbc := startTest(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fp, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdChild$", "-test.v")
+	cmd.ExtraFiles = []*os.File{fp} // fd 3
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_FDNAMES=http", "GCTEST_SYSTEMD_CHILD="+dbc)
+	out := new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = out, out
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Signal(os.Interrupt)
+		err := cmd.Wait()
+		if err != nil || t.Failed() {
+			t.Errorf("child: %v\n%s", err, out)
+		}
+	}()
+
+	// Close our copy, so that only the child accepts connections on it.
+	ln.Close()
+	fp.Close()
+
+	// Connections are queued on the socket until the child accepts them.
+	c := http.Client{Timeout: 30 * time.Second}
+	resp, err := c.Get("http://" + ln.Addr().String() + "/status")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || len(b) < 100 {
+		t.Errorf("status %d: %s", resp.StatusCode, b)
+	}
+}
+
+func TestPickListeners(t *testing.T) {
+	var (
+		a, b = &net.TCPListener{}, &net.TCPListener{}
+		none net.Listener
+	)
+	tests := []struct {
+		sockets  map[string]net.Listener
+		tls      bool
+		wantMain net.Listener
+		wantRdr  net.Listener
+		wantErr  bool
+	}{
+		{map[string]net.Listener{"goatcounter.socket": a}, true, a, none, false},
+		{map[string]net.Listener{"https": a, "http": b}, true, a, b, false},
+		{map[string]net.Listener{"https": a, "http": b}, false, b, none, false},
+		{map[string]net.Listener{"https": a, "xxx": b}, false, none, none, true},
+		{map[string]net.Listener{"xxx": a, "yyy": b}, true, none, none, true},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			main, rdr, err := pickListeners(tt.sockets, tt.tls)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if main != tt.wantMain || rdr != tt.wantRdr {
+				t.Errorf("\nmain: %p; want: %p\nrdr:  %p; want: %p", main, tt.wantMain, rdr, tt.wantRdr)
+			}
+		})
+	}
+}
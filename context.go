@@ -9,6 +9,9 @@ import (
 	"fmt"
 	"time"
 
+	"zgo.at/goatcounter/v2/mailer"
+	"zgo.at/goatcounter/v2/oidc"
+	"zgo.at/goatcounter/v2/pwned"
 	"zgo.at/z18n"
 	"zgo.at/zcache"
 	"zgo.at/zdb"
@@ -24,6 +27,7 @@ var Version = "dev"
 var (
 	keyCacheSites      = &struct{ n string }{""}
 	keyCacheUA         = &struct{ n string }{""}
+	keyCacheUAOverride = &struct{ n string }{""}
 	keyCacheBrowsers   = &struct{ n string }{""}
 	keyCacheSystems    = &struct{ n string }{""}
 	keyCachePaths      = &struct{ n string }{""}
@@ -34,6 +38,10 @@ var (
 	keyChangedTitles   = &struct{ n string }{""}
 	keyCacheSitesProxy = &struct{ n string }{""}
 	keyCacheI18n       = &struct{ n string }{""}
+	keyShareLink       = &struct{ n string }{""}
+	keyCachePasskeys   = &struct{ n string }{""}
+	keyCacheOIDC       = &struct{ n string }{""}
+	keyAPIToken        = &struct{ n string }{""}
 
 	keyConfig = &struct{ n string }{""}
 )
@@ -50,6 +58,25 @@ type GlobalConfig struct {
 	Websocket      bool
 	EmailFrom      string
 	BcryptMinCost  bool
+
+	// Data retention in days for sites that don't set their own, and the
+	// lowest and highest values sites can set. 0 means no default or limit.
+	DataRetention    int
+	DataRetentionMin int
+	DataRetentionMax int
+
+	// Reject passwords that appear in the Pwned Passwords database; nil if
+	// it's not enabled.
+	Pwned *pwned.Checker
+
+	// Transport to retry queued emails with; nil if emails aren't queued.
+	Mail mailer.Transport
+
+	// OpenID Connect; OIDC is nil if it's not enabled.
+	OIDC        *oidc.Provider
+	OIDCDomains []string   // Create users on first login for these email domains.
+	OIDCAccess  UserAccess // Access for new users.
+	OIDCOnly    bool       // Disable password and passkey logins.
 }
 
 // WithSite adds the site to the context.
@@ -113,6 +140,17 @@ func GetUser(ctx context.Context) *User {
 	return u
 }
 
+// WithAPIToken adds the API token used for this request to the context.
+func WithAPIToken(ctx context.Context, t *APIToken) context.Context {
+	return context.WithValue(ctx, keyAPIToken, t)
+}
+
+// GetAPIToken gets the API token used for this request, if any.
+func GetAPIToken(ctx context.Context) *APIToken {
+	t, _ := ctx.Value(keyAPIToken).(*APIToken)
+	return t
+}
+
 // MustGetUser behaves as GetUser(), panicking if this fails.
 func MustGetUser(ctx context.Context) *User {
 	u := GetUser(ctx)
@@ -135,6 +173,9 @@ func CopyContextValues(ctx context.Context) context.Context {
 	if c := ctx.Value(keyCacheUA); c != nil {
 		n = context.WithValue(n, keyCacheUA, c.(*zcache.Cache))
 	}
+	if c := ctx.Value(keyCacheUAOverride); c != nil {
+		n = context.WithValue(n, keyCacheUAOverride, c.(*zcache.Cache))
+	}
 	if c := ctx.Value(keyCacheBrowsers); c != nil {
 		n = context.WithValue(n, keyCacheBrowsers, c.(*zcache.Cache))
 	}
@@ -165,9 +206,18 @@ func CopyContextValues(ctx context.Context) context.Context {
 	if c := ctx.Value(keyCacheSitesProxy); c != nil {
 		n = context.WithValue(n, keyCacheSitesProxy, c.(*zcache.Proxy))
 	}
+	if c := ctx.Value(keyCachePasskeys); c != nil {
+		n = context.WithValue(n, keyCachePasskeys, c.(*zcache.Cache))
+	}
+	if c := ctx.Value(keyCacheOIDC); c != nil {
+		n = context.WithValue(n, keyCacheOIDC, c.(*zcache.Cache))
+	}
 	if c := Config(ctx); c != nil {
 		n = context.WithValue(n, keyConfig, c)
 	}
+	if r := GetReplica(ctx); r != nil {
+		n = context.WithValue(n, keyReplica, r)
+	}
 	if s := GetSite(ctx); s != nil {
 		n = context.WithValue(n, ctxkey.Site, s)
 	}
@@ -194,6 +244,7 @@ func NewCache(ctx context.Context) context.Context {
 	ctx = context.WithValue(ctx, keyCacheSitesProxy, zcache.NewProxy(s))
 
 	ctx = context.WithValue(ctx, keyCacheUA, zcache.New(1*time.Hour, 5*time.Minute))
+	ctx = context.WithValue(ctx, keyCacheUAOverride, zcache.New(1*time.Hour, 5*time.Minute))
 	ctx = context.WithValue(ctx, keyCacheBrowsers, zcache.New(1*time.Hour, 5*time.Minute))
 	ctx = context.WithValue(ctx, keyCacheSystems, zcache.New(1*time.Hour, 5*time.Minute))
 	ctx = context.WithValue(ctx, keyCachePaths, zcache.New(1*time.Hour, 5*time.Minute))
@@ -203,6 +254,8 @@ func NewCache(ctx context.Context) context.Context {
 	ctx = context.WithValue(ctx, keyCacheCampaigns, zcache.New(24*time.Hour, 15*time.Minute))
 	ctx = context.WithValue(ctx, keyCacheI18n, zcache.New(zcache.NoExpiration, zcache.NoExpiration))
 	ctx = context.WithValue(ctx, keyChangedTitles, zcache.New(48*time.Hour, 1*time.Hour))
+	ctx = context.WithValue(ctx, keyCachePasskeys, zcache.New(5*time.Minute, 1*time.Minute))
+	ctx = context.WithValue(ctx, keyCacheOIDC, zcache.New(15*time.Minute, 1*time.Minute))
 	return ctx
 }
 
@@ -229,6 +282,12 @@ func cacheUA(ctx context.Context) *zcache.Cache {
 	}
 	return zcache.New(0, 0)
 }
+func cacheUAOverride(ctx context.Context) *zcache.Cache {
+	if c := ctx.Value(keyCacheUAOverride); c != nil {
+		return c.(*zcache.Cache)
+	}
+	return zcache.New(0, 0)
+}
 func cacheBrowsers(ctx context.Context) *zcache.Cache {
 	if c := ctx.Value(keyCacheBrowsers); c != nil {
 		return c.(*zcache.Cache)
@@ -283,6 +342,18 @@ func cacheChangedTitles(ctx context.Context) *zcache.Cache {
 	}
 	return zcache.New(0, 0)
 }
+func cachePasskeys(ctx context.Context) *zcache.Cache {
+	if c := ctx.Value(keyCachePasskeys); c != nil {
+		return c.(*zcache.Cache)
+	}
+	return zcache.New(0, 0)
+}
+func cacheOIDC(ctx context.Context) *zcache.Cache {
+	if c := ctx.Value(keyCacheOIDC); c != nil {
+		return c.(*zcache.Cache)
+	}
+	return zcache.New(0, 0)
+}
 func cacheSitesHost(ctx context.Context) *zcache.Proxy {
 	if c := ctx.Value(keyCacheSitesProxy); c != nil {
 		return c.(*zcache.Proxy)
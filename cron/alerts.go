@@ -0,0 +1,169 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// alertPayload is the JSON that's sent to webhooks for alerts.
+type alertPayload struct {
+	Event     string    `json:"event"`    // Always "alert".
+	Test      bool      `json:"test"`     // Sent with the "test" button.
+	Resolved  bool      `json:"resolved"` // There are pageviews again after a nodata alert.
+	Site      string    `json:"site"`
+	SiteURL   string    `json:"site_url"`
+	Kind      string    `json:"kind"` // count, average, or nodata
+	Threshold float64   `json:"threshold"`
+	Pageviews int       `json:"pageviews"` // In the last hour.
+	Average   float64   `json:"average"`   // Hourly average in the 7 days before that.
+	Limit     float64   `json:"limit"`
+	Time      time.Time `json:"time"`
+}
+
+// trafficAlerts checks all alert rules, and sends a notification if there are
+// more pageviews than the rule allows.
+//
+// Rules aren't checked again until the cooldown has passed, so a single spike
+// only sends one notification. No-data alerts are sent once, and a follow-up is
+// sent once there are pageviews again.
+func trafficAlerts(ctx context.Context) error {
+	var rules goatcounter.AlertRules
+	err := rules.UnscopedListActive(ctx)
+	if err != nil {
+		return errors.Errorf("cron.trafficAlerts: %w", err)
+	}
+
+	l := zlog.Module("alert")
+	now := ztime.Now()
+	for _, r := range rules {
+		if r.InCooldown(now) {
+			continue
+		}
+
+		var site goatcounter.Site
+		err := site.ByID(ctx, r.SiteID)
+		if err != nil {
+			l.Error(err)
+			continue
+		}
+		siteCtx := goatcounter.WithSite(ctx, &site)
+
+		check, err := r.Check(siteCtx, now)
+		if err != nil {
+			l.Error(err)
+			continue
+		}
+		if r.Firing {
+			if check.Pageviews == 0 {
+				continue
+			}
+			l.Fields(zlog.F{"site": site.ID, "rule": r.ID, "pageviews": check.Pageviews}).
+				Print("traffic alert resolved")
+			err = r.Resolved(siteCtx)
+			if err != nil {
+				l.Error(err)
+				continue
+			}
+			err = sendAlert(siteCtx, r, check, false, true)
+			if err != nil {
+				l.Error(err)
+			}
+			continue
+		}
+		if !check.Triggered {
+			continue
+		}
+
+		l.Fields(zlog.F{"site": site.ID, "rule": r.ID, "pageviews": check.Pageviews, "limit": check.Limit}).
+			Print("traffic alert")
+		err = r.Fired(siteCtx)
+		if err != nil {
+			l.Error(err)
+			continue
+		}
+		err = FireAlert(siteCtx, r, check, false)
+		if err != nil {
+			l.Error(err)
+		}
+	}
+	return nil
+}
+
+// FireAlert sends the notification for the alert rule by email, and to the
+// user's webhooks if this is enabled for the rule.
+//
+// Test alerts are always emailed, even if the user disabled alerts.
+func FireAlert(ctx context.Context, rule goatcounter.AlertRule, check goatcounter.AlertCheck, test bool) error {
+	return sendAlert(ctx, rule, check, test, false)
+}
+
+func sendAlert(ctx context.Context, rule goatcounter.AlertRule, check goatcounter.AlertCheck, test, resolved bool) error {
+	site := goatcounter.MustGetSite(ctx)
+
+	var user goatcounter.User
+	err := user.ByID(ctx, rule.UserID)
+	if err != nil {
+		return errors.Errorf("cron.sendAlert: %w", err)
+	}
+
+	if test || user.Settings.Notify(goatcounter.NotifyAlerts) {
+		subject := "Traffic spike on " + site.Display(ctx)
+		switch {
+		case resolved:
+			subject = "Pageviews are being recorded again on " + site.Display(ctx)
+		case rule.Kind == goatcounter.AlertNoData:
+			subject = "No pageviews on " + site.Display(ctx)
+		}
+		if test {
+			subject = "Test: " + subject
+		}
+		err := blackmail.Send(subject,
+			blackmail.From("GoatCounter alerts", goatcounter.Config(ctx).EmailFrom),
+			blackmail.To(user.Email),
+			blackmail.HeadersAutoreply(),
+			blackmail.BodyMustText(goatcounter.TplEmailAlert{
+				Context:  ctx,
+				Site:     *site,
+				User:     user,
+				Rule:     rule,
+				Check:    check,
+				Test:     test,
+				Resolved: resolved,
+			}.Render))
+		if err != nil {
+			return errors.Errorf("cron.sendAlert: %w", err)
+		}
+	}
+
+	if rule.Webhook {
+		var hooks goatcounter.Webhooks
+		err := hooks.ListUser(ctx, user)
+		if err != nil {
+			return errors.Errorf("cron.sendAlert: %w", err)
+		}
+		sendWebhooks(ctx, *site, user, hooks.Active(), alertPayload{
+			Event:     "alert",
+			Test:      test,
+			Resolved:  resolved,
+			Site:      site.Code,
+			SiteURL:   site.URL(ctx),
+			Kind:      rule.Kind,
+			Threshold: rule.Threshold,
+			Pageviews: check.Pageviews,
+			Average:   check.Average,
+			Limit:     check.Limit,
+			Time:      ztime.Now().UTC(),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zgo"
+	"zgo.at/zstd/ztime"
+	"zgo.at/ztpl"
+)
+
+func TestTrafficAlerts(t *testing.T) {
+	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
+	err := ztpl.Init(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 6, 17, 12, 5, 0, 0, time.UTC)
+	ztime.Now = func() time.Time { return now }
+	t.Cleanup(func() { ztime.Now = func() time.Time { return time.Now().UTC() } })
+
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+
+	spike := func(n int) {
+		hits := make([]goatcounter.Hit, n)
+		for i := range hits {
+			hits[i] = goatcounter.Hit{FirstVisit: true, Path: "/spike", CreatedAt: now.Add(-time.Minute)}
+		}
+		gctest.StoreHits(ctx, t, false, hits...)
+	}
+	run := func(t *testing.T, want int) {
+		t.Helper()
+		buf := new(bytes.Buffer)
+		blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+
+		err := cron.TaskTrafficAlerts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitTrafficAlerts()
+
+		if have := strings.Count(buf.String(), "Subject: Traffic spike on"); have != want {
+			t.Fatalf("sent %d alerts; want %d\n%s", have, want, buf.String())
+		}
+	}
+
+	for _, r := range []goatcounter.AlertRule{
+		{Kind: goatcounter.AlertCount, Threshold: 20, Cooldown: 60},
+		{Kind: goatcounter.AlertAverage, Threshold: 10, Cooldown: 180},
+	} {
+		err := r.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Normal traffic.
+	spike(5)
+	run(t, 0)
+
+	// Spike: both rules fire.
+	now = now.Add(5 * time.Minute)
+	spike(30)
+	run(t, 2)
+
+	// Traffic is still high, but the rules are in the cooldown.
+	for range 5 {
+		now = now.Add(10 * time.Minute)
+		spike(10)
+		run(t, 0)
+	}
+
+	// Cooldown of the first rule has passed.
+	now = now.Add(10 * time.Minute)
+	spike(30)
+	run(t, 1)
+
+	// Spike is over.
+	now = now.Add(4 * time.Hour)
+	run(t, 0)
+
+	var rules goatcounter.AlertRules
+	err = rules.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[0].LastFiredAt == nil || !rules[0].LastFiredAt.Equal(time.Date(2019, 6, 17, 13, 10, 0, 0, time.UTC)) {
+		t.Errorf("rule 0: %v", rules[0].LastFiredAt)
+	}
+	if rules[1].LastFiredAt == nil || !rules[1].LastFiredAt.Equal(time.Date(2019, 6, 17, 12, 10, 0, 0, time.UTC)) {
+		t.Errorf("rule 1: %v", rules[1].LastFiredAt)
+	}
+}
+
+func TestNoDataAlerts(t *testing.T) {
+	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
+	err := ztpl.Init(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 6, 17, 12, 0, 0, 0, time.UTC)
+	ztime.Now = func() time.Time { return now }
+	t.Cleanup(func() { ztime.Now = func() time.Time { return time.Now().UTC() } })
+
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+
+	// An average of one pageview per hour in the week before.
+	hits := make([]goatcounter.Hit, 168)
+	for i := range hits {
+		hits[i] = goatcounter.Hit{FirstVisit: true, Path: "/a", CreatedAt: now.Add(-3 * 24 * time.Hour)}
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	rule := goatcounter.AlertRule{Kind: goatcounter.AlertNoData, Threshold: 24}
+	err = rule.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(t *testing.T) string {
+		t.Helper()
+		buf := new(bytes.Buffer)
+		blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+
+		err := cron.TaskTrafficAlerts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitTrafficAlerts()
+		return buf.String()
+	}
+
+	if have := run(t); !strings.Contains(have, "Subject: No pageviews on") || !strings.Contains(have, "/help/start") {
+		t.Fatalf("no alert:\n%s", have)
+	}
+	err = rule.ByID(ctx, rule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rule.Firing {
+		t.Error("not firing")
+	}
+
+	// Only sent once.
+	now = now.Add(2 * time.Hour)
+	if have := run(t); have != "" {
+		t.Fatalf("sent email:\n%s", have)
+	}
+
+	// Resolved once there are pageviews again.
+	now = now.Add(time.Hour)
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{FirstVisit: true, Path: "/a", CreatedAt: now.Add(-time.Minute)})
+	if have := run(t); !strings.Contains(have, "Subject: Pageviews are being recorded again on") {
+		t.Fatalf("no resolved email:\n%s", have)
+	}
+	err = rule.ByID(ctx, rule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Firing {
+		t.Error("still firing")
+	}
+
+	now = now.Add(time.Hour)
+	if have := run(t); have != "" {
+		t.Fatalf("sent email:\n%s", have)
+	}
+}
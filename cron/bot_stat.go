@@ -0,0 +1,87 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strconv"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// updateBotStats counts the pageviews flagged as a bot per path and bot code,
+// and per User-Agent header if the site collects that.
+func updateBotStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			count  int
+			day    string
+			bot    int
+			pathID int64
+			ua     string
+		}
+		var (
+			site    = goatcounter.MustGetSite(ctx)
+			withUA  = site.Settings.Collect.Has(goatcounter.CollectUserAgent)
+			grouped = map[string]gt{}
+			byUA    = map[string]gt{}
+		)
+		for _, h := range hits {
+			if h.Bot == 0 || !goatcounter.StatusIsPageview(h.Status) {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			k := day + strconv.Itoa(h.Bot) + "-" + strconv.FormatInt(h.PathID, 10)
+			v := grouped[k]
+			if v.count == 0 {
+				v.day, v.bot, v.pathID = day, h.Bot, h.PathID
+			}
+			v.count += 1
+			grouped[k] = v
+
+			if withUA && h.UserAgentHeader != "" {
+				k := day + strconv.Itoa(h.Bot) + "-" + h.UserAgentHeader
+				v := byUA[k]
+				if v.count == 0 {
+					v.day, v.bot, v.ua = day, h.Bot, h.UserAgentHeader
+				}
+				v.count += 1
+				byUA[k] = v
+			}
+		}
+
+		ins := zdb.NewBulkInsert(ctx, "bot_stats", []string{"site_id", "day", "bot", "path_id", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "bot_stats#site_id#path_id#day#bot" do update set
+				count = bot_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day, bot) do update set
+				count = bot_stats.count + excluded.count`)
+		}
+		for _, v := range grouped {
+			ins.Values(site.ID, v.day, v.bot, v.pathID, v.count)
+		}
+		err := ins.Finish()
+		if err != nil {
+			return err
+		}
+
+		ins = zdb.NewBulkInsert(ctx, "bot_ua_stats", []string{"site_id", "day", "bot", "user_agent", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "bot_ua_stats#site_id#day#bot#user_agent" do update set
+				count = bot_ua_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, day, bot, user_agent) do update set
+				count = bot_ua_stats.count + excluded.count`)
+		}
+		for _, v := range byUA {
+			ins.Values(site.ID, v.day, v.bot, v.ua, v.count)
+		}
+		return ins.Finish()
+	}), "cron.updateBotStats")
+}
@@ -0,0 +1,67 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strconv"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+func updateCityStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			count    int
+			day      string
+			location string
+			city     string
+			pathID   int64
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			// The city is only set when collecting it and using a City
+			// database.
+			if h.Bot > 0 || h.City == "" {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			k := day + h.Location + "\x00" + h.City + "\x00" + strconv.FormatInt(h.PathID, 10)
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.location = h.Location
+				v.city = h.City
+				v.pathID = h.PathID
+			}
+
+			if h.FirstVisit {
+				v.count += 1
+			}
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := zdb.NewBulkInsert(ctx, "city_stats", []string{"site_id", "day",
+			"path_id", "location", "city", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "city_stats#site_id#path_id#day#location#city" do update set
+				count = city_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day, location, city) do update set
+				count = city_stats.count + excluded.count`)
+		}
+
+		for _, v := range grouped {
+			if v.count > 0 {
+				ins.Values(siteID, v.day, v.pathID, v.location, v.city, v.count)
+			}
+		}
+		return ins.Finish()
+	}), "cron.updateCityStats")
+}
@@ -0,0 +1,69 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestCityStats(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	rng := ztime.NewRange(now).To(now)
+
+	list := func() string {
+		t.Helper()
+		var stats goatcounter.HitStats
+		err := stats.ListCities(ctx, "US-TX", rng, nil, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zjson.MustMarshalString(stats)
+	}
+
+	// Not collected by default.
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Location: "US-TX", City: "Austin", FirstVisit: true},
+	}...)
+	if d := ztest.Diff(list(), `{"more": false, "stats": null}`, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+
+	site.Settings.Collect |= goatcounter.CollectLocationCity
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Location: "US-TX", City: "Austin", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Location: "US-TX", City: "Austin"},
+		{Site: site.ID, CreatedAt: now, Location: "US-TX", City: "Houston", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Location: "US-TX", City: "Austin", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Location: "US-TX", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Location: "US-CA", City: "Fresno", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Location: "NL", City: "Amsterdam", FirstVisit: true},
+	}...)
+
+	want := `{
+		"more": false,
+		"stats": [
+			{"count": 2, "name": "Austin"},
+			{"count": 1, "name": "Houston"}
+		]
+	}`
+	if d := ztest.Diff(list(), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"zgo.at/bgrun"
+	"zgo.at/goatcounter/v2/metrics"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zruntime"
 	"zgo.at/zstd/zsync"
@@ -33,8 +34,23 @@ var Tasks = []Task{
 	{"renew ACME certs", renewACME, 2 * time.Hour},
 	{"vacuum soft-deleted sites", vacuumDeleted, 12 * time.Hour},
 	{"rm old exports", oldExports, 1 * time.Hour},
+	{"rm expired login sessions", oldLoginSessions, 1 * time.Hour},
+	{"rm expired email changes", oldEmailChanges, 1 * time.Hour},
+	{"rm old audit entries", oldAuditEntries, 24 * time.Hour},
+	{"rm old queued emails", oldQueuedEmails, 1 * time.Hour},
+	{"reload GeoIP database", reloadGeoDB, 1 * time.Hour},
+	{"reload referrer spam list", reloadRefspam, 1 * time.Hour},
+	{"reload referrer rules", reloadRefRules, 1 * time.Hour},
+	{"reload traffic channels", reloadChannels, 1 * time.Hour},
+	{"reload bot data", reloadBotData, 1 * time.Hour},
 	{"cycle sessions", sessions, 1 * time.Minute},
 	{"send email reports", emailReports, 1 * time.Hour},
+	{"check traffic alerts", trafficAlerts, 5 * time.Minute},
+	{"retry queued emails", retryEmails, 1 * time.Minute},
+	{"run migration backfills", migrationBackfills, 1 * time.Minute},
+	{"create hits partitions", hitPartitions, 12 * time.Hour},
+	{"rm orphaned paths, refs, and user agents", orphans, 1 * time.Hour},
+	{"SQLite maintenance (WAL checkpoint, vacuum)", sqliteMaintenance, time.Duration(maintenanceInterval.Load())},
 	{"persist hits", persistAndStat, time.Duration(persistInterval.Load())},
 }
 
@@ -65,9 +81,12 @@ func Start(ctx context.Context) {
 		t := t
 		f := t.ID()
 		bgrun.NewTask("cron:"+f, 1, func(context.Context) error {
+			start := time.Now()
 			err := t.Fun(ctx)
+			metrics.Observe("goatcounter_cron_task_seconds", time.Since(start), "task", f)
 			if err != nil {
-				l.Error(err)
+				metrics.Count("goatcounter_cron_task_errors_total", 1, "task", f)
+				l.Field("task", f).Error(err)
 			}
 			return nil
 		})
@@ -79,9 +98,12 @@ func Start(ctx context.Context) {
 			id := t.ID()
 
 			for {
-				if id == "persistAndStat" {
+				switch {
+				case id == "persistAndStat":
 					time.Sleep(time.Duration(persistInterval.Load()))
-				} else {
+				case id == "sqliteMaintenance" && maintenanceInterval.Load() > 0:
+					time.Sleep(time.Duration(maintenanceInterval.Load()))
+				default:
 					time.Sleep(t.Period)
 				}
 				if stopped.Value() == 1 {
@@ -105,17 +127,30 @@ func Stop() error {
 	return nil
 }
 
-func TaskOldExports() error     { return bgrun.RunTask("cron:oldExports") }
-func TaskDataRetention() error  { return bgrun.RunTask("cron:dataRetention") }
-func TaskVacuumOldSites() error { return bgrun.RunTask("cron:vacuumDeleted") }
-func TaskACME() error           { return bgrun.RunTask("cron:renewACME") }
-func TaskSessions() error       { return bgrun.RunTask("cron:sessions") }
-func TaskEmailReports() error   { return bgrun.RunTask("cron:emailReports") }
-func TaskPersistAndStat() error { return bgrun.RunTask("cron:persistAndStat") }
-func WaitOldExports()           { bgrun.Wait("cron:oldExports") }
-func WaitDataRetention()        { bgrun.Wait("cron:dataRetention") }
-func WaitVacuumOldSites()       { bgrun.Wait("cron:vacuumDeleted") }
-func WaitACME()                 { bgrun.Wait("cron:renewACME") }
-func WaitSessions()             { bgrun.Wait("cron:sessions") }
-func WaitEmailReports()         { bgrun.Wait("cron:emailReports") }
-func WaitPersistAndStat()       { bgrun.Wait("cron:persistAndStat") }
+func TaskOldExports() error        { return bgrun.RunTask("cron:oldExports") }
+func TaskDataRetention() error     { return bgrun.RunTask("cron:dataRetention") }
+func TaskOldBot() error            { return bgrun.RunTask("cron:oldBot") }
+func TaskVacuumOldSites() error    { return bgrun.RunTask("cron:vacuumDeleted") }
+func TaskACME() error              { return bgrun.RunTask("cron:renewACME") }
+func TaskSessions() error          { return bgrun.RunTask("cron:sessions") }
+func TaskEmailReports() error      { return bgrun.RunTask("cron:emailReports") }
+func TaskPersistAndStat() error    { return bgrun.RunTask("cron:persistAndStat") }
+func TaskTrafficAlerts() error     { return bgrun.RunTask("cron:trafficAlerts") }
+func TaskRetryEmails() error       { return bgrun.RunTask("cron:retryEmails") }
+func TaskBackfills() error         { return bgrun.RunTask("cron:migrationBackfills") }
+func TaskSQLiteMaintenance() error { return bgrun.RunTask("cron:sqliteMaintenance") }
+func TaskOrphans() error           { return bgrun.RunTask("cron:orphans") }
+func WaitOldExports()              { bgrun.Wait("cron:oldExports") }
+func WaitDataRetention()           { bgrun.Wait("cron:dataRetention") }
+func WaitOldBot()                  { bgrun.Wait("cron:oldBot") }
+func WaitVacuumOldSites()          { bgrun.Wait("cron:vacuumDeleted") }
+func WaitACME()                    { bgrun.Wait("cron:renewACME") }
+func WaitSessions()                { bgrun.Wait("cron:sessions") }
+func WaitEmailReports()            { bgrun.Wait("cron:emailReports") }
+func WaitPersistAndStat()          { bgrun.Wait("cron:persistAndStat") }
+func WaitTrafficAlerts()           { bgrun.Wait("cron:trafficAlerts") }
+func WaitRetryEmails()             { bgrun.Wait("cron:retryEmails") }
+func WaitBackfills()               { bgrun.Wait("cron:migrationBackfills") }
+func WaitSQLiteMaintenance()       { bgrun.Wait("cron:sqliteMaintenance") }
+func WaitOrphans()                 { bgrun.Wait("cron:orphans") }
+func WaitWebhooks()                { bgrun.Wait("webhook") }
@@ -0,0 +1,56 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestDeviceStats(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	const (
+		iPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+		android = "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36"
+	)
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Size: []float64{1920, 1080, 1}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Size: []float64{1920, 1080, 1}},
+		{Site: site.ID, CreatedAt: now, Size: []float64{390, 844, 3}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Size: []float64{820, 1180, 2}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, UserAgentHeader: iPhone, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, UserAgentHeader: android, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, FirstVisit: true},
+	}...)
+
+	var have goatcounter.HitStats
+	err := have.ListDevices(ctx, ztime.NewRange(now).To(now), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{
+		"more": false,
+		"stats": [
+			{"count": 2, "id": "mobile", "name": "Mobile"},
+			{"count": 2, "id": "tablet", "name": "Tablet"},
+			{"count": 1, "id": "desktop", "name": "Desktop"},
+			{"count": 1, "id": "unknown", "name": ""}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"html/template"
+	"slices"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+	"zgo.at/zstd/ztime"
+	"zgo.at/ztpl"
+)
+
+// Number of pages for every site in the digest.
+const digestLimit = 3
+
+type digestArgs struct {
+	Context     context.Context
+	Site        goatcounter.Site // Account site.
+	User        goatcounter.User
+	DisplayDate string
+	Range       ztime.Range
+
+	Sites []digestSite      // Sites with pageviews, most visitors first.
+	Empty goatcounter.Sites // Sites without pageviews.
+}
+
+type digestSite struct {
+	Site      goatcounter.Site
+	Compare   reportCompare // Visitors compared to the previous period.
+	Pages     goatcounter.HitLists
+	TextPages template.HTML
+}
+
+// newDigestArgs gets the data for the digest of all sites in the account that
+// the user didn't exclude; this returns nil if none of the sites had
+// pageviews.
+func newDigestArgs(ctx context.Context, account goatcounter.Site, user goatcounter.User) (*digestArgs, string, error) {
+	ctx = goatcounter.WithSite(ctx, &account)
+	ctx = z18n.With(ctx, goatcounter.GetBundle(goatcounter.WithUser(ctx, &user)).
+		Locale(user.Settings.Language, account.UserDefaults.Language))
+	rng := user.EmailReportRange().UTC()
+
+	args := digestArgs{
+		Context:     ctx,
+		Site:        account,
+		User:        user,
+		Range:       rng,
+		DisplayDate: user.Settings.FormatDate(rng.Start, false),
+	}
+	if user.Settings.EmailReports != goatcounter.EmailReportDaily {
+		args.DisplayDate += " – " + user.Settings.FormatDate(rng.End, false)
+	}
+	subject := z18n.T(ctx, "email/digest-subject|Your GoatCounter digest for %(date)", args.DisplayDate)
+
+	var sites goatcounter.Sites
+	err := sites.ForThisAccount(ctx, false)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "newDigestArgs")
+	}
+
+	d := -rng.End.Sub(rng.Start)
+	prev := ztime.NewRange(rng.Start.Add(d)).To(rng.End.Add(d))
+	for _, s := range sites {
+		// All users have at least read-only access to every site in the
+		// account, but check anyway in case that ever changes.
+		if user.Access.For(s.ID) == "" || !user.Settings.InDigest(s.ID) {
+			continue
+		}
+
+		siteCtx := goatcounter.WithSite(ctx, &s)
+		cur, err := goatcounter.GetTotalCount(siteCtx, rng, nil, false)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "newDigestArgs: site %d", s.ID)
+		}
+		if cur.Total == 0 {
+			args.Empty = append(args.Empty, s)
+			continue
+		}
+		prevCount, err := goatcounter.GetTotalCount(siteCtx, prev, nil, false)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "newDigestArgs: site %d", s.ID)
+		}
+
+		ds := digestSite{
+			Site:    s,
+			Compare: compare(ctx, z18n.T(ctx, "email/report-visitors-header|Visitors"), prevCount.Total, cur.Total),
+		}
+		_, _, err = ds.Pages.List(siteCtx, rng, nil, goatcounter.HitListOpts{}, digestLimit, true)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "newDigestArgs: site %d", s.ID)
+		}
+		args.Sites = append(args.Sites, ds)
+	}
+	if len(args.Sites) == 0 {
+		return nil, "", nil
+	}
+
+	slices.SortStableFunc(args.Sites, func(a, b digestSite) int { return b.Compare.Cur - a.Compare.Cur })
+	return &args, subject, nil
+}
+
+// EmptyNames gets the names of the sites without pageviews, for the footer.
+func (args digestArgs) EmptyNames() string {
+	names := make([]string, 0, len(args.Empty))
+	for _, s := range args.Empty {
+		names = append(names, s.Display(args.Context))
+	}
+	return strings.Join(names, ", ")
+}
+
+// render the text and HTML versions of the digest.
+func (args digestArgs) render() (text, html []byte, err error) {
+	for i := range args.Sites {
+		b := new(strings.Builder)
+		for _, p := range args.Sites[i].Pages {
+			textRow(b, []string{pathName(args.Context, p), args.User.Settings.FormatNumber(p.Count)})
+		}
+		args.Sites[i].TextPages = template.HTML(b.String())
+	}
+
+	text, err = ztpl.ExecuteBytes("email_digest.gotxt", args)
+	if err != nil {
+		return nil, nil, errors.Errorf("cron.digest text: %w", err)
+	}
+	html, err = ztpl.ExecuteBytes("email_digest.gohtml", args)
+	if err != nil {
+		return nil, nil, errors.Errorf("cron.digest html: %w", err)
+	}
+	return text, html, nil
+}
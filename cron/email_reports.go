@@ -10,21 +10,27 @@ import (
 	"html/template"
 	"math"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"zgo.at/blackmail"
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
 	"zgo.at/zdb"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zstring"
 	"zgo.at/zstd/ztime"
 	"zgo.at/ztpl"
-	"zgo.at/ztpl/tplfunc"
 )
 
 var el = zlog.Module("email-report")
 
 // EmailReports sends email reports for sites that have this configured.
+//
+// The report is sent once the EmailReportSendAt() time has passed; this is
+// run every hour, so it's sent within an hour of that. After downtime only the
+// most recent missed report is sent.
 func emailReports(ctx context.Context) error {
 	users, err := reportUsers(ctx)
 	if err != nil {
@@ -47,29 +53,65 @@ func emailReports(ctx context.Context) error {
 			return fmt.Errorf("cron.emailReports: user=%d: LastReportAt is after the current time; this should never happen", user.ID)
 		}
 
-		rng := user.EmailReportRange().UTC()
-		if rng.End.After(now) || rng.IsZero() {
+		sendAt := user.EmailReportSendAt()
+		if sendAt.IsZero() || sendAt.After(now) {
 			continue
 		}
+		user = latestReport(user, now)
 
-		text, html, subject, err := reportText(ctx, site, user)
+		args, subject, err := reportArgs(ctx, site, user)
 		if err != nil {
 			return fmt.Errorf("cron.emailReports: user=%d: %w", user.ID, err)
 		}
-		if text == nil {
-			el.Debug("no text: bailing")
+
+		// The digest is sent if any of the sites had pageviews; the webhooks
+		// only get the report for the account's site.
+		var digest *digestArgs
+		if user.Settings.EmailReportsDigest {
+			var digestSubject string
+			digest, digestSubject, err = newDigestArgs(ctx, site, user)
+			if err != nil {
+				return fmt.Errorf("cron.emailReports: user=%d: %w", user.ID, err)
+			}
+			if digest != nil {
+				subject = digestSubject
+			}
+		}
+		if args == nil && digest == nil {
+			el.Debug("no pages: bailing")
 			continue
 		}
 
-		err = blackmail.Send(subject,
-			blackmail.From("GoatCounter reports", goatcounter.Config(ctx).EmailFrom),
-			blackmail.To(user.Email),
-			blackmail.HeadersAutoreply(),
-			blackmail.BodyText(text),
-			blackmail.BodyHTML(html))
+		var hooks goatcounter.Webhooks
+		err = hooks.ListUser(ctx, user)
 		if err != nil {
-			zlog.Error(err)
-			continue
+			return fmt.Errorf("cron.emailReports: user=%d: %w", user.ID, err)
+		}
+		hooks = hooks.Active()
+		if len(hooks) > 0 && args != nil {
+			sendWebhooks(ctx, site, user, hooks, args.payload())
+		}
+
+		if len(hooks) == 0 || !user.Settings.EmailReportsWebhookOnly {
+			var text, html []byte
+			if digest != nil {
+				text, html, err = digest.render()
+			} else {
+				text, html, err = args.render()
+			}
+			if err != nil {
+				return fmt.Errorf("cron.emailReports: user=%d: %w", user.ID, err)
+			}
+			err = blackmail.Send(subject,
+				blackmail.From("GoatCounter reports", goatcounter.Config(ctx).EmailFrom),
+				blackmail.To(user.Email),
+				blackmail.HeadersAutoreply(),
+				blackmail.BodyText(text),
+				blackmail.BodyHTML(html))
+			if err != nil {
+				zlog.Error(err)
+				continue
+			}
 		}
 
 		err = zdb.Exec(ctx, `update users set last_report_at=$1 where user_id=$2`, ztime.Now(), user.ID)
@@ -80,6 +122,19 @@ func emailReports(ctx context.Context) error {
 	return nil
 }
 
+// latestReport skips to the most recent report that should have been sent,
+// for when several reports were missed (e.g. because the server was down).
+func latestReport(user goatcounter.User, now time.Time) goatcounter.User {
+	for {
+		next := user
+		next.LastReportAt = user.EmailReportRange().End.Add(time.Second)
+		if next.EmailReportSendAt().After(now) {
+			return user
+		}
+		user = next
+	}
+}
+
 // Get list of all users to send reports for.
 func reportUsers(ctx context.Context) (goatcounter.Users, error) {
 	query := `
@@ -98,122 +153,263 @@ func reportUsers(ctx context.Context) (goatcounter.Users, error) {
 	return users, errors.Wrap(err, "get users")
 }
 
+// Number of rows in every table in the report.
+const reportLimit = 5
+
 type templateArgs struct {
-	Context context.Context
-	Site    goatcounter.Site
-	User    goatcounter.User
-	Pages   goatcounter.HitLists
-	Total   goatcounter.HitList
-	Refs    goatcounter.HitStats
+	Context    context.Context
+	Site       goatcounter.Site
+	User       goatcounter.User
+	Pages      goatcounter.HitLists
+	NewPages   goatcounter.HitLists
+	Total      goatcounter.HitList
+	Refs       goatcounter.HitStats
+	Locations  goatcounter.HitStats
+	Counts     goatcounter.TotalCount
+	PrevCounts goatcounter.TotalCount
+	Compare    []reportCompare
+	Range      ztime.Range
 
 	DisplayDate                  string
 	TextPagesTable, TextRefTable template.HTML
+	TextNewTable, TextLocTable   template.HTML
+	TextCompareTable             template.HTML
+
+	// Sections are omitted if the site doesn't collect the data.
+	ShowRefs, ShowLocations bool
 
 	Diffs []string
 }
 
-func reportText(ctx context.Context, site goatcounter.Site, user goatcounter.User) (text, html []byte, subject string, err error) {
+// reportCompare is a row in the comparison against the previous period.
+type reportCompare struct {
+	Name      string
+	Cur, Prev int
+	Growth    string
+	Up, Down  bool
+}
+
+// reportArgs gets the data for the report; this returns nil if there were no
+// pageviews in the period.
+//
+// The report is in the user's language, falling back to English for strings
+// that aren't translated.
+func reportArgs(ctx context.Context, site goatcounter.Site, user goatcounter.User) (*templateArgs, string, error) {
 	ctx = goatcounter.WithSite(ctx, &site)
+	ctx = z18n.With(ctx, goatcounter.GetBundle(goatcounter.WithUser(ctx, &user)).
+		Locale(user.Settings.Language, site.UserDefaults.Language))
 	rng := user.EmailReportRange().UTC()
 
 	args := templateArgs{
-		Context:     ctx,
-		Site:        site,
-		User:        user,
-		DisplayDate: fmt.Sprintf("%s ", rng.Start.Format(user.Settings.DateFormat)),
+		Context:       ctx,
+		Site:          site,
+		User:          user,
+		Range:         rng,
+		DisplayDate:   user.Settings.FormatDate(rng.Start, false),
+		ShowRefs:      site.Settings.Collect.Has(goatcounter.CollectReferrer),
+		ShowLocations: site.Settings.Collect.Has(goatcounter.CollectLocation),
 	}
 	// TODO: ztime.Range.String() prints "relative" dates such as "yesterday"
 	// and "last week"; this is nice in some cases, but not so nice in others
 	// (such as here). Should have two functions for this.
 	if user.Settings.EmailReports != goatcounter.EmailReportDaily {
-		args.DisplayDate += " – " + rng.End.Format(user.Settings.DateFormat)
+		args.DisplayDate += " – " + user.Settings.FormatDate(rng.End, false)
 	}
-	// TODO: no locale on context here.
-	subject = fmt.Sprintf("Your GoatCounter report for %s", args.DisplayDate)
+	subject := z18n.T(ctx, "email/report-subject|Your GoatCounter report for %(date)", args.DisplayDate)
+
+	d := -rng.End.Sub(rng.Start)
+	prev := ztime.NewRange(rng.Start.Add(d)).To(rng.End.Add(d))
 
 	{ // Get overview of paths.
-		_, _, err := args.Pages.List(ctx, rng, nil, nil, 10, true)
+		_, _, err := args.Pages.List(ctx, rng, nil, goatcounter.HitListOpts{}, reportLimit, true)
 		if err != nil {
-			return nil, nil, "", err
+			return nil, "", err
 		}
 
 		if len(args.Pages) == 0 { /// No pages: don't bother sending out anything.
-			return nil, nil, "", nil
+			return nil, "", nil
 		}
 
 		_, err = args.Total.Totals(ctx, rng, nil, true, true)
 		if err != nil {
-			return nil, nil, "", err
+			return nil, "", err
 		}
 
-		d := -rng.End.Sub(rng.Start)
-		prev := ztime.NewRange(rng.Start.Add(d)).To(rng.End.Add(d))
 		diffs, err := args.Pages.Diff(ctx, rng, prev)
 		if err != nil {
-			return nil, nil, "", err
-		}
-
-		diffStr := make([]string, len(args.Pages))
-		for i := range diffs {
-			switch {
-			case math.IsInf(diffs[i], 0):
-				diffStr[i] = "(new)"
-			case diffs[i] < 0:
-				diffStr[i] = fmt.Sprintf("%+.0f%%", diffs[i])
-			default:
-				diffStr[i] = fmt.Sprintf("%.0f%%", diffs[i])
-			}
+			return nil, "", err
 		}
-		args.Diffs = diffStr
 
-		b := new(strings.Builder)
-		fmt.Fprintf(b, "    %-36s  %9s  %7s\n", "Path", "Visitors", "Growth")
-		b.WriteString("    " + strings.Repeat("-", 56) + "\n")
-		b.WriteByte('\n')
-		for i, p := range args.Pages {
-			path := p.Path
-			if p.Event {
-				path += " (e)"
+		args.Diffs = make([]string, len(args.Pages))
+		for i := range args.Pages {
+			if i < len(diffs) {
+				args.Diffs[i] = growth(ctx, diffs[i])
 			}
+		}
+	}
+
+	{ // Compare to the previous period.
+		var err error
+		args.Counts, err = goatcounter.GetTotalCount(ctx, rng, nil, false)
+		if err != nil {
+			return nil, "", err
+		}
+		args.PrevCounts, err = goatcounter.GetTotalCount(ctx, prev, nil, false)
+		if err != nil {
+			return nil, "", err
+		}
 
-			fmt.Fprintf(b, "    %-36s  %9s  %7s\n",
-				template.HTMLEscapeString(zstring.ElideLeft(path, 35)),
-				tplfunc.Number(p.Count, user.Settings.NumberFormat),
-				diffStr[i])
+		args.Compare = append(args.Compare, compare(ctx,
+			z18n.T(ctx, "email/report-visitors-header|Visitors"), args.PrevCounts.Total, args.Counts.Total))
+		if site.Settings.Collect.Has(goatcounter.CollectSession) {
+			args.Compare = append(args.Compare, compare(ctx,
+				z18n.T(ctx, "email/report-sessions-header|Sessions"), args.PrevCounts.Sessions, args.Counts.Sessions))
 		}
-		args.TextPagesTable = template.HTML(b.String())
 	}
 
-	{ // Get overview of refs.
-		err := args.Refs.ListTopRefs(ctx, rng, nil, 10, 0)
+	{ // Get paths that are new in this period.
+		err := args.NewPages.ListNew(ctx, rng, reportLimit)
 		if err != nil {
-			return nil, nil, "", err
+			return nil, "", err
 		}
+	}
 
-		b := new(strings.Builder)
-		fmt.Fprintf(b, "    %-45s  %9s\n", "Referrer", "Visitors")
-		b.WriteString("    " + strings.Repeat("-", 56) + "\n")
-		for _, r := range args.Refs.Stats {
-			path := r.Name
-			if path == "" {
-				path = "(no data)"
-			}
-			fmt.Fprintf(b, "    %-45s  %9s\n",
-				template.HTMLEscapeString(zstring.ElideLeft(path, 44)),
-				tplfunc.Number(r.Count, user.Settings.NumberFormat))
-			//refs[i].Path = zstring.ElideLeft(refs[i].Path, 44)
+	if args.ShowRefs { // Get overview of refs.
+		err := args.Refs.ListTopRefs(ctx, rng, nil, true, reportLimit, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		args.ShowRefs = len(args.Refs.Stats) > 0
+	}
+
+	if args.ShowLocations { // Get overview of countries.
+		err := args.Locations.ListLocations(ctx, rng, nil, reportLimit, 0)
+		if err != nil {
+			return nil, "", err
 		}
-		args.TextRefTable = template.HTML(b.String())
+		args.ShowLocations = len(args.Locations.Stats) > 0
+	}
+
+	return &args, subject, nil
+}
+
+// render the text and HTML versions of the report, in the language of the
+// locale on args.Context.
+func (args templateArgs) render() (text, html []byte, err error) {
+	var (
+		ctx         = args.Context
+		num         = args.User.Settings.FormatNumber
+		hdrPath     = z18n.T(ctx, "header/path|Path")
+		hdrVisitors = z18n.T(ctx, "email/report-visitors-header|Visitors")
+		hdrGrowth   = z18n.T(ctx, "email/report-growth-header|Growth")
+		rows        [][]string
+	)
+	for _, c := range args.Compare {
+		rows = append(rows, []string{c.Name, num(c.Cur), num(c.Prev), c.Growth})
+	}
+	args.TextCompareTable = textTable(z18n.T(ctx, "email/report-compare|Compared to the previous period"),
+		[]string{"", z18n.T(ctx, "email/report-this-period|This period"), z18n.T(ctx, "email/report-previous|Previous"), hdrGrowth},
+		rows)
+
+	rows = nil
+	for i, p := range args.Pages {
+		rows = append(rows, []string{pathName(ctx, p), num(p.Count), args.Diffs[i]})
+	}
+	args.TextPagesTable = textTable(z18n.T(ctx, "email/report-top-pages|Top 5 pages"),
+		[]string{hdrPath, hdrVisitors, hdrGrowth}, rows)
+
+	rows = nil
+	for _, p := range args.NewPages {
+		rows = append(rows, []string{pathName(ctx, p), num(p.Count)})
 	}
+	args.TextNewTable = textTable(z18n.T(ctx, "email/report-new-pages|New pages"),
+		[]string{hdrPath, hdrVisitors}, rows)
+
+	args.TextRefTable = statsTable(z18n.T(ctx, "email/report-top-refs|Top 5 referrers"),
+		z18n.T(ctx, "email/report-referrer|Referrer"), z18n.T(ctx, "email/report-no-ref|(no data)"),
+		hdrVisitors, args.User, args.Refs)
+	args.TextLocTable = statsTable(z18n.T(ctx, "email/report-top-countries|Top 5 countries"),
+		z18n.T(ctx, "email/report-country|Country"), z18n.T(ctx, "unknown|(unknown)"),
+		hdrVisitors, args.User, args.Locations)
 
 	text, err = ztpl.ExecuteBytes("email_report.gotxt", args)
 	if err != nil {
-		return nil, nil, "", errors.Errorf("cron.report text: %w", err)
+		return nil, nil, errors.Errorf("cron.report text: %w", err)
 	}
 	html, err = ztpl.ExecuteBytes("email_report.gohtml", args)
 	if err != nil {
-		return nil, nil, "", errors.Errorf("cron.report html: %w", err)
+		return nil, nil, errors.Errorf("cron.report html: %w", err)
+	}
+	return text, html, nil
+}
+
+func pathName(ctx context.Context, p goatcounter.HitList) string {
+	if p.Event {
+		return p.Path + " " + z18n.T(ctx, "email/report-event-short|(e)")
+	}
+	return p.Path
+}
+
+func compare(ctx context.Context, name string, prev, cur int) reportCompare {
+	c := reportCompare{Name: name, Cur: cur, Prev: prev, Up: cur > prev, Down: cur < prev}
+	if prev == 0 && cur == 0 {
+		c.Growth = growth(ctx, 0)
+	} else {
+		c.Growth = growth(ctx, float64(cur-prev)/float64(prev)*100)
+	}
+	return c
+}
+
+// growth formats the difference in percentage, with an arrow for the
+// direction.
+func growth(ctx context.Context, d float64) string {
+	switch {
+	case math.IsInf(d, 0) || math.IsNaN(d):
+		return z18n.T(ctx, "email/report-new|(new)")
+	case math.Round(d) > 0:
+		return fmt.Sprintf("↑ %.0f%%", d)
+	case math.Round(d) < 0:
+		return fmt.Sprintf("↓ %.0f%%", -d)
+	default:
+		return "0%"
+	}
+}
+
+func statsTable(title, header, empty, visitors string, user goatcounter.User, stats goatcounter.HitStats) template.HTML {
+	rows := make([][]string, 0, len(stats.Stats))
+	for _, s := range stats.Stats {
+		name := s.Name
+		if name == "" {
+			name = empty
+		}
+		rows = append(rows, []string{name, user.Settings.FormatNumber(s.Count)})
+	}
+	return textTable(title, []string{header, visitors}, rows)
+}
+
+// textTable formats a text table with 2, 3, or 4 columns and a centered title;
+// the first column is left-aligned and shortened if it's too long.
+func textTable(title string, header []string, rows [][]string) template.HTML {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "%s%s\n", strings.Repeat(" ", 4+max(56-utf8.RuneCountInString(title), 0)/2),
+		template.HTMLEscapeString(title))
+	b.WriteString("    " + strings.Repeat("-", 56) + "\n")
+	textRow(b, header)
+	b.WriteString("    " + strings.Repeat("-", 56) + "\n")
+	for _, r := range rows {
+		textRow(b, r)
 	}
+	return template.HTML(b.String())
+}
 
-	return text, html, subject, nil
+// textRow writes a row of a text table.
+func textRow(b *strings.Builder, cols []string) {
+	switch len(cols) {
+	case 2:
+		fmt.Fprintf(b, "    %-45s  %9s\n", template.HTMLEscapeString(zstring.ElideLeft(cols[0], 44)), cols[1])
+	case 3:
+		fmt.Fprintf(b, "    %-36s  %9s  %7s\n", template.HTMLEscapeString(zstring.ElideLeft(cols[0], 35)), cols[1], cols[2])
+	case 4:
+		fmt.Fprintf(b, "    %-23s  %11s  %9s  %7s\n", template.HTMLEscapeString(zstring.ElideLeft(cols[0], 22)), cols[1], cols[2], cols[3])
+	}
 }
@@ -7,9 +7,11 @@ package cron_test
 import (
 	"bytes"
 	"context"
+	"flag"
 	"io/fs"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -19,6 +21,8 @@ import (
 	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/tz"
+	"zgo.at/z18n"
+	"zgo.at/zdb"
 	"zgo.at/zstd/zgo"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/ztest"
@@ -57,6 +61,25 @@ func TestEmailReports(t *testing.T) {
 			},
 			"",
 		},
+		// Reports disabled → don't send out anything.
+		{
+			"opted out",
+			func(ctx context.Context) context.Context {
+				ctx = gctest.Site(ctx, t, nil, &goatcounter.User{
+					LastReportAt: now.Add(-day),
+					Settings: goatcounter.UserSettings{
+						EmailReports:  zint.Int(goatcounter.EmailReportNever),
+						Notifications: goatcounter.Notifications{Off: goatcounter.NotifyTypes},
+						Timezone:      tz.UTC,
+					},
+				})
+				sID := goatcounter.MustGetSite(ctx).ID
+				gctest.StoreHits(ctx, t, false,
+					goatcounter.Hit{Site: sID, FirstVisit: true, Path: "/a", CreatedAt: now.Add(-1 * time.Hour)})
+				return ctx
+			},
+			"",
+		},
 		{
 			"day",
 			func(ctx context.Context) context.Context {
@@ -88,12 +111,16 @@ func TestEmailReports(t *testing.T) {
 			}, `
 				Path                                   Visitors   Growth
 				/c                                            2    (new)
-				/b                                            2     100%
+				/b                                            2   ↑ 100%
 				/d                                            1       0%
 				/a                                            1    (new)
+				Path                                            Visitors
+				/c                                                     2
 				Referrer                                        Visitors
 				(no data)                                              5
 				xx                                                     1
+				Country                                         Visitors
+				(unknown)                                              6
 			`,
 		},
 		{
@@ -130,9 +157,16 @@ func TestEmailReports(t *testing.T) {
 				/d                                            2    (new)
 				/c                                            2    (new)
 				/a                                            2    (new)
+				Path                                            Visitors
+				/b                                                     3
+				/d                                                     2
+				/c                                                     2
+				/a                                                     2
 				Referrer                                        Visitors
 				(no data)                                              7
 				xx                                                     2
+				Country                                         Visitors
+				(unknown)                                              9
 		 	`,
 		},
 	}
@@ -159,12 +193,11 @@ func TestEmailReports(t *testing.T) {
 			}
 
 			// Compare a somewhat trimmed-down version of the text table.
-			have := regexp.MustCompile(`(?s)Top 10 pages.*This is the text version`).FindString(buf.String())
-			have = strings.ReplaceAll(have, "\r\n", "\n")
+			have := regexp.MustCompile(`(?s)Top 5 pages.*This is the text version`).FindString(buf.String())
+			have = strings.NewReplacer("\r\n", "\n", "=E2=86=91", "↑", "=E2=86=93", "↓").Replace(have)
 			have = strings.ReplaceAll(have, "This is the text version", "")
 			have = strings.TrimSpace(have)
-			have = strings.ReplaceAll(have, `Top 10 pages`, ``)
-			have = strings.ReplaceAll(have, `Top 10 referrers`, ``)
+			have = regexp.MustCompile(`(?m)^\s*(Top 5 \w+|New pages)$`).ReplaceAllString(have, ``)
 			have = strings.ReplaceAll(have, `--------------------------------------------------------`, ``)
 			have = regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(have, "")
 
@@ -175,3 +208,341 @@ func TestEmailReports(t *testing.T) {
 		})
 	}
 }
+
+func TestEmailReportsLocale(t *testing.T) {
+	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
+	err := ztpl.Init(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 6, 17, 0, 1, 0, 0, time.UTC)
+	ztime.Now = func() time.Time { return now }
+	t.Cleanup(func() { ztime.Now = func() time.Time { return time.Now().UTC() } })
+
+	tests := []struct {
+		lang     string
+		wantDate string
+		wantNum  string
+	}{
+		{"en-GB", "Sun Jun 16 2019", "1,234,567"},
+		{"de-DE", "So Jun 16 2019", "1.234.567"},
+		{"hi", "", "12,34,567"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			ctx := gctest.Site(gctest.DB(t), t, nil, &goatcounter.User{
+				LastReportAt: now.Add(-24 * time.Hour),
+				Settings: goatcounter.UserSettings{
+					EmailReports: zint.Int(goatcounter.EmailReportDaily),
+					Timezone:     tz.UTC,
+					Language:     tt.lang,
+					DateFormat:   "Mon Jan 2 2006",
+				},
+			})
+			goatcounter.Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+			gctest.StoreHits(ctx, t, false, goatcounter.Hit{FirstVisit: true, Path: "/a", CreatedAt: now.Add(-1 * time.Hour)})
+			err := zdb.Exec(ctx, `update hit_counts set total=1234567`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := new(bytes.Buffer)
+			blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+
+			err = cron.TaskEmailReports()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cron.WaitEmailReports()
+
+			have := buf.String()
+			if !strings.Contains(have, tt.wantNum) {
+				t.Errorf("doesn't contain %q:\n%s", tt.wantNum, have)
+			}
+			if tt.wantDate != "" && !strings.Contains(have, "report for "+tt.wantDate+" for the site") {
+				t.Errorf("doesn't contain %q:\n%s", tt.wantDate, have)
+			}
+		})
+	}
+}
+
+func TestEmailReportsSchedule(t *testing.T) {
+	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
+	err := ztpl.Init(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var now time.Time
+	ztime.Now = func() time.Time { return now }
+	t.Cleanup(func() { ztime.Now = func() time.Time { return time.Now().UTC() } })
+
+	setup := func(t *testing.T, user goatcounter.User) (context.Context, *bytes.Buffer) {
+		ctx := gctest.Site(gctest.DB(t), t, nil, &user)
+		goatcounter.Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+
+		hits := make([]goatcounter.Hit, 0, 30)
+		for d := time.Date(2019, 5, 25, 12, 0, 0, 0, time.UTC); d.Before(time.Date(2019, 6, 30, 0, 0, 0, 0, time.UTC)); d = d.Add(24 * time.Hour) {
+			hits = append(hits, goatcounter.Hit{FirstVisit: true, Path: "/a", CreatedAt: d})
+		}
+		gctest.StoreHits(ctx, t, false, hits...)
+
+		buf := new(bytes.Buffer)
+		blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+		return ctx, buf
+	}
+	run := func(t *testing.T, buf *bytes.Buffer) string {
+		buf.Reset()
+		err := cron.TaskEmailReports()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitEmailReports()
+		return strings.ReplaceAll(buf.String(), "=\r\n", "")
+	}
+
+	t.Run("walk", func(t *testing.T) {
+		// Friday 15:00 in WITA (UTC+8) is 07:00 UTC.
+		now = time.Date(2019, 6, 17, 0, 0, 0, 0, time.UTC)
+		_, buf := setup(t, goatcounter.User{
+			LastReportAt: time.Date(2019, 6, 14, 8, 0, 0, 0, time.UTC),
+			Settings: goatcounter.UserSettings{
+				EmailReports:       zint.Int(goatcounter.EmailReportWeekly),
+				EmailReportWeekday: "friday",
+				EmailReportHour:    15,
+				Timezone:           tz.MustNew("", "Asia/Makassar"),
+				DateFormat:         "2006-01-02",
+			},
+		})
+
+		var (
+			sent []string
+			want = []string{
+				"2019-06-21 07:00 report for 2019-06-14",
+				"2019-06-28 07:00 report for 2019-06-21",
+			}
+		)
+		for ; now.Before(time.Date(2019, 6, 29, 0, 0, 0, 0, time.UTC)); now = now.Add(time.Hour) {
+			mail := run(t, buf)
+			if mail == "" {
+				continue
+			}
+			d := regexp.MustCompile(`report for \S+`).FindString(mail)
+			sent = append(sent, now.Format("2006-01-02 15:04 ")+d)
+		}
+		if !slices.Equal(sent, want) {
+			t.Errorf("\nhave: %q\nwant: %q", sent, want)
+		}
+	})
+
+	t.Run("monthly", func(t *testing.T) {
+		now = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+		_, buf := setup(t, goatcounter.User{
+			LastReportAt: time.Date(2019, 5, 20, 0, 0, 0, 0, time.UTC),
+			Settings: goatcounter.UserSettings{
+				EmailReports:        zint.Int(goatcounter.EmailReportMonthly),
+				EmailReportMonthday: 3,
+				EmailReportHour:     9,
+				Timezone:            tz.UTC,
+				DateFormat:          "2006-01-02",
+			},
+		})
+
+		var sent []string
+		for ; now.Before(time.Date(2019, 6, 5, 0, 0, 0, 0, time.UTC)); now = now.Add(time.Hour) {
+			if mail := run(t, buf); mail != "" {
+				sent = append(sent, now.Format("2006-01-02 15:04 ")+regexp.MustCompile(`report for \S+`).FindString(mail))
+			}
+		}
+		if want := []string{"2019-06-03 09:00 report for 2019-05-01"}; !slices.Equal(sent, want) {
+			t.Errorf("\nhave: %q\nwant: %q", sent, want)
+		}
+	})
+
+	// Only send the most recent report after the server was down for a few
+	// weeks.
+	t.Run("catch up", func(t *testing.T) {
+		now = time.Date(2019, 6, 19, 12, 0, 0, 0, time.UTC)
+		_, buf := setup(t, goatcounter.User{
+			LastReportAt: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC),
+			Settings: goatcounter.UserSettings{
+				EmailReports:   zint.Int(goatcounter.EmailReportWeekly),
+				FirstDayOfWeek: "monday",
+				Timezone:       tz.UTC,
+				DateFormat:     "2006-01-02",
+			},
+		})
+
+		mail := run(t, buf)
+		if !strings.Contains(mail, "report for 2019-06-10 =E2=80=93 2019-06-16") {
+			t.Errorf("wrong report:\n%s", mail)
+		}
+
+		now = now.Add(time.Hour)
+		if mail := run(t, buf); mail != "" {
+			t.Errorf("sent second email:\n%s", mail)
+		}
+	})
+}
+
+func TestEmailReportsDigest(t *testing.T) {
+	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
+	err := ztpl.Init(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 6, 17, 0, 1, 0, 0, time.UTC)
+	ztime.Now = func() time.Time { return now }
+	t.Cleanup(func() { ztime.Now = func() time.Time { return time.Now().UTC() } })
+
+	ctx := gctest.Site(gctest.DB(t), t, nil, &goatcounter.User{
+		LastReportAt: now.Add(-24 * time.Hour),
+		Settings: goatcounter.UserSettings{
+			EmailReports:       zint.Int(goatcounter.EmailReportDaily),
+			EmailReportsDigest: true,
+			Timezone:           tz.UTC,
+		},
+	})
+	goatcounter.Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+	account := goatcounter.MustGetSite(ctx)
+
+	sites := make(map[string]*goatcounter.Site)
+	for _, code := range []string{"busy", "quiet", "hidden"} {
+		s := goatcounter.Site{Code: code, Parent: &account.ID}
+		err := s.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sites[code] = &s
+	}
+
+	user := goatcounter.MustGetUser(ctx)
+	user.Settings.EmailReportsExclude = []int64{sites["hidden"].ID}
+	err = user.Update(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hit := func(site int64, path string) goatcounter.Hit {
+		return goatcounter.Hit{Site: site, FirstVisit: true, Path: path, CreatedAt: now.Add(-1 * time.Hour)}
+	}
+	gctest.StoreHits(ctx, t, false,
+		hit(account.ID, "/account"),
+		hit(sites["busy"].ID, "/page-a"), hit(sites["busy"].ID, "/page-a"), hit(sites["busy"].ID, "/page-a"),
+		hit(sites["busy"].ID, "/page-b"), hit(sites["busy"].ID, "/page-b"),
+		hit(sites["busy"].ID, "/page-c"), hit(sites["busy"].ID, "/page-c"),
+		hit(sites["busy"].ID, "/page-d"),
+		hit(sites["hidden"].ID, "/hidden"))
+
+	buf := new(bytes.Buffer)
+	blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+	err = cron.TaskEmailReports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitEmailReports()
+
+	mail := strings.ReplaceAll(buf.String(), "=\r\n", "")
+	if n := strings.Count(mail, "Subject: "); n != 1 {
+		t.Fatalf("sent %d emails:\n%s", n, mail)
+	}
+	if !strings.Contains(mail, "Subject: Your GoatCounter digest for") {
+		t.Errorf("wrong subject:\n%s", mail)
+	}
+
+	var (
+		busy    = strings.Index(mail, sites["busy"].Display(ctx))
+		acct    = strings.Index(mail, account.Display(ctx))
+		noViews = strings.Index(mail, "No pageviews: "+sites["quiet"].Display(ctx))
+	)
+	if busy == -1 || acct == -1 || noViews == -1 || !(busy < acct && acct < noViews) {
+		t.Errorf("wrong order: busy=%d; account=%d; no pageviews=%d\n%s", busy, acct, noViews, mail)
+	}
+	if strings.Contains(mail, sites["hidden"].Display(ctx)) || strings.Contains(mail, "/hidden") {
+		t.Errorf("excluded site in digest:\n%s", mail)
+	}
+	// Top 3 pages only.
+	if !strings.Contains(mail, "/page-a") || strings.Contains(mail, "/page-d") {
+		t.Errorf("wrong pages:\n%s", mail)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata/")
+
+func TestEmailReportsGolden(t *testing.T) {
+	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
+	err := ztpl.Init(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := gctest.Site(gctest.DB(t), t, nil, nil)
+	site := goatcounter.MustGetSite(ctx)
+
+	tests := []struct {
+		lang, file                  string
+		visitors, sessions, newPage string
+	}{
+		{"en-GB", "email_report", "Visitors", "Sessions", "(new)"},
+		{"nl-NL", "email_report.nl-NL", "Bezoekers", "Sessies", "(nieuw)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			text, html, err := cron.RenderReport(cron.TemplateArgs{
+				Context:     z18n.With(ctx, goatcounter.GetBundle(ctx).Locale(tt.lang)),
+				Site:        *site,
+				User:        goatcounter.User{Settings: goatcounter.UserSettings{Language: tt.lang}},
+				DisplayDate: "2026-06-01 – 2026-06-07",
+				Counts:      goatcounter.TotalCount{Total: 1297},
+				PrevCounts:  goatcounter.TotalCount{Total: 1000},
+				Compare: []cron.ReportCompare{
+					{Name: tt.visitors, Cur: 1297, Prev: 1000, Growth: "↑ 30%", Up: true},
+					{Name: tt.sessions, Cur: 990, Prev: 1100, Growth: "↓ 10%", Down: true},
+				},
+				Pages: goatcounter.HitLists{
+					{Path: "/", Count: 1234},
+					{Path: "/blog/post", Count: 56},
+					{Path: "/click", Count: 7, Event: true},
+				},
+				Diffs:    []string{"↑ 12%", tt.newPage, "↓ 50%"},
+				NewPages: goatcounter.HitLists{{Path: "/blog/post", Count: 56}},
+				Refs: goatcounter.HitStats{Stats: []goatcounter.HitStat{
+					{Name: "", Count: 900},
+					{Name: "news.ycombinator.com", Count: 300},
+				}},
+				Locations: goatcounter.HitStats{Stats: []goatcounter.HitStat{
+					{ID: "NL", Name: "Netherlands", Count: 600},
+					{ID: "ID", Name: "Indonesia", Count: 400},
+				}},
+				ShowRefs:      true,
+				ShowLocations: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for file, have := range map[string][]byte{"testdata/" + tt.file + ".txt": text, "testdata/" + tt.file + ".html": html} {
+				h := strings.ReplaceAll(string(have), site.URL(ctx), "https://example.com")
+				if *updateGolden {
+					err := os.WriteFile(file, []byte(h), 0o644)
+					if err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+
+				want, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d := ztest.Diff(h, string(want)); d != "" {
+					t.Errorf("%s (run with -update to update)\n%s", file, d)
+				}
+			}
+		})
+	}
+}
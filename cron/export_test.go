@@ -0,0 +1,26 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import "time"
+
+type (
+	TemplateArgs  = templateArgs
+	ReportCompare = reportCompare
+)
+
+func RenderReport(args TemplateArgs) (text, html []byte, err error) { return args.render() }
+
+func SetWebhookRetry(t interface{ Cleanup(func()) }, r ...time.Duration) {
+	old := webhookRetry
+	webhookRetry = r
+	t.Cleanup(func() { webhookRetry = old })
+}
+
+func SetMaintenanceMinWAL(t interface{ Cleanup(func()) }, n int64) {
+	old := maintenanceMinWAL
+	maintenanceMinWAL = n
+	t.Cleanup(func() { maintenanceMinWAL = old })
+}
@@ -18,6 +18,7 @@ func updateHitCounts(ctx context.Context, hits []goatcounter.Hit) error {
 		// Group by day + pathID
 		type gt struct {
 			total  int
+			views  int
 			hour   string
 			pathID int64
 		}
@@ -30,11 +31,12 @@ func updateHitCounts(ctx context.Context, hits []goatcounter.Hit) error {
 			hour := h.CreatedAt.Format("2006-01-02 15:00:00")
 			k := hour + strconv.FormatInt(h.PathID, 10)
 			v := grouped[k]
-			if v.total == 0 {
+			if v.hour == "" {
 				v.hour = hour
 				v.pathID = h.PathID
 			}
 
+			v.views += 1
 			if h.FirstVisit {
 				v.total += 1
 			}
@@ -43,17 +45,19 @@ func updateHitCounts(ctx context.Context, hits []goatcounter.Hit) error {
 
 		siteID := goatcounter.MustGetSite(ctx).ID
 		ins := zdb.NewBulkInsert(ctx, "hit_counts", []string{"site_id", "path_id",
-			"hour", "total"})
+			"hour", "total", "views"})
 		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
 			ins.OnConflict(`on conflict on constraint "hit_counts#site_id#path_id#hour" do update set
-				total = hit_counts.total + excluded.total`)
+				total = hit_counts.total + excluded.total,
+				views = hit_counts.views + excluded.views`)
 		} else {
 			ins.OnConflict(`on conflict(site_id, path_id, hour) do update set
-				total = hit_counts.total + excluded.total`)
+				total = hit_counts.total + excluded.total,
+				views = hit_counts.views + excluded.views`)
 		}
 
 		for _, v := range grouped {
-			ins.Values(siteID, v.pathID, v.hour, v.total)
+			ins.Values(siteID, v.pathID, v.hour, v.total, v.views)
 		}
 		return ins.Finish()
 	}), "cron.updateHitCounts")
@@ -0,0 +1,56 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strconv"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// updateLabelStats counts the pageviews that matched the site's bot allowlist
+// per path and label; see goatcounter.BotAllow.
+func updateLabelStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			count  int
+			day    string
+			label  string
+			pathID int64
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			if h.Bot > 0 || h.Label == "" {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			k := day + strconv.FormatInt(h.PathID, 10) + "-" + h.Label
+			v := grouped[k]
+			if v.count == 0 {
+				v.day, v.label, v.pathID = day, h.Label, h.PathID
+			}
+			v.count += 1
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := zdb.NewBulkInsert(ctx, "label_stats", []string{"site_id", "path_id", "day", "label", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "label_stats#site_id#path_id#day#label" do update set
+				count = label_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day, label) do update set
+				count = label_stats.count + excluded.count`)
+		}
+		for _, v := range grouped {
+			ins.Values(siteID, v.pathID, v.day, v.label, v.count)
+		}
+		return ins.Finish()
+	}), "cron.updateLabelStats")
+}
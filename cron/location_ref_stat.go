@@ -0,0 +1,75 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// updateLocationRefStats stores the referrers per country, for the referrers
+// in the locations detail. Regions aren't stored, as that would be too much
+// data for too little use.
+func updateLocationRefStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			count   int
+			day     string
+			country string
+			refID   int64
+			pathID  int64
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			if h.Bot > 0 {
+				continue
+			}
+
+			refID := h.RefID
+			if h.CanonicalRefID > 0 {
+				refID = h.CanonicalRefID
+			}
+			country, _, _ := strings.Cut(h.Location, "-")
+
+			day := h.CreatedAt.Format("2006-01-02")
+			k := day + country + strconv.FormatInt(refID, 10) + "-" + strconv.FormatInt(h.PathID, 10)
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.country = country
+				v.refID = refID
+				v.pathID = h.PathID
+			}
+
+			if h.FirstVisit {
+				v.count += 1
+			}
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := zdb.NewBulkInsert(ctx, "location_ref_stats", []string{"site_id", "day",
+			"path_id", "country", "ref_id", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "location_ref_stats#site_id#path_id#day#country#ref_id" do update set
+				count = location_ref_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day, country, ref_id) do update set
+				count = location_ref_stats.count + excluded.count`)
+		}
+
+		for _, v := range grouped {
+			if v.count > 0 {
+				ins.Values(siteID, v.day, v.pathID, v.country, v.refID, v.count)
+			}
+		}
+		return ins.Finish()
+	}), "cron.updateLocationRefStats")
+}
@@ -0,0 +1,63 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestLocationRefStats(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Location: "US-TX", Path: "/a", FirstVisit: true, Ref: "https://example.com/x"},
+		{Site: site.ID, CreatedAt: now, Location: "US-CA", Path: "/a", FirstVisit: true, Ref: "https://example.com/x"},
+		{Site: site.ID, CreatedAt: now, Location: "US", Path: "/b", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Location: "US", Path: "/b", FirstVisit: false, Ref: "https://example.org"},
+		{Site: site.ID, CreatedAt: now, Location: "NL", Path: "/c", FirstVisit: true, Ref: "https://example.net"},
+	}...)
+
+	rng := ztime.NewRange(now).To(now)
+	var paths goatcounter.HitStats
+	err := paths.ListLocationPaths(ctx, "US", rng, nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+		"more": false,
+		"stats": [
+			{"count": 2, "name": "/a"},
+			{"count": 1, "name": "/b"}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(paths), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+
+	var refs goatcounter.HitStats
+	err = refs.ListLocationRefs(ctx, "US", rng, nil, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{
+		"more": true,
+		"stats": [
+			{"count": 2, "name": "example.com/x", "ref_scheme": "h"}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(refs), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
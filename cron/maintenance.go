@@ -0,0 +1,189 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// persistMu is held by persistAndStat, so that the SQLite maintenance doesn't
+// run at the same time and block storing pageviews for long.
+var persistMu sync.Mutex
+
+var (
+	// How often to run the SQLite maintenance; 0 to disable.
+	maintenanceInterval = func() atomic.Int64 {
+		var d atomic.Int64
+		d.Store(int64(6 * time.Hour))
+		return d
+	}()
+
+	// Don't checkpoint the WAL if it's smaller than this.
+	maintenanceMinWAL int64 = 64 * 1024 * 1024
+
+	// Number of pages to reclaim per "pragma incremental_vacuum"; the pageviews
+	// can be stored in between.
+	maintenanceVacuumPages = 10_000
+)
+
+// SetMaintenanceInterval sets how often to run the SQLite maintenance; 0 to
+// disable it.
+func SetMaintenanceInterval(d time.Duration) {
+	maintenanceInterval.Store(int64(d))
+}
+
+// MaintenanceResult is the result of the last run of the SQLite maintenance.
+type MaintenanceResult struct {
+	Ran       time.Time     `json:"ran"`
+	Took      time.Duration `json:"took"`
+	WALBefore int64         `json:"wal_before"` // WAL size in bytes before and after the checkpoint.
+	WALAfter  int64         `json:"wal_after"`
+	Vacuumed  int64         `json:"vacuumed"` // Bytes reclaimed by the incremental vacuum.
+	Skipped   []string      `json:"skipped"`  // Why work was skipped, if anything.
+}
+
+// GetMaintenanceResult gets the result of the last run of the SQLite
+// maintenance.
+func GetMaintenanceResult(ctx context.Context) (MaintenanceResult, error) {
+	var (
+		r MaintenanceResult
+		v []byte
+	)
+	err := zdb.Get(ctx, &v, `select value from store where key='sqlite-maintenance'`)
+	if zdb.ErrNoRows(err) {
+		return r, nil
+	}
+	if err != nil {
+		return r, errors.Wrap(err, "cron.GetMaintenanceResult")
+	}
+	return r, errors.Wrap(json.Unmarshal(v, &r), "cron.GetMaintenanceResult")
+}
+
+func (r MaintenanceResult) store(ctx context.Context) error {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return zdb.Exec(ctx, `insert into store (key, value) values ('sqlite-maintenance', :v)
+		on conflict (key) do update set value = excluded.value`,
+		map[string]any{"v": string(j)})
+}
+
+// sqliteMaintenance checkpoints and truncates the WAL, and reclaims the space of
+// deleted rows if auto_vacuum is set to incremental. This does nothing on
+// PostgreSQL.
+func sqliteMaintenance(ctx context.Context) error {
+	if zdb.SQLDialect(ctx) != zdb.DialectSQLite || maintenanceInterval.Load() <= 0 {
+		return nil
+	}
+
+	var (
+		l     = zlog.Module("cron")
+		start = time.Now()
+		res   = MaintenanceResult{Ran: ztime.Now()}
+	)
+
+	var files []struct {
+		Seq  int    `db:"seq"`
+		Name string `db:"name"`
+		File string `db:"file"`
+	}
+	err := zdb.Select(ctx, &files, `pragma database_list`)
+	if err != nil {
+		return errors.Wrap(err, "cron.sqliteMaintenance")
+	}
+	var file string
+	for _, f := range files {
+		if f.Name == "main" {
+			file = f.File
+		}
+	}
+
+	// In-memory databases don't have a WAL.
+	if st, err := os.Stat(file + "-wal"); err == nil {
+		res.WALBefore, res.WALAfter = st.Size(), st.Size()
+	}
+	if res.WALBefore < maintenanceMinWAL {
+		res.Skipped = append(res.Skipped, "WAL is small")
+	} else {
+		persistMu.Lock()
+		var ck struct {
+			Busy         int `db:"busy"`
+			Log          int `db:"log"`
+			Checkpointed int `db:"checkpointed"`
+		}
+		err := zdb.Get(ctx, &ck, `pragma wal_checkpoint(truncate)`)
+		persistMu.Unlock()
+		if err != nil {
+			return errors.Wrap(err, "cron.sqliteMaintenance: wal_checkpoint")
+		}
+		if ck.Busy != 0 {
+			res.Skipped = append(res.Skipped, "WAL checkpoint blocked by readers")
+		}
+		res.WALAfter = 0
+		if st, err := os.Stat(file + "-wal"); err == nil {
+			res.WALAfter = st.Size()
+		}
+	}
+
+	var autoVacuum, pageSize int
+	err = zdb.Get(ctx, &autoVacuum, `pragma auto_vacuum`)
+	if err != nil {
+		return errors.Wrap(err, "cron.sqliteMaintenance")
+	}
+	err = zdb.Get(ctx, &pageSize, `pragma page_size`)
+	if err != nil {
+		return errors.Wrap(err, "cron.sqliteMaintenance")
+	}
+	if autoVacuum != 2 {
+		res.Skipped = append(res.Skipped, `auto_vacuum isn't incremental; run "vacuum" once to enable it`)
+	} else {
+		for {
+			var before, after int
+			err := zdb.Get(ctx, &before, `pragma freelist_count`)
+			if err != nil {
+				return errors.Wrap(err, "cron.sqliteMaintenance")
+			}
+			if before == 0 {
+				break
+			}
+
+			persistMu.Lock()
+			err = zdb.Exec(ctx, `pragma incremental_vacuum(`+strconv.Itoa(maintenanceVacuumPages)+`)`)
+			persistMu.Unlock()
+			if err != nil {
+				return errors.Wrap(err, "cron.sqliteMaintenance: incremental_vacuum")
+			}
+
+			err = zdb.Get(ctx, &after, `pragma freelist_count`)
+			if err != nil {
+				return errors.Wrap(err, "cron.sqliteMaintenance")
+			}
+			res.Vacuumed += int64(before-after) * int64(pageSize)
+			if after >= before {
+				break
+			}
+		}
+	}
+
+	res.Took = time.Since(start)
+	if res.WALBefore != res.WALAfter || res.Vacuumed > 0 {
+		l.Fields(zlog.F{"wal_before": res.WALBefore, "wal_after": res.WALAfter, "vacuumed": res.Vacuumed}).Printf(
+			"sqlite maintenance: WAL from %d to %d bytes; reclaimed %d bytes in %s",
+			res.WALBefore, res.WALAfter, res.Vacuumed, res.Took.Round(time.Millisecond))
+	}
+	return res.store(ctx)
+}
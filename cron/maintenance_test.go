@@ -0,0 +1,75 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+)
+
+func TestSQLiteMaintenance(t *testing.T) {
+	ctx := gctest.DBFile(t)
+	cron.SetMaintenanceMinWAL(t, 0)
+
+	run := func() cron.MaintenanceResult {
+		err := cron.TaskSQLiteMaintenance()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitSQLiteMaintenance()
+		res, err := cron.GetMaintenanceResult(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if zdb.SQLDialect(ctx) != zdb.DialectSQLite {
+		if res := run(); !res.Ran.IsZero() {
+			t.Errorf("ran on PostgreSQL: %#v", res)
+		}
+		return
+	}
+
+	var autoVacuum int
+	err := zdb.Get(ctx, &autoVacuum, `pragma auto_vacuum`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if autoVacuum != 2 {
+		t.Fatalf("auto_vacuum is %d; want 2 (incremental)", autoVacuum)
+	}
+
+	ins := zdb.NewBulkInsert(ctx, "hits", []string{"site_id", "path_id", "browser_id", "system_id", "location", "created_at"})
+	now := time.Now().UTC().Round(time.Second)
+	for i := 0; i < 20_000; i++ {
+		ins.Values(1, 1, 0, 0, "NL-NH", now)
+	}
+	err = ins.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zdb.Exec(ctx, `delete from hits`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := run()
+	if res.Ran.IsZero() || res.Vacuumed == 0 {
+		t.Errorf("%#v", res)
+	}
+	var free int
+	err = zdb.Get(ctx, &free, `pragma freelist_count`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free != 0 {
+		t.Errorf("freelist_count is %d", free)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// Orphaned paths, refs, browsers, and systems are checked in batches; a single
+// run stops after orphanBudget and the next run continues where it left off. A
+// new pass over all tables is started orphanEvery after the last one finished.
+var (
+	orphanBatch  = 1_000
+	orphanBudget = 10 * time.Second
+	orphanEvery  = 24 * time.Hour
+)
+
+// SetOrphanBudget sets the batch size and the time budget for a single run of
+// the orphan cleanup; exported here for tests.
+func SetOrphanBudget(batch int, budget time.Duration) {
+	orphanBatch, orphanBudget = batch, budget
+}
+
+// OrphanProgress is the progress of the cleanup of orphaned paths, refs,
+// browsers, and systems.
+type OrphanProgress struct {
+	// Last checked ID by table in the current pass; tables that are done in
+	// this pass are -1.
+	Cursor map[string]int64 `json:"cursor"`
+
+	// Number of rows deleted by table, in the current pass and the last run.
+	Deleted    map[string]int `json:"deleted"`
+	LastRunDel map[string]int `json:"last_run_deleted"`
+
+	Started  time.Time `json:"started"`  // Start of the current pass.
+	Finished time.Time `json:"finished"` // End of the last pass; zero if in progress.
+	Updated  time.Time `json:"updated"`  // End of the last run.
+}
+
+// Total gets the total number of rows deleted in the current or last pass.
+func (p OrphanProgress) Total() int {
+	var t int
+	for _, n := range p.Deleted {
+		t += n
+	}
+	return t
+}
+
+// GetOrphanProgress gets the progress of the orphan cleanup.
+func GetOrphanProgress(ctx context.Context) (OrphanProgress, error) {
+	var (
+		p OrphanProgress
+		v []byte
+	)
+	err := zdb.Get(ctx, &v, `select value from store where key='orphans'`)
+	if zdb.ErrNoRows(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, errors.Wrap(err, "cron.GetOrphanProgress")
+	}
+	return p, errors.Wrap(json.Unmarshal(v, &p), "cron.GetOrphanProgress")
+}
+
+func (p OrphanProgress) store(ctx context.Context) error {
+	j, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return zdb.Exec(ctx, `insert into store (key, value) values ('orphans', :v)
+		on conflict (key) do update set value = excluded.value`,
+		map[string]any{"v": string(j)})
+}
+
+// orphans deletes paths, refs, browsers, and systems that are no longer used by
+// any pageview or stats.
+func orphans(ctx context.Context) error {
+	prog, err := GetOrphanProgress(ctx)
+	if err != nil {
+		return err
+	}
+	if !prog.Finished.IsZero() && ztime.Now().Sub(prog.Finished) < orphanEvery {
+		return nil
+	}
+	if prog.Started.IsZero() || !prog.Finished.IsZero() {
+		prog = OrphanProgress{Started: ztime.Now(), Cursor: make(map[string]int64), Deleted: make(map[string]int)}
+	}
+	prog.LastRunDel = make(map[string]int)
+
+	deadline := time.Now().Add(orphanBudget)
+	done := true
+	for _, t := range goatcounter.OrphanTables() {
+		for prog.Cursor[t] != -1 {
+			if time.Now().After(deadline) {
+				done = false
+				break
+			}
+
+			ids, last, err := goatcounter.FindOrphans(ctx, t, prog.Cursor[t], orphanBatch)
+			if err != nil {
+				return err
+			}
+
+			// Make sure no pageviews are stored while deleting, so they won't
+			// use a row that's about to be deleted.
+			persistMu.Lock()
+			n, err := goatcounter.DeleteOrphans(ctx, t, ids)
+			persistMu.Unlock()
+			if err != nil {
+				return err
+			}
+
+			prog.Deleted[t] += n
+			prog.LastRunDel[t] += n
+			prog.Cursor[t] = last
+			if last == 0 {
+				prog.Cursor[t] = -1
+			}
+		}
+	}
+
+	prog.Updated = ztime.Now()
+	if done {
+		prog.Finished = prog.Updated
+	}
+	if msg := orphanCounts(prog.LastRunDel); msg != "" {
+		zlog.Module("cron").Fields(zlog.F{"deleted": prog.LastRunDel, "done": done}).Printf(
+			"orphan cleanup: deleted %s", msg)
+	}
+	return prog.store(ctx)
+}
+
+func orphanCounts(n map[string]int) string {
+	var l []string
+	for _, t := range goatcounter.OrphanTables() {
+		if n[t] > 0 {
+			l = append(l, fmt.Sprintf("%d %s", n[t], t))
+		}
+	}
+	return strings.Join(l, ", ")
+}
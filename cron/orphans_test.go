@@ -0,0 +1,90 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+)
+
+func TestOrphans(t *testing.T) {
+	ctx := gctest.DB(t)
+	cron.SetOrphanBudget(2, time.Minute)
+	t.Cleanup(func() { cron.SetOrphanBudget(1_000, 10*time.Second) })
+
+	gctest.StoreHits(ctx, t, false, goatcounter.Hit{
+		Path:            "/used",
+		Ref:             "https://used.example.com",
+		UserAgentHeader: "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0",
+	})
+
+	for _, q := range []string{
+		`insert into paths (site_id, path) values (1, '/orphan1'), (1, '/orphan2'), (1, '/orphan3')`,
+		`insert into refs (ref, ref_scheme) values ('orphan.example.com', 'h')`,
+		`insert into browsers (name, version) values ('Orphan', '1')`,
+		`insert into systems (name, version) values ('Orphan', '1')`,
+	} {
+		err := zdb.Exec(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func() cron.OrphanProgress {
+		err := cron.TaskOrphans()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitOrphans()
+		p, err := cron.GetOrphanProgress(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	p := run()
+	if p.Finished.IsZero() {
+		t.Fatalf("not finished: %#v", p)
+	}
+	want := map[string]int{"paths": 3, "refs": 1, "browsers": 1, "systems": 1}
+	for k, v := range want {
+		if p.Deleted[k] != v {
+			t.Errorf("deleted %s: %d; want %d\n%#v", k, p.Deleted[k], v, p.Deleted)
+		}
+	}
+
+	have := zdb.DumpString(ctx, `
+		select 'path' as t, path as name from paths union all
+		select 'ref', ref from refs union all
+		select 'browser', name from browsers union all
+		select 'system', name from systems
+		order by t, name`)
+	w := `
+		t        name
+		browser  Firefox
+		path     /used
+		ref
+		ref      used.example.com
+		system   Linux`
+	if d := zdb.Diff(have, w); d != "" {
+		t.Error(d)
+	}
+
+	// Doesn't start a new pass right away.
+	err := zdb.Exec(ctx, `insert into paths (site_id, path) values (1, '/orphan4')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2 := run()
+	if !p2.Finished.Equal(p.Finished) || p2.Deleted["paths"] != 3 {
+		t.Errorf("started new pass: %#v", p2)
+	}
+}
@@ -28,13 +28,18 @@ func updateRefCounts(ctx context.Context, hits []goatcounter.Hit) error {
 				continue
 			}
 
+			refID := h.RefID
+			if h.CanonicalRefID > 0 {
+				refID = h.CanonicalRefID
+			}
+
 			hour := h.CreatedAt.Format("2006-01-02 15:00:00")
-			k := hour + strconv.FormatInt(h.PathID, 10) + strconv.FormatInt(h.RefID, 10)
+			k := hour + strconv.FormatInt(h.PathID, 10) + strconv.FormatInt(refID, 10)
 			v := grouped[k]
 			if v.total == 0 {
 				v.hour = hour
 				v.pathID = h.PathID
-				v.refID = h.RefID
+				v.refID = refID
 			}
 
 			if h.FirstVisit {
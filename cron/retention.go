@@ -0,0 +1,298 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// The pageviews are deleted or anonymized in batches, so that a site with a lot
+// of pageviews doesn't lock the hits table for too long. A single run stops
+// after retentionBudget, and the next run continues where it left off.
+var (
+	retentionBatch  = 5_000
+	retentionBudget = 5 * time.Second
+)
+
+// SetRetentionBudget sets the batch size and the time budget for a single run
+// of the data retention; exported here for tests.
+func SetRetentionBudget(batch int, budget time.Duration) {
+	retentionBatch, retentionBudget = batch, budget
+}
+
+// RetentionProgress is the progress of the data retention, which may take
+// several runs on large instances.
+type RetentionProgress struct {
+	// Site to continue with in the next run; 0 if the last run finished.
+	SiteID int64 `json:"site_id"`
+
+	// Number of pageviews deleted or anonymized since Started.
+	Deleted int `json:"deleted"`
+
+	// Estimated number of pageviews remaining for SiteID.
+	Remaining int `json:"remaining"`
+
+	Started time.Time `json:"started"` // Start of the first run.
+	Updated time.Time `json:"updated"` // End of the last run.
+}
+
+// GetRetentionProgress gets the progress of the data retention.
+func GetRetentionProgress(ctx context.Context) (RetentionProgress, error) {
+	var (
+		p RetentionProgress
+		v []byte
+	)
+	err := zdb.Get(ctx, &v, `select value from store where key='retention'`)
+	if zdb.ErrNoRows(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, errors.Wrap(err, "cron.GetRetentionProgress")
+	}
+	return p, errors.Wrap(json.Unmarshal(v, &p), "cron.GetRetentionProgress")
+}
+
+func (p RetentionProgress) store(ctx context.Context) error {
+	j, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return zdb.Exec(ctx, `insert into store (key, value) values ('retention', :v)
+		on conflict (key) do update set value = excluded.value`,
+		map[string]any{"v": string(j)})
+}
+
+func dataRetention(ctx context.Context) error {
+	l := zlog.Module("cron")
+
+	prog, err := GetRetentionProgress(ctx)
+	if err != nil {
+		return err
+	}
+	if prog.SiteID == 0 {
+		prog = RetentionProgress{Started: ztime.Now()}
+	}
+
+	var sites goatcounter.Sites
+	err = sites.UnscopedList(ctx)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(sites, func(a, b goatcounter.Site) int { return cmp.Compare(a.ID, b.ID) })
+
+	err = dropPartitions(ctx, sites)
+	if err != nil {
+		l.Error(err)
+	}
+
+	var (
+		deadline = time.Now().Add(retentionBudget)
+		deleted  int
+	)
+	for _, s := range sites {
+		if s.ID < prog.SiteID {
+			continue
+		}
+		days := s.Settings.EffectiveDataRetention(ctx)
+		if days <= 0 {
+			continue
+		}
+		until, err := s.RetentionDelayedUntil(ctx)
+		if err != nil {
+			l.Field("site", s.ID).Error(err)
+			continue
+		}
+		if until != nil {
+			l.Field("site", s.ID).Debugf("data retention: delayed until %s", until.Format(time.DateTime))
+			continue
+		}
+
+		n, done, err := retainSite(ctx, s, days, deadline)
+		deleted += n
+		prog.Deleted += n
+		if err != nil {
+			l.Field("site", s.ID).Error(err)
+			continue
+		}
+		if !done {
+			prog.SiteID, prog.Remaining, prog.Updated = s.ID, remaining(ctx, s, days), ztime.Now()
+			l.Fields(zlog.F{"site": s.ID, "deleted": deleted, "remaining": prog.Remaining}).Printf(
+				"data retention: out of time; deleted %d pageviews, about %d remaining for site %d",
+				deleted, prog.Remaining, s.ID)
+			return prog.store(ctx)
+		}
+	}
+
+	if prog.Deleted > 0 {
+		l.Field("deleted", prog.Deleted).Printf("data retention: finished; deleted %d pageviews since %s",
+			prog.Deleted, prog.Started.Format(time.DateTime))
+	}
+	prog.SiteID, prog.Remaining, prog.Updated = 0, 0, ztime.Now()
+	return prog.store(ctx)
+}
+
+// DataRetentionDryRun gets what the data retention would remove for every
+// site, without removing anything.
+func DataRetentionDryRun(ctx context.Context) (map[int64]goatcounter.RetentionPreview, error) {
+	var sites goatcounter.Sites
+	err := sites.UnscopedList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l := zlog.Module("cron")
+	previews := make(map[int64]goatcounter.RetentionPreview)
+	for _, s := range sites {
+		p, err := s.RetentionPreview(ctx, s.Settings)
+		if err != nil {
+			return nil, err
+		}
+		if p.Pageviews == 0 && p.StatRows == 0 {
+			continue
+		}
+		previews[s.ID] = p
+		l.Fields(zlog.F{"site": s.ID, "pageviews": p.Pageviews, "stat_rows": p.StatRows, "bytes": p.Bytes}).Printf(
+			"data retention (dry run): would remove %d pageviews and %d stat rows before %s (~%sM) for site %d",
+			p.Pageviews, p.StatRows, p.To.Format(time.DateOnly), p.SizeMB(), s.ID)
+	}
+	return previews, nil
+}
+
+// retainSite applies the data retention for a site, until everything is done
+// or the deadline has passed.
+func retainSite(ctx context.Context, s goatcounter.Site, days int, deadline time.Time) (int, bool, error) {
+	anon := s.Settings.RetentionMode == goatcounter.RetentionAnonymize
+
+	var total int
+	for {
+		if time.Now().After(deadline) {
+			return total, false, nil
+		}
+
+		var (
+			n   int
+			err error
+		)
+		if anon {
+			n, err = s.AnonymizeOlderThan(ctx, days, retentionBatch)
+		} else {
+			n, err = s.DeleteHitsOlderThan(ctx, days, retentionBatch)
+		}
+		total += n
+		if err != nil {
+			return total, false, err
+		}
+		if n < retentionBatch {
+			break
+		}
+	}
+
+	if anon {
+		return total, true, nil
+	}
+	err := s.DeleteOlderThan(ctx, days)
+	if err != nil {
+		return total, false, err
+	}
+	if s.Settings.RetentionMode == goatcounter.RetentionDownsample {
+		err = downsample(ctx, s)
+	}
+	return total, err == nil, err
+}
+
+// remaining gets the number of pageviews still to be deleted or anonymized.
+func remaining(ctx context.Context, s goatcounter.Site, days int) int {
+	var n int
+	err := zdb.Get(ctx, &n, `/* cron.remaining */
+		select count(*) from hits where site_id = :site and created_at < `+goatcounter.Interval(ctx, days)+`
+		{{:anon and (session is not null or browser_id != 0 or system_id != 0 or length(location) > 2)}}`,
+		map[string]any{"site": s.ID, "anon": s.Settings.RetentionMode == goatcounter.RetentionAnonymize})
+	if err != nil {
+		zlog.Module("cron").Field("site", s.ID).Error(err)
+	}
+	return n
+}
+
+func downsample(ctx context.Context, s goatcounter.Site) error {
+	res, err := s.Downsample(ctx)
+	if res.Rows > 0 {
+		zlog.Module("cron").Field("site", s.ID).Printf(
+			"downsampled %d days and %d months; removed %d rows", res.Days, res.Months, res.Rows)
+	}
+	return err
+}
+
+var rePartitionTo = regexp.MustCompile(`TO \('([^']+)'\)`)
+
+// dropPartitions drops partitions of the hits table on PostgreSQL if all
+// pageviews in it are older than the data retention of every site, which is a
+// lot faster than deleting the rows. The hits table can be partitioned with
+// "goatcounter db partition-hits".
+//
+// This does nothing if any site keeps the pageviews forever or anonymizes them,
+// or if the data retention is delayed for any site.
+func dropPartitions(ctx context.Context, sites goatcounter.Sites) error {
+	if zdb.SQLDialect(ctx) != zdb.DialectPostgreSQL {
+		return nil
+	}
+
+	var parts []struct {
+		Name  string `db:"name"`
+		Bound string `db:"bound"`
+	}
+	err := zdb.Select(ctx, &parts, `/* cron.dropPartitions */
+		select c.relname as name, pg_get_expr(c.relpartbound, c.oid) as bound
+		from pg_inherits i
+		join pg_class c on c.oid = i.inhrelid
+		join pg_class p on p.oid = i.inhparent
+		where p.relname = 'hits'`)
+	if err != nil || len(parts) == 0 {
+		return errors.Wrap(err, "cron.dropPartitions")
+	}
+
+	var cutoff time.Time
+	for _, s := range sites {
+		days := s.Settings.EffectiveDataRetention(ctx)
+		if days <= 0 || s.Settings.RetentionMode == goatcounter.RetentionAnonymize {
+			return nil
+		}
+		if until, err := s.RetentionDelayedUntil(ctx); err != nil || until != nil {
+			return err
+		}
+		if c := ztime.Now().UTC().AddDate(0, 0, -days); cutoff.IsZero() || c.Before(cutoff) {
+			cutoff = c
+		}
+	}
+
+	for _, p := range parts {
+		m := rePartitionTo.FindStringSubmatch(p.Bound)
+		if len(m) < 2 || len(m[1]) < 10 {
+			continue
+		}
+		to, err := time.Parse(time.DateOnly, m[1][:10])
+		if err != nil || to.After(cutoff) {
+			continue
+		}
+
+		err = zdb.Exec(ctx, `drop table "`+strings.ReplaceAll(p.Name, `"`, `""`)+`"`)
+		if err != nil {
+			return errors.Wrapf(err, "cron.dropPartitions: %s", p.Name)
+		}
+		zlog.Module("cron").Printf("data retention: dropped partition %s (%s)", p.Name, p.Bound)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+func TestDataRetentionBudget(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	const (
+		old    = 20_000
+		recent = 100
+		budget = 50 * time.Millisecond
+	)
+	var sites []goatcounter.Site
+	for _, code := range []string{"bbbb", "cccc"} {
+		s := goatcounter.Site{Code: code, Settings: goatcounter.SiteSettings{DataRetention: 31}}
+		err := s.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sites = append(sites, s)
+	}
+
+	ins := zdb.NewBulkInsert(ctx, "hits", []string{"site_id", "path_id", "browser_id", "system_id", "created_at"})
+	now := time.Now().UTC()
+	for _, s := range sites {
+		for i := 0; i < old; i++ {
+			ins.Values(s.ID, 1, 0, 0, now.Add(-40*24*time.Hour-time.Duration(i)*time.Minute).Round(time.Second))
+		}
+		for i := 0; i < recent; i++ {
+			ins.Values(s.ID, 1, 0, 0, now.Add(-time.Duration(i)*time.Minute).Round(time.Second))
+		}
+	}
+	err := ins.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cron.SetRetentionBudget(500, budget)
+	defer cron.SetRetentionBudget(5_000, 5*time.Second)
+
+	var (
+		runs int
+		prog cron.RetentionProgress
+	)
+	for {
+		runs++
+		if runs > 1000 {
+			t.Fatal("still not finished after 1,000 runs")
+		}
+
+		start := time.Now()
+		err := cron.TaskDataRetention()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitDataRetention()
+
+		// The last batch can start right before the deadline, so allow some
+		// time for that.
+		if took := time.Since(start); took > budget+time.Second {
+			t.Errorf("run %d took %s", runs, took)
+		}
+
+		prog, err = cron.GetRetentionProgress(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prog.SiteID == 0 {
+			break
+		}
+		if prog.Remaining == 0 || prog.Remaining > old {
+			t.Errorf("run %d: remaining is %d", runs, prog.Remaining)
+		}
+	}
+
+	if runs < 2 {
+		t.Errorf("finished in one run; the budget wasn't used")
+	}
+	if prog.Deleted != old*len(sites) {
+		t.Errorf("deleted %d; want %d", prog.Deleted, old*len(sites))
+	}
+	for _, s := range sites {
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from hits where site_id = ?`, s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != recent {
+			t.Errorf("site %d: %d hits left; want %d", s.ID, n, recent)
+		}
+	}
+}
+
+func TestDataRetentionPreview(t *testing.T) {
+	tables := []string{"hit_counts", "ref_counts", "hit_stats", "system_stats", "browser_stats",
+		"location_stats", "city_stats", "language_stats", "size_stats", "device_stats",
+		"status_stats", "session_stats", "session_durations", "exit_stats", "unknown_ua_stats",
+		"location_ref_stats", "scale_stats", "label_stats", "campaign_stats", "visitor_sketches"}
+	statRows := func(t *testing.T, ctx context.Context, siteID int64) int {
+		var total int
+		for _, tbl := range tables {
+			var n int
+			err := zdb.Get(ctx, &n, `select count(*) from `+tbl+` where site_id = ?`, siteID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += n
+		}
+		return total
+	}
+
+	for _, mode := range []string{goatcounter.RetentionAll, goatcounter.RetentionAggregate, goatcounter.RetentionAnonymize} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := goatcounter.Site{Code: "bbbb", Settings: goatcounter.SiteSettings{DataRetention: -1, RetentionMode: mode}}
+			site.Settings.Defaults(ctx)
+			site.Settings.Collect.Set(goatcounter.CollectHits)
+			err := site.Insert(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx = goatcounter.WithSite(ctx, &site)
+
+			var (
+				ff   = "Mozilla/5.0 (X11; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0"
+				now  = time.Now().UTC()
+				hits []goatcounter.Hit
+			)
+			for i := range 10 {
+				hits = append(hits,
+					goatcounter.Hit{Site: site.ID, Path: "/old", FirstVisit: true, UserAgentHeader: ff, CreatedAt: now.AddDate(0, 0, -40-i)},
+					goatcounter.Hit{Site: site.ID, Path: "/new", FirstVisit: true, UserAgentHeader: ff, CreatedAt: now.AddDate(0, 0, -i)})
+			}
+			gctest.StoreHits(ctx, t, false, hits...)
+
+			// Lower the retention; nothing should be removed for a day.
+			old := site.Settings
+			site.Settings.DataRetention = 31
+			err = site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = site.DelayRetention(ctx, old)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			preview, err := site.RetentionPreview(ctx, site.Settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preview.Pageviews != 10 || preview.From == nil || preview.To == nil {
+				t.Fatalf("%#v", preview)
+			}
+			if mode == goatcounter.RetentionAll && preview.StatRows == 0 {
+				t.Errorf("StatRows is 0")
+			}
+			if mode != goatcounter.RetentionAll && preview.StatRows != 0 {
+				t.Errorf("StatRows is %d", preview.StatRows)
+			}
+			dry, err := cron.DataRetentionDryRun(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// To is the current time, so will be different.
+			if d := dry[site.ID]; d.Pageviews != preview.Pageviews || d.StatRows != preview.StatRows ||
+				d.Bytes != preview.Bytes || d.From == nil || !d.From.Equal(*preview.From) {
+				t.Errorf("dry run:\nhave: %#v\nwant: %#v", d, preview)
+			}
+
+			before := statRows(t, ctx, site.ID)
+			run := func() cron.RetentionProgress {
+				err = cron.TaskDataRetention()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cron.WaitDataRetention()
+				prog, err := cron.GetRetentionProgress(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return prog
+			}
+
+			if prog := run(); prog.Deleted != 0 {
+				t.Fatalf("deleted %d pageviews before the delay was over", prog.Deleted)
+			}
+			if after := statRows(t, ctx, site.ID); after != before {
+				t.Fatalf("deleted %d stat rows before the delay was over", before-after)
+			}
+
+			ztime.SetNow(t, ztime.Now().Add(goatcounter.RetentionDelay+time.Minute).Format(time.DateTime))
+			if prog := run(); prog.Deleted != preview.Pageviews {
+				t.Errorf("deleted %d pageviews; preview said %d", prog.Deleted, preview.Pageviews)
+			}
+			if after := statRows(t, ctx, site.ID); before-after != preview.StatRows {
+				t.Errorf("deleted %d stat rows; preview said %d", before-after, preview.StatRows)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestScaleStats(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Size: []float64{1920, 1080, 1}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Size: []float64{1920, 1080, 1}},
+		{Site: site.ID, CreatedAt: now, Size: []float64{1536, 864, 1.25}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Size: []float64{1280, 720, 1.5}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Size: []float64{412, 915, 2.625}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Size: []float64{390, 844, 3}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Size: []float64{1920, 1080, 0}, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, FirstVisit: true},
+	}...)
+
+	var have goatcounter.HitStats
+	err := have.ListScales(ctx, ztime.NewRange(now).To(now), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{
+		"more": false,
+		"stats": [
+			{"count": 2, "id": "1x",      "name": "1×"},
+			{"count": 1, "id": "1.5x",    "name": "1.5×"},
+			{"count": 1, "id": "2x",      "name": "2×"},
+			{"count": 1, "id": "3x",      "name": "3×+"},
+			{"count": 2, "id": "unknown", "name": ""}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
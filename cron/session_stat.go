@@ -0,0 +1,234 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+)
+
+// Sessions are attributed to the day and path they started on; a second
+// pageview on the next day still "un-bounces" the session on the day it
+// started.
+//
+// The duration is the time between the first and last pageview; every new
+// pageview adds the difference to the total duration, and moves the session to
+// a different bucket in the histogram.
+//
+// The exit page is the last page in a session; like the duration this is
+// updated with every new pageview, moving the exit from the previous path to
+// the new one. Exits are also stored on the day the session started.
+func updateSessionStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			sessions  int
+			bounces   int
+			duration  int
+			pageviews int
+			day       string
+			pathID    int64
+			buckets   map[int]int
+		}
+		grouped := map[string]gt{}
+		exits := map[string]map[int64]int{}
+		for _, h := range hits {
+			if h.Bot > 0 || h.Event || h.SessionEntry.Pageviews == 0 {
+				continue
+			}
+
+			day := h.SessionEntry.Start.Format("2006-01-02")
+			k := day + strconv.FormatInt(h.SessionEntry.PathID, 10)
+			v := grouped[k]
+			if v.day == "" {
+				v.day = day
+				v.pathID = h.SessionEntry.PathID
+				v.buckets = make(map[int]int)
+			}
+
+			v.pageviews += 1
+			switch h.SessionEntry.Pageviews {
+			case 1:
+				v.sessions += 1
+				v.bounces += 1
+				v.buckets[0] += 1
+			case 2:
+				v.bounces -= 1
+			}
+			if h.SessionEntry.Pageviews > 1 {
+				prev, cur := h.SessionEntry.PrevDuration(), h.SessionEntry.Duration()
+				v.duration += int((cur - prev) / time.Second)
+				if pb, cb := goatcounter.SessionDurationBucket(prev), goatcounter.SessionDurationBucket(cur); pb != cb {
+					v.buckets[pb] -= 1
+					v.buckets[cb] += 1
+				}
+			}
+			grouped[k] = v
+
+			if e := h.SessionEntry; e.Pageviews == 1 || e.ExitPathID != e.PrevExitPathID {
+				if exits[day] == nil {
+					exits[day] = make(map[int64]int)
+				}
+				if e.Pageviews > 1 && e.PrevExitPathID != 0 {
+					exits[day][e.PrevExitPathID] -= 1
+				}
+				exits[day][e.ExitPathID] += 1
+			}
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := zdb.NewBulkInsert(ctx, "session_stats", []string{"site_id", "day", "path_id",
+			"sessions", "bounces", "duration", "pageviews"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "session_stats#site_id#path_id#day" do update set
+				sessions  = session_stats.sessions  + excluded.sessions,
+				bounces   = session_stats.bounces   + excluded.bounces,
+				duration  = session_stats.duration  + excluded.duration,
+				pageviews = session_stats.pageviews + excluded.pageviews`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day) do update set
+				sessions  = session_stats.sessions  + excluded.sessions,
+				bounces   = session_stats.bounces   + excluded.bounces,
+				duration  = session_stats.duration  + excluded.duration,
+				pageviews = session_stats.pageviews + excluded.pageviews`)
+		}
+
+		insDur := zdb.NewBulkInsert(ctx, "session_durations", []string{"site_id", "day", "path_id",
+			"bucket", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			insDur.OnConflict(`on conflict on constraint "session_durations#site_id#path_id#day#bucket" do update set
+				count = session_durations.count + excluded.count`)
+		} else {
+			insDur.OnConflict(`on conflict(site_id, path_id, day, bucket) do update set
+				count = session_durations.count + excluded.count`)
+		}
+
+		insExit := zdb.NewBulkInsert(ctx, "exit_stats", []string{"site_id", "day", "path_id", "exits"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			insExit.OnConflict(`on conflict on constraint "exit_stats#site_id#path_id#day" do update set
+				exits = exit_stats.exits + excluded.exits`)
+		} else {
+			insExit.OnConflict(`on conflict(site_id, path_id, day) do update set
+				exits = exit_stats.exits + excluded.exits`)
+		}
+
+		for _, v := range grouped {
+			if v.pageviews > 0 {
+				ins.Values(siteID, v.day, v.pathID, v.sessions, v.bounces, v.duration, v.pageviews)
+			}
+			for b, c := range v.buckets {
+				if c != 0 {
+					insDur.Values(siteID, v.day, v.pathID, b, c)
+				}
+			}
+		}
+		for day, paths := range exits {
+			for pathID, c := range paths {
+				if c != 0 {
+					insExit.Values(siteID, day, pathID, c)
+				}
+			}
+		}
+
+		err := ins.Finish()
+		if err != nil {
+			return err
+		}
+		err = insDur.Finish()
+		if err != nil {
+			return err
+		}
+		return insExit.Finish()
+	}), "cron.updateSessionStats")
+}
+
+// SessionStatsFromHits recalculates the session_stats, session_durations, and
+// exit_stats from the hits table.
+//
+// This only works for the period for which there are raw hits, and will
+// replace the session_stats for that period.
+func SessionStatsFromHits(ctx context.Context, site goatcounter.Site) error {
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	var first, last time.Time
+	err := zdb.Get(ctx, &first, `/* cron.SessionStatsFromHits */
+		select created_at from hits where site_id=? and bot=0 and session is not null order by created_at asc limit 1`,
+		site.ID)
+	if zdb.ErrNoRows(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "cron.SessionStatsFromHits")
+	}
+	err = zdb.Get(ctx, &last, `/* cron.SessionStatsFromHits */
+		select created_at from hits where site_id=? and bot=0 order by created_at desc limit 1`,
+		site.ID)
+	if err != nil {
+		return errors.Wrap(err, "cron.SessionStatsFromHits")
+	}
+
+	for _, t := range []string{"session_stats", "session_durations", "exit_stats"} {
+		err = zdb.Exec(ctx, `delete from `+t+` where site_id=? and day >= ?`,
+			site.ID, first.Format("2006-01-02"))
+		if err != nil {
+			return errors.Wrap(err, "cron.SessionStatsFromHits")
+		}
+	}
+
+	// Go over it one day at a time to keep the memory usage in check; sessions
+	// can span more than one day so keep track of the ones we've seen.
+	entries := make(map[zint.Uint128]goatcounter.SessionEntry)
+	for day := ztime.StartOf(first.UTC(), ztime.Day); !day.After(last); day = day.Add(24 * time.Hour) {
+		var rows []struct {
+			Session   zint.Uint128 `db:"session"`
+			PathID    int64        `db:"path_id"`
+			Event     zbool.Bool   `db:"event"`
+			CreatedAt time.Time    `db:"created_at"`
+		}
+		err := zdb.Select(ctx, &rows, `/* cron.SessionStatsFromHits */
+			select session, path_id, paths.event, created_at from hits
+			join paths using (site_id, path_id)
+			where
+				hits.site_id = ? and bot = 0 and session is not null and
+				created_at >= ? and created_at < ?
+			order by created_at asc`,
+			site.ID, day, day.Add(24*time.Hour))
+		if err != nil {
+			return errors.Wrap(err, "cron.SessionStatsFromHits")
+		}
+
+		hits := make([]goatcounter.Hit, 0, len(rows))
+		for _, r := range rows {
+			if r.Event || r.Session.IsZero() {
+				continue
+			}
+
+			e := entries[r.Session]
+			e.Add(r.PathID, r.CreatedAt)
+			entries[r.Session] = e
+
+			hits = append(hits, goatcounter.Hit{Site: site.ID, PathID: r.PathID, SessionEntry: e})
+		}
+
+		err = updateSessionStats(ctx, hits)
+		if err != nil {
+			return errors.Wrap(err, "cron.SessionStatsFromHits")
+		}
+
+		for id, e := range entries {
+			if e.Start.Before(day.Add(-goatcounter.SessionTime)) {
+				delete(entries, id)
+			}
+		}
+	}
+	return nil
+}
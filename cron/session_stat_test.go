@@ -0,0 +1,197 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestSessionStats(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.Collect.Set(goatcounter.CollectHits)
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	s1 := zint.Uint128{1, 1}
+	s2 := zint.Uint128{1, 2}
+	s3 := zint.Uint128{1, 3}
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", Session: s1, FirstVisit: true},
+
+		{Site: site.ID, CreatedAt: now, Path: "/a", Session: s2, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Path: "/b", Session: s2, FirstVisit: true},
+
+		// Events aren't pageviews, so this is still a bounce.
+		{Site: site.ID, CreatedAt: now, Path: "/b", Session: s3, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Path: "click", Event: true, Session: s3, FirstVisit: true},
+	}...)
+
+	check := func(wantSessions, wantBounces int) {
+		t.Helper()
+		tc, err := goatcounter.GetTotalCount(ctx, ztime.NewRange(now).To(now.Add(24*time.Hour)), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.Sessions != wantSessions || tc.Bounces != wantBounces {
+			t.Errorf("\nhave: sessions=%d bounces=%d\nwant: sessions=%d bounces=%d",
+				tc.Sessions, tc.Bounces, wantSessions, wantBounces)
+		}
+	}
+	check(3, 2)
+
+	// Second pageview on the next day: the session started yesterday, so it's
+	// no longer a bounce there.
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now.Add(10 * time.Hour), Path: "/c", Session: s1, FirstVisit: true},
+	}...)
+	check(3, 1)
+
+	// Recalculating from the hits should give the same result.
+	err = zdb.Exec(ctx, `delete from session_stats`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(0, 0)
+	err = cron.SessionStatsFromHits(ctx, *site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(3, 1)
+
+	tc, err := goatcounter.GetTotalCount(ctx, ztime.NewRange(now).To(now.Add(24*time.Hour)), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.Pageviews != 5 || tc.PagesPerVisit() != 5.0/3 {
+		t.Errorf("pageviews=%d; pages per visit=%f", tc.Pageviews, tc.PagesPerVisit())
+	}
+}
+
+func TestSessionDuration(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	s1 := zint.Uint128{1, 1}
+	s2 := zint.Uint128{1, 2}
+	s3 := zint.Uint128{1, 3}
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", Session: s1, FirstVisit: true},
+
+		{Site: site.ID, CreatedAt: now, Path: "/a", Session: s2, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now.Add(20 * time.Second), Path: "/b", Session: s2, FirstVisit: true},
+
+		{Site: site.ID, CreatedAt: now, Path: "/b", Session: s3, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now.Add(30 * time.Second), Path: "/c", Session: s3, FirstVisit: true},
+	}...)
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now.Add(90 * time.Second), Path: "/a", Session: s3, FirstVisit: true},
+	}...)
+
+	have, err := goatcounter.GetSessionDuration(ctx, ztime.NewRange(now).To(now), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"average": 36.666666666666664, "median": 20}`
+	if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestEntryExitPages(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	s1 := zint.Uint128{1, 1}
+	s2 := zint.Uint128{1, 2}
+	s3 := zint.Uint128{1, 3}
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", Session: s1, FirstVisit: true},
+
+		{Site: site.ID, CreatedAt: now, Path: "/a", Session: s2, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now.Add(20 * time.Second), Path: "/b", Session: s2, FirstVisit: true},
+
+		{Site: site.ID, CreatedAt: now, Path: "/b", Session: s3, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now.Add(30 * time.Second), Path: "/c", Session: s3, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now.Add(40 * time.Second), Path: "click", Event: true, Session: s3, FirstVisit: true},
+	}...)
+
+	rng := ztime.NewRange(now).To(now)
+	check := func(wantEntries, wantExits string) {
+		t.Helper()
+		var entries, exits goatcounter.HitStats
+		err := entries.ListEntryPages(ctx, rng, nil, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = exits.ListExitPages(ctx, rng, nil, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		str := func(h goatcounter.HitStats) string {
+			var s []string
+			for _, st := range h.Stats {
+				s = append(s, fmt.Sprintf("%s:%d", st.Name, st.Count))
+			}
+			return strings.Join(s, " ")
+		}
+		if have := str(entries); have != wantEntries {
+			t.Errorf("entries\nhave: %s\nwant: %s", have, wantEntries)
+		}
+		if have := str(exits); have != wantExits {
+			t.Errorf("exits\nhave: %s\nwant: %s", have, wantExits)
+		}
+	}
+	check("/a:2 /b:1", "/a:1 /b:1 /c:1")
+
+	// Session continues on the next day; the exit moves but stays on the day
+	// the session started.
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now.Add(10 * time.Hour), Path: "/a", Session: s3, FirstVisit: true},
+	}...)
+	check("/a:2 /b:1", "/a:2 /b:1")
+
+	sessions, exits, err := goatcounter.CountSessions(ctx, rng, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions != 3 || exits != 3 {
+		t.Errorf("sessions=%d; exits=%d", sessions, exits)
+	}
+
+	// Recalculating from the hits should give the same result.
+	err = zdb.Exec(ctx, `delete from exit_stats`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("/a:2 /b:1", "")
+	err = cron.SessionStatsFromHits(ctx, *site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("/a:2 /b:1", "/a:2 /b:1")
+}
@@ -0,0 +1,60 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strconv"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// This counts every request with a status code, rather than just the first
+// visit, as it's about the requests and not the visitors.
+func updateStatusStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			count  int
+			day    string
+			status int
+			pathID int64
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			if h.Bot > 0 || h.Status == 0 {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			k := day + strconv.Itoa(h.Status) + strconv.FormatInt(h.PathID, 10)
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.status = h.Status
+				v.pathID = h.PathID
+			}
+			v.count += 1
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := zdb.NewBulkInsert(ctx, "status_stats", []string{"site_id", "day",
+			"path_id", "status", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "status_stats#site_id#path_id#day#status" do update set
+				count = status_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day, status) do update set
+				count = status_stats.count + excluded.count`)
+		}
+
+		for _, v := range grouped {
+			ins.Values(siteID, v.day, v.pathID, v.status, v.count)
+		}
+		return ins.Finish()
+	}), "cron.updateStatusStats")
+}
@@ -0,0 +1,107 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestStatusStats(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	rng := ztime.NewRange(now).To(now)
+
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Path: "/a", Status: 200, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Path: "/a", Status: 304},
+		{Site: site.ID, CreatedAt: now, Path: "/old", Status: 301},
+		{Site: site.ID, CreatedAt: now, Path: "/missing", Status: 404, FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Path: "/missing", Status: 404},
+		{Site: site.ID, CreatedAt: now, Path: "/a", Status: 404},
+		{Site: site.ID, CreatedAt: now, Path: "/secret", Status: 403},
+		{Site: site.ID, CreatedAt: now, Path: "/a", Status: 500},
+	}...)
+
+	// Only pageviews are stored in hits.
+	have := zdb.DumpString(ctx, `select paths.path, hits.status from hits join paths using (path_id) order by hit_id`)
+	want := `
+		path  status
+		/a    0
+		/a    200
+		/a    304`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	t.Run("classes", func(t *testing.T) {
+		var have goatcounter.HitStats
+		err := have.ListStatusClasses(ctx, rng, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := `{
+			"more": false,
+			"stats": [
+				{"count": 1, "id": "2xx", "name": "2xx Success"},
+				{"count": 2, "id": "3xx", "name": "3xx Redirect"},
+				{"count": 4, "id": "4xx", "name": "4xx Client error"},
+				{"count": 1, "id": "5xx", "name": "5xx Server error"}
+			]
+		}`
+		if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+			t.Error(d)
+		}
+	})
+
+	t.Run("class", func(t *testing.T) {
+		var have goatcounter.HitStats
+		err := have.ListStatus(ctx, "4xx", rng, nil, 2, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := `{
+			"more": true,
+			"stats": [
+				{"count": 2, "name": "404 /missing"},
+				{"count": 1, "name": "403 /secret"}
+			]
+		}`
+		if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+			t.Error(d)
+		}
+	})
+
+	t.Run("404", func(t *testing.T) {
+		var have goatcounter.HitStats
+		err := have.ListStatus(ctx, "404", rng, nil, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := `{
+			"more": false,
+			"stats": [
+				{"count": 2, "name": "/missing"},
+				{"count": 1, "name": "/a"}
+			]
+		}`
+		if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+			t.Error(d)
+		}
+	})
+}
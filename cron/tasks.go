@@ -8,12 +8,14 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/acme"
+	"zgo.at/goatcounter/v2/db/migrate/gomig"
 	"zgo.at/zdb"
 	"zgo.at/zlog"
 	"zgo.at/zstd/ztime"
@@ -55,32 +57,31 @@ func oldExports(ctx context.Context) error {
 	return nil
 }
 
-func dataRetention(ctx context.Context) error {
-	var sites goatcounter.Sites
-	err := sites.UnscopedList(ctx)
+func oldBot(ctx context.Context) error {
+	ival := goatcounter.Interval(ctx, 30)
+	err := zdb.Exec(ctx, `delete from hits where bot > 0 and created_at < `+ival)
 	if err != nil {
-		return err
+		zlog.Module("cron").Error(err)
 	}
-
-	for _, s := range sites {
-		if s.Settings.DataRetention <= 0 {
-			continue
-		}
-
-		err = s.DeleteOlderThan(ctx, s.Settings.DataRetention)
-		if err != nil {
-			zlog.Module("cron").Field("site", s.ID).Error(err)
-		}
+	err = zdb.Exec(ctx, `delete from ua_block_stats where day < `+ival)
+	if err != nil {
+		zlog.Module("cron").Error(err)
 	}
 
-	return nil
-}
-
-func oldBot(ctx context.Context) error {
-	ival := goatcounter.Interval(ctx, 30)
-	err := zdb.Exec(ctx, `delete from hits where bot > 0 and created_at < `+ival)
+	var sites goatcounter.Sites
+	err = sites.UnscopedList(ctx)
 	if err != nil {
 		zlog.Module("cron").Error(err)
+		return nil
+	}
+	for _, s := range sites {
+		cutoff := ztime.Now().AddDate(0, 0, -s.Settings.EffectiveBotRetention(ctx)).Format("2006-01-02")
+		for _, t := range []string{"bot_stats", "bot_ua_stats"} {
+			err := zdb.Exec(ctx, `delete from `+t+` where site_id = $1 and day < $2`, s.ID, cutoff)
+			if err != nil {
+				zlog.Module("cron").Field("site", s.ID).Error(err)
+			}
+		}
 	}
 	return nil
 }
@@ -89,6 +90,9 @@ func persistAndStat(ctx context.Context) error {
 	l := zlog.Module("cron")
 	l.Debug("persistAndStat started")
 
+	persistMu.Lock()
+	defer persistMu.Unlock()
+
 	hits, err := goatcounter.Memstore.Persist(ctx)
 	if err != nil {
 		return err
@@ -97,9 +101,13 @@ func persistAndStat(ctx context.Context) error {
 		l = l.Since("memstore")
 	}
 
-	grouped := make(map[int64][]goatcounter.Hit)
+	var (
+		grouped = make(map[int64][]goatcounter.Hit)
+		bots    = make(map[int64][]goatcounter.Hit)
+	)
 	for _, h := range hits {
 		if h.Bot > 0 {
+			bots[h.Site] = append(bots[h.Site], h)
 			continue
 		}
 		grouped[h.Site] = append(grouped[h.Site], h)
@@ -114,12 +122,42 @@ func persistAndStat(ctx context.Context) error {
 		}
 	}
 
+	for siteID, hits := range bots {
+		err := UpdateBotStats(ctx, siteID, hits)
+		if err != nil {
+			l.Field("site", siteID).Error(err)
+		}
+	}
+
 	if len(hits) > 0 {
 		l.Since("stats").FieldsSince().Debugf("persisted %d hits", len(hits))
 	}
 	return err
 }
 
+// UpdateBotStats updates the stats for pageviews flagged as a bot; these are
+// kept separate from all other stats.
+//
+// Exported for tests.
+func UpdateBotStats(ctx context.Context, siteID int64, hits []goatcounter.Hit) error {
+	var site goatcounter.Site
+	err := site.ByID(ctx, siteID)
+	if err != nil {
+		return err
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	err = updateBotStats(ctx, hits)
+	if err != nil {
+		return errors.Wrapf(err, "site %d", siteID)
+	}
+	err = updateUABlockStats(ctx, siteID, hits)
+	if err != nil {
+		return errors.Wrapf(err, "site %d", siteID)
+	}
+	return nil
+}
+
 // UpdateStats updates all the stats tables.
 //
 // Exported for tests.
@@ -133,16 +171,35 @@ func UpdateStats(ctx context.Context, site *goatcounter.Site, siteID int64, hits
 	}
 	ctx = goatcounter.WithSite(ctx, site)
 
+	err := updateStatusStats(ctx, hits)
+	if err != nil {
+		return errors.Wrapf(err, "site %d", siteID)
+	}
+
+	// Everything else only counts pageviews, and not redirects, errors, etc.
+	// from logfiles.
+	hits = slices.DeleteFunc(slices.Clone(hits), func(h goatcounter.Hit) bool {
+		return !goatcounter.StatusIsPageview(h.Status)
+	})
+
 	funs := []func(context.Context, []goatcounter.Hit) error{
 		updateHitCounts,
 		updateRefCounts,
 		updateHitStats,
 		updateBrowserStats,
+		updateUnknownUAStats,
 		updateSystemStats,
 		updateLocationStats,
+		updateLocationRefStats,
+		updateCityStats,
 		updateLanguageStats,
 		updateSizeStats,
+		updateScaleStats,
+		updateDeviceStats,
 		updateCampaignStats,
+		updateSessionStats,
+		updateVisitorSketches,
+		updateLabelStats,
 	}
 
 	for _, f := range funs {
@@ -158,6 +215,77 @@ func UpdateStats(ctx context.Context, site *goatcounter.Site, siteID int64, hits
 			return errors.Wrapf(err, "update received_data: site %d", siteID)
 		}
 	}
+
+	err = site.UpdateQuota(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "site %d", siteID)
+	}
+	return nil
+}
+
+func reloadGeoDB(ctx context.Context) error {
+	reloaded, err := goatcounter.ReloadGeoDB()
+	if err != nil {
+		return err
+	}
+	if reloaded {
+		zlog.Module("cron").Printf("reloaded GeoIP database")
+	}
+	return nil
+}
+
+func reloadRefspam(ctx context.Context) error {
+	reloaded, err := goatcounter.ReloadRefspam()
+	if err != nil {
+		return err
+	}
+	if reloaded {
+		zlog.Module("cron").Printf("reloaded referrer spam list")
+	}
+	return nil
+}
+
+func reloadChannels(ctx context.Context) error {
+	reloaded, err := goatcounter.ReloadChannels()
+	if err != nil {
+		return err
+	}
+	if reloaded {
+		zlog.Module("cron").Printf("reloaded traffic channels")
+	}
+	return nil
+}
+
+func reloadBotData(ctx context.Context) error {
+	reloaded, err := goatcounter.ReloadBotData(ctx)
+	if err != nil {
+		return err
+	}
+	if reloaded {
+		zlog.Module("cron").Printf("reloaded bot data: %s", goatcounter.BotDataInfo().Version)
+	}
+	return nil
+}
+
+// Re-apply the rules to the stats of all sites if the instance rules changed.
+func reloadRefRules(ctx context.Context) error {
+	reloaded, err := goatcounter.ReloadRefRules()
+	if err != nil || !reloaded {
+		return err
+	}
+	zlog.Module("cron").Printf("reloaded referrer rules")
+
+	var sites goatcounter.Sites
+	err = sites.UnscopedList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range sites {
+		err := goatcounter.ApplyRefRules(goatcounter.WithSite(ctx, &s))
+		if err != nil {
+			zlog.Module("cron").Field("site", s.ID).Error(err)
+		}
+	}
 	return nil
 }
 
@@ -176,8 +304,15 @@ func renewACME(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	var domains goatcounter.SiteDomains
+	err = domains.UnscopedList(ctx)
+	if err != nil {
+		return err
+	}
 
+	keep := make([]string, 0, len(sites)+len(domains))
 	for _, s := range sites {
+		keep = append(keep, *s.Cname)
 		err := acme.Make(ctx, *s.Cname)
 		if err != nil {
 			zlog.Module("cron-acme").Field("cname", *s.Cname).Error(err)
@@ -191,24 +326,74 @@ func renewACME(ctx context.Context) error {
 		}
 	}
 
+	for _, d := range domains {
+		keep = append(keep, d.Domain)
+		st, err := acme.MakeStatus(ctx, d.Domain)
+		if err != nil {
+			zlog.Module("cron-acme").Field("domain", d.Domain).Error(err)
+		}
+		err = d.UpdateStatus(ctx, st.DNSOK, st.Expires)
+		if err != nil {
+			zlog.Module("cron-acme").Field("domain", d.Domain).Error(err)
+		}
+	}
+
+	// Remove certificates for domains that were removed.
+	err = acme.Prune(ctx, keep)
+	if err != nil {
+		zlog.Module("cron-acme").Error(err)
+	}
 	return nil
 }
 
-// Permanently delete soft-deleted sites.
+// Permanently delete soft-deleted sites, and email about sites that will be
+// deleted soon.
 func vacuumDeleted(ctx context.Context) error {
+	var warn goatcounter.Sites
+	err := warn.PendingPurge(ctx)
+	if err != nil {
+		return errors.Errorf("vacuumDeleted: %w", err)
+	}
+	for _, s := range warn {
+		err := s.WarnPurge(ctx)
+		if err != nil {
+			zlog.Module("vacuum").Error(err)
+		}
+	}
+
 	var sites goatcounter.Sites
-	err := sites.OldSoftDeleted(ctx)
+	err = sites.OldSoftDeleted(ctx)
 	if err != nil {
 		return errors.Errorf("vacuumDeleted: %w", err)
 	}
 
 	for _, s := range sites {
-		zlog.Module("vacuum").Printf("vacuum site %s/%d", s.Code, s.ID)
+		zlog.Module("vacuum").Printf("vacuum site %s/%d", s.DeletedCode, s.ID)
 		err := zdb.TX(ctx, func(ctx context.Context) error {
+			// Check again that the site is still deleted, as it may have been
+			// restored after loading the list. The update locks the row on
+			// PostgreSQL, so a restore happening now will wait for us.
+			err := zdb.Exec(ctx, `update sites set deleted_warned=1 where site_id=$1 and state=$2`,
+				s.ID, goatcounter.StateDeleted)
+			if err != nil {
+				return err
+			}
+			var n int
+			err = zdb.Get(ctx, &n, `select count(*) from sites where site_id=$1 and state=$2 and deleted_at <= $3`,
+				s.ID, goatcounter.StateDeleted, ztime.Now().Add(-goatcounter.SiteRestoreWindow))
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				zlog.Module("vacuum").Printf("site %d was restored; not vacuuming", s.ID)
+				return nil
+			}
+
 			for _, t := range []string{"hits", "paths",
 				"hit_counts", "ref_counts",
-				"browser_stats", "system_stats", "hit_stats", "location_stats", "language_stats", "size_stats",
-				"campaign_stats", "exports", "api_tokens", "users", "sites"} {
+				"browser_stats", "system_stats", "hit_stats", "location_stats", "city_stats", "language_stats", "size_stats", "device_stats", "status_stats", "visitor_sketches", "unknown_ua_stats", "ua_block_stats", "bot_stats", "bot_ua_stats", "label_stats", "location_ref_stats", "scale_stats",
+				"campaign_stats", "session_stats", "session_durations", "exit_stats",
+				"exports", "api_tokens", "share_links", "invites", "site_transfers", "site_domains", "passkeys", "backup_codes", "email_changes", "webhook_deliveries", "webhooks", "alert_rules", "login_sessions", "audit_entries", "users", "sites"} {
 
 				err := zdb.Exec(ctx, fmt.Sprintf(`delete from %s where site_id=%d`, t, s.ID))
 				if err != nil {
@@ -224,7 +409,96 @@ func vacuumDeleted(ctx context.Context) error {
 	return nil
 }
 
+func oldLoginSessions(ctx context.Context) error {
+	err := (&goatcounter.LoginSessions{}).DeleteExpired(ctx)
+	if err != nil {
+		zlog.Module("cron").Error(err)
+	}
+	return nil
+}
+
+func oldEmailChanges(ctx context.Context) error {
+	err := (&goatcounter.EmailChanges{}).DeleteExpired(ctx)
+	if err != nil {
+		zlog.Module("cron").Error(err)
+	}
+	return nil
+}
+
+func oldAuditEntries(ctx context.Context) error {
+	err := (&goatcounter.AuditEntries{}).DeleteOld(ctx)
+	if err != nil {
+		zlog.Module("cron").Error(err)
+	}
+	return nil
+}
+
 func sessions(ctx context.Context) error {
 	goatcounter.Memstore.EvictSessions()
 	return nil
 }
+
+// retryEmails retries sending emails from the queue.
+func retryEmails(ctx context.Context) error {
+	t := goatcounter.Config(ctx).Mail
+	if t == nil {
+		return nil
+	}
+
+	var emails goatcounter.QueuedEmails
+	err := emails.ListDue(ctx, 50)
+	if err != nil {
+		return err
+	}
+
+	l := zlog.Module("email")
+	for _, e := range emails {
+		sendErr := t.Send(e.From, e.Recipients(), e.Message)
+		err := e.Attempted(ctx, sendErr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sendErr == nil:
+			l.Debugf("sent queued email %d to %s after %d attempts", e.ID, e.To, e.Attempts)
+		case e.FailedAt != nil:
+			l.Fields(zlog.F{"to": e.To, "attempts": e.Attempts}).Errorf("giving up on email %d: %s", e.ID, sendErr)
+		default:
+			l.Fields(zlog.F{"to": e.To, "attempts": e.Attempts}).Printf("email %d: %s", e.ID, sendErr)
+		}
+	}
+	return nil
+}
+
+func oldQueuedEmails(ctx context.Context) error {
+	err := (&goatcounter.QueuedEmails{}).Purge(ctx)
+	if err != nil {
+		zlog.Module("cron").Error(err)
+	}
+	return nil
+}
+
+// migrationBackfills runs the backfills of migrations that were run in batches,
+// for at most 10 seconds per run; "goatcounter db migrate backfill" can be used
+// to run them to completion.
+func migrationBackfills(ctx context.Context) error {
+	done, err := gomig.RunBackfills(ctx, 500, time.Now().Add(10*time.Second))
+	if err != nil {
+		return err
+	}
+	if !done {
+		zlog.Module("cron").Debug("migration backfills: out of time; continuing in the next run")
+	}
+	return nil
+}
+
+// hitPartitions creates the partitions of the hits table for the upcoming
+// months, if it's partitioned; the expired ones are dropped by the data
+// retention.
+func hitPartitions(ctx context.Context) error {
+	names, err := goatcounter.CreateHitPartitions(ctx, goatcounter.HitPartitionsAhead)
+	if len(names) > 0 {
+		zlog.Module("cron").Printf("created hits partitions: %s", strings.Join(names, ", "))
+	}
+	return err
+}
@@ -5,14 +5,18 @@
 package cron_test
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
 	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/ztest"
 	"zgo.at/zstd/ztime"
 )
 
@@ -65,3 +69,406 @@ func TestDataRetention(t *testing.T) {
 		t.Errorf("\ngot:  %s\nwant: %s", out, want)
 	}
 }
+
+func TestDataRetentionOverride(t *testing.T) {
+	ctx := gctest.DB(t)
+	goatcounter.Config(ctx).DataRetention = 35
+	defer func() { goatcounter.Config(ctx).DataRetention = 0 }()
+
+	var (
+		now  = time.Now().UTC()
+		past = now.Add(-40 * 24 * time.Hour)
+		old  = now.Add(-32 * 24 * time.Hour)
+	)
+
+	tests := []struct {
+		retention int
+		want      int // Remaining hit_counts rows.
+	}{
+		{31, 1},  // Override: removes past and old.
+		{-1, 3},  // Keep forever.
+		{0, 2},   // Instance default: removes just past.
+		{365, 3}, // Override longer than default.
+	}
+
+	sites := make([]goatcounter.Site, len(tests))
+	for i, tt := range tests {
+		sites[i] = goatcounter.Site{Code: fmt.Sprintf("site%d", i), Settings: goatcounter.SiteSettings{DataRetention: tt.retention}}
+		err := sites[i].Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gctest.StoreHits(goatcounter.WithSite(ctx, &sites[i]), t, false, []goatcounter.Hit{
+			{Site: sites[i].ID, CreatedAt: now, Path: "/a"},
+			{Site: sites[i].ID, CreatedAt: old, Path: "/a"},
+			{Site: sites[i].ID, CreatedAt: past, Path: "/a"},
+		}...)
+	}
+
+	err := cron.TaskDataRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitDataRetention()
+
+	for i, tt := range tests {
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from hit_counts where site_id=$1`, sites[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.want {
+			t.Errorf("site %d with retention %d: %d rows; want %d", i, tt.retention, n, tt.want)
+		}
+	}
+}
+
+func TestDataRetentionAggregate(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.Site{Code: "bbbb", Settings: goatcounter.SiteSettings{
+		DataRetention: 31,
+		RetentionMode: goatcounter.RetentionAggregate,
+		Collect:       goatcounter.CollectReferrer | goatcounter.CollectSession | goatcounter.CollectHits,
+	}}
+	err := site.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	var (
+		now  = time.Now().UTC()
+		past = now.Add(-40 * 24 * time.Hour)
+	)
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: true},
+		{Site: site.ID, CreatedAt: past, Path: "/a", FirstVisit: true},
+		{Site: site.ID, CreatedAt: past, Path: "/b", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Path: "/c", FirstVisit: true},
+	}...)
+
+	err = cron.TaskDataRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitDataRetention()
+
+	count := func(table string) int {
+		t.Helper()
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from `+table+` where site_id=$1`, site.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	have := fmt.Sprintf("hits=%d hit_counts=%d hit_stats=%d paths=%d",
+		count("hits"), count("hit_counts"), count("hit_stats"), count("paths"))
+	if want := "hits=2 hit_counts=4 hit_stats=4 paths=3"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	pathID := func(p string) int64 {
+		t.Helper()
+		var id int64
+		err := zdb.Get(ctx, &id, `select path_id from paths where site_id=$1 and path=$2`, site.ID, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	var hits goatcounter.Hits
+	err = hits.CheckMerge(ctx, []int64{pathID("/c")})
+	if err != nil {
+		t.Errorf("path without old stats: %v", err)
+	}
+	err = hits.CheckMerge(ctx, []int64{pathID("/b")})
+	if err == nil || !strings.Contains(err.Error(), "were removed or anonymized") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestDataRetentionAnonymize(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.Site{Code: "bbbb", Settings: goatcounter.SiteSettings{
+		DataRetention: 31,
+		RetentionMode: goatcounter.RetentionAnonymize,
+		Collect: goatcounter.CollectReferrer | goatcounter.CollectUserAgent | goatcounter.CollectLocation |
+			goatcounter.CollectLocationRegion | goatcounter.CollectSession | goatcounter.CollectHits,
+	}}
+	err := site.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	var (
+		now  = time.Now().UTC()
+		past = now.Add(-40 * 24 * time.Hour)
+		ua   = "Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0"
+	)
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{CreatedAt: past, Path: "/a", Ref: "https://example.com", UserAgentHeader: ua, Location: "NL-NH", FirstVisit: true},
+		{CreatedAt: past.Add(time.Minute), Path: "/b", UserAgentHeader: ua, Location: "NL-NH"},
+		{CreatedAt: now, Path: "/a", UserAgentHeader: ua, Location: "NL-NH", FirstVisit: true},
+	}...)
+
+	err = cron.TaskDataRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitDataRetention()
+
+	have := zdb.DumpString(ctx, `
+		select
+			paths.path, hits.ref_id > 1 as ref, hits.session is not null as session,
+			hits.browser_id > 0 as browser, hits.system_id > 0 as system, hits.location, hits.first_visit
+		from hits
+		join paths using (path_id)
+		order by hit_id asc`)
+	want := `
+		path  ref  session  browser  system  location  first_visit
+		/a    1    0        0        0       NL        1
+		/b    0    0        0        0       NL        0
+		/a    0    1        1        1       NL-NH     1`
+	if d := ztest.Diff(have, want, ztest.DiffNormalizeWhitespace); d != "" {
+		t.Error(d)
+	}
+
+	var n int
+	err = zdb.Get(ctx, &n, `select count(*) from hit_stats where site_id=$1`, site.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("hit_stats: %d rows; want 3", n)
+	}
+
+	n, err = site.AnonymizeOlderThan(ctx, 31, 100)
+	if err != nil || n != 0 {
+		t.Errorf("anonymized again: %d, %v", n, err)
+	}
+}
+
+func TestDataRetentionDownsample(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.Site{Code: "bbbb", Settings: goatcounter.SiteSettings{
+		DataRetention:  31,
+		DailyRetention: 90,
+		RetentionMode:  goatcounter.RetentionDownsample,
+		Collect:        goatcounter.CollectReferrer | goatcounter.CollectSession | goatcounter.CollectHits,
+	}}
+	err := site.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	var (
+		now   = time.Now().UTC()
+		day   = ztime.StartOf(now.AddDate(0, 0, -40), ztime.Day)
+		month = ztime.StartOf(now.AddDate(0, 0, -200), ztime.Month)
+	)
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{CreatedAt: now, Path: "/a", FirstVisit: true},
+		{CreatedAt: day.Add(10 * time.Hour), Path: "/a", FirstVisit: true},
+		{CreatedAt: day.Add(15 * time.Hour), Path: "/a", FirstVisit: true},
+		{CreatedAt: day.Add(15*time.Hour + time.Minute), Path: "/a"},
+		{CreatedAt: month.AddDate(0, 0, 2).Add(10 * time.Hour), Path: "/a", FirstVisit: true},
+		{CreatedAt: month.AddDate(0, 0, 11).Add(15 * time.Hour), Path: "/a", FirstVisit: true, Ref: "https://example.com"},
+	}...)
+
+	check := func(t *testing.T) {
+		t.Helper()
+		var (
+			have  []string
+			n     int
+			query = func(q string, args ...any) {
+				t.Helper()
+				err := zdb.Get(ctx, &n, q, args...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				have = append(have, fmt.Sprint(n))
+			}
+		)
+		query(`select count(*) from hits`)
+		query(`select count(*) from hit_counts`)
+		query(`select sum(total) from hit_counts`)
+		query(`select sum(views) from hit_counts`)
+		query(`select count(*) from hit_counts where hour = ?`, day.Format(time.DateTime))
+		query(`select count(*) from hit_counts where hour = ?`, month.Format(time.DateTime))
+		query(`select count(*) from ref_counts where hour = ?`, month.Format(time.DateTime))
+		query(`select count(*) from hit_stats`)
+		query(`select count(*) from hit_stats where day = ? and stats like '[2,0,%'`, day.Format(time.DateOnly))
+		query(`select count(*) from hit_stats where day = ? and stats like '[2,0,%'`, month.Format(time.DateOnly))
+		query(`select count(*) from browser_stats where day < ?`, day.Format(time.DateOnly))
+		query(`select sum(count) from browser_stats where day < ?`, day.Format(time.DateOnly))
+
+		want := "1 3 5 6 1 1 2 3 1 1 1 2"
+		if h := strings.Join(have, " "); h != want {
+			t.Errorf("\nhave: %s\nwant: %s", h, want)
+		}
+	}
+
+	err = cron.TaskDataRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitDataRetention()
+	check(t)
+
+	// Running it again shouldn't change anything.
+	res, err := site.Downsample(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (goatcounter.DownsampleResult{}) {
+		t.Errorf("%#v", res)
+	}
+	check(t)
+}
+
+type testTransport struct {
+	err  error
+	sent []string
+}
+
+func (t *testTransport) Name() string { return "test" }
+
+func (t *testTransport) Send(from string, to []string, msg []byte) error {
+	if t.err != nil {
+		return t.err
+	}
+	t.sent = append(t.sent, strings.Join(to, ","))
+	return nil
+}
+
+func TestRetryEmails(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2026-10-16 12:00:00")
+
+	tr := &testTransport{err: errors.New("connection refused")}
+	goatcounter.Config(ctx).Mail = tr
+
+	msg := []byte("From: test@example.com\r\nTo: a@example.com\r\nSubject: Test\r\n\r\nHello\r\n")
+	err := goatcounter.QueueEmail(ctx, "test@example.com", []string{"a@example.com"}, msg, tr.err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := func() goatcounter.QueuedEmails {
+		t.Helper()
+		var e goatcounter.QueuedEmails
+		err := e.ListUnsent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	run := func() {
+		t.Helper()
+		err := cron.TaskRetryEmails()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitRetryEmails()
+	}
+
+	// Not due yet.
+	run()
+	if e := list(); len(e) != 1 || e[0].Attempts != 1 {
+		t.Fatalf("%#v", e)
+	}
+
+	// Fails again; next attempt is 4 minutes later.
+	ztime.SetNow(t, "2026-10-16 12:02:00")
+	run()
+	e := list()
+	if len(e) != 1 || e[0].Attempts != 2 || !e[0].NextAttemptAt.Equal(ztime.Now().Add(4*time.Minute)) {
+		t.Fatalf("%#v", e)
+	}
+
+	// Sent.
+	tr.err = nil
+	ztime.SetNow(t, "2026-10-16 12:06:00")
+	run()
+	if e := list(); len(e) != 0 {
+		t.Errorf("%#v", e)
+	}
+	if strings.Join(tr.sent, " ") != "a@example.com" {
+		t.Errorf("sent: %q", tr.sent)
+	}
+}
+
+func TestUABlockStats(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2026-10-16 12:00:00")
+
+	site := goatcounter.MustGetSite(ctx)
+	hit := func(day int, bot int, rule string) goatcounter.Hit {
+		return goatcounter.Hit{Site: site.ID, Path: "/", Session: goatcounter.TestSession,
+			CreatedAt: ztime.Now().AddDate(0, 0, -day), Bot: bot, UABlockRule: rule}
+	}
+	goatcounter.Memstore.Append(
+		hit(0, goatcounter.BotUABlock, "SyntheticMonitor"),
+		hit(0, goatcounter.BotUABlock, "SyntheticMonitor"),
+		hit(6, goatcounter.BotUABlock, "SyntheticMonitor"),
+		hit(7, goatcounter.BotUABlock, "SyntheticMonitor"), // Too old.
+		hit(1, goatcounter.BotUABlock, "/^acme-probe/"),
+		hit(0, 0, ""),
+		hit(0, 5, ""))
+
+	err := cron.TaskPersistAndStat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitPersistAndStat()
+
+	have, err := goatcounter.UABlockCounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"SyntheticMonitor": 3, "/^acme-probe/": 1}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+}
+
+func TestBotStatsRetention(t *testing.T) {
+	ctx := gctest.DB(t)
+	ztime.SetNow(t, "2026-10-16 12:00:00")
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.BotRetention = 7
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hit := func(day int) goatcounter.Hit {
+		return goatcounter.Hit{Path: "/", CreatedAt: ztime.Now().AddDate(0, 0, -day), Bot: 5}
+	}
+	gctest.StoreHits(ctx, t, false, hit(0), hit(7), hit(8), hit(20))
+
+	err = cron.TaskOldBot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron.WaitOldBot()
+
+	var days []string
+	err = zdb.Select(ctx, &days, `select day from bot_stats order by day`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range days {
+		days[i] = days[i][:10]
+	}
+	if have, want := strings.Join(days, " "), "2026-10-09 2026-10-16"; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
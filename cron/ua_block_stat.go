@@ -0,0 +1,55 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// updateUABlockStats counts how many pageviews every rule in the site's
+// User-Agent blocklist matched, for the settings page.
+func updateUABlockStats(ctx context.Context, siteID int64, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			count int
+			day   string
+			rule  string
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			if h.Bot != goatcounter.BotUABlock || h.UABlockRule == "" {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			k := day + h.UABlockRule
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.rule = h.UABlockRule
+			}
+			v.count += 1
+			grouped[k] = v
+		}
+
+		ins := zdb.NewBulkInsert(ctx, "ua_block_stats", []string{"site_id", "day", "rule", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "ua_block_stats#site_id#day#rule" do update set
+				count = ua_block_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, day, rule) do update set
+				count = ua_block_stats.count + excluded.count`)
+		}
+
+		for _, v := range grouped {
+			ins.Values(siteID, v.day, v.rule, v.count)
+		}
+		return ins.Finish()
+	}), "cron.updateUABlockStats")
+}
@@ -0,0 +1,70 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"strconv"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+// updateUnknownUAStats stores the User-Agent headers for which no browser was
+// detected, so the browser stats can be corrected later with a UAOverride.
+func updateUnknownUAStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		type gt struct {
+			count     int
+			day       string
+			browserID int64
+			pathID    int64
+			ua        string
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			if h.Bot > 0 {
+				continue
+			}
+			if !h.UnknownUA || h.UserAgentHeader == "" {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			k := day + strconv.FormatInt(h.PathID, 10) + h.UserAgentHeader
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.browserID = h.BrowserID
+				v.pathID = h.PathID
+				v.ua = h.UserAgentHeader
+			}
+
+			if h.FirstVisit {
+				v.count += 1
+			}
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := zdb.NewBulkInsert(ctx, "unknown_ua_stats", []string{"site_id", "day",
+			"path_id", "browser_id", "user_agent", "count"})
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			ins.OnConflict(`on conflict on constraint "unknown_ua_stats#site_id#path_id#day#user_agent" do update set
+				count = unknown_ua_stats.count + excluded.count`)
+		} else {
+			ins.OnConflict(`on conflict(site_id, path_id, day, user_agent) do update set
+				count = unknown_ua_stats.count + excluded.count`)
+		}
+
+		for _, v := range grouped {
+			if v.count > 0 {
+				ins.Values(siteID, v.day, v.pathID, v.browserID, v.ua, v.count)
+			}
+		}
+		return ins.Finish()
+	}), "cron.updateUnknownUAStats")
+}
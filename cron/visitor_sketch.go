@@ -0,0 +1,57 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zdb"
+)
+
+func updateVisitorSketches(ctx context.Context, hits []goatcounter.Hit) error {
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		grouped := map[string]goatcounter.HLL{}
+		for _, h := range hits {
+			if h.Bot > 0 || h.VisitorHash == 0 {
+				continue
+			}
+
+			day := h.CreatedAt.Format("2006-01-02")
+			s := grouped[day]
+			s.Add(h.VisitorHash)
+			grouped[day] = s
+		}
+		if len(grouped) == 0 {
+			return nil
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		conflict := `on conflict(site_id, day)`
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			conflict = `on conflict on constraint "visitor_sketches#site_id#day"`
+		}
+
+		// Can't merge the registers in SQL, so load the existing sketch.
+		for day, s := range grouped {
+			var cur goatcounter.HLL
+			err := zdb.Get(ctx, &cur, `select sketch from visitor_sketches where site_id = :site and day = :day`,
+				map[string]any{"site": siteID, "day": day})
+			if err != nil && !zdb.ErrNoRows(err) {
+				return err
+			}
+			s.Merge(cur)
+
+			err = zdb.Exec(ctx, `insert into visitor_sketches (site_id, day, sketch) values (:site, :day, :sketch) `+
+				conflict+` do update set sketch = excluded.sketch`,
+				map[string]any{"site": siteID, "day": day, "sketch": s})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}), "cron.updateVisitorSketches")
+}
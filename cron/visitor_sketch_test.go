@@ -0,0 +1,56 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestVisitorSketches(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := goatcounter.MustGetSite(ctx)
+	site.FirstHitAt = time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)
+	day1 := time.Date(2019, 8, 30, 14, 42, 0, 0, time.UTC)
+	day2 := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+
+	// Three visitors on the first day, two of which return on the second day.
+	gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: day1, RemoteAddr: "1.1.1.1", FirstVisit: true},
+		{Site: site.ID, CreatedAt: day1, RemoteAddr: "1.1.1.1", Path: "/x", FirstVisit: true},
+		{Site: site.ID, CreatedAt: day1, RemoteAddr: "2.2.2.2", FirstVisit: true},
+		{Site: site.ID, CreatedAt: day1, RemoteAddr: "3.3.3.3", FirstVisit: true},
+		{Site: site.ID, CreatedAt: day2, RemoteAddr: "1.1.1.1", FirstVisit: true},
+		{Site: site.ID, CreatedAt: day2, RemoteAddr: "2.2.2.2", FirstVisit: true},
+		{Site: site.ID, CreatedAt: day2, RemoteAddr: "4.4.4.4", Event: true, Path: "e"},
+	}...)
+
+	tests := []struct {
+		rng  ztime.Range
+		want int
+	}{
+		{ztime.NewRange(day1).To(day2), 3},
+		{ztime.NewRange(day2).To(day2.Add(24 * time.Hour)), 2},
+		// Starts before the first sketch.
+		{ztime.NewRange(day1.Add(-24 * time.Hour)).To(day2), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rng.String(), func(t *testing.T) {
+			have, err := goatcounter.GetVisitorEstimate(ctx, tt.rng)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tt.want {
+				t.Errorf("have %d; want %d", have, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"zgo.at/bgrun"
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/zlog"
+)
+
+var (
+	// Redirects aren't followed, and the address is checked on every connection
+	// so a DNS record can't be changed to point to a local address after the
+	// webhook was added.
+	webhookClient = &http.Client{
+		Timeout: 15 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: func(network, address string, _ syscall.RawConn) error {
+					addr, err := netip.ParseAddrPort(address)
+					if err != nil {
+						return err
+					}
+					if !goatcounter.WebhookAddrAllowed(addr.Addr()) {
+						return fmt.Errorf("not allowed to connect to local or private network address %s", addr.Addr())
+					}
+					return nil
+				},
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+
+	// Time to wait before retrying after a network error or 5xx response; the
+	// number of entries is the number of retries.
+	webhookRetry = []time.Duration{10 * time.Second, 1 * time.Minute}
+
+	// Maximum number of webhooks that are sent at the same time.
+	webhookPool = make(chan struct{}, 8)
+)
+
+// reportPayload is the JSON that's sent to webhooks.
+type reportPayload struct {
+	Event     string    `json:"event"`     // Always "report".
+	Site      string    `json:"site"`      // Site code.
+	SiteURL   string    `json:"site_url"`  // URL to the dashboard.
+	Frequency string    `json:"frequency"` // daily, weekly, biweekly, monthly
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+
+	Totals struct {
+		Visitors     int `json:"visitors"`
+		Sessions     int `json:"sessions"`
+		PrevVisitors int `json:"prev_visitors"` // For the previous period of the same length.
+		PrevSessions int `json:"prev_sessions"`
+	} `json:"totals"`
+
+	Pages     []reportPage `json:"pages"`
+	NewPages  []reportPage `json:"new_pages"`
+	Refs      []reportStat `json:"refs"`      // Empty if the site doesn't collect referrers.
+	Countries []reportStat `json:"countries"` // Empty if the site doesn't collect locations.
+}
+
+type reportPage struct {
+	Path   string `json:"path"`
+	Title  string `json:"title"`
+	Event  bool   `json:"event"`
+	Count  int    `json:"count"`
+	Growth string `json:"growth,omitempty"`
+}
+
+type reportStat struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+var reportFrequency = map[int]string{
+	goatcounter.EmailReportNever:    "once",
+	goatcounter.EmailReportDaily:    "daily",
+	goatcounter.EmailReportWeekly:   "weekly",
+	goatcounter.EmailReportBiWeekly: "biweekly",
+	goatcounter.EmailReportMonthly:  "monthly",
+}
+
+// payload gets the report for webhooks.
+func (args templateArgs) payload() reportPayload {
+	p := reportPayload{
+		Event:     "report",
+		Site:      args.Site.Code,
+		SiteURL:   args.Site.URL(args.Context),
+		Frequency: reportFrequency[args.User.Settings.EmailReports.Int()],
+		Start:     args.Range.Start,
+		End:       args.Range.End,
+		Pages:     make([]reportPage, 0, len(args.Pages)),
+		NewPages:  make([]reportPage, 0, len(args.NewPages)),
+		Refs:      make([]reportStat, 0, len(args.Refs.Stats)),
+		Countries: make([]reportStat, 0, len(args.Locations.Stats)),
+	}
+	p.Totals.Visitors, p.Totals.Sessions = args.Counts.Total, args.Counts.Sessions
+	p.Totals.PrevVisitors, p.Totals.PrevSessions = args.PrevCounts.Total, args.PrevCounts.Sessions
+
+	for i, pp := range args.Pages {
+		rp := reportPage{Path: pp.Path, Title: pp.Title, Event: bool(pp.Event), Count: pp.Count}
+		if i < len(args.Diffs) {
+			rp.Growth = args.Diffs[i]
+		}
+		p.Pages = append(p.Pages, rp)
+	}
+	for _, pp := range args.NewPages {
+		p.NewPages = append(p.NewPages, reportPage{Path: pp.Path, Title: pp.Title, Event: bool(pp.Event), Count: pp.Count})
+	}
+	if args.ShowRefs {
+		for _, s := range args.Refs.Stats {
+			p.Refs = append(p.Refs, reportStat{Name: s.Name, Count: s.Count})
+		}
+	}
+	if args.ShowLocations {
+		for _, s := range args.Locations.Stats {
+			p.Countries = append(p.Countries, reportStat{Name: s.Name, Count: s.Count})
+		}
+	}
+	return p
+}
+
+// sendWebhooks delivers the payload to all webhooks in the background,
+// recording the result in the delivery log. Retries can take a while, so this
+// doesn't wait for the delivery to finish; use WaitWebhooks() for that.
+//
+// Webhooks are disabled after goatcounter.WebhookMaxFailures failures in a row,
+// and the user is notified by email.
+func sendWebhooks(ctx context.Context, site goatcounter.Site, user goatcounter.User, hooks goatcounter.Webhooks, payload any) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		zlog.Module("webhook").Error(err)
+		return
+	}
+
+	for _, h := range hooks {
+		webhookPool <- struct{}{}
+		bgrun.RunFunction("webhook", func() {
+			defer func() { <-webhookPool }()
+			sendWebhook(ctx, site, user, h, body)
+		})
+	}
+}
+
+func sendWebhook(ctx context.Context, site goatcounter.Site, user goatcounter.User, h goatcounter.Webhook, body []byte) {
+	l := zlog.Module("webhook")
+
+	status, attempts, deliveryErr := postWebhook(ctx, h, body)
+	if deliveryErr != nil {
+		l.Fields(zlog.F{"user": user.ID, "webhook": h.ID, "attempts": attempts}).Print(deliveryErr)
+	}
+
+	disabled, err := h.Delivered(ctx, status, attempts, deliveryErr)
+	if err != nil {
+		l.Error(err)
+		return
+	}
+	if !disabled || !user.Settings.Notify(goatcounter.NotifyAlerts) {
+		return
+	}
+
+	err = blackmail.Send("Your GoatCounter webhook was disabled",
+		blackmail.From("GoatCounter", goatcounter.Config(ctx).EmailFrom),
+		blackmail.To(user.Email),
+		blackmail.HeadersAutoreply(),
+		blackmail.BodyMustText(goatcounter.TplEmailWebhookDisabled{
+			Context: goatcounter.WithSite(ctx, &site),
+			Site:    site,
+			User:    user,
+			Webhook: h,
+			Error:   deliveryErr.Error(),
+		}.Render))
+	if err != nil {
+		l.Error(err)
+	}
+}
+
+// postWebhook sends the body to the webhook, retrying on network errors and 5xx
+// responses.
+func postWebhook(ctx context.Context, h goatcounter.Webhook, body []byte) (status, attempts int, err error) {
+	for attempts = 1; ; attempts++ {
+		status, err = postWebhookOnce(ctx, h, body)
+		if err == nil || (status > 0 && status < 500) || attempts > len(webhookRetry) {
+			return status, attempts, err
+		}
+		select {
+		case <-ctx.Done():
+			return status, attempts, err
+		case <-time.After(webhookRetry[attempts-1]):
+		}
+	}
+}
+
+func postWebhookOnce(ctx context.Context, h goatcounter.Webhook, body []byte) (int, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "postWebhook")
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("User-Agent", "GoatCounter")
+	r.Header.Set(goatcounter.WebhookSignatureHeader, h.Sign(body))
+
+	resp, err := webhookClient.Do(r)
+	if err != nil {
+		return 0, errors.Wrap(err, "postWebhook")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("postWebhook: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
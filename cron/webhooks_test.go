@@ -0,0 +1,225 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/tz"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zgo"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/ztime"
+	"zgo.at/ztpl"
+)
+
+func TestWebhooks(t *testing.T) {
+	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
+	err := ztpl.Init(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 6, 17, 0, 1, 0, 0, time.UTC)
+	ztime.Now = func() time.Time { return now }
+	t.Cleanup(func() { ztime.Now = func() time.Time { return time.Now().UTC() } })
+	cron.SetWebhookRetry(t, 0, 0)
+	goatcounter.SetWebhookAllowPrivate(true) // httptest listens on 127.0.0.1
+	t.Cleanup(func() { goatcounter.SetWebhookAllowPrivate(false) })
+
+	type req struct {
+		sig  string
+		body []byte
+	}
+	var (
+		mu     sync.Mutex
+		reqs   []req
+		status int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		reqs = append(reqs, req{r.Header.Get(goatcounter.WebhookSignatureHeader), b})
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	setup := func(t *testing.T, st, failures int, blockPrivate bool) (context.Context, goatcounter.Webhook, *bytes.Buffer) {
+		mu.Lock()
+		reqs, status = nil, st
+		mu.Unlock()
+
+		ctx := gctest.Site(gctest.DB(t), t, nil, &goatcounter.User{
+			LastReportAt: now.Add(-24 * time.Hour),
+			Settings: goatcounter.UserSettings{
+				EmailReports:            zint.Int(goatcounter.EmailReportDaily),
+				EmailReportsWebhookOnly: true,
+				Timezone:                tz.UTC,
+			},
+		})
+		goatcounter.Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+		gctest.StoreHits(ctx, t, false,
+			goatcounter.Hit{FirstVisit: true, Path: "/a", CreatedAt: now.Add(-1 * time.Hour)},
+			goatcounter.Hit{FirstVisit: true, Path: "/a", CreatedAt: now.Add(-2 * time.Hour)},
+			goatcounter.Hit{FirstVisit: true, Path: "/b", CreatedAt: now.Add(-1 * time.Hour)})
+
+		hook := goatcounter.Webhook{URL: srv.URL + "/hook"}
+		err := hook.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures > 0 {
+			err := zdb.Exec(ctx, `update webhooks set failures=$1`, failures)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if blockPrivate {
+			goatcounter.SetWebhookAllowPrivate(false)
+			defer goatcounter.SetWebhookAllowPrivate(true)
+		}
+
+		buf := new(bytes.Buffer)
+		blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+
+		err = cron.TaskEmailReports()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cron.WaitEmailReports()
+		cron.WaitWebhooks()
+
+		err = hook.ByID(ctx, hook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx, hook, buf
+	}
+
+	deliveries := func(t *testing.T, ctx context.Context, hook goatcounter.Webhook) goatcounter.WebhookDeliveries {
+		var d goatcounter.WebhookDeliveries
+		err := d.List(ctx, goatcounter.Webhooks{hook})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	t.Run("deliver", func(t *testing.T) {
+		ctx, hook, buf := setup(t, 200, 0, false)
+
+		if buf.String() != "" {
+			t.Errorf("sent email:\n%s", buf.String())
+		}
+		if len(reqs) != 1 {
+			t.Fatalf("len(reqs) = %d", len(reqs))
+		}
+		if have, want := reqs[0].sig, hook.Sign(reqs[0].body); have != want || !strings.HasPrefix(have, "sha256=") {
+			t.Errorf("signature\nhave: %s\nwant: %s", have, want)
+		}
+
+		var p struct {
+			Event     string    `json:"event"`
+			Site      string    `json:"site"`
+			Frequency string    `json:"frequency"`
+			Start     time.Time `json:"start"`
+			Totals    struct {
+				Visitors int `json:"visitors"`
+			} `json:"totals"`
+			Pages []struct {
+				Path  string `json:"path"`
+				Count int    `json:"count"`
+			} `json:"pages"`
+		}
+		err := json.Unmarshal(reqs[0].body, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Event != "report" || p.Site != goatcounter.MustGetSite(ctx).Code || p.Frequency != "daily" ||
+			!p.Start.Equal(time.Date(2019, 6, 16, 0, 0, 0, 0, time.UTC)) || p.Totals.Visitors != 3 {
+			t.Errorf("wrong payload:\n%s", reqs[0].body)
+		}
+		if len(p.Pages) != 2 || p.Pages[0].Path != "/a" || p.Pages[0].Count != 2 {
+			t.Errorf("wrong pages:\n%s", reqs[0].body)
+		}
+
+		d := deliveries(t, ctx, hook)
+		if len(d) != 1 || d[0].Status != 200 || d[0].Attempts != 1 || d[0].Error != "" {
+			t.Errorf("wrong deliveries: %#v", d)
+		}
+		if hook.Failures != 0 || hook.Disabled() {
+			t.Errorf("failures=%d; disabled=%t", hook.Failures, hook.Disabled())
+		}
+	})
+
+	t.Run("client error", func(t *testing.T) {
+		ctx, hook, _ := setup(t, 404, 0, false)
+
+		if len(reqs) != 1 {
+			t.Errorf("len(reqs) = %d", len(reqs))
+		}
+		d := deliveries(t, ctx, hook)
+		if len(d) != 1 || d[0].Status != 404 || d[0].Attempts != 1 || !strings.Contains(d[0].Error, "404") {
+			t.Errorf("wrong deliveries: %#v", d)
+		}
+		if hook.Failures != 1 || hook.Disabled() {
+			t.Errorf("failures=%d; disabled=%t", hook.Failures, hook.Disabled())
+		}
+	})
+
+	t.Run("retry and disable", func(t *testing.T) {
+		ctx, hook, buf := setup(t, 503, goatcounter.WebhookMaxFailures-1, false)
+
+		if len(reqs) != 3 {
+			t.Errorf("len(reqs) = %d", len(reqs))
+		}
+		d := deliveries(t, ctx, hook)
+		if len(d) != 1 || d[0].Status != 503 || d[0].Attempts != 3 {
+			t.Errorf("wrong deliveries: %#v", d)
+		}
+		if hook.Failures != goatcounter.WebhookMaxFailures || !hook.Disabled() {
+			t.Errorf("failures=%d; disabled=%t", hook.Failures, hook.Disabled())
+		}
+
+		if !strings.Contains(buf.String(), "Subject: Your GoatCounter webhook was disabled") {
+			t.Errorf("no email:\n%s", buf.String())
+		}
+		if strings.Contains(buf.String(), "Your GoatCounter report") {
+			t.Errorf("sent report email:\n%s", buf.String())
+		}
+	})
+
+	t.Run("private address", func(t *testing.T) {
+		ctx, hook, _ := setup(t, 200, 0, true)
+
+		if len(reqs) != 0 {
+			t.Errorf("len(reqs) = %d", len(reqs))
+		}
+		d := deliveries(t, ctx, hook)
+		if len(d) != 1 || d[0].Status != 0 || !strings.Contains(d[0].Error, "local or private network address") {
+			t.Errorf("wrong deliveries: %#v", d)
+		}
+		if hook.Failures != 1 {
+			t.Errorf("failures=%d", hook.Failures)
+		}
+	})
+}
@@ -1,3 +1,4 @@
+-- destructive: removes the billing columns from sites
 alter table sites drop column plan;
 alter table sites drop column plan_pending;
 alter table sites drop column plan_cancel_at;
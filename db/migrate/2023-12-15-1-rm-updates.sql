@@ -1 +1,2 @@
+-- destructive: removes users.seen_updates_at
 alter table users drop column seen_updates_at;
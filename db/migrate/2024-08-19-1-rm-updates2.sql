@@ -1 +1,2 @@
+-- destructive: removes the updates table
 drop table updates;
@@ -0,0 +1 @@
+alter table session_stats add column pageviews integer not null default 0;
@@ -0,0 +1,85 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package gomig
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/zdb"
+)
+
+// DeviceStats backfills device_stats from the screen widths in size_stats, one
+// site and day at a time; the cursor is the last "site_id/day" that was done.
+//
+// The User-Agent isn't stored, so a width of 0 is always unknown. Keep in sync
+// with goatcounter.DeviceClass().
+func DeviceStats(ctx context.Context, p *BackfillProgress, limit int) (int, bool, error) {
+	args := map[string]any{
+		"site":  int64(0),
+		"day":   "1970-01-01",
+		"until": p.Started.UTC().Format(time.DateOnly),
+		"limit": limit,
+	}
+	if p.Cursor != "" {
+		site, day, ok := strings.Cut(p.Cursor, "/")
+		id, err := strconv.ParseInt(site, 10, 64)
+		if !ok || err != nil {
+			return 0, false, fmt.Errorf("gomig.DeviceStats: invalid cursor %q", p.Cursor)
+		}
+		args["site"], args["day"] = id, day
+	}
+
+	var days []struct {
+		SiteID int64  `db:"site_id"`
+		Day    string `db:"day"`
+	}
+	err := zdb.Select(ctx, &days, `/* gomig.DeviceStats */
+		select distinct site_id, substr(cast(day as varchar), 1, 10) as day from size_stats
+		where (site_id > :site or (site_id = :site and day > :day)) and day <= :until
+		order by site_id, day
+		limit :limit`, args)
+	if err != nil || len(days) == 0 {
+		return 0, err == nil, err
+	}
+
+	last := days[len(days)-1]
+	args["last_site"], args["last_day"] = last.SiteID, last.Day
+	const where = `
+		(site_id > :site      or (site_id = :site      and day >  :day)) and
+		(site_id < :last_site or (site_id = :last_site and day <= :last_day)) and
+		day <= :until`
+
+	// Replace rather than add, as the pageviews since the migration may already
+	// be in device_stats; they're also in size_stats.
+	err = zdb.Exec(ctx, `/* gomig.DeviceStats */ delete from device_stats where `+where, args)
+	if err != nil {
+		return 0, false, err
+	}
+	err = zdb.Exec(ctx, `/* gomig.DeviceStats */
+		insert into device_stats (site_id, path_id, day, device, count)
+		select site_id, path_id, day, device, sum(count) from (
+			select
+				site_id, path_id, day, count,
+				case
+					when width > 1279 then 'desktop'
+					when width > 599  then 'tablet'
+					when width > 0    then 'mobile'
+					else                   'unknown'
+				end as device
+			from size_stats
+			where `+where+`
+		) x
+		group by site_id, path_id, day, device`, args)
+	if err != nil {
+		return 0, false, err
+	}
+
+	p.Cursor = fmt.Sprintf("%d/%s", last.SiteID, last.Day)
+	return len(days), len(days) < limit, nil
+}
@@ -0,0 +1,124 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package gomig
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Backfill fills data for a migration in batches, after the schema change
+// itself has been applied. This way a migration that needs to fill a large
+// table doesn't lock the database for hours; everything needs to work with
+// the backfill still in progress.
+//
+// It should process at most limit items starting at p.Cursor, update p.Cursor,
+// and return the number of items processed and if it's done; what an "item" is
+// depends on the backfill. Every batch is run in a transaction with storing the
+// progress, so it's safe to resume after a crash.
+//
+// A migration registers its backfill by inserting a "backfill:<name>" row in
+// the store table with "{}" or a BackfillProgress as JSON, so that
+// installations created from the schema don't run it.
+type Backfill func(ctx context.Context, p *BackfillProgress, limit int) (n int, done bool, err error)
+
+// Backfills are all the backfills, by the name of the migration.
+var Backfills = map[string]Backfill{
+	"2026-10-16-07-device-stats": DeviceStats,
+}
+
+// BackfillProgress is the progress of a backfill.
+type BackfillProgress struct {
+	Name      string    `json:"-"`
+	Cursor    string    `json:"cursor"`    // Where to continue; the meaning depends on the backfill.
+	Processed int       `json:"processed"` // Number of items processed so far.
+	Done      bool      `json:"done"`      // Finished?
+	Started   time.Time `json:"started"`   // Migration or first batch.
+	Updated   time.Time `json:"updated"`   // Last batch; zero if it didn't run yet.
+}
+
+// ListBackfills lists the progress of all backfills registered by the
+// migrations that were run.
+func ListBackfills(ctx context.Context) ([]BackfillProgress, error) {
+	var rows []struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	err := zdb.Select(ctx, &rows, `select key, value from store where key like 'backfill:%' order by key`)
+	if err != nil {
+		return nil, errors.Wrap(err, "gomig.ListBackfills")
+	}
+
+	list := make([]BackfillProgress, 0, len(rows))
+	for _, r := range rows {
+		var p BackfillProgress
+		err := json.Unmarshal([]byte(r.Value), &p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "gomig.ListBackfills: %s", r.Key)
+		}
+		p.Name = strings.TrimPrefix(r.Key, "backfill:")
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// RunBackfills runs batches of limit rows for all unfinished backfills until
+// they're done or the deadline has passed, and reports if they're all done.
+func RunBackfills(ctx context.Context, limit int, deadline time.Time) (bool, error) {
+	list, err := ListBackfills(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range list {
+		if p.Done {
+			continue
+		}
+		fun, ok := Backfills[p.Name]
+		if !ok { // Registered by a newer version.
+			continue
+		}
+		if p.Started.IsZero() {
+			p.Started = ztime.Now().UTC()
+		}
+
+		for !p.Done {
+			if time.Now().After(deadline) {
+				return false, nil
+			}
+			err := zdb.TX(ctx, func(ctx context.Context) error {
+				n, done, err := fun(ctx, &p, limit)
+				if err != nil {
+					return err
+				}
+				p.Processed, p.Done, p.Updated = p.Processed+n, done, ztime.Now().UTC()
+				return p.store(ctx)
+			})
+			if err != nil {
+				return false, errors.Wrapf(err, "gomig.RunBackfills: %s", p.Name)
+			}
+		}
+	}
+	return !slices.ContainsFunc(list, func(p BackfillProgress) bool {
+		_, ok := Backfills[p.Name]
+		return ok && !p.Done
+	}), nil
+}
+
+func (p BackfillProgress) store(ctx context.Context) error {
+	j, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return zdb.Exec(ctx, `update store set value = :v where key = :k`,
+		map[string]any{"k": "backfill:" + p.Name, "v": string(j)})
+}
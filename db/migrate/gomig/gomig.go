@@ -10,3 +10,9 @@ var Migrations = map[string]func(context.Context) error{
 	"2021-12-08-1-set-chart-text":    KeepAsText,
 	"2022-11-15-1-correct-hit-stats": CorrectHitStats,
 }
+
+// Destructive lists the Go migrations that rewrite or remove data, with the
+// reason; SQL migrations use a "-- destructive: reason" comment instead.
+var Destructive = map[string]string{
+	"2022-11-15-1-correct-hit-stats": "rewrites the hit_stats table",
+}
@@ -0,0 +1,8 @@
+select * from audit_entries
+where
+	site_id = :site
+	{{:actor and user_id = :actor}}
+	{{:action and action = :action}}
+	{{:before and audit_entry_id < :before}}
+order by audit_entry_id desc
+limit :limit
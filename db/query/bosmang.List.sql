@@ -3,7 +3,10 @@ with
 		select
 			site_id as site_id,
 			(select a.site_id || array_agg(site_id)      from sites c where c.parent = a.site_id) as allsites,
-			(select string_agg(code, ' | ') from sites d where d.site_id = a.site_id or d.parent = a.site_id) as codes
+			(select string_agg(code, ' | ') from sites d where d.site_id = a.site_id or d.parent = a.site_id) as codes,
+			(select string_agg(nullif(tags, ''), ',') from sites t where t.site_id = a.site_id or t.parent = a.site_id) as tags,
+			(select coalesce(sum(quota), 0)      from sites e where (e.site_id = a.site_id or e.parent = a.site_id)) as quota,
+			(select coalesce(sum(quota_used), 0) from sites e where (e.site_id = a.site_id or e.parent = a.site_id) and e.quota > 0) as quota_used
 		from sites a
 		where parent is null
 		group by site_id
@@ -20,9 +23,9 @@ with
 			accounts.site_id,
 			(select coalesce(sum(t), 0) from total      where total.site_id      = any(accounts.allsites)) as total,
 			(select coalesce(sum(t), 0) from last_month where last_month.site_id = any(accounts.allsites)) as last_month,
-			codes
+			codes, tags, quota, quota_used
 		from accounts
-		group by accounts.site_id, codes, allsites
+		group by accounts.site_id, codes, tags, allsites, quota, quota_used
 		order by last_month desc
 	)
 select
@@ -31,7 +34,10 @@ select
 	created_at,
 	grouped.last_month,
 	(coalesce(total, 0) / greatest(extract('days' from now() - created_at), 1) * 30.5)::int as avg,
-	grouped.codes
+	grouped.codes,
+	grouped.tags,
+	grouped.quota,
+	grouped.quota_used
 from grouped
 join sites using (site_id)
-where last_month > 10000 or total > 500000
+where last_month > 10000 or total > 500000 or grouped.quota > 0
@@ -0,0 +1,25 @@
+with
+	this_month as (
+		select site_id, sum(views) as views from hit_counts where hour >= :month group by site_id
+	),
+	total as (
+		select site_id, sum(total) as total from hit_counts group by site_id
+	)
+select
+	sites.site_id,
+	sites.parent,
+	sites.code,
+	sites.cname,
+	sites.cname_setup_at,
+	sites.settings,
+	sites.created_at,
+	sites.disabled_at,
+	(select email from users where users.site_id = coalesce(sites.parent, sites.site_id) order by user_id limit 1) as owner,
+	coalesce(this_month.views, 0) as this_month,
+	coalesce(total.total, 0)      as total,
+	(select max(hour) from hit_counts where hit_counts.site_id = sites.site_id) as last_hit
+from sites
+left join this_month using (site_id)
+left join total      using (site_id)
+where sites.state = :state
+order by sites.site_id
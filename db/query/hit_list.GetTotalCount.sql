@@ -20,6 +20,15 @@ with x as (
 	where
 		site_id = :site and hour >= :start_utc and hour <= :end_utc
 		{{:filter and path_id in (:filter)}}
+), s as (
+	select
+		coalesce(sum(sessions), 0)  as sessions,
+		coalesce(sum(bounces), 0)   as bounces,
+		coalesce(sum(pageviews), 0) as pageviews
+	from session_stats
+	where
+		site_id = :site and day >= :start_day and day <= :end_day
+		{{:filter and path_id in (:filter)}}
 )
 select
 	*
@@ -36,4 +45,4 @@ select
 	-- 		(hour >= :start and hour <= cast(:start as timestamp) + :tz * interval '1 minute') or
 	-- 		(hour >= :end   and hour <= cast(:end   as timestamp) + :tz * interval '1 minute')
 	-- ) as total_utc
-from x, y, z;
+from x, y, z, s;
@@ -0,0 +1,8 @@
+select
+	path_id,
+	sum(sessions) as sessions,
+	sum(bounces)  as bounces
+from session_stats
+where
+	site_id = :site and day >= :start and day <= :end and path_id in (:paths)
+group by path_id
@@ -0,0 +1,17 @@
+select
+	paths.path_id,
+	paths.path,
+	paths.title,
+	paths.event,
+	sum(c.total) as count
+from hit_counts c
+join paths using (path_id)
+where
+	c.site_id = :site and c.hour >= :start and c.hour <= :end and
+	not exists (
+		select 1 from hit_counts prev
+		where prev.site_id = :site and prev.path_id = c.path_id and prev.hour < :start
+	)
+group by paths.path_id, paths.path, paths.title, paths.event
+order by count desc, paths.path_id desc
+limit :limit
@@ -0,0 +1,11 @@
+select
+	name,
+	version,
+	sum(count) as count
+from browser_stats
+join browsers using (browser_id)
+where
+	site_id = :site and day >= :start and day <= :end
+	{{:filter and path_id in (:filter)}}
+	{{:browser and lower(name) = lower(:browser)}}
+group by name, version
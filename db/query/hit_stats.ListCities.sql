@@ -0,0 +1,11 @@
+select
+	city       as name,
+	sum(count) as count
+from city_stats
+where
+	site_id = :site and day >= :start and day <= :end and
+	{{:filter path_id in (:filter) and}}
+	location = :location
+group by city
+order by count desc, name asc
+limit :limit offset :offset
@@ -0,0 +1,20 @@
+with x as (
+	select
+		path_id,
+		sum(sessions) as count
+	from session_stats
+	where
+		site_id = :site and day >= :start and day <= :end
+		{{:filter and path_id in (:filter)}}
+	group by path_id
+	having sum(sessions) > 0
+	order by count desc, path_id
+	limit :limit offset :offset
+)
+select
+	x.path_id   as id,
+	paths.path  as name,
+	x.count     as count
+from x
+join paths using (path_id)
+order by count desc, name asc
@@ -0,0 +1,20 @@
+with s as (
+	select distinct session
+	from hits
+	where
+		site_id = :site and path_id = :path and bot = 0 and session is not null and
+		created_at >= :start and created_at <= :end
+)
+select
+	paths.path_id  as id,
+	paths.path     as name,
+	count(*)       as count
+from hits
+join paths using (site_id, path_id)
+where
+	hits.site_id = :site and paths.event = 1 and hits.bot = 0 and
+	hits.created_at >= :start and hits.created_at <= :end and
+	hits.session in (select session from s)
+group by paths.path_id, paths.path
+order by count desc, name asc
+limit :limit offset :offset
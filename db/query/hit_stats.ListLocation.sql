@@ -1,6 +1,7 @@
 select
+	iso_3166_2                         as id,
 	coalesce(region_name, '(unknown)') as name,
-	sum(count)                  as count
+	sum(count)                         as count
 from location_stats
 join locations on location = iso_3166_2
 where
@@ -0,0 +1,12 @@
+select
+	paths.path                  as name,
+	sum(location_stats.count)   as count
+from location_stats
+join paths using (path_id)
+where
+	location_stats.site_id = :site and day >= :start and day <= :end and
+	{{:filter path_id in (:filter) and}}
+	substr(location, 0, 3) = :country
+group by paths.path
+order by count desc, name asc
+limit :limit offset :offset
@@ -0,0 +1,13 @@
+select
+	status_stats.status     as status,
+	paths.path              as path,
+	sum(status_stats.count) as count
+from status_stats
+join paths using (site_id, path_id)
+where
+	site_id = :site and day >= :start and day <= :end and
+	status_stats.status >= :min and status_stats.status <= :max
+	{{:filter and path_id in (:filter)}}
+group by status_stats.status, paths.path
+order by count desc, status asc, path asc
+limit :limit offset :offset
@@ -0,0 +1,9 @@
+select
+	status     as status,
+	sum(count) as count
+from status_stats
+where
+	site_id = :site and day >= :start and day <= :end
+	{{:filter and path_id in (:filter)}}
+group by status
+order by status asc
@@ -1,6 +1,7 @@
 select
-	trim(name || ' ' || version) as name,
-	sum(count)            as count
+	name,
+	version,
+	sum(count) as count
 from system_stats
 join systems using (system_id)
 where
@@ -8,5 +9,3 @@ where
 	{{:filter path_id in (:filter) and}}
 	lower(name) = lower(:system)
 group by name, version
-order by count desc, name asc
-limit :limit offset :offset
@@ -0,0 +1,9 @@
+select
+	site_id,
+	hour,
+	sum(total) as total,
+	sum(views) as views
+from hit_counts
+where
+	site_id in (:sites) and hour >= :start
+group by site_id, hour
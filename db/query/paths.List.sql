@@ -2,5 +2,6 @@ select * from paths
 where
 	site_id = :site
 	{{:after and path_id > :after}}
+	{{:filter and path_id in (:filter)}}
 order by path_id asc
 {{:limit limit :limit}}
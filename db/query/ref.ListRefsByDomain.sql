@@ -0,0 +1,21 @@
+-- This selects more than needed as "like" will also match other domains; the
+-- refs are filtered on the registrable domain afterwards.
+with x as (
+	select
+		ref_id,
+		coalesce(sum(total), 0) as count
+	from ref_counts
+	where
+		site_id = :site and hour >= :start and hour <= :end
+		{{:filter and path_id in (:filter)}}
+	group by ref_id
+)
+select
+	x.count,
+	refs.ref_scheme as ref_scheme,
+	refs.ref        as name
+from x
+join refs using (ref_id)
+where
+	lower(refs.ref) like :like
+	{{:hide_spam and coalesce(refs.ref_scheme, '') != 's'}}
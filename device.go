@@ -0,0 +1,99 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/z18n"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Device classes, as stored in device_stats.
+const (
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+	DeviceUnknown = "unknown"
+)
+
+// Screen width thresholds for device classes, in CSS pixels.
+//
+// These are stored in device_stats and used to backfill from size_stats, so
+// changing them will make old and new data inconsistent. Don't.
+const (
+	deviceMaxMobile = 599  // 1-599:     mobile
+	deviceMaxTablet = 1279 // 600-1279:  tablet; 1280 and wider is desktop.
+)
+
+// DeviceClass gets the device class from the screen width and User-Agent
+// header.
+//
+// The screen width is used if it's known; the User-Agent is only used as a
+// fallback if it's not (e.g. when not collecting the screen size, or if the
+// script failed to send it):
+//
+//   - "iPad", "Tablet", or "Android" without "Mobile" is a tablet;
+//   - "Mobi", "iPhone", or "iPod" is a mobile;
+//   - any other non-empty User-Agent is a desktop.
+//
+// It's DeviceUnknown if neither is known.
+func DeviceClass(width int, ua string) string {
+	switch {
+	case width > deviceMaxTablet:
+		return DeviceDesktop
+	case width > deviceMaxMobile:
+		return DeviceTablet
+	case width > 0:
+		return DeviceMobile
+	}
+
+	switch {
+	case ua == "":
+		return DeviceUnknown
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"),
+		strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "Mobi"), strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPod"):
+		return DeviceMobile
+	default:
+		return DeviceDesktop
+	}
+}
+
+// ListDevices lists the visitor count for every device class.
+//
+// This always returns all device classes, in a fixed order.
+func (h *HitStats) ListDevices(ctx context.Context, rng ztime.Range, pathFilter []int64) error {
+	user := MustGetUser(ctx)
+	var rows []HitStat
+	err := zdb.Select(ctx, &rows, "load:hit_stats.ListDevices", map[string]any{
+		"site":   MustGetSite(ctx).ID,
+		"start":  asUTCDate(user, rng.Start),
+		"end":    asUTCDate(user, rng.End),
+		"filter": pathFilter,
+	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListDevices")
+	}
+
+	h.Stats = []HitStat{
+		{ID: DeviceMobile, Name: z18n.T(ctx, "label/device-mobile|Mobile")},
+		{ID: DeviceTablet, Name: z18n.T(ctx, "label/device-tablet|Tablet")},
+		{ID: DeviceDesktop, Name: z18n.T(ctx, "label/device-desktop|Desktop")},
+		{ID: DeviceUnknown},
+	}
+	for _, r := range rows {
+		for i := range h.Stats {
+			if h.Stats[i].ID == r.ID {
+				h.Stats[i].Count += r.Count
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDeviceClass(t *testing.T) {
+	tests := []struct {
+		width int
+		ua    string
+		want  string
+	}{
+		{0, "", DeviceUnknown},
+		{1, "", DeviceMobile},
+		{599, "", DeviceMobile},
+		{600, "", DeviceTablet},
+		{1279, "", DeviceTablet},
+		{1280, "", DeviceDesktop},
+		{3840, "", DeviceDesktop},
+
+		// Width takes precedence.
+		{1920, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148", DeviceDesktop},
+
+		{0, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148", DeviceMobile},
+		{0, "Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) Mobile/15E148", DeviceTablet},
+		{0, "Mozilla/5.0 (Linux; Android 13; Pixel 7) Chrome/118.0.0.0 Mobile Safari/537.36", DeviceMobile},
+		{0, "Mozilla/5.0 (Linux; Android 13; SM-X700) Chrome/118.0.0.0 Safari/537.36", DeviceTablet},
+		{0, "Mozilla/5.0 (Android 13; Mobile; rv:109.0) Gecko/118.0 Firefox/118.0", DeviceMobile},
+		{0, "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/118.0", DeviceDesktop},
+		{0, "curl/8.0", DeviceDesktop},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.width, tt.ua), func(t *testing.T) {
+			have := DeviceClass(tt.width, tt.ua)
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package dkim signs email messages with DKIM.
+//
+// Messages are signed with the "relaxed/relaxed" canonicalization, using
+// rsa-sha256 or ed25519-sha256 depending on the key.
+//
+// https://www.rfc-editor.org/rfc/rfc6376
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SignHeaders are the headers that are signed, if they're present in the
+// message.
+var SignHeaders = []string{"From", "To", "Cc", "Reply-To", "Subject", "Date",
+	"Message-Id", "In-Reply-To", "References", "Mime-Version", "Content-Type",
+	"Content-Transfer-Encoding"}
+
+// Signer signs messages.
+type Signer struct {
+	Domain   string
+	Selector string
+	key      crypto.Signer
+	now      func() time.Time
+}
+
+// New creates a new signer for the domain and selector with the given key,
+// which must be a *rsa.PrivateKey or ed25519.PrivateKey.
+func New(domain, selector string, key crypto.Signer) (*Signer, error) {
+	if domain == "" {
+		return nil, errors.New("dkim.New: domain is empty")
+	}
+	if selector == "" {
+		return nil, errors.New("dkim.New: selector is empty")
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("dkim.New: RSA key is %d bits; need at least 1024", k.N.BitLen())
+		}
+	case ed25519.PrivateKey:
+	default:
+		return nil, fmt.Errorf("dkim.New: unsupported key type %T", key)
+	}
+	return &Signer{Domain: domain, Selector: selector, key: key, now: time.Now}, nil
+}
+
+// Load creates a new signer with the PEM-encoded private key from keyFile, in
+// PKCS #1 or PKCS #8 format.
+func Load(domain, selector, keyFile string) (*Signer, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("dkim.Load: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("dkim.Load: no PEM data in %q", keyFile)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("dkim.Load: unsupported PEM block %q in %q", block.Type, keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim.Load: %q: %w", keyFile, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("dkim.Load: unsupported key type %T", key)
+	}
+	return New(domain, selector, signer)
+}
+
+// Sign the message, returning it with the DKIM-Signature header prepended.
+func (s *Signer) Sign(msg []byte) ([]byte, error) {
+	if !bytes.Contains(msg, []byte("\r\n")) {
+		msg = bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+	}
+	head, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("dkim.Sign: no end of headers")
+	}
+
+	var (
+		fields = splitHeader(string(head) + "\r\n")
+		signed []string
+		canon  strings.Builder
+	)
+	for _, h := range SignHeaders {
+		if f, ok := lastField(fields, h); ok {
+			signed = append(signed, strings.ToLower(h))
+			canon.WriteString(relaxedHeader(f))
+		}
+	}
+	if !slices.Contains(signed, "from") {
+		return nil, errors.New("dkim.Sign: no From header")
+	}
+
+	bh := sha256.Sum256(relaxedBody(body))
+	alg := "rsa-sha256"
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		alg = "ed25519-sha256"
+	}
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n"+
+		"\tt=%d; h=%s;\r\n"+
+		"\tbh=%s;\r\n"+
+		"\tb=",
+		alg, s.Domain, s.Selector, s.now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]))
+	canon.WriteString(strings.TrimSuffix(relaxedHeader(sig+"\r\n"), "\r\n"))
+
+	hash := sha256.Sum256([]byte(canon.String()))
+	var (
+		b   []byte
+		err error
+	)
+	switch k := s.key.(type) {
+	case ed25519.PrivateKey:
+		b = ed25519.Sign(k, hash[:])
+	default:
+		b, err = s.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim.Sign: %w", err)
+	}
+
+	out := make([]byte, 0, len(sig)+400+len(msg))
+	out = append(out, sig...)
+	out = append(out, base64.StdEncoding.EncodeToString(b)...)
+	out = append(out, "\r\n"...)
+	return append(out, msg...), nil
+}
+
+// DNS gets the TXT record to publish at <selector>._domainkey.<domain>.
+func (s *Signer) DNS() (string, error) {
+	if k, ok := s.key.Public().(ed25519.PublicKey); ok {
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return "", fmt.Errorf("dkim.DNS: %w", err)
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+}
+
+// splitHeader splits the header in fields, including continuation lines and
+// the trailing CRLF.
+func splitHeader(head string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(head, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// lastField gets the last field with this name; if a header is present more
+// than once the bottom-most one is signed.
+func lastField(fields []string, name string) (string, bool) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		n, _, ok := strings.Cut(fields[i], ":")
+		if ok && strings.EqualFold(strings.TrimSpace(n), name) {
+			return fields[i], true
+		}
+	}
+	return "", false
+}
+
+var reWSP = regexp.MustCompile(`[ \t]+`)
+
+// relaxedHeader canonicalizes a header field with the "relaxed" algorithm.
+func relaxedHeader(f string) string {
+	name, value, _ := strings.Cut(f, ":")
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	value = strings.Trim(reWSP.ReplaceAllString(value, " "), " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value + "\r\n"
+}
+
+// relaxedBody canonicalizes the body with the "relaxed" algorithm.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(reWSP.ReplaceAllString(lines[i], " "), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,218 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMsg = "From: GoatCounter <test@example.com>\r\n" +
+	"To: someone@example.net\r\n" +
+	"Message-Id: <blackmail-1@example.com>\r\n" +
+	"Date: Fri, 16 Oct 2026 14:00:00 +0000\r\n" +
+	"Subject: A very long subject line that is\r\n" +
+	"\tfolded\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello,  \r\n" +
+	"\r\n" +
+	"This is  the body.\r\n" +
+	"\r\n" +
+	"\r\n"
+
+// verify a signed message with the public key, independent of the code used
+// for signing.
+func verify(t *testing.T, msg string, pub crypto.PublicKey) error {
+	t.Helper()
+
+	head, body, _ := strings.Cut(msg, "\r\n\r\n")
+	head = regexp.MustCompile(`\r\n[ \t]`).ReplaceAllString(head, " ")
+	lines := strings.Split(head, "\r\n")
+
+	canonH := func(l string) string {
+		k, v, _ := strings.Cut(l, ":")
+		v = strings.TrimSpace(regexp.MustCompile(`[ \t]+`).ReplaceAllString(v, " "))
+		return strings.ToLower(strings.TrimSpace(k)) + ":" + v
+	}
+
+	if !strings.HasPrefix(lines[0], "DKIM-Signature:") {
+		t.Fatalf("first header is not DKIM-Signature: %q", lines[0])
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(strings.TrimPrefix(lines[0], "DKIM-Signature:"), ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(tag), "=")
+		tags[k] = v
+	}
+
+	var b strings.Builder
+	for _, l := range strings.Split(strings.TrimRight(body, "\r\n"), "\r\n") {
+		b.WriteString(strings.TrimRight(regexp.MustCompile(`[ \t]+`).ReplaceAllString(l, " "), " ") + "\r\n")
+	}
+	bh := sha256.Sum256([]byte(b.String()))
+	if have := base64.StdEncoding.EncodeToString(bh[:]); have != tags["bh"] {
+		return errBodyHash
+	}
+
+	var h strings.Builder
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(lines) - 1; i > 0; i-- {
+			if k, _, _ := strings.Cut(lines[i], ":"); strings.EqualFold(strings.TrimSpace(k), name) {
+				h.WriteString(canonH(lines[i]) + "\r\n")
+				break
+			}
+		}
+	}
+	h.WriteString(canonH(regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(lines[0], "b=")))
+	hash := sha256.Sum256([]byte(h.String()))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hash[:], sig) {
+			return errSig
+		}
+		return nil
+	}
+	t.Fatalf("unknown key %T", pub)
+	return nil
+}
+
+type testErr string
+
+func (e testErr) Error() string { return string(e) }
+
+const (
+	errBodyHash = testErr("body hash mismatch")
+	errSig      = testErr("invalid signature")
+)
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		t.Run("", func(t *testing.T) {
+			s, err := New("example.com", "gc", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.now = func() time.Time { return time.Unix(1791900000, 0) }
+
+			signed, err := s.Sign([]byte(testMsg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := string(signed)
+
+			if !strings.HasSuffix(msg, testMsg) {
+				t.Errorf("message was modified:\n%s", msg)
+			}
+			for _, want := range []string{"d=example.com;", "s=gc;", "t=1791900000;",
+				"h=from:to:subject:date:message-id:content-type;"} {
+				if !strings.Contains(msg, want) {
+					t.Errorf("signature doesn't contain %q:\n%s", want, msg)
+				}
+			}
+
+			if err := verify(t, msg, key.Public()); err != nil {
+				t.Fatalf("verify: %s\n%s", err, msg)
+			}
+
+			// Changing whitespace is fine with relaxed canonicalization.
+			relaxed := strings.Replace(msg, "This is  the body.", "This is the body.   ", 1)
+			relaxed = strings.Replace(relaxed, "To: someone", "To:   someone", 1)
+			if err := verify(t, relaxed, key.Public()); err != nil {
+				t.Errorf("verify relaxed: %s\n%s", err, relaxed)
+			}
+
+			if err := verify(t, strings.Replace(msg, "the body", "the b0dy", 1), key.Public()); err != errBodyHash {
+				t.Errorf("modified body: %v", err)
+			}
+			if err := verify(t, strings.Replace(msg, "Subject: A very", "Subject: A vary", 1), key.Public()); err == nil {
+				t.Error("modified subject: no error")
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	write := func(name, typ string, data []byte) string {
+		p := filepath.Join(dir, name)
+		err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: data}), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		file, wantErr string
+	}{
+		{write("pkcs1.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), ""},
+		{write("pkcs8.pem", "PRIVATE KEY", pkcs8), ""},
+		{write("cert.pem", "CERTIFICATE", []byte("x")), "unsupported PEM block"},
+		{write("broken.pem", "PRIVATE KEY", []byte("x")), "dkim.Load"},
+		{filepath.Join(dir, "nonexistent"), "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.file), func(t *testing.T) {
+			s, err := Load("example.com", "gc", tt.file)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			dns, err := s.DNS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(dns, "v=DKIM1; k=rsa; p=") {
+				t.Errorf("DNS: %q", dns)
+			}
+		})
+	}
+
+	if _, err := Load("", "gc", tests[0].file); err == nil {
+		t.Error("no error for empty domain")
+	}
+}
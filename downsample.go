@@ -0,0 +1,289 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zjson"
+)
+
+// DownsampleResult is what Site.Downsample changed.
+type DownsampleResult struct {
+	Days   int // Number of days rolled up.
+	Months int // Number of months rolled up.
+	Rows   int // Number of rows removed.
+}
+
+type downsampleTable struct {
+	table  string
+	unique []string // Columns in the unique constraint, in order.
+	sum    []string // Columns to add up.
+	max    []string // Columns to take the maximum of.
+}
+
+var (
+	// Only the hit_counts and ref_counts are stored per hour; hit_stats is
+	// stored per day but has the visitors per hour, and is done separately.
+	downsampleDaily = []downsampleTable{
+		{"hit_counts", []string{"site_id", "path_id", "hour"}, []string{"total", "views"}, nil},
+		{"ref_counts", []string{"site_id", "path_id", "ref_id", "hour"}, []string{"total"}, nil},
+	}
+	// The bot stats are never kept for longer than the data retention, so
+	// there's no need to roll them up.
+	downsampleMonthly = append(slices.Clone(downsampleDaily), []downsampleTable{
+		{"browser_stats", []string{"site_id", "path_id", "day", "browser_id"}, []string{"count"}, nil},
+		{"system_stats", []string{"site_id", "path_id", "day", "system_id"}, []string{"count"}, nil},
+		{"location_stats", []string{"site_id", "path_id", "day", "location"}, []string{"count"}, nil},
+		{"location_ref_stats", []string{"site_id", "path_id", "day", "country", "ref_id"}, []string{"count"}, nil},
+		{"city_stats", []string{"site_id", "path_id", "day", "location", "city"}, []string{"count"}, nil},
+		{"status_stats", []string{"site_id", "path_id", "day", "status"}, []string{"count"}, nil},
+		{"unknown_ua_stats", []string{"site_id", "path_id", "day", "user_agent"}, []string{"count"}, []string{"browser_id"}},
+		{"label_stats", []string{"site_id", "path_id", "day", "label"}, []string{"count"}, nil},
+		{"size_stats", []string{"site_id", "path_id", "day", "width"}, []string{"count"}, nil},
+		{"scale_stats", []string{"site_id", "path_id", "day", "scale"}, []string{"count"}, nil},
+		{"device_stats", []string{"site_id", "path_id", "day", "device"}, []string{"count"}, nil},
+		{"language_stats", []string{"site_id", "path_id", "day", "language"}, []string{"count"}, nil},
+		{"session_stats", []string{"site_id", "path_id", "day"}, []string{"sessions", "bounces", "duration", "pageviews"}, nil},
+		{"session_durations", []string{"site_id", "path_id", "day", "bucket"}, []string{"count"}, nil},
+		{"exit_stats", []string{"site_id", "path_id", "day"}, []string{"exits"}, nil},
+		{"campaign_stats", []string{"site_id", "path_id", "campaign_id", "ref", "day"}, []string{"count"}, nil},
+	}...)
+)
+
+// Downsample rolls up the stats for sites with RetentionDownsample: the stats
+// older than the data retention are stored per day rather than per hour, and
+// the stats older than the daily retention are stored per month.
+//
+// Every day or month is rolled up in a single transaction by replacing all
+// rows with the total, so it's safe to run this again after a crash: a day or
+// month that's already rolled up is left as-is.
+func (s Site) Downsample(ctx context.Context) (DownsampleResult, error) {
+	var res DownsampleResult
+	daily, monthly := s.Settings.DownsampleCutoffs(ctx)
+	if daily == nil {
+		return res, nil
+	}
+
+	var months []string
+	err := zdb.Select(ctx, &months, `/* Site.Downsample */
+		select distinct substr(cast(hour as varchar), 1, 7) as month from hit_counts
+		where
+			site_id = ? and hour < ? and
+			substr(cast(hour as varchar), 9, 5) != '01 00'
+		order by month`,
+		s.ID, monthly.Format(time.DateTime))
+	if err != nil {
+		return res, errors.Wrap(err, "Site.Downsample")
+	}
+	for _, m := range months {
+		start, err := time.Parse("2006-01", m)
+		if err != nil {
+			return res, errors.Wrap(err, "Site.Downsample")
+		}
+		n, err := s.downsample(ctx, downsampleMonthly, true, start, start.AddDate(0, 1, 0))
+		if err != nil {
+			return res, errors.Wrapf(err, "Site.Downsample %s", m)
+		}
+		res.Months++
+		res.Rows += n
+	}
+
+	var days []string
+	err = zdb.Select(ctx, &days, `/* Site.Downsample */
+		select distinct substr(cast(hour as varchar), 1, 10) as day from hit_counts
+		where
+			site_id = ? and hour >= ? and hour < ? and
+			substr(cast(hour as varchar), 12, 2) != '00'
+		order by day`,
+		s.ID, monthly.Format(time.DateTime), daily.Format(time.DateTime))
+	if err != nil {
+		return res, errors.Wrap(err, "Site.Downsample")
+	}
+	for _, d := range days {
+		start, err := time.Parse(time.DateOnly, d)
+		if err != nil {
+			return res, errors.Wrap(err, "Site.Downsample")
+		}
+		n, err := s.downsample(ctx, downsampleDaily, false, start, start.AddDate(0, 0, 1))
+		if err != nil {
+			return res, errors.Wrapf(err, "Site.Downsample %s", d)
+		}
+		res.Days++
+		res.Rows += n
+	}
+
+	if res.Rows > 0 {
+		s.ClearCache(ctx, true)
+	}
+	return res, nil
+}
+
+// downsample rolls up all rows in the period to a single row at the start of
+// the period, returning the number of rows removed.
+func (s Site) downsample(ctx context.Context, tables []downsampleTable, sketches bool, start, end time.Time) (int, error) {
+	var removed int
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		for _, t := range tables {
+			n, err := s.downsampleTable(ctx, t, start, end)
+			if err != nil {
+				return errors.Wrap(err, t.table)
+			}
+			removed += n
+		}
+
+		n, err := s.downsampleHitStats(ctx, start, end)
+		if err != nil {
+			return errors.Wrap(err, "hit_stats")
+		}
+		removed += n
+
+		if sketches {
+			n, err := s.downsampleSketches(ctx, start, end)
+			if err != nil {
+				return errors.Wrap(err, "visitor_sketches")
+			}
+			removed += n
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (s Site) downsampleTable(ctx context.Context, t downsampleTable, start, end time.Time) (int, error) {
+	var (
+		col, typ, layout = "day", "date", time.DateOnly
+		pg               = zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL
+		keys             []string
+	)
+	if slices.Contains(t.unique, "hour") {
+		col, typ, layout = "hour", "timestamp", time.DateTime
+	}
+	for _, c := range t.unique {
+		if c != "site_id" && c != col {
+			keys = append(keys, c)
+		}
+	}
+	args := map[string]any{
+		"site":  s.ID,
+		"start": start.Format(layout),
+		"end":   end.Format(layout),
+	}
+
+	var before int
+	err := zdb.Get(ctx, &before, `select count(*) from `+t.table+`
+		where site_id = :site and `+col+` >= :start and `+col+` < :end`, args)
+	if err != nil || before == 0 {
+		return 0, err
+	}
+
+	var (
+		target = ":start"
+		cols   = append([]string{"site_id", col}, keys...)
+		sel    = append([]string{"site_id", target}, keys...)
+		set    []string
+	)
+	if pg {
+		sel[1] = "cast(:start as " + typ + ")"
+	}
+	for _, c := range t.sum {
+		cols, sel, set = append(cols, c), append(sel, "sum("+c+")"), append(set, c+" = excluded."+c)
+	}
+	for _, c := range t.max {
+		cols, sel, set = append(cols, c), append(sel, "max("+c+")"), append(set, c+" = excluded."+c)
+	}
+	conflict := `on conflict(` + strings.Join(t.unique, ", ") + `)`
+	if pg {
+		conflict = `on conflict on constraint "` + t.table + "#" + strings.Join(t.unique, "#") + `"`
+	}
+
+	// Replace rather than add to the existing row at the start of the period,
+	// as that's already included in the total.
+	err = zdb.Exec(ctx, `/* Site.downsample */
+		insert into `+t.table+` (`+strings.Join(cols, ", ")+`)
+		select `+strings.Join(sel, ", ")+` from `+t.table+`
+		where site_id = :site and `+col+` >= :start and `+col+` < :end
+		group by site_id, `+strings.Join(keys, ", ")+`
+		`+conflict+` do update set `+strings.Join(set, ", "), args)
+	if err != nil {
+		return 0, err
+	}
+	err = zdb.Exec(ctx, `/* Site.downsample */
+		delete from `+t.table+`
+		where site_id = :site and `+col+` > :start and `+col+` < :end`, args)
+	if err != nil {
+		return 0, err
+	}
+
+	var after int
+	err = zdb.Get(ctx, &after, `select count(*) from `+t.table+`
+		where site_id = :site and `+col+` >= :start and `+col+` < :end`, args)
+	return before - after, err
+}
+
+// All visitors are stored in the first hour, as the visitors per hour are no
+// longer known for the other stats.
+func (s Site) downsampleHitStats(ctx context.Context, start, end time.Time) (int, error) {
+	var rows []struct {
+		PathID int64  `db:"path_id"`
+		Stats  string `db:"stats"`
+	}
+	err := zdb.Select(ctx, &rows, `/* Site.downsampleHitStats */
+		select path_id, stats from hit_stats where site_id = ? and day >= ? and day < ?`,
+		s.ID, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+
+	totals := make(map[int64]int)
+	for _, r := range rows {
+		var st []int
+		zjson.MustUnmarshal([]byte(r.Stats), &st)
+		for _, n := range st {
+			totals[r.PathID] += n
+		}
+	}
+
+	err = zdb.Exec(ctx, `delete from hit_stats where site_id = ? and day >= ? and day < ?`,
+		s.ID, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	if err != nil {
+		return 0, err
+	}
+	ins := zdb.NewBulkInsert(ctx, "hit_stats", []string{"site_id", "day", "path_id", "stats"})
+	for pathID, total := range totals {
+		st := make([]int, 24)
+		st[0] = total
+		ins.Values(s.ID, start.Format(time.DateOnly), pathID, zjson.MustMarshal(st))
+	}
+	return len(rows) - len(totals), ins.Finish()
+}
+
+func (s Site) downsampleSketches(ctx context.Context, start, end time.Time) (int, error) {
+	var sketches []HLL
+	err := zdb.Select(ctx, &sketches, `/* Site.downsampleSketches */
+		select sketch from visitor_sketches where site_id = ? and day >= ? and day < ?`,
+		s.ID, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	if err != nil || len(sketches) == 0 {
+		return 0, err
+	}
+
+	var merged HLL
+	for _, sk := range sketches {
+		merged.Merge(sk)
+	}
+	err = zdb.Exec(ctx, `delete from visitor_sketches where site_id = ? and day >= ? and day < ?`,
+		s.ID, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	if err != nil {
+		return 0, err
+	}
+	err = zdb.Exec(ctx, `insert into visitor_sketches (site_id, day, sketch) values (?, ?, ?)`,
+		s.ID, start.Format(time.DateOnly), merged)
+	return len(sketches) - 1, err
+}
@@ -0,0 +1,219 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// EmailChangeExpire is how long an email change can be confirmed.
+const EmailChangeExpire = 48 * time.Hour
+
+// EmailChange is a pending change of a user's email address.
+//
+// The new address gets a link to confirm the change, and the old address gets
+// a link to cancel it. The user's email isn't changed until it's confirmed, so
+// logins, password resets, and email reports keep using the old address.
+//
+// A user can have only one pending change; starting a new one replaces it.
+type EmailChange struct {
+	ID     int64 `db:"email_change_id" json:"-"`
+	SiteID int64 `db:"site_id" json:"-"` // Account ID.
+	UserID int64 `db:"user_id" json:"-"`
+
+	Email       string    `db:"email" json:"email"`         // New address.
+	OldEmail    string    `db:"old_email" json:"old_email"` // Address at the time the change was started.
+	Token       string    `db:"token" json:"-"`             // Sent to the new address.
+	CancelToken string    `db:"cancel_token" json:"-"`      // Sent to the old address.
+	ExpiresAt   time.Time `db:"expires_at" json:"expires_at"`
+	CreatedAt   time.Time `db:"created_at" json:"-"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (c *EmailChange) Defaults(ctx context.Context) {
+	c.SiteID = MustGetSite(ctx).IDOrParent()
+	c.Email = strings.TrimSpace(c.Email)
+	if c.Token == "" {
+		c.Token = zcrypto.Secret192()
+	}
+	if c.CancelToken == "" {
+		c.CancelToken = zcrypto.Secret192()
+	}
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = ztime.Now()
+	}
+	if c.ExpiresAt.IsZero() {
+		c.ExpiresAt = c.CreatedAt.Add(EmailChangeExpire)
+	}
+}
+
+func (c *EmailChange) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", c.SiteID)
+	v.Required("user_id", c.UserID)
+	v.Required("token", c.Token)
+	v.Required("cancel_token", c.CancelToken)
+	v.Required("email", c.Email)
+	v.Len("email", c.Email, 5, 255)
+	v.Email("email", c.Email)
+
+	if strings.EqualFold(c.Email, c.OldEmail) {
+		v.Append("email", "is the same as the current address")
+	}
+	if !v.HasErrors() {
+		inUse, err := c.inUse(ctx)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			v.Append("email", "already in use by another user")
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// inUse reports if the new address is used by another user in the account.
+func (c EmailChange) inUse(ctx context.Context) (bool, error) {
+	var n int
+	err := zdb.Get(ctx, &n, `select count(*) from users where site_id=$1 and lower(email)=lower($2) and user_id != $3`,
+		c.SiteID, c.Email, c.UserID)
+	return n > 0, errors.Wrap(err, "EmailChange.inUse")
+}
+
+// Expired reports if this change has expired.
+func (c EmailChange) Expired() bool {
+	return !c.ExpiresAt.After(ztime.Now())
+}
+
+// Insert a new row, replacing any pending change for this user.
+func (c *EmailChange) Insert(ctx context.Context) error {
+	if c.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	c.Defaults(ctx)
+	err := c.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from email_changes where user_id=$1 and site_id=$2`, c.UserID, c.SiteID)
+		if err != nil {
+			return err
+		}
+		c.ID, err = zdb.InsertID(ctx, "email_change_id",
+			`insert into email_changes (site_id, user_id, email, old_email, token, cancel_token, expires_at, created_at) values (?)`,
+			[]any{c.SiteID, c.UserID, c.Email, c.OldEmail, c.Token, c.CancelToken, c.ExpiresAt, c.CreatedAt})
+		return err
+	})
+	return errors.Wrap(err, "EmailChange.Insert")
+}
+
+// ByUser gets the pending change for a user. This will also return an expired
+// change.
+func (c *EmailChange) ByUser(ctx context.Context, userID int64) error {
+	return errors.Wrapf(zdb.Get(ctx, c, `/* EmailChange.ByUser */
+		select * from email_changes where user_id=$1 and site_id=$2`,
+		userID, MustGetSite(ctx).IDOrParent()), "EmailChange.ByUser %d", userID)
+}
+
+// ByToken gets a change by the confirmation token.
+func (c *EmailChange) ByToken(ctx context.Context, token string) error {
+	return errors.Wrap(zdb.Get(ctx, c, `/* EmailChange.ByToken */
+		select * from email_changes where token=$1 and site_id=$2`,
+		token, MustGetSite(ctx).IDOrParent()), "EmailChange.ByToken")
+}
+
+// ByCancelToken gets a change by the cancel token.
+func (c *EmailChange) ByCancelToken(ctx context.Context, token string) error {
+	return errors.Wrap(zdb.Get(ctx, c, `/* EmailChange.ByCancelToken */
+		select * from email_changes where cancel_token=$1 and site_id=$2`,
+		token, MustGetSite(ctx).IDOrParent()), "EmailChange.ByCancelToken")
+}
+
+// Confirm this change, updating the user's email address.
+//
+// The address is marked as verified, as the token was sent to it.
+func (c *EmailChange) Confirm(ctx context.Context) (*User, error) {
+	if c.Expired() {
+		return nil, guru.New(403, "this link has expired; change your email address again to get a new one")
+	}
+
+	var user User
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		// Remove first, so the change can't be used twice if two requests come
+		// in at the same time.
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from email_changes where email_change_id=$1`, c.ID)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return guru.New(403, "this change was already confirmed or cancelled")
+		}
+		err = zdb.Exec(ctx, `delete from email_changes where email_change_id=$1`, c.ID)
+		if err != nil {
+			return err
+		}
+
+		err = user.ByID(ctx, c.UserID)
+		if err != nil {
+			if zdb.ErrNoRows(err) {
+				return guru.New(404, "this user no longer exists")
+			}
+			return err
+		}
+		if !strings.EqualFold(user.Email, c.OldEmail) {
+			return guru.New(403, "the email address was changed after this link was sent")
+		}
+
+		// Someone else may have started using the address since the change
+		// was started.
+		inUse, err := c.inUse(ctx)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return guru.Errorf(400, "%s is already in use by another user", c.Email)
+		}
+
+		user.Email, user.EmailVerified, user.EmailToken = c.Email, true, nil
+		err = zdb.Exec(ctx, `update users set email=$1, email_verified=1, email_token=null, updated_at=$2 where user_id=$3`,
+			user.Email, ztime.Now(), user.ID)
+		if zdb.ErrUnique(err) {
+			return guru.Errorf(400, "%s is already in use by another user", c.Email)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "EmailChange.Confirm")
+	}
+	return &user, nil
+}
+
+// Delete (cancel) this change.
+func (c *EmailChange) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* EmailChange.Delete */ delete from email_changes where email_change_id=$1 and site_id=$2`,
+		c.ID, MustGetSite(ctx).IDOrParent())
+	return errors.Wrapf(err, "EmailChange.Delete %d", c.ID)
+}
+
+type EmailChanges []EmailChange
+
+// DeleteExpired deletes all expired changes.
+func (c *EmailChanges) DeleteExpired(ctx context.Context) error {
+	err := zdb.Exec(ctx, `delete from email_changes where expires_at < $1`, ztime.Now())
+	return errors.Wrap(err, "EmailChanges.DeleteExpired")
+}
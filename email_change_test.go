@@ -0,0 +1,151 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+func TestEmailChange(t *testing.T) {
+	setup := func(t *testing.T) (context.Context, EmailChange) {
+		t.Helper()
+		ctx := gctest.DB(t)
+
+		u := MustGetUser(ctx)
+		c := EmailChange{UserID: u.ID, Email: "new@example.com", OldEmail: u.Email}
+		err := c.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx, c
+	}
+	email := func(t *testing.T, ctx context.Context) string {
+		t.Helper()
+		var u User
+		err := u.ByID(ctx, MustGetUser(ctx).ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Email
+	}
+
+	t.Run("confirm", func(t *testing.T) {
+		ctx, c := setup(t)
+
+		if e := email(t, ctx); e != c.OldEmail {
+			t.Fatalf("changed before confirming: %q", e)
+		}
+
+		var byToken EmailChange
+		err := byToken.ByToken(ctx, c.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := byToken.Confirm(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Email != "new@example.com" || !u.EmailVerified {
+			t.Errorf("wrong user: %q %v", u.Email, u.EmailVerified)
+		}
+		if e := email(t, ctx); e != "new@example.com" {
+			t.Errorf("not changed in DB: %q", e)
+		}
+
+		_, err = c.Confirm(ctx)
+		if err == nil {
+			t.Fatal("confirmed twice")
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, c := setup(t)
+
+		var byToken EmailChange
+		err := byToken.ByCancelToken(ctx, c.CancelToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = byToken.Delete(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = byToken.ByToken(ctx, c.Token)
+		if !zdb.ErrNoRows(err) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		_, err = c.Confirm(ctx)
+		if err == nil {
+			t.Fatal("confirmed cancelled change")
+		}
+		if e := email(t, ctx); e != c.OldEmail {
+			t.Errorf("changed after cancel: %q", e)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ctx, c := setup(t)
+
+		ztime.SetNow(t, ztime.Now().Add(EmailChangeExpire+time.Minute).Format("2006-01-02 15:04:05"))
+		if !c.Expired() {
+			t.Fatal("not expired")
+		}
+		_, err := c.Confirm(ctx)
+		if err == nil {
+			t.Fatal("confirmed expired change")
+		}
+		if e := email(t, ctx); e != c.OldEmail {
+			t.Errorf("changed after expiry: %q", e)
+		}
+
+		err = (&EmailChanges{}).DeleteExpired(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.ByUser(ctx, c.UserID)
+		if !zdb.ErrNoRows(err) {
+			t.Fatalf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("in use", func(t *testing.T) {
+		ctx, c := setup(t)
+
+		other := User{Site: MustGetSite(ctx).ID, Email: "taken@example.com",
+			Access: UserAccesses{"all": AccessReadOnly}, Password: []byte("coconuts")}
+		err := other.Insert(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u := MustGetUser(ctx)
+		err = (&EmailChange{UserID: u.ID, Email: "TAKEN@example.com", OldEmail: u.Email}).Insert(ctx)
+		if err == nil || !strings.Contains(err.Error(), "already in use") {
+			t.Fatalf("wrong error: %v", err)
+		}
+
+		// Address was taken after the change was started.
+		err = zdb.Exec(ctx, `update users set email='new@example.com' where user_id=$1`, other.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Confirm(ctx)
+		if err == nil || !strings.Contains(err.Error(), "already in use") {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if e := email(t, ctx); e != c.OldEmail {
+			t.Errorf("changed: %q", e)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Retry schedule for emails that couldn't be sent: the first retry is after
+// EmailRetryBase, and the wait is doubled after every attempt up to
+// EmailRetryMax. Emails are marked as failed after EmailMaxAttempts.
+//
+// With the defaults the last attempt is about 12 hours after the first.
+const (
+	EmailRetryBase   = 2 * time.Minute
+	EmailRetryMax    = 4 * time.Hour
+	EmailMaxAttempts = 10
+)
+
+// How long to keep sent and failed emails in the queue.
+const (
+	emailKeepSent   = 2 * 24 * time.Hour
+	emailKeepFailed = 30 * 24 * time.Hour
+)
+
+// EmailBackoff gets the time to wait before retrying an email that failed
+// attempts times.
+func EmailBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	if attempts > 20 { // Don't overflow.
+		return EmailRetryMax
+	}
+	return min(EmailRetryBase<<(attempts-1), EmailRetryMax)
+}
+
+// QueuedEmail is an email that couldn't be sent, which is retried by the cron
+// job.
+type QueuedEmail struct {
+	ID      int64  `db:"email_id" json:"id"`
+	From    string `db:"from_addr" json:"from"`
+	To      string `db:"to_addr" json:"to"` // Comma-separated.
+	Subject string `db:"subject" json:"subject"`
+	Message []byte `db:"message" json:"-"` // Complete message, with all headers.
+
+	Attempts int    `db:"attempts" json:"attempts"`
+	Error    string `db:"error" json:"error"` // Error from the last attempt.
+
+	// Time of the next attempt; nil once it's sent or failed.
+	NextAttemptAt *time.Time `db:"next_attempt_at" json:"next_attempt_at"`
+	SentAt        *time.Time `db:"sent_at" json:"sent_at"`
+	FailedAt      *time.Time `db:"failed_at" json:"failed_at"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+}
+
+// QueueEmail adds an email to the queue after the first attempt to send it
+// failed with sendErr.
+func QueueEmail(ctx context.Context, from string, to []string, msg []byte, sendErr error) error {
+	e := QueuedEmail{
+		From:      from,
+		To:        strings.Join(to, ","),
+		Message:   msg,
+		Attempts:  1,
+		CreatedAt: ztime.Now(),
+	}
+	if m, err := mail.ReadMessage(bytes.NewReader(msg)); err == nil {
+		e.Subject = m.Header.Get("Subject")
+		if s, err := new(mime.WordDecoder).DecodeHeader(e.Subject); err == nil {
+			e.Subject = s
+		}
+	}
+	e.setError(sendErr)
+	next := e.CreatedAt.Add(EmailBackoff(e.Attempts))
+	e.NextAttemptAt = &next
+
+	var err error
+	e.ID, err = zdb.InsertID(ctx, "email_id",
+		`insert into email_queue (from_addr, to_addr, subject, message, attempts, error, next_attempt_at, created_at) values (?)`,
+		[]any{e.From, e.To, e.Subject, e.Message, e.Attempts, e.Error, e.NextAttemptAt, e.CreatedAt})
+	return errors.Wrap(err, "QueueEmail")
+}
+
+// Recipients gets the list of recipients.
+func (e QueuedEmail) Recipients() []string { return strings.Split(e.To, ",") }
+
+// Attempted records an attempt to send the email; sendErr is nil if it was
+// sent.
+func (e *QueuedEmail) Attempted(ctx context.Context, sendErr error) error {
+	now := ztime.Now()
+	e.Attempts++
+	e.setError(sendErr)
+	switch {
+	case sendErr == nil:
+		e.NextAttemptAt, e.SentAt = nil, &now
+	case e.Attempts >= EmailMaxAttempts:
+		e.NextAttemptAt, e.FailedAt = nil, &now
+	default:
+		next := now.Add(EmailBackoff(e.Attempts))
+		e.NextAttemptAt = &next
+	}
+
+	err := zdb.Exec(ctx, `update email_queue
+		set attempts=$1, error=$2, next_attempt_at=$3, sent_at=$4, failed_at=$5
+		where email_id=$6`,
+		e.Attempts, e.Error, e.NextAttemptAt, e.SentAt, e.FailedAt, e.ID)
+	return errors.Wrapf(err, "QueuedEmail.Attempted %d", e.ID)
+}
+
+func (e *QueuedEmail) setError(err error) {
+	e.Error = ""
+	if err != nil {
+		e.Error = err.Error()
+		if len(e.Error) > 1000 {
+			e.Error = e.Error[:1000]
+		}
+	}
+}
+
+type QueuedEmails []QueuedEmail
+
+// ListDue lists emails that should be retried now.
+func (e *QueuedEmails) ListDue(ctx context.Context, limit int) error {
+	return errors.Wrap(zdb.Select(ctx, e, `/* QueuedEmails.ListDue */
+		select * from email_queue where next_attempt_at <= $1
+		order by next_attempt_at limit $2`,
+		ztime.Now(), limit), "QueuedEmails.ListDue")
+}
+
+// ListUnsent lists all emails that are waiting to be retried or have failed,
+// most recent first.
+func (e *QueuedEmails) ListUnsent(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, e, `/* QueuedEmails.ListUnsent */
+		select * from email_queue where sent_at is null
+		order by created_at desc, email_id desc limit 500`), "QueuedEmails.ListUnsent")
+}
+
+// Purge deletes sent emails after two days, and failed ones after 30 days.
+func (e *QueuedEmails) Purge(ctx context.Context) error {
+	now := ztime.Now()
+	err := zdb.Exec(ctx, `delete from email_queue where sent_at < $1 or failed_at < $2`,
+		now.Add(-emailKeepSent), now.Add(-emailKeepFailed))
+	return errors.Wrap(err, "QueuedEmails.Purge")
+}
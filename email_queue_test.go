@@ -0,0 +1,143 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestEmailBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 2 * time.Minute},
+		{2, 4 * time.Minute},
+		{3, 8 * time.Minute},
+		{7, 128 * time.Minute},
+		{8, 4 * time.Hour},
+		{9, 4 * time.Hour},
+		{100, 4 * time.Hour},
+	}
+	for _, tt := range tests {
+		if have := EmailBackoff(tt.attempts); have != tt.want {
+			t.Errorf("EmailBackoff(%d) = %s; want %s", tt.attempts, have, tt.want)
+		}
+	}
+
+	var total time.Duration
+	for i := 1; i < EmailMaxAttempts; i++ {
+		total += EmailBackoff(i)
+	}
+	if total < 10*time.Hour || total > 14*time.Hour {
+		t.Errorf("total = %s", total)
+	}
+}
+
+func TestQueuedEmail(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	ztime.SetNow(t, now.Format("2006-01-02 15:04:05"))
+
+	msg := []byte("From: test@example.com\r\nTo: a@example.com\r\nSubject: =?utf-8?q?Caf=C3=A9?=\r\n\r\nHello\r\n")
+	err := QueueEmail(ctx, "test@example.com", []string{"a@example.com", "b@example.com"}, msg, errors.New("connection refused"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := func() QueuedEmails {
+		t.Helper()
+		var e QueuedEmails
+		err := e.ListUnsent(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	due := func() QueuedEmails {
+		t.Helper()
+		var e QueuedEmails
+		err := e.ListDue(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	e := list()
+	if len(e) != 1 {
+		t.Fatalf("len = %d", len(e))
+	}
+	if e[0].Subject != "Café" || e[0].Error != "connection refused" || e[0].Attempts != 1 ||
+		e[0].To != "a@example.com,b@example.com" || string(e[0].Message) != string(msg) ||
+		!e[0].NextAttemptAt.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("%#v", e[0])
+	}
+	if d := due(); len(d) != 0 {
+		t.Errorf("due before next attempt: %d", len(d))
+	}
+
+	ztime.SetNow(t, now.Add(2*time.Minute).Format("2006-01-02 15:04:05"))
+	d := due()
+	if len(d) != 1 {
+		t.Fatalf("len(due) = %d", len(d))
+	}
+
+	// Fail until the max. attempts.
+	for i := d[0].Attempts; i < EmailMaxAttempts; i++ {
+		err := d[0].Attempted(ctx, errors.New("still refused"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	e = list()
+	if len(e) != 1 || e[0].FailedAt == nil || e[0].NextAttemptAt != nil ||
+		e[0].Attempts != EmailMaxAttempts || e[0].Error != "still refused" {
+		t.Errorf("%#v", e[0])
+	}
+	if d := due(); len(d) != 0 {
+		t.Errorf("failed email is due: %d", len(d))
+	}
+
+	// Sent emails aren't listed.
+	err = QueueEmail(ctx, "test@example.com", []string{"a@example.com"}, msg, errors.New("oops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = list()
+	err = e[0].Attempted(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := list(); len(e) != 1 || e[0].FailedAt == nil {
+		t.Errorf("%#v", e)
+	}
+
+	// Purge.
+	ztime.SetNow(t, now.Add(3*24*time.Hour).Format("2006-01-02 15:04:05"))
+	err = (&QueuedEmails{}).Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := list(); len(e) != 1 {
+		t.Errorf("failed email purged too soon: %d", len(e))
+	}
+	ztime.SetNow(t, now.Add(31*24*time.Hour).Format("2006-01-02 15:04:05"))
+	err = (&QueuedEmails{}).Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := list(); len(e) != 0 {
+		t.Errorf("not purged: %d", len(e))
+	}
+}
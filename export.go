@@ -120,8 +120,12 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 		*e.NumRows += len(hits)
 
 		for _, hit := range hits {
+			var session string
+			if !hit.Session.IsZero() {
+				session = hit.Session.String()
+			}
 			c.Write([]string{hit.Path, hit.Title, hit.Event, hit.UserAgent,
-				hit.Browser, hit.System, hit.Session.String(), hit.Bot, hit.Ref,
+				hit.Browser, hit.System, session, hit.Bot, hit.Ref,
 				hit.RefScheme, hit.Size, hit.Location, hit.FirstVisit,
 				hit.CreatedAt})
 		}
@@ -197,9 +201,8 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 		zlog.Error(err)
 	}
 
-	if mailUser {
+	if user := GetUser(ctx); mailUser && user.Settings.Notify(NotifyExports) {
 		site := MustGetSite(ctx)
-		user := GetUser(ctx)
 		err = blackmail.Send("GoatCounter export ready",
 			blackmail.From("GoatCounter export", Config(ctx).EmailFrom),
 			blackmail.To(user.Email),
@@ -293,13 +296,19 @@ func Import(
 			firstHitAt = hit.CreatedAt
 		}
 
-		// Map session IDs to new session IDs.
-		s, ok := sessions[row.Session]
-		if !ok {
-			sessions[row.Session] = Memstore.SessionID()
-			s = sessions[row.Session]
+		// Map session IDs to new session IDs. Anonymized pageviews don't have
+		// a session, so give them their own rather than grouping them all in
+		// one; the first visit is kept from the export.
+		if row.Session.IsZero() {
+			hit.Session = Memstore.SessionID()
+		} else {
+			s, ok := sessions[row.Session]
+			if !ok {
+				sessions[row.Session] = Memstore.SessionID()
+				s = sessions[row.Session]
+			}
+			hit.Session = s
 		}
-		hit.Session = s
 
 		persist(hit, false)
 		n++
@@ -311,7 +320,7 @@ func Import(
 		l.Error(errs)
 	}
 
-	if email {
+	if email && GetUser(ctx).Settings.Notify(NotifyExports) {
 		// Send email after 10s delay to make sure the cron task has finished
 		// updating all the rows.
 		time.Sleep(10 * time.Second)
@@ -412,7 +421,7 @@ func (row ExportRow) Hit(ctx context.Context, siteID int64) (Hit, error) {
 
 	if row.RefScheme != "" {
 		v.Include("refScheme", row.RefScheme,
-			[]string{*RefSchemeHTTP, *RefSchemeOther, *RefSchemeGenerated, *RefSchemeCampaign})
+			[]string{*RefSchemeHTTP, *RefSchemeOther, *RefSchemeGenerated, *RefSchemeCampaign, *RefSchemeSpam})
 		if row.RefScheme != "" {
 			hit.RefScheme = &row.RefScheme
 		}
@@ -5,6 +5,7 @@
 package goatcounter_test
 
 import (
+	"bytes"
 	"compress/gzip"
 	"os"
 	"strings"
@@ -150,3 +151,42 @@ func TestExport(t *testing.T) {
 		}
 	})
 }
+
+func TestExportNotify(t *testing.T) {
+	var user goatcounter.User
+	ctx := gctest.DB(t)
+	ctx = gctest.Site(ctx, t, nil, &user)
+	goatcounter.Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+
+	buf := new(bytes.Buffer)
+	blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+
+	run := func(t *testing.T) string {
+		var export goatcounter.Export
+		fp, err := export.Create(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		defer os.Remove(export.Path)
+
+		buf.Reset()
+		export.Run(ctx, fp, true)
+		return buf.String()
+	}
+
+	if mail := run(t); !strings.Contains(mail, "export ready") {
+		t.Errorf("no email sent:\n%s", mail)
+	}
+
+	user.Settings.Notifications.Off = []string{goatcounter.NotifyExports}
+	err := user.Update(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithUser(ctx, &user)
+
+	if mail := run(t); mail != "" {
+		t.Errorf("sent out email:\n%s", mail)
+	}
+}
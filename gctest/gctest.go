@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
 	"testing"
 
 	"golang.org/x/text/language"
@@ -24,7 +25,10 @@ import (
 	"zgo.at/zstd/ztype"
 )
 
-var pgSQL = false
+var (
+	pgSQL       = false
+	pgPartition = false // Partition the hits table; only for PostgreSQL.
+)
 
 func init() {
 	sqlite3.DefaultHook(goatcounter.SQLiteHook)
@@ -94,6 +98,12 @@ func db(t testing.TB, storeFile bool) context.Context {
 	}
 
 	ctx := Context(db)
+	if pgPartition {
+		_, err := goatcounter.PartitionHits(ctx)
+		if err != nil {
+			t.Fatalf("partition hits: %s", err)
+		}
+	}
 	goatcounter.Memstore.TestInit(db)
 	ctx = initData(ctx, db, t)
 	cron.Start(ctx)
@@ -134,7 +144,7 @@ func initData(ctx context.Context, db zdb.DB, t testing.TB) context.Context {
 
 	user := goatcounter.User{
 		Site:          site.ID,
-		Access:        goatcounter.UserAccesses{"all": goatcounter.AccessAdmin},
+		Access:        goatcounter.UserAccesses{"all": goatcounter.AccessOwner},
 		Email:         "test@gctest.localhost",
 		EmailVerified: true,
 		Password:      []byte("coconuts"),
@@ -188,6 +198,12 @@ func StoreHits(ctx context.Context, t *testing.T, wantFail bool, hits ...goatcou
 		if err != nil {
 			t.Fatal(err)
 		}
+		err = cron.UpdateBotStats(ctx, s, slices.DeleteFunc(slices.Clone(hits), func(h goatcounter.Hit) bool {
+			return h.Site != s || h.Bot == 0
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	return hits
@@ -223,7 +239,7 @@ func Site(ctx context.Context, t *testing.T, site *goatcounter.Site, user *goatc
 		user.Password = []byte("coconuts")
 	}
 	if user.Access == nil {
-		user.Access = goatcounter.UserAccesses{"all": goatcounter.AccessAdmin}
+		user.Access = goatcounter.UserAccesses{"all": goatcounter.AccessOwner}
 	}
 	err = user.Insert(ctx, false)
 	if err != nil {
@@ -0,0 +1,11 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+//go:build testpg && testpartition
+
+package gctest
+
+func init() {
+	pgPartition = true
+}
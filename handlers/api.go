@@ -102,12 +102,27 @@ func (h api) mount(r chi.Router, db zdb.DB) {
 
 	a.Post("/api/v0/count", zhttp.Wrap(h.count))
 
-	a.Get("/api/v0/paths", zhttp.Wrap(h.paths))
-	a.Get("/api/v0/stats/total", zhttp.Wrap(h.countTotal))
-	a.Get("/api/v0/stats/hits", zhttp.Wrap(h.hits))
-	a.Get("/api/v0/stats/hits/{path_id}", zhttp.Wrap(h.refs))
-	a.Get("/api/v0/stats/{page}", zhttp.Wrap(h.stats))
-	a.Get("/api/v0/stats/{page}/{id}", zhttp.Wrap(h.statsDetail))
+	a.Post("/api/v0/purge", zhttp.Wrap(h.purge))
+	a.Get("/api/v0/purge/{id}", zhttp.Wrap(h.purgeGet))
+	a.Post("/api/v0/purge/ref", zhttp.Wrap(h.purgeRef))
+	a.Post("/api/v0/purge/sessions", zhttp.Wrap(h.purgeSessions))
+
+	// Stats can be read from the read-only replica, and have the query timeout.
+	ro := a.With(readOnly)
+	ro.Get("/api/v0/paths", wrapRO(h.paths))
+	ro.Get("/api/v0/stats/total", wrapRO(h.countTotal))
+	ro.Get("/api/v0/stats/sessions", wrapRO(h.sessions))
+	ro.Get("/api/v0/stats/bots", wrapRO(h.bots))
+	a.Get("/api/v0/bots/classify", zhttp.Wrap(h.botsClassify))
+	ro.Get("/api/v0/stats/chart.svg", wrapRO(h.chart))
+	ro.Get("/api/v0/stats/chart.png", wrapRO(h.chart))
+	a.Post("/api/v0/stats/chart/sign", zhttp.Wrap(h.chartSign))
+	a.Delete("/api/v0/stats/chart/sign", zhttp.Wrap(h.chartSignReset))
+	ro.Get("/api/v0/stats/hits", wrapRO(h.hits))
+	ro.Get("/api/v0/stats/hits/{path_id}", wrapRO(h.refs))
+	ro.Get("/api/v0/stats/locations/{id}/paths", wrapRO(h.locationPaths))
+	ro.Get("/api/v0/stats/{page}", wrapRO(h.stats))
+	ro.Get("/api/v0/stats/{page}/{id}", wrapRO(h.statsDetail))
 
 	// Note: DELETE not supported for sites and users intentionally, since it's
 	// such a dangerous operation.
@@ -118,6 +133,20 @@ func (h api) mount(r chi.Router, db zdb.DB) {
 	a.Patch("/api/v0/sites/{id}", zhttp.Wrap(h.siteUpdate)) // Update just fields given
 }
 
+// wrapRO is like zhttp.Wrap(), but sends a query timeout as a 503 with the
+// error message, rather than as an unexpected error.
+func wrapRO(h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+		err := h(w, r)
+		var tErr *goatcounter.QueryTimeoutError
+		if errors.As(err, &tErr) {
+			w.WriteHeader(tErr.Code())
+			return zhttp.JSON(w, apiError{Error: tErr.Error()})
+		}
+		return err
+	})
+}
+
 func tokenFromHeader(r *http.Request, w http.ResponseWriter) (string, error) {
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
@@ -178,9 +207,11 @@ func (h api) auth(r *http.Request, w http.ResponseWriter, require zint.Bitflag64
 		return nil
 	}
 
-	// Regular API token.
+	// Regular API token; always from the primary as a new token may not be on
+	// the read-only replica yet.
+	ctx := goatcounter.Primary(r.Context())
 	var token goatcounter.APIToken
-	err = token.ByToken(r.Context(), key)
+	err = token.ByToken(ctx, key)
 	if zdb.ErrNoRows(err) {
 		w.Header().Set("WWW-Authenticate", "Basic realm=GoatCounter")
 		return guru.New(http.StatusUnauthorized, "unknown token")
@@ -191,14 +222,14 @@ func (h api) auth(r *http.Request, w http.ResponseWriter, require zint.Bitflag64
 
 	// Update once a day at the most.
 	if token.LastUsedAt == nil || token.LastUsedAt.Before(ztime.Now().Add(-24*time.Hour)) {
-		err := token.UpdateLastUsed(r.Context())
+		err := token.UpdateLastUsed(ctx)
 		if err != nil {
 			zlog.Error(err)
 		}
 	}
 
 	var user goatcounter.User
-	err = user.ByID(r.Context(), token.UserID)
+	err = user.ByID(ctx, token.UserID)
 	if err != nil {
 		return err
 	}
@@ -209,7 +240,7 @@ func (h api) auth(r *http.Request, w http.ResponseWriter, require zint.Bitflag64
 		return guru.New(401, "only admins can create and use API keys")
 	}
 
-	*r = *r.WithContext(goatcounter.WithUser(r.Context(), &user))
+	*r = *r.WithContext(goatcounter.WithAPIToken(goatcounter.WithUser(r.Context(), &user), &token))
 
 	if require == 0 {
 		return nil
@@ -479,7 +510,8 @@ type APICountRequestHit struct {
 	Location string `json:"location"`
 
 	// IP to get location from; not used if location is set. Also used for
-	// session generation.
+	// session generation, and pageviews from networks in the site's IP
+	// blocklist are recorded as a bot.
 	IP string `json:"ip"`
 
 	// Time this pageview should be recorded at; this can be in the past,
@@ -495,6 +527,11 @@ type APICountRequestHit struct {
 	// identifier.
 	Session string `json:"session"`
 
+	// HTTP status code of the request, for hits imported from logfiles.
+	// Redirects, errors, etc. are only counted in the status code stats, and
+	// not as a pageview; only 2xx and 304 are.
+	Status int `json:"status"`
+
 	// {omitdoc}
 	Host string `json:"-"`
 
@@ -506,8 +543,8 @@ type APICountRequestHit struct {
 
 func (h APICountRequestHit) String() string {
 	return fmt.Sprintf(
-		`{Path: %q, Title: %q, Event: %t, Ref: %q, Size: "%s", Query: %q, Bot: %d, UserAgent: %q, Location: %q, IP: %q, CreatedAt: %q, Session: %q, Host: %q}`,
-		h.Path, h.Title, h.Event, h.Ref, h.Size, h.Query, h.Bot, h.UserAgent, h.Location, h.IP, h.CreatedAt, h.Session, h.Host)
+		`{Path: %q, Title: %q, Event: %t, Ref: %q, Size: "%s", Query: %q, Bot: %d, UserAgent: %q, Location: %q, IP: %q, CreatedAt: %q, Session: %q, Status: %d, Host: %q}`,
+		h.Path, h.Title, h.Event, h.Ref, h.Size, h.Query, h.Bot, h.UserAgent, h.Location, h.IP, h.CreatedAt, h.Session, h.Status, h.Host)
 }
 
 // POST /api/v0/count count
@@ -521,8 +558,12 @@ func (h APICountRequestHit) String() string {
 // Errors will have the key set to the index of the pageview. Any pageviews not
 // listed have been processed and shouldn't be sent again.
 //
+// A 429 is returned if the site has a monthly pageview quota which is reached,
+// and the quota is set to reject new pageviews.
+//
 // Request body: APICountRequest
 // Response 202: {empty}
+// Response 429: zgo.at/goatcounter/v2/handlers.apiError
 func (h api) count(w http.ResponseWriter, r *http.Request) error {
 	m := metrics.Start("/api/v0/count")
 	defer m.Done()
@@ -531,6 +572,10 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	if Site(r.Context()).OverQuota() {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return zhttp.JSON(w, apiError{Error: "the monthly pageview quota for this site is reached"})
+	}
 
 	var args APICountRequest
 	_, err = h.dec.Decode(r, &args)
@@ -566,8 +611,11 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 			continue
 		}
 
-		if a.Location == "" && a.IP != "" {
-			a.Location = (goatcounter.Location{}).LookupIP(r.Context(), a.IP)
+		ipBlock := a.IP != "" && site.Settings.IPBlock.Contains(a.IP)
+
+		var city string
+		if a.Location == "" && a.IP != "" && !ipBlock {
+			a.Location, city = (goatcounter.Location{}).LookupIPCity(r.Context(), a.IP)
 		}
 
 		hit := goatcounter.Hit{
@@ -581,13 +629,19 @@ func (h api) count(w http.ResponseWriter, r *http.Request) error {
 			CreatedAt:       a.CreatedAt.UTC(),
 			UserAgentHeader: a.UserAgent,
 			Location:        a.Location,
+			City:            city,
 			RemoteAddr:      a.IP,
+			Status:          a.Status,
 		}
 
-		if a.UserAgent != "" {
-			if b := isbot.UserAgent(a.UserAgent); isbot.Is(b) {
-				hit.Bot = int(b)
-			}
+		if ipBlock {
+			hit.Bot = goatcounter.BotIPBlock
+		} else if label, ok := site.Settings.BotAllow.Match(a.UserAgent, a.IP); ok {
+			hit.Bot, hit.Label = 0, label
+		} else if b := isbot.UserAgent(a.UserAgent); a.UserAgent != "" && isbot.Is(b) {
+			hit.Bot = int(b)
+		} else if goatcounter.IsSupplementBot(a.UserAgent, a.IP) {
+			hit.Bot = goatcounter.BotSupplement
 		}
 
 		switch {
@@ -708,10 +762,21 @@ func (h api) siteGet(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.JSON(w, site)
 }
 
+// Settings that aren't in the request are taken from the account defaults, if
+// they're set.
+type apiSiteCreateRequest struct {
+	goatcounter.Site
+
+	// Copy the settings and dashboard defaults from this site ID; the
+	// settings and user_defaults in the request are ignored if this is set.
+	// The domain and the secret for viewing the dashboard are never copied.
+	CopyFrom int64 `json:"copy_from"`
+}
+
 // PUT /api/v0/sites sites
 // Create a new site.
 //
-// Request body: goatcounter.Site
+// Request body: apiSiteCreateRequest
 // Response 200: goatcounter.Site
 func (h api) siteCreate(w http.ResponseWriter, r *http.Request) error {
 	err := h.auth(r, w, goatcounter.APIPermSiteCreate)
@@ -719,17 +784,42 @@ func (h api) siteCreate(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	var site goatcounter.Site
-	_, err = h.dec.Decode(r, &site)
+	account, err := goatcounter.GetAccount(r.Context())
+	if err != nil {
+		return err
+	}
+
+	// Decode on top of the account defaults, so that values in the request
+	// take precedence.
+	var args apiSiteCreateRequest
+	args.Site.ApplyAccountDefaults(*account)
+	_, err = h.dec.Decode(r, &args)
 	if err != nil {
 		return err
 	}
 
+	site := args.Site
+	if args.CopyFrom > 0 {
+		var src goatcounter.Site
+		err := src.ByID(r.Context(), args.CopyFrom)
+		if err != nil {
+			if zdb.ErrNoRows(err) {
+				return guru.Errorf(400, "copy_from: no site with ID %d", args.CopyFrom)
+			}
+			return err
+		}
+		if src.IDOrParent() != Site(r.Context()).IDOrParent() {
+			return guru.Errorf(400, "copy_from: no site with ID %d", args.CopyFrom)
+		}
+		site.CopySettings(src)
+	}
+
 	site.Parent = &Site(r.Context()).ID
 	err = site.Insert(r.Context())
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteCreate, site.Display(r.Context()), nil, site)
 
 	return zhttp.JSON(w, site)
 }
@@ -738,6 +828,13 @@ type apiSiteUpdateRequest struct {
 	Settings   goatcounter.SiteSettings `json:"settings"`
 	Cname      *string                  `json:"cname"`
 	LinkDomain string                   `json:"link_domain"`
+	Tags       goatcounter.Strings      `json:"tags"`
+	Notes      string                   `json:"notes"`
+}
+
+func newAPISiteUpdateRequest(s goatcounter.Site) apiSiteUpdateRequest {
+	return apiSiteUpdateRequest{Settings: s.Settings, Cname: s.Cname, LinkDomain: s.LinkDomain,
+		Tags: s.Tags, Notes: s.Notes}
 }
 
 // POST /api/v0/sites/{id} sites
@@ -761,11 +858,10 @@ func (h api) siteUpdate(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	old := goatcounter.AuditSnapshot(newAPISiteUpdateRequest(*site))
 	var args apiSiteUpdateRequest
 	if r.Method == http.MethodPatch {
-		args.LinkDomain = site.LinkDomain
-		args.Cname = site.Cname
-		args.Settings = site.Settings
+		args = newAPISiteUpdateRequest(*site)
 	}
 
 	_, err = h.dec.Decode(r, &args)
@@ -773,13 +869,22 @@ func (h api) siteUpdate(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	oldSettings := site.Settings
 	site.LinkDomain = args.LinkDomain
 	site.Cname = args.Cname
 	site.Settings = args.Settings
+	site.Tags = args.Tags
+	site.Notes = args.Notes
 	err = site.Update(r.Context())
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteUpdate, site.Display(r.Context()), old, args)
+
+	err = site.DelayRetention(r.Context(), oldSettings)
+	if err != nil {
+		return err
+	}
 
 	return zhttp.JSON(w, site)
 }
@@ -791,6 +896,11 @@ type (
 
 		// Only select paths after this ID, for pagination.
 		After int64 `json:"after"`
+
+		// Only select paths matching this filter; a filter starting with /
+		// matches the start of the path, anything else matches anywhere in the
+		// path or title.
+		Filter string `json:"filter"`
 	}
 	apiPathsResponse struct {
 		// List of paths, sorted by ID.
@@ -827,8 +937,17 @@ func (h api) paths(w http.ResponseWriter, r *http.Request) error {
 		args.Limit = 1
 	}
 
+	var filter []int64
+	if args.Filter != "" {
+		var err error
+		filter, err = goatcounter.PathFilter(r.Context(), args.Filter, true)
+		if err != nil {
+			return err
+		}
+	}
+
 	var p goatcounter.Paths
-	more, err := p.List(r.Context(), goatcounter.MustGetSite(r.Context()).ID, args.After, args.Limit)
+	more, err := p.List(r.Context(), goatcounter.MustGetSite(r.Context()).ID, args.After, filter, args.Limit)
 	if err != nil {
 		return err
 	}
@@ -848,12 +967,38 @@ type (
 		// than the highest value for the hour.
 		Daily bool `json:"daily" query:"daily"`
 
+		// Group the stats by week or month, rather than by day. The "day" in
+		// the stats is the first day and "end" is the last day of every week or
+		// month. Visitors are summed for every day, so this is the number of
+		// visits rather than unique visitors. Implies daily {enum: week month}.
+		Group string `json:"group" query:"group"`
+
 		// Include only these paths; default is to include everything.
 		IncludePaths goatcounter.Ints `json:"include_paths" query:"include_paths"`
 
 		// Exclude these paths, for pagination.
 		ExcludePaths goatcounter.Ints `json:"exclude_paths" query:"exclude_paths"`
 
+		// Only include paths matching this filter; a filter starting with /
+		// matches the start of the path, anything else matches anywhere in the
+		// path or title.
+		Filter string `json:"filter" query:"filter"`
+
+		// Sort order {enum: visitors views path new trending, default: visitors}.
+		//
+		//   visitors  Most visitors first.
+		//   views     Most pageviews first.
+		//   path      Alphabetically by path.
+		//   new       Paths that were first seen most recently first.
+		//   trending  Largest growth compared to the previous period of the
+		//             same length first; this sets growth, prev_count, and
+		//             new on the returned paths.
+		Sort string `json:"sort" query:"sort"`
+
+		// Get the page after this; use the "after" value from the previous
+		// response.
+		After string `json:"after" query:"after"`
+
 		// Maximum number of pages to get {range: 1-100, default: 20}.
 		Limit int `json:"limit" query:"limit"`
 	}
@@ -866,6 +1011,9 @@ type (
 
 		// More hits after this?
 		More bool `json:"more"`
+
+		// Pass as "after" to get the next page.
+		After string `json:"after"`
 	}
 )
 
@@ -900,17 +1048,43 @@ func (h api) hits(w http.ResponseWriter, r *http.Request) error {
 		args.End = ztime.Now()
 	}
 
+	v := goatcounter.NewValidate(r.Context())
+	v.Include("group", args.Group, []string{"", goatcounter.GroupWeek, goatcounter.GroupMonth})
+	v.Include("sort", args.Sort, append([]string{""}, goatcounter.Sorts...))
+	if v.HasErrors() {
+		return v
+	}
+
+	include := []int64(args.IncludePaths)
+	if args.Filter != "" {
+		f, err := goatcounter.PathFilter(r.Context(), args.Filter, true)
+		if err != nil {
+			return err
+		}
+		if len(include) > 0 {
+			f = slices.DeleteFunc(f, func(p int64) bool { return !slices.Contains(include, p) })
+			if len(f) == 0 {
+				f = []int64{-1}
+			}
+		}
+		include = f
+	}
+
 	var pages goatcounter.HitLists
-	tdu, more, err := pages.List(r.Context(), ztime.NewRange(args.Start).To(args.End),
-		args.IncludePaths, args.ExcludePaths, args.Limit, args.Daily)
+	tdu, more, err := pages.List(r.Context(), ztime.NewRange(args.Start).To(args.End), include,
+		goatcounter.HitListOpts{Sort: args.Sort, After: args.After, Exclude: args.ExcludePaths},
+		args.Limit, args.Daily || args.Group != "")
 	if err != nil {
 		return err
 	}
+	after := pages.Cursor(args.Sort)
+	pages.Group(args.Group, User(r.Context()).Settings.WeekStart())
 
 	return zhttp.JSON(w, apiHitsResponse{
 		Total: tdu,
 		Hits:  pages,
 		More:  more,
+		After: after,
 	})
 }
 
@@ -1035,6 +1209,330 @@ func (h api) countTotal(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.JSON(w, tc)
 }
 
+type (
+	apiSessionsRequest struct {
+		// Start time {date, default: one week ago}.
+		Start time.Time `json:"start" query:"start"`
+
+		// End time {date, default: current time}.
+		End time.Time `json:"end" query:"end"`
+
+		// Include only sessions that started on these paths; default is to
+		// include everything.
+		IncludePaths goatcounter.Ints `json:"include_paths" query:"include_paths"`
+	}
+	apiSessionsResponse struct {
+		// Session statistics per day; days without any sessions are omitted.
+		Stats goatcounter.SessionStats `json:"stats"`
+	}
+)
+
+// GET /api/v0/stats/sessions stats
+// Get session statistics per day.
+//
+// Sessions are counted on the day (in UTC) they started. The duration is the
+// time between the first and last pageview in a session.
+//
+// Query: apiSessionsRequest
+// Response 200: apiSessionsResponse
+func (h api) sessions(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/stats/*")
+	defer m.Done()
+
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	var args apiSessionsRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	if args.Start.IsZero() {
+		args.Start = ztime.AddPeriod(ztime.Now(), -7, ztime.Day)
+	}
+	if args.End.IsZero() {
+		args.End = ztime.Now()
+	}
+
+	var stats goatcounter.SessionStats
+	err = stats.List(r.Context(), ztime.NewRange(args.Start).To(args.End), args.IncludePaths)
+	if err != nil {
+		return err
+	}
+
+	return zhttp.JSON(w, apiSessionsResponse{Stats: stats})
+}
+
+type apiBotsRequest struct {
+	// Start time {date, default: start of the bot retention period}.
+	Start time.Time `json:"start" query:"start"`
+
+	// End time {date, default: current time}.
+	End time.Time `json:"end" query:"end"`
+
+	// Maximum number of paths and User-Agents to get {range: 1-100, default: 20}.
+	Limit int `json:"limit" query:"limit"`
+}
+
+// GET /api/v0/stats/bots stats
+// Get statistics for pageviews flagged as a bot.
+//
+// These are kept for the number of days in the bot_retention setting, and are
+// never included in any of the other stats. The User-Agent headers are only
+// included if the site collects the User-Agent.
+//
+// Query: apiBotsRequest
+// Response 200: goatcounter.BotStats
+func (h api) bots(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/stats/*")
+	defer m.Done()
+
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	args := apiBotsRequest{Limit: 20}
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	if h.apiMax > 0 && args.Limit > h.apiMax {
+		args.Limit = h.apiMax
+	}
+	if args.Limit < 1 {
+		args.Limit = 1
+	}
+	if args.Start.IsZero() {
+		days := Site(r.Context()).Settings.EffectiveBotRetention(r.Context())
+		args.Start = ztime.AddPeriod(ztime.Now(), -days, ztime.Day)
+	}
+	if args.End.IsZero() {
+		args.End = ztime.Now()
+	}
+
+	var stats goatcounter.BotStats
+	err = stats.List(r.Context(), ztime.NewRange(args.Start).To(args.End), args.Limit)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, stats)
+}
+
+type apiBotsClassifyRequest struct {
+	// User-Agent header.
+	UserAgent string `json:"user_agent" query:"user_agent"`
+
+	// IP address.
+	IP string `json:"ip" query:"ip"`
+
+	// Bot code sent by count.js, if any.
+	Bot int `json:"bot" query:"bot"`
+}
+
+// GET /api/v0/bots/classify count
+// Get how a pageview with this User-Agent header and IP address would be
+// classified for this site.
+//
+// This uses the same rules as /count and the bot stats, so it can be used to
+// find out why pageviews aren't counted. This only looks at the User-Agent
+// header; /count also detects some bots from other headers.
+//
+// Query: apiBotsClassifyRequest
+// Response 200: goatcounter.BotReason
+func (h api) botsClassify(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermSiteRead)
+	if err != nil {
+		return err
+	}
+
+	var args apiBotsClassifyRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	if args.Bot != 0 && !goatcounter.IsClientBot(args.Bot) {
+		w.WriteHeader(400)
+		return zhttp.JSON(w, apiError{Error: fmt.Sprintf("bot: not a count.js bot code: %d", args.Bot)})
+	}
+
+	return zhttp.JSON(w, Site(r.Context()).ClassifyBot(args.UserAgent, args.IP,
+		isbot.UserAgent(args.UserAgent), args.Bot))
+}
+
+type apiPurgeRequest struct {
+	// First day to purge, in UTC {date}.
+	Start string `json:"start"`
+
+	// Last day to purge (inclusive), in UTC {date}.
+	End string `json:"end"`
+
+	// Only purge these paths; default is to purge all paths.
+	Paths goatcounter.Ints `json:"paths"`
+}
+
+// POST /api/v0/purge purge
+// Remove all pageviews in a date range.
+//
+// This starts the purge in the background; the stored pageviews are removed in
+// batches, after which all the stats for these days are removed. Use
+// /api/v0/purge/{id} to get the progress.
+//
+// Request body: apiPurgeRequest
+// Response 202: zgo.at/goatcounter/v2.Purge
+func (h api) purge(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermPurge)
+	if err != nil {
+		return err
+	}
+
+	var args apiPurgeRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	p := goatcounter.Purge{
+		Start: v.Date("start", args.Start, "2006-01-02"),
+		End:   v.Date("end", args.End, "2006-01-02"),
+		Paths: args.Paths,
+	}
+	if v.HasErrors() {
+		return v
+	}
+	err = p.Insert(r.Context())
+	if err != nil {
+		return err
+	}
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.MustRunFunction(fmt.Sprintf("purge-range:%d", p.SiteID), func() { p.Run(ctx) })
+
+	w.WriteHeader(http.StatusAccepted)
+	return zhttp.JSON(w, p)
+}
+
+// GET /api/v0/purge/{id} purge
+// Get details about a purge, including the progress.
+//
+// Response 200: zgo.at/goatcounter/v2.Purge
+func (h api) purgeGet(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermPurge)
+	if err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var p goatcounter.Purge
+	err = p.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, p)
+}
+
+type apiPurgeRefRequest struct {
+	// Referrer to purge, e.g. "example.com/page"; the scheme is ignored.
+	Ref string `json:"ref"`
+
+	// Purge all referrers for the registrable domain of ref, including
+	// subdomains.
+	Domain bool `json:"domain"`
+
+	// Delete the pageviews, rather than keeping them without a referrer.
+	Delete bool `json:"delete"`
+
+	// Only get what would be purged, without changing anything.
+	DryRun bool `json:"dry_run"`
+}
+
+// POST /api/v0/purge/ref purge
+// Remove a referrer from the stats.
+//
+// This starts the purge in the background, and returns what will be purged;
+// use dry_run to only get this, without purging anything.
+//
+// Request body: apiPurgeRefRequest
+// Response 200: zgo.at/goatcounter/v2.RefPurgePreview
+// Response 202: zgo.at/goatcounter/v2.RefPurgePreview
+func (h api) purgeRef(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermPurge)
+	if err != nil {
+		return err
+	}
+
+	var args apiPurgeRefRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	p := goatcounter.RefPurge{Ref: args.Ref, Domain: args.Domain, Delete: args.Delete}
+	err = p.Validate(r.Context())
+	if err != nil {
+		return err
+	}
+
+	preview, err := p.Preview(r.Context())
+	if err != nil {
+		return err
+	}
+	if args.DryRun {
+		return zhttp.JSON(w, preview)
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditRefPurge, p.Ref, nil, p)
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("purge-ref:%d", Site(ctx).ID), func() {
+		err := p.Run(ctx)
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	return zhttp.JSON(w, preview)
+}
+
+type apiPurgeSessionsRequest struct {
+	// Session IDs to remove, as in the export; at most 1,000.
+	Sessions []string `json:"sessions"`
+}
+
+// POST /api/v0/purge/sessions purge
+// Remove all pageviews for one or more sessions.
+//
+// The stored pageviews are removed, and the stats they were counted in are
+// decremented; this is intended for data subject requests. The session IDs
+// aren't stored in the audit log.
+//
+// Request body: apiPurgeSessionsRequest
+// Response 200: zgo.at/goatcounter/v2.SessionPurgeResult
+func (h api) purgeSessions(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermPurge)
+	if err != nil {
+		return err
+	}
+
+	var args apiPurgeSessionsRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	p := goatcounter.SessionPurge{Sessions: args.Sessions}
+	err = p.Validate(r.Context())
+	if err != nil {
+		return err
+	}
+
+	res, err := p.Run(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, res)
+}
+
 type (
 	apiStatsRequest struct {
 		// Start time, should be rounded to the hour {datetime, default: one week ago}.
@@ -1051,19 +1549,66 @@ type (
 
 		// Offset for pagination.
 		Offset int `json:"offset" query:"offset"`
+
+		// Sort order; only for toprefs {enum: visitors trending, default: visitors}.
+		//
+		//   visitors  Most visitors first.
+		//   trending  Largest growth compared to the previous period of the
+		//             same length first; this sets growth, prev_count, and
+		//             new on the returned stats.
+		Sort string `json:"sort" query:"sort"`
+
+		// Group by; only for browsers and toprefs {enum: browser major full domain}.
+		//
+		// For browsers (default: browser):
+		//
+		//   browser  Browser name; the detail lists the major versions.
+		//   major    Browser name and major version, with the ID as
+		//            "name/major"; the detail lists the full versions for a
+		//            name or "name/major" ID.
+		//   full     Browser name and full version.
+		//
+		// The detail lists all full versions for a browser if this isn't set.
+		//
+		// For toprefs (default: not grouped):
+		//
+		//   domain   Registrable domain (e.g. "reddit.com" for
+		//            "old.reddit.com/r/golang"); the detail lists the full
+		//            referrers for the domain. The sort is ignored.
+		Group string `json:"group" query:"group"`
+
+		// Include referrers flagged as spam; only for toprefs.
+		ShowSpam bool `json:"show_spam" query:"show_spam"`
 	}
 	apiStatsResponse struct {
 		// Sorted list of paths with their visitor and pageview count.
 		Stats []goatcounter.HitStat `json:"stats"`
 		More  bool                  `json:"more"`
+
+		// Visitors per pixel density (1x, 1.5x, 2x, 3x); only for sizes.
+		Scales []goatcounter.HitStat `json:"scales,omitempty"`
+	}
+	apiLocationPathsResponse struct {
+		// Top paths for visitors from the country.
+		Paths []goatcounter.HitStat `json:"paths"`
+
+		// Top referrers for visitors from the country; referrers flagged as
+		// spam are never included.
+		Refs []goatcounter.HitStat `json:"refs"`
 	}
 )
 
 // GET /api/v0/stats/{page} stats
 // Get browser/system/etc. stats.
 //
-// Page can be: browsers, systems, locations, languages, sizes, campaigns,
-// toprefs.
+// Page can be: browsers, systems, locations, languages, sizes, devices,
+// statuscodes, channels, campaigns, toprefs, entries, exits.
+//
+// The sizes page also lists the visitors per pixel density in scales.
+//
+// The statuscodes page counts requests per HTTP status class (2xx, 3xx, etc.)
+// rather than visitors; these are only available for hits imported from
+// logfiles.
 //
 // Query: apiStatsRequest
 // Response 200: apiStatsResponse
@@ -1073,7 +1618,8 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 
 	v := goatcounter.NewValidate(r.Context())
 	page := v.Include("page", chi.URLParam(r, "page"), []string{
-		"browsers", "systems", "locations", "languages", "sizes", "campaigns", "toprefs"})
+		"browsers", "systems", "locations", "languages", "sizes", "devices", "statuscodes",
+		"channels", "campaigns", "toprefs", "entries", "exits"})
 	if v.HasErrors() {
 		return v
 	}
@@ -1099,6 +1645,15 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 	if args.End.IsZero() {
 		args.End = ztime.Now()
 	}
+	v.Include("sort", args.Sort, []string{"", goatcounter.SortVisitors, goatcounter.SortTrending})
+	if page == "toprefs" {
+		v.Include("group", args.Group, []string{"", goatcounter.RefGroupDomain})
+	} else {
+		v.Include("group", args.Group, append([]string{""}, goatcounter.BrowserGroups...))
+	}
+	if v.HasErrors() {
+		return v
+	}
 
 	var (
 		stats goatcounter.HitStats
@@ -1106,7 +1661,9 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 	)
 	switch page {
 	case "browsers":
-		f = stats.ListBrowsers
+		f = func(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+			return stats.ListBrowserVersions(ctx, args.Group, "", rng, pathFilter, limit, offset)
+		}
 	case "systems":
 		f = stats.ListSystems
 	case "locations":
@@ -1117,10 +1674,34 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 		f = func(ctx context.Context, rng ztime.Range, pathFilter []int64, _, _ int) error {
 			return stats.ListSizes(ctx, rng, pathFilter)
 		}
+	case "devices":
+		f = func(ctx context.Context, rng ztime.Range, pathFilter []int64, _, _ int) error {
+			return stats.ListDevices(ctx, rng, pathFilter)
+		}
+	case "statuscodes":
+		f = func(ctx context.Context, rng ztime.Range, pathFilter []int64, _, _ int) error {
+			return stats.ListStatusClasses(ctx, rng, pathFilter)
+		}
+	case "channels":
+		f = func(ctx context.Context, rng ztime.Range, pathFilter []int64, _, _ int) error {
+			return stats.ListChannels(ctx, rng, pathFilter)
+		}
 	case "campaigns":
 		f = stats.ListCampaigns
 	case "toprefs":
-		f = stats.ListTopRefs
+		f = func(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+			if args.Group == goatcounter.RefGroupDomain {
+				return stats.ListTopRefDomains(ctx, rng, pathFilter, !args.ShowSpam, limit, offset)
+			}
+			if args.Sort == goatcounter.SortTrending {
+				return stats.ListTopRefsTrending(ctx, rng, pathFilter, !args.ShowSpam, limit, offset)
+			}
+			return stats.ListTopRefs(ctx, rng, pathFilter, !args.ShowSpam, limit, offset)
+		}
+	case "entries":
+		f = stats.ListEntryPages
+	case "exits":
+		f = stats.ListExitPages
 	}
 	err = f(r.Context(), ztime.NewRange(args.Start).To(args.End), args.IncludePaths, args.Limit, args.Offset)
 	if err != nil {
@@ -1135,16 +1716,105 @@ func (h api) stats(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
+	var scales goatcounter.HitStats
+	if page == "sizes" {
+		err = scales.ListScales(r.Context(), ztime.NewRange(args.Start).To(args.End), args.IncludePaths)
+		if err != nil {
+			return err
+		}
+	}
+
 	return zhttp.JSON(w, apiStatsResponse{
-		Stats: stats.Stats,
-		More:  stats.More,
+		Stats:  stats.Stats,
+		More:   stats.More,
+		Scales: scales.Stats,
+	})
+}
+
+// GET /api/v0/stats/locations/{id}/paths stats
+// Get the top paths and referrers for a country.
+//
+// The ID is a country (e.g. "US"). The limit applies to both the paths and
+// referrers, and the offset is ignored.
+//
+// The referrers are only stored per country since this was added, and are
+// removed with the rest of the stats if data retention is set.
+//
+// Query: apiStatsRequest
+// Response 200: apiLocationPathsResponse
+func (h api) locationPaths(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/stats/*")
+	defer m.Done()
+
+	v := goatcounter.NewValidate(r.Context())
+	country := strings.ToUpper(chi.URLParam(r, "id"))
+	v.Len("id", country, 2, 2)
+	if v.HasErrors() {
+		return v
+	}
+
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	args := apiStatsRequest{Limit: 10}
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+	if h.apiMax > 0 && args.Limit > h.apiMax {
+		args.Limit = h.apiMax
+	}
+	if args.Limit < 1 {
+		args.Limit = 1
+	}
+	if args.Start.IsZero() {
+		args.Start = ztime.AddPeriod(ztime.Now(), -7, ztime.Day)
+	}
+	if args.End.IsZero() {
+		args.End = ztime.Now()
+	}
+
+	var (
+		rng         = ztime.NewRange(args.Start).To(args.End)
+		paths, refs goatcounter.HitStats
+	)
+	err = paths.ListLocationPaths(r.Context(), country, rng, args.IncludePaths, args.Limit, 0)
+	if err != nil {
+		return err
+	}
+	err = refs.ListLocationRefs(r.Context(), country, rng, args.IncludePaths, args.Limit, 0)
+	if err != nil {
+		return err
+	}
+
+	return zhttp.JSON(w, apiLocationPathsResponse{
+		Paths: paths.Stats,
+		Refs:  refs.Stats,
 	})
 }
 
 // GET /api/v0/stats/{page}/{id} stats
 // Get detailed stats for an ID.
 //
-// Page can be: browsers, systems, locations, sizes, campaigns, toprefs.
+// Page can be: browsers, systems, locations, sizes, statuscodes, campaigns,
+// toprefs.
+//
+// For systems this lists the versions; some versions are normalized as they're
+// reported ambiguously (e.g. "Windows 10/11" and "macOS 10.15+").
+//
+// For toprefs this lists the paths for a referrer, or the referrers for a
+// domain if group is "domain".
+//
+// For locations the ID can be a country (e.g. "US") to list the regions, or a
+// region (e.g. "US-TX") to list the cities. Cities are only available if
+// enabled in the site settings and the server uses a GeoIP City database.
+//
+// For statuscodes the ID can be a class (e.g. "4xx") to list the paths with the
+// status code, or a status code (e.g. "404") to list just the paths.
+//
+// For channels the ID is a channel (e.g. "search") to list the referrers in
+// that channel.
 //
 // Query: apiStatsRequest
 // Response 200: apiStatsResponse
@@ -1154,7 +1824,8 @@ func (h api) statsDetail(w http.ResponseWriter, r *http.Request) error {
 
 	v := goatcounter.NewValidate(r.Context())
 	page := v.Include("page", chi.URLParam(r, "page"), []string{
-		"browsers", "systems", "locations", "sizes", "campaigns", "toprefs"})
+		"browsers", "systems", "locations", "sizes", "statuscodes", "channels",
+		"campaigns", "toprefs", "entries", "exits"})
 	if v.HasErrors() {
 		return v
 	}
@@ -1180,6 +1851,14 @@ func (h api) statsDetail(w http.ResponseWriter, r *http.Request) error {
 	if args.End.IsZero() {
 		args.End = ztime.Now()
 	}
+	if page == "toprefs" {
+		v.Include("group", args.Group, []string{"", goatcounter.RefGroupDomain})
+	} else {
+		v.Include("group", args.Group, append([]string{""}, goatcounter.BrowserGroups...))
+	}
+	if v.HasErrors() {
+		return v
+	}
 
 	var (
 		stats goatcounter.HitStats
@@ -1187,15 +1866,32 @@ func (h api) statsDetail(w http.ResponseWriter, r *http.Request) error {
 	)
 	switch page {
 	case "browsers":
-		f = stats.ListBrowser
+		f = func(ctx context.Context, id string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+			return stats.ListBrowserVersions(ctx, args.Group, id, rng, pathFilter, limit, offset)
+		}
+		if args.Group == "" {
+			f = stats.ListBrowser
+		}
 	case "systems":
 		f = stats.ListSystem
 	case "locations":
 		f = stats.ListLocation
+		if strings.ContainsRune(chi.URLParam(r, "id"), '-') {
+			f = stats.ListCities
+		}
 	case "sizes":
 		f = stats.ListSize
+	case "statuscodes":
+		f = stats.ListStatus
+	case "channels":
+		f = stats.ListChannel
 	case "toprefs":
 		f = stats.ListTopRef
+		if args.Group == goatcounter.RefGroupDomain {
+			f = func(ctx context.Context, id string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+				return stats.ListRefsByDomain(ctx, id, rng, pathFilter, !args.ShowSpam, limit, offset)
+			}
+		}
 	case "campaigns":
 		f = func(ctx context.Context, id string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 			n, err := strconv.ParseInt(id, 0, 64)
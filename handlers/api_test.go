@@ -8,14 +8,19 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"image/png"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"zgo.at/bgrun"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
 	"zgo.at/json"
@@ -440,6 +445,182 @@ func TestAPICount(t *testing.T) {
 	}
 }
 
+func TestAPICountIPBlock(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := Site(ctx)
+	site.Settings.Collect.Set(goatcounter.CollectHits)
+	site.Settings.IPBlock.Scan("192.0.2.0/24\n2001:db8::/32")
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := APICountRequest{NoSessions: true, Hits: []APICountRequestHit{
+		{Path: "/a", IP: "192.0.2.1"},
+		{Path: "/b", IP: "2001:db8::1"},
+		{Path: "/c", IP: "1.2.3.4"},
+	}}
+	r, rr := newAPITest(ctx, t, "POST", "/api/v0/count", bytes.NewReader(zjson.MustMarshal(body)), goatcounter.APIPermCount)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 202)
+
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[string]string)
+	for _, h := range hits {
+		have[h.Path] = fmt.Sprintf("%d %q", h.Bot, h.Location)
+	}
+	want := map[string]string{
+		"/a": fmt.Sprintf(`%d ""`, goatcounter.BotIPBlock),
+		"/b": fmt.Sprintf(`%d ""`, goatcounter.BotIPBlock),
+		"/c": `0 "AU"`,
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+}
+
+func TestAPIBots(t *testing.T) {
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", Bot: 5, UserAgentHeader: "Googlebot/2.1"},
+		goatcounter.Hit{Path: "/a", Bot: goatcounter.BotIPBlock, UserAgentHeader: "curl/8.0"},
+		goatcounter.Hit{Path: "/b", FirstVisit: true})
+
+	r, rr := newAPITest(ctx, t, "GET", "/api/v0/stats/bots", nil, goatcounter.APIPermStats)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var have goatcounter.BotStats
+	zjson.MustUnmarshal(rr.Body.Bytes(), &have)
+	if have.Total != 2 || len(have.Bots) != 2 || len(have.Paths) != 1 || len(have.UserAgents) != 2 {
+		t.Errorf("%s", rr.Body.String())
+	}
+
+	site := Site(ctx)
+	site.Settings.Collect.Clear(goatcounter.CollectUserAgent)
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, rr = newAPITest(ctx, t, "GET", "/api/v0/stats/bots", nil, goatcounter.APIPermStats)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+	if strings.Contains(rr.Body.String(), "Googlebot") {
+		t.Errorf("User-Agent in response: %s", rr.Body.String())
+	}
+}
+
+func TestAPIBotsClassify(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.IgnoreIPs = goatcounter.Strings{"192.0.2.1"}
+	site.Settings.UABlock.Scan("SyntheticMonitor")
+	site.Settings.BotAllow.Scan("Partner: PartnerBot")
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query, want string
+	}{
+		{"user_agent=Firefox/130.0&ip=192.0.2.1", fmt.Sprintf(`%d false "ignored because \"192.0.2.1\" is in the IP ignore list"`, goatcounter.BotIgnoreIP)},
+		{"user_agent=SyntheticMonitor/1.0", fmt.Sprintf(`%d false "flagged as bot because the User-Agent matches \"SyntheticMonitor\" in the User-Agent blocklist"`, goatcounter.BotUABlock)},
+		{"user_agent=PartnerBot/1.0", `0 true "counted as a regular pageview because it matches \"Partner\" in the bot allowlist"`},
+		{"user_agent=Googlebot/2.1", `5 false "flagged as bot by the User-Agent or headers: Known bot"`},
+		{"user_agent=Mozilla/5.0+(X11;+Linux+x86_64;+rv:130.0)+Gecko/20100101+Firefox/130.0&bot=153",
+			`153 false "flagged as bot by count.js: WebDriver"`},
+		{"user_agent=Mozilla/5.0+(X11;+Linux+x86_64;+rv:130.0)+Gecko/20100101+Firefox/130.0",
+			`0 true "counted as a regular pageview"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r, rr := newAPITest(ctx, t, "GET", "/api/v0/bots/classify?"+tt.query, nil, goatcounter.APIPermSiteRead)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			var have goatcounter.BotReason
+			zjson.MustUnmarshal(rr.Body.Bytes(), &have)
+			if h := fmt.Sprintf("%d %t %q", have.Bot, have.Counted, have.Reason); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+
+	r, rr := newAPITest(ctx, t, "GET", "/api/v0/bots/classify?bot=5", nil, goatcounter.APIPermSiteRead)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 400)
+}
+
+func TestAPIPurge(t *testing.T) {
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Path: "/a", Ref: "https://spam.example.com", FirstVisit: true, CreatedAt: time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", FirstVisit: true, CreatedAt: time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC)})
+
+	t.Run("permission", func(t *testing.T) {
+		body := strings.NewReader(`{"start": "2026-03-02", "end": "2026-03-02"}`)
+		r, rr := newAPITest(ctx, t, "POST", "/api/v0/purge", body, goatcounter.APIPermSiteUpdate)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 403)
+	})
+
+	t.Run("ref", func(t *testing.T) {
+		body := strings.NewReader(`{"ref": "example.com", "domain": true, "dry_run": true}`)
+		r, rr := newAPITest(ctx, t, "POST", "/api/v0/purge/ref", body, goatcounter.APIPermPurge)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		var have goatcounter.RefPurgePreview
+		zjson.MustUnmarshal(rr.Body.Bytes(), &have)
+		if fmt.Sprint(have.Refs, have.Visitors, len(have.Days)) != "[spam.example.com] 1 1" {
+			t.Errorf("%#v", have)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		body := strings.NewReader(`{"start": "2026-03-02", "end": "2026-03-02"}`)
+		r, rr := newAPITest(ctx, t, "POST", "/api/v0/purge", body, goatcounter.APIPermPurge)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 202)
+		bgrun.Wait("")
+
+		var p goatcounter.Purge
+		zjson.MustUnmarshal(rr.Body.Bytes(), &p)
+		r, rr = newAPITest(ctx, t, "GET", "/api/v0/purge/"+strconv.FormatInt(p.ID, 10), nil, goatcounter.APIPermPurge)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+		zjson.MustUnmarshal(rr.Body.Bytes(), &p)
+		if p.FinishedAt == nil || p.Error != nil {
+			t.Fatalf("%#v", p)
+		}
+
+		var days []string
+		err := zdb.Select(ctx, &days, `select substr(cast(hour as varchar), 1, 10) from hit_counts order by hour`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(days) != "[2026-03-01 2026-03-03]" {
+			t.Errorf("hit_counts: %v", days)
+		}
+
+		var entries goatcounter.AuditEntries
+		_, err = entries.List(ctx, 0, goatcounter.AuditPageviewPurge, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("audit entries: %v", entries)
+		}
+	})
+}
+
 func TestAPISitesCreate(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 	now := ztime.Now()
@@ -572,6 +753,43 @@ func TestAPISitesUpdate(t *testing.T) {
 	}
 }
 
+func TestAPISitesUpdateAudit(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := Site(ctx)
+
+	r, rr := newAPITest(ctx, t, "PATCH", fmt.Sprintf("/api/v0/sites/%d", site.ID),
+		strings.NewReader(`{"settings": {"data_retention": 60, "ignore_ips": ["192.0.2.1"]}}`),
+		goatcounter.APIPermSiteUpdate)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var entries goatcounter.AuditEntries
+	_, err := entries.List(ctx, 0, "", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("len(entries) = %d; want 1\n%v", len(entries), entries)
+	}
+
+	e := entries[0]
+	if e.Action != goatcounter.AuditSiteUpdate || e.UserID != User(ctx).ID || e.APITokenID == nil {
+		t.Errorf("wrong entry: %#v", e)
+	}
+	if want := User(ctx).Email + " (API token ‘test’)"; e.Actor != want {
+		t.Errorf("\nhave: %q\nwant: %q", e.Actor, want)
+	}
+
+	keys := slices.Sorted(maps.Keys(e.Diff))
+	if want := []string{"settings.data_retention", "settings.ignore_ips"}; !slices.Equal(keys, want) {
+		t.Errorf("\nhave: %q\nwant: %q", keys, want)
+	}
+	c := e.Diff["settings.data_retention"]
+	if c.OldString() != "0" || c.NewString() != "60" {
+		t.Errorf("data_retention: %s → %s", c.OldString(), c.NewString())
+	}
+}
+
 func TestAPIPaths(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 
@@ -990,6 +1208,22 @@ func TestAPIStats(t *testing.T) {
 	}
 }
 
+func TestAPIQueryTimeout(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	goatcounter.SetQueryTimeout(time.Nanosecond)
+	defer goatcounter.SetQueryTimeout(0)
+
+	r, rr := newAPITest(ctx, t, "GET", "/api/v0/stats/browsers", nil, goatcounter.APIPermStats)
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 503)
+
+	want := `{"error": "Loading the data took too long; try selecting a shorter date range or a more specific filter"}`
+	if d := ztest.Diff(rr.Body.String(), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
+
 func TestAPIStatsDetail(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:13:14")
 
@@ -1053,3 +1287,97 @@ func TestAPIStatsDetail(t *testing.T) {
 		})
 	}
 }
+
+func TestAPIChart(t *testing.T) {
+	ztime.SetNow(t, "2020-06-18 12:13:14")
+
+	ctx := gctest.DB(t)
+	gctest.StoreHits(ctx, t, false,
+		goatcounter.Hit{Site: 1, Path: "/a", FirstVisit: true},
+		goatcounter.Hit{Site: 1, Path: "/b", FirstVisit: true})
+
+	perm := goatcounter.APIPermStats
+	t.Run("svg", func(t *testing.T) {
+		r, rr := newAPITest(ctx, t, "GET", "/api/v0/stats/chart.svg?style=dark", nil, perm)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		if h := rr.Header().Get("Content-Type"); h != "image/svg+xml" {
+			t.Errorf("wrong Content-Type: %q", h)
+		}
+		if b := rr.Body.String(); !strings.Contains(b, "<polyline") || !strings.Contains(b, `fill="#0e1011"`) {
+			t.Error(b)
+		}
+	})
+
+	t.Run("png", func(t *testing.T) {
+		r, rr := newAPITest(ctx, t, "GET", "/api/v0/stats/chart.png?width=300&height=100", nil, perm)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		img, err := png.Decode(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 100 {
+			t.Errorf("wrong size: %s", b)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		r, rr := newAPITest(ctx, t, "GET", "/api/v0/stats/chart.svg?width=5&style=x", nil, perm)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 400)
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		r, rr := newAPITest(ctx, t, "POST", "/api/v0/stats/chart/sign",
+			strings.NewReader(`{"width": 400}`), perm)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		var resp apiChartSignResponse
+		err := json.Unmarshal(rr.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(resp.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		get := func(t *testing.T, q url.Values, wantCode int) {
+			t.Helper()
+			r, rr := newTest(ctx, "GET", u.Path+"?"+q.Encode(), nil)
+			newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, wantCode)
+		}
+
+		get(t, u.Query(), 200)
+
+		q := u.Query()
+		q.Set("width", "800")
+		get(t, q, 403)
+
+		var user goatcounter.User
+		uid, _ := strconv.ParseInt(u.Query().Get("uid"), 10, 64)
+		err = user.ByID(ctx, uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Access = goatcounter.UserAccesses{"all": goatcounter.AccessReadOnly}
+		err = user.Update(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, rr = newTest(ctx, "GET", u.Path+"?"+u.RawQuery, nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 403)
+		if !strings.Contains(rr.Body.String(), "no access") {
+			t.Errorf("wrong error: %s", rr.Body.String())
+		}
+
+		ztime.SetNow(t, "2020-08-18 12:13:14")
+		get(t, u.Query(), 403)
+	})
+}
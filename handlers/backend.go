@@ -54,15 +54,20 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 	}
 
 	r.Use(
-		mware.RealIP(),
+		RealIP(),
 		mware.WrapWriter(),
+		countStatus,
 		mware.Unpanic("zgo.at/goatcounter/v2/handlers.add"),
 		addctx(db, true, dashTimeout),
 		addcsp(domainStatic),
 		middleware.RedirectSlashes,
 		mware.NoStore())
 	if slices.Contains(zlog.Config.Debug, "req") || slices.Contains(zlog.Config.Debug, "all") {
-		r.Use(mware.RequestLog(nil, "/count"))
+		if jsonRequestLog {
+			r.Use(requestLog("/count"))
+		} else {
+			r.Use(mware.RequestLog(nil, "/count"))
+		}
 	}
 	if true {
 		r.Use(middleware.NewCompressor(5).Handler)
@@ -137,15 +142,19 @@ func (h backend) Mount(r chi.Router, db zdb.DB, dev bool, domainStatic string, d
 		a := r.With(mware.Headers(headers), keyAuth, addz18n())
 		user{}.mount(a)
 		{
-			ap := a.With(loggedInOrPublic, addz18n())
+			ap := a.With(shareLink, loggedInOrPublic, addz18n())
 			ap.Get("/", zhttp.Wrap(h.dashboard))
 			if h.websocket {
 				ap.Get("/loader", zhttp.Wrap(h.loader))
 			}
 			ap.Get("/load-widget", zhttp.Wrap(h.loadWidget))
+			ap.Get("/load-widget/csv", zhttp.Wrap(h.widgetCSV))
+			ap.Get("/path/{id}", zhttp.Wrap(h.pathDetail))
 		}
 		{
 			af := a.With(loggedIn, addz18n())
+			af.Get("/overview", zhttp.Wrap(h.overview))
+			af.Get("/bots", zhttp.Wrap(h.bots))
 			settings{}.mount(af)
 
 			Newi18n().mount(af)
@@ -33,6 +33,7 @@ func TestBackendTpl(t *testing.T) {
 		// User settings
 		{"/user/dashboard", "Paths overview"},
 		{"/user/pref", "Your email"},
+		{"/user/notifications", "Send email reports"},
 		{"/user/auth", "Change password"},
 		{"/user/api", "API documentation"},
 
@@ -44,6 +45,7 @@ func TestBackendTpl(t *testing.T) {
 		{"/settings/users/1", "Password"},
 		{"/settings/purge", "Remove or merge pageviews"},
 		{"/settings/export", "format of the CSV file"},
+		{"/settings/alerts", "Traffic alerts"},
 		{"/settings/delete-account", "The site and all associated data will be permanently removed"},
 		{"/settings/change-code", "Change your site code and login domain"},
 
@@ -6,10 +6,12 @@ package handlers
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"zgo.at/bgrun"
+	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/cron"
 	"zgo.at/goatcounter/v2/metrics"
@@ -17,6 +19,7 @@ import (
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zhttp/auth"
+	"zgo.at/zhttp/header"
 	"zgo.at/zhttp/mware"
 	"zgo.at/zlog"
 	"zgo.at/zprof"
@@ -40,10 +43,20 @@ func (h bosmang) mount(r chi.Router, db zdb.DB) {
 	a.Get("/bosmang/bgrun", zhttp.Wrap(h.bgrun))
 	a.Post("/bosmang/bgrun/{task}", zhttp.Wrap(h.runTask))
 	a.Get("/bosmang/metrics", zhttp.Wrap(h.metrics))
+	a.Get("/bosmang/slow-queries", zhttp.Wrap(h.slowQueries))
+	a.Get("/bosmang/email", zhttp.Wrap(h.email))
 	a.Handle("/bosmang/profile*", zprof.NewHandler(zprof.Prefix("/bosmang/profile")))
 
 	a.Get("/bosmang/sites", zhttp.Wrap(h.sites))
+	a.Get("/bosmang/instance", zhttp.Wrap(h.instance))
+	a.Get("/bosmang/instance/json", zhttp.Wrap(h.instanceJSON))
+	a.Post("/bosmang/instance/bulk", zhttp.Wrap(h.instanceBulk))
 	a.Post("/bosmang/sites/login/{id}", zhttp.Wrap(h.login))
+
+	a.Get("/bosmang/user-agents", zhttp.Wrap(h.userAgents(nil)))
+	a.Post("/bosmang/user-agents", zhttp.Wrap(h.addUAOverride))
+	a.Post("/bosmang/user-agents/{id}/delete", zhttp.Wrap(h.deleteUAOverride))
+	a.Get("/bosmang/user-agents/export", zhttp.Wrap(h.exportUAOverrides))
 }
 
 func (h bosmang) cache(w http.ResponseWriter, r *http.Request) error {
@@ -71,13 +84,44 @@ func (h bosmang) bgrun(w http.ResponseWriter, r *http.Request) error {
 		metrics[h.Task] = x
 	}
 
+	retention, err := cron.GetRetentionProgress(r.Context())
+	if err != nil {
+		return err
+	}
+
+	var maintenance *cron.MaintenanceResult
+	if zdb.SQLDialect(r.Context()) == zdb.DialectSQLite {
+		m, err := cron.GetMaintenanceResult(r.Context())
+		if err != nil {
+			return err
+		}
+		maintenance = &m
+	}
+
+	orphans, err := cron.GetOrphanProgress(r.Context())
+	if err != nil {
+		return err
+	}
+
+	var dryRun map[int64]goatcounter.RetentionPreview
+	if r.URL.Query().Get("dry_run") != "" {
+		dryRun, err = cron.DataRetentionDryRun(r.Context())
+		if err != nil {
+			return err
+		}
+	}
+
 	return zhttp.Template(w, "bosmang_bgrun.gohtml", struct {
 		Globals
-		Tasks   []cron.Task
-		Jobs    []bgrun.Job
-		History []bgrun.Job
-		Metrics map[string]ztime.Durations
-	}{newGlobals(w, r), cron.Tasks, bgrun.Running(), hist, metrics})
+		Tasks       []cron.Task
+		Jobs        []bgrun.Job
+		History     []bgrun.Job
+		Metrics     map[string]ztime.Durations
+		Retention   cron.RetentionProgress
+		DryRun      map[int64]goatcounter.RetentionPreview
+		Maintenance *cron.MaintenanceResult
+		Orphans     cron.OrphanProgress
+	}{newGlobals(w, r), cron.Tasks, bgrun.Running(), hist, metrics, retention, dryRun, maintenance, orphans})
 }
 
 func (h bosmang) runTask(w http.ResponseWriter, r *http.Request) error {
@@ -113,6 +157,31 @@ func (h bosmang) metrics(w http.ResponseWriter, r *http.Request) error {
 	}{newGlobals(w, r), metrics.List().Sort(by), by})
 }
 
+func (h bosmang) slowQueries(w http.ResponseWriter, r *http.Request) error {
+	by := "max"
+	if b := r.URL.Query().Get("by"); b != "" {
+		by = b
+	}
+	return zhttp.Template(w, "bosmang_slow_queries.gohtml", struct {
+		Globals
+		Queries []goatcounter.SlowQuery
+		By      string
+	}{newGlobals(w, r), goatcounter.ListSlowQueries(by), by})
+}
+
+func (h bosmang) email(w http.ResponseWriter, r *http.Request) error {
+	var emails goatcounter.QueuedEmails
+	err := emails.ListUnsent(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.Template(w, "bosmang_email.gohtml", struct {
+		Globals
+		Emails      goatcounter.QueuedEmails
+		MaxAttempts int
+	}{newGlobals(w, r), emails, goatcounter.EmailMaxAttempts})
+}
+
 func (h bosmang) sites(w http.ResponseWriter, r *http.Request) error {
 	var a goatcounter.BosmangStats
 	err := a.List(r.Context())
@@ -120,10 +189,95 @@ func (h bosmang) sites(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	tag := r.URL.Query().Get("tag")
+	if tag != "" {
+		a = a.Tagged(tag)
+	}
+
 	return zhttp.Template(w, "bosmang_sites.gohtml", struct {
 		Globals
 		Stats goatcounter.BosmangStats
-	}{newGlobals(w, r), a})
+		Tag   string
+	}{newGlobals(w, r), a, tag})
+}
+
+// Overview of all sites on this instance.
+func (h bosmang) instance(w http.ResponseWriter, r *http.Request) error {
+	v := zvalidate.New()
+	var inactive int64
+	if i := r.URL.Query().Get("inactive"); i != "" {
+		inactive = v.Integer("inactive", i)
+		v.Range("inactive", inactive, 1, 120)
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	var sites goatcounter.BosmangSites
+	err := sites.List(r.Context())
+	if err != nil {
+		return err
+	}
+	if inactive > 0 {
+		sites = sites.Inactive(int(inactive))
+	}
+
+	return zhttp.Template(w, "bosmang_instance.gohtml", struct {
+		Globals
+		Sites    goatcounter.BosmangSites
+		Inactive int64
+		Actions  []string
+	}{newGlobals(w, r), sites, inactive, goatcounter.BulkActions})
+}
+
+// Run a bulk action on the selected sites in the background; the result is
+// logged and added to the audit log.
+func (h bosmang) instanceBulk(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Action  string  `json:"action"`
+		Sites   []int64 `json:"sites"`
+		Message string  `json:"message"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	v := zvalidate.New()
+	v.Include("action", args.Action, goatcounter.BulkActions)
+	if len(args.Sites) == 0 {
+		v.Append("sites", "no sites selected")
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction("bosmang:bulk-"+args.Action, func() {
+		res, err := goatcounter.BulkSites(ctx, args.Action, args.Sites, args.Message)
+		if err != nil {
+			zlog.Error(err)
+			return
+		}
+		l := zlog.Module("bosmang").Fields(zlog.F{"done": res.Done, "failed": res.Failed})
+		if len(res.Failed) > 0 {
+			l.Errorf("bulk %s", res)
+			return
+		}
+		l.Printf("bulk %s", res)
+	})
+
+	zhttp.Flash(w, "Running %q for %d sites in the background; the result will be in the audit log", args.Action, len(args.Sites))
+	return zhttp.SeeOther(w, "/bosmang/instance")
+}
+
+func (h bosmang) instanceJSON(w http.ResponseWriter, r *http.Request) error {
+	var sites goatcounter.BosmangSites
+	err := sites.List(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, sites)
 }
 
 func (h bosmang) login(w http.ResponseWriter, r *http.Request) error {
@@ -150,6 +304,11 @@ func (h bosmang) login(w http.ResponseWriter, r *http.Request) error {
 		return guru.New(403, "AllowBosmang not enabled")
 	}
 
+	err = user.Login(r.Context(), r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+
 	domain := cookieDomain(&site, r)
 	auth.SetCookie(w, *user.LoginToken, domain)
 	http.SetCookie(w, &http.Cookie{
@@ -163,7 +322,104 @@ func (h bosmang) login(w http.ResponseWriter, r *http.Request) error {
 		SameSite: zhttp.CookieSameSite,
 	})
 
-	return zhttp.SeeOther(w, site.URL(r.Context()))
+	// Only allow redirecting to the settings, so this can't be used as an open
+	// redirect.
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/settings/") {
+		next = ""
+	}
+	return zhttp.SeeOther(w, site.URL(r.Context())+next)
+}
+
+func (h bosmang) userAgents(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var unknown goatcounter.UnknownUAs
+		err := unknown.List(r.Context(), 100)
+		if err != nil {
+			return err
+		}
+
+		var overrides goatcounter.UAOverrides
+		err = overrides.List(r.Context())
+		if err != nil {
+			return err
+		}
+
+		return zhttp.Template(w, "bosmang_user_agents.gohtml", struct {
+			Globals
+			Validate  *zvalidate.Validator
+			Unknown   goatcounter.UnknownUAs
+			Overrides goatcounter.UAOverrides
+		}{newGlobals(w, r), verr, unknown, overrides})
+	}
+}
+
+func (h bosmang) addUAOverride(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Pattern string `json:"pattern"`
+		Browser string `json:"browser"`
+		Version string `json:"version"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	o := goatcounter.UAOverride{Pattern: args.Pattern, Browser: args.Browser, Version: args.Version}
+	err = o.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			return h.userAgents(vErr)(w, r)
+		}
+		return err
+	}
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction("ua-overrides", func() {
+		err := goatcounter.ApplyUAOverrides(ctx)
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	zhttp.Flash(w, "Override for %q added; existing stats are being updated in the background", o.Pattern)
+	return zhttp.SeeOther(w, "/bosmang/user-agents")
+}
+
+func (h bosmang) deleteUAOverride(w http.ResponseWriter, r *http.Request) error {
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	o := goatcounter.UAOverride{ID: id}
+	err := o.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, "Override deleted")
+	return zhttp.SeeOther(w, "/bosmang/user-agents")
+}
+
+// Export the overrides as JSON, so they can be sent upstream.
+func (h bosmang) exportUAOverrides(w http.ResponseWriter, r *http.Request) error {
+	var overrides goatcounter.UAOverrides
+	err := overrides.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	err = header.SetContentDisposition(w.Header(), header.DispositionArgs{
+		Type:     header.TypeAttachment,
+		Filename: "goatcounter-ua-overrides.json",
+	})
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, overrides)
 }
 
 func (h bosmang) error(w http.ResponseWriter, r *http.Request) error {
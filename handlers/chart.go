@@ -0,0 +1,541 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zhttp"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zvalidate"
+)
+
+type (
+	apiChartRequest struct {
+		// Start date {date, default: one week ago}.
+		Start time.Time `json:"start" query:"start"`
+
+		// End date {date, default: today}.
+		End time.Time `json:"end" query:"end"`
+
+		// Filter paths, using the same syntax as the dashboard.
+		Filter string `json:"filter" query:"filter"`
+
+		// Show totals per day rather than per hour; this is always done if the
+		// date range is larger than 90 days.
+		Daily bool `json:"daily" query:"daily"`
+
+		// Don't include events.
+		NoEvents bool `json:"no_events" query:"no_events"`
+
+		// Image width in pixels, 100 to 2000 {default: 800}.
+		Width int `json:"width" query:"width"`
+
+		// Image height in pixels, 50 to 1000 {default: 200}.
+		Height int `json:"height" query:"height"`
+
+		// Colour scheme {enum: light dark, default: light}.
+		Style string `json:"style" query:"style"`
+
+		// Expiry as a UNIX timestamp; only for signed URLs.
+		Expires int64 `json:"expires" query:"expires"`
+
+		// User who signed the URL; only for signed URLs.
+		UserID int64 `json:"uid" query:"uid"`
+
+		// Signature; only for signed URLs.
+		Sig string `json:"sig" query:"sig"`
+	}
+
+	apiChartSignResponse struct {
+		// Signed URL to the SVG image; replace .svg with .png to get a PNG.
+		URL string `json:"url"`
+
+		// When the URL expires.
+		Expires time.Time `json:"expires"`
+	}
+)
+
+// values gets the URL parameters for the chart, excluding the signature.
+//
+// This is also what gets signed; url.Values.Encode() sorts by key, so this
+// is always in the same order.
+func (a apiChartRequest) values() url.Values {
+	v := make(url.Values)
+	if !a.Start.IsZero() {
+		v.Set("start", a.Start.Format("2006-01-02"))
+	}
+	if !a.End.IsZero() {
+		v.Set("end", a.End.Format("2006-01-02"))
+	}
+	if a.Filter != "" {
+		v.Set("filter", a.Filter)
+	}
+	if a.Daily {
+		v.Set("daily", "true")
+	}
+	if a.NoEvents {
+		v.Set("no_events", "true")
+	}
+	if a.Width != 0 {
+		v.Set("width", strconv.Itoa(a.Width))
+	}
+	if a.Height != 0 {
+		v.Set("height", strconv.Itoa(a.Height))
+	}
+	if a.Style != "" {
+		v.Set("style", a.Style)
+	}
+	v.Set("expires", strconv.FormatInt(a.Expires, 10))
+	v.Set("uid", strconv.FormatInt(a.UserID, 10))
+	return v
+}
+
+func (a apiChartRequest) sign(key []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(a.values().Encode()))
+	return m.Sum(nil)
+}
+
+// chartAccess checks if the user can view the chart. This is checked when
+// signing a URL and every time it's used, so signed URLs stop working once the
+// user loses access.
+func chartAccess(user goatcounter.User) error {
+	if !user.AccessAdmin() {
+		return guru.New(http.StatusForbidden, "no access: only admins can view the chart with a signed URL")
+	}
+	return nil
+}
+
+// Check the signature for signed URLs, and set the user who signed it.
+func (h api) authSigned(r *http.Request, args apiChartRequest) error {
+	if args.Expires < ztime.Now().Unix() {
+		return guru.New(http.StatusForbidden, "signed URL has expired")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(args.Sig)
+	if err != nil {
+		return guru.New(http.StatusForbidden, "invalid signature")
+	}
+	// Creates the key if it doesn't exist yet, so needs the primary.
+	ctx := goatcounter.Primary(r.Context())
+	key, err := goatcounter.LoadChartKey(ctx)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, args.sign(key)) {
+		return guru.New(http.StatusForbidden, "invalid signature")
+	}
+
+	// Make sure the user still exists and has access.
+	var user goatcounter.User
+	err = user.ByID(ctx, args.UserID)
+	if zdb.ErrNoRows(err) {
+		return guru.New(http.StatusForbidden, "no access: the user who signed this URL no longer exists")
+	}
+	if err != nil {
+		return err
+	}
+	if err := chartAccess(user); err != nil {
+		return err
+	}
+
+	*r = *r.WithContext(goatcounter.WithUser(r.Context(), &user))
+	return nil
+}
+
+// GET /api/v0/stats/chart.svg stats
+// Get the total pageviews chart as an image.
+//
+// This renders the same chart with the same data as the "Totals" on the
+// dashboard. Use /api/v0/stats/chart.png to get a PNG image.
+//
+// This can be accessed without an API key with a signed URL; see POST
+// /api/v0/stats/chart/sign.
+//
+// Responses may be cached for five minutes.
+//
+// Query: apiChartRequest
+// Response 200 (image/svg+xml): {data}
+func (h api) chart(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("/api/v0/stats/*")
+	defer m.Done()
+
+	var args apiChartRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+
+	cache := "private"
+	if args.Sig != "" {
+		err := h.authSigned(r, args)
+		if err != nil {
+			return err
+		}
+		cache = "public"
+	} else {
+		err := h.auth(r, w, goatcounter.APIPermStats)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := newChart(r, args)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", cache+",max-age=300")
+	if strings.HasSuffix(r.URL.Path, ".png") {
+		w.Header().Set("Content-Type", "image/png")
+		return c.PNG(w)
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	return c.SVG(w)
+}
+
+// POST /api/v0/stats/chart/sign stats
+// Create a signed URL for the chart image.
+//
+// The signed URL can be used without an API key. It's valid until the expiry
+// time, or until the user who created it loses access to the site.
+//
+// Use DELETE /api/v0/stats/chart/sign to invalidate all existing signed URLs.
+//
+// Request body: apiChartRequest
+// Response 200: apiChartSignResponse
+func (h api) chartSign(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+	if err := chartAccess(*User(r.Context())); err != nil {
+		return err
+	}
+
+	var args apiChartRequest
+	if _, err := h.dec.Decode(r, &args); err != nil {
+		return err
+	}
+
+	var (
+		now     = ztime.Now()
+		expires = time.Unix(args.Expires, 0)
+	)
+	if args.Expires == 0 {
+		expires = now.Add(30 * 24 * time.Hour)
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	v.Range("expires", expires.Unix(), now.Unix(), now.Add(366*24*time.Hour).Unix())
+	validateChart(&v, args)
+	if v.HasErrors() {
+		return v
+	}
+
+	key, err := goatcounter.LoadChartKey(r.Context())
+	if err != nil {
+		return err
+	}
+
+	args.Expires, args.UserID = expires.Unix(), User(r.Context()).ID
+	q := args.values()
+	q.Set("sig", base64.RawURLEncoding.EncodeToString(args.sign(key)))
+
+	return zhttp.JSON(w, apiChartSignResponse{
+		URL:     Site(r.Context()).URL(r.Context()) + "/api/v0/stats/chart.svg?" + q.Encode(),
+		Expires: expires.UTC(),
+	})
+}
+
+// DELETE /api/v0/stats/chart/sign stats
+// Invalidate all signed chart URLs for this site.
+//
+// Response 200: {empty}
+func (h api) chartSignReset(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, w, goatcounter.APIPermStats)
+	if err != nil {
+		return err
+	}
+
+	err = goatcounter.ResetChartKey(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.String(w, respOK)
+}
+
+func validateChart(v *zvalidate.Validator, args apiChartRequest) {
+	if args.Width != 0 {
+		v.Range("width", int64(args.Width), 100, 2000)
+	}
+	if args.Height != 0 {
+		v.Range("height", int64(args.Height), 50, 1000)
+	}
+	if args.Style != "" {
+		v.Include("style", args.Style, []string{"light", "dark"})
+	}
+}
+
+type chartStyle struct {
+	bg, line, fill, future, text color.RGBA
+}
+
+// These are the same colours as the dashboard uses.
+var chartStyles = map[string]chartStyle{
+	"light": {
+		bg:     color.RGBA{0xff, 0xff, 0xff, 0xff},
+		line:   color.RGBA{0x9a, 0x15, 0xa4, 0xff},
+		fill:   color.RGBA{0xfd, 0xec, 0xfe, 0xff},
+		future: color.RGBA{0xdd, 0xdd, 0xdd, 0xff},
+		text:   color.RGBA{0x25, 0x25, 0x25, 0xff},
+	},
+	"dark": {
+		bg:     color.RGBA{0x0e, 0x10, 0x11, 0xff},
+		line:   color.RGBA{0x00, 0x39, 0x96, 0xff},
+		fill:   color.RGBA{0x00, 0x39, 0x96, 0xff},
+		future: color.RGBA{0x55, 0x55, 0x55, 0xff},
+		text:   color.RGBA{0xff, 0xff, 0xff, 0xff},
+	},
+}
+
+// chart is a rendered pageview chart.
+type chart struct {
+	width, height int
+	style         chartStyle
+	title         string
+	label         string
+	max           int
+	slots         int   // Number of hours or days in the range.
+	data          []int // Data up to now; may be shorter than slots.
+}
+
+const chartPad = 2
+
+func newChart(r *http.Request, args apiChartRequest) (chart, error) {
+	v := goatcounter.NewValidate(r.Context())
+	validateChart(&v, args)
+	if v.HasErrors() {
+		return chart{}, v
+	}
+	if args.Width == 0 {
+		args.Width = 800
+	}
+	if args.Height == 0 {
+		args.Height = 200
+	}
+	if args.Style == "" {
+		args.Style = "light"
+	}
+
+	var (
+		ctx  = r.Context()
+		user = goatcounter.MustGetUser(ctx)
+		tz   = user.Settings.Timezone.Loc()
+		now  = ztime.Now().In(tz)
+	)
+	if args.Start.IsZero() {
+		args.Start = ztime.AddPeriod(now, -7, ztime.Day)
+	}
+	if args.End.IsZero() {
+		args.End = now
+	}
+	var (
+		sy, sm, sd = args.Start.Date()
+		ey, em, ed = args.End.Date()
+		rng        = ztime.NewRange(time.Date(sy, sm, sd, 0, 0, 0, 0, tz)).
+				To(time.Date(ey, em, ed, 23, 59, 59, 0, tz)).UTC()
+	)
+	daily := args.Daily || rng.End.Sub(rng.Start).Hours()/24 >= DailyView
+
+	var filter []int64
+	if args.Filter != "" {
+		var err error
+		filter, err = goatcounter.PathFilter(ctx, args.Filter, true)
+		if err != nil {
+			return chart{}, err
+		}
+	}
+
+	c := chart{
+		width:  args.Width,
+		height: args.Height,
+		style:  chartStyles[args.Style],
+		title: fmt.Sprintf("%s: %s – %s", goatcounter.MustGetSite(ctx).Display(ctx),
+			rng.Start.In(tz).Format("2006-01-02"), rng.End.In(tz).Format("2006-01-02")),
+	}
+
+	var (
+		hl  goatcounter.HitList
+		err error
+	)
+	c.max, err = hl.Totals(ctx, rng, filter, daily, args.NoEvents)
+	if err != nil {
+		return chart{}, err
+	}
+	// The PNG font doesn't have a thin space.
+	c.label = strings.ReplaceAll(user.Settings.FormatNumber(c.max), "\u202f", " ")
+
+	// Don't draw anything in the future, but do include it in the width.
+	today, hour := now.Format("2006-01-02"), now.Hour()
+	for _, s := range hl.Stats {
+		if daily {
+			c.slots++
+		} else {
+			c.slots += 24
+		}
+		switch {
+		case s.Day > today:
+		case daily:
+			c.data = append(c.data, s.Daily)
+		case s.Day == today:
+			c.data = append(c.data, s.Hourly[:hour+1]...)
+		default:
+			c.data = append(c.data, s.Hourly...)
+		}
+	}
+	return c, nil
+}
+
+// x and y get the coordinates for a data point.
+func (c chart) x(i int) float64 {
+	return chartPad + float64(i)*float64(c.width-chartPad*2)/float64(max(c.slots-1, 1))
+}
+func (c chart) y(n int) float64 {
+	return float64(c.height-chartPad) - float64(n)*float64(c.height-chartPad*2)/float64(max(c.max, 1))
+}
+
+func svgColor(c color.RGBA) string { return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B) }
+
+func (c chart) SVG(w io.Writer) error {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="%[2]d" viewBox="0 0 %[1]d %[2]d">`+"\n",
+		c.width, c.height)
+	fmt.Fprintf(b, "<title>%s</title>\n", html.EscapeString(c.title))
+	fmt.Fprintf(b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", svgColor(c.style.bg))
+
+	if len(c.data) > 0 {
+		base := float64(c.height - chartPad)
+		points := make([]string, 0, len(c.data))
+		for i, n := range c.data {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", c.x(i), c.y(n)))
+		}
+		fmt.Fprintf(b, `<polygon points="%.1f,%.1f %s %.1f,%.1f" fill="%s"/>`+"\n",
+			c.x(0), base, strings.Join(points, " "), c.x(len(c.data)-1), base, svgColor(c.style.fill))
+		fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5" stroke-linejoin="round"/>`+"\n",
+			strings.Join(points, " "), svgColor(c.style.line))
+	}
+	if f := len(c.data); f < c.slots {
+		x := c.x(max(f-1, 0))
+		fmt.Fprintf(b, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s"/>`+"\n",
+			x, chartPad, c.x(c.slots-1)-x, c.height-chartPad*2, svgColor(c.style.future))
+	}
+
+	fmt.Fprintf(b, `<text x="4" y="14" font-family="sans-serif" font-size="11" fill="%s">%s</text>`+"\n",
+		svgColor(c.style.text), html.EscapeString(c.label))
+	b.WriteString("</svg>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var (
+	chartFontOnce sync.Once
+	chartFont     font.Face
+)
+
+func (c chart) PNG(w io.Writer) error {
+	chartFontOnce.Do(func() {
+		f, err := opentype.Parse(goregular.TTF)
+		if err != nil {
+			panic(err)
+		}
+		chartFont, err = opentype.NewFace(f, &opentype.FaceOptions{Size: 11, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	img := image.NewRGBA(image.Rect(0, 0, c.width, c.height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c.style.bg), image.Point{}, draw.Src)
+
+	if len(c.data) > 0 {
+		// Fill the area below the line, interpolating between the data points
+		// for every column of pixels.
+		base := c.height - chartPad
+		for px := int(c.x(0)); px <= int(c.x(len(c.data)-1)); px++ {
+			y := c.lineY(float64(px))
+			for py := int(math.Ceil(y)); py < base; py++ {
+				img.Set(px, py, c.style.fill)
+			}
+		}
+		for i := 1; i < len(c.data); i++ {
+			c.drawLine(img, c.x(i-1), c.y(c.data[i-1]), c.x(i), c.y(c.data[i]))
+		}
+		if len(c.data) == 1 {
+			c.drawLine(img, c.x(0), c.y(c.data[0]), c.x(0)+1, c.y(c.data[0]))
+		}
+	}
+	if f := len(c.data); f < c.slots {
+		r := image.Rect(int(c.x(max(f-1, 0))), chartPad, int(c.x(c.slots-1))+1, c.height-chartPad)
+		draw.Draw(img, r, image.NewUniform(c.style.future), image.Point{}, draw.Src)
+	}
+
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c.style.text),
+		Face: chartFont,
+		Dot:  fixed.P(4, 14),
+	}
+	d.DrawString(c.label)
+
+	return png.Encode(w, img)
+}
+
+// lineY gets the y coordinate of the line at this x coordinate.
+func (c chart) lineY(x float64) float64 {
+	step := float64(c.width-chartPad*2) / float64(max(c.slots-1, 1))
+	i := int((x - chartPad) / step)
+	if i >= len(c.data)-1 {
+		return c.y(c.data[len(c.data)-1])
+	}
+	f := (x - c.x(i)) / step
+	return c.y(c.data[i]) + f*(c.y(c.data[i+1])-c.y(c.data[i]))
+}
+
+// drawLine draws a line with a width of about 1.5 pixels.
+func (c chart) drawLine(img *image.RGBA, x1, y1, x2, y2 float64) {
+	steps := int(math.Max(math.Abs(x2-x1), math.Abs(y2-y1))*2) + 1
+	for s := 0; s <= steps; s++ {
+		f := float64(s) / float64(steps)
+		x, y := x1+f*(x2-x1), y1+f*(y2-y1)
+		img.Set(int(math.Round(x)), int(math.Round(y)), c.style.line)
+		img.Set(int(math.Round(x)), int(math.Round(y+.5)), c.style.line)
+	}
+}
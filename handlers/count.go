@@ -26,6 +26,7 @@ var gif = []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x1, 0x0, 0x1, 0x0, 0x80,
 func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 	m := metrics.Start("/count")
 	defer m.Done()
+	metrics.Count("goatcounter_count_requests_total", 1, "method", r.Method)
 
 	if r.Method == "GET" {
 		metrics.Start("/count GET").Done()
@@ -42,19 +43,24 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 	// https://github.com/golang/go/issues/16100
 	w.Header().Set("Connection", "close")
 
+	site := Site(r.Context())
 	bot := isbot.Bot(r)
 	// Don't track pages fetched with the browser's prefetch algorithm.
 	if bot == isbot.BotPrefetch {
+		w.Header().Add("X-Goatcounter", site.ClassifyBot(r.UserAgent(), r.RemoteAddr, bot, 0).String())
 		return zhttp.Bytes(w, gif)
 	}
 
-	site := Site(r.Context())
-	for _, ip := range site.Settings.IgnoreIPs {
-		if ip == r.RemoteAddr {
-			w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because %q is in the IP ignore list", ip))
-			w.WriteHeader(http.StatusAccepted)
-			return zhttp.Bytes(w, gif)
-		}
+	if site.DisabledAt != nil {
+		// 410 rather than 4xx: this isn't going to change by retrying.
+		w.Header().Add("X-Goatcounter", "rejected because counting for this site was disabled by the administrator")
+		w.WriteHeader(http.StatusGone)
+		return zhttp.Bytes(w, gif)
+	}
+	if site.OverQuota() {
+		w.Header().Add("X-Goatcounter", "rejected because the monthly pageview quota for this site is reached")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return zhttp.Bytes(w, gif)
 	}
 
 	hit := goatcounter.Hit{
@@ -63,22 +69,6 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 		CreatedAt:       ztime.Now(),
 		RemoteAddr:      r.RemoteAddr,
 	}
-	if site.Settings.Collect.Has(goatcounter.CollectLocation) {
-		var l goatcounter.Location
-		hit.Location = l.LookupIP(r.Context(), r.RemoteAddr)
-	}
-
-	if site.Settings.Collect.Has(goatcounter.CollectLanguage) {
-		tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
-		if len(tags) > 0 {
-			base, c := tags[0].Base()
-			if c == language.Exact || c == language.High {
-				l := base.ISO3()
-				hit.Language = &l
-			}
-		}
-	}
-
 	err := formam.NewDecoder(&formam.DecoderOptions{
 		TagName:           "json",
 		IgnoreUnknownKeys: true,
@@ -88,7 +78,7 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(400)
 		return zhttp.Bytes(w, gif)
 	}
-	if hit.Bot > 0 && hit.Bot < 150 {
+	if hit.Bot != 0 && !goatcounter.IsClientBot(hit.Bot) {
 		w.Header().Add("X-Goatcounter", fmt.Sprintf("wrong value: b=%d", hit.Bot))
 		w.WriteHeader(400)
 		return zhttp.Bytes(w, gif)
@@ -100,8 +90,24 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.Bytes(w, gif)
 	}
 
-	if isbot.Is(bot) { // Prefer the backend detection.
-		hit.Bot = int(bot)
+	cls := site.ClassifyBot(hit.UserAgentHeader, r.RemoteAddr, bot, hit.Bot)
+	if cls.Bot != 0 || cls.Label != "" {
+		w.Header().Add("X-Goatcounter", cls.String())
+	}
+	if !cls.Stored {
+		w.WriteHeader(http.StatusAccepted)
+		return zhttp.Bytes(w, gif)
+	}
+	hit.Bot, hit.UABlockRule, hit.Label = cls.Bot, cls.Rule, cls.Label
+
+	// Don't look up the location for blocked networks, as there may be a lot
+	// of them.
+	if site.Settings.Collect.Has(goatcounter.CollectLocation) && hit.Bot != goatcounter.BotIPBlock {
+		var l goatcounter.Location
+		hit.Location, hit.City = l.LookupIPCity(r.Context(), r.RemoteAddr)
+	}
+	if site.Settings.Collect.Has(goatcounter.CollectLanguage) {
+		hit.Language = acceptLanguage(r.Header.Get("Accept-Language"))
 	}
 
 	err = hit.Validate(r.Context(), true)
@@ -111,6 +117,30 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.Bytes(w, gif)
 	}
 
+	// Prerendered page that is now visible: count the earlier pageview rather
+	// than this one if it's still in the memstore.
+	if hit.Bot == 0 && goatcounter.Memstore.Visible(site.ID, hit.Prerender) {
+		w.Header().Add("X-Goatcounter", "upgraded prerendered pageview")
+		return zhttp.Bytes(w, gif)
+	}
+
 	goatcounter.Memstore.Append(hit)
 	return zhttp.Bytes(w, gif)
 }
+
+// acceptLanguage gets the base language of the preferred language in the
+// Accept-Language header ("pt-BR" is "pt"). The header is never stored as-is.
+//
+// Returns nil if there is no header or if it can't be parsed.
+func acceptLanguage(header string) *string {
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil || len(tags) == 0 {
+		return nil
+	}
+	base, c := tags[0].Base()
+	if c != language.Exact && c != language.High {
+		return nil
+	}
+	l := base.String()
+	return &l
+}
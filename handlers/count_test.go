@@ -6,8 +6,11 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
@@ -104,7 +107,28 @@ func TestBackendCount(t *testing.T) {
 			UserAgentHeader: "GoogleBot/1.0",
 		}},
 
+		{"webdriver", url.Values{"p": {"/a"}, "b": {"153"}}, nil, 200, goatcounter.Hit{
+			Path: "/a",
+			Bot:  goatcounter.BotClientWebDriver,
+		}},
+		{"puppeteer", url.Values{"p": {"/a"}, "b": {"154"}}, nil, 200, goatcounter.Hit{
+			Path: "/a",
+			Bot:  goatcounter.BotClientPuppeteer,
+		}},
+		{"headless", url.Values{"p": {"/a"}, "b": {"155"}}, nil, 200, goatcounter.Hit{
+			Path: "/a",
+			Bot:  goatcounter.BotClientHeadless,
+		}},
+		{"prerender", url.Values{"p": {"/a"}, "b": {"156"}, "pr": {"abc"}}, nil, 200, goatcounter.Hit{
+			Path: "/a",
+			Bot:  goatcounter.BotClientPrerender,
+		}},
+
 		{"bot", url.Values{"p": {"/a"}, "b": {"100"}}, nil, 400, goatcounter.Hit{}},
+		{"bot", url.Values{"p": {"/a"}, "b": {"1"}}, nil, 400, goatcounter.Hit{}},
+		{"bot", url.Values{"p": {"/a"}, "b": {"200"}}, nil, 400, goatcounter.Hit{}},
+		{"bot", url.Values{"p": {"/a"}, "b": {"-1"}}, nil, 400, goatcounter.Hit{}},
+		{"prerender too long", url.Values{"p": {"/a"}, "b": {"156"}, "pr": {strings.Repeat("a", 33)}}, nil, 400, goatcounter.Hit{}},
 
 		{"post", url.Values{"p": {"/foo.html"}}, func(r *http.Request) {
 			r.Method = "POST"
@@ -181,6 +205,245 @@ func TestBackendCount(t *testing.T) {
 	}
 }
 
+func TestBackendCountDisabled(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	var site goatcounter.Site
+	site.Defaults(ctx)
+	site.Settings.Collect.Set(goatcounter.CollectHits)
+	ctx = gctest.Site(ctx, t, &site, nil)
+
+	err := site.SetDisabled(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, rr := newTest(ctx, "GET", "/count?p=/foo", nil)
+	r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+	newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 410)
+	if h := rr.Header().Get("X-Goatcounter"); !strings.Contains(h, "disabled") {
+		t.Errorf("X-Goatcounter: %q", h)
+	}
+}
+
+func TestBackendCountUABlock(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	var site goatcounter.Site
+	site.Defaults(ctx)
+	site.Settings.Collect.Set(goatcounter.CollectHits)
+	site.Settings.UABlock.Scan("SyntheticMonitor\n/^acme-probe/")
+	ctx = gctest.Site(ctx, t, &site, nil)
+
+	for _, ua := range []string{
+		"Mozilla/5.0 (compatible; SyntheticMonitor/2.1)",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0",
+		"GoogleBot/1.0",
+	} {
+		r, rr := newTest(ctx, "GET", "/count?p=/a", nil)
+		r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+		r.Header.Set("User-Agent", ua)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		h := rr.Header().Get("X-Goatcounter")
+		if strings.Contains(ua, "SyntheticMonitor") &&
+			h != `flagged as bot because the User-Agent matches "SyntheticMonitor" in the User-Agent blocklist (b=100)` {
+			t.Errorf("X-Goatcounter: %q", h)
+		}
+	}
+
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[string]string)
+	for _, h := range hits {
+		have[h.UserAgentHeader] = fmt.Sprintf("%d %q", h.Bot, h.UABlockRule)
+	}
+	want := map[string]string{
+		"Mozilla/5.0 (compatible; SyntheticMonitor/2.1)":                         `100 "SyntheticMonitor"`,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0": `0 ""`,
+		"GoogleBot/1.0": fmt.Sprintf(`%d ""`, isbot.BotShort),
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+}
+
+func TestBackendCountBotData(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	tmp := filepath.Join(t.TempDir(), "botdata")
+	err := os.WriteFile(tmp, []byte("ua ^acme-crawler/\nip 192.0.2.0/24\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = goatcounter.InitBotData(ctx, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { goatcounter.InitBotData(ctx, "") })
+
+	var site goatcounter.Site
+	site.Defaults(ctx)
+	site.Settings.Collect.Set(goatcounter.CollectHits)
+	ctx = gctest.Site(ctx, t, &site, nil)
+
+	for i, tt := range []struct{ ua, ip string }{
+		{"acme-crawler/1.0", "127.0.0.1"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0", "192.0.2.1"},
+		{"GoogleBot/1.0", "192.0.2.1"}, // Built-in detection takes precedence.
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0", "127.0.0.1"},
+	} {
+		r, rr := newTest(ctx, "GET", fmt.Sprintf("/count?p=/%d", i), nil)
+		r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+		r.Header.Set("User-Agent", tt.ua)
+		r.RemoteAddr = tt.ip
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+	}
+
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[string]int)
+	for _, h := range hits {
+		have[h.Path] = h.Bot
+	}
+	want := map[string]int{
+		"/0": goatcounter.BotSupplement,
+		"/1": goatcounter.BotSupplement,
+		"/2": int(isbot.BotShort),
+		"/3": 0,
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+}
+
+func TestBackendCountPrerender(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	var site goatcounter.Site
+	site.Defaults(ctx)
+	site.Settings.Collect.Set(goatcounter.CollectHits)
+	ctx = gctest.Site(ctx, t, &site, nil)
+
+	count := func(query string) string {
+		t.Helper()
+		r, rr := newTest(ctx, "GET", "/count?"+query, nil)
+		r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+		return rr.Header().Get("X-Goatcounter")
+	}
+
+	count("p=/a&b=156&pr=aaa") // Prerendered and shown.
+	count("p=/b&b=156&pr=bbb") // Prerendered and never shown.
+	if h := count("p=/a&pr=aaa"); h != "upgraded prerendered pageview" {
+		t.Errorf("X-Goatcounter: %q", h)
+	}
+	// No prerendered pageview with this ID; count as a new pageview.
+	if h := count("p=/c&pr=ccc"); h != "" {
+		t.Errorf("X-Goatcounter: %q", h)
+	}
+
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[string]int)
+	for _, h := range hits {
+		have[h.Path] = h.Bot
+	}
+	want := map[string]int{"/a": 0, "/b": goatcounter.BotClientPrerender, "/c": 0}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+}
+
+func TestBackendCountIPBlock(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	var site goatcounter.Site
+	site.Defaults(ctx)
+	site.Settings.Collect.Set(goatcounter.CollectHits)
+	site.Settings.IPBlock.Scan("192.0.2.0/24\n2001:db8::/32")
+	ctx = gctest.Site(ctx, t, &site, nil)
+
+	for _, ip := range []string{"192.0.2.77", "2001:db8:1::1", "198.51.100.1"} {
+		r, rr := newTest(ctx, "GET", "/count?p=/a", nil)
+		r.RemoteAddr = ip
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+	}
+
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[string]int)
+	for _, h := range hits {
+		have[h.RemoteAddr] = h.Bot
+	}
+	want := map[string]int{"192.0.2.77": goatcounter.BotIPBlock, "2001:db8:1::1": goatcounter.BotIPBlock, "198.51.100.1": 0}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+}
+
+func TestBackendCountBotAllow(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	var site goatcounter.Site
+	site.Defaults(ctx)
+	site.Settings.Collect.Set(goatcounter.CollectHits)
+	site.Settings.IPBlock.Scan("192.0.2.0/24")
+	site.Settings.UABlock.Scan("BlockedBot")
+	site.Settings.BotAllow.Scan("Partner: PartnerBot\nMonitor: 198.51.100.0/24")
+	ctx = gctest.Site(ctx, t, &site, nil)
+
+	// Order is: blocklists > allowlist > bot detection.
+	for i, tt := range []struct{ ua, ip, query string }{
+		{"PartnerBot/1.0", "203.0.113.1", ""},
+		{"PartnerBot/1.0", "203.0.113.1", "&b=153"},
+		{"PartnerBot/1.0", "192.0.2.1", ""},
+		{"PartnerBot/1.0 BlockedBot/1.0", "203.0.113.1", ""},
+		{"curl/8.0", "198.51.100.1", ""},
+		{"curl/8.0", "203.0.113.1", ""},
+	} {
+		r, rr := newTest(ctx, "GET", fmt.Sprintf("/count?p=/%d%s", i, tt.query), nil)
+		r.Host = site.Code + "." + goatcounter.Config(ctx).Domain
+		r.Header.Set("User-Agent", tt.ua)
+		r.RemoteAddr = tt.ip
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+	}
+
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[string]string)
+	for _, h := range hits {
+		have[h.Path] = fmt.Sprintf("%d %q", h.Bot, h.Label)
+	}
+	want := map[string]string{
+		"/0": `0 "Partner"`,
+		"/1": `0 "Partner"`,
+		"/2": fmt.Sprintf(`%d ""`, goatcounter.BotIPBlock),
+		"/3": fmt.Sprintf(`%d ""`, goatcounter.BotUABlock),
+		"/4": `0 "Monitor"`,
+		"/5": fmt.Sprintf(`%d ""`, isbot.UserAgent("curl/8.0")),
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+}
+
 func TestBackendCountSessions(t *testing.T) {
 	now := time.Date(2019, 6, 18, 14, 42, 0, 0, time.UTC)
 	ztime.Now = func() time.Time { return now }
@@ -312,3 +575,32 @@ func TestBackendCountSessions(t *testing.T) {
 	want = []int{1, 1, 2, 3, 3, 1, 2, 1, 3, 4, 5}
 	checkSess(append(hits1, hits2...), want)
 }
+
+func TestAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"de", "de"},
+		{"pt-BR", "pt"},
+		{"fr-CH, fr;q=0.9, en;q=0.8", "fr"},
+		{"en;q=0.5, nl", "nl"},
+		{"en-GB;q=0.8, en-US;q=0.9, *;q=0.1", "en"},
+
+		{"*", ""},
+		{"garbage!!", ""},
+		{"en;q=xxx", ""},
+		{";;;,,,", ""},
+		{strings.Repeat("a", 1000), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have := ztype.Deref(acceptLanguage(tt.in), "")
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
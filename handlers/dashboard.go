@@ -6,21 +6,28 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 	"html/template"
 	"math"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/metrics"
 	"zgo.at/goatcounter/v2/widgets"
 	"zgo.at/guru"
+	"zgo.at/isbot"
 	"zgo.at/z18n"
+	"zgo.at/zdb"
 	"zgo.at/zhttp"
+	"zgo.at/zhttp/header"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zsync"
@@ -57,7 +64,7 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		zhttp.FlashError(w, err.Error())
 	}
 	if rng.Start.IsZero() || rng.End.IsZero() {
-		rng = timeRange(view.Period, user.Settings.Timezone.Loc(), bool(user.Settings.SundayStartsWeek))
+		rng = timeRange(view.Period, user.Settings.Timezone.Loc(), user.Settings)
 		if err != nil {
 			return err
 		}
@@ -66,14 +73,29 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	showRefs, _ := strconv.ParseInt(q.Get("showrefs"), 10, 64)
+	if user.ID == 0 && !site.Settings.PublicWidget("toprefs") {
+		showRefs = 0
+	}
+	remember := user.ID > 0 && user.Settings.RememberFilter
 	if _, ok := q["filter"]; ok {
 		view.Filter = q.Get("filter")
+		if remember {
+			setFilterCookie(w, view.Filter)
+		}
+	} else if f, ok := filterCookie(r); ok && remember {
+		view.Filter = f
+	}
+	shareFilter := false
+	if l := goatcounter.GetShareLink(r.Context()); l != nil && l.Filter != "" {
+		view.Filter, shareFilter = l.Filter, true
 	}
 	if _, ok := q["daily"]; ok {
 		view.Daily = q.Get("daily") == "on" || q.Get("daily") == "true"
 	}
 	_, forcedDaily := getDaily(r, rng)
-	if forcedDaily {
+	groupSel := selectedGroup(r, view.Group)
+	group := getGroup(r.Context(), groupSel, rng)
+	if forcedDaily || group != "" {
 		view.Daily = true
 	}
 
@@ -94,7 +116,7 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 			err error
 		)
 		if view.Filter != "" {
-			f, err = goatcounter.PathFilter(r.Context(), view.Filter, true)
+			f, err = goatcounter.PathFilter(goatcounter.ReadOnly(r.Context()), view.Filter, true)
 		}
 		pathFilter <- struct {
 			Paths []int64
@@ -118,6 +140,7 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		Daily:       view.Daily,
 		ForcedDaily: forcedDaily,
 		ShowRefs:    showRefs,
+		Group:       group,
 	}
 
 	f := <-pathFilter
@@ -128,6 +151,20 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 
 	// Load widgets data from the database.
 	wid := widgets.FromSiteWidgets(r.Context(), user.Settings.Widgets, 0)
+	if user.ID == 0 {
+		wid = slices.DeleteFunc(wid, func(w widgets.Widget) bool { return !site.Settings.PublicWidget(w.Name()) })
+	}
+	// Status codes are only known for logfile imports, so don't show an empty
+	// widget for everyone else.
+	if len(wid.Get("statuscodes")) > 0 {
+		has, err := goatcounter.HasStatusStats(r.Context())
+		if err != nil {
+			return err
+		}
+		if !has {
+			wid = slices.DeleteFunc(wid, func(w widgets.Widget) bool { return w.Name() == "statuscodes" })
+		}
+	}
 	shared := widgets.SharedData{Args: args, Site: site, User: user}
 
 	for _, w := range wid.Get("totalpages") {
@@ -146,15 +183,20 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		defer m.Done()
 
 		// Create context for every goroutine, so we know which timed out.
-		ctx, cancel := context.WithTimeout(goatcounter.CopyContextValues(r.Context()),
+		ctx, cancel := context.WithTimeout(goatcounter.ReadOnly(goatcounter.CopyContextValues(r.Context())),
 			time.Duration(h.dashTimeout)*time.Second)
 		defer cancel()
+		ctx = goatcounter.WithQueryCaller(ctx, "dashboard:"+w.Name())
 
 		l := zlog.Module("dashboard")
 		_, err := w.GetData(ctx, args)
 		if err != nil {
-			l.FieldsRequest(r).Error(err)
-			_, err = zhttp.UserError(err)
+			if errors.As(err, new(*goatcounter.QueryTimeoutError)) {
+				l.FieldsRequest(r).Printf("%s: %s", w.Name(), err)
+			} else {
+				l.FieldsRequest(r).Error(err)
+				_, err = zhttp.UserError(err)
+			}
 			w.SetErr(err)
 		}
 		l.Since(w.Name())
@@ -190,6 +232,8 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 	// Set shared params.
 	tc := wid.GetOne("totalcount").(*widgets.TotalCount)
 	shared.Total, shared.TotalUTC, shared.TotalEvents = tc.Total, tc.TotalUTC, tc.TotalEvents
+	shared.Sessions, shared.Bounces, shared.Pageviews, shared.Duration = tc.Sessions, tc.Bounces, tc.Pageviews, tc.Duration
+	shared.Visitors = tc.Visitors
 
 	// Render widget templates.
 	func() {
@@ -268,24 +312,27 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.Template(w, "dashboard.gohtml", struct {
 		Globals
 		CountDomain string
-		SubSites    []string
+		SubSites    goatcounter.SubSites
 		ShowRefs    int64
 		Period      ztime.Range
 		PathFilter  []int64
 		ForcedDaily bool
+		ShareFilter bool
+		ShareLink   bool
+		Group       string
 		Widgets     widgets.List
 		View        goatcounter.View
 		Total       int
 		TotalUTC    int
 		ConnectID   zint.Uint128
 	}{newGlobals(w, r), cd, subs, showRefs, rng,
-		args.PathFilter, forcedDaily, wid, view, shared.Total, shared.TotalUTC,
+		args.PathFilter, forcedDaily, shareFilter, goatcounter.GetShareLink(r.Context()) != nil, groupSel, wid, view, shared.Total, shared.TotalUTC,
 		connectID})
 }
 
 func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
-	user := User(r.Context())
-	rng, err := getPeriod(w, r, Site(r.Context()), user)
+	site, user := Site(r.Context()), User(r.Context())
+	rng, err := getPeriod(w, r, site, user)
 	if err != nil {
 		return err
 	}
@@ -298,13 +345,23 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 		offset     = int(v.Integer("offset", r.URL.Query().Get("offset")))
 		pathFilter = getPathFilter(&v, r)
 	)
+	v.Range("widget", int64(widget), 0, int64(len(user.Settings.Widgets)-1))
 	if v.HasErrors() {
 		return v
 	}
+	view, _ := user.Settings.Views.Get("default")
+
+	// Widgets are loaded by index, so make sure people can't load hidden ones.
+	if user.ID == 0 {
+		n := user.Settings.Widgets[widget].Name()
+		if !site.Settings.PublicWidget(n) || (n == "pages" && key != "" && !site.Settings.PublicWidget("toprefs")) {
+			return guru.New(http.StatusForbidden, T(r.Context(), "error/widget-not-public|This widget isn’t available on the public dashboard"))
+		}
+	}
 
 	args := widgets.SharedData{
-		Site:     Site(r.Context()),
-		User:     User(r.Context()),
+		Site:     site,
+		User:     user,
 		TotalUTC: total,
 		Total:    total,
 		RowsOnly: key != "" || offset > 0,
@@ -312,6 +369,7 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 			Rng:        rng,
 			PathFilter: pathFilter,
 			Offset:     offset,
+			Group:      getGroup(r.Context(), selectedGroup(r, view.Group), rng),
 		},
 	}
 
@@ -329,6 +387,7 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 
 		args.RowsOnly = true
 		args.Args.Daily, args.Args.ForcedDaily = getDaily(r, rng)
+		args.Args.Daily = args.Args.Daily || args.Args.Group != ""
 
 		if key != "" {
 			p.RefsForPath, _ = strconv.ParseInt(key, 10, 64)
@@ -337,16 +396,17 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 			if err != nil {
 				return err
 			}
-			p.Exclude, err = zint.Split(r.URL.Query().Get("exclude"), ",")
-			if err != nil {
-				return err
-			}
+			p.After = r.URL.Query().Get("after")
 		}
 	}
 
-	ret["more"], err = wid.GetData(r.Context(), args.Args)
+	ctx := goatcounter.WithQueryCaller(goatcounter.ReadOnly(r.Context()), "dashboard:"+wid.Name())
+	ret["more"], err = wid.GetData(ctx, args.Args)
 	if err != nil {
-		return err
+		if !errors.As(err, new(*goatcounter.QueryTimeoutError)) {
+			return err
+		}
+		wid.SetErr(err)
 	}
 	ret["html"], err = ztpl.ExecuteString(wid.RenderHTML(r.Context(), args))
 	if err != nil {
@@ -357,11 +417,253 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 		p := wid.(*widgets.Pages)
 		ret["total_display"] = p.Display
 		ret["max"] = p.Max
+		ret["after"] = p.Pages.Cursor(p.Sort)
 	}
 
 	return zhttp.JSON(w, ret)
 }
 
+// Download all data for a widget as CSV, for the selected period and filter.
+func (h backend) widgetCSV(w http.ResponseWriter, r *http.Request) error {
+	// Share links only give access to view the dashboard, not to export data.
+	if goatcounter.GetShareLink(r.Context()) != nil {
+		return guru.New(http.StatusForbidden, T(r.Context(), "error/share-link-csv|Data can’t be downloaded with a share link"))
+	}
+
+	site, user := Site(r.Context()), User(r.Context())
+	rng, err := getPeriod(w, r, site, user)
+	if err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	var (
+		widget     = int(v.Integer("widget", r.URL.Query().Get("widget")))
+		pathFilter = getPathFilter(&v, r)
+	)
+	v.Range("widget", int64(widget), 0, int64(len(user.Settings.Widgets)-1))
+	if v.HasErrors() {
+		return v
+	}
+
+	n := user.Settings.Widgets[widget].Name()
+	if user.ID == 0 && !site.Settings.PublicWidget(n) {
+		return guru.New(http.StatusForbidden, T(r.Context(), "error/widget-not-public|This widget isn’t available on the public dashboard"))
+	}
+
+	wid := widgets.FromSiteWidget(r.Context(), user.Settings.Widgets[widget])
+	if !widgets.CanCSV(wid) {
+		return guru.Errorf(http.StatusBadRequest, "can't download %q as CSV", n)
+	}
+
+	loc := user.Settings.Timezone.Loc()
+	err = header.SetContentDisposition(w.Header(), header.DispositionArgs{
+		Type: header.TypeAttachment,
+		Filename: fmt.Sprintf("goatcounter-%s-%s-%s-%s.csv", site.Code, n,
+			rng.Start.In(loc).Format("2006-01-02"), rng.End.In(loc).Format("2006-01-02")),
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+
+	return widgets.CSV(goatcounter.ReadOnly(r.Context()), wid, widgets.Args{Rng: rng, PathFilter: pathFilter}, w)
+}
+
+// Detail page for a single path, with the referrers, locations, browsers, and
+// events for just this path.
+func (h backend) pathDetail(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("path")
+	m.AddTag(r.Host)
+	defer m.Done()
+
+	site, user := Site(r.Context()), User(r.Context())
+	if user.ID == 0 && !site.Settings.PublicWidget("pages") {
+		return guru.New(http.StatusForbidden, T(r.Context(), "error/path-not-public|This page isn’t available on the public dashboard"))
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var path goatcounter.Path
+	err := path.ByID(r.Context(), id)
+	if zdb.ErrNoRows(err) {
+		return guru.New(http.StatusNotFound, T(r.Context(), "error/path-not-found|No such path"))
+	}
+	if err != nil {
+		return err
+	}
+	// Share links with a filter can only see the paths matching that filter.
+	if l := goatcounter.GetShareLink(r.Context()); l != nil && l.Filter != "" {
+		f, err := goatcounter.PathFilter(r.Context(), l.Filter, true)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(f, path.ID) {
+			return guru.New(http.StatusNotFound, T(r.Context(), "error/path-not-found|No such path"))
+		}
+	}
+
+	view, _ := user.Settings.Views.Get("default")
+	rng, err := getPeriod(w, r, site, user)
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+	}
+	if rng.Start.IsZero() || rng.End.IsZero() {
+		rng = timeRange(view.Period, user.Settings.Timezone.Loc(), user.Settings)
+	}
+	daily, forcedDaily := getDaily(r, rng)
+	group := getGroup(r.Context(), selectedGroup(r, view.Group), rng)
+	if group != "" {
+		daily = true
+	}
+
+	var (
+		pathFilter = []int64{path.ID}
+		public     = func(name string) bool { return user.ID > 0 || site.Settings.PublicWidget(name) }
+
+		pages                             goatcounter.HitLists
+		refs, locations, browsers, events goatcounter.HitStats
+	)
+
+	// Load everything in parallel.
+	var (
+		wg   sync.WaitGroup
+		errs = errors.NewGroup(5)
+	)
+	run := func(f func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer zlog.Recover(func(l zlog.Log) zlog.Log { return l.Field("path", path.ID).FieldsRequest(r) })
+			defer wg.Done()
+			errs.Append(f(goatcounter.CopyContextValues(r.Context())))
+		}()
+	}
+	run(func(ctx context.Context) error {
+		_, _, err := pages.List(ctx, rng, pathFilter, goatcounter.HitListOpts{}, 1, daily)
+		return err
+	})
+	if public("toprefs") {
+		run(func(ctx context.Context) error { return refs.ListRefsByPathID(ctx, path.ID, rng, 10, 0) })
+	}
+	if public("locations") {
+		run(func(ctx context.Context) error { return locations.ListLocations(ctx, rng, pathFilter, 10, 0) })
+	}
+	if public("browsers") {
+		run(func(ctx context.Context) error { return browsers.ListBrowsers(ctx, rng, pathFilter, 10, 0) })
+	}
+	// The events are from the raw pageviews, which may have been removed or
+	// anonymized while the stats are kept.
+	rawCutoff := site.Settings.RawDataCutoff(r.Context())
+	if rawCutoff != nil && (!site.Settings.KeepsStats() || !rng.Start.Before(*rawCutoff)) {
+		rawCutoff = nil
+	}
+	rawGone := rawCutoff != nil && !rng.End.After(*rawCutoff)
+	if !path.Event && site.Settings.Collect.Has(goatcounter.CollectSession) && !rawGone {
+		run(func(ctx context.Context) error { return events.ListEventsByPathID(ctx, path.ID, rng, 10, 0) })
+	}
+	wg.Wait()
+	if err := errs.ErrorOrNil(); err != nil {
+		return err
+	}
+
+	var page goatcounter.HitList
+	if len(pages) > 0 {
+		pages.Group(group, user.Settings.WeekStart())
+		page = pages[0]
+	}
+	var eventsTotal int
+	for _, e := range events.Stats {
+		eventsTotal += e.Count
+	}
+
+	return zhttp.Template(w, "path.gohtml", struct {
+		Globals
+		Path        goatcounter.Path
+		Page        goatcounter.HitList
+		Period      ztime.Range
+		Daily       bool
+		ForcedDaily bool
+		Group       string
+		Refs        goatcounter.HitStats
+		Locations   goatcounter.HitStats
+		Browsers    goatcounter.HitStats
+		Events      goatcounter.HitStats
+		EventsTotal int
+		RawCutoff   *time.Time
+		RawGone     bool
+		ShowRefs    bool
+		ShowLocs    bool
+		ShowBrowser bool
+	}{newGlobals(w, r), path, page, rng.In(user.Settings.Timezone.Loc()), daily, forcedDaily,
+		r.URL.Query().Get("group"), refs, locations, browsers, events, eventsTotal, rawCutoff, rawGone,
+		public("toprefs"), public("locations"), public("browsers")})
+}
+
+// Overview of the recent traffic for all sites in this account.
+func (h backend) overview(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("overview")
+	m.AddTag(r.Host)
+	defer m.Done()
+
+	var sites goatcounter.SiteOverviews
+	err := sites.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	tags := sites.TagSummary()
+	tag := r.URL.Query().Get("tag")
+	if tag != "" {
+		sites = sites.Tagged(tag)
+	}
+
+	return zhttp.Template(w, "overview.gohtml", struct {
+		Globals
+		Sites goatcounter.SiteOverviews
+		Days  int
+		Tags  []goatcounter.TagCount
+		Tag   string
+	}{newGlobals(w, r), sites, goatcounter.OverviewDays, tags, tag})
+}
+
+func (h backend) bots(w http.ResponseWriter, r *http.Request) error {
+	m := metrics.Start("bots")
+	m.AddTag(r.Host)
+	defer m.Done()
+
+	var (
+		site = Site(r.Context())
+		days = site.Settings.EffectiveBotRetention(r.Context())
+		rng  = ztime.NewRange(ztime.AddPeriod(ztime.Now(), -days, ztime.Day)).To(ztime.Now())
+	)
+	var stats goatcounter.BotStats
+	err := stats.List(r.Context(), rng, 20)
+	if err != nil {
+		return err
+	}
+
+	// Classify the current browser, or the User-Agent and IP from the form.
+	ua, ip := r.URL.Query().Get("ua"), r.URL.Query().Get("ip")
+	if ua == "" && ip == "" {
+		ua, ip = r.UserAgent(), r.RemoteAddr
+	}
+
+	return zhttp.Template(w, "bots.gohtml", struct {
+		Globals
+		Stats      goatcounter.BotStats
+		Days       int
+		UserAgents bool
+		ClassifyUA string
+		ClassifyIP string
+		Classify   goatcounter.BotReason
+	}{newGlobals(w, r), stats, days, site.Settings.Collect.Has(goatcounter.CollectUserAgent),
+		ua, ip, site.ClassifyBot(ua, ip, isbot.UserAgent(ua), 0)})
+}
+
 // Get a time range; the return value is always in UTC, and is the UTC day range
 // corresponding to the given timezone.
 //
@@ -379,16 +681,17 @@ func (h backend) loadWidget(w http.ResponseWriter, r *http.Request) error {
 //
 //	Any digit
 //	   Last n days.
-func timeRange(r string, tz *time.Location, sundayStartsWeek bool) ztime.Range {
+func timeRange(r string, tz *time.Location, settings goatcounter.UserSettings) ztime.Range {
 	rng := ztime.NewRange(ztime.Now().In(tz)).Current(ztime.Day)
 	switch r {
 	case "0", "day":
 	case "week-cur":
-		rng = rng.Current(ztime.Week(sundayStartsWeek))
+		rng = ztime.NewRange(settings.StartOfWeek(rng.Start)).
+			To(settings.StartOfWeek(rng.End).AddDate(0, 0, 6))
 	case "month-cur":
 		rng = rng.Current(ztime.Month)
 	case "week":
-		rng = rng.Last(ztime.Week(sundayStartsWeek))
+		rng = rng.Last(ztime.Week(settings.WeekStart() == time.Sunday))
 	case "month":
 		rng = rng.Last(ztime.Month)
 	case "quarter":
@@ -404,7 +707,7 @@ func timeRange(r string, tz *time.Location, sundayStartsWeek bool) ztime.Range {
 		days, err := strconv.ParseFloat(r, 32)
 		if err != nil {
 			zlog.Field("rng", r).Error(errors.Errorf("timeRange: %w", err))
-			return timeRange("week", tz, sundayStartsWeek)
+			return timeRange("week", tz, settings)
 		}
 		rng.Start = ztime.AddPeriod(rng.Start, -int(math.Round(days)), ztime.Day)
 	}
@@ -443,12 +746,91 @@ func getDaily(r *http.Request, rng ztime.Range) (daily bool, forced bool) {
 	if rng.End.Sub(rng.Start).Hours()/24 >= DailyView {
 		return true, true
 	}
+	// There are no hourly stats for older periods if the stats are downsampled.
+	if d, _ := Site(r.Context()).Settings.DownsampleCutoffs(r.Context()); d != nil && rng.Start.Before(*d) {
+		return true, true
+	}
 	d := strings.ToLower(r.URL.Query().Get("daily"))
 	return d == "on" || d == "true", false
 }
 
+// WeeklyView and MonthlyView group the charts by week or month if the number of
+// selected days is larger than this, unless overridden with the "group"
+// parameter.
+const (
+	WeeklyView  = 366
+	MonthlyView = 366 * 3
+)
+
+// selectedGroup gets the selected grouping from the "group" parameter, or def if
+// there is no such parameter. An empty "group" parameter selects the automatic
+// grouping, even if def is set.
+func selectedGroup(r *http.Request, def string) string {
+	if g, ok := r.URL.Query()["group"]; ok && len(g) > 0 {
+		return g[0]
+	}
+	return def
+}
+
+// getGroup gets how to group the charts: by week, by month, or "" for the
+// regular hourly or daily view.
+//
+// This is always by month for periods where the stats were downsampled per
+// month.
+func getGroup(ctx context.Context, sel string, rng ztime.Range) string {
+	if _, m := Site(ctx).Settings.DownsampleCutoffs(ctx); m != nil && rng.Start.Before(*m) {
+		return goatcounter.GroupMonth
+	}
+
+	switch g := sel; g {
+	case "day":
+		return ""
+	case goatcounter.GroupWeek, goatcounter.GroupMonth:
+		return g
+	}
+
+	switch days := rng.End.Sub(rng.Start).Hours() / 24; {
+	case days >= MonthlyView:
+		return goatcounter.GroupMonth
+	case days >= WeeklyView:
+		return goatcounter.GroupWeek
+	}
+	return ""
+}
+
+// setFilterCookie remembers the last-used path filter. Cookies are set for the
+// current domain only, so this is remembered for every site separately.
+func setFilterCookie(w http.ResponseWriter, f string) {
+	c := &http.Cookie{
+		Name:     "filter",
+		Value:    url.QueryEscape(f),
+		Path:     "/",
+		MaxAge:   86400 * 365,
+		HttpOnly: true,
+		Secure:   zhttp.CookieSecure,
+		SameSite: zhttp.CookieSameSite,
+	}
+	if f == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// filterCookie gets the path filter remembered with setFilterCookie.
+func filterCookie(r *http.Request) (string, bool) {
+	c, err := r.Cookie("filter")
+	if err != nil {
+		return "", false
+	}
+	f, err := url.QueryUnescape(c.Value)
+	return f, err == nil
+}
+
 func getPathFilter(v *zvalidate.Validator, r *http.Request) []int64 {
 	f := r.URL.Query().Get("filter")
+	if l := goatcounter.GetShareLink(r.Context()); l != nil && l.Filter != "" {
+		f = l.Filter
+	}
 	if f == "" {
 		return nil
 	}
@@ -5,10 +5,19 @@
 package handlers
 
 import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
 	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
 )
 
 func TestDashboard(t *testing.T) {
@@ -27,6 +36,197 @@ func TestDashboard(t *testing.T) {
 	}
 }
 
+func TestDashboardDefaults(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	user := goatcounter.MustGetUser(ctx)
+	user.Settings.Views = goatcounter.Views{{Name: "default", Period: "30", Group: "week", Filter: "/saved"}}
+	user.Settings.RememberFilter = true
+	err := user.Update(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, path, cookie string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, rr := newTest(ctx, "GET", path, nil)
+		login(t, r)
+		if cookie != "" {
+			r.Header.Set("Cookie", r.Header.Get("Cookie")+"; "+cookie)
+		}
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+		return rr
+	}
+	want := func(t *testing.T, rr *httptest.ResponseRecorder, want ...string) {
+		t.Helper()
+		for _, w := range want {
+			if !strings.Contains(rr.Body.String(), w) {
+				t.Errorf("body doesn't contain %q", w)
+			}
+		}
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		rr := get(t, "/", "")
+		want(t, rr, `class="period-30"`, `value="week" selected`, `id="filter-paths"`, `value="/saved"`)
+	})
+
+	t.Run("query wins", func(t *testing.T) {
+		day := ztime.Now().Format("2006-01-02")
+		rr := get(t, "/?group=&filter=/q&period-start="+day+"&period-end="+day, "")
+		want(t, rr, `class="period-"`, `value="" selected`, `value="/q"`)
+		if c := rr.Header().Get("Set-Cookie"); !strings.Contains(c, "filter=%2Fq") {
+			t.Errorf("filter not remembered: %q", c)
+		}
+	})
+
+	t.Run("remembered filter", func(t *testing.T) {
+		want(t, get(t, "/", "filter=%2Fremembered"), `value="/remembered"`)
+		want(t, get(t, "/?filter=/q", "filter=%2Fremembered"), `value="/q"`)
+	})
+}
+
+func TestPathDetail(t *testing.T) {
+	setup := func(ctx context.Context, t *testing.T) {
+		gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/a", Ref: "https://example.org"})
+	}
+	tests := []handlerTest{
+		{
+			name:     "path",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/path/1",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "example.org",
+		},
+		{
+			name:     "not-found",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/path/42",
+			auth:     true,
+			wantCode: 404,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+
+	t.Run("share link", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		setup(ctx, t)
+
+		l := goatcounter.ShareLink{Name: "test", Filter: "/b"}
+		err := l.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, rr := newTest(goatcounter.WithUser(ctx, &goatcounter.User{}), "GET", "/path/1", nil)
+		r.Header.Set("Cookie", "share-token="+l.Token)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 404)
+	})
+}
+
+func TestWidgetCSV(t *testing.T) {
+	setup := func(ctx context.Context, t *testing.T) {
+		gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/a", Ref: "https://example.org", FirstVisit: true})
+	}
+	period := fmt.Sprintf("period-start=%s&period-end=%[1]s", ztime.Now().Format("2006-01-02"))
+
+	tests := []handlerTest{
+		{
+			name:     "pages",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/load-widget/csv?widget=0&" + period,
+			auth:     true,
+			wantCode: 200,
+			wantBody: "path,title,event,visitors,pageviews\n/a,,false,1,1\n",
+		},
+		{
+			name:     "toprefs",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/load-widget/csv?widget=2&" + period,
+			auth:     true,
+			wantCode: 200,
+			wantBody: "name,visitors\nexample.org,1\n",
+		},
+		{
+			name:     "totalpages",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/load-widget/csv?widget=1&" + period,
+			auth:     true,
+			wantCode: 400,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
+func TestOverview(t *testing.T) {
+	tests := []handlerTest{
+		{
+			name: "overview",
+			setup: func(ctx context.Context, t *testing.T) {
+				s := goatcounter.Site{Code: "other", Cname: ztype.Ptr("other.example.com"), Parent: ztype.Ptr(int64(1))}
+				err := s.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gctest.StoreHits(ctx, t, false, goatcounter.Hit{Path: "/a", FirstVisit: true})
+			},
+			router:   newBackend,
+			path:     "/overview",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "//other.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
+func TestBots(t *testing.T) {
+	tests := []handlerTest{
+		{
+			name: "bots",
+			setup: func(ctx context.Context, t *testing.T) {
+				gctest.StoreHits(ctx, t, false,
+					goatcounter.Hit{Path: "/a", Bot: 5, UserAgentHeader: "Googlebot/2.1"},
+					goatcounter.Hit{Path: "/b", FirstVisit: true})
+			},
+			router:   newBackend,
+			path:     "/bots",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<code>Googlebot/2.1</code>",
+		},
+		{
+			name:     "classify",
+			router:   newBackend,
+			path:     "/bots?ua=Googlebot/2.1&ip=192.0.2.1",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "flagged as bot by the User-Agent or headers",
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
 func TestTimeRange(t *testing.T) {
 	tests := []struct {
 		rng, now, wantStart, wantEnd string
@@ -42,7 +242,6 @@ func TestTimeRange(t *testing.T) {
 		{"year", "2020-01-18",
 			"2019-01-18 00:00:00", "2020-01-18 23:59:59"},
 
-		// TODO: also test with sundayStartsWeek
 		{"week-cur", "2020-01-01",
 			"2019-12-30 00:00:00", "2020-01-05 23:59:59"},
 
@@ -64,7 +263,7 @@ func TestTimeRange(t *testing.T) {
 			ztime.SetNow(t, tt.now)
 
 			t.Run("UTC", func(t *testing.T) {
-				rng := timeRange(tt.rng, time.UTC, false)
+				rng := timeRange(tt.rng, time.UTC, goatcounter.UserSettings{FirstDayOfWeek: "monday"})
 				gotStart := rng.Start.Format("2006-01-02 15:04:05")
 				gotEnd := rng.End.Format("2006-01-02 15:04:05")
 
@@ -79,3 +278,161 @@ func TestTimeRange(t *testing.T) {
 		})
 	}
 }
+
+func TestTimeRangeWeekStart(t *testing.T) {
+	tests := []struct {
+		weekStart, now, wantStart, wantEnd string
+	}{
+		{"monday", "2020-01-01", "2019-12-30 00:00:00", "2020-01-05 23:59:59"},
+		{"sunday", "2020-01-01", "2019-12-29 00:00:00", "2020-01-04 23:59:59"},
+		{"saturday", "2020-01-01", "2019-12-28 00:00:00", "2020-01-03 23:59:59"},
+
+		{"monday", "2020-02-01", "2020-01-27 00:00:00", "2020-02-02 23:59:59"},
+		{"sunday", "2020-02-01", "2020-01-26 00:00:00", "2020-02-01 23:59:59"},
+		{"saturday", "2020-02-01", "2020-02-01 00:00:00", "2020-02-07 23:59:59"},
+
+		{"monday", "2020-03-01", "2020-02-24 00:00:00", "2020-03-01 23:59:59"},
+		{"sunday", "2020-03-01", "2020-03-01 00:00:00", "2020-03-07 23:59:59"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.weekStart+"-"+tt.now, func(t *testing.T) {
+			ztime.SetNow(t, tt.now)
+
+			rng := timeRange("week-cur", time.UTC, goatcounter.UserSettings{FirstDayOfWeek: tt.weekStart})
+			gotStart := rng.Start.Format("2006-01-02 15:04:05")
+			gotEnd := rng.End.Format("2006-01-02 15:04:05")
+			if gotStart != tt.wantStart || gotEnd != tt.wantEnd {
+				t.Errorf("\ngot:  %q, %q\nwant: %q, %q",
+					gotStart, gotEnd, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestDashboardPublicWidgets(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := Site(ctx)
+	site.Settings.Public = "public"
+	site.Settings.PublicWidgets = goatcounter.Strings{"pages", "totalpages"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not logged in.
+	ctx = goatcounter.WithUser(ctx, &goatcounter.User{})
+
+	t.Run("dashboard", func(t *testing.T) {
+		r, rr := newTest(ctx, "GET", "/", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		b := rr.Body.String()
+		if !strings.Contains(b, `<div class="totals"`) {
+			t.Error("totals not in body")
+		}
+		if strings.Contains(b, `<div class="hchart"`) {
+			t.Error("hchart widgets in body")
+		}
+	})
+
+	t.Run("load-widget", func(t *testing.T) {
+		for i, w := range site.UserDefaults.Widgets {
+			want := 403
+			if w.Name() == "pages" || w.Name() == "totalpages" {
+				want = 200
+			}
+			t.Run(w.Name(), func(t *testing.T) {
+				r, rr := newTest(ctx, "GET", fmt.Sprintf(
+					"/load-widget?widget=%d&total=0&offset=0&max=0&period-start=2020-06-01&period-end=2020-06-18", i), nil)
+				newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+				ztest.Code(t, rr, want)
+			})
+		}
+
+		// Referrers for a path are part of the pages widget.
+		r, rr := newTest(ctx, "GET",
+			"/load-widget?widget=0&key=1&total=0&offset=0&period-start=2020-06-01&period-end=2020-06-18", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 403)
+	})
+}
+
+func TestDashboardShareLink(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	l := goatcounter.ShareLink{Name: "test", Filter: "/a"}
+	err := l.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not logged in.
+	ctx = goatcounter.WithUser(ctx, &goatcounter.User{})
+
+	t.Run("no link", func(t *testing.T) {
+		r, rr := newTest(ctx, "GET", "/", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if rr.Code == 200 {
+			t.Error("can access dashboard without share link")
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		r, rr := newTest(ctx, "GET", "/?share="+l.Token, nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		if c := rr.Header().Get("Set-Cookie"); !strings.Contains(c, "share-token="+l.Token) {
+			t.Errorf("cookie not set: %q", c)
+		}
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		r, rr := newTest(ctx, "GET", "/", nil)
+		r.Header.Set("Cookie", "share-token="+l.Token)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+		if !strings.Contains(rr.Body.String(), `value="/a"`) {
+			t.Error("filter not set")
+		}
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		r, rr := newTest(ctx, "GET", "/settings/main", nil)
+		r.Header.Set("Cookie", "share-token="+l.Token)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		if rr.Code == 200 {
+			t.Error("can access settings with share link")
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		gctest.StoreHits(ctx, t, false,
+			goatcounter.Hit{Path: "/a", FirstVisit: true},
+			goatcounter.Hit{Path: "/b", FirstVisit: true})
+
+		r, rr := newTest(ctx, "GET", "/load-widget/csv?widget=0&filter=/b&period-start="+
+			ztime.Now().Format("2006-01-02")+"&period-end="+ztime.Now().Format("2006-01-02"), nil)
+		r.Header.Set("Cookie", "share-token="+l.Token)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 403)
+		if h := rr.Header().Get("Content-Type"); strings.HasPrefix(h, "text/csv") {
+			t.Errorf("Content-Type: %s", h)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		err := zdb.Exec(ctx, `update share_links set expires_at=$1 where share_link_id=$2`,
+			ztime.Now().Add(-time.Hour), l.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, rr := newTest(ctx, "GET", "/", nil)
+		r.Header.Set("Cookie", "share-token="+l.Token)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 410)
+	})
+}
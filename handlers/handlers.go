@@ -20,13 +20,14 @@ import (
 )
 
 var rateLimits = struct {
-	count, api, apiCount, export, login func(*http.Request) (int, int64)
+	count, api, apiCount, export, login, invite func(*http.Request) (int, int64)
 }{
 	count:    mware.RatelimitLimit(4, 1),
 	api:      mware.RatelimitLimit(4, 1),
 	apiCount: mware.RatelimitLimit(60, 120),
 	export:   mware.RatelimitLimit(1, 3600),
 	login:    mware.RatelimitLimit(20, 60),
+	invite:   mware.RatelimitLimit(20, 3600),
 }
 
 // Set the rate limits.
@@ -43,11 +44,27 @@ func SetRateLimit(name string, reqs int, secs int64) {
 		rateLimits.export = r
 	case "login":
 		rateLimits.login = r
+	case "invite":
+		rateLimits.invite = r
 	default:
 		panic(fmt.Sprintf("handlers.SetRateLimit: invalid name: %q", name))
 	}
 }
 
+var jsonRequestLog bool
+
+// SetJSONRequestLog sets if the request log from "-debug req" is logged with
+// zlog, so it's in the same format as all the other logs, instead of
+// mware.RequestLog().
+func SetJSONRequestLog(v bool) { jsonRequestLog = v }
+
+var proxyProtocol bool
+
+// SetProxyProtocol sets if the client address is read from the PROXY protocol
+// header by the listener; the X-Forwarded-For and X-Real-Ip headers are ignored
+// if it is, as any client can send those.
+func SetProxyProtocol(v bool) { proxyProtocol = v }
+
 // Site calls goatcounter.MustGetSite; it's just shorter :-)
 func Site(ctx context.Context) *goatcounter.Site    { return goatcounter.MustGetSite(ctx) }
 func Account(ctx context.Context) *goatcounter.Site { return goatcounter.MustGetAccount(ctx) }
@@ -70,6 +87,8 @@ type Globals struct {
 	Dev            bool
 	Port           string
 	Websocket      bool
+	OIDC           bool
+	OIDCOnly       bool
 	JSTranslations map[string]string
 	HideUI         bool
 }
@@ -99,6 +118,8 @@ func newGlobals(w http.ResponseWriter, r *http.Request) Globals {
 		Dev:            goatcounter.Config(ctx).Dev,
 		Port:           goatcounter.Config(ctx).Port,
 		Websocket:      goatcounter.Config(ctx).Websocket,
+		OIDC:           goatcounter.Config(ctx).OIDC != nil,
+		OIDCOnly:       goatcounter.Config(ctx).OIDCOnly,
 		HideUI:         r.URL.Query().Get("hideui") != "",
 		JSTranslations: map[string]string{
 			"error/date-future":           T(ctx, "error/date-future|That would be in the future"),
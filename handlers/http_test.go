@@ -70,6 +70,7 @@ func TestMain(m *testing.M) {
 		// Don't need tests.
 		"", "bosmang.gohtml", "bosmang_site.gohtml", "bosmang_cache.gohtml",
 		"bosmang_bgrun.gohtml", "bosmang_metrics.gohtml", "bosmang_sites.gohtml",
+		"bosmang_instance.gohtml", "bosmang_email.gohtml",
 		"i18n_list.gohtml", "i18n_show.gohtml", "i18n_manage.gohtml",
 
 		// Tested in tpl_test.go
@@ -77,7 +78,9 @@ func TestMain(m *testing.M) {
 		"email_import_done.gotxt", "email_import_error.gotxt",
 		"email_password_reset.gotxt", "email_verify.gotxt",
 		"email_adduser.gotxt", "_email_bottom.gohtml", "email_report.gohtml",
-		"email_report.gotxt",
+		"email_report.gotxt", "email_change_confirm.gotxt", "email_change_notify.gotxt",
+		"email_backup_code.gotxt", "email_site_warning.gotxt", "email_password_changed.gotxt",
+		"email_retention_delay.gotxt",
 
 		// TODO
 		"_dashboard_pages_refs.gohtml",
@@ -175,7 +178,7 @@ func login(t *testing.T, r *http.Request) {
 
 	// Login user
 	u := User(r.Context())
-	err := u.Login(r.Context())
+	err := u.Login(r.Context(), r.UserAgent(), r.RemoteAddr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -10,11 +10,14 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"zgo.at/errors"
 	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/metrics"
 	"zgo.at/guru"
 	"zgo.at/json"
 	"zgo.at/termtext"
@@ -23,6 +26,7 @@ import (
 	"zgo.at/zhttp"
 	"zgo.at/zhttp/auth"
 	"zgo.at/zhttp/header"
+	"zgo.at/zhttp/mware"
 	"zgo.at/zlog"
 	"zgo.at/zstd/znet"
 	"zgo.at/zstd/zruntime"
@@ -62,7 +66,7 @@ var (
 			return nil
 		}
 		s := Site(r.Context())
-		if s.Settings.IsPublic() {
+		if s.Settings.IsPublic() || goatcounter.GetShareLink(r.Context()) != nil {
 			return nil
 		}
 		if a := r.URL.Query().Get("access-token"); s.Settings.CanView(a) {
@@ -85,16 +89,80 @@ var (
 		return redirect(w, r)
 	})
 
+	// Read-only access to the dashboard with a share link; this needs to be
+	// before loggedInOrPublic.
+	shareLink = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if u := goatcounter.GetUser(r.Context()); u != nil && u.ID > 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, fromCookie := r.URL.Query().Get("share"), false
+			if token == "" {
+				if c, err := r.Cookie("share-token"); err == nil {
+					token, fromCookie = c.Value, true
+				}
+			}
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var l goatcounter.ShareLink
+			err := l.ByToken(r.Context(), token)
+			if err != nil && !zdb.ErrNoRows(err) {
+				zhttp.ErrPage(w, r, err)
+				return
+			}
+			if zdb.ErrNoRows(err) || l.Expired() {
+				http.SetCookie(w, &http.Cookie{Name: "share-token", Path: "/", MaxAge: -1})
+				zhttp.ErrPage(w, r, guru.New(http.StatusGone, T(r.Context(),
+					"error/share-link-expired|This link has expired or was removed; ask the person who gave it to you for a new one.")))
+				return
+			}
+
+			// Set cookie and redirect, so the token doesn't stay in the URL;
+			// same as the access-token.
+			if !fromCookie {
+				http.SetCookie(w, &http.Cookie{
+					Name:     "share-token",
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   zhttp.CookieSecure,
+					SameSite: zhttp.CookieSameSite,
+				})
+				zhttp.SeeOther(w, goatcounter.Config(r.Context()).BasePath+"/")
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(goatcounter.WithShareLink(r.Context(), &l)))
+		})
+	}
+
 	requireAccess = func(atLeast goatcounter.UserAccess) func(http.Handler) http.Handler {
 		return auth.Filter(func(w http.ResponseWriter, r *http.Request) error {
 			u := goatcounter.GetUser(r.Context())
-			if u != nil && u.ID > 0 && u.HasAccess(atLeast) {
-				return nil
+			if u == nil || u.ID == 0 {
+				return guru.Errorf(401, "Not allowed to view this page")
 			}
-			return guru.Errorf(401, "Not allowed to view this page")
+			if !u.HasAccess(atLeast) {
+				return guru.Errorf(403, "Not allowed to view this page")
+			}
+			return nil
 		})
 	}
 
+	// Password and passkey logins, which can be disabled with -oidc-only.
+	localLogin = auth.Filter(func(w http.ResponseWriter, r *http.Request) error {
+		if goatcounter.Config(r.Context()).OIDCOnly {
+			return guru.New(403, T(r.Context(),
+				"error/local-login-disabled|Signing in with a password is disabled on this server; use single sign-on instead."))
+		}
+		return nil
+	})
+
 	keyAuth = auth.Add(func(ctx context.Context, key string) (auth.User, error) {
 		u := &goatcounter.User{}
 		err := u.ByTokenAndSite(ctx, key)
@@ -104,6 +172,35 @@ var (
 
 type statusWriter interface{ Status() int }
 
+// dbPoolStats is the sql.DBStats for the database connection pool.
+type dbPoolStats struct {
+	MaxOpen      int    `json:"max_open"`      // Maximum number of open connections.
+	Open         int    `json:"open"`          // Number of open connections, in use and idle.
+	InUse        int    `json:"in_use"`        // Number of connections in use.
+	Idle         int    `json:"idle"`          // Number of idle connections.
+	WaitCount    int64  `json:"wait_count"`    // Number of times a connection was waited for.
+	WaitDuration string `json:"wait_duration"` // Total time waited for a connection.
+
+	// Number of connections closed because of the max_idle and max_lifetime
+	// limits.
+	MaxIdleClosed     int64 `json:"max_idle_closed"`
+	MaxLifetimeClosed int64 `json:"max_lifetime_closed"`
+}
+
+func newDBPoolStats(db zdb.DB) dbPoolStats {
+	s := db.DBSQL().Stats()
+	return dbPoolStats{
+		MaxOpen:           s.MaxOpenConnections,
+		Open:              s.OpenConnections,
+		InUse:             s.InUse,
+		Idle:              s.Idle,
+		WaitCount:         s.WaitCount,
+		WaitDuration:      s.WaitDuration.Round(time.Millisecond).String(),
+		MaxIdleClosed:     s.MaxIdleClosed + s.MaxIdleTimeClosed,
+		MaxLifetimeClosed: s.MaxLifetimeClosed,
+	}
+}
+
 func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.Handler {
 	Started = ztime.Now()
 	return func(next http.Handler) http.Handler {
@@ -113,16 +210,21 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 			// Intercept /status here so it works everywhere.
 			if r.URL.Path == "/status" {
 				info, _ := zdb.Info(ctx)
-				j, err := json.Marshal(map[string]any{
+				status := map[string]any{
 					"uptime":   ztime.Now().Sub(Started).Round(time.Second).String(),
 					"version":  goatcounter.Version,
 					"database": zdb.SQLDialect(ctx).String() + " " + string(info.Version),
+					"db_pool":  newDBPoolStats(db),
 					"go":       runtime.Version(),
 					"GOOS":     runtime.GOOS,
 					"GOARCH":   runtime.GOARCH,
 					"race":     zruntime.Race,
 					"cgo":      zruntime.CGO,
-				})
+				}
+				if rep := goatcounter.GetReplica(ctx); rep != nil {
+					status["replica"] = rep.Status(ctx)
+				}
+				j, err := json.Marshal(status)
 				if err != nil {
 					http.Error(w, err.Error(), 500)
 					return
@@ -209,6 +311,9 @@ func addctx(db zdb.DB, loadSite bool, dashTimeout int) func(http.Handler) http.H
 				*r = *r.WithContext(goatcounter.WithSite(r.Context(), &s))
 			}
 
+			// Record which endpoint ran a query for -log-slow-queries.
+			*r = *r.WithContext(goatcounter.WithQueryCaller(r.Context(), r.Method+" "+r.URL.Path))
+
 			// Make sure there's always a z18n object; will get overriden by
 			// addz18n() later for endpoints where it matters.
 			*r = *r.WithContext(z18n.With(r.Context(), goatcounter.DefaultLocale()))
@@ -278,7 +383,7 @@ func noSites(db zdb.DB, w http.ResponseWriter, r *http.Request) {
 				return err
 			}
 
-			err = u.Login(ctx)
+			err = u.Login(ctx, r.UserAgent(), r.RemoteAddr)
 			if err != nil {
 				return err
 			}
@@ -313,6 +418,58 @@ func noSites(db zdb.DB, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// RealIP sets RemoteAddr from the X-Forwarded-For or X-Real-Ip headers, unless
+// the address is read from the PROXY protocol header; see SetProxyProtocol.
+func RealIP() func(http.Handler) http.Handler {
+	if proxyProtocol {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return mware.RealIP()
+}
+
+// countStatus counts the HTTP requests by status code for the Prometheus
+// metrics; this must be after mware.WrapWriter().
+func countStatus(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		code := http.StatusOK
+		if ww, ok := w.(statusWriter); ok && ww.Status() > 0 {
+			code = ww.Status()
+		}
+		metrics.Count("goatcounter_http_requests_total", 1, "code", strconv.Itoa(code))
+	})
+}
+
+// requestLog logs all requests with zlog, except for the paths in ignore.
+func requestLog(ignore ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			if slices.Contains(ignore, r.URL.Path) {
+				return
+			}
+
+			code := http.StatusOK
+			if ww, ok := w.(statusWriter); ok && ww.Status() > 0 {
+				code = ww.Status()
+			}
+			f := zlog.F{
+				"method":      r.Method,
+				"host":        r.Host,
+				"path":        r.URL.Path,
+				"code":        code,
+				"duration_ms": time.Since(start).Milliseconds(),
+			}
+			if s := goatcounter.GetSite(r.Context()); s != nil {
+				f["site_id"] = s.ID
+			}
+			zlog.Module("request").Fields(f).Printf("%s %s%s %d", r.Method, r.Host, r.URL.Path, code)
+		})
+	}
+}
+
 func addz18n() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -387,3 +544,11 @@ func addcsp(domainStatic string) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// readOnly uses the read-only replica for the request, if there is one; use
+// goatcounter.Primary() for writes.
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(goatcounter.ReadOnly(r.Context())))
+	})
+}
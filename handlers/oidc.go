@@ -0,0 +1,98 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"net/http"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/guru"
+	"zgo.at/zhttp"
+	"zgo.at/zhttp/auth"
+	"zgo.at/zlog"
+)
+
+// The OpenID Connect callback URL; this needs to be registered with the
+// provider for every domain GoatCounter is accessed on.
+func oidcRedirectURI(r *http.Request) string {
+	return Site(r.Context()).URL(r.Context()) + "/user/oidc/callback"
+}
+
+func (h user) oidcLogin(w http.ResponseWriter, r *http.Request) error {
+	p := goatcounter.Config(r.Context()).OIDC
+	if p == nil {
+		return guru.New(404, "single sign-on is not enabled")
+	}
+	if u := goatcounter.GetUser(r.Context()); u != nil && u.ID > 0 {
+		return zhttp.SeeOther(w, "/")
+	}
+
+	state, nonce, verifier := goatcounter.NewOIDCState(r.Context())
+	u, err := p.AuthURL(r.Context(), oidcRedirectURI(r), state, nonce, verifier)
+	if err != nil {
+		return err
+	}
+
+	// Bind the state to this browser, so someone can't login a victim to
+	// their account by sending them the callback URL.
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc-state",
+		Value:    state,
+		Path:     goatcounter.Config(r.Context()).BasePath + "/user/oidc",
+		MaxAge:   15 * 60,
+		HttpOnly: true,
+		Secure:   zhttp.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, u, http.StatusSeeOther)
+	return nil
+}
+
+func (h user) oidcCallback(w http.ResponseWriter, r *http.Request) error {
+	p := goatcounter.Config(r.Context()).OIDC
+	if p == nil {
+		return guru.New(404, "single sign-on is not enabled")
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		zlog.Module("oidc").Fields(zlog.F{"error": e, "description": q.Get("error_description")}).Print("provider returned an error")
+		zhttp.FlashError(w, T(r.Context(), "error/sso-failed|Single sign-on failed: %(error)", e))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	state := q.Get("state")
+	c, err := r.Cookie("oidc-state")
+	if err != nil || state == "" || c.Value != state {
+		zhttp.FlashError(w, T(r.Context(), "error/sso-expired|Took too long; please try again."))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc-state", Path: c.Path, MaxAge: -1})
+	nonce, verifier, ok := goatcounter.UseOIDCState(r.Context(), state)
+	if !ok {
+		zhttp.FlashError(w, T(r.Context(), "error/sso-expired|Took too long; please try again."))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	claims, err := p.Exchange(r.Context(), oidcRedirectURI(r), q.Get("code"), nonce, verifier)
+	if err != nil {
+		zlog.Module("oidc").Error(err)
+		return guru.New(403, T(r.Context(), "error/sso-verify|Could not verify the login with the identity provider."))
+	}
+
+	var u goatcounter.User
+	err = u.ByOIDC(r.Context(), claims)
+	if err != nil {
+		return err
+	}
+	err = u.Login(r.Context(), r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+
+	// Multi-factor auth is up to the identity provider.
+	auth.SetCookie(w, *u.LoginToken, cookieDomain(Site(r.Context()), r))
+	return zhttp.SeeOther(w, afterLogin(r.Context()))
+}
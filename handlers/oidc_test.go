@@ -0,0 +1,114 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/goatcounter/v2/oidc"
+	"zgo.at/goatcounter/v2/oidc/oidctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestOIDC(t *testing.T) {
+	ctx := gctest.DB(t)
+	srv := oidctest.New(t)
+
+	c := goatcounter.Config(ctx)
+	c.OIDC = oidc.New(srv.URL, srv.ClientID, srv.ClientSecret)
+	c.OIDCDomains = []string{"example.com"}
+	c.OIDCAccess = goatcounter.AccessReadOnly
+	defer func() { c.OIDC, c.OIDCDomains, c.OIDCAccess = nil, nil, "" }()
+
+	// Start the login and follow the provider's redirect, returning the
+	// response for the callback.
+	login := func(t *testing.T, claims map[string]any, sendCookie bool) *httptest.ResponseRecorder {
+		t.Helper()
+		srv.Claims = claims
+
+		r, rr := newTest(ctx, "GET", "/user/oidc", nil)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		code, state := srv.Authorize(t, rr.Header().Get("Location"))
+		cookie := rr.Result().Cookies()[0]
+
+		r, rr = newTest(ctx, "GET", "/user/oidc/callback?code="+code+"&state="+state, nil)
+		if sendCookie {
+			r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr
+	}
+	loggedIn := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+		ztest.Code(t, rr, 303)
+		if c := rr.Header().Get("Set-Cookie"); !strings.Contains(c, "key="+ztime.Now().Format("20060102")+"-") {
+			t.Errorf("not logged in: %q", c)
+		}
+	}
+
+	t.Run("existing user", func(t *testing.T) {
+		rr := login(t, map[string]any{"sub": "1", "email": "TEST@gctest.localhost", "email_verified": true}, true)
+		loggedIn(t, rr)
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		rr := login(t, map[string]any{"sub": "1", "email": "test@gctest.localhost"}, true)
+		ztest.Code(t, rr, 403)
+	})
+
+	t.Run("new user", func(t *testing.T) {
+		rr := login(t, map[string]any{"sub": "2", "email": "new@example.com", "email_verified": true}, true)
+		loggedIn(t, rr)
+
+		var u goatcounter.User
+		err := u.ByEmail(ctx, "new@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Access["all"] != goatcounter.AccessReadOnly || len(u.Password) > 0 || !u.EmailVerified {
+			t.Errorf("%#v", u)
+		}
+	})
+
+	t.Run("domain not allowed", func(t *testing.T) {
+		rr := login(t, map[string]any{"sub": "3", "email": "new@example.org", "email_verified": true}, true)
+		ztest.Code(t, rr, 403)
+
+		var u goatcounter.User
+		err := u.ByEmail(ctx, "new@example.org")
+		if !zdb.ErrNoRows(err) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("no state cookie", func(t *testing.T) {
+		rr := login(t, map[string]any{"sub": "1", "email": "test@gctest.localhost", "email_verified": true}, false)
+		ztest.Code(t, rr, 303)
+		if l := rr.Header().Get("Location"); l != "/user/new" {
+			t.Error(l)
+		}
+	})
+
+	t.Run("oidc only", func(t *testing.T) {
+		c.OIDCOnly = true
+		defer func() { c.OIDCOnly = false }()
+
+		r, rr := newTest(ctx, "POST", "/user/requestlogin", strings.NewReader("email=test@gctest.localhost&password=coconuts"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 403)
+
+		rr = login(t, map[string]any{"sub": "1", "email": "test@gctest.localhost", "email_verified": true}, true)
+		loggedIn(t, rr)
+	})
+}
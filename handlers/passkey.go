@@ -0,0 +1,243 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/xsrftoken"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/webauthn"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zhttp"
+	"zgo.at/zhttp/auth"
+	"zgo.at/zlog"
+)
+
+// The WebAuthn ceremonies are done from JavaScript (see bind_passkeys in
+// backend.js), which first POSTs to get the options for navigator.credentials,
+// and then POSTs the result to the "finish" endpoint, which responds with a
+// JSON object with the URL to redirect to.
+
+type passkeyFinish struct {
+	Challenge webauthn.Bytes `json:"challenge"`
+
+	// Registration.
+	Name              string         `json:"name"`
+	ClientDataJSON    webauthn.Bytes `json:"client_data"`
+	AttestationObject webauthn.Bytes `json:"attestation_object"`
+
+	// Login.
+	Assertion webauthn.Assertion `json:"assertion"`
+
+	// MFA.
+	LoginMAC       string `json:"loginmac"`
+	UserLoginToken string `json:"user_logintoken"`
+}
+
+func (h user) passkeyRegisterBegin(w http.ResponseWriter, r *http.Request) error {
+	u := User(r.Context())
+	var passkeys goatcounter.Passkeys
+	err := passkeys.ListUser(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	rp := goatcounter.RelyingParty(r.Host)
+	ch := goatcounter.NewPasskeyChallenge(r.Context(), goatcounter.PasskeyRegister, u.ID)
+	return zhttp.JSON(w, rp.CreationOptions(ch, webauthn.Bytes(strconv.FormatInt(u.ID, 10)), u.Email, passkeys.CredentialIDs()))
+}
+
+func (h user) passkeyRegister(w http.ResponseWriter, r *http.Request) error {
+	u := User(r.Context())
+	var args passkeyFinish
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	if !goatcounter.UsePasskeyChallenge(r.Context(), args.Challenge, goatcounter.PasskeyRegister, u.ID) {
+		return guru.New(400, T(r.Context(), "error/passkey-expired|Took too long; please try again."))
+	}
+	cred, err := goatcounter.RelyingParty(r.Host).Register(args.Challenge, args.ClientDataJSON, args.AttestationObject)
+	if err != nil {
+		return guru.Errorf(400, "%s", err)
+	}
+
+	p := goatcounter.Passkey{
+		Name:         args.Name,
+		CredentialID: cred.ID,
+		PublicKey:    cred.PublicKey,
+		SignCount:    int64(cred.SignCount),
+	}
+	err = p.Insert(r.Context())
+	if err != nil {
+		return err
+	}
+	err = u.LogoutOthers(r.Context())
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserMFA, u.Email, nil, map[string]string{"passkey": p.Name})
+
+	zhttp.Flash(w, T(r.Context(), "notify/passkey-added|Passkey ‘%(name)’ added.", p.Name))
+	return zhttp.JSON(w, map[string]string{"redirect": "/user/auth"})
+}
+
+func (h user) passkeyDelete(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var p goatcounter.Passkey
+	err := p.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = p.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserMFA, User(r.Context()).Email, map[string]string{"passkey": p.Name}, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/passkey-deleted|Passkey ‘%(name)’ deleted.", p.Name))
+	return zhttp.SeeOther(w, "/user/auth")
+}
+
+// passkeyLoginBegin starts a usernameless login; the browser will ask which
+// passkey to use.
+func (h user) passkeyLoginBegin(w http.ResponseWriter, r *http.Request) error {
+	ch := goatcounter.NewPasskeyChallenge(r.Context(), goatcounter.PasskeyLogin, 0)
+	return zhttp.JSON(w, goatcounter.RelyingParty(r.Host).RequestOptions(ch, nil, true))
+}
+
+func (h user) passkeyLogin(w http.ResponseWriter, r *http.Request) error {
+	var args passkeyFinish
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	if !goatcounter.UsePasskeyChallenge(r.Context(), args.Challenge, goatcounter.PasskeyLogin, 0) {
+		return guru.New(400, T(r.Context(), "error/passkey-expired|Took too long; please try again."))
+	}
+
+	var p goatcounter.Passkey
+	err = p.ByCredentialID(r.Context(), args.Assertion.ID)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return guru.New(403, T(r.Context(), "error/passkey-unknown|Unknown passkey; it may have been removed."))
+		}
+		return err
+	}
+	var u goatcounter.User
+	err = u.ByID(r.Context(), p.UserID)
+	if err != nil {
+		return err
+	}
+
+	// The passkey is the only factor, so the user must be verified by the
+	// authenticator.
+	err = h.passkeyVerify(r, &p, args, true)
+	if err != nil {
+		return err
+	}
+
+	err = u.Login(r.Context(), r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	auth.SetCookie(w, *u.LoginToken, cookieDomain(Site(r.Context()), r))
+	return zhttp.JSON(w, map[string]string{"redirect": afterLogin(r.Context())})
+}
+
+// passkeyMFABegin uses a passkey as the second factor after logging in with the
+// password.
+func (h user) passkeyMFABegin(w http.ResponseWriter, r *http.Request) error {
+	var args passkeyFinish
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+	u, err := h.mfaUser(r, args.UserLoginToken, args.LoginMAC)
+	if err != nil {
+		return err
+	}
+
+	var passkeys goatcounter.Passkeys
+	err = passkeys.ListUser(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	ch := goatcounter.NewPasskeyChallenge(r.Context(), goatcounter.PasskeyMFA, u.ID)
+	return zhttp.JSON(w, goatcounter.RelyingParty(r.Host).RequestOptions(ch, passkeys.CredentialIDs(), false))
+}
+
+func (h user) passkeyMFA(w http.ResponseWriter, r *http.Request) error {
+	var args passkeyFinish
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+	u, err := h.mfaUser(r, args.UserLoginToken, args.LoginMAC)
+	if err != nil {
+		return err
+	}
+
+	if !goatcounter.UsePasskeyChallenge(r.Context(), args.Challenge, goatcounter.PasskeyMFA, u.ID) {
+		return guru.New(400, T(r.Context(), "error/passkey-expired|Took too long; please try again."))
+	}
+
+	var p goatcounter.Passkey
+	err = p.ByCredentialID(r.Context(), args.Assertion.ID)
+	if err != nil && !zdb.ErrNoRows(err) {
+		return err
+	}
+	if err != nil || p.UserID != u.ID {
+		return guru.New(403, T(r.Context(), "error/passkey-unknown|Unknown passkey; it may have been removed."))
+	}
+
+	err = h.passkeyVerify(r, &p, args, false)
+	if err != nil {
+		return err
+	}
+
+	err = u.VerifyMFA(r.Context())
+	if err != nil {
+		return err
+	}
+	auth.SetCookie(w, *u.LoginToken, cookieDomain(Site(r.Context()), r))
+	return zhttp.JSON(w, map[string]string{"redirect": afterLogin(r.Context())})
+}
+
+// mfaUser gets the user for the MFA step, after the password was verified.
+func (h user) mfaUser(r *http.Request, loginToken, loginMAC string) (*goatcounter.User, error) {
+	var u goatcounter.User
+	err := u.ByMFAToken(r.Context(), loginToken)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return nil, guru.New(403, T(r.Context(), "error/login-invalid|Invalid login"))
+		}
+		return nil, err
+	}
+	if !testTOTP && !xsrftoken.Valid(loginMAC, *u.LoginToken, strconv.FormatInt(u.ID, 10), actionTOTP) {
+		return nil, guru.New(403, T(r.Context(), "error/login-invalid|Invalid login"))
+	}
+	return &u, nil
+}
+
+func (h user) passkeyVerify(r *http.Request, p *goatcounter.Passkey, args passkeyFinish, requireUV bool) error {
+	n, err := goatcounter.RelyingParty(r.Host).Login(args.Challenge, p.Credential(), args.Assertion, requireUV)
+	if err != nil {
+		zlog.Module("passkey").Fields(zlog.F{"passkey_id": p.ID}).Printf("login failed: %s", err)
+		return guru.New(403, T(r.Context(), "error/passkey-failed|Could not verify the passkey."))
+	}
+	return p.UpdateUsed(r.Context(), n)
+}
@@ -0,0 +1,195 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/goatcounter/v2/webauthn"
+	"zgo.at/goatcounter/v2/webauthn/webauthntest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztest"
+)
+
+func TestPasskey(t *testing.T) {
+	ctx := gctest.DB(t)
+	origin := "https://" + Site(ctx).Code + "." + goatcounter.Config(ctx).Domain
+
+	post := func(t *testing.T, path string, form url.Values, loggedIn bool) *httptest.ResponseRecorder {
+		t.Helper()
+		r, rr := newTest(ctx, "POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if loggedIn {
+			login(t, r)
+		}
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr
+	}
+	decode := func(t *testing.T, rr *httptest.ResponseRecorder, v any) {
+		t.Helper()
+		err := json.Unmarshal(rr.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("%s: %s", err, rr.Body.String())
+		}
+	}
+	assertion := func(ch webauthn.Bytes, a webauthn.Assertion, form url.Values) url.Values {
+		form.Set("challenge", ch.String())
+		form.Set("assertion.id", a.ID.String())
+		form.Set("assertion.client_data", a.ClientDataJSON.String())
+		form.Set("assertion.authenticator_data", a.AuthenticatorData.String())
+		form.Set("assertion.signature", a.Signature.String())
+		form.Set("assertion.user_handle", a.UserHandle.String())
+		return form
+	}
+
+	a := webauthntest.New()
+
+	t.Run("register", func(t *testing.T) {
+		rr := post(t, "/user/passkey/register", nil, true)
+		ztest.Code(t, rr, 200)
+		var opt webauthn.CreationOptions
+		decode(t, rr, &opt)
+
+		cd, att := a.Create(opt, origin)
+		form := url.Values{
+			"name":               {"Laptop"},
+			"challenge":          {opt.Challenge.String()},
+			"client_data":        {webauthn.Bytes(cd).String()},
+			"attestation_object": {webauthn.Bytes(att).String()},
+		}
+		rr = post(t, "/user/passkey/register/finish", form, true)
+		ztest.Code(t, rr, 200)
+
+		// Challenge can only be used once.
+		rr = post(t, "/user/passkey/register/finish", form, true)
+		ztest.Code(t, rr, 400)
+
+		var passkeys goatcounter.Passkeys
+		err := passkeys.ListUser(ctx, User(ctx).ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(passkeys) != 1 || passkeys[0].Name != "Laptop" {
+			t.Fatalf("%#v", passkeys)
+		}
+	})
+
+	t.Run("login", func(t *testing.T) {
+		rr := post(t, "/user/passkey/login", nil, false)
+		ztest.Code(t, rr, 200)
+		var opt webauthn.RequestOptions
+		decode(t, rr, &opt)
+
+		form := assertion(opt.Challenge, a.Get(opt, origin), url.Values{})
+		rr = post(t, "/user/passkey/login/finish", form, false)
+		ztest.Code(t, rr, 200)
+		if c := rr.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "key=") {
+			t.Error(c)
+		}
+
+		rr = post(t, "/user/passkey/login/finish", form, false)
+		ztest.Code(t, rr, 400)
+	})
+
+	t.Run("login not verified", func(t *testing.T) {
+		a.NoUserVerified = true
+		defer func() { a.NoUserVerified = false }()
+
+		rr := post(t, "/user/passkey/login", nil, false)
+		ztest.Code(t, rr, 200)
+		var opt webauthn.RequestOptions
+		decode(t, rr, &opt)
+
+		rr = post(t, "/user/passkey/login/finish", assertion(opt.Challenge, a.Get(opt, origin), url.Values{}), false)
+		ztest.Code(t, rr, 403)
+	})
+
+	t.Run("mfa", func(t *testing.T) {
+		r, rr := newTest(ctx, "POST", "/user/requestlogin", nil)
+		body, ct, err := ztest.MultipartForm(map[string]string{
+			"email":    "test@gctest.localhost",
+			"password": "coconuts",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", ct)
+		r.Body = io.NopCloser(body)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+
+		doc, err := goquery.NewDocumentFromReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := doc.Find(`input[name="totp_token"]`); f.Length() != 0 {
+			t.Error("TOTP form shown without TOTP")
+		}
+		mac, _ := doc.Find(`#passkey-mfa input[name="loginmac"]`).Attr("value")
+		token, _ := doc.Find(`#passkey-mfa input[name="user_logintoken"]`).Attr("value")
+		form := url.Values{"loginmac": {mac}, "user_logintoken": {token}}
+
+		rr = post(t, "/user/passkey/mfa", form, false)
+		ztest.Code(t, rr, 200)
+		var opt webauthn.RequestOptions
+		decode(t, rr, &opt)
+		if len(opt.AllowCredentials) != 1 {
+			t.Errorf("%#v", opt.AllowCredentials)
+		}
+
+		a.NoUserVerified = true // Not needed for the second factor.
+		defer func() { a.NoUserVerified = false }()
+
+		rr = post(t, "/user/passkey/mfa/finish", assertion(opt.Challenge, a.Get(opt, origin), form), false)
+		ztest.Code(t, rr, 200)
+		if c := rr.Header().Get("Set-Cookie"); !strings.HasPrefix(c, "key=") {
+			t.Error(c)
+		}
+
+		// Wrong MAC.
+		form.Set("loginmac", "x")
+		rr = post(t, "/user/passkey/mfa", form, false)
+		ztest.Code(t, rr, 403)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		rr := post(t, "/user/passkey/login", nil, false)
+		ztest.Code(t, rr, 200)
+		var opt webauthn.RequestOptions
+		decode(t, rr, &opt)
+
+		rr = post(t, "/user/passkey/login/finish", assertion(opt.Challenge, webauthntest.New().Get(opt, origin), url.Values{}), false)
+		ztest.Code(t, rr, 403)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		var passkeys goatcounter.Passkeys
+		err := passkeys.ListUser(ctx, User(ctx).ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := post(t, "/user/passkey/"+strconv.FormatInt(passkeys[0].ID, 10)+"/delete", nil, true)
+		ztest.Code(t, rr, 303)
+
+		var after goatcounter.Passkeys
+		err = after.ListUser(ctx, User(ctx).ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != 0 {
+			t.Errorf("%#v", after)
+		}
+	})
+}
@@ -5,15 +5,19 @@
 package handlers
 
 import (
+	"cmp"
 	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,15 +29,19 @@ import (
 	"zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/acme"
 	"zgo.at/goatcounter/v2/cron"
+	"zgo.at/goatcounter/v2/widgets"
 	"zgo.at/guru"
+	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zhttp/header"
 	"zgo.at/zhttp/mware"
 	"zgo.at/zlog"
+	"zgo.at/zstd/zbool"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zruntime"
 	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
 	"zgo.at/zvalidate"
 )
 
@@ -48,6 +56,12 @@ func (h settings) mount(r chi.Router) {
 		r.Get("/user/pref", zhttp.Wrap(h.userPref(nil)))
 		r.Post("/user/pref", zhttp.Wrap(h.userPrefSave))
 
+		r.Get("/user/notifications", zhttp.Wrap(h.userNotifications(nil)))
+		r.Post("/user/notifications", zhttp.Wrap(h.userNotificationsSave))
+		r.Post("/user/webhooks", zhttp.Wrap(h.userWebhookAdd))
+		r.Post("/user/webhooks/remove/{id}", zhttp.Wrap(h.userWebhookRemove))
+		r.Post("/user/webhooks/enable/{id}", zhttp.Wrap(h.userWebhookEnable))
+
 		r.Get("/user/dashboard", zhttp.Wrap(h.userDashboard(nil)))
 		r.Get("/user/dashboard/widget/{name}", zhttp.Wrap(h.userDashboardWidget))
 		r.Get("/user/dashboard/{id}", zhttp.Wrap(h.userDashboardID))
@@ -70,12 +84,32 @@ func (h settings) mount(r chi.Router) {
 		}))
 		set.Post("/settings/main", zhttp.Wrap(h.mainSave))
 		set.Get("/settings/main/ip", zhttp.Wrap(h.ip))
+		set.Get("/settings/main/retention-preview", zhttp.Wrap(h.retentionPreview))
+		set.Post("/settings/domains", zhttp.Wrap(h.domainAdd))
+		set.Post("/settings/domains/remove/{id}", zhttp.Wrap(h.domainRemove))
 		set.Get("/settings/change-code", zhttp.Wrap(h.changeCode))
 		set.Post("/settings/change-code", zhttp.Wrap(h.changeCode))
 
 		set.Get("/settings/purge", zhttp.Wrap(h.purge))
 		set.Post("/settings/purge", zhttp.Wrap(h.purgeDo))
 		set.Post("/settings/merge", zhttp.Wrap(h.merge))
+		set.Post("/settings/purge-ref", zhttp.Wrap(h.purgeRef))
+		set.Get("/settings/purge/confirm", zhttp.Wrap(h.purgeRangeConfirm))
+		set.Post("/settings/purge/confirm", zhttp.Wrap(h.purgeRange))
+		set.Post("/settings/recalc-sessions", zhttp.Wrap(h.recalcSessions))
+
+		set.Get("/settings/share", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.share(nil)(w, r)
+		}))
+		set.Post("/settings/share", zhttp.Wrap(h.shareAdd))
+		set.Post("/settings/share/remove/{id}", zhttp.Wrap(h.shareRemove))
+
+		set.Get("/settings/alerts", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.alerts(nil)(w, r)
+		}))
+		set.Post("/settings/alerts", zhttp.Wrap(h.alertAdd))
+		set.Post("/settings/alerts/remove/{id}", zhttp.Wrap(h.alertRemove))
+		set.Post("/settings/alerts/test/{id}", zhttp.Wrap(h.alertTest))
 
 		set.Get("/settings/export", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
 			return h.export(nil)(w, r)
@@ -105,7 +139,12 @@ func (h settings) mount(r chi.Router) {
 		admin.Post("/settings/sites/add", zhttp.Wrap(h.sitesAdd))
 		admin.Get("/settings/sites/remove/{id}", zhttp.Wrap(h.sitesRemoveConfirm))
 		admin.Post("/settings/sites/remove/{id}", zhttp.Wrap(h.sitesRemove))
+		admin.Post("/settings/sites/restore/{id}", zhttp.Wrap(h.sitesRestore))
 		admin.Post("/settings/sites/copy-settings", zhttp.Wrap(h.sitesCopySettings))
+		admin.Get("/settings/sites/defaults", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.sitesDefaults(nil)(w, r)
+		}))
+		admin.Post("/settings/sites/defaults", zhttp.Wrap(h.sitesDefaultsSave))
 
 		admin.Get("/settings/users", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
 			return h.users(nil)(w, r)
@@ -122,33 +161,184 @@ func (h settings) mount(r chi.Router) {
 		admin.Post("/settings/users/{id}", zhttp.Wrap(h.usersEdit))
 		admin.Post("/settings/users/remove/{id}", zhttp.Wrap(h.usersRemove))
 
-		admin.Get("/settings/delete-account", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+		admin.Get("/settings/users/invite", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.usersInviteForm(nil, nil)(w, r)
+		}))
+		admin.With(mware.Ratelimit(mware.RatelimitOptions{
+			Client: func(r *http.Request) string { return strconv.FormatInt(Account(r.Context()).ID, 10) },
+			Store:  mware.NewRatelimitMemory(),
+			Limit:  rateLimits.invite,
+			// TODO(i18n): this should be translated, but no locale here.
+			Message: "too many invites sent; try again later",
+		})).Post("/settings/users/invite", zhttp.Wrap(h.usersInvite))
+		admin.Post("/settings/users/invite/{id}/revoke", zhttp.Wrap(h.usersInviteRevoke))
+
+		admin.Get("/settings/audit", zhttp.Wrap(h.audit))
+	}
+
+	{ // Owner settings
+		owner := r.With(requireAccess(goatcounter.AccessOwner))
+
+		owner.Get("/settings/delete-account", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
 			return h.delete(nil)(w, r)
 		}))
-		admin.Post("/settings/delete-account", zhttp.Wrap(h.deleteDo))
+		owner.Post("/settings/delete-account", zhttp.Wrap(h.deleteDo))
+
+		owner.Get("/settings/sites/transfer/{id}", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return h.sitesTransferForm(nil, nil)(w, r)
+		}))
+		owner.Post("/settings/sites/transfer/{id}", zhttp.Wrap(h.sitesTransfer))
+		owner.Post("/settings/sites/transfer-cancel/{id}", zhttp.Wrap(h.sitesTransferCancel))
+		owner.Get("/settings/sites/transfer-accept/{key}", zhttp.Wrap(h.sitesTransferAcceptForm))
+		owner.Post("/settings/sites/transfer-accept/{key}", zhttp.Wrap(h.sitesTransferAccept))
 	}
 
 }
 
 func (h settings) main(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		// Every widget only once, even if it's on the dashboard more than once.
+		var (
+			wid  = widgets.FromSiteWidgets(r.Context(), Site(r.Context()).UserDefaults.Widgets, widgets.FilterInternal)
+			seen = make(map[string]struct{})
+		)
+		wid = slices.DeleteFunc(wid, func(w widgets.Widget) bool {
+			_, ok := seen[w.Name()]
+			seen[w.Name()] = struct{}{}
+			return ok
+		})
+
+		var domains goatcounter.SiteDomains
+		err := domains.List(r.Context())
+		if err != nil {
+			return err
+		}
+
+		uaBlock, err := goatcounter.UABlockCounts(r.Context())
+		if err != nil {
+			return err
+		}
+
+		retentionDelay, err := Site(r.Context()).RetentionDelayedUntil(r.Context())
+		if err != nil {
+			return err
+		}
+
 		return zhttp.Template(w, "settings_main.gohtml", struct {
 			Globals
-			Validate *zvalidate.Validator
-		}{newGlobals(w, r), verr})
+			Validate       *zvalidate.Validator
+			PublicWidgets  widgets.List
+			Domains        goatcounter.SiteDomains
+			UABlockCounts  map[string]int
+			RetentionDelay *time.Time
+		}{newGlobals(w, r), verr, wid, domains, uaBlock, retentionDelay})
+	}
+}
+
+func (h settings) domainAdd(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Domain string `json:"domain"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	d := goatcounter.SiteDomain{Domain: args.Domain}
+	err = d.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if !errors.As(err, &vErr) {
+			return err
+		}
+		v := goatcounter.NewValidate(r.Context())
+		v.Sub("site_domain", "", err)
+		return h.main(&v)(w, r)
+	}
+	site := Site(r.Context())
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteUpdate, site.Display(r.Context()),
+		nil, map[string]string{"domain": d.Domain})
+
+	if acme.Enabled() {
+		ctx := goatcounter.CopyContextValues(r.Context())
+		bgrun.RunFunction(fmt.Sprintf("acme.Make:%s", d.Domain), func() {
+			st, err := acme.MakeStatus(ctx, d.Domain)
+			if err != nil {
+				zlog.Field("domain", d.Domain).Error(err)
+			}
+			err = d.UpdateStatus(ctx, st.DNSOK, st.Expires)
+			if err != nil {
+				zlog.Field("domain", d.Domain).Error(err)
+			}
+		})
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/domain-added|Domain ‘%(domain)’ added.", d.Domain))
+	return zhttp.SeeOther(w, "/settings/main#section-domains")
+}
+
+func (h settings) domainRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
 	}
+
+	var d goatcounter.SiteDomain
+	err := d.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = d.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+	site := Site(r.Context())
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteUpdate, site.Display(r.Context()),
+		map[string]string{"domain": d.Domain}, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/domain-removed|Domain ‘%(domain)’ removed.", d.Domain))
+	return zhttp.SeeOther(w, "/settings/main#section-domains")
 }
 
 func (h settings) ip(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.String(w, r.RemoteAddr)
 }
 
+func (h settings) retentionPreview(w http.ResponseWriter, r *http.Request) error {
+	var (
+		q     = r.URL.Query()
+		v     = goatcounter.NewValidate(r.Context())
+		days  = v.Integer("data_retention", q.Get("data_retention"))
+		daily = v.Integer("daily_retention", cmp.Or(q.Get("daily_retention"), "0"))
+	)
+	if v.HasErrors() {
+		return v
+	}
+
+	site := Site(r.Context())
+	ss := site.Settings
+	ss.DataRetention, ss.RetentionMode, ss.DailyRetention = int(days), q.Get("retention_mode"), int(daily)
+	preview, err := site.RetentionPreview(r.Context(), ss)
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "_settings_retention_preview.gohtml", struct {
+		Globals
+		Preview goatcounter.RetentionPreview
+		Lowered bool
+	}{newGlobals(w, r), preview, ss.RetentionLowered(r.Context(), site.Settings)})
+}
+
 func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 	v := goatcounter.NewValidate(r.Context())
 
 	args := struct {
 		Cname      string                   `json:"cname"`
 		LinkDomain string                   `json:"link_domain"`
+		Tags       goatcounter.Strings      `json:"tags"`
+		Notes      string                   `json:"notes"`
 		Settings   goatcounter.SiteSettings `json:"settings"`
 	}{}
 	_, err := zhttp.Decode(r, &args)
@@ -166,8 +356,33 @@ func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	site := Site(r.Context())
+	old := goatcounter.AuditSnapshot(newAPISiteUpdateRequest(*site))
+	oldSettings := site.Settings
+	fold := (args.Settings.FoldPathCase && !site.Settings.FoldPathCase) ||
+		(args.Settings.FoldPathSlash && !site.Settings.FoldPathSlash)
+	refRules := args.Settings.RefRules.String() != site.Settings.RefRules.String()
+	args.Settings.PublicWidgets = site.Settings.PublicWidgets
 	site.Settings = args.Settings
 	site.LinkDomain = args.LinkDomain
+	site.Tags = args.Tags
+	site.Notes = args.Notes
+
+	// Store an empty list if all widgets are selected, so that widgets added
+	// later are also shown.
+	if pw, ok := r.Form["public_widgets"]; ok {
+		site.Settings.PublicWidgets = nil
+		pw = slices.DeleteFunc(pw, func(s string) bool { return s == "" })
+		if len(pw) == 0 {
+			v.Append("public_widgets", T(r.Context(), "error/public-widgets-none|must select at least one widget"))
+		}
+		all := true
+		for _, w := range site.UserDefaults.Widgets {
+			all = all && slices.Contains(pw, w.Name())
+		}
+		if !all {
+			site.Settings.PublicWidgets = pw
+		}
+	}
 
 	makecert := false
 	if args.Cname == "" {
@@ -191,6 +406,13 @@ func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 	if v.HasErrors() {
 		return h.main(&v)(w, r)
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteUpdate, site.Display(r.Context()), old,
+		newAPISiteUpdateRequest(*site))
+
+	err = site.DelayRetention(r.Context(), oldSettings)
+	if err != nil {
+		return err
+	}
 
 	if makecert {
 		ctx := goatcounter.CopyContextValues(r.Context())
@@ -208,6 +430,26 @@ func (h settings) mainSave(w http.ResponseWriter, r *http.Request) error {
 		})
 	}
 
+	if fold {
+		ctx := goatcounter.CopyContextValues(r.Context())
+		bgrun.RunFunction(fmt.Sprintf("fold-paths:%d", site.ID), func() {
+			err := goatcounter.FoldPaths(ctx)
+			if err != nil {
+				zlog.Error(err)
+			}
+		})
+	}
+
+	if refRules {
+		ctx := goatcounter.CopyContextValues(r.Context())
+		bgrun.RunFunction(fmt.Sprintf("ref-rules:%d", site.ID), func() {
+			err := goatcounter.ApplyRefRules(ctx)
+			if err != nil {
+				zlog.Error(err)
+			}
+		})
+	}
+
 	zhttp.Flash(w, T(r.Context(), "notify/saved|Saved!"))
 	return zhttp.SeeOther(w, "/settings")
 }
@@ -228,10 +470,13 @@ func (h settings) changeCode(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	site := Site(r.Context())
+	oldCode := site.Code
 	err = site.UpdateCode(r.Context(), args.Code)
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteCode, site.Display(r.Context()),
+		map[string]string{"code": oldCode}, map[string]string{"code": site.Code})
 
 	zhttp.Flash(w, T(r.Context(), "notify/saved|Saved!"))
 	return zhttp.SeeOther(w, site.URL(r.Context())+"/settings/main")
@@ -245,18 +490,36 @@ func (h settings) sites(verr *zvalidate.Validator) zhttp.HandlerFunc {
 			return err
 		}
 
+		var transfers goatcounter.SiteTransfers
+		err = transfers.ListPending(r.Context())
+		if err != nil {
+			return err
+		}
+
+		var deleted goatcounter.Sites
+		err = deleted.ListDeleted(r.Context())
+		if err != nil {
+			return err
+		}
+
 		return zhttp.Template(w, "settings_sites.gohtml", struct {
 			Globals
-			SubSites goatcounter.Sites
-			Validate *zvalidate.Validator
-		}{newGlobals(w, r), sites, verr})
+			SubSites  goatcounter.Sites
+			Transfers goatcounter.SiteTransfers
+			Deleted   goatcounter.Sites
+			Tags      []goatcounter.TagCount
+			Tag       string
+			Validate  *zvalidate.Validator
+		}{newGlobals(w, r), sites, transfers, deleted, sites.TagSummary(),
+			r.URL.Query().Get("tag"), verr})
 	}
 }
 
 func (h settings) sitesAdd(w http.ResponseWriter, r *http.Request) error {
 	var args struct {
-		Code  string `json:"code"`
-		Cname string `json:"cname"`
+		Code     string `json:"code"`
+		Cname    string `json:"cname"`
+		CopyFrom int64  `json:"copy_from"`
 	}
 	_, err := zhttp.Decode(r, &args)
 	if err != nil {
@@ -276,35 +539,40 @@ func (h settings) sitesAdd(w http.ResponseWriter, r *http.Request) error {
 		addr = args.Cname
 	}
 
-	// Undelete previous soft-deleted site.
-	id, err := newSite.Exists(r.Context())
+	// Restore previous soft-deleted site with the same name.
+	var deleted goatcounter.Sites
+	err = deleted.ListDeleted(r.Context())
 	if err != nil {
 		return err
 	}
-	if id > 0 {
-		err := newSite.ByIDState(r.Context(), id, goatcounter.StateDeleted)
-		if err != nil {
-			if zdb.ErrNoRows(err) {
-				return guru.Errorf(400, T(r.Context(), "error/address-exists|%(addr) already exists", addr))
-			}
-			return err
-		}
-		if newSite.Parent == nil || *newSite.Parent != account.ID {
-			return guru.Errorf(400, T(r.Context(), "error/address-exists|%(addr) already exists", addr))
+	for _, d := range deleted {
+		sameCode := newSite.Code != "" && strings.EqualFold(d.DeletedCode, newSite.Code)
+		sameCname := newSite.Cname != nil && d.DeletedCname != nil && strings.EqualFold(*d.DeletedCname, *newSite.Cname)
+		if !sameCode && !sameCname {
+			continue
 		}
 
-		err = newSite.Undelete(r.Context(), newSite.ID)
+		err := d.Restore(r.Context())
 		if err != nil {
 			return err
 		}
+		goatcounter.Audit(r.Context(), goatcounter.AuditSiteRestore, d.Display(r.Context()), nil, nil)
 
-		zhttp.Flash(w, T(r.Context(), "notify/restored-previously-deleted-site|Site ‘%(url)’ was previously deleted; restored site with all data.", newSite.URL(r.Context())))
+		zhttp.Flash(w, T(r.Context(), "notify/restored-previously-deleted-site|Site ‘%(url)’ was previously deleted; restored site with all data.", d.URL(r.Context())))
 		return zhttp.SeeOther(w, "/settings/sites")
 	}
 
 	// Create new site.
 	newSite.Parent = &account.ID
-	newSite.Settings = Site(r.Context()).Settings
+	if args.CopyFrom > 0 {
+		src, err := h.getSite(r.Context(), args.CopyFrom)
+		if err != nil {
+			return err
+		}
+		newSite.CopySettings(*src)
+	} else {
+		newSite.ApplyAccountDefaults(*account)
+	}
 	err = zdb.TX(r.Context(), func(ctx context.Context) error {
 		err = newSite.Insert(ctx)
 		if err != nil {
@@ -319,11 +587,84 @@ func (h settings) sitesAdd(w http.ResponseWriter, r *http.Request) error {
 		zhttp.FlashError(w, err.Error())
 		return zhttp.SeeOther(w, "/settings/sites")
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteCreate, newSite.Display(r.Context()), nil, newSite)
 
 	zhttp.Flash(w, T(r.Context(), "notify/site-added|Site ‘%(url)’ added.", newSite.URL(r.Context())))
 	return zhttp.SeeOther(w, "/settings/sites")
 }
 
+func (h settings) sitesDefaults(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		account := Account(r.Context())
+		d := account.AccountDefaults
+		if d == nil {
+			d = &goatcounter.AccountDefaults{}
+			d.Defaults(r.Context())
+		}
+
+		return zhttp.Template(w, "settings_sites_defaults.gohtml", struct {
+			Globals
+			Defaults    *goatcounter.AccountDefaults
+			HasDefaults bool
+			Timezones   []*tz.Zone
+			Validate    *zvalidate.Validator
+		}{newGlobals(w, r), d, account.AccountDefaults != nil, tz.Zones, verr})
+	}
+}
+
+func (h settings) sitesDefaultsSave(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Settings        goatcounter.SiteSettings `json:"settings"`
+		UserDefaults    goatcounter.UserSettings `json:"user_defaults"`
+		WidgetsFromUser bool                     `json:"widgets_from_user"`
+		Clear           bool                     `json:"clear"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	account := Account(r.Context())
+	old := account.AccountDefaults
+	if args.Clear {
+		err := account.UpdateAccountDefaults(r.Context(), nil)
+		if err != nil {
+			return err
+		}
+		goatcounter.Audit(r.Context(), goatcounter.AuditSiteUpdate, account.Display(r.Context()),
+			map[string]any{"account_defaults": old}, map[string]any{"account_defaults": nil})
+
+		zhttp.Flash(w, T(r.Context(), "notify/account-defaults-cleared|Account defaults removed; new sites will use the default settings."))
+		return zhttp.SeeOther(w, "/settings/sites/defaults")
+	}
+
+	var d goatcounter.AccountDefaults
+	if old != nil {
+		d = *old
+	}
+	d.Settings.Collect = args.Settings.Collect
+	d.Settings.CollectRegions = args.Settings.CollectRegions
+	d.Settings.IgnoreIPs = args.Settings.IgnoreIPs
+	d.UserDefaults.Timezone = args.UserDefaults.Timezone
+	if args.WidgetsFromUser {
+		d.UserDefaults.Widgets = User(r.Context()).Settings.Widgets
+	}
+
+	err = account.UpdateAccountDefaults(r.Context(), &d)
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			return h.sitesDefaults(vErr)(w, r)
+		}
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteUpdate, account.Display(r.Context()),
+		map[string]any{"account_defaults": old}, map[string]any{"account_defaults": d})
+
+	zhttp.Flash(w, T(r.Context(), "notify/account-defaults-saved|Account defaults saved; they will be used for new sites."))
+	return zhttp.SeeOther(w, "/settings/sites/defaults")
+}
+
 func (h settings) getSite(ctx context.Context, id int64) (*goatcounter.Site, error) {
 	var s goatcounter.Site
 	err := s.ByID(ctx, id)
@@ -379,6 +720,7 @@ func (h settings) sitesRemove(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteDelete, s.Display(r.Context()), nil, nil)
 
 	zhttp.Flash(w, T(r.Context(), "notify/site-removed|Site ‘%(url)’ removed.", s.URL(r.Context())))
 
@@ -395,6 +737,215 @@ func (h settings) sitesRemove(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/settings/sites")
 }
 
+func (h settings) sitesRestore(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var s goatcounter.Site
+	err := s.ByIDState(r.Context(), id, goatcounter.StateDeleted)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+		}
+		return err
+	}
+	if s.Parent == nil || *s.Parent != Account(r.Context()).ID {
+		return guru.New(404, T(r.Context(), "error/not-found|Not Found"))
+	}
+
+	err = s.Restore(r.Context())
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteRestore, s.Display(r.Context()), nil, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/site-restored|Site ‘%(url)’ restored.", s.URL(r.Context())))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
+func (h settings) sitesTransferForm(t *goatcounter.SiteTransfer, pErr error) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		v := goatcounter.NewValidate(r.Context())
+		id := v.Integer("id", chi.URLParam(r, "id"))
+		if v.HasErrors() {
+			return v
+		}
+		s, err := h.getSite(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			t = &goatcounter.SiteTransfer{}
+		}
+
+		var vErr *zvalidate.Validator
+		if errors.As(pErr, &vErr) {
+			pErr = nil
+		}
+		if pErr != nil {
+			zlog.Error(pErr)
+			var code int
+			code, pErr = zhttp.UserError(pErr)
+			w.WriteHeader(code)
+		}
+
+		return zhttp.Template(w, "settings_sites_transfer.gohtml", struct {
+			Globals
+			TransferSite *goatcounter.Site
+			Email        string
+			Validate     *zvalidate.Validator
+			Error        error
+		}{newGlobals(w, r), s, t.Email, vErr, pErr})
+	}
+}
+
+func (h settings) sitesTransfer(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+	var args struct {
+		Email string `json:"email"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	s, err := h.getSite(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	t := goatcounter.SiteTransfer{SiteID: s.ID, Email: args.Email}
+	err = t.Insert(r.Context())
+	if err != nil {
+		return h.sitesTransferForm(&t, err)(w, r)
+	}
+	targets, err := t.Targets(r.Context())
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteTransfer, s.Display(r.Context()),
+		nil, map[string]string{"email": t.Email})
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	startedBy := User(r.Context()).Email
+	bgrun.RunFunction(fmt.Sprintf("site-transfer:%d", t.ID), func() {
+		for _, a := range targets {
+			err := blackmail.Send(fmt.Sprintf("Transfer of %s to your GoatCounter account", s.Display(ctx)),
+				blackmail.From("GoatCounter", goatcounter.Config(ctx).EmailFrom),
+				blackmail.To(t.Email),
+				blackmail.BodyMustText(goatcounter.TplEmailSiteTransfer{ctx, *s, a, t, startedBy}.Render),
+			)
+			if err != nil {
+				zlog.Errorf(": %s", err)
+			}
+		}
+	})
+
+	zhttp.Flash(w, T(r.Context(),
+		"notify/site-transfer-sent|Transfer request sent to ‘%(email)’ if this address is an owner of another account.", t.Email))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
+func (h settings) sitesTransferCancel(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var t goatcounter.SiteTransfer
+	err := t.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = t.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/site-transfer-cancelled|Transfer to ‘%(email)’ cancelled.", t.Email))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
+func (h settings) loadTransfer(ctx context.Context, key string) (*goatcounter.SiteTransfer, *goatcounter.Site, error) {
+	var t goatcounter.SiteTransfer
+	err := t.ByToken(ctx, key)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return nil, nil, guru.New(404, T(ctx,
+				"error/site-transfer-not-found|Could not find this transfer; perhaps it was cancelled?"))
+		}
+		return nil, nil, err
+	}
+	if t.AcceptedAt != nil {
+		return nil, nil, guru.New(403, T(ctx, "error/site-transfer-used|This transfer has already been accepted."))
+	}
+	if t.Expired() {
+		return nil, nil, guru.New(403, T(ctx,
+			"error/site-transfer-expired|This transfer has expired; ask the owner of the site to start a new one."))
+	}
+
+	var s goatcounter.Site
+	err = s.ByID(ctx, t.SiteID)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return nil, nil, guru.New(404, T(ctx, "error/site-transfer-site-gone|This site no longer exists."))
+		}
+		return nil, nil, err
+	}
+	return &t, &s, nil
+}
+
+func (h settings) sitesTransferAcceptForm(w http.ResponseWriter, r *http.Request) error {
+	t, s, err := h.loadTransfer(r.Context(), chi.URLParam(r, "key"))
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "settings_sites_transfer_accept.gohtml", struct {
+		Globals
+		Transfer     goatcounter.SiteTransfer
+		TransferSite *goatcounter.Site
+	}{newGlobals(w, r), *t, s})
+}
+
+func (h settings) sitesTransferAccept(w http.ResponseWriter, r *http.Request) error {
+	t, _, err := h.loadTransfer(r.Context(), chi.URLParam(r, "key"))
+	if err != nil {
+		return err
+	}
+
+	var from goatcounter.Site
+	err = from.ByID(r.Context(), t.AccountID)
+	if err != nil {
+		return err
+	}
+
+	s, err := t.Accept(r.Context())
+	if err != nil {
+		return err
+	}
+
+	var (
+		account = Account(r.Context())
+		diff    = map[string]string{"account": from.Display(r.Context())}
+		newDiff = map[string]string{"account": account.Display(r.Context())}
+	)
+	goatcounter.Audit(r.Context(), goatcounter.AuditSiteTransferIn, s.Display(r.Context()), diff, newDiff)
+	goatcounter.Audit(goatcounter.WithSite(r.Context(), &from), goatcounter.AuditSiteTransferOut,
+		s.Display(r.Context()), diff, newDiff)
+
+	zhttp.Flash(w, T(r.Context(), "notify/site-transfer-accepted|Site ‘%(url)’ transferred to this account.", s.URL(r.Context())))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
 func (h settings) sitesCopySettings(w http.ResponseWriter, r *http.Request) error {
 	master := Site(r.Context())
 
@@ -427,92 +978,414 @@ func (h settings) sitesCopySettings(w http.ResponseWriter, r *http.Request) erro
 		}
 	}
 
-	for _, c := range copies {
-		c.Settings = master.Settings
-		err := c.Update(r.Context())
+	for _, c := range copies {
+		old := goatcounter.AuditSnapshot(newAPISiteUpdateRequest(c))
+		c.Settings = master.Settings
+		err := c.Update(r.Context())
+		if err != nil {
+			return err
+		}
+		goatcounter.Audit(r.Context(), goatcounter.AuditSiteUpdate, c.Display(r.Context()), old,
+			newAPISiteUpdateRequest(c))
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/settings-copied-to-site|Settings copied to the selected sites."))
+	return zhttp.SeeOther(w, "/settings/sites")
+}
+
+func (h settings) purge(w http.ResponseWriter, r *http.Request) error {
+	var (
+		path       = strings.TrimSpace(r.URL.Query().Get("path"))
+		matchTitle = r.URL.Query().Get("match-title") == "on"
+		matchCase  = r.URL.Query().Get("match-case") == "on"
+		list       goatcounter.HitLists
+		paths      goatcounter.Paths
+		refPurge   = goatcounter.RefPurge{
+			Ref:    r.URL.Query().Get("ref"),
+			Domain: r.URL.Query().Get("ref-domain") == "on",
+		}
+		refPreview *goatcounter.RefPurgePreview
+	)
+
+	if path != "" {
+		err := list.ListPathsLike(r.Context(), path, matchTitle, matchCase)
+		if err != nil {
+			return err
+		}
+
+		_, err = paths.List(r.Context(), goatcounter.MustGetSite(r.Context()).ID, 0, nil, 5_000)
+		if err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(refPurge.Ref) != "" {
+		err := refPurge.Validate(r.Context())
+		if err != nil {
+			return err
+		}
+		p, err := refPurge.Preview(r.Context())
+		if err != nil {
+			return err
+		}
+		refPreview = &p
+	}
+
+	var purges goatcounter.Purges
+	err := purges.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "settings_purge.gohtml", struct {
+		Globals
+		PurgePath  string
+		MatchTitle bool
+		MatchCase  bool
+		List       goatcounter.HitLists
+		AllPaths   goatcounter.Paths
+		RefPurge   goatcounter.RefPurge
+		RefPreview *goatcounter.RefPurgePreview
+		Purges     goatcounter.Purges
+	}{newGlobals(w, r), path, matchTitle, matchCase, list, paths, refPurge, refPreview, purges})
+}
+
+func (h settings) purgeRangeConfirm(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	p := goatcounter.Purge{
+		Start: v.Date("start", r.URL.Query().Get("start"), "2006-01-02"),
+		End:   v.Date("end", r.URL.Query().Get("end"), "2006-01-02"),
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	var (
+		path  = strings.TrimSpace(r.URL.Query().Get("path"))
+		paths goatcounter.HitLists
+	)
+	if path != "" {
+		err := paths.ListPathsLike(r.Context(), path, false, false)
+		if err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			zhttp.FlashError(w, T(r.Context(), "p/no-matches|Nothing matches %(query).", path))
+			return zhttp.SeeOther(w, "/settings/purge#purge-range")
+		}
+		for _, pp := range paths {
+			p.Paths = append(p.Paths, pp.PathID)
+		}
+	}
+
+	p.Defaults(r.Context())
+	err := p.Validate(r.Context())
+	if err != nil {
+		return err
+	}
+	preview, err := p.Preview(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "settings_purge_confirm.gohtml", struct {
+		Globals
+		Purge   goatcounter.Purge
+		Path    string
+		Paths   goatcounter.HitLists
+		Preview goatcounter.PurgePreview
+		Confirm string
+	}{newGlobals(w, r), p, path, paths, preview, Site(r.Context()).Display(r.Context())})
+}
+
+func (h settings) purgeRange(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	p := goatcounter.Purge{
+		Start: v.Date("start", r.Form.Get("start"), "2006-01-02"),
+		End:   v.Date("end", r.Form.Get("end"), "2006-01-02"),
+	}
+	if v.HasErrors() {
+		return v
+	}
+	if r.Form.Get("paths") != "" {
+		var err error
+		p.Paths, err = zint.Split(r.Form.Get("paths"), ",")
+		if err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(r.Form.Get("confirm")) != Site(r.Context()).Display(r.Context()) {
+		zhttp.FlashError(w, T(r.Context(), "notify/purge-confirm|Type the name of the site to confirm."))
+		return zhttp.SeeOther(w, "/settings/purge/confirm?"+url.Values{
+			"start": {r.Form.Get("start")},
+			"end":   {r.Form.Get("end")},
+			"path":  {r.Form.Get("path")},
+		}.Encode())
+	}
+
+	err := p.Insert(r.Context())
+	if err != nil {
+		return err
+	}
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.MustRunFunction(fmt.Sprintf("purge-range:%d", p.SiteID), func() { p.Run(ctx) })
+
+	zhttp.Flash(w, T(r.Context(), "notify/purge-started|Started in the background; the progress is shown below."))
+	return zhttp.SeeOther(w, "/settings/purge#purge-range")
+}
+
+func (h settings) purgeDo(w http.ResponseWriter, r *http.Request) error {
+	paths, err := zint.Split(r.Form.Get("paths"), ",")
+	if err != nil {
+		return err
+	}
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("purge:%d", Site(ctx).ID), func() {
+		var list goatcounter.Hits
+		err := list.Purge(ctx, paths)
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/started-background-process|Started in the background; may take about 10-20 seconds to fully process."))
+	return zhttp.SeeOther(w, "/settings/purge")
+}
+
+func (h settings) purgeRef(w http.ResponseWriter, r *http.Request) error {
+	p := goatcounter.RefPurge{
+		Ref:    r.Form.Get("ref"),
+		Domain: r.Form.Get("ref-domain") == "on",
+		Delete: r.Form.Get("ref-action") == "delete",
+	}
+	err := p.Validate(r.Context())
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditRefPurge, p.Ref, nil, p)
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("purge-ref:%d", Site(ctx).ID), func() {
+		err := p.Run(ctx)
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/started-background-process|Started in the background; may take about 10-20 seconds to fully process."))
+	return zhttp.SeeOther(w, "/settings/purge")
+}
+
+func (h settings) merge(w http.ResponseWriter, r *http.Request) error {
+	paths, err := zint.Split(r.Form.Get("paths"), ",")
+	if err != nil {
+		return err
+	}
+
+	v := goatcounter.NewValidate(r.Context())
+	dst := v.Integer("merge_with", r.Form.Get("merge_with"))
+	if v.HasErrors() {
+		return v
+	}
+	paths = slices.DeleteFunc(paths, func(p int64) bool { return p == dst })
+
+	var list goatcounter.Hits
+	err = list.CheckMerge(r.Context(), paths)
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+		return zhttp.SeeOther(w, "/settings/purge")
+	}
+
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("merge:%d", Site(ctx).ID), func() {
+		var list goatcounter.Hits
+		err := list.Merge(ctx, dst, paths)
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/started-background-process|Started in the background; may take about 10-20 seconds to fully process."))
+	return zhttp.SeeOther(w, "/settings/purge")
+}
+
+func (h settings) recalcSessions(w http.ResponseWriter, r *http.Request) error {
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("recalc-sessions:%d", Site(ctx).ID), func() {
+		err := cron.SessionStatsFromHits(ctx, *Site(ctx))
+		if err != nil {
+			zlog.Error(err)
+		}
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/started-background-process|Started in the background; may take about 10-20 seconds to fully process."))
+	return zhttp.SeeOther(w, "/settings/purge")
+}
+
+func (h settings) share(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var links goatcounter.ShareLinks
+		err := links.List(r.Context())
 		if err != nil {
 			return err
 		}
-	}
 
-	zhttp.Flash(w, T(r.Context(), "notify/settings-copied-to-site|Settings copied to the selected sites."))
-	return zhttp.SeeOther(w, "/settings/sites")
+		return zhttp.Template(w, "settings_share.gohtml", struct {
+			Globals
+			Validate   *zvalidate.Validator
+			ShareLinks goatcounter.ShareLinks
+		}{newGlobals(w, r), verr, links})
+	}
 }
 
-func (h settings) purge(w http.ResponseWriter, r *http.Request) error {
-	var (
-		path       = strings.TrimSpace(r.URL.Query().Get("path"))
-		matchTitle = r.URL.Query().Get("match-title") == "on"
-		matchCase  = r.URL.Query().Get("match-case") == "on"
-		list       goatcounter.HitLists
-		paths      goatcounter.Paths
-	)
+func (h settings) shareAdd(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Name    string `json:"name"`
+		Filter  string `json:"filter"`
+		Expires int    `json:"expires"` // In days; 0 is never.
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
 
-	if path != "" {
-		err := list.ListPathsLike(r.Context(), path, matchTitle, matchCase)
-		if err != nil {
-			return err
+	l := goatcounter.ShareLink{Name: args.Name, Filter: strings.TrimSpace(args.Filter)}
+	if args.Expires > 0 {
+		l.ExpiresAt = ztype.Ptr(ztime.Now().Add(time.Duration(args.Expires) * 24 * time.Hour))
+	}
+	err = l.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			return h.share(vErr)(w, r)
 		}
+		return err
+	}
 
-		_, err = paths.List(r.Context(), goatcounter.MustGetSite(r.Context()).ID, 0, 5_000)
+	goatcounter.Audit(r.Context(), goatcounter.AuditShareLinkCreate, l.Name, nil, l)
+
+	zhttp.Flash(w, T(r.Context(), "notify/share-link-created|Share link created."))
+	return zhttp.SeeOther(w, "/settings/share")
+}
+
+func (h settings) shareRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var l goatcounter.ShareLink
+	err := l.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = l.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	goatcounter.Audit(r.Context(), goatcounter.AuditShareLinkRevoke, l.Name, l, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/share-link-removed|Share link removed."))
+	return zhttp.SeeOther(w, "/settings/share")
+}
+
+func (h settings) alerts(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var rules goatcounter.AlertRules
+		err := rules.List(r.Context())
 		if err != nil {
 			return err
 		}
-	}
 
-	return zhttp.Template(w, "settings_purge.gohtml", struct {
-		Globals
-		PurgePath  string
-		MatchTitle bool
-		MatchCase  bool
-		List       goatcounter.HitLists
-		AllPaths   goatcounter.Paths
-	}{newGlobals(w, r), path, matchTitle, matchCase, list, paths})
+		return zhttp.Template(w, "settings_alerts.gohtml", struct {
+			Globals
+			Validate            *zvalidate.Validator
+			AlertRules          goatcounter.AlertRules
+			AlertNoDataBaseline int
+		}{newGlobals(w, r), verr, rules, goatcounter.AlertNoDataBaseline})
+	}
 }
 
-func (h settings) purgeDo(w http.ResponseWriter, r *http.Request) error {
-	paths, err := zint.Split(r.Form.Get("paths"), ",")
+func (h settings) alertAdd(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Kind      string  `json:"kind"`
+		Threshold float64 `json:"threshold"`
+		Cooldown  int     `json:"cooldown"`
+		Webhook   bool    `json:"webhook"`
+	}
+	_, err := zhttp.Decode(r, &args)
 	if err != nil {
 		return err
 	}
 
-	ctx := goatcounter.CopyContextValues(r.Context())
-	bgrun.RunFunction(fmt.Sprintf("purge:%d", Site(ctx).ID), func() {
-		var list goatcounter.Hits
-		err := list.Purge(ctx, paths)
-		if err != nil {
-			zlog.Error(err)
+	rule := goatcounter.AlertRule{
+		Kind:      args.Kind,
+		Threshold: args.Threshold,
+		Cooldown:  args.Cooldown,
+		Webhook:   zbool.Bool(args.Webhook),
+	}
+	err = rule.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			return h.alerts(vErr)(w, r)
 		}
-	})
+		return err
+	}
 
-	zhttp.Flash(w, T(r.Context(), "notify/started-background-process|Started in the background; may take about 10-20 seconds to fully process."))
-	return zhttp.SeeOther(w, "/settings/purge")
+	zhttp.Flash(w, T(r.Context(), "notify/alert-added|Alert added."))
+	return zhttp.SeeOther(w, "/settings/alerts")
 }
 
-func (h settings) merge(w http.ResponseWriter, r *http.Request) error {
-	paths, err := zint.Split(r.Form.Get("paths"), ",")
+func (h settings) alertRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var rule goatcounter.AlertRule
+	err := rule.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = rule.Delete(r.Context())
 	if err != nil {
 		return err
 	}
 
+	zhttp.Flash(w, T(r.Context(), "notify/alert-removed|Alert removed."))
+	return zhttp.SeeOther(w, "/settings/alerts")
+}
+
+func (h settings) alertTest(w http.ResponseWriter, r *http.Request) error {
 	v := goatcounter.NewValidate(r.Context())
-	dst := v.Integer("merge_with", r.Form.Get("merge_with"))
+	id := v.Integer("id", chi.URLParam(r, "id"))
 	if v.HasErrors() {
 		return v
 	}
-	paths = slices.DeleteFunc(paths, func(p int64) bool { return p == dst })
 
-	ctx := goatcounter.CopyContextValues(r.Context())
-	bgrun.RunFunction(fmt.Sprintf("merge:%d", Site(ctx).ID), func() {
-		var list goatcounter.Hits
-		err := list.Merge(ctx, dst, paths)
-		if err != nil {
-			zlog.Error(err)
-		}
-	})
+	var rule goatcounter.AlertRule
+	err := rule.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	check, err := rule.Check(r.Context(), ztime.Now())
+	if err != nil {
+		return err
+	}
+	err = cron.FireAlert(r.Context(), rule, check, true)
+	if err != nil {
+		return err
+	}
 
-	zhttp.Flash(w, T(r.Context(), "notify/started-background-process|Started in the background; may take about 10-20 seconds to fully process."))
-	return zhttp.SeeOther(w, "/settings/purge")
+	zhttp.Flash(w, T(r.Context(), "notify/alert-test-sent|Test alert sent."))
+	return zhttp.SeeOther(w, "/settings/alerts")
 }
 
 func (h settings) export(verr *zvalidate.Validator) zhttp.HandlerFunc {
@@ -612,7 +1485,7 @@ func (h settings) exportImport(w http.ResponseWriter, r *http.Request) error {
 				cron.WaitPersistAndStat()
 			}
 		})
-		if err != nil {
+		if err != nil && user.Settings.Notify(goatcounter.NotifyExports) {
 			if e, ok := err.(*errors.StackErr); ok {
 				err = e.Unwrap()
 			}
@@ -697,11 +1570,18 @@ func (h settings) users(verr *zvalidate.Validator) zhttp.HandlerFunc {
 			return err
 		}
 
+		var invites goatcounter.Invites
+		err = invites.ListPending(r.Context())
+		if err != nil {
+			return err
+		}
+
 		return zhttp.Template(w, "settings_users.gohtml", struct {
 			Globals
 			Users    goatcounter.Users
+			Invites  goatcounter.Invites
 			Validate *zvalidate.Validator
-		}{newGlobals(w, r), users, verr})
+		}{newGlobals(w, r), users, invites, verr})
 	}
 }
 
@@ -738,16 +1618,29 @@ func (h settings) usersForm(newUser *goatcounter.User, pErr error) zhttp.Handler
 			w.WriteHeader(code)
 		}
 
+		var sites goatcounter.Sites
+		err := sites.ForThisAccount(r.Context(), false)
+		if err != nil {
+			return err
+		}
+
 		return zhttp.Template(w, "settings_users_form.gohtml", struct {
 			Globals
 			NewUser  goatcounter.User
 			Validate *zvalidate.Validator
 			Error    error
 			Edit     bool
-		}{newGlobals(w, r), *newUser, vErr, pErr, edit})
+			Sites    goatcounter.Sites
+		}{newGlobals(w, r), *newUser, vErr, pErr, edit, sites})
 	}
 }
 
+// auditUser is what's recorded in the audit log for changes to users.
+type auditUser struct {
+	Email  string                   `json:"email"`
+	Access goatcounter.UserAccesses `json:"access"`
+}
+
 func (h settings) usersAdd(w http.ResponseWriter, r *http.Request) error {
 	var args struct {
 		Email    string                   `json:"email"`
@@ -759,7 +1652,14 @@ func (h settings) usersAdd(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	// Empty per-site values mean "use the default for all sites".
+	maps.DeleteFunc(args.Access, func(k string, a goatcounter.UserAccess) bool { return a == "" })
+
 	account := Account(r.Context())
+	err = h.checkAccess(r.Context(), args.Access, nil)
+	if err != nil {
+		return err
+	}
 
 	newUser := goatcounter.User{
 		Email:  args.Email,
@@ -786,6 +1686,8 @@ func (h settings) usersAdd(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return h.usersForm(&newUser, err)(w, r)
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserCreate, newUser.Email, nil,
+		auditUser{newUser.Email, newUser.Access})
 
 	ctx := goatcounter.CopyContextValues(r.Context())
 	bgrun.RunFunction(fmt.Sprintf("adduser:%d", newUser.ID), func() {
@@ -820,9 +1722,7 @@ func (h settings) usersEdit(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	if args.Access["all"] == goatcounter.AccessSuperuser && !User(r.Context()).AccessSuperuser() {
-		return guru.New(400, "can't set 'superuser' if you're not a superuser yourself.")
-	}
+	maps.DeleteFunc(args.Access, func(k string, a goatcounter.UserAccess) bool { return a == "" })
 
 	var editUser goatcounter.User
 	err = editUser.ByID(r.Context(), id)
@@ -834,7 +1734,12 @@ func (h settings) usersEdit(w http.ResponseWriter, r *http.Request) error {
 	if account.ID != editUser.Site {
 		return guru.New(404, T(r.Context(), "notify/not-found|Not Found"))
 	}
+	err = h.checkAccess(r.Context(), args.Access, &editUser)
+	if err != nil {
+		return err
+	}
 
+	old := goatcounter.AuditSnapshot(auditUser{editUser.Email, editUser.Access})
 	emailChanged := editUser.Email != args.Email
 	editUser.Email = args.Email
 	editUser.Access = args.Access
@@ -856,11 +1761,65 @@ func (h settings) usersEdit(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return h.usersForm(&editUser, err)(w, r)
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserUpdate, editUser.Email, old,
+		auditUser{editUser.Email, editUser.Access})
+	if args.Password != "" {
+		goatcounter.Audit(r.Context(), goatcounter.AuditUserPassword, editUser.Email, nil, nil)
+	}
 
 	zhttp.Flash(w, T(r.Context(), "notify/users-edited|User ‘%(email)’ edited.", editUser.Email))
 	return zhttp.SeeOther(w, "/settings/users")
 }
 
+// checkAccess checks if the current user can set the access for a user, and
+// edit or remove the user in editUser.
+//
+// Only owners can add, change, or remove owners, and only superusers can do so
+// for superusers. The access for a site can only be set for sites in this
+// account.
+func (h settings) checkAccess(ctx context.Context, access goatcounter.UserAccesses, editUser *goatcounter.User) error {
+	cur := User(ctx)
+	check := []goatcounter.UserAccess{access["all"]}
+	if editUser != nil {
+		check = append(check, editUser.Access["all"])
+	}
+	for _, a := range check {
+		if a == goatcounter.AccessSuperuser && !cur.AccessSuperuser() {
+			return guru.New(403, "can't set or change 'superuser' if you're not a superuser yourself.")
+		}
+		if a == goatcounter.AccessOwner && !cur.AccessOwner() {
+			return guru.New(403, "can't set or change 'owner' if you're not an owner yourself.")
+		}
+	}
+
+	if editUser != nil && access != nil && editUser.AccessOwner() && access["all"] != editUser.Access["all"] {
+		var users goatcounter.Users
+		err := users.List(ctx, editUser.Site)
+		if err != nil {
+			return err
+		}
+		if o := users.Owners(); len(o) == 1 && o[0].ID == editUser.ID {
+			return guru.New(400, "can't change the access for the last owner.")
+		}
+	}
+
+	if len(access) > 1 {
+		var sites goatcounter.Sites
+		err := sites.ForThisAccount(ctx, false)
+		if err != nil {
+			return err
+		}
+		for k := range access {
+			if k != "all" && !slices.ContainsFunc(sites, func(s goatcounter.Site) bool {
+				return strconv.FormatInt(s.ID, 10) == k
+			}) {
+				return guru.Errorf(400, "unknown site: %q", k)
+			}
+		}
+	}
+	return nil
+}
+
 func (h settings) usersRemove(w http.ResponseWriter, r *http.Request) error {
 	v := goatcounter.NewValidate(r.Context())
 	id := v.Integer("id", chi.URLParam(r, "id"))
@@ -879,28 +1838,191 @@ func (h settings) usersRemove(w http.ResponseWriter, r *http.Request) error {
 	if user.Site != account.ID {
 		return guru.New(404, T(r.Context(), "error/not-found|Not Found"))
 	}
+	err = h.checkAccess(r.Context(), nil, &user)
+	if err != nil {
+		return err
+	}
 
 	err = user.Delete(r.Context(), false)
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserDelete, user.Email,
+		auditUser{user.Email, user.Access}, nil)
 
 	zhttp.Flash(w, T(r.Context(), "notify/user-removed|User ‘%(email)’ removed.", user.Email))
 	return zhttp.SeeOther(w, "/settings/users")
 }
 
+func (h settings) usersInviteForm(inv *goatcounter.Invite, pErr error) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if inv == nil {
+			inv = &goatcounter.Invite{
+				Access: goatcounter.UserAccesses{"all": goatcounter.AccessReadOnly},
+			}
+		}
+
+		var vErr *zvalidate.Validator
+		if errors.As(pErr, &vErr) {
+			pErr = nil
+		}
+		if pErr != nil {
+			zlog.Error(pErr)
+			var code int
+			code, pErr = zhttp.UserError(pErr)
+			w.WriteHeader(code)
+		}
+
+		return zhttp.Template(w, "settings_users_invite.gohtml", struct {
+			Globals
+			Invite   goatcounter.Invite
+			Validate *zvalidate.Validator
+			Error    error
+		}{newGlobals(w, r), *inv, vErr, pErr})
+	}
+}
+
+func (h settings) usersInvite(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		Email  string                   `json:"email"`
+		Access goatcounter.UserAccesses `json:"access"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	err = h.checkAccess(r.Context(), args.Access, nil)
+	if err != nil {
+		return err
+	}
+
+	inv := goatcounter.Invite{Email: args.Email, Access: args.Access}
+	err = inv.Insert(r.Context())
+	if err != nil {
+		return h.usersInviteForm(&inv, err)(w, r)
+	}
+	existing, err := inv.ExistingUser(r.Context())
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditInviteCreate, inv.Email, nil,
+		auditUser{inv.Email, inv.Access})
+
+	account := Account(r.Context())
+	ctx := goatcounter.CopyContextValues(r.Context())
+	bgrun.RunFunction(fmt.Sprintf("invite:%d", inv.ID), func() {
+		err := blackmail.Send(fmt.Sprintf("You've been invited to GoatCounter at %s", account.Display(ctx)),
+			blackmail.From("GoatCounter", goatcounter.Config(ctx).EmailFrom),
+			blackmail.To(inv.Email),
+			blackmail.BodyMustText(goatcounter.TplEmailInvite{ctx, *account, inv, goatcounter.GetUser(ctx).Email, existing != nil}.Render),
+		)
+		if err != nil {
+			zlog.Errorf(": %s", err)
+		}
+	})
+
+	zhttp.Flash(w, T(r.Context(), "notify/user-invited|Invite sent to ‘%(email)’.", inv.Email))
+	return zhttp.SeeOther(w, "/settings/users")
+}
+
+func (h settings) usersInviteRevoke(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var inv goatcounter.Invite
+	err := inv.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = inv.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditInviteRevoke, inv.Email, nil, nil)
+
+	zhttp.Flash(w, T(r.Context(), "notify/invite-revoked|Invite for ‘%(email)’ revoked.", inv.Email))
+	return zhttp.SeeOther(w, "/settings/users")
+}
+
+func (h settings) audit(w http.ResponseWriter, r *http.Request) error {
+	var (
+		v      = goatcounter.NewValidate(r.Context())
+		q      = r.URL.Query()
+		action = q.Get("action")
+		actor  int64
+		before int64
+	)
+	if q.Get("actor") != "" {
+		actor = v.Integer("actor", q.Get("actor"))
+	}
+	if q.Get("before") != "" {
+		before = v.Integer("before", q.Get("before"))
+	}
+	if action != "" {
+		v.Include("action", action, goatcounter.AuditActions)
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	var entries goatcounter.AuditEntries
+	more, err := entries.List(r.Context(), actor, action, before, 100)
+	if err != nil {
+		return err
+	}
+
+	if more {
+		before = entries[len(entries)-1].ID
+	}
+
+	var users goatcounter.Users
+	err = users.List(r.Context(), Account(r.Context()).ID)
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "settings_audit.gohtml", struct {
+		Globals
+		Entries goatcounter.AuditEntries
+		More    bool
+		Before  int64
+		Users   goatcounter.Users
+		Actions []string
+		Actor   int64
+		Action  string
+	}{newGlobals(w, r), entries, more, before, users, goatcounter.AuditActions, actor, action})
+}
+
 func (h settings) bosmang(w http.ResponseWriter, r *http.Request) error {
 	info, _ := zdb.Info(r.Context())
+	var emails goatcounter.QueuedEmails
+	err := emails.ListUnsent(r.Context())
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, e := range emails {
+		if e.FailedAt != nil {
+			failed++
+		}
+	}
+
 	return zhttp.Template(w, "settings_server.gohtml", struct {
 		Globals
-		Uptime   string
-		Version  string
-		Database string
-		Go       string
-		GOOS     string
-		GOARCH   string
-		Race     bool
-		Cgo      bool
+		Uptime       string
+		Version      string
+		Database     string
+		Go           string
+		GOOS         string
+		GOARCH       string
+		Race         bool
+		Cgo          bool
+		FailedEmails int
+		BotData      goatcounter.BotDataStatus
 	}{newGlobals(w, r),
 		ztime.Now().Sub(Started).Round(time.Second).String(),
 		goatcounter.Version,
@@ -910,5 +2032,7 @@ func (h settings) bosmang(w http.ResponseWriter, r *http.Request) error {
 		runtime.GOARCH,
 		zruntime.Race,
 		zruntime.CGO,
+		failed,
+		goatcounter.BotDataInfo(),
 	})
 }
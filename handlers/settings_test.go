@@ -35,6 +35,34 @@ func TestSettingsTpl(t *testing.T) {
 			wantCode: 200,
 			wantBody: "<tr><td>2</td><td>/asd</td><td>AAA</td></tr>",
 		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+				gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+					{FirstVisit: true, Site: 1, Path: "/asd", Ref: "https://spam.example.com/a", CreatedAt: now},
+					{FirstVisit: true, Site: 1, Path: "/asd", Ref: "https://example.org", CreatedAt: now},
+				}...)
+			},
+			router:   newBackend,
+			path:     "/settings/purge?ref=example.com&ref-domain=on",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<tr><td>2019-08-31</td><td>1</td><td>1</td></tr>",
+		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+				gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+					{FirstVisit: true, Site: 1, Path: "/asd", CreatedAt: now},
+					{FirstVisit: true, Site: 1, Path: "/zxc", CreatedAt: now},
+				}...)
+			},
+			router:   newBackend,
+			path:     "/settings/purge/confirm?start=2019-08-31&end=2019-08-31&path=/asd",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "<li>/asd</li>",
+		},
 
 		{
 			setup: func(ctx context.Context, t *testing.T) {
@@ -54,6 +82,18 @@ func TestSettingsTpl(t *testing.T) {
 			wantCode: 200,
 			wantBody: "Are you sure you want to remove the site",
 		},
+		{
+			setup: func(ctx context.Context, t *testing.T) {
+				gctest.StoreHits(ctx, t, false, []goatcounter.Hit{
+					{FirstVisit: true, Site: 1, Path: "/asd", CreatedAt: time.Now().UTC().AddDate(0, 0, -60)},
+				}...)
+			},
+			router:   newBackend,
+			path:     "/settings/main/retention-preview?data_retention=31&retention_mode=all",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "rows of stats will be removed",
+		},
 	}
 
 	for _, tt := range tests {
@@ -308,3 +348,154 @@ func TestSettingsSitesRemove(t *testing.T) {
 		})
 	}
 }
+
+func TestSettingsAccess(t *testing.T) {
+	setAccess := func(a goatcounter.UserAccesses) func(context.Context, *testing.T) {
+		return func(ctx context.Context, t *testing.T) {
+			u := goatcounter.MustGetUser(ctx)
+			u.Access = a
+			err := u.Update(ctx, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []handlerTest{
+		{
+			name:         "viewer can't change settings",
+			setup:        setAccess(goatcounter.UserAccesses{"all": goatcounter.AccessReadOnly}),
+			router:       newBackend,
+			path:         "/settings/purge",
+			method:       "POST",
+			body:         map[string]string{"paths": "1,"},
+			auth:         true,
+			wantCode:     403,
+			wantFormCode: 403,
+		},
+		{
+			name:     "viewer can't export",
+			setup:    setAccess(goatcounter.UserAccesses{"all": goatcounter.AccessReadOnly}),
+			router:   newBackend,
+			path:     "/settings/export",
+			auth:     true,
+			wantCode: 403,
+		},
+		{
+			name:         "viewer for this site",
+			setup:        setAccess(goatcounter.UserAccesses{"all": goatcounter.AccessAdmin, "1": goatcounter.AccessReadOnly}),
+			router:       newBackend,
+			path:         "/settings/purge",
+			method:       "POST",
+			body:         map[string]string{"paths": "1,"},
+			auth:         true,
+			wantCode:     403,
+			wantFormCode: 403,
+		},
+		{
+			name:     "editor can't manage users",
+			setup:    setAccess(goatcounter.UserAccesses{"all": goatcounter.AccessSettings}),
+			router:   newBackend,
+			path:     "/settings/users",
+			auth:     true,
+			wantCode: 403,
+		},
+		{
+			name:     "admin can't delete account",
+			setup:    setAccess(goatcounter.UserAccesses{"all": goatcounter.AccessAdmin}),
+			router:   newBackend,
+			path:     "/settings/delete-account",
+			auth:     true,
+			wantCode: 403,
+		},
+		{
+			name:     "owner can delete account",
+			router:   newBackend,
+			path:     "/settings/delete-account",
+			auth:     true,
+			wantCode: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
+func TestSettingsShareAudit(t *testing.T) {
+	tests := []handlerTest{
+		{
+			name:         "create",
+			router:       newBackend,
+			path:         "/settings/share",
+			body:         map[string]string{"name": "blog", "filter": "/blog"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		},
+		{
+			name: "revoke",
+			setup: func(ctx context.Context, t *testing.T) {
+				l := goatcounter.ShareLink{Name: "blog"}
+				err := l.Insert(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:       newBackend,
+			path:         "/settings/share/remove/1",
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			var entries goatcounter.AuditEntries
+			_, err := entries.List(r.Context(), 0, "", 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("len(entries) = %d\n%v", len(entries), entries)
+			}
+			want := goatcounter.AuditShareLinkCreate
+			if tt.name == "revoke" {
+				want = goatcounter.AuditShareLinkRevoke
+			}
+			if e := entries[0]; e.Action != want || e.Target != "blog" {
+				t.Errorf("wrong entry: %#v", e)
+			}
+			if _, ok := entries[0].Diff["token"]; ok {
+				t.Error("token in diff")
+			}
+		})
+	}
+}
+
+func TestSettingsWebhooks(t *testing.T) {
+	tests := []handlerTest{
+		{
+			router:       newBackend,
+			path:         "/user/webhooks",
+			body:         map[string]string{"url": "https://example.com/hook"},
+			method:       "POST",
+			auth:         true,
+			wantFormCode: 303,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			var hooks goatcounter.Webhooks
+			err := hooks.ListUser(r.Context(), *goatcounter.MustGetUser(r.Context()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hooks) != 1 || hooks[0].URL != "https://example.com/hook" || len(hooks[0].Secret) < 10 {
+				t.Errorf("wrong webhooks: %#v", hooks)
+			}
+		})
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"zgo.at/errors"
@@ -18,32 +21,54 @@ import (
 	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
+	"zgo.at/zstd/zint"
 	"zgo.at/zstd/ztime"
 	"zgo.at/zvalidate"
 )
 
 func (h settings) userPref(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		u := goatcounter.MustGetUser(r.Context())
+
+		var change *goatcounter.EmailChange
+		{
+			var c goatcounter.EmailChange
+			err := c.ByUser(r.Context(), u.ID)
+			if err != nil && !zdb.ErrNoRows(err) {
+				return err
+			}
+			if err == nil && !c.Expired() {
+				change = &c
+			}
+		}
+
+		view, _ := u.Settings.Views.Get("default")
 		return zhttp.Template(w, "user_pref.gohtml", struct {
 			Globals
 			Validate           *zvalidate.Validator
 			Timezones          []*tz.Zone
 			FewerNumbersLocked bool
+			EmailChange        *goatcounter.EmailChange
+			View               goatcounter.View
+			CustomPeriod       bool
 		}{newGlobals(w, r), verr, tz.Zones,
-			goatcounter.MustGetUser(r.Context()).Settings.FewerNumbersLockUntil.After(ztime.Now())})
+			u.Settings.FewerNumbersLockUntil.After(ztime.Now()), change,
+			view, !slices.Contains(goatcounter.ViewPeriods, view.Period) && view.Period != "30" && view.Period != "90"})
 	}
 }
 
 func (h settings) userPrefSave(w http.ResponseWriter, r *http.Request) error {
+	view, _ := User(r.Context()).Settings.Views.Get("default")
 	args := struct {
 		User             goatcounter.User `json:"user"`
 		SetSite          bool             `json:"set_site"`
 		FewerNumbersLock string           `json:"fewer_numbers_lock"`
 		Theme            string           `json:"theme"`
-	}{*User(r.Context()), false, "", ""}
+		DefaultPeriod    string           `json:"default_period"`
+		DefaultGroup     string           `json:"default_group"`
+	}{*User(r.Context()), false, "", "", view.Period, view.Group}
 	var (
 		oldEmail     = args.User.Email
-		oldReports   = args.User.Settings.EmailReports
 		oldFewerNums = args.User.Settings.FewerNumbers
 	)
 	_, err := zhttp.Decode(r, &args)
@@ -53,6 +78,14 @@ func (h settings) userPrefSave(w http.ResponseWriter, r *http.Request) error {
 
 	args.User.Settings.Theme = args.Theme
 
+	// The default period and grouping are stored in the default view, which
+	// can also be saved from the dashboard.
+	if _, i := args.User.Settings.Views.Get("default"); i > -1 {
+		views := slices.Clone(args.User.Settings.Views)
+		views[i].Period, views[i].Group = args.DefaultPeriod, args.DefaultGroup
+		args.User.Settings.Views = views
+	}
+
 	if oldFewerNums && !args.User.Settings.FewerNumbers && args.User.Settings.FewerNumbersLockUntil.After(ztime.Now()) {
 		zhttp.FlashError(w, "Nice try")
 		return zhttp.SeeOther(w, "/user/pref")
@@ -66,19 +99,26 @@ func (h settings) userPrefSave(w http.ResponseWriter, r *http.Request) error {
 			Time
 	}
 
-	var (
-		emailChanged     = goatcounter.Config(r.Context()).GoatcounterCom && oldEmail != args.User.Email
-		reportingChanged = goatcounter.Config(r.Context()).GoatcounterCom && oldReports != args.User.Settings.EmailReports
-	)
-	if reportingChanged {
-		args.User.LastReportAt = ztime.Now()
+	// The email isn't changed until it's confirmed from the new address; the
+	// old address can still be used until then. Changing just the case is
+	// fine.
+	var change *goatcounter.EmailChange
+	if !strings.EqualFold(strings.TrimSpace(args.User.Email), oldEmail) {
+		change = &goatcounter.EmailChange{UserID: args.User.ID, Email: args.User.Email, OldEmail: oldEmail}
+		args.User.Email = oldEmail
 	}
 
 	err = zdb.TX(r.Context(), func(ctx context.Context) error {
-		err = args.User.Update(ctx, emailChanged)
+		err = args.User.Update(ctx, false)
 		if err != nil {
 			return err
 		}
+		if change != nil {
+			err = change.Insert(ctx)
+			if err != nil {
+				return err
+			}
+		}
 		if args.User.AccessSettings() && args.SetSite {
 			s := Site(ctx)
 			s.UserDefaults = args.User.Settings
@@ -94,14 +134,195 @@ func (h settings) userPrefSave(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	if emailChanged {
-		sendEmailVerify(r.Context(), Site(r.Context()), &args.User, goatcounter.Config(r.Context()).EmailFrom)
+	if change != nil {
+		sendEmailChange(r.Context(), Site(r.Context()), *change, goatcounter.Config(r.Context()).EmailFrom)
+		zhttp.Flash(w, T(r.Context(),
+			"notify/email-change-sent|Saved! Your email address will be changed once you click the link sent to %(email).",
+			change.Email))
+		return zhttp.SeeOther(w, "/user/pref")
 	}
 
 	zhttp.Flash(w, T(r.Context(), "notify/saved|Saved!"))
 	return zhttp.SeeOther(w, "/user/pref")
 }
 
+func (h settings) userNotifications(verr *zvalidate.Validator) zhttp.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var (
+			u         = goatcounter.MustGetUser(r.Context())
+			hours     = make([]string, 24)
+			monthdays = make([]int, 28)
+			day       = ztime.Now().In(u.Settings.Timezone.Loc())
+		)
+		for i := range hours {
+			hours[i] = u.Settings.FormatTime(time.Date(day.Year(), day.Month(), day.Day(), i, 0, 0, 0, day.Location()))
+		}
+		for i := range monthdays {
+			monthdays[i] = i + 1
+		}
+
+		var (
+			hooks      goatcounter.Webhooks
+			deliveries goatcounter.WebhookDeliveries
+			sites      goatcounter.Sites
+		)
+		err := hooks.ListUser(r.Context(), *u)
+		if err != nil {
+			return err
+		}
+		err = deliveries.List(r.Context(), hooks)
+		if err != nil {
+			return err
+		}
+		err = sites.ForThisAccount(r.Context(), false)
+		if err != nil {
+			return err
+		}
+
+		return zhttp.Template(w, "user_notifications.gohtml", struct {
+			Globals
+			Validate    *zvalidate.Validator
+			Hours       []string
+			Monthdays   []int
+			Webhooks    goatcounter.Webhooks
+			Deliveries  goatcounter.WebhookDeliveries
+			MaxFailures int
+			Sites       goatcounter.Sites
+		}{newGlobals(w, r), verr, hours, monthdays, hooks, deliveries, goatcounter.WebhookMaxFailures, sites})
+	}
+}
+
+func (h settings) userNotificationsSave(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		EmailReports        zint.Int `json:"email_reports"`
+		EmailReportWeekday  string   `json:"email_report_weekday"`
+		EmailReportMonthday int      `json:"email_report_monthday"`
+		EmailReportHour     int      `json:"email_report_hour"`
+		WebhookOnly         bool     `json:"email_reports_webhook_only"`
+		Digest              bool     `json:"email_reports_digest"`
+		DigestSites         []int64  `json:"digest_sites"`
+		Notify              []string `json:"notify"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	user := *User(r.Context())
+	if goatcounter.Config(r.Context()).GoatcounterCom && user.Settings.EmailReports != args.EmailReports {
+		user.LastReportAt = ztime.Now()
+	}
+	user.Settings.EmailReports = args.EmailReports
+	user.Settings.EmailReportWeekday = args.EmailReportWeekday
+	user.Settings.EmailReportMonthday = args.EmailReportMonthday
+	user.Settings.EmailReportHour = args.EmailReportHour
+	user.Settings.EmailReportsWebhookOnly = args.WebhookOnly
+	user.Settings.EmailReportsDigest = args.Digest
+
+	// Same as the notifications: store the excluded sites, so that new sites
+	// are in the digest by default.
+	var sites goatcounter.Sites
+	err = sites.ForThisAccount(r.Context(), false)
+	if err != nil {
+		return err
+	}
+	if len(sites) > 1 { // The list isn't shown with just one site.
+		user.Settings.EmailReportsExclude = make([]int64, 0, len(sites))
+		for _, s := range sites {
+			if !slices.Contains(args.DigestSites, s.ID) {
+				user.Settings.EmailReportsExclude = append(user.Settings.EmailReportsExclude, s.ID)
+			}
+		}
+	}
+
+	// Store the disabled types rather than the enabled ones, so that new
+	// notification types are enabled by default.
+	off := make([]string, 0, len(goatcounter.NotifyTypes))
+	for _, n := range goatcounter.NotifyTypes {
+		if !slices.Contains(args.Notify, n) {
+			off = append(off, n)
+		}
+	}
+	user.Settings.Notifications.Off = off
+
+	err = user.Update(r.Context(), false)
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			return h.userNotifications(vErr)(w, r)
+		}
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/saved|Saved!"))
+	return zhttp.SeeOther(w, "/user/notifications")
+}
+
+func (h settings) userWebhookAdd(w http.ResponseWriter, r *http.Request) error {
+	var args struct {
+		URL string `json:"url"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	hook := goatcounter.Webhook{URL: strings.TrimSpace(args.URL)}
+	err = hook.Insert(r.Context())
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			return h.userNotifications(vErr)(w, r)
+		}
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/webhook-added|Webhook added."))
+	return zhttp.SeeOther(w, "/user/notifications#webhooks")
+}
+
+func (h settings) userWebhookRemove(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var hook goatcounter.Webhook
+	err := hook.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = hook.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/webhook-removed|Webhook removed."))
+	return zhttp.SeeOther(w, "/user/notifications#webhooks")
+}
+
+func (h settings) userWebhookEnable(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var hook goatcounter.Webhook
+	err := hook.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = hook.Enable(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/webhook-enabled|Webhook enabled."))
+	return zhttp.SeeOther(w, "/user/notifications#webhooks")
+}
+
 func (h settings) userDashboardWidget(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.Template(w, "_user_dashboard_widgets.gohtml", struct {
 		Globals
@@ -262,10 +483,29 @@ func (h settings) userDashboardSave(w http.ResponseWriter, r *http.Request) erro
 
 func (h settings) userAuth(verr *zvalidate.Validator) zhttp.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		var passkeys goatcounter.Passkeys
+		err := passkeys.ListUser(r.Context(), User(r.Context()).ID)
+		if err != nil {
+			return err
+		}
+		var sessions goatcounter.LoginSessions
+		err = sessions.ListUser(r.Context(), User(r.Context()).ID)
+		if err != nil {
+			return err
+		}
+		var codes goatcounter.BackupCodes
+		err = codes.ListUser(r.Context(), User(r.Context()).ID)
+		if err != nil {
+			return err
+		}
+
 		return zhttp.Template(w, "user_auth.gohtml", struct {
 			Globals
-			Validate *zvalidate.Validator
-		}{newGlobals(w, r), verr})
+			Validate    *zvalidate.Validator
+			Passkeys    goatcounter.Passkeys
+			Sessions    goatcounter.LoginSessions
+			BackupCodes goatcounter.BackupCodes
+		}{newGlobals(w, r), verr, passkeys, sessions, codes})
 	}
 }
 
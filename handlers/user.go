@@ -42,8 +42,6 @@ type user struct{}
 
 func (h user) mount(r chi.Router) {
 	r.Get("/user/new", zhttp.Wrap(h.login))
-	r.Get("/user/forgot", zhttp.Wrap(h.forgot))
-	r.Post("/user/request-reset", zhttp.Wrap(h.requestReset))
 
 	// Rate limit login attempts.
 	rate := r.With(mware.Ratelimit(mware.RatelimitOptions{
@@ -51,22 +49,48 @@ func (h user) mount(r chi.Router) {
 		Store:  mware.NewRatelimitMemory(),
 		Limit:  rateLimits.login,
 	}))
-	rate.Post("/user/requestlogin", zhttp.Wrap(h.requestLogin))
 	r.Get("/user/requestlogin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Redirect, as panic()s and such can end up here.
 		zhttp.SeeOther(w, "/user/new")
 	}))
-	rate.Post("/user/totplogin", zhttp.Wrap(h.totpLogin))
-	rate.Get("/user/reset/{key}", zhttp.Wrap(h.reset))
 	rate.Get("/user/verify/{key}", zhttp.Wrap(h.verify))
-	rate.Post("/user/reset/{key}", zhttp.Wrap(h.doReset))
+	rate.Get("/user/email-change/{key}", zhttp.Wrap(h.emailChangeConfirm))
+	rate.Get("/user/email-change/cancel/{key}", zhttp.Wrap(h.emailChangeCancel))
+	rate.Get("/user/invite/{key}", zhttp.Wrap(h.invite))
+	rate.Post("/user/invite/{key}", zhttp.Wrap(h.acceptInvite))
+	rate.Get("/user/oidc", zhttp.Wrap(h.oidcLogin))
+	rate.Get("/user/oidc/callback", zhttp.Wrap(h.oidcCallback))
+
+	{ // Password and passkey logins.
+		local, localRate := r.With(localLogin), rate.With(localLogin)
+		local.Get("/user/forgot", zhttp.Wrap(h.forgot))
+		local.Post("/user/request-reset", zhttp.Wrap(h.requestReset))
+		localRate.Post("/user/requestlogin", zhttp.Wrap(h.requestLogin))
+		localRate.Post("/user/totplogin", zhttp.Wrap(h.totpLogin))
+		localRate.Get("/user/reset/{key}", zhttp.Wrap(h.reset))
+		localRate.Post("/user/reset/{key}", zhttp.Wrap(h.doReset))
+		localRate.Post("/user/passkey/login", zhttp.Wrap(h.passkeyLoginBegin))
+		localRate.Post("/user/passkey/login/finish", zhttp.Wrap(h.passkeyLogin))
+		localRate.Post("/user/passkey/mfa", zhttp.Wrap(h.passkeyMFABegin))
+		localRate.Post("/user/passkey/mfa/finish", zhttp.Wrap(h.passkeyMFA))
+	}
 
 	auth := r.With(loggedIn, addz18n())
 	auth.Post("/user/logout", zhttp.Wrap(h.logout))
-	auth.Post("/user/change-password", zhttp.Wrap(h.changePassword))
-	auth.Post("/user/disable-totp", zhttp.Wrap(h.disableTOTP))
-	auth.Post("/user/enable-totp", zhttp.Wrap(h.enableTOTP))
 	auth.Post("/user/resend-verify", zhttp.Wrap(h.resendVerify))
+	auth.Post("/user/email-change/cancel", zhttp.Wrap(h.emailChangeCancelPending))
+	auth.Post("/user/session/{id}/revoke", zhttp.Wrap(h.revokeSession))
+	auth.Post("/user/session/revoke-others", zhttp.Wrap(h.revokeOtherSessions))
+	{ // Password and passkey settings.
+		local := auth.With(localLogin)
+		local.Post("/user/change-password", zhttp.Wrap(h.changePassword))
+		local.Post("/user/disable-totp", zhttp.Wrap(h.disableTOTP))
+		local.Post("/user/enable-totp", zhttp.Wrap(h.enableTOTP))
+		local.Post("/user/backup-codes", zhttp.Wrap(h.backupCodes))
+		local.Post("/user/passkey/register", zhttp.Wrap(h.passkeyRegisterBegin))
+		local.Post("/user/passkey/register/finish", zhttp.Wrap(h.passkeyRegister))
+		local.Post("/user/passkey/{id}/delete", zhttp.Wrap(h.passkeyDelete))
+	}
 
 	admin := auth.With(requireAccess(goatcounter.AccessAdmin))
 	admin.Post("/user/api-token", zhttp.Wrap(h.newAPIToken))
@@ -187,18 +211,27 @@ func (h user) requestLogin(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
 	}
 
-	err = user.Login(r.Context())
+	var passkeys goatcounter.Passkeys
+	err = passkeys.ListUser(r.Context(), user.ID)
 	if err != nil {
 		return err
 	}
-
-	if user.TOTPEnabled {
-		return h.totpForm(w, r, *user.LoginToken,
+	if user.TOTPEnabled || len(passkeys) > 0 {
+		// The session can't be used until the second factor is verified.
+		err = user.LoginMFA(r.Context(), r.UserAgent(), r.RemoteAddr)
+		if err != nil {
+			return err
+		}
+		return h.totpForm(w, r, user, len(passkeys) > 0,
 			xsrftoken.Generate(*user.LoginToken, strconv.FormatInt(user.ID, 10), actionTOTP))
 	}
 
+	err = user.Login(r.Context(), r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		return err
+	}
 	auth.SetCookie(w, *user.LoginToken, cookieDomain(Site(r.Context()), r))
-	return zhttp.SeeOther(w, "/")
+	return zhttp.SeeOther(w, afterLogin(r.Context()))
 }
 
 func (h user) totpLogin(w http.ResponseWriter, r *http.Request) error {
@@ -213,8 +246,12 @@ func (h user) totpLogin(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	var u goatcounter.User
-	err = u.ByTokenAndSite(r.Context(), args.UserLoginToken)
+	err = u.ByMFAToken(r.Context(), args.UserLoginToken)
 	if err != nil {
+		if zdb.ErrNoRows(err) {
+			zhttp.Flash(w, T(r.Context(), "error/login-invalid|Invalid login"))
+			return zhttp.SeeOther(w, "/user/new")
+		}
 		return err
 	}
 
@@ -227,32 +264,74 @@ func (h user) totpLogin(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.SeeOther(w, "/user/new")
 	}
 
-	tokInt, err := strconv.ParseInt(args.Token, 10, 32)
-	if err != nil {
-		return err
+	// The user may only have passkeys.
+	if !u.TOTPEnabled {
+		zhttp.Flash(w, T(r.Context(), "error/login-invalid|Invalid login"))
+		return zhttp.SeeOther(w, "/user/new")
 	}
 
 	// Check a 30 second window on either side of the current time as well. It's
 	// common for clocks to be slightly out of sync and this prevents most
 	// errors and is what the spec recommends.
+	//
+	// Anything that's not a number is tried as a backup code.
 	if !testTOTP {
-		tokGen := otp.NewOTP(u.TOTPSecret, 6, sha1.New, otp.TOTP(30*time.Second, time.Now))
-		if tokGen(0, nil) != int32(tokInt) && tokGen(-1, nil) != int32(tokInt) && tokGen(1, nil) != int32(tokInt) {
+		var valid, backup bool
+		if tokInt, err := strconv.ParseInt(args.Token, 10, 32); err == nil {
+			tokGen := otp.NewOTP(u.TOTPSecret, 6, sha1.New, otp.TOTP(30*time.Second, time.Now))
+			valid = tokGen(0, nil) == int32(tokInt) || tokGen(-1, nil) == int32(tokInt) || tokGen(1, nil) == int32(tokInt)
+		} else {
+			valid, err = (&goatcounter.BackupCodes{}).Use(r.Context(), u.ID, args.Token)
+			if err != nil {
+				return err
+			}
+			backup = valid
+		}
+		if !valid {
+			var passkeys goatcounter.Passkeys
+			err := passkeys.ListUser(r.Context(), u.ID)
+			if err != nil {
+				return err
+			}
 			zhttp.FlashError(w, mfaError)
-			return h.totpForm(w, r, *u.LoginToken, args.LoginMAC)
+			return h.totpForm(w, r, u, len(passkeys) > 0, args.LoginMAC)
+		}
+		if backup {
+			sendBackupCodeUsed(r.Context(), Site(r.Context()), &u, goatcounter.Config(r.Context()).EmailFrom)
 		}
 	}
 
+	err = u.VerifyMFA(r.Context())
+	if err != nil {
+		return err
+	}
 	auth.SetCookie(w, *u.LoginToken, cookieDomain(Site(r.Context()), r))
-	return zhttp.SeeOther(w, "/")
+	return zhttp.SeeOther(w, afterLogin(r.Context()))
 }
 
-func (h user) totpForm(w http.ResponseWriter, r *http.Request, loginToken, loginMAC string) error {
+// afterLogin gets the page to redirect to after logging in: the overview of all
+// sites if the account has more than one site, or the dashboard otherwise.
+func afterLogin(ctx context.Context) string {
+	var sites goatcounter.Sites
+	err := sites.ForThisAccount(ctx, false)
+	if err != nil {
+		zlog.Error(err)
+		return "/"
+	}
+	if len(sites) > 1 {
+		return "/overview"
+	}
+	return "/"
+}
+
+func (h user) totpForm(w http.ResponseWriter, r *http.Request, u goatcounter.User, hasPasskeys bool, loginMAC string) error {
 	return zhttp.Template(w, "totp.gohtml", struct {
 		Globals
-		LoginToken string
-		LoginMAC   string
-	}{newGlobals(w, r), loginToken, loginMAC})
+		LoginToken  string
+		LoginMAC    string
+		HasTOTP     bool
+		HasPasskeys bool
+	}{newGlobals(w, r), *u.LoginToken, loginMAC, bool(u.TOTPEnabled), hasPasskeys})
 }
 
 func (h user) reset(w http.ResponseWriter, r *http.Request) error {
@@ -290,6 +369,7 @@ func (h user) doReset(w http.ResponseWriter, r *http.Request) error {
 	var args struct {
 		Password  string `json:"password"`
 		Password2 string `json:"password2"`
+		RemoveMFA bool   `json:"remove_mfa"`
 	}
 	_, err = zhttp.Decode(r, &args)
 	if err != nil {
@@ -307,6 +387,22 @@ func (h user) doReset(w http.ResponseWriter, r *http.Request) error {
 			return err
 		}
 
+		// For people who lost their authenticator; the reset token is sent by
+		// email, so this is as secure as the email account.
+		if args.RemoveMFA {
+			if user.TOTPEnabled {
+				err = user.DisableTOTP(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			var passkeys goatcounter.Passkeys
+			err = passkeys.DeleteUser(ctx, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
 		// Might as well verify the email here, as you can only get the token
 		// from email.
 		if !user.EmailVerified {
@@ -327,7 +423,96 @@ func (h user) doReset(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/user/new")
 }
 
+func (h user) loadInvite(ctx context.Context, key string) (*goatcounter.Invite, error) {
+	var inv goatcounter.Invite
+	err := inv.ByToken(ctx, key)
+	if err != nil {
+		if !zdb.ErrNoRows(err) {
+			zlog.Error(err)
+		}
+		return nil, guru.New(http.StatusForbidden, T(ctx,
+			"error/invite-not-found|Could not find this invite; perhaps it was revoked?"))
+	}
+	if inv.AcceptedAt != nil {
+		return nil, guru.New(http.StatusForbidden, T(ctx,
+			"error/invite-used|This invite has already been used."))
+	}
+	if inv.Expired() {
+		return nil, guru.New(http.StatusForbidden, T(ctx,
+			"error/invite-expired|This invite has expired; ask the person who invited you to send a new one."))
+	}
+	return &inv, nil
+}
+
+func (h user) invite(w http.ResponseWriter, r *http.Request) error {
+	key := chi.URLParam(r, "key")
+	inv, err := h.loadInvite(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	existing, err := inv.ExistingUser(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "user_invite.gohtml", struct {
+		Globals
+		Site     *goatcounter.Site
+		Invite   goatcounter.Invite
+		Existing bool
+		Key      string
+	}{newGlobals(w, r), Site(r.Context()), *inv, existing != nil, key})
+}
+
+func (h user) acceptInvite(w http.ResponseWriter, r *http.Request) error {
+	key := chi.URLParam(r, "key")
+	inv, err := h.loadInvite(r.Context(), key)
+	if err != nil {
+		return err
+	}
+
+	var args struct {
+		Password  string `json:"password"`
+		Password2 string `json:"password2"`
+	}
+	_, err = zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	existing, err := inv.ExistingUser(r.Context())
+	if err != nil {
+		return err
+	}
+	if existing == nil && args.Password != args.Password2 {
+		zhttp.FlashError(w, T(r.Context(), "error/password-does-not-match|Password confirmation doesn’t match."))
+		return zhttp.SeeOther(w, "/user/invite/"+key)
+	}
+
+	_, err = inv.Accept(r.Context(), args.Password)
+	if err != nil {
+		var (
+			vErr  *zvalidate.Validator
+			stErr interface{ Code() int }
+		)
+		if errors.As(err, &vErr) || (errors.As(err, &stErr) && stErr.Code() == http.StatusForbidden) {
+			zhttp.FlashError(w, err.Error())
+			return zhttp.SeeOther(w, "/user/invite/"+key)
+		}
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/invite-accepted|Invite accepted; you can now login."))
+	return zhttp.SeeOther(w, "/user/new")
+}
+
 func (h user) logout(w http.ResponseWriter, r *http.Request) error {
+	u := User(r.Context())
+	err := u.Logout(r.Context())
+	if err != nil {
+		zlog.Errorf("logout: %s", err)
+	}
+
 	if goatcounter.Config(r.Context()).GoatcounterCom {
 		isBosmang := false
 		for _, c := range r.Cookies() {
@@ -342,14 +527,43 @@ func (h user) logout(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	u := User(r.Context())
-	err := u.Logout(r.Context())
+	auth.ClearCookie(w, Site(r.Context()).Domain(r.Context()))
+	return zhttp.SeeOther(w, "/")
+}
+
+func (h user) revokeSession(w http.ResponseWriter, r *http.Request) error {
+	v := goatcounter.NewValidate(r.Context())
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var s goatcounter.LoginSession
+	err := s.ByID(r.Context(), id)
 	if err != nil {
-		zlog.Errorf("logout: %s", err)
+		return err
+	}
+	err = s.Delete(r.Context())
+	if err != nil {
+		return err
 	}
 
-	auth.ClearCookie(w, Site(r.Context()).Domain(r.Context()))
-	return zhttp.SeeOther(w, "/")
+	if s.ID == User(r.Context()).LoginSession {
+		auth.ClearCookie(w, Site(r.Context()).Domain(r.Context()))
+		return zhttp.SeeOther(w, "/")
+	}
+	zhttp.Flash(w, T(r.Context(), "notify/session-revoked|Signed out the session."))
+	return zhttp.SeeOther(w, "/user/auth#sessions")
+}
+
+func (h user) revokeOtherSessions(w http.ResponseWriter, r *http.Request) error {
+	err := User(r.Context()).LogoutOthers(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/sessions-revoked|Signed out all other sessions."))
+	return zhttp.SeeOther(w, "/user/auth#sessions")
 }
 
 func (h user) disableTOTP(w http.ResponseWriter, r *http.Request) error {
@@ -358,6 +572,8 @@ func (h user) disableTOTP(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserMFA, u.Email,
+		map[string]bool{"totp_enabled": true}, map[string]bool{"totp_enabled": false})
 
 	zhttp.Flash(w, T(r.Context(), "notify/disabled-multi-factor-auth|Multi-factor authentication disabled."))
 	return zhttp.SeeOther(w, "/user/auth")
@@ -387,13 +603,84 @@ func (h user) enableTOTP(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.SeeOther(w, "/user/auth")
 	}
 
-	err = u.EnableTOTP(r.Context())
+	var codes []string
+	err = zdb.TX(r.Context(), func(ctx context.Context) error {
+		err := u.EnableTOTP(ctx)
+		if err != nil {
+			return err
+		}
+		codes, err = (&goatcounter.BackupCodes{}).Generate(ctx, u.ID)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserMFA, u.Email,
+		map[string]bool{"totp_enabled": false}, map[string]bool{"totp_enabled": true})
 
 	zhttp.Flash(w, T(r.Context(), "notify/multi-factor-auth-enabled|Multi-factor authentication enabled."))
-	return zhttp.SeeOther(w, "/user/auth")
+	return h.backupCodesForm(w, r, codes)
+}
+
+// backupCodes generates a new set of backup codes, invalidating the old ones.
+func (h user) backupCodes(w http.ResponseWriter, r *http.Request) error {
+	u := User(r.Context())
+	if !u.TOTPEnabled {
+		return guru.New(400, T(r.Context(), "error/mfa-not-enabled|Multi-factor authentication isn’t enabled."))
+	}
+
+	codes, err := (&goatcounter.BackupCodes{}).Generate(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserMFA, u.Email,
+		nil, map[string]bool{"backup_codes_regenerated": true})
+	return h.backupCodesForm(w, r, codes)
+}
+
+func (h user) backupCodesForm(w http.ResponseWriter, r *http.Request, codes []string) error {
+	return zhttp.Template(w, "user_backup_codes.gohtml", struct {
+		Globals
+		Codes []string
+	}{newGlobals(w, r), codes})
+}
+
+func sendBackupCodeUsed(ctx context.Context, site *goatcounter.Site, user *goatcounter.User, emailFrom string) {
+	if !user.Settings.Notify(goatcounter.NotifySecurity) {
+		return
+	}
+
+	var codes goatcounter.BackupCodes
+	err := codes.ListUser(ctx, user.ID)
+	if err != nil {
+		zlog.Error(err)
+		return
+	}
+
+	ctx = goatcounter.CopyContextValues(ctx)
+	bgrun.RunFunction("email:backup-code", func() {
+		err := blackmail.Send("A backup code was used to sign in",
+			mail.Address{Name: "GoatCounter", Address: emailFrom},
+			blackmail.To(user.Email),
+			blackmail.BodyMustText(goatcounter.TplEmailBackupCode{ctx, *site, *user, codes.Remaining()}.Render))
+		if err != nil {
+			zlog.Errorf("blackmail: %s", err)
+		}
+	})
+}
+
+// Always sent, irrespective of the notification settings.
+func sendPasswordChanged(ctx context.Context, site *goatcounter.Site, user *goatcounter.User, emailFrom string) {
+	ctx = goatcounter.CopyContextValues(ctx)
+	bgrun.RunFunction("email:password-changed", func() {
+		err := blackmail.Send("Your GoatCounter password was changed",
+			mail.Address{Name: "GoatCounter", Address: emailFrom},
+			blackmail.To(user.Email),
+			blackmail.BodyMustText(goatcounter.TplEmailPasswordChanged{ctx, *site, *user}.Render))
+		if err != nil {
+			zlog.Errorf("blackmail: %s", err)
+		}
+	})
 }
 
 func (h user) changePassword(w http.ResponseWriter, r *http.Request) error {
@@ -433,6 +720,8 @@ func (h user) changePassword(w http.ResponseWriter, r *http.Request) error {
 		}
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditUserPassword, u.Email, nil, nil)
+	sendPasswordChanged(r.Context(), Site(r.Context()), u, goatcounter.Config(r.Context()).EmailFrom)
 
 	zhttp.Flash(w, T(r.Context(), "notify/password-changed|Password changed."))
 	return zhttp.SeeOther(w, "/user/auth")
@@ -467,6 +756,7 @@ func (h user) newAPIToken(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditAPITokenCreate, token.Name, nil, token)
 
 	zhttp.Flash(w, T(r.Context(), "notify/api-token-created|API token created."))
 	return zhttp.SeeOther(w, "/user/api")
@@ -489,6 +779,7 @@ func (h user) deleteAPIToken(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	goatcounter.Audit(r.Context(), goatcounter.AuditAPITokenDelete, token.Name, token, nil)
 
 	zhttp.Flash(w, T(r.Context(), "notify/api-token-removed|API token removed."))
 	return zhttp.SeeOther(w, "/user/api")
@@ -537,6 +828,84 @@ func (h user) verify(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/")
 }
 
+func sendEmailChange(ctx context.Context, site *goatcounter.Site, change goatcounter.EmailChange, emailFrom string) {
+	ctx = goatcounter.CopyContextValues(ctx)
+	bgrun.RunFunction("email:change", func() {
+		err := blackmail.Send("Confirm your new email address",
+			mail.Address{Name: "GoatCounter", Address: emailFrom},
+			blackmail.To(change.Email),
+			blackmail.BodyMustText(goatcounter.TplEmailChangeConfirm{ctx, *site, change}.Render))
+		if err != nil {
+			zlog.Errorf("blackmail: %s", err)
+		}
+
+		err = blackmail.Send("Your email address is being changed",
+			mail.Address{Name: "GoatCounter", Address: emailFrom},
+			blackmail.To(change.OldEmail),
+			blackmail.BodyMustText(goatcounter.TplEmailChangeNotify{ctx, *site, change}.Render))
+		if err != nil {
+			zlog.Errorf("blackmail: %s", err)
+		}
+	})
+}
+
+func (h user) emailChangeConfirm(w http.ResponseWriter, r *http.Request) error {
+	var change goatcounter.EmailChange
+	err := change.ByToken(r.Context(), chi.URLParam(r, "key"))
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return guru.New(400, T(r.Context(), "error/token-already-used|Unknown token; perhaps it was already used?"))
+		}
+		return err
+	}
+
+	user, err := change.Confirm(r.Context())
+	if err != nil {
+		return err
+	}
+	goatcounter.Audit(goatcounter.WithUser(r.Context(), user), goatcounter.AuditUserEmail, user.Email,
+		map[string]any{"email": change.OldEmail}, map[string]any{"email": change.Email})
+
+	zhttp.Flash(w, T(r.Context(), "notify/email-changed|Your email address was changed to %(email).", user.Email))
+	return zhttp.SeeOther(w, "/")
+}
+
+func (h user) emailChangeCancel(w http.ResponseWriter, r *http.Request) error {
+	var change goatcounter.EmailChange
+	err := change.ByCancelToken(r.Context(), chi.URLParam(r, "key"))
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return guru.New(400, T(r.Context(), "error/email-change-gone|Unknown token; perhaps the change was already confirmed, cancelled, or expired?"))
+		}
+		return err
+	}
+
+	err = change.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/email-change-cancelled|The change of your email address was cancelled."))
+	return zhttp.SeeOther(w, "/")
+}
+
+func (h user) emailChangeCancelPending(w http.ResponseWriter, r *http.Request) error {
+	var change goatcounter.EmailChange
+	err := change.ByUser(r.Context(), User(r.Context()).ID)
+	if err != nil && !zdb.ErrNoRows(err) {
+		return err
+	}
+	if err == nil {
+		err = change.Delete(r.Context())
+		if err != nil {
+			return err
+		}
+	}
+
+	zhttp.Flash(w, T(r.Context(), "notify/email-change-cancelled|The change of your email address was cancelled."))
+	return zhttp.SeeOther(w, "/user/pref")
+}
+
 // Make sure to use the correct cookie, since both "custom.example.com" and
 // "example.goatcounter.com" will work if you're using a custom domain.
 func cookieDomain(site *goatcounter.Site, r *http.Request) string {
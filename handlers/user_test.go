@@ -9,8 +9,10 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"zgo.at/goatcounter/v2"
@@ -251,3 +253,170 @@ func TestUserLogout(t *testing.T) {
 		})
 	}
 }
+
+func TestUserInvite(t *testing.T) {
+	invite := func(expires time.Time, accept bool) func(context.Context, *testing.T) {
+		return func(ctx context.Context, t *testing.T) {
+			inv := goatcounter.Invite{
+				Email:     "invited@example.com",
+				Access:    goatcounter.UserAccesses{"all": goatcounter.AccessReadOnly},
+				Token:     "test-invite-token",
+				ExpiresAt: expires,
+			}
+			err := inv.Insert(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accept {
+				_, err := inv.Accept(ctx, "password123")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	var (
+		valid   = ztime.Now().Add(time.Hour)
+		expired = ztime.Now().Add(-time.Hour)
+		body    = map[string]string{"password": "password123", "password2": "password123"}
+	)
+
+	tests := []handlerTest{
+		{
+			name:     "form",
+			setup:    invite(valid, false),
+			router:   newBackend,
+			path:     "/user/invite/test-invite-token",
+			wantCode: 200,
+			wantBody: "Accept invite for invited@example.com",
+		},
+		{
+			name:     "form expired",
+			setup:    invite(expired, false),
+			router:   newBackend,
+			path:     "/user/invite/test-invite-token",
+			wantCode: 403,
+			wantBody: "This invite has expired",
+		},
+		{
+			name:     "form unknown",
+			router:   newBackend,
+			path:     "/user/invite/test-invite-token",
+			wantCode: 403,
+		},
+		{
+			name:         "accept",
+			setup:        invite(valid, false),
+			router:       newBackend,
+			path:         "/user/invite/test-invite-token",
+			method:       "POST",
+			body:         body,
+			wantCode:     303,
+			wantFormCode: 303,
+		},
+		{
+			name:         "accept expired",
+			setup:        invite(expired, false),
+			router:       newBackend,
+			path:         "/user/invite/test-invite-token",
+			method:       "POST",
+			body:         body,
+			wantCode:     403,
+			wantFormCode: 403,
+		},
+		{
+			name:         "accept twice",
+			setup:        invite(valid, true),
+			router:       newBackend,
+			path:         "/user/invite/test-invite-token",
+			method:       "POST",
+			body:         body,
+			wantCode:     403,
+			wantFormCode: 403,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			var u goatcounter.User
+			err := u.ByEmail(r.Context(), "invited@example.com")
+			created := err == nil
+			if want := tt.wantCode == 303 || strings.HasSuffix(tt.name, "twice"); created != want {
+				t.Errorf("user created: %t; want %t", created, want)
+			}
+		})
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	type session struct {
+		id          int64
+		token, csrf string
+	}
+	newSession := func(t *testing.T) session {
+		t.Helper()
+		u := *User(ctx)
+		err := u.Login(ctx, "Mozilla/5.0 (X11; Linux x86_64)", "192.0.2.42")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session{u.LoginSession, *u.LoginToken, *u.Token}
+	}
+	do := func(t *testing.T, s session, method, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, rr := newTest(ctx, method, path, strings.NewReader("csrf="+s.csrf))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Cookie", "key="+s.token)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		return rr
+	}
+	loggedOut := func(t *testing.T, s session) {
+		t.Helper()
+		rr := do(t, s, "GET", "/user/auth")
+		ztest.Code(t, rr, 303)
+		if l := rr.Header().Get("Location"); l != "/user/new" {
+			t.Errorf("Location: %q", l)
+		}
+	}
+
+	a, b, c := newSession(t), newSession(t), newSession(t)
+
+	rr := do(t, a, "GET", "/user/auth")
+	ztest.Code(t, rr, 200)
+	if !strings.Contains(rr.Body.String(), "192.0.2.0/24") {
+		t.Error("IP not in sessions list")
+	}
+
+	t.Run("revoke", func(t *testing.T) {
+		rr := do(t, a, "POST", "/user/session/"+strconv.FormatInt(b.id, 10)+"/revoke")
+		ztest.Code(t, rr, 303)
+		loggedOut(t, b)
+		ztest.Code(t, do(t, a, "GET", "/user/auth"), 200)
+	})
+
+	t.Run("revoke others", func(t *testing.T) {
+		rr := do(t, a, "POST", "/user/session/revoke-others")
+		ztest.Code(t, rr, 303)
+		loggedOut(t, c)
+		ztest.Code(t, do(t, a, "GET", "/user/auth"), 200)
+	})
+
+	t.Run("change password", func(t *testing.T) {
+		d := newSession(t)
+		r, rr := newTest(ctx, "POST", "/user/change-password",
+			strings.NewReader("csrf="+a.csrf+"&c_password=coconuts&password=bananas!&password2=bananas!"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Cookie", "key="+a.token)
+		newBackend(zdb.MustGetDB(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		loggedOut(t, d)
+		ztest.Code(t, do(t, a, "GET", "/user/auth"), 200)
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		ztest.Code(t, do(t, a, "POST", "/user/logout"), 303)
+		loggedOut(t, a)
+	})
+}
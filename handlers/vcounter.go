@@ -29,7 +29,6 @@ import (
 	"zgo.at/zstd/zfilepath"
 	"zgo.at/zstd/zfs"
 	"zgo.at/zstd/ztime"
-	"zgo.at/ztpl/tplfunc"
 )
 
 type vcounter struct{ files fs.FS }
@@ -148,7 +147,7 @@ func (h vcounter) counter(w http.ResponseWriter, r *http.Request) error {
 	if zdb.ErrNoRows(err) {
 		w.WriteHeader(404)
 	}
-	count := tplfunc.Number(hl.Count, site.UserDefaults.NumberFormat)
+	count := site.UserDefaults.FormatNumber(hl.Count)
 
 	switch ext {
 	default:
@@ -52,7 +52,7 @@ type website struct {
 
 func (h website) Mount(r chi.Router, db zdb.DB, dev bool) {
 	r.Use(
-		mware.RealIP(),
+		RealIP(),
 		mware.Unpanic(),
 		middleware.RedirectSlashes,
 		addctx(db, false, 10),
@@ -294,7 +294,7 @@ func (h website) doSignup(w http.ResponseWriter, r *http.Request) error {
 
 	site := goatcounter.Site{Code: args.Code, LinkDomain: args.LinkDomain}
 	user := goatcounter.User{Email: args.Email, Password: []byte(args.Password),
-		Access: goatcounter.UserAccesses{"all": goatcounter.AccessAdmin}}
+		Access: goatcounter.UserAccesses{"all": goatcounter.AccessOwner}}
 
 	v := zvalidate.New()
 	if strings.TrimSpace(args.TuringTest) != "9" {
@@ -375,7 +375,7 @@ func (h website) doSignup(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	err = user.Login(goatcounter.WithSite(r.Context(), &site))
+	err = user.Login(goatcounter.WithSite(r.Context(), &site), r.UserAgent(), r.RemoteAddr)
 	if err != nil {
 		zlog.Errorf("login during account creation: %w", err)
 	} else {
@@ -26,6 +26,7 @@ func TestWebsiteTpl(t *testing.T) {
 		{"/design", "Firefox on iOS is just displayed as Safari"},
 		{"/help/translating", "translate GoatCounter"},
 		{"/status", "uptime"},
+		{"/status", `"db_pool":{"max_open"`},
 		{"/signup", `<label for="email">Email address</label>`},
 		{"/user/forgot", "Forgot domain"},
 
@@ -128,6 +128,56 @@ func LoadBufferKey(ctx context.Context) ([]byte, error) {
 	return key, nil
 }
 
+// LoadChartKey loads the key to sign chart image URLs for the current site,
+// creating a new key if there isn't one yet.
+func LoadChartKey(ctx context.Context) ([]byte, error) {
+	k := "chart-secret-" + strconv.FormatInt(MustGetSite(ctx).ID, 10)
+	err := zdb.Exec(ctx, `insert into store (key, value) values (:k, :s) on conflict (key) do nothing`,
+		map[string]any{"k": k, "s": zcrypto.Secret256()})
+	if err != nil {
+		return nil, fmt.Errorf("LoadChartKey: %w", err)
+	}
+
+	var key []byte
+	err = zdb.Get(ctx, &key, `select value from store where key=:k`, map[string]any{"k": k})
+	if err != nil {
+		return nil, fmt.Errorf("LoadChartKey: %w", err)
+	}
+	return key, nil
+}
+
+// LoadVisitorKey loads the key to hash visitors for the unique visitor
+// sketches, creating a new key if there isn't one yet.
+//
+// This is never rotated, as it needs to be the same for all days in a period
+// to count someone only once.
+func LoadVisitorKey(ctx context.Context) ([]byte, error) {
+	err := zdb.Exec(ctx, `insert into store (key, value) values ('visitor-secret', :s) on conflict (key) do nothing`,
+		map[string]any{"s": zcrypto.Secret256()})
+	if err != nil {
+		return nil, fmt.Errorf("LoadVisitorKey: %w", err)
+	}
+
+	var key []byte
+	err = zdb.Get(ctx, &key, `select value from store where key='visitor-secret'`)
+	if err != nil {
+		return nil, fmt.Errorf("LoadVisitorKey: %w", err)
+	}
+	return key, nil
+}
+
+// ResetChartKey removes the key to sign chart image URLs for the current site,
+// invalidating all previously signed URLs. A new key will be created on the
+// next call to LoadChartKey().
+func ResetChartKey(ctx context.Context) error {
+	err := zdb.Exec(ctx, `delete from store where key=:k`, map[string]any{
+		"k": "chart-secret-" + strconv.FormatInt(MustGetSite(ctx).ID, 10)})
+	if err != nil {
+		return fmt.Errorf("ResetChartKey: %w", err)
+	}
+	return nil
+}
+
 // UUID created a new UUID v4.
 func UUID() zint.Uint128 {
 	u, err := uuid.NewRandom()
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"zgo.at/errors"
+	"zgo.at/guru"
 	"zgo.at/zdb"
 	"zgo.at/zstd/zbool"
 	"zgo.at/zstd/zint"
@@ -41,10 +42,39 @@ type Hit struct {
 	RefScheme       *string    `db:"ref_scheme" json:"-"`
 	UserAgentHeader string     `db:"-" json:"-"`
 	Location        string     `db:"location" json:"-"`
+	City            string     `db:"-" json:"-"`
 	Language        *string    `db:"language" json:"-"`
 	FirstVisit      zbool.Bool `db:"first_visit" json:"-"`
 	CreatedAt       time.Time  `db:"created_at" json:"-"`
 
+	// HTTP status code; only set for hits imported from logfiles. See
+	// StatusIsPageview().
+	Status int `db:"status" json:"-"`
+
+	// No browser was detected from the User-Agent header; see UAOverride.
+	UnknownUA bool `db:"-" json:"-"`
+
+	// Keyed hash of the session key, for the unique visitors sketch; this is
+	// never stored. See HLL.
+	VisitorHash uint64 `db:"-" json:"-"`
+
+	// Ref after applying the referrer rules; this is used for the stats, while
+	// the hits always store the original RefID. See RefRules.
+	CanonicalRefID int64 `db:"-" json:"-"`
+
+	// Pattern in the site's User-Agent blocklist this matched, if Bot is
+	// BotUABlock. See UABlock.
+	UABlockRule string `db:"-" json:"-"`
+
+	// Label of the rule in the site's bot allowlist this matched; these are
+	// counted as regular pageviews. See BotAllow.
+	Label string `db:"-" json:"-"`
+
+	// Random ID count.js sends for a prerendered page (with Bot set to
+	// BotClientPrerender), and again once the page becomes visible. See
+	// Memstore.Visible.
+	Prerender string `db:"-" json:"pr,omitempty"`
+
 	RefURL *url.URL `db:"-" json:"-"`   // Parsed Ref
 	Random string   `db:"-" json:"rnd"` // Browser cache buster, as they don't always listen to Cache-Control
 
@@ -54,6 +84,10 @@ type Hit struct {
 
 	NoStore   bool `db:"-" json:"-"` // Don't store in hits (still store in stats).
 	noProcess bool `db:"-" json:"-"` // Don't process in memstore; for merging paths.
+
+	// Entry page of this hit's session; set by the memstore for pageviews (not
+	// events) and used to calculate the bounce rate.
+	SessionEntry SessionEntry `db:"-" json:"-"`
 }
 
 func (h *Hit) Ignore() bool {
@@ -187,6 +221,9 @@ func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 		}
 	} else {
 		h.cleanPath(ctx)
+		if h.Path != "" {
+			h.Path = FoldPath(h.Path, site.Settings.FoldPathCase, site.Settings.FoldPathSlash)
+		}
 	}
 
 	// Set campaign.
@@ -270,7 +307,17 @@ func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 	if err != nil {
 		return errors.Wrap(err, "Hit.Defaults")
 	}
-	h.RefID = ref.ID
+	h.RefID, h.CanonicalRefID = ref.ID, ref.ID
+
+	// Get or insert the canonical ref for the stats.
+	if name, scheme, ok := site.Settings.RefRules.Canonical(h.Ref, h.RefScheme); ok {
+		canon := Ref{Ref: name, RefScheme: scheme}
+		err = canon.GetOrInsert(ctx)
+		if err != nil {
+			return errors.Wrap(err, "Hit.Defaults")
+		}
+		h.CanonicalRefID = canon.ID
+	}
 
 	// Get or insert size.
 	if site.Settings.Collect.Has(CollectScreenSize) {
@@ -291,6 +338,7 @@ func (h *Hit) Defaults(ctx context.Context, initial bool) error {
 		}
 		h.BrowserID = ua.BrowserID
 		h.SystemID = ua.SystemID
+		h.UnknownUA = ua.Unknown
 	}
 
 	return nil
@@ -305,6 +353,9 @@ func (h *Hit) Validate(ctx context.Context, initial bool) error {
 	v.Required("created_at", h.CreatedAt)
 	v.UTF8("ref", h.Ref)
 	v.Len("ref", h.Ref, 0, 2048)
+	if h.Status != 0 {
+		v.Range("status", int64(h.Status), 100, 599)
+	}
 
 	// Small margin as client's clocks may not be 100% accurate.
 	if h.CreatedAt.After(ztime.Now().Add(5 * time.Second)) {
@@ -319,6 +370,7 @@ func (h *Hit) Validate(ctx context.Context, initial bool) error {
 		v.Len("path", h.Path, 1, 2048)
 		v.Len("title", h.Title, 0, 1024)
 		v.Len("user_agent_header", h.UserAgentHeader, 0, 512)
+		v.Len("prerender", h.Prerender, 0, 32)
 	} else {
 		v.Required("path_id", h.PathID)
 
@@ -407,6 +459,32 @@ func (h *Hits) Purge(ctx context.Context, pathIDs []int64) error {
 	})
 }
 
+// CheckMerge reports if the paths can be merged.
+//
+// The stats are re-created from the raw pageviews when merging, so this isn't
+// possible for paths that have stats from before the raw pageviews were removed
+// or anonymized; see SiteSettings.KeepsStats.
+func (h *Hits) CheckMerge(ctx context.Context, pathIDs []int64) error {
+	site := MustGetSite(ctx)
+	cutoff := site.Settings.RawDataCutoff(ctx)
+	if !site.Settings.KeepsStats() || cutoff == nil || len(pathIDs) == 0 {
+		return nil
+	}
+
+	var n int
+	err := zdb.Get(ctx, &n, `/* Hits.CheckMerge */
+		select count(*) from hit_counts where site_id=? and path_id in (?) and hour < ?`,
+		site.ID, pathIDs, *cutoff)
+	if err != nil {
+		return errors.Wrap(err, "Hits.CheckMerge")
+	}
+	if n > 0 {
+		return guru.Errorf(400, "can't merge paths with stats from before %s, as the pageviews for this period were removed or anonymized",
+			cutoff.Format("2006-01-02"))
+	}
+	return nil
+}
+
 // Merge the given paths.
 func (h *Hits) Merge(ctx context.Context, dst int64, pathIDs []int64) error {
 	// Shouldn't happen, but just in case.
@@ -418,6 +496,10 @@ func (h *Hits) Merge(ctx context.Context, dst int64, pathIDs []int64) error {
 	if err != nil {
 		return errors.Wrap(err, "Hits.Merge")
 	}
+	err = h.CheckMerge(ctx, pathIDs)
+	if err != nil {
+		return errors.Wrap(err, "Hits.Merge")
+	}
 
 	// Push back to lot to memstore to re-add it again, and then just call
 	// Purge() to delete the old ones.
@@ -431,6 +513,57 @@ func (h *Hits) Merge(ctx context.Context, dst int64, pathIDs []int64) error {
 		hh[i].noProcess = true
 	}
 
+	// Redirects, errors, etc. aren't stored in hits, so copy these stats
+	// directly; the rest is re-created from the hits.
+	conflict := `on conflict(site_id, path_id, day, status)`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		conflict = `on conflict on constraint "status_stats#site_id#path_id#day#status"`
+	}
+	err = zdb.Exec(ctx, `
+		insert into status_stats (site_id, path_id, day, status, count)
+		select site_id, :dst, day, status, sum(count) from status_stats
+		where
+			site_id = :site and path_id in (:paths) and
+			(status < 200 or status > 299) and status != 304
+		group by site_id, day, status `+conflict+` do update set
+			count = status_stats.count + excluded.count`,
+		map[string]any{"site": site, "dst": dst, "paths": pathIDs})
+	if err != nil {
+		return errors.Wrap(err, "Hits.Merge")
+	}
+
+	// The User-Agent isn't stored in hits either.
+	conflict = `on conflict(site_id, path_id, day, user_agent)`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		conflict = `on conflict on constraint "unknown_ua_stats#site_id#path_id#day#user_agent"`
+	}
+	err = zdb.Exec(ctx, `
+		insert into unknown_ua_stats (site_id, path_id, day, browser_id, user_agent, count)
+		select site_id, :dst, day, min(browser_id), user_agent, sum(count) from unknown_ua_stats
+		where site_id = :site and path_id in (:paths)
+		group by site_id, day, user_agent `+conflict+` do update set
+			count = unknown_ua_stats.count + excluded.count`,
+		map[string]any{"site": site, "dst": dst, "paths": pathIDs})
+	if err != nil {
+		return errors.Wrap(err, "Hits.Merge")
+	}
+
+	// Nor is the label for the bot allowlist.
+	conflict = `on conflict(site_id, path_id, day, label)`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		conflict = `on conflict on constraint "label_stats#site_id#path_id#day#label"`
+	}
+	err = zdb.Exec(ctx, `
+		insert into label_stats (site_id, path_id, day, label, count)
+		select site_id, :dst, day, label, sum(count) from label_stats
+		where site_id = :site and path_id in (:paths)
+		group by site_id, day, label `+conflict+` do update set
+			count = label_stats.count + excluded.count`,
+		map[string]any{"site": site, "dst": dst, "paths": pathIDs})
+	if err != nil {
+		return errors.Wrap(err, "Hits.Merge")
+	}
+
 	err = errors.Wrap(h.Purge(ctx, pathIDs), "Hits.Merge")
 	if err != nil {
 		return errors.Wrap(err, "Hits.Merge")
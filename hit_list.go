@@ -6,8 +6,10 @@ package goatcounter
 
 import (
 	"context"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"zgo.at/errors"
@@ -22,6 +24,16 @@ type HitList struct {
 	// Number of visitors for the selected date range.
 	Count int `db:"count" json:"count"`
 
+	// Number of pageviews for the selected date range, including returning
+	// visitors. This wasn't stored before October 2026, so will be 0 for
+	// older periods.
+	Views int `db:"views" json:"views"`
+
+	// Number of visitors as used for sorting; this is for the UTC hours and
+	// may be different from Count, which is for the days in the user's
+	// timezone.
+	Total int `db:"total" json:"-"`
+
 	// Path ID
 	PathID int64 `db:"path_id" json:"path_id"`
 
@@ -34,12 +46,30 @@ type HitList struct {
 	// Page title.
 	Title string `db:"title" json:"title"`
 
+	// Change in visitors compared to the previous period of the same length;
+	// see trendBase. Only set when sorting by SortTrending.
+	Growth *int `db:"growth" json:"growth,omitempty"`
+
+	// Number of visitors in the previous period, and whether that was zero.
+	// Only set when sorting by SortTrending.
+	PrevCount int  `db:"prev" json:"prev_count,omitempty"`
+	New       bool `db:"-" json:"new,omitempty"`
+
 	// Highest visitors per hour or day (depending on daily being set).
 	Max int `json:"max"`
 
 	// Statistics by day and hour.
 	Stats []HitListStat `json:"stats"`
 
+	// Number of sessions that started on this path, and how many of those
+	// bounced. Only set when listing paths.
+	Sessions int `json:"sessions"`
+	Bounces  int `json:"bounces"`
+
+	// Pageviews from the site's bot allowlist included in the count, per
+	// label. Only set when listing paths.
+	Labels []HitListLabel `json:"labels,omitempty"`
+
 	// What kind of referral this is; only set when retrieving referrals {enum: h g c o}.
 	//
 	//  h   HTTP Referal header.
@@ -50,10 +80,26 @@ type HitList struct {
 	RefScheme *string `db:"ref_scheme" json:"ref_scheme,omitempty"`
 }
 
+// BounceRate gets the bounce rate for this path as a percentage.
+func (h HitList) BounceRate() float64 {
+	return bounceRate(h.Sessions, h.Bounces)
+}
+
+// HitListLabel is the number of pageviews with a label from the site's bot
+// allowlist; see BotAllow.
+type HitListLabel struct {
+	Label string `db:"label" json:"label"`
+	Count int    `db:"count" json:"count"`
+}
+
 type HitListStat struct {
 	Day    string `json:"day"`    // Day these statistics are for {date}.
 	Hourly []int  `json:"hourly"` // Visitors per hour.
 	Daily  int    `json:"daily"`  // Total visitors for this day.
+
+	// Last day these statistics are for if grouped by week or month; Day is
+	// the first day {date}.
+	End string `json:"end,omitempty"`
 }
 
 // PathCount gets the visit count for one path.
@@ -97,26 +143,157 @@ func (h *HitLists) ListPathsLike(ctx context.Context, search string, matchTitle,
 	return errors.Wrap(err, "Hits.ListPathsLike")
 }
 
+// Sort orders for HitLists.List().
+const (
+	SortVisitors = "visitors" // Most visitors first; the default.
+	SortViews    = "views"    // Most pageviews first.
+	SortPath     = "path"     // Alphabetically by path.
+	SortNew      = "new"      // Paths that were first seen most recently first.
+	SortTrending = "trending" // Largest growth compared to the previous period first.
+)
+
+// Sorts is a list of all valid sort orders.
+var Sorts = []string{SortVisitors, SortViews, SortPath, SortNew, SortTrending}
+
+// trendBase is the minimum visitor count the growth is calculated against when
+// sorting by SortTrending; without it, a path going from 1 to 3 visitors
+// (+200%) would be listed above a path going from 1,000 to 1,500 (+50%).
+//
+// The growth is (count - prev) * 100 / max(prev, trendBase), so it's the
+// percentage change for anything with at least trendBase visitors in the
+// previous period, and closer to the absolute change below that.
+const trendBase = 10
+
+// trendRange gets the period of the same length immediately before rng.
+func trendRange(rng ztime.Range) ztime.Range {
+	d := rng.End.Sub(rng.Start) + time.Second
+	return ztime.NewRange(rng.Start.Add(-d)).To(rng.Start.Add(-time.Second))
+}
+
+// HitListOpts are options for HitLists.List().
+type HitListOpts struct {
+	Sort    string  // Sort order; one of the Sort* constants.
+	After   string  // Only list paths after this cursor; see HitLists.Cursor().
+	Exclude []int64 // Don't list these paths.
+}
+
+// Cursor gets the cursor to pass as HitListOpts.After to get the next page.
+//
+// This uses keyset pagination rather than an offset or list of paths to
+// exclude, so paths aren't skipped or listed twice if new pageviews come in
+// while paginating.
+func (h HitLists) Cursor(order string) string {
+	if len(h) == 0 {
+		return ""
+	}
+
+	// The list may be re-ordered after the TZ offset is applied, so find the
+	// last one in the order the database returned.
+	l := h[0]
+	for _, hh := range h[1:] {
+		var after bool
+		switch order {
+		case SortViews:
+			after = hh.Views < l.Views || (hh.Views == l.Views && hh.PathID < l.PathID)
+		case SortPath:
+			after = strings.ToLower(hh.Path) > strings.ToLower(l.Path) ||
+				(strings.EqualFold(hh.Path, l.Path) && hh.PathID > l.PathID)
+		case SortNew:
+			after = hh.PathID < l.PathID
+		case SortTrending:
+			g, lg := trendGrowth(hh.Growth), trendGrowth(l.Growth)
+			after = g < lg || (g == lg && (hh.Total < l.Total || (hh.Total == l.Total && hh.PathID < l.PathID)))
+		default:
+			after = hh.Total < l.Total || (hh.Total == l.Total && hh.PathID < l.PathID)
+		}
+		if after {
+			l = hh
+		}
+	}
+
+	id := strconv.FormatInt(l.PathID, 10)
+	switch order {
+	case SortViews:
+		return id + ":" + strconv.Itoa(l.Views)
+	case SortPath:
+		return id + ":" + l.Path
+	case SortNew:
+		return id
+	case SortTrending:
+		return id + ":" + strconv.Itoa(trendGrowth(l.Growth)) + ":" + strconv.Itoa(l.Total)
+	default:
+		return id + ":" + strconv.Itoa(l.Total)
+	}
+}
+
+func trendGrowth(g *int) int {
+	if g == nil {
+		return 0
+	}
+	return *g
+}
+
 var allDays = []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 
 // List the top paths for this site in the given time period.
 func (h *HitLists) List(
-	ctx context.Context, rng ztime.Range, pathFilter, exclude []int64, limit int, daily bool,
+	ctx context.Context, rng ztime.Range, pathFilter []int64, opts HitListOpts, limit int, daily bool,
 ) (int, bool, error) {
 	site := MustGetSite(ctx)
 	user := MustGetUser(ctx)
 
+	if opts.Sort == "" {
+		opts.Sort = SortVisitors
+	}
+	if !slices.Contains(Sorts, opts.Sort) {
+		return 0, false, errors.Errorf("HitLists.List: invalid sort %q", opts.Sort)
+	}
+
 	// List the pages for this time period; this gets the path_id, path, title.
 	var more bool
 	{
-		err := zdb.Select(ctx, h, "load:hit_list.List-counts", map[string]any{
+		args := map[string]any{
 			"site":    site.ID,
 			"start":   rng.Start,
 			"end":     rng.End,
 			"filter":  pathFilter,
 			"limit":   limit + 1,
-			"exclude": exclude,
-		})
+			"exclude": opts.Exclude,
+			"sort":    opts.Sort,
+			"after":   opts.After != "",
+		}
+		if opts.Sort == SortTrending {
+			args["prev_start"] = trendRange(rng).Start
+			args["trend_base"] = trendBase
+		}
+		if opts.After != "" {
+			id, v, _ := strings.Cut(opts.After, ":")
+			afterID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return 0, false, errors.Errorf("HitLists.List: invalid cursor %q", opts.After)
+			}
+			args["after_id"] = afterID
+			switch opts.Sort {
+			case SortPath:
+				args["after_path"] = v
+			case SortVisitors, SortViews:
+				args["after_n"], err = strconv.Atoi(v)
+				if err != nil {
+					return 0, false, errors.Errorf("HitLists.List: invalid cursor %q", opts.After)
+				}
+			case SortTrending:
+				g, t, _ := strings.Cut(v, ":")
+				args["after_n"], err = strconv.Atoi(g)
+				if err == nil {
+					args["after_total"], err = strconv.Atoi(t)
+				}
+				if err != nil {
+					return 0, false, errors.Errorf("HitLists.List: invalid cursor %q", opts.After)
+				}
+			}
+		}
+
+		err := zdb.Select(ctx, h, "load:hit_list.List-counts", args)
 		if err != nil {
 			return 0, false, errors.Wrap(err, "HitLists.List hit_counts")
 		}
@@ -136,17 +313,21 @@ func (h *HitLists) List(
 
 	// Get stats for every page.
 	hh := *h
+	if opts.Sort == SortTrending {
+		for i := range hh {
+			hh[i].New = hh[i].PrevCount == 0
+		}
+	}
 	var st []struct {
 		PathID int64     `db:"path_id"`
 		Day    time.Time `db:"day"`
 		Stats  []byte    `db:"stats"`
 	}
+	paths := make([]int64, len(hh))
+	for i := range hh {
+		paths[i] = hh[i].PathID
+	}
 	{
-		paths := make([]int64, len(hh))
-		for i := range hh {
-			paths[i] = hh[i].PathID
-		}
-
 		err := zdb.Select(ctx, &st, "load:hit_list.List-stats", map[string]any{
 			"site":  site.ID,
 			"start": rng.Start.Format("2006-01-02"),
@@ -174,6 +355,60 @@ func (h *HitLists) List(
 		}
 	}
 
+	// Add the session_stats.
+	if site.Settings.Collect.Has(CollectSession) {
+		var ss []struct {
+			PathID   int64 `db:"path_id"`
+			Sessions int   `db:"sessions"`
+			Bounces  int   `db:"bounces"`
+		}
+		err := zdb.Select(ctx, &ss, "load:hit_list.List-sessions", map[string]any{
+			"site":  site.ID,
+			"start": rng.Start.Format("2006-01-02"),
+			"end":   rng.End.Format("2006-01-02"),
+			"paths": paths,
+		})
+		if err != nil {
+			return 0, false, errors.Wrap(err, "HitLists.List session_stats")
+		}
+		for i := range hh {
+			for _, s := range ss {
+				if s.PathID == hh[i].PathID {
+					hh[i].Sessions, hh[i].Bounces = s.Sessions, s.Bounces
+				}
+			}
+		}
+	}
+
+	// Add the label_stats.
+	{
+		var ls []struct {
+			PathID int64 `db:"path_id"`
+			HitListLabel
+		}
+		err := zdb.Select(ctx, &ls, `/* HitLists.List label_stats */
+			select path_id, label, sum(count) as count from label_stats
+			where site_id = :site and path_id in (:paths) and day >= :start and day <= :end
+			group by path_id, label
+			order by count desc, label asc`,
+			map[string]any{
+				"site":  site.ID,
+				"start": rng.Start.Format("2006-01-02"),
+				"end":   rng.End.Format("2006-01-02"),
+				"paths": paths,
+			})
+		if err != nil {
+			return 0, false, errors.Wrap(err, "HitLists.List label_stats")
+		}
+		for i := range hh {
+			for _, l := range ls {
+				if l.PathID == hh[i].PathID {
+					hh[i].Labels = append(hh[i].Labels, l.HitListLabel)
+				}
+			}
+		}
+	}
+
 	fillBlankDays(hh, rng)
 	applyOffset(hh, user.Settings.Timezone)
 
@@ -181,9 +416,87 @@ func (h *HitLists) List(
 	var totalDisplay int
 	addTotals(hh, daily, &totalDisplay)
 
+	// We sort in SQL, but this is not always 100% correct after applying
+	// the TZ offset, so order here as well.
+	//
+	// TODO: this is still not 100% correct, as the "first 10" after
+	// applying the TZ offset may be different than the first 10 being
+	// fetched in the SQL query. There is no easy fix for that in the
+	// current design. I considered storing everything in the DB as the
+	// configured TZ, but that would make changing the TZ expensive, I'm not
+	// 100% sure yet what a good solution here is. For now, this is "good
+	// enough".
+	if opts.Sort == SortVisitors {
+		sort.SliceStable(hh, func(i, j int) bool { return hh[i].Count > hh[j].Count })
+	}
+
 	return totalDisplay, more, nil
 }
 
+// Group stats by week or month, rather than by day; see HitList.Group().
+const (
+	GroupWeek  = "week"
+	GroupMonth = "month"
+)
+
+// Group the daily stats by week or month, and set Max to the highest value in
+// the new groups.
+//
+// Day is set to the first day and End to the last day of every group; the
+// first and last groups are cut off to the days that are in Stats. Hourly is
+// the sum of all days.
+//
+// Visitors are summed for every day, so someone who visited on two days in
+// the same week is counted twice; these are visits rather than unique
+// visitors.
+func (h *HitList) Group(group string, weekStart time.Weekday) {
+	if group != GroupWeek && group != GroupMonth {
+		return
+	}
+
+	var (
+		grouped = make([]HitListStat, 0, len(h.Stats)/7+1)
+		last    string
+	)
+	h.Max = 0
+	for _, s := range h.Stats {
+		day, err := time.Parse("2006-01-02", s.Day)
+		if err != nil {
+			continue
+		}
+
+		var start time.Time
+		switch group {
+		case GroupWeek:
+			start = day.AddDate(0, 0, -int((7+day.Weekday()-weekStart)%7))
+		case GroupMonth:
+			start = day.AddDate(0, 0, 1-day.Day())
+		}
+		if k := start.Format("2006-01-02"); k != last {
+			grouped = append(grouped, HitListStat{Day: s.Day, Hourly: make([]int, 24)})
+			last = k
+		}
+
+		g := &grouped[len(grouped)-1]
+		g.End = s.Day
+		for i, n := range s.Hourly {
+			g.Hourly[i%24] += n
+			g.Daily += n
+		}
+		if g.Daily > h.Max {
+			h.Max = g.Daily
+		}
+	}
+	h.Stats = grouped
+}
+
+// Group the stats for all paths by week or month; see HitList.Group().
+func (h HitLists) Group(group string, weekStart time.Weekday) {
+	for i := range h {
+		h[i].Group(group, weekStart)
+	}
+}
+
 // PathTotals is a special path to indicate this is the "total" overview.
 //
 // Trailing whitespace is trimmed on paths, so this should never conflict.
@@ -395,18 +708,6 @@ func addTotals(hh HitLists, daily bool, totalDisplay *int) {
 
 		*totalDisplay += hh[i].Count
 	}
-
-	// We sort in SQL, but this is not always 100% correct after applying
-	// the TZ offset, so order here as well.
-	//
-	// TODO: this is still not 100% correct, as the "first 10" after
-	// applying the TZ offset may be different than the first 10 being
-	// fetched in the SQL query. There is no easy fix for that in the
-	// current design. I considered storing everything in the DB as the
-	// configured TZ, but that would make changing the TZ expensive, I'm not
-	// 100% sure yet what a good solution here is. For now, this is "good
-	// enough".
-	sort.Slice(hh, func(i, j int) bool { return hh[i].Count > hh[j].Count })
 }
 
 type TotalCount struct {
@@ -415,6 +716,52 @@ type TotalCount struct {
 	// Total number of visitors in UTC. The browser, system, etc, stats are
 	// always in UTC.
 	TotalUTC int `db:"total_utc" json:"total_utc"`
+
+	// Number of sessions that started in this period, and how many of those
+	// bounced (had just one pageview; events aren't counted as pageviews).
+	// Sessions are counted on the day they started, in UTC.
+	Sessions int `db:"sessions" json:"sessions"`
+	Bounces  int `db:"bounces" json:"bounces"`
+
+	// Number of pageviews (excluding events) for the sessions.
+	Pageviews int `db:"pageviews" json:"pageviews"`
+
+	// Average and median session duration; see SessionDuration for details
+	// on how this is calculated.
+	Duration SessionDuration `db:"-" json:"duration"`
+
+	// Estimated number of unique visitors for the entire site, where someone
+	// visiting on several days is counted only once. This is only set for
+	// periods longer than a day without a path filter, and if the site
+	// collects this. See GetVisitorEstimate.
+	Visitors int `db:"-" json:"visitors,omitempty"`
+}
+
+// BounceRate gets the bounce rate as a percentage.
+func (t TotalCount) BounceRate() float64 {
+	return bounceRate(t.Sessions, t.Bounces)
+}
+
+// PagesPerVisit gets the average number of pageviews per session.
+func (t TotalCount) PagesPerVisit() float64 {
+	return pagesPerVisit(t.Sessions, t.Pageviews)
+}
+
+// Pageviews weren't recorded before sessions stats had a pageview column; there
+// will always be at least as many pageviews as sessions, so a lower number
+// means the data isn't complete.
+func pagesPerVisit(sessions, pageviews int) float64 {
+	if sessions <= 0 || pageviews < sessions {
+		return 0
+	}
+	return float64(pageviews) / float64(sessions)
+}
+
+func bounceRate(sessions, bounces int) float64 {
+	if sessions <= 0 {
+		return 0
+	}
+	return float64(max(bounces, 0)) / float64(sessions) * 100
 }
 
 // GetTotalCount gets the total number of pageviews for the selected timeview in
@@ -435,13 +782,89 @@ func GetTotalCount(ctx context.Context, rng ztime.Range, pathFilter []int64, noE
 		"end":       rng.End,
 		"start_utc": rng.Start.In(user.Settings.Timezone.Location),
 		"end_utc":   rng.End.In(user.Settings.Timezone.Location),
+		"start_day": rng.Start.Format("2006-01-02"),
+		"end_day":   rng.End.Format("2006-01-02"),
 		"filter":    pathFilter,
 		"no_events": noEvents,
 		"tz":        user.Settings.Timezone.Offset(),
 	})
+	if err != nil {
+		return t, errors.Wrap(err, "GetTotalCount")
+	}
+
+	if t.Sessions > 0 {
+		t.Duration, err = GetSessionDuration(ctx, rng, pathFilter)
+		if err != nil {
+			return t, errors.Wrap(err, "GetTotalCount")
+		}
+	}
+
+	// Summing the daily visitors is already correct for a single day.
+	if len(pathFilter) == 0 && site.Settings.Collect.Has(CollectVisitors) &&
+		asUTCDate(user, rng.Start) != asUTCDate(user, rng.End) {
+		t.Visitors, err = GetVisitorEstimate(ctx, rng)
+	}
 	return t, errors.Wrap(err, "GetTotalCount")
 }
 
+// GetVisitorEstimate estimates the number of unique visitors for the site in
+// the period, counting someone visiting on several days only once.
+//
+// The daily visitors are merged from the HLL sketches, so this is an estimate
+// with an error of about 2%. This returns 0 if there are no sketches for the
+// start of the period, for example because it was enabled only recently.
+func GetVisitorEstimate(ctx context.Context, rng ztime.Range) (int, error) {
+	site := MustGetSite(ctx)
+	user := MustGetUser(ctx)
+
+	var first time.Time
+	err := zdb.Get(ctx, &first, `select day from visitor_sketches where site_id = :site order by day asc limit 1`,
+		map[string]any{"site": site.ID})
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "GetVisitorEstimate")
+	}
+	start := asUTCDate(user, rng.Start)
+	if f := site.FirstHitAt.UTC().Format("2006-01-02"); f > start {
+		start = f
+	}
+	if first.Format("2006-01-02") > start {
+		return 0, nil
+	}
+
+	var sketches []HLL
+	err = zdb.Select(ctx, &sketches, `
+		select sketch from visitor_sketches
+		where site_id = :site and day >= :start and day <= :end`,
+		map[string]any{
+			"site":  site.ID,
+			"start": asUTCDate(user, rng.Start),
+			"end":   asUTCDate(user, rng.End),
+		})
+	if err != nil {
+		return 0, errors.Wrap(err, "GetVisitorEstimate")
+	}
+
+	var s HLL
+	for _, x := range sketches {
+		s.Merge(x)
+	}
+	return s.Estimate(), nil
+}
+
+// ListNew lists paths that have visitors in this period, but none before it.
+func (h *HitLists) ListNew(ctx context.Context, rng ztime.Range, limit int) error {
+	err := zdb.Select(ctx, h, "load:hit_list.ListNew", map[string]any{
+		"site":  MustGetSite(ctx).ID,
+		"start": rng.Start,
+		"end":   rng.End,
+		"limit": limit,
+	})
+	return errors.Wrap(err, "HitLists.ListNew")
+}
+
 // Diff gets the difference in percentage of all paths in this HitList.
 //
 // e.g. if called with start=2020-01-20; end=2020-01-2020-01-27, then it will
@@ -168,7 +168,7 @@ func TestHitListsList(t *testing.T) {
 			}
 
 			var stats HitLists
-			uniqueDisplay, more, err := stats.List(ctx, rng, pathsFilter, tt.inExclude, 2, false)
+			uniqueDisplay, more, err := stats.List(ctx, rng, pathsFilter, HitListOpts{Exclude: tt.inExclude}, 2, false)
 
 			have := fmt.Sprintf("%d %t %v", uniqueDisplay, more, err)
 			if have != tt.wantReturn {
@@ -187,6 +187,151 @@ func TestHitListsList(t *testing.T) {
 	}
 }
 
+func TestHitListsSort(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	rng := ztime.NewRange(time.Date(2019, 8, 10, 0, 0, 0, 0, time.UTC)).
+		To(time.Date(2019, 8, 16, 23, 59, 59, 0, time.UTC))
+
+	// Number of visitors in the previous week and the selected week.
+	var hits []Hit
+	for _, p := range []struct {
+		path       string
+		prev, curr int
+	}{
+		{"/steady", 20, 22},
+		{"/small", 1, 3},
+		{"/drop", 10, 2},
+		{"/big", 100, 200},
+		{"/new", 0, 5},
+	} {
+		for i := 0; i < p.prev+p.curr; i++ {
+			created := rng.Start.Add(-3 * 24 * time.Hour)
+			if i >= p.prev {
+				created = rng.Start.Add(24 * time.Hour)
+			}
+			hits = append(hits, Hit{FirstVisit: true, CreatedAt: created, Path: p.path,
+				Ref: "https://" + p.path[1:] + ".example.com"})
+		}
+	}
+	gctest.StoreHits(ctx, t, false, hits...)
+
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{SortVisitors, "/big /steady /new /small /drop"},
+		{SortViews, "/big /steady /new /small /drop"},
+		{SortPath, "/big /drop /new /small /steady"},
+		{SortNew, "/new /big /drop /small /steady"},
+		{SortTrending, "/big:100 /new:new /small:20 /steady:10 /drop:-80"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			var (
+				have  []string
+				after string
+			)
+			for i := 0; i < 10; i++ {
+				var hl HitLists
+				_, more, err := hl.List(ctx, rng, nil, HitListOpts{Sort: tt.sort, After: after}, 2, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, h := range hl {
+					switch {
+					case h.New:
+						have = append(have, h.Path+":new")
+					case h.Growth != nil:
+						have = append(have, h.Path+":"+strconv.Itoa(*h.Growth))
+					default:
+						have = append(have, h.Path)
+					}
+				}
+				if !more {
+					break
+				}
+				after = hl.Cursor(tt.sort)
+			}
+
+			if h := strings.Join(have, " "); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+
+	t.Run("refs", func(t *testing.T) {
+		var stats HitStats
+		err := stats.ListTopRefsTrending(ctx, rng, nil, true, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var have []string
+		for _, s := range stats.Stats {
+			if s.New {
+				have = append(have, s.Name+":new")
+			} else {
+				have = append(have, s.Name+":"+strconv.Itoa(*s.Growth))
+			}
+		}
+		want := "big.example.com:100 new.example.com:new small.example.com:20 steady.example.com:10 drop.example.com:-80"
+		if h := strings.Join(have, " "); h != want {
+			t.Errorf("\nhave: %s\nwant: %s", h, want)
+		}
+	})
+}
+
+func TestHitListsLabels(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	rng := ztime.NewRange(time.Date(2019, 8, 10, 0, 0, 0, 0, time.UTC)).
+		To(time.Date(2019, 8, 16, 23, 59, 59, 0, time.UTC))
+	hit := rng.Start.Add(1 * time.Second)
+	gctest.StoreHits(ctx, t, false,
+		Hit{FirstVisit: true, CreatedAt: hit, Path: "/a"},
+		Hit{FirstVisit: true, CreatedAt: hit, Path: "/a", Label: "Partner"},
+		Hit{FirstVisit: true, CreatedAt: hit.Add(24 * time.Hour), Path: "/a", Label: "Partner"},
+		Hit{FirstVisit: true, CreatedAt: hit, Path: "/a", Label: "Uptime"},
+		Hit{FirstVisit: true, CreatedAt: hit, Path: "/b"},
+		Hit{FirstVisit: true, CreatedAt: hit, Path: "/c", Label: "Uptime"})
+
+	tests := []struct {
+		filter, want string
+	}{
+		{"", "/a:4[{Partner 2} {Uptime 1}] /b:1[] /c:1[{Uptime 1}]"},
+		{"label:partner", "/a:4[{Partner 2} {Uptime 1}]"},
+		{"-label:Partner", "/b:1[] /c:1[{Uptime 1}]"},
+		{"label:Other", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			var filter []int64
+			if tt.filter != "" {
+				var err error
+				filter, err = PathFilter(ctx, tt.filter, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var hl HitLists
+			_, _, err := hl.List(ctx, rng, filter, HitListOpts{Sort: SortPath}, 10, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have := make([]string, 0, len(hl))
+			for _, h := range hl {
+				have = append(have, fmt.Sprintf("%s:%d%v", h.Path, h.Count, h.Labels))
+			}
+			if h := strings.Join(have, " "); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
+
 func TestGetTotalCount(t *testing.T) {
 	ztime.SetNow(t, "2020-06-18 12:00:00")
 	ctx := gctest.DB(t)
@@ -507,3 +652,52 @@ func TestHitListSiteTotalUnique(t *testing.T) {
 		}
 	}
 }
+
+func TestHitListGroup(t *testing.T) {
+	hourly := func(n int) []int {
+		h := make([]int, 24)
+		h[10] = n
+		return h
+	}
+	// 2020-06-01 is a Monday.
+	var stats []HitListStat
+	for i := 0; i < 40; i++ {
+		stats = append(stats, HitListStat{
+			Day:    time.Date(2020, 5, 30+i, 0, 0, 0, 0, time.UTC).Format("2006-01-02"),
+			Hourly: hourly(1),
+		})
+	}
+
+	tests := []struct {
+		group     string
+		weekStart time.Weekday
+		want      string
+	}{
+		{"", time.Monday, "2020-05-30:0 2020-05-31:0 2020-06-01:0"},
+		{GroupWeek, time.Monday, "2020-05-30–2020-05-31:2 2020-06-01–2020-06-07:7 2020-06-08–2020-06-14:7"},
+		{GroupWeek, time.Sunday, "2020-05-30–2020-05-30:1 2020-05-31–2020-06-06:7 2020-06-07–2020-06-13:7"},
+		{GroupMonth, time.Monday, "2020-05-30–2020-05-31:2 2020-06-01–2020-06-30:30 2020-07-01–2020-07-08:8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.group+tt.weekStart.String(), func(t *testing.T) {
+			h := HitList{Stats: append([]HitListStat{}, stats...)}
+			h.Group(tt.group, tt.weekStart)
+
+			var have []string
+			for _, s := range h.Stats[:3] {
+				if s.End == "" {
+					have = append(have, fmt.Sprintf("%s:%d", s.Day, s.Daily))
+				} else {
+					have = append(have, fmt.Sprintf("%s–%s:%d", s.Day, s.End, s.Daily))
+				}
+			}
+			if h := strings.Join(have, " "); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+			if tt.group == GroupMonth && h.Max != 30 {
+				t.Errorf("max: %d", h.Max)
+			}
+		})
+	}
+}
@@ -5,12 +5,17 @@
 package goatcounter
 
 import (
+	"cmp"
 	"context"
+	"maps"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/text/language"
 	"zgo.at/errors"
+	"zgo.at/z18n"
 	"zgo.at/zdb"
 	"zgo.at/zstd/ztime"
 )
@@ -21,14 +26,22 @@ type HitStat struct {
 	Name  string `db:"name" json:"name"`   // Display name.
 	Count int    `db:"count" json:"count"` // Number of visitors.
 
-	// What kind of referral this is; only set when retrieving referrals {enum: h g c o}.
+	// What kind of referral this is; only set when retrieving referrals {enum: h g c o s}.
 	//
 	//  h   HTTP Referal header.
 	//  g   Generated; for example are Google domains (google.com, google.nl,
 	//      google.co.nz, etc.) are grouped as the generated referral "Google".
 	//  c   Campaign (via query parameter)
 	//  o   Other
+	//  s   Spam; only stored if the site is set to flag referrer spam
 	RefScheme *string `db:"ref_scheme" json:"ref_scheme,omitempty"`
+
+	// Change in visitors compared to the previous period, the number of
+	// visitors in the previous period, and whether that was zero. Only set
+	// when listing by trend; see HitList.Growth.
+	Growth    *int `db:"growth" json:"growth,omitempty"`
+	PrevCount int  `db:"prev" json:"prev_count,omitempty"`
+	New       bool `db:"-" json:"new,omitempty"`
 }
 
 type HitStats struct {
@@ -43,20 +56,24 @@ func asUTCDate(u *User, t time.Time) string {
 // ListTopRefs lists all ref statistics for the given time period, excluding
 // referrals from the configured LinkDomain.
 //
+// Referrals flagged as spam are excluded if hideSpam is set; see
+// SiteSettings.RefSpam.
+//
 // The returned count is the count without LinkDomain, and is different from the
 // total number of hits.
-func (h *HitStats) ListTopRefs(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+func (h *HitStats) ListTopRefs(ctx context.Context, rng ztime.Range, pathFilter []int64, hideSpam bool, limit, offset int) error {
 	site := MustGetSite(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:ref.ListTopRefs.sql", map[string]any{
+	err := zdb.Select(ctx, &h.Stats, "load:ref.ListTopRefs", map[string]any{
 		"site":       site.ID,
 		"start":      rng.Start,
 		"end":        rng.End,
 		"filter":     pathFilter,
 		"ref":        site.LinkDomainURL(false) + "%",
 		"limit":      limit + 1,
-		"limit2":     limit + (limit * 3),
+		"limit2":     offset + limit + (limit * 3),
 		"offset":     offset,
 		"has_domain": site.LinkDomain != "",
+		"hide_spam":  hideSpam,
 	})
 	if err != nil {
 		return errors.Wrap(err, "HitStats.ListAllRefs")
@@ -69,6 +86,37 @@ func (h *HitStats) ListTopRefs(ctx context.Context, rng ztime.Range, pathFilter
 	return nil
 }
 
+// ListTopRefsTrending lists the ref statistics like ListTopRefs, but ordered
+// by the largest growth compared to the previous period of the same length.
+func (h *HitStats) ListTopRefsTrending(ctx context.Context, rng ztime.Range, pathFilter []int64, hideSpam bool, limit, offset int) error {
+	site := MustGetSite(ctx)
+	err := zdb.Select(ctx, &h.Stats, "load:ref.ListTopRefsTrending", map[string]any{
+		"site":       site.ID,
+		"start":      rng.Start,
+		"end":        rng.End,
+		"prev_start": trendRange(rng).Start,
+		"trend_base": trendBase,
+		"filter":     pathFilter,
+		"ref":        site.LinkDomainURL(false) + "%",
+		"limit":      limit + 1,
+		"offset":     offset,
+		"has_domain": site.LinkDomain != "",
+		"hide_spam":  hideSpam,
+	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListTopRefsTrending")
+	}
+
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	for i := range h.Stats {
+		h.Stats[i].New = h.Stats[i].PrevCount == 0
+	}
+	return nil
+}
+
 // ListTopRef lists all paths by referrer.
 func (h *HitStats) ListTopRef(ctx context.Context, ref string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ByRef", map[string]any{
@@ -87,6 +135,85 @@ func (h *HitStats) ListTopRef(ctx context.Context, ref string, rng ztime.Range,
 	return errors.Wrap(err, "HitStats.ByRef")
 }
 
+// RefGroupDomain groups referrers by their registrable domain, rather than
+// listing every referrer URL.
+const RefGroupDomain = "domain"
+
+// ListTopRefDomains lists the ref statistics like ListTopRefs, but with all
+// HTTP referrers grouped by their registrable domain (e.g. "old.reddit.com/r/x"
+// and "reddit.com/r/y" are both "reddit.com"). Other referrers, such as
+// campaigns, are listed as-is.
+func (h *HitStats) ListTopRefDomains(ctx context.Context, rng ztime.Range, pathFilter []int64, hideSpam bool, limit, offset int) error {
+	site := MustGetSite(ctx)
+	var rows []HitStat
+	err := zdb.Select(ctx, &rows, "load:ref.ListRefDomains", map[string]any{
+		"site":       site.ID,
+		"start":      rng.Start,
+		"end":        rng.End,
+		"filter":     pathFilter,
+		"ref":        site.LinkDomainURL(false) + "%",
+		"has_domain": site.LinkDomain != "",
+		"hide_spam":  hideSpam,
+		"sqlite":     zdb.SQLDialect(ctx) == zdb.DialectSQLite,
+	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListTopRefDomains")
+	}
+
+	var (
+		stats = make([]HitStat, 0, len(rows))
+		idx   = make(map[string]int)
+	)
+	for _, r := range rows {
+		if isURLRef(r.RefScheme) {
+			r.Name = refDomain(r.Name)
+		}
+		k := r.Name
+		if r.RefScheme != nil {
+			k += "\x00" + *r.RefScheme
+		}
+		if i, ok := idx[k]; ok {
+			stats[i].Count += r.Count
+			continue
+		}
+		idx[k] = len(stats)
+		stats = append(stats, r)
+	}
+	h.paginate(stats, limit, offset)
+	return nil
+}
+
+// ListRefsByDomain lists all referrers for the registrable domain, as listed
+// by ListTopRefDomains.
+func (h *HitStats) ListRefsByDomain(ctx context.Context, domain string, rng ztime.Range, pathFilter []int64, hideSpam bool, limit, offset int) error {
+	var rows []HitStat
+	err := zdb.Select(ctx, &rows, "load:ref.ListRefsByDomain", map[string]any{
+		"site":      MustGetSite(ctx).ID,
+		"start":     rng.Start,
+		"end":       rng.End,
+		"filter":    pathFilter,
+		"like":      "%" + strings.ToLower(domain) + "%",
+		"hide_spam": hideSpam,
+	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListRefsByDomain")
+	}
+
+	stats := rows[:0]
+	for _, r := range rows {
+		if isURLRef(r.RefScheme) {
+			host, _, _ := strings.Cut(r.Name, "/")
+			if refDomain(host) == domain {
+				stats = append(stats, r)
+			}
+		} else if r.Name == domain {
+			stats = append(stats, r)
+		}
+	}
+	h.paginate(stats, limit, offset)
+	return nil
+}
+
 // ListBrowsers lists all browser statistics for the given time period.
 func (h *HitStats) ListBrowsers(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
@@ -124,6 +251,101 @@ func (h *HitStats) ListBrowser(ctx context.Context, browser string, rng ztime.Ra
 	return errors.Wrap(err, "HitStats.ListBrowser")
 }
 
+// paginate sets h.Stats to the page at offset of stats grouped in Go, sorted
+// by the count and name.
+func (h *HitStats) paginate(stats []HitStat, limit, offset int) {
+	slices.SortFunc(stats, func(a, b HitStat) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	stats = stats[min(offset, len(stats)):]
+	if len(stats) > limit {
+		h.More = true
+		stats = stats[:limit]
+	}
+	h.Stats = stats
+}
+
+// Granularities to group browsers by.
+const (
+	BrowserGroupName  = "browser" // Only the browser name: "Chrome".
+	BrowserGroupMajor = "major"   // Name and major version: "Chrome 118".
+	BrowserGroupFull  = "full"    // Name and full version: "Chrome 118.0.5993.88".
+)
+
+// BrowserGroups is a list of all valid browser groupings.
+var BrowserGroups = []string{BrowserGroupName, BrowserGroupMajor, BrowserGroupFull}
+
+// ListBrowserVersions lists browser statistics grouped by group.
+//
+// If browser is empty this lists the top-level stats for the grouping. If it's
+// set it lists the level below that: the major versions for a browser name if
+// grouping by name, or all full versions for a browser name or
+// "name/major" ID.
+//
+// The ID of major version stats is set as "name/major".
+func (h *HitStats) ListBrowserVersions(ctx context.Context, group, browser string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	if group == "" {
+		group = BrowserGroupName
+	}
+	if browser == "" && group == BrowserGroupName {
+		return h.ListBrowsers(ctx, rng, pathFilter, limit, offset)
+	}
+
+	major, hasMajor := "", false
+	if i := strings.IndexByte(browser, '/'); i > -1 {
+		browser, major, hasMajor = browser[:i], browser[i+1:], true
+	}
+
+	user := MustGetUser(ctx)
+	var versions []struct {
+		Name    string `db:"name"`
+		Version string `db:"version"`
+		Count   int    `db:"count"`
+	}
+	err := zdb.Select(ctx, &versions, "load:hit_stats.ListBrowserVersions", map[string]any{
+		"site":    MustGetSite(ctx).ID,
+		"start":   asUTCDate(user, rng.Start),
+		"end":     asUTCDate(user, rng.End),
+		"filter":  pathFilter,
+		"browser": browser,
+	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListBrowserVersions")
+	}
+
+	var (
+		byMajor = (browser == "" && group == BrowserGroupMajor) ||
+			(browser != "" && !hasMajor && group == BrowserGroupName)
+		grouped = make(map[string]int)
+		stats   = make([]HitStat, 0, len(versions))
+	)
+	for _, v := range versions {
+		m, _, _ := strings.Cut(v.Version, ".")
+		if hasMajor && m != major {
+			continue
+		}
+
+		st := HitStat{Name: strings.TrimSpace(v.Name + " " + v.Version), Count: v.Count}
+		k := st.Name
+		if byMajor {
+			st.ID, st.Name = v.Name+"/"+m, strings.TrimSpace(v.Name+" "+m)
+			k = st.ID
+		}
+		if i, ok := grouped[k]; ok {
+			stats[i].Count += st.Count
+			continue
+		}
+		grouped[k] = len(stats)
+		stats = append(stats, st)
+	}
+
+	h.paginate(stats, limit, offset)
+	return nil
+}
+
 // ListSystems lists OS statistics for the given time period.
 func (h *HitStats) ListSystems(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
@@ -143,22 +365,47 @@ func (h *HitStats) ListSystems(ctx context.Context, rng ztime.Range, pathFilter
 }
 
 // ListSystem lists all the versions for one system.
+//
+// Versions are normalized with NormalizeSystemVersion(), so this also applies
+// to data stored before the normalization was added or changed.
 func (h *HitStats) ListSystem(ctx context.Context, system string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
-	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListSystem", map[string]any{
+	var versions []struct {
+		Name    string `db:"name"`
+		Version string `db:"version"`
+		Count   int    `db:"count"`
+	}
+	err := zdb.Select(ctx, &versions, "load:hit_stats.ListSystem", map[string]any{
 		"site":   MustGetSite(ctx).ID,
 		"start":  asUTCDate(user, rng.Start),
 		"end":    asUTCDate(user, rng.End),
 		"filter": pathFilter,
 		"system": system,
-		"limit":  limit + 1,
-		"offset": offset,
 	})
-	if len(h.Stats) > limit {
-		h.More = true
-		h.Stats = h.Stats[:len(h.Stats)-1]
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListSystem")
 	}
-	return errors.Wrap(err, "HitStats.ListSystem")
+
+	var (
+		grouped = make(map[string]int)
+		stats   = make([]HitStat, 0, len(versions))
+	)
+	for _, v := range versions {
+		version := NormalizeSystemVersion(v.Name, v.Version)
+		if version == "" {
+			version = z18n.T(ctx, "label/unknown-version|(unknown version)")
+		}
+		name := v.Name + " " + version
+		if i, ok := grouped[name]; ok {
+			stats[i].Count += v.Count
+			continue
+		}
+		grouped[name] = len(stats)
+		stats = append(stats, HitStat{Name: name, Count: v.Count})
+	}
+
+	h.paginate(stats, limit, offset)
+	return nil
 }
 
 const (
@@ -183,6 +430,24 @@ func (h *HitStats) ListSizes(ctx context.Context, rng ztime.Range, pathFilter []
 		return errors.Wrap(err, "HitStats.ListSize")
 	}
 
+	if b := MustGetSite(ctx).Settings.SizeBuckets; len(b) > 0 {
+		ns := make([]HitStat, 0, len(b)+1)
+		for _, bb := range b {
+			ns = append(ns, HitStat{ID: bb.Name, Name: bb.Name})
+		}
+		ns = append(ns, HitStat{ID: sizeUnknown})
+		for i := range h.Stats {
+			x, _ := strconv.Atoi(h.Stats[i].Name)
+			if x == 0 {
+				ns[len(ns)-1].Count += h.Stats[i].Count
+			} else {
+				ns[b.bucket(x)].Count += h.Stats[i].Count
+			}
+		}
+		h.Stats = ns
+		return nil
+	}
+
 	// Group a bit more user-friendly.
 	ns := []HitStat{
 		{ID: sizePhones, Count: 0},
@@ -220,19 +485,31 @@ func (h *HitStats) ListSize(ctx context.Context, id string, rng ztime.Range, pat
 		minSize, maxSize int
 		empty            bool
 	)
-	switch id {
-	case sizePhones:
+	buckets := MustGetSite(ctx).Settings.SizeBuckets
+	switch {
+	case id == sizeUnknown:
+		empty = true
+	case len(buckets) > 0:
+		// The query has "min_size < width <= max_size", and the buckets are
+		// "lo <= width < hi".
+		lo, hi, ok := buckets.bounds(id)
+		if !ok {
+			return errors.Errorf("HitStats.ListSizes: invalid value for name: %#v", id)
+		}
+		minSize, maxSize = lo-1, hi-1
+		if hi == 0 {
+			maxSize = 99999
+		}
+	case id == sizePhones:
 		maxSize = 384
-	case sizeLargePhones:
+	case id == sizeLargePhones:
 		minSize, maxSize = 384, 1024
-	case sizeTablets:
+	case id == sizeTablets:
 		minSize, maxSize = 1024, 1440
-	case sizeDesktop:
+	case id == sizeDesktop:
 		minSize, maxSize = 1440, 1920
-	case sizeDesktopHD:
+	case id == sizeDesktopHD:
 		minSize, maxSize = 1920, 99999
-	case sizeUnknown:
-		empty = true
 	default:
 		return errors.Errorf("HitStats.ListSizes: invalid value for name: %#v", id)
 	}
@@ -299,6 +576,75 @@ func (h *HitStats) ListLocation(ctx context.Context, country string, rng ztime.R
 	return errors.Wrap(err, "HitStats.ListLocation")
 }
 
+// ListCities lists all cities for a region, as an ISO-3166-2 code (e.g.
+// "US-TX").
+//
+// This only lists cities that are known; cities are only stored if collecting
+// them is enabled and a GeoIP City database is used.
+func (h *HitStats) ListCities(ctx context.Context, region string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	user := MustGetUser(ctx)
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListCities", map[string]any{
+		"site":     MustGetSite(ctx).ID,
+		"start":    asUTCDate(user, rng.Start),
+		"end":      asUTCDate(user, rng.End),
+		"filter":   pathFilter,
+		"location": region,
+		"limit":    limit + 1,
+		"offset":   offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListCities")
+}
+
+// ListLocationPaths lists the top paths for visitors from a country, as an
+// ISO-3166-1 code (e.g. "US").
+func (h *HitStats) ListLocationPaths(ctx context.Context, country string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	user := MustGetUser(ctx)
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListLocationPaths", map[string]any{
+		"site":    MustGetSite(ctx).ID,
+		"start":   asUTCDate(user, rng.Start),
+		"end":     asUTCDate(user, rng.End),
+		"filter":  pathFilter,
+		"country": country,
+		"limit":   limit + 1,
+		"offset":  offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListLocationPaths")
+}
+
+// ListLocationRefs lists the top referrers for visitors from a country, as an
+// ISO-3166-1 code (e.g. "US"). Spam referrers are never included.
+//
+// This is only stored per country and not per region, and only since
+// location_ref_stats was added.
+func (h *HitStats) ListLocationRefs(ctx context.Context, country string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	user := MustGetUser(ctx)
+	site := MustGetSite(ctx)
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListLocationRefs", map[string]any{
+		"site":       site.ID,
+		"start":      asUTCDate(user, rng.Start),
+		"end":        asUTCDate(user, rng.End),
+		"filter":     pathFilter,
+		"country":    country,
+		"ref":        site.LinkDomainURL(false) + "%",
+		"has_domain": site.LinkDomain != "",
+		"limit":      limit + 1,
+		"offset":     offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListLocationRefs")
+}
+
 // ListLanguages lists all language statistics for the given time period.
 func (h *HitStats) ListLanguages(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
 	user := MustGetUser(ctx)
@@ -310,11 +656,85 @@ func (h *HitStats) ListLanguages(ctx context.Context, rng ztime.Range, pathFilte
 		"limit":  limit + 1,
 		"offset": offset,
 	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListLanguages")
+	}
 	if len(h.Stats) > limit {
 		h.More = true
 		h.Stats = h.Stats[:len(h.Stats)-1]
 	}
-	return errors.Wrap(err, "HitStats.ListLanguages")
+	if len(h.Stats) == 0 {
+		return nil
+	}
+
+	// Languages are stored as the base tag ("pt"), but the names in the
+	// languages table are by ISO 639-3 ("por"). Unknown languages are stored
+	// as "", which is also "" in the languages table.
+	iso3 := make(map[string]string, len(h.Stats))
+	for _, s := range h.Stats {
+		if b, err := language.ParseBase(s.ID); err == nil {
+			iso3[b.ISO3()] = s.ID
+		} else if s.ID == "" {
+			iso3[""] = ""
+		}
+	}
+	var names []struct {
+		ISO3 string `db:"iso_639_3"`
+		Name string `db:"name"`
+	}
+	err = zdb.Select(ctx, &names, `select iso_639_3, name from languages where iso_639_3 in (?)`,
+		slices.Collect(maps.Keys(iso3)))
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListLanguages")
+	}
+	for _, n := range names {
+		for i := range h.Stats {
+			if h.Stats[i].ID == iso3[n.ISO3] {
+				h.Stats[i].Name = n.Name
+			}
+		}
+	}
+	return nil
+}
+
+// ListEntryPages lists the entry pages: the first page of a session.
+//
+// Sessions are attributed to the day they started.
+func (h *HitStats) ListEntryPages(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	user := MustGetUser(ctx)
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListEntryPages", map[string]any{
+		"site":   MustGetSite(ctx).ID,
+		"start":  asUTCDate(user, rng.Start),
+		"end":    asUTCDate(user, rng.End),
+		"filter": pathFilter,
+		"limit":  limit + 1,
+		"offset": offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListEntryPages")
+}
+
+// ListExitPages lists the exit pages: the last page of a session.
+//
+// Sessions are attributed to the day they started.
+func (h *HitStats) ListExitPages(ctx context.Context, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	user := MustGetUser(ctx)
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListExitPages", map[string]any{
+		"site":   MustGetSite(ctx).ID,
+		"start":  asUTCDate(user, rng.Start),
+		"end":    asUTCDate(user, rng.End),
+		"filter": pathFilter,
+		"limit":  limit + 1,
+		"offset": offset,
+	})
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListExitPages")
 }
 
 // ListCampaigns lists all campaigns statistics for the given time period.
@@ -353,3 +773,25 @@ func (h *HitStats) ListCampaign(ctx context.Context, campaign int64, rng ztime.R
 	}
 	return errors.Wrap(err, "HitStats.ListCampaign")
 }
+
+// ListEventsByPathID lists all events that were fired in sessions that visited
+// pathID.
+//
+// This uses the hits table, so it only works for the period for which there
+// are raw hits and if sessions are collected.
+func (h *HitStats) ListEventsByPathID(ctx context.Context, pathID int64, rng ztime.Range, limit, offset int) error {
+	err := zdb.Select(ctx, &h.Stats, "load:hit_stats.ListEventsByPathID", map[string]any{
+		"site":   MustGetSite(ctx).ID,
+		"start":  rng.Start,
+		"end":    rng.End,
+		"path":   pathID,
+		"limit":  limit + 1,
+		"offset": offset,
+	})
+
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "HitStats.ListEventsByPathID")
+}
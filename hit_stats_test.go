@@ -5,6 +5,7 @@
 package goatcounter_test
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -107,7 +108,7 @@ func TestHitStats(t *testing.T) {
 				"more": false,
 				"stats": [
 					{
-						"name": "Linux",
+						"name": "Linux (unknown version)",
 						"count": 1
 					},
 					{
@@ -219,6 +220,7 @@ func TestHitStats(t *testing.T) {
 				"more": false,
 				"stats": [
 					{
+						"id": "ID-BA",
 						"name": "",
 						"count": 1
 					}
@@ -227,6 +229,7 @@ func TestHitStats(t *testing.T) {
 				"more": false,
 				"stats": [
 					{
+						"id": "ID-BA",
 						"name": "Bali",
 						"count": 1
 					}
@@ -398,6 +401,157 @@ func TestListSizes(t *testing.T) {
 	})
 }
 
+func TestListBrowserVersions(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := ztime.Now()
+	for _, b := range []struct {
+		name, version string
+		count         int
+	}{
+		{"Chrome", "118.0.5993.88", 4},
+		{"Chrome", "118.0.5993.70", 2},
+		{"Chrome", "117.0.5938.149", 3},
+		{"Safari", "17.0", 1},
+		{"Safari", "17.1", 2},
+		{"Safari", "16.6", 1},
+	} {
+		var browser Browser
+		err := browser.GetOrInsert(ctx, b.name, b.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zdb.Exec(ctx, `insert into browser_stats (site_id, path_id, day, browser_id, count) values (?, 1, ?, ?, ?)`,
+			MustGetSite(ctx).ID, now.Format("2006-01-02"), browser.ID, b.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		group, browser string
+		limit, offset  int
+		want           string
+	}{
+		{BrowserGroupName, "", 10, 0, `Chrome=9 Safari=4`},
+		{BrowserGroupName, "Chrome", 10, 0, `Chrome 118 (Chrome/118)=6 Chrome 117 (Chrome/117)=3`},
+		{BrowserGroupName, "Safari/17", 10, 0, `Safari 17.1=2 Safari 17.0=1`},
+		{BrowserGroupMajor, "", 10, 0, `Chrome 118 (Chrome/118)=6 Chrome 117 (Chrome/117)=3 Safari 17 (Safari/17)=3 Safari 16 (Safari/16)=1`},
+		{BrowserGroupMajor, "", 2, 2, `Safari 17 (Safari/17)=3 Safari 16 (Safari/16)=1`},
+		{BrowserGroupMajor, "Chrome/118", 10, 0, `Chrome 118.0.5993.88=4 Chrome 118.0.5993.70=2`},
+		{BrowserGroupMajor, "Safari", 10, 0, `Safari 17.1=2 Safari 16.6=1 Safari 17.0=1`},
+		{BrowserGroupFull, "", 3, 0, `Chrome 118.0.5993.88=4 Chrome 117.0.5938.149=3 Chrome 118.0.5993.70=2 (more)`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.group+" "+tt.browser, func(t *testing.T) {
+			var stats HitStats
+			err := stats.ListBrowserVersions(ctx, tt.group, tt.browser, ztime.NewRange(now).To(now), nil, tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var have []string
+			for _, s := range stats.Stats {
+				if s.ID != "" {
+					have = append(have, fmt.Sprintf("%s (%s)=%d", s.Name, s.ID, s.Count))
+				} else {
+					have = append(have, fmt.Sprintf("%s=%d", s.Name, s.Count))
+				}
+			}
+			if stats.More {
+				have = append(have, "(more)")
+			}
+			if h := strings.Join(have, " "); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestListSystemNormalize(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := ztime.Now()
+	for _, sys := range []struct {
+		name, version string
+		count         int
+	}{
+		{"macOS", "10.15", 5},
+		{"macOS", "10.14", 1},
+		{"macOS", "", 2},
+		{"Windows", "10", 3},
+		{"Windows", "7", 1},
+	} {
+		var system System
+		err := system.GetOrInsert(ctx, sys.name, sys.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zdb.Exec(ctx, `insert into system_stats (site_id, path_id, day, system_id, count) values (?, 1, ?, ?, ?)`,
+			MustGetSite(ctx).ID, now.Format("2006-01-02"), system.ID, sys.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		system string
+		want   string
+	}{
+		{"macOS", `macOS 10.15+=5 macOS (unknown version)=2 macOS 10.14=1`},
+		{"Windows", `Windows 10/11=3 Windows 7=1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.system, func(t *testing.T) {
+			var stats HitStats
+			err := stats.ListSystem(ctx, tt.system, ztime.NewRange(now).To(now), nil, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := make([]string, 0, len(stats.Stats))
+			for _, s := range stats.Stats {
+				have = append(have, fmt.Sprintf("%s=%d", s.Name, s.Count))
+			}
+			if h := strings.Join(have, " "); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestListLanguages(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	err := zdb.Exec(ctx, `insert into languages (iso_639_3, name) values ('por', 'Portuguese'), ('nld', 'Dutch')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := ztime.Now()
+	for lang, n := range map[string]int{"pt": 3, "nl": 2, "xx": 1, "": 4} {
+		err := zdb.Exec(ctx, `insert into language_stats (site_id, path_id, day, language, count) values (?, 1, ?, ?, ?)`,
+			MustGetSite(ctx).ID, now.Format("2006-01-02"), lang, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats HitStats
+	err = stats.ListLanguages(ctx, ztime.NewRange(now).To(now), nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make([]string, 0, len(stats.Stats))
+	for _, s := range stats.Stats {
+		have = append(have, fmt.Sprintf("%s:%s=%d", s.ID, s.Name, s.Count))
+	}
+	want := `:(unknown)=4 pt:Portuguese=3 nl:Dutch=2 xx:xx=1`
+	if h := strings.Join(have, " "); h != want {
+		t.Errorf("\nhave: %s\nwant: %s", h, want)
+	}
+}
+
 func TestStatsByRef(t *testing.T) {
 	ctx := gctest.DB(t)
 
@@ -0,0 +1,134 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Precision of the HLL sketch; this gives 4096 registers and a standard error
+// of about 1.6%.
+const (
+	hllP = 12
+	hllM = 1 << hllP
+)
+
+// HLL is a HyperLogLog sketch to estimate the number of distinct values.
+//
+// This only stores the maximum number of leading zero bits for every register,
+// so it's not possible to get any of the added values back, or to reliably
+// tell if some value was added.
+//
+// The zero value is an empty sketch.
+type HLL []uint8
+
+// Add the hash of a value to the sketch.
+func (s *HLL) Add(hash uint64) {
+	if len(*s) == 0 {
+		*s = make(HLL, hllM)
+	}
+	i := hash >> (64 - hllP)
+	// Set a bit at the end so that the count is at most 64-hllP+1.
+	rho := uint8(bits.LeadingZeros64(hash<<hllP|1<<(hllP-1))) + 1
+	if rho > (*s)[i] {
+		(*s)[i] = rho
+	}
+}
+
+// Merge the other sketch in to this one.
+func (s *HLL) Merge(other HLL) {
+	if len(other) == 0 {
+		return
+	}
+	if len(*s) == 0 {
+		*s = make(HLL, hllM)
+	}
+	for i, r := range other {
+		if r > (*s)[i] {
+			(*s)[i] = r
+		}
+	}
+}
+
+// Estimate the number of distinct values.
+func (s HLL) Estimate() int {
+	if len(s) == 0 {
+		return 0
+	}
+
+	var (
+		m     = float64(hllM)
+		sum   float64
+		zeros int
+	)
+	for _, r := range s {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// Linear counting is more accurate for small cardinalities.
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(e))
+}
+
+// Value stores the sketch; most sketches only have a few registers set, so
+// they're stored as a list of (index, value) triplets if that's shorter.
+//
+// The dense encoding is always hllM bytes, which is never a multiple of 3.
+func (s HLL) Value() (driver.Value, error) {
+	var n int
+	for _, r := range s {
+		if r > 0 {
+			n++
+		}
+	}
+	if n*3 >= hllM {
+		return []byte(s), nil
+	}
+
+	b := make([]byte, 0, n*3)
+	for i, r := range s {
+		if r > 0 {
+			b = append(b, byte(i>>8), byte(i), r)
+		}
+	}
+	return b, nil
+}
+
+func (s *HLL) Scan(v any) error {
+	if v == nil {
+		*s = nil
+		return nil
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return fmt.Errorf("HLL.Scan: unsupported type %T", v)
+	}
+
+	switch {
+	case len(b) == hllM:
+		*s = append(HLL(nil), b...)
+	case len(b)%3 == 0:
+		*s = make(HLL, hllM)
+		for i := 0; i < len(b); i += 3 {
+			idx := int(b[i])<<8 | int(b[i+1])
+			if idx >= hllM {
+				return fmt.Errorf("HLL.Scan: invalid register %d", idx)
+			}
+			(*s)[idx] = b[i+2]
+		}
+	default:
+		return fmt.Errorf("HLL.Scan: invalid length %d", len(b))
+	}
+	return nil
+}
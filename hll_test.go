@@ -0,0 +1,63 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"testing"
+)
+
+func TestHLL(t *testing.T) {
+	hash := func(i int) uint64 {
+		h := fnv.New64a()
+		binary.Write(h, binary.LittleEndian, uint64(i))
+		// FNV doesn't mix the high bits very well.
+		x := h.Sum64()
+		x ^= x >> 33
+		x *= 0xff51afd7ed558ccd
+		x ^= x >> 33
+		return x
+	}
+
+	for _, n := range []int{0, 1, 10, 1000, 50_000, 500_000} {
+		t.Run(fmt.Sprintf("%d", n), func(t *testing.T) {
+			// Add everything twice, in two sketches, to make sure duplicates
+			// and merging work.
+			var a, b HLL
+			for i := 0; i < n; i++ {
+				a.Add(hash(i))
+				b.Add(hash(i))
+				if i%2 == 0 {
+					a.Add(hash(i))
+				}
+			}
+			a.Merge(b)
+
+			have := a.Estimate()
+			if e := math.Abs(float64(have-n)) / float64(max(n, 1)); e > 0.05 {
+				t.Errorf("have %d, want %d (error %.1f%%)", have, n, e*100)
+			}
+
+			v, err := a.Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n < 1000 && len(v.([]byte)) >= hllM {
+				t.Errorf("not stored as sparse: %d bytes", len(v.([]byte)))
+			}
+			var scan HLL
+			err = scan.Scan(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scan.Estimate() != have {
+				t.Errorf("estimate after Scan: %d; want %d", scan.Estimate(), have)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
+)
+
+// InviteExpire is how long an invite is valid for.
+const InviteExpire = 7 * 24 * time.Hour
+
+// Invite to create a user for an account; the user sets their own password when
+// accepting the invite.
+type Invite struct {
+	ID     int64 `db:"invite_id" json:"-"`
+	SiteID int64 `db:"site_id" json:"-"` // Always the account ID.
+	UserID int64 `db:"user_id" json:"-"` // Invited by.
+
+	Email  string       `db:"email" json:"email"`
+	Access UserAccesses `db:"access" json:"access"`
+	Token  string       `db:"token" json:"-"`
+
+	// Set once the invite is used; it can only be used once.
+	AcceptedAt *time.Time `db:"accepted_at" json:"accepted_at"`
+	ExpiresAt  time.Time  `db:"expires_at" json:"expires_at"`
+	CreatedAt  time.Time  `db:"created_at" json:"-"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (i *Invite) Defaults(ctx context.Context) {
+	i.SiteID = MustGetSite(ctx).IDOrParent()
+	if i.UserID == 0 {
+		i.UserID = GetUser(ctx).ID
+	}
+	if i.Token == "" {
+		i.Token = zcrypto.Secret192()
+	}
+	if i.CreatedAt.IsZero() {
+		i.CreatedAt = ztime.Now()
+	}
+	if i.ExpiresAt.IsZero() {
+		i.ExpiresAt = i.CreatedAt.Add(InviteExpire)
+	}
+}
+
+func (i *Invite) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", i.SiteID)
+	v.Required("user_id", i.UserID)
+	v.Required("token", i.Token)
+	v.Required("email", i.Email)
+	v.Len("email", i.Email, 5, 255)
+	v.Email("email", i.Email)
+	i.Access.validate(&v)
+
+	if i.ID == 0 && i.Email != "" {
+		var u User
+		err := u.ByEmail(ctx, i.Email)
+		if err == nil {
+			v.Append("email", "already has access to this site")
+		} else if !zdb.ErrNoRows(err) {
+			return err
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Expired reports if this invite has expired.
+func (i Invite) Expired() bool {
+	return !i.ExpiresAt.After(ztime.Now())
+}
+
+// Insert a new row.
+func (i *Invite) Insert(ctx context.Context) error {
+	if i.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	i.Defaults(ctx)
+	err := i.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	i.ID, err = zdb.InsertID(ctx, "invite_id",
+		`insert into invites (site_id, user_id, email, access, token, expires_at, created_at) values (?)`,
+		[]any{i.SiteID, i.UserID, i.Email, i.Access, i.Token, i.ExpiresAt, i.CreatedAt})
+	return errors.Wrap(err, "Invite.Insert")
+}
+
+func (i *Invite) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, i, `/* Invite.ByID */
+		select * from invites where invite_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).IDOrParent()), "Invite.ByID %d", id)
+}
+
+// ByToken gets an invite by the token. This will also return expired and
+// accepted invites.
+func (i *Invite) ByToken(ctx context.Context, token string) error {
+	return errors.Wrap(zdb.Get(ctx, i,
+		`/* Invite.ByToken */ select * from invites where token=$1 and site_id=$2`,
+		token, MustGetSite(ctx).IDOrParent()), "Invite.ByToken")
+}
+
+// ExistingUser gets a user with the same email on another account, if any.
+//
+// Accepting the invite will copy the password and TOTP settings from this user,
+// rather than setting a new password. This is always nil if only OpenID Connect
+// logins are allowed.
+func (i Invite) ExistingUser(ctx context.Context) (*User, error) {
+	if Config(ctx).OIDCOnly {
+		return nil, nil
+	}
+	var users Users
+	err := users.ByEmail(ctx, i.Email)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invite.ExistingUser")
+	}
+	for _, u := range users {
+		if u.Site != i.SiteID && len(u.Password) > 0 {
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+// Accept this invite and create the user.
+//
+// If the email already has a user on this instance then password must be the
+// password of that user, and the new user will use the same password and TOTP
+// settings. Otherwise it's the password for the new user.
+func (i *Invite) Accept(ctx context.Context, password string) (*User, error) {
+	if i.AcceptedAt != nil {
+		return nil, guru.New(403, "this invite has already been used")
+	}
+	if i.Expired() {
+		return nil, guru.New(403, "this invite has expired")
+	}
+
+	// Users can only sign in with OpenID Connect, so there's no password to
+	// set or copy.
+	oidcOnly := Config(ctx).OIDCOnly
+
+	existing, err := i.ExistingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		ok, err := existing.CorrectPassword(password)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invite.Accept")
+		}
+		if !ok {
+			return nil, guru.New(403, "wrong password")
+		}
+	}
+
+	u := &User{
+		Site:          i.SiteID,
+		Email:         i.Email,
+		EmailVerified: true, // Can only get the invite link from the email.
+		Access:        i.Access,
+	}
+	if existing == nil && !oidcOnly {
+		u.Password = []byte(password)
+	}
+
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		// Mark as accepted first, so the invite can't be used twice if two
+		// requests come in at the same time.
+		i.AcceptedAt = ztype.Ptr(ztime.Now())
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from invites where invite_id=$1 and accepted_at is null`, i.ID)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return guru.New(403, "this invite has already been used")
+		}
+		err = zdb.Exec(ctx, `update invites set accepted_at=$1 where invite_id=$2`, i.AcceptedAt, i.ID)
+		if err != nil {
+			return err
+		}
+
+		err = u.Insert(ctx, existing != nil || oidcOnly)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			u.Password, u.TOTPEnabled, u.TOTPSecret = existing.Password, existing.TOTPEnabled, existing.TOTPSecret
+			return zdb.Exec(ctx, `update users set password=$1, totp_enabled=$2, totp_secret=$3 where user_id=$4`,
+				u.Password, u.TOTPEnabled, u.TOTPSecret, u.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		i.AcceptedAt = nil
+		return nil, errors.Wrap(err, "Invite.Accept")
+	}
+	return u, nil
+}
+
+func (i *Invite) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* Invite.Delete */ delete from invites where invite_id=$1 and site_id=$2`,
+		i.ID, MustGetSite(ctx).IDOrParent())
+	return errors.Wrapf(err, "Invite.Delete %d", i.ID)
+}
+
+type Invites []Invite
+
+// ListPending lists all invites for this account that haven't been accepted
+// yet, including expired ones.
+func (i *Invites) ListPending(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, i,
+		`select * from invites where site_id=$1 and accepted_at is null order by created_at desc`,
+		MustGetSite(ctx).IDOrParent()), "Invites.ListPending")
+}
@@ -0,0 +1,129 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestInvite(t *testing.T) {
+	newInvite := func(ctx context.Context, t *testing.T, email string) Invite {
+		t.Helper()
+		inv := Invite{Email: email, Access: UserAccesses{"all": AccessReadOnly}}
+		err := inv.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Invite
+		err = got.ByToken(ctx, inv.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	t.Run("accept", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		inv := newInvite(ctx, t, "new@example.com")
+
+		u, err := inv.Accept(ctx, "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Site != MustGetSite(ctx).ID || u.Access["all"] != AccessReadOnly || !u.EmailVerified {
+			t.Errorf("wrong user: %#v", u)
+		}
+		if ok, _ := u.CorrectPassword("password123"); !ok {
+			t.Error("password not set")
+		}
+
+		var pending Invites
+		err = pending.ListPending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("still pending: %v", pending)
+		}
+	})
+
+	t.Run("reuse", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		inv := newInvite(ctx, t, "new@example.com")
+		stale := inv
+
+		_, err := inv.Accept(ctx, "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = inv.Accept(ctx, "password123")
+		if err == nil {
+			t.Fatal("accepted twice")
+		}
+
+		// Loaded before it was accepted.
+		_, err = stale.Accept(ctx, "password123")
+		if err == nil {
+			t.Fatal("accepted twice with stale invite")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		inv := newInvite(ctx, t, "new@example.com")
+
+		ztime.SetNow(t, ztime.Now().Add(InviteExpire+time.Minute).Format("2006-01-02 15:04:05"))
+		if !inv.Expired() {
+			t.Fatal("not expired")
+		}
+		_, err := inv.Accept(ctx, "password123")
+		if err == nil {
+			t.Fatal("accepted expired invite")
+		}
+
+		var u User
+		err = u.ByEmail(ctx, "new@example.com")
+		if err == nil {
+			t.Fatal("user was created")
+		}
+	})
+
+	t.Run("already a user", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		inv := Invite{Email: MustGetUser(ctx).Email, Access: UserAccesses{"all": AccessReadOnly}}
+		err := inv.Insert(ctx)
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("existing user on other account", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		gctest.Site(ctx, t, nil, &User{Email: "other@example.com", Password: []byte("other-password")})
+		inv := newInvite(ctx, t, "other@example.com")
+
+		_, err := inv.Accept(ctx, "wrong-password")
+		if err == nil {
+			t.Fatal("accepted with wrong password")
+		}
+
+		u, err := inv.Accept(ctx, "other-password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Site != MustGetSite(ctx).ID {
+			t.Errorf("wrong site: %d", u.Site)
+		}
+		if ok, _ := u.CorrectPassword("other-password"); !ok {
+			t.Error("password not copied")
+		}
+	})
+}
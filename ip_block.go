@@ -0,0 +1,211 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// BotIPBlock is the bot code for pageviews from an address in the site's IP
+// blocklist.
+const BotIPBlock = 101
+
+// IPBlockMax is the maximum number of entries in an IPBlock.
+const IPBlockMax = 500
+
+// IPBlock is a list of IPv4 and IPv6 networks to flag as a bot, stored as one
+// CIDR (e.g. "192.0.2.0/24") or single address per line.
+type IPBlock struct {
+	Prefixes []netip.Prefix
+
+	entries []string // As entered, to show invalid entries in the form.
+	err     error
+	trie    *ipTrie
+}
+
+// ipTrie is a binary trie of network prefixes, with separate roots for IPv4
+// and IPv6 addresses.
+type ipTrie struct{ v4, v6 ipTrieNode }
+
+type ipTrieNode struct {
+	child [2]*ipTrieNode
+	end   bool
+}
+
+// insert a prefix, returning the existing prefix length that contains it, or
+// -1 if there isn't any.
+func (t *ipTrie) insert(p netip.Prefix) int {
+	n, b := t.root(p.Addr())
+	for i := 0; i < p.Bits(); i++ {
+		if n.end {
+			return i
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = new(ipTrieNode)
+		}
+		n = n.child[bit]
+	}
+	if n.end {
+		return p.Bits()
+	}
+	n.end = true
+	return -1
+}
+
+func (t *ipTrie) contains(addr netip.Addr) bool {
+	n, b := t.root(addr)
+	for i := 0; n != nil; i++ {
+		if n.end {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		n = n.child[b[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+func (t *ipTrie) root(addr netip.Addr) (*ipTrieNode, []byte) {
+	if addr.Is4() {
+		b := addr.As4()
+		return &t.v4, b[:]
+	}
+	b := addr.As16()
+	return &t.v6, b[:]
+}
+
+func (l IPBlock) String() string {
+	if l.entries != nil {
+		return strings.Join(l.entries, "\n")
+	}
+	s := make([]string, 0, len(l.Prefixes))
+	for _, p := range l.Prefixes {
+		s = append(s, ipBlockString(p))
+	}
+	return strings.Join(s, "\n")
+}
+
+func ipBlockString(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+func (l IPBlock) Value() (driver.Value, error)  { return l.String(), nil }
+func (l IPBlock) MarshalText() ([]byte, error)  { return []byte(l.String()), nil }
+func (l *IPBlock) UnmarshalText(v []byte) error { return l.Scan(v) }
+
+// Scan the list; this never returns an error, so that a bad entry doesn't
+// prevent loading the settings. Use Validate() to check the list.
+//
+// Entries can also be separated by commas or spaces.
+func (l *IPBlock) Scan(v any) error {
+	*l = IPBlock{}
+	if v == nil {
+		return nil
+	}
+
+	var prefixes []netip.Prefix
+	for _, line := range strings.Split(fmt.Sprintf("%s", v), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		for _, f := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			p, err := parseIPBlock(f)
+			if err != nil {
+				if l.err == nil {
+					l.err = err
+				}
+				l.entries = append(l.entries, f)
+				continue
+			}
+			prefixes = append(prefixes, p)
+			l.entries = append(l.entries, ipBlockString(p))
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	if l.err == nil && len(prefixes) > IPBlockMax {
+		l.err = fmt.Errorf("can have at most %d entries; have %d", IPBlockMax, len(prefixes))
+	}
+
+	// Insert the largest networks first, so that anything they already contain
+	// is reported.
+	sorted := slices.Clone(prefixes)
+	slices.SortStableFunc(sorted, func(a, b netip.Prefix) int { return a.Bits() - b.Bits() })
+	l.trie = new(ipTrie)
+	for _, p := range sorted {
+		bits := l.trie.insert(p)
+		switch {
+		case bits == -1 || l.err != nil:
+		case bits == p.Bits():
+			l.err = fmt.Errorf("%q: listed more than once", p)
+		default:
+			l.err = fmt.Errorf("%q: already included in %q", p, netip.PrefixFrom(p.Addr(), bits).Masked())
+		}
+	}
+
+	l.Prefixes = prefixes
+	return nil
+}
+
+func parseIPBlock(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || addr.Zone() != "" {
+			return netip.Prefix{}, fmt.Errorf("%q: not a valid IP address or CIDR", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q: not a valid IP address or CIDR", s)
+	}
+	if p.Addr().Is4In6() {
+		if p.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("%q: not a valid IP address or CIDR", s)
+		}
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	if p.Bits() == 0 {
+		return netip.Prefix{}, fmt.Errorf("%q: would match every address", s)
+	}
+	if m := p.Masked(); m != p {
+		return netip.Prefix{}, fmt.Errorf("%q: has host bits set; did you mean %q?", s, m)
+	}
+	return p, nil
+}
+
+// Validate reports the first entry that failed to parse, or overlaps with
+// another entry.
+func (l IPBlock) Validate() error { return l.err }
+
+// Contains reports if the address is in one of the networks; the address may
+// include a port.
+func (l IPBlock) Contains(ip string) bool {
+	if l.trie == nil || len(l.Prefixes) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		ap, err := netip.ParseAddrPort(ip)
+		if err != nil {
+			return false
+		}
+		addr = ap.Addr()
+	}
+	return l.trie.contains(addr.Unmap())
+}
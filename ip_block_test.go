@@ -0,0 +1,98 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/zstd/ztest"
+)
+
+func TestIPBlockContains(t *testing.T) {
+	var l IPBlock
+	l.Scan("192.0.0.0/22, 10.1.2.3\n# Comment\n2001:db8::/32\n::ffff:198.51.100.0/120")
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := l.String(), "192.0.0.0/22\n10.1.2.3\n2001:db8::/32\n198.51.100.0/24"; have != want {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.0.0", true},
+		{"192.0.3.255", true},
+		{"192.0.4.0", false},
+		{"191.255.255.255", false},
+		{"10.1.2.3", true},
+		{"10.1.2.4", false},
+		{"198.51.100.7", true},
+		{"::ffff:192.0.2.1", true},
+		{"192.0.2.1:8080", true},
+		{"[2001:db8::1]:443", true},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+		{"::1", false},
+		{"", false},
+		{"not an ip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if have := l.Contains(tt.ip); have != tt.want {
+				t.Errorf("have %t; want %t", have, tt.want)
+			}
+		})
+	}
+
+	if (IPBlock{}).Contains("192.0.2.1") {
+		t.Error("empty list contains address")
+	}
+}
+
+func TestIPBlockValidate(t *testing.T) {
+	many := make([]string, IPBlockMax+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+	}
+
+	tests := []struct {
+		in, wantErr string
+	}{
+		{"", ""},
+		{"192.0.2.0/24\n2001:db8::/32", ""},
+		{strings.Join(many[:IPBlockMax], "\n"), ""},
+
+		{"192.0.2.1/22", `"192.0.2.1/22": has host bits set; did you mean "192.0.0.0/22"?`},
+		{"192.0.2.0/33", `"192.0.2.0/33": not a valid IP address or CIDR`},
+		{"example.com", `"example.com": not a valid IP address or CIDR`},
+		{"0.0.0.0/0", `"0.0.0.0/0": would match every address`},
+		{"10.0.0.0/8\n10.1.0.0/16", `"10.1.0.0/16": already included in "10.0.0.0/8"`},
+		{"10.1.2.3\n10.0.0.0/8", `"10.1.2.3/32": already included in "10.0.0.0/8"`},
+		{"2001:db8::/32\n2001:db8::/32", `"2001:db8::/32": listed more than once`},
+		{strings.Join(many, "\n"), fmt.Sprintf("can have at most %d entries; have %d", IPBlockMax, IPBlockMax+1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var l IPBlock
+			l.Scan(tt.in)
+			if !ztest.ErrorContains(l.Validate(), tt.wantErr) {
+				t.Errorf("\nhave: %v\nwant: %s", l.Validate(), tt.wantErr)
+			}
+		})
+	}
+
+	// Invalid entries are kept, so they're shown in the form again.
+	var l IPBlock
+	l.Scan("192.0.2.0/24\nexample.com")
+	if have := l.String(); have != "192.0.2.0/24\nexample.com" {
+		t.Errorf("have: %q", have)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package locale formats numbers, dates, and times for a language.
+//
+// This only has the data GoatCounter needs (thousands separators, short month
+// and day names, and the clock) for the languages it's translated in, rather
+// than the full CLDR data.
+package locale
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format describes how numbers and dates are formatted in a language.
+type Format struct {
+	Group   string // Thousands separator.
+	Decimal string // Decimal separator.
+
+	// Group the digits in groups of 2 after the first group of 3, as used in
+	// India (12,34,567).
+	Indian bool
+
+	// Minimum number of digits before the first group separator is used; for
+	// example in Spanish 1234 is written without separator, but 12.345 with.
+	// 0 means there is no minimum.
+	MinGroup int
+
+	// Digits to use instead of 0-9; empty for ASCII digits.
+	Digits string
+
+	Months [12]string // Short month names, starting with January.
+	Days   [7]string  // Short day names, starting with Sunday.
+
+	Hour24 bool   // The 24-hour clock is the common clock.
+	AM, PM string // Only used for the 12-hour clock.
+}
+
+var (
+	months1 = [12]string{"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月", "10月", "11月", "12月"}
+	en      = Format{
+		Group: ",", Decimal: ".",
+		Months: [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		Days:   [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+		AM:     "AM", PM: "PM",
+	}
+)
+
+// Formats for all languages, by the lower-case language tag. Get() falls back
+// to just the language if there is no entry for the region.
+var Formats = map[string]Format{
+	"en": en,
+	"en-gb": func() Format {
+		f := en
+		f.Hour24, f.AM, f.PM = true, "am", "pm"
+		return f
+	}(),
+	"de": {
+		Group: ".", Decimal: ",", Hour24: true,
+		Months: [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		Days:   [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+	},
+	"es": {
+		Group: ".", Decimal: ",", MinGroup: 2, Hour24: true,
+		Months: [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		Days:   [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+	},
+	"fr": {
+		Group: "\u202f", Decimal: ",", Hour24: true,
+		Months: [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		Days:   [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+	},
+	"hi": {
+		Group: ",", Decimal: ".", Indian: true, AM: "am", PM: "pm",
+		Months: [12]string{"जन॰", "फ़र॰", "मार्च", "अप्रैल", "मई", "जून", "जुल॰", "अग॰", "सित॰", "अक्तू॰", "नव॰", "दिस॰"},
+		Days:   [7]string{"रवि", "सोम", "मंगल", "बुध", "गुरु", "शुक्र", "शनि"},
+	},
+	"id": {
+		Group: ".", Decimal: ",", Hour24: true,
+		Months: [12]string{"Jan", "Feb", "Mar", "Apr", "Mei", "Jun", "Jul", "Agu", "Sep", "Okt", "Nov", "Des"},
+		Days:   [7]string{"Min", "Sen", "Sel", "Rab", "Kam", "Jum", "Sab"},
+	},
+	"it": {
+		Group: ".", Decimal: ",", Hour24: true,
+		Months: [12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		Days:   [7]string{"dom", "lun", "mar", "mer", "gio", "ven", "sab"},
+	},
+	"ja": {
+		Group: ",", Decimal: ".", Hour24: true,
+		Months: months1,
+		Days:   [7]string{"日", "月", "火", "水", "木", "金", "土"},
+	},
+	"nl": {
+		Group: ".", Decimal: ",", Hour24: true,
+		Months: [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		Days:   [7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+	},
+	"pl": {
+		Group: "\u00a0", Decimal: ",", MinGroup: 2, Hour24: true,
+		Months: [12]string{"sty", "lut", "mar", "kwi", "maj", "cze", "lip", "sie", "wrz", "paź", "lis", "gru"},
+		Days:   [7]string{"niedz.", "pon.", "wt.", "śr.", "czw.", "pt.", "sob."},
+	},
+	"pt": {
+		Group: ".", Decimal: ",", Hour24: true,
+		Months: [12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+		Days:   [7]string{"dom", "seg", "ter", "qua", "qui", "sex", "sáb"},
+	},
+	"ro": {
+		Group: ".", Decimal: ",", Hour24: true,
+		Months: [12]string{"ian.", "feb.", "mar.", "apr.", "mai", "iun.", "iul.", "aug.", "sept.", "oct.", "nov.", "dec."},
+		Days:   [7]string{"dum.", "lun.", "mar.", "mie.", "joi", "vin.", "sâm."},
+	},
+	"ru": {
+		Group: "\u00a0", Decimal: ",", Hour24: true,
+		Months: [12]string{"янв.", "февр.", "март", "апр.", "май", "июнь", "июль", "авг.", "сент.", "окт.", "нояб.", "дек."},
+		Days:   [7]string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"},
+	},
+	"tr": {
+		Group: ".", Decimal: ",", Hour24: true,
+		Months: [12]string{"Oca", "Şub", "Mar", "Nis", "May", "Haz", "Tem", "Ağu", "Eyl", "Eki", "Kas", "Ara"},
+		Days:   [7]string{"Paz", "Pzt", "Sal", "Çar", "Per", "Cum", "Cmt"},
+	},
+	"zh": {
+		Group: ",", Decimal: ".", Hour24: true,
+		Months: months1,
+		Days:   [7]string{"周日", "周一", "周二", "周三", "周四", "周五", "周六"},
+	},
+	"ar": {
+		Group: "٬", Decimal: "٫", Digits: "٠١٢٣٤٥٦٧٨٩", AM: "ص", PM: "م",
+		Months: [12]string{"يناير", "فبراير", "مارس", "أبريل", "مايو", "يونيو", "يوليو", "أغسطس", "سبتمبر", "أكتوبر", "نوفمبر", "ديسمبر"},
+		Days:   [7]string{"الأحد", "الاثنين", "الثلاثاء", "الأربعاء", "الخميس", "الجمعة", "السبت"},
+	},
+}
+
+// Get the format for a language tag such as "de-DE" or "hi".
+//
+// This uses the format for just the language if there is no format for the
+// region, and falls back to English if the language isn't known.
+func Get(tag string) Format {
+	tag = strings.ReplaceAll(strings.ToLower(tag), "_", "-")
+	if f, ok := Formats[tag]; ok {
+		return f
+	}
+	lang, _, _ := strings.Cut(tag, "-")
+	if f, ok := Formats[lang]; ok {
+		return f
+	}
+	return en
+}
+
+// Number formats a number. n can be any integer or float type; anything else
+// is formatted with fmt.Sprint() and grouped if it looks like a number.
+func (f Format) Number(n any) string {
+	var s string
+	switch nn := n.(type) {
+	case float32:
+		s = strconv.FormatFloat(float64(nn), 'f', -1, 32)
+	case float64:
+		s = strconv.FormatFloat(nn, 'f', -1, 64)
+	default:
+		s = fmt.Sprint(n)
+	}
+
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	i, frac, hasFrac := strings.Cut(s, ".")
+	if i == "" || strings.Trim(i, "0123456789") != "" {
+		return sign + s
+	}
+
+	b := new(strings.Builder)
+	b.WriteString(sign)
+	b.WriteString(f.digits(f.group(i)))
+	if hasFrac {
+		b.WriteString(f.Decimal)
+		b.WriteString(f.digits(frac))
+	}
+	return b.String()
+}
+
+func (f Format) group(s string) string {
+	if len(s) <= 3 || len(s) < 3+f.MinGroup {
+		return s
+	}
+
+	var (
+		groups = []string{s[len(s)-3:]}
+		size   = 3
+	)
+	if f.Indian {
+		size = 2
+	}
+	for s = s[:len(s)-3]; len(s) > 0; {
+		n := min(size, len(s))
+		groups = append(groups, s[len(s)-n:])
+		s = s[:len(s)-n]
+	}
+
+	b := new(strings.Builder)
+	for i := len(groups) - 1; i >= 0; i-- {
+		b.WriteString(groups[i])
+		if i > 0 {
+			b.WriteString(f.Group)
+		}
+	}
+	return b.String()
+}
+
+func (f Format) digits(s string) string {
+	if f.Digits == "" {
+		return s
+	}
+	d := []rune(f.Digits)
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return d[r-'0']
+		}
+		return r
+	}, s)
+}
+
+// Date formats t with a Go time layout, using the short month and day names
+// for this language for "Jan" and "Mon".
+//
+// The full names ("January", "Monday") aren't translated.
+func (f Format) Date(t time.Time, layout string) string {
+	b := new(strings.Builder)
+	for {
+		i, j := strings.Index(layout, "Jan"), strings.Index(layout, "Mon")
+		if i == -1 || (j > -1 && j < i) {
+			i = j
+		}
+		if i == -1 {
+			b.WriteString(t.Format(layout))
+			return b.String()
+		}
+		b.WriteString(t.Format(layout[:i]))
+		layout = layout[i:]
+
+		switch {
+		case strings.HasPrefix(layout, "January"):
+			b.WriteString(t.Format("January"))
+			layout = layout[7:]
+		case strings.HasPrefix(layout, "Monday"):
+			b.WriteString(t.Format("Monday"))
+			layout = layout[6:]
+		case strings.HasPrefix(layout, "Jan"):
+			b.WriteString(f.Months[t.Month()-1])
+			layout = layout[3:]
+		default:
+			b.WriteString(f.Days[t.Weekday()])
+			layout = layout[3:]
+		}
+	}
+}
+
+// Time formats the time of t as "15:04" or "3:04 PM".
+func (f Format) Time(t time.Time, hour24 bool) string {
+	if hour24 {
+		return t.Format("15:04")
+	}
+	am, pm := f.AM, f.PM
+	if am == "" {
+		am, pm = "AM", "PM"
+	}
+	if t.Hour() >= 12 {
+		return t.Format("3:04") + " " + pm
+	}
+	return t.Format("3:04") + " " + am
+}
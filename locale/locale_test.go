@@ -0,0 +1,112 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package locale_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2/locale"
+)
+
+func TestNumber(t *testing.T) {
+	tests := []struct {
+		lang string
+		in   any
+		want string
+	}{
+		{"en", 0, "0"},
+		{"en", 999, "999"},
+		{"en", 1234, "1,234"},
+		{"en", int64(1234567), "1,234,567"},
+		{"en", -1234567, "-1,234,567"},
+		{"en", 1234.5, "1,234.5"},
+		{"en-GB", 1234567, "1,234,567"},
+		{"en-US", 1234567, "1,234,567"},
+
+		{"de", 1234567, "1.234.567"},
+		{"de-DE", 1234.5, "1.234,5"},
+		{"fr-FR", 1234567, "1\u202f234\u202f567"},
+
+		// Minimum grouping digits.
+		{"es-CL", 1234, "1234"},
+		{"es-CL", 12345, "12.345"},
+		{"pl", 1234, "1234"},
+
+		// Indian grouping.
+		{"hi", 123, "123"},
+		{"hi", 1234, "1,234"},
+		{"hi", 123456, "1,23,456"},
+		{"hi", 1234567, "12,34,567"},
+		{"hi", 1234567890, "1,23,45,67,890"},
+
+		// Non-ASCII digits.
+		{"ar", 1234567, "١٬٢٣٤٬٥٦٧"},
+		{"ar", 12.5, "١٢٫٥"},
+
+		{"xx", 1234, "1,234"},
+		{"en", "not a number", "not a number"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have := locale.Get(tt.lang).Number(tt.in)
+			if have != tt.want {
+				t.Errorf("%s %v\nhave: %q\nwant: %q", tt.lang, tt.in, have, tt.want)
+			}
+		})
+	}
+}
+
+func TestDate(t *testing.T) {
+	d := time.Date(2026, 10, 18, 14, 5, 0, 0, time.UTC)
+
+	tests := []struct {
+		lang, layout, want string
+	}{
+		{"en", "2 Jan ’06", "18 Oct ’26"},
+		{"en", "Mon Jan 2 2006", "Sun Oct 18 2026"},
+		{"en", "2006-01-02", "2026-10-18"},
+		{"en", "Monday 2 January 2006 15:04 MST", "Sunday 18 October 2026 14:05 UTC"},
+		{"de-DE", "2 Jan ’06", "18 Okt ’26"},
+		{"de-DE", "Mon Jan 2 2006", "So Okt 18 2026"},
+		{"hi", "2 Jan 2006", "18 अक्तू॰ 2026"},
+		{"ja-JP", "Jan 2", "10月 18"},
+		{"ar", "Mon", "الأحد"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have := locale.Get(tt.lang).Date(d, tt.layout)
+			if have != tt.want {
+				t.Errorf("%s %q\nhave: %q\nwant: %q", tt.lang, tt.layout, have, tt.want)
+			}
+		})
+	}
+}
+
+func TestTime(t *testing.T) {
+	tests := []struct {
+		lang   string
+		t      time.Time
+		hour24 bool
+		want   string
+	}{
+		{"en", time.Date(2026, 1, 1, 14, 5, 0, 0, time.UTC), true, "14:05"},
+		{"en", time.Date(2026, 1, 1, 14, 5, 0, 0, time.UTC), false, "2:05 PM"},
+		{"en", time.Date(2026, 1, 1, 0, 5, 0, 0, time.UTC), false, "12:05 AM"},
+		{"en-GB", time.Date(2026, 1, 1, 9, 5, 0, 0, time.UTC), false, "9:05 am"},
+		{"de", time.Date(2026, 1, 1, 14, 5, 0, 0, time.UTC), false, "2:05 PM"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have := locale.Get(tt.lang).Time(tt.t, tt.hour24)
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
@@ -10,7 +10,11 @@ import (
 	"context"
 	"io"
 	"net"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/oschwald/geoip2-golang"
 	"zgo.at/errors"
@@ -18,21 +22,37 @@ import (
 	"zgo.at/zlog"
 )
 
-var geodb *geoip2.Reader
+var (
+	geodb atomic.Pointer[geoip2.Reader]
+
+	// Path and mtime of the database set with InitGeoDB(), for ReloadGeoDB().
+	geoMu    sync.Mutex
+	geoPath  string
+	geoMtime time.Time
+)
 
 // InitGeoDB sets up the geoDB database located at the given path.
 //
-// The database can be the "Countries" or "Cities" version.
+// The database can be the "Countries" or "Cities" version; regions and cities
+// are only available with the "Cities" version.
 //
 // It will use the embeded "Countries" database if path is an empty string.
 func InitGeoDB(path string) {
-	var err error
+	geoMu.Lock()
+	defer geoMu.Unlock()
+	geoPath, geoMtime = path, time.Time{}
 
 	if path != "" {
-		geodb, err = geoip2.Open(path)
+		st, err := os.Stat(path)
 		if err != nil {
 			panic(err)
 		}
+		db, err := geoip2.Open(path)
+		if err != nil {
+			panic(err)
+		}
+		geodb.Store(db)
+		geoMtime = st.ModTime()
 		GeoDB = nil // Save some memory.
 		return
 	}
@@ -45,10 +65,42 @@ func InitGeoDB(path string) {
 	if err != nil {
 		panic(err)
 	}
-	geodb, err = geoip2.FromBytes(d)
+	db, err := geoip2.FromBytes(d)
 	if err != nil {
 		panic(err)
 	}
+	geodb.Store(db)
+}
+
+// ReloadGeoDB reloads the database set with InitGeoDB() if the file was
+// modified since it was loaded. It does nothing for the embedded database.
+//
+// The previous database is closed after a minute, to give running lookups the
+// time to finish.
+func ReloadGeoDB() (bool, error) {
+	geoMu.Lock()
+	defer geoMu.Unlock()
+	if geoPath == "" {
+		return false, nil
+	}
+
+	st, err := os.Stat(geoPath)
+	if err != nil {
+		return false, errors.Wrap(err, "ReloadGeoDB")
+	}
+	if st.ModTime().Equal(geoMtime) {
+		return false, nil
+	}
+
+	db, err := geoip2.Open(geoPath)
+	if err != nil {
+		return false, errors.Wrap(err, "ReloadGeoDB")
+	}
+	if old := geodb.Swap(db); old != nil {
+		time.AfterFunc(time.Minute, func() { old.Close() })
+	}
+	geoMtime = st.ModTime()
+	return true, nil
 }
 
 type Location struct {
@@ -62,6 +114,10 @@ type Location struct {
 	// TODO: send patch to staticcheck to deal with this better. This shouldn't
 	// errror since "ISO" is an initialism.
 	ISO3166_2 string `db:"iso_3166_2"` //lint:ignore ST1003 staticcheck bug
+
+	// City name; only set by Lookup() with a "Cities" database. This isn't
+	// stored in the locations table.
+	City string `db:"-"`
 }
 
 // ByCode gets a location by ISO-3166-2 code; e.g. "US" or "US-TX".
@@ -90,14 +146,18 @@ func (l *Location) ByCode(ctx context.Context, code string) error {
 //
 // This will insert a row in the locations table if one doesn't exist yet.
 func (l *Location) Lookup(ctx context.Context, ip string) error {
-	if geodb == nil {
+	db := geodb.Load()
+	if db == nil {
 		panic("Location.Lookup: geo.Init not called")
 	}
 
-	loc, err := geodb.City(net.ParseIP(ip))
+	loc, err := db.City(net.ParseIP(ip))
 	if err != nil {
 		return errors.Wrap(err, "Location.Lookup")
 	}
+	city := loc.City.Names["en"]
+	defer func() { l.City = city }()
+
 	l.Country = loc.Country.IsoCode
 	l.CountryName = loc.Country.Names["en"]
 	if len(loc.Subdivisions) > 0 {
@@ -123,7 +183,8 @@ func (l *Location) Lookup(ctx context.Context, ip string) error {
 		return errors.Wrap(err, "Location.Lookup")
 	}
 
-	cacheLoc(ctx).SetDefault(l.ISO3166_2, l)
+	cache := *l // Don't store the city in the cache.
+	cacheLoc(ctx).SetDefault(l.ISO3166_2, &cache)
 	return nil
 }
 
@@ -136,6 +197,16 @@ func (l Location) LookupIP(ctx context.Context, ip string) string {
 	return l.ISO3166_2
 }
 
+// LookupIPCity is like LookupIP(), but also returns the city name. The city is
+// always blank unless a "Cities" database is used.
+func (l Location) LookupIPCity(ctx context.Context, ip string) (string, string) {
+	err := l.Lookup(ctx, ip)
+	if err != nil {
+		return "", ""
+	}
+	return l.ISO3166_2, l.City
+}
+
 func (l *Location) insert(ctx context.Context) (err error) {
 	l.ID, err = zdb.InsertID(ctx, "location_id",
 		`insert into locations (country, region, country_name, region_name) values (?, ?, ?, ?)`,
@@ -171,8 +242,9 @@ func (l *Locations) ListCountries(ctx context.Context) error {
 // but in most cases it should be (much) faster, and this should get called
 // extremely infrequently anyway, if ever.
 func findGeoName(country, region string) (string, string) {
-	hasRegions := geodb.Metadata().DatabaseType == "City"
-	iter := geodb.DB().Data()
+	db := geodb.Load()
+	hasRegions := db.Metadata().DatabaseType == "City"
+	iter := db.DB().Data()
 	for iter.Next() {
 		var r struct {
 			Country struct {
@@ -26,7 +26,7 @@ func TestLocations(t *testing.T) {
 			}
 
 			out := fmt.Sprintf("%#v", l)
-			want := `goatcounter.Location{ID:2, Country:"IE", Region:"", CountryName:"Ireland", RegionName:"", ISO3166_2:"IE"}`
+			want := `goatcounter.Location{ID:2, Country:"IE", Region:"", CountryName:"Ireland", RegionName:"", ISO3166_2:"IE", City:""}`
 			if out != want {
 				t.Error(out)
 			}
@@ -39,7 +39,7 @@ func TestLocations(t *testing.T) {
 			}
 
 			out := fmt.Sprintf("%#v", l)
-			want := `goatcounter.Location{ID:3, Country:"US", Region:"TX", CountryName:"United States", RegionName:"", ISO3166_2:"US-TX"}`
+			want := `goatcounter.Location{ID:3, Country:"US", Region:"TX", CountryName:"United States", RegionName:"", ISO3166_2:"US-TX", City:""}`
 			if out != want {
 				t.Error(out)
 			}
@@ -0,0 +1,168 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"time"
+	"unicode/utf8"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// MFAExpire is how long someone has to complete multi-factor auth after
+// entering the password.
+const MFAExpire = 15 * time.Minute
+
+// LoginSession is a login for a user on a device.
+//
+// Only a hash of the token in the cookie is stored.
+type LoginSession struct {
+	ID     int64 `db:"login_session_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"` // Always the account ID.
+	UserID int64 `db:"user_id" json:"-"`
+
+	Token      string     `db:"token" json:"-"`
+	CSRFToken  string     `db:"csrf_token" json:"-"`
+	MFAPending zbool.Bool `db:"mfa_pending" json:"-"`
+	UserAgent  string     `db:"user_agent" json:"user_agent"`
+	IP         string     `db:"ip" json:"ip"`
+
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at" json:"last_seen_at"`
+}
+
+// ShortUserAgent gets the User-Agent header, truncated for display.
+func (s LoginSession) ShortUserAgent() string {
+	if utf8.RuneCountInString(s.UserAgent) <= 60 {
+		return s.UserAgent
+	}
+	return string([]rune(s.UserAgent)[:59]) + "…"
+}
+
+func hashLoginToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// coarseIP removes the host part of the IP address; we only need it to let
+// people recognize their sessions.
+func coarseIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	p, _ := addr.Prefix(bits)
+	return p.String()
+}
+
+// newLoginSession creates a new session for the user, returning the token to
+// set as the cookie.
+func newLoginSession(ctx context.Context, u *User, userAgent, ip string, mfaPending bool) (*LoginSession, string, error) {
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	token := ztime.Now().Format("20060102") + "-" + zcrypto.Secret256()
+	s := LoginSession{
+		SiteID:     u.Site,
+		UserID:     u.ID,
+		Token:      hashLoginToken(token),
+		CSRFToken:  zcrypto.Secret256(),
+		MFAPending: zbool.Bool(mfaPending),
+		UserAgent:  userAgent,
+		IP:         coarseIP(ip),
+		CreatedAt:  ztime.Now(),
+		LastSeenAt: ztime.Now(),
+	}
+
+	var err error
+	s.ID, err = zdb.InsertID(ctx, "login_session_id",
+		`insert into login_sessions (site_id, user_id, token, csrf_token, mfa_pending, user_agent, ip, created_at, last_seen_at) values (?)`,
+		[]any{s.SiteID, s.UserID, s.Token, s.CSRFToken, s.MFAPending, s.UserAgent, s.IP, s.CreatedAt, s.LastSeenAt})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "newLoginSession")
+	}
+	return &s, token, nil
+}
+
+// ByToken gets a session by the token from the cookie.
+func (s *LoginSession) ByToken(ctx context.Context, token string) error {
+	return errors.Wrap(zdb.Get(ctx, s,
+		`select * from login_sessions where token=$1`, hashLoginToken(token)),
+		"LoginSession.ByToken")
+}
+
+// ByID gets a session for the current user by ID.
+func (s *LoginSession) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, s, `/* LoginSession.ByID */
+		select * from login_sessions where login_session_id=$1 and site_id=$2 and user_id=$3`,
+		id, MustGetSite(ctx).IDOrParent(), GetUser(ctx).ID), "LoginSession.ByID %d", id)
+}
+
+// UpdateSeen sets the last seen time.
+func (s *LoginSession) UpdateSeen(ctx context.Context) error {
+	if s.ID == 0 {
+		return errors.New("ID == 0")
+	}
+
+	// Update once an hour at the most.
+	if s.LastSeenAt.After(ztime.Now().Add(-1 * time.Hour)) {
+		return nil
+	}
+
+	s.LastSeenAt = ztime.Now()
+	err := zdb.Exec(ctx, `update login_sessions set last_seen_at=$1 where login_session_id=$2`,
+		s.LastSeenAt, s.ID)
+	return errors.Wrap(err, "LoginSession.UpdateSeen")
+}
+
+// Delete this session, logging out the device.
+func (s *LoginSession) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* LoginSession.Delete */ delete from login_sessions where login_session_id=$1 and site_id=$2`,
+		s.ID, s.SiteID)
+	return errors.Wrapf(err, "LoginSession.Delete %d", s.ID)
+}
+
+type LoginSessions []LoginSession
+
+// ListUser lists all sessions for a user, except those still waiting for
+// multi-factor auth.
+func (s *LoginSessions) ListUser(ctx context.Context, userID int64) error {
+	return errors.Wrap(zdb.Select(ctx, s, `
+		select * from login_sessions
+		where site_id=$1 and user_id=$2 and mfa_pending=0
+		order by last_seen_at desc`,
+		MustGetSite(ctx).IDOrParent(), userID), "LoginSessions.ListUser")
+}
+
+// DeleteUser deletes all sessions for a user, except the session with the ID
+// keep (if any).
+func (s *LoginSessions) DeleteUser(ctx context.Context, siteID, userID, keep int64) error {
+	err := zdb.Exec(ctx,
+		`delete from login_sessions where site_id=$1 and user_id=$2 and login_session_id != $3`,
+		siteID, userID, keep)
+	return errors.Wrap(err, "LoginSessions.DeleteUser")
+}
+
+// DeleteExpired deletes sessions for which multi-factor auth was never
+// completed.
+func (s *LoginSessions) DeleteExpired(ctx context.Context) error {
+	err := zdb.Exec(ctx, `delete from login_sessions where mfa_pending=1 and created_at < $1`,
+		ztime.Now().Add(-MFAExpire))
+	return errors.Wrap(err, "LoginSessions.DeleteExpired")
+}
@@ -0,0 +1,26 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import "testing"
+
+func TestCoarseIP(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"192.0.2.42", "192.0.2.0/24"},
+		{"::ffff:192.0.2.42", "192.0.2.0/24"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234::/48"},
+		{"", ""},
+		{"not an ip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := coarseIP(tt.in); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
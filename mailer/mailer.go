@@ -0,0 +1,200 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package mailer sends email through SMTP or the HTTP API of an email
+// provider.
+//
+// All email is created with blackmail, which writes every message to the
+// Writer:
+//
+//	w := mailer.NewWriter(transport)
+//	blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(w))
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Transport sends a message.
+type Transport interface {
+	// Send a complete RFC 5322 message to the recipients.
+	Send(from string, to []string, msg []byte) error
+
+	// Name of the transport, for logs.
+	Name() string
+}
+
+// New creates a new transport.
+//
+// If api is empty this uses SMTP, with the same connection string as
+// blackmail.NewMailer(): an URL for a relay, ConnectDirect to deliver to the MX
+// records, or ConnectWriter to write the messages to out.
+//
+// Otherwise, api is the HTTP API to use as "provider:arg[,url]":
+//
+//	mailgun:domain      Mailgun; key is the API key.
+//	ses:region          Amazon SES; key is "access-key-id:secret-access-key".
+//
+// The optional URL overrides the API endpoint; "eu" can be used as a shortcut
+// for Mailgun's EU region.
+func New(smtp, api, key string, out io.Writer) (Transport, error) {
+	if api == "" {
+		if smtp == ConnectWriter {
+			return Print{Out: out}, nil
+		}
+		return SMTP{URL: smtp}, nil
+	}
+
+	provider, arg, _ := strings.Cut(api, ":")
+	arg, endpoint, _ := strings.Cut(arg, ",")
+	if arg == "" {
+		return nil, fmt.Errorf("mailer.New: %q: missing argument after %q", api, provider+":")
+	}
+	if key == "" {
+		return nil, fmt.Errorf("mailer.New: %q: API key is empty", api)
+	}
+
+	switch provider {
+	default:
+		return nil, fmt.Errorf("mailer.New: unknown API %q; must be mailgun or ses", provider)
+	case "mailgun":
+		if endpoint == "eu" {
+			endpoint = MailgunEU
+		}
+		return Mailgun{Domain: arg, Key: key, API: endpoint}, nil
+	case "ses":
+		id, secret, ok := strings.Cut(key, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, errors.New("mailer.New: SES key must be as \"access-key-id:secret-access-key\"")
+		}
+		return SES{Region: arg, AccessKey: id, SecretKey: secret, API: endpoint}, nil
+	}
+}
+
+// Writer sends every message written to it with a transport.
+//
+// This is intended to be used with blackmail's writer mailer, which writes
+// every message with a single Write() call.
+//
+// The recipients are read from the To and Cc headers; Bcc isn't supported.
+type Writer struct {
+	t Transport
+
+	// Sign the message before sending it, for example with DKIM. Optional.
+	Sign func(msg []byte) ([]byte, error)
+
+	// Called for every error; blackmail ignores errors from Write(), so this
+	// should be set to log them.
+	Errors func(error)
+
+	// Called if sending the message failed, so it can be stored and retried
+	// later. The message is already signed. Optional.
+	Outbox func(from string, to []string, msg []byte, sendErr error) error
+}
+
+// NewWriter creates a new Writer.
+func NewWriter(t Transport) *Writer {
+	return &Writer{t: t}
+}
+
+// Transport gets the transport messages are sent with.
+func (w *Writer) Transport() Transport { return w.t }
+
+func (w *Writer) Write(msg []byte) (int, error) {
+	err := w.write(msg)
+	if err != nil {
+		if w.Errors != nil {
+			w.Errors(err)
+		}
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (w *Writer) write(msg []byte) error {
+	if w.Sign != nil {
+		var err error
+		msg, err = w.Sign(msg)
+		if err != nil {
+			return err
+		}
+	}
+	if p, ok := w.t.(Print); ok {
+		return p.Send("", nil, msg)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return fmt.Errorf("mailer.Writer: %w", err)
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return fmt.Errorf("mailer.Writer: From: %w", err)
+	}
+	var to []string
+	for _, h := range []string{"To", "Cc"} {
+		if m.Header.Get(h) == "" {
+			continue
+		}
+		list, err := m.Header.AddressList(h)
+		if err != nil {
+			return fmt.Errorf("mailer.Writer: %s: %w", h, err)
+		}
+		for _, a := range list {
+			to = append(to, a.Address)
+		}
+	}
+	if len(to) == 0 {
+		return errors.New("mailer.Writer: no recipients")
+	}
+
+	err = w.t.Send(from.Address, to, msg)
+	if err != nil && w.Outbox != nil {
+		if qErr := w.Outbox(from.Address, to, msg, err); qErr != nil {
+			return errors.Join(err, qErr)
+		}
+		return fmt.Errorf("%w (queued to retry later)", err)
+	}
+	return err
+}
+
+// Print writes messages to Out, without sending them.
+type Print struct{ Out io.Writer }
+
+func (p Print) Name() string { return "print" }
+
+func (p Print) Send(_ string, _ []string, msg []byte) error {
+	_, err := p.Out.Write(msg)
+	return err
+}
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// apiError gets the error from an API response, which is usually a JSON object
+// with the error in "message" or "Message".
+func apiError(name string, resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var j struct {
+		Message string `json:"message"`
+	}
+	msg := strings.TrimSpace(string(b))
+	if json.Unmarshal(b, &j) == nil && j.Message != "" {
+		msg = j.Message
+	}
+	if len(msg) > 500 {
+		msg = msg[:500]
+	}
+	if msg == "" {
+		return fmt.Errorf("%s: %s", name, resp.Status)
+	}
+	return fmt.Errorf("%s: %s: %s", name, resp.Status, msg)
+}
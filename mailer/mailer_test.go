@@ -0,0 +1,239 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMsg = "From: GoatCounter <test@example.com>\r\n" +
+	"To: someone@example.net, other@example.org\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+type testTransport struct {
+	from string
+	to   []string
+	msg  []byte
+	err  error
+}
+
+func (t *testTransport) Name() string { return "test" }
+
+func (t *testTransport) Send(from string, to []string, msg []byte) error {
+	t.from, t.to, t.msg = from, to, msg
+	return t.err
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		smtp, api, key string
+		want           Transport
+		wantErr        string
+	}{
+		{ConnectWriter, "", "", Print{}, ""},
+		{ConnectDirect, "", "", SMTP{URL: ConnectDirect}, ""},
+		{"smtp://x:y@localhost", "", "", SMTP{URL: "smtp://x:y@localhost"}, ""},
+
+		{"", "mailgun:mg.example.com", "k", Mailgun{Domain: "mg.example.com", Key: "k"}, ""},
+		{"", "mailgun:mg.example.com,eu", "k", Mailgun{Domain: "mg.example.com", Key: "k", API: MailgunEU}, ""},
+		{"", "ses:eu-west-1", "id:secret", SES{Region: "eu-west-1", AccessKey: "id", SecretKey: "secret"}, ""},
+		{"", "ses:eu-west-1,http://localhost", "id:secret", SES{Region: "eu-west-1", AccessKey: "id", SecretKey: "secret", API: "http://localhost"}, ""},
+
+		{"", "mailgun:", "k", nil, "missing argument"},
+		{"", "mailgun:mg.example.com", "", nil, "API key is empty"},
+		{"", "ses:eu-west-1", "secret", nil, "access-key-id:secret-access-key"},
+		{"", "sendmail:x", "k", nil, "unknown API"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.smtp+tt.api, func(t *testing.T) {
+			have, err := New(tt.smtp, tt.api, tt.key, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tt.want {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tr := new(testTransport)
+	w := NewWriter(tr)
+	w.Sign = func(msg []byte) ([]byte, error) { return append([]byte("X-Signed: yes\r\n"), msg...), nil }
+
+	n, err := w.Write([]byte(testMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(testMsg) {
+		t.Errorf("n = %d", n)
+	}
+	if tr.from != "test@example.com" || strings.Join(tr.to, " ") != "someone@example.net other@example.org" {
+		t.Errorf("from=%q; to=%q", tr.from, tr.to)
+	}
+	if !strings.HasPrefix(string(tr.msg), "X-Signed: yes\r\n") {
+		t.Errorf("not signed:\n%s", tr.msg)
+	}
+
+	var logged error
+	w.Errors = func(err error) { logged = err }
+	if _, err := w.Write([]byte("no headers")); err == nil || logged == nil {
+		t.Errorf("err=%v; logged=%v", err, logged)
+	}
+
+	logged = nil
+	tr.err = errors.New("oh noes")
+	if _, err := w.Write([]byte(testMsg)); err == nil || logged != tr.err {
+		t.Errorf("err=%v; logged=%v", err, logged)
+	}
+
+	var queued []byte
+	w.Outbox = func(from string, to []string, msg []byte, sendErr error) error {
+		queued = msg
+		return nil
+	}
+	if _, err := w.Write([]byte(testMsg)); err == nil || !strings.Contains(err.Error(), "queued to retry later") {
+		t.Errorf("err=%v", err)
+	}
+	if !strings.HasPrefix(string(queued), "X-Signed: yes\r\n") {
+		t.Errorf("not queued or not signed:\n%s", queued)
+	}
+
+	buf := new(bytes.Buffer)
+	_, err = NewWriter(Print{Out: buf}).Write([]byte(testMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != testMsg {
+		t.Errorf("wrong output:\n%s", buf.String())
+	}
+}
+
+func TestMailgun(t *testing.T) {
+	var (
+		status = 200
+		path   string
+		auth   string
+		to     []string
+		msg    []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		_, auth, _ = r.BasicAuth()
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+		}
+		to = r.MultipartForm.Value["to"]
+		if f, _, err := r.FormFile("message"); err == nil {
+			msg, _ = io.ReadAll(f)
+		}
+
+		w.WriteHeader(status)
+		if status == 200 {
+			w.Write([]byte(`{"id": "<1@mg.example.com>", "message": "Queued. Thank you."}`))
+		} else {
+			w.Write([]byte(`{"message": "Invalid private key"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	m := Mailgun{Domain: "mg.example.com", Key: "key-1", API: srv.URL}
+	err := m.Send("test@example.com", []string{"someone@example.net", "other@example.org"}, []byte(testMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v3/mg.example.com/messages.mime" || auth != "key-1" {
+		t.Errorf("path=%q; auth=%q", path, auth)
+	}
+	if strings.Join(to, " ") != "someone@example.net other@example.org" || string(msg) != testMsg {
+		t.Errorf("to=%q; msg=\n%s", to, msg)
+	}
+
+	status = 401
+	err = m.Send("test@example.com", []string{"someone@example.net"}, []byte(testMsg))
+	if err == nil || err.Error() != "mailer.Mailgun: 401 Unauthorized: Invalid private key" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestSES(t *testing.T) {
+	var (
+		status = 200
+		path   string
+		auth   string
+		body   struct {
+			FromEmailAddress string
+			Destination      struct{ ToAddresses []string }
+			Content          struct{ Raw struct{ Data []byte } }
+		}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth = r.URL.Path, r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+
+		w.WriteHeader(status)
+		if status == 200 {
+			w.Write([]byte(`{"MessageId": "1"}`))
+		} else {
+			w.Write([]byte(`{"message": "Email address is not verified."}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	s := SES{Region: "eu-west-1", AccessKey: "AKID", SecretKey: "secret", API: srv.URL}
+	err := s.Send("test@example.com", []string{"someone@example.net"}, []byte(testMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v2/email/outbound-emails" ||
+		!strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		!strings.Contains(auth, "/eu-west-1/ses/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=") {
+		t.Errorf("path=%q; auth=%q", path, auth)
+	}
+	if body.FromEmailAddress != "test@example.com" || strings.Join(body.Destination.ToAddresses, " ") != "someone@example.net" ||
+		string(body.Content.Raw.Data) != testMsg {
+		t.Errorf("wrong body: %#v", body)
+	}
+
+	status = 400
+	err = s.Send("test@example.com", []string{"someone@example.net"}, []byte(testMsg))
+	if err == nil || err.Error() != "mailer.SES: 400 Bad Request: Email address is not verified." {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// Test vector from the AWS documentation ("get-vanilla").
+func TestSignV4(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	signV4(r, nil, "us-east-1", "service", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if have := r.Header.Get("Authorization"); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// Mailgun API endpoints.
+const (
+	MailgunUS = "https://api.mailgun.net"
+	MailgunEU = "https://api.eu.mailgun.net"
+)
+
+// Mailgun sends messages with the Mailgun API.
+//
+// https://documentation.mailgun.com/docs/mailgun/api-reference/openapi-final/tag/Messages/
+type Mailgun struct {
+	Domain string // Sending domain.
+	Key    string // API key.
+	API    string // API endpoint; MailgunUS if empty.
+}
+
+func (m Mailgun) Name() string { return "mailgun" }
+
+func (m Mailgun) Send(from string, to []string, msg []byte) error {
+	api := m.API
+	if api == "" {
+		api = MailgunUS
+	}
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	for _, t := range to {
+		err := form.WriteField("to", t)
+		if err != nil {
+			return fmt.Errorf("mailer.Mailgun: %w", err)
+		}
+	}
+	fw, err := form.CreateFormFile("message", "message.eml")
+	if err != nil {
+		return fmt.Errorf("mailer.Mailgun: %w", err)
+	}
+	_, err = fw.Write(msg)
+	if err != nil {
+		return fmt.Errorf("mailer.Mailgun: %w", err)
+	}
+	err = form.Close()
+	if err != nil {
+		return fmt.Errorf("mailer.Mailgun: %w", err)
+	}
+
+	r, err := http.NewRequest(http.MethodPost,
+		api+"/v3/"+url.PathEscape(m.Domain)+"/messages.mime", body)
+	if err != nil {
+		return fmt.Errorf("mailer.Mailgun: %w", err)
+	}
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.SetBasicAuth("api", m.Key)
+
+	resp, err := client.Do(r)
+	if err != nil {
+		return fmt.Errorf("mailer.Mailgun: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiError("mailer.Mailgun", resp)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SES sends messages with the Amazon SES v2 API.
+//
+// https://docs.aws.amazon.com/ses/latest/APIReference-V2/API_SendEmail.html
+type SES struct {
+	Region    string
+	AccessKey string
+	SecretKey string
+	API       string // API endpoint; https://email.<region>.amazonaws.com if empty.
+}
+
+func (s SES) Name() string { return "ses" }
+
+func (s SES) Send(from string, to []string, msg []byte) error {
+	api := s.API
+	if api == "" {
+		api = "https://email." + s.Region + ".amazonaws.com"
+	}
+
+	var req struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct {
+			Raw struct{ Data []byte } // Encoded as base64.
+		}
+	}
+	req.FromEmailAddress = from
+	req.Destination.ToAddresses = to
+	req.Content.Raw.Data = msg
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("mailer.SES: %w", err)
+	}
+
+	r, err := http.NewRequest(http.MethodPost, api+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("mailer.SES: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	signV4(r, body, s.Region, "ses", s.AccessKey, s.SecretKey, time.Now())
+
+	resp, err := client.Do(r)
+	if err != nil {
+		return fmt.Errorf("mailer.SES: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiError("mailer.SES", resp)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// signV4 signs the request with AWS Signature Version 4; this signs the Host
+// header and all headers that are set on the request.
+//
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+func signV4(r *http.Request, body []byte, region, service, key, secret string, now time.Time) {
+	var (
+		amzDate = now.UTC().Format("20060102T150405Z")
+		day     = amzDate[:8]
+		scope   = day + "/" + region + "/" + service + "/aws4_request"
+		payload = sha256.Sum256(body)
+	)
+	r.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": r.URL.Host}
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	canon := new(strings.Builder)
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	fmt.Fprintf(canon, "%s\n%s\n%s\n", r.Method, path, r.URL.Query().Encode())
+	for _, k := range names {
+		fmt.Fprintf(canon, "%s:%s\n", k, strings.TrimSpace(headers[k]))
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(canon, "\n%s\n%s", signed, hex.EncodeToString(payload[:]))
+
+	reqHash := sha256.Sum256([]byte(canon.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	k := hmacSHA256([]byte("AWS4"+secret), day)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	k = hmacSHA256(k, "aws4_request")
+
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		key, scope, signed, hex.EncodeToString(hmacSHA256(k, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,174 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Connection strings for SMTP; these are the same as blackmail.NewMailer().
+const (
+	ConnectWriter = "writer" // Write to an io.Writer.
+	ConnectDirect = "direct" // Connect directly to MX records.
+)
+
+// SMTP sends messages through an SMTP relay, or directly to the MX records of
+// the recipients if URL is ConnectDirect or empty.
+type SMTP struct{ URL string }
+
+func (s SMTP) Name() string {
+	if s.URL == ConnectDirect || s.URL == "" {
+		return "smtp-direct"
+	}
+	return "smtp"
+}
+
+func (s SMTP) Send(from string, to []string, msg []byte) error {
+	if s.URL == ConnectDirect || s.URL == "" {
+		return sendDirect(from, to, msg)
+	}
+	return sendRelay(s.URL, from, to, msg)
+}
+
+// sendRelay sends the message through an SMTP relay; this uses STARTTLS if the
+// server supports it, or TLS if the scheme is smtps://.
+func sendRelay(relay, from string, to []string, msg []byte) error {
+	u, err := url.Parse(relay)
+	if err != nil {
+		return fmt.Errorf("mailer.sendRelay: %w", err)
+	}
+	if u.Host == "" {
+		return errors.New("mailer.sendRelay: host empty")
+	}
+
+	host, addr := u.Hostname(), u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(host, map[bool]string{true: "465", false: "25"}[u.Scheme == "smtps"])
+	}
+
+	var c *smtp.Client
+	if u.Scheme == "smtps" {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: host})
+		if err != nil {
+			return fmt.Errorf("mailer.sendRelay: %w", err)
+		}
+		c, err = smtp.NewClient(conn, host)
+		if err != nil {
+			return fmt.Errorf("mailer.sendRelay: %w", err)
+		}
+	} else {
+		c, err = smtp.Dial(addr)
+		if err != nil {
+			return fmt.Errorf("mailer.sendRelay: %w", err)
+		}
+	}
+	defer c.Close()
+
+	var auth smtp.Auth
+	if u.User != nil {
+		pw, _ := u.User.Password()
+		auth = smtp.PlainAuth("", u.User.Username(), pw, host)
+	}
+	err = deliver(c, "", host, auth, from, to, msg)
+	if err != nil {
+		return fmt.Errorf("mailer.sendRelay: %w", err)
+	}
+	return nil
+}
+
+// sendDirect delivers the message to the MX records for every recipient's
+// domain, trying the next MX if one fails.
+func sendDirect(from string, to []string, msg []byte) error {
+	hello, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("mailer.sendDirect: getting hostname: %w", err)
+	}
+
+	var (
+		domains []string
+		byDom   = make(map[string][]string)
+	)
+	for _, t := range to {
+		d := strings.ToLower(t[strings.LastIndex(t, "@")+1:])
+		if _, ok := byDom[d]; !ok {
+			domains = append(domains, d)
+		}
+		byDom[d] = append(byDom[d], t)
+	}
+
+	var errs []error
+	for _, d := range domains {
+		hosts := []string{d}
+		if mx, err := net.LookupMX(d); err == nil && len(mx) > 0 {
+			hosts = hosts[:0]
+			for _, m := range mx {
+				hosts = append(hosts, strings.TrimSuffix(m.Host, "."))
+			}
+		}
+
+		var err error
+		for _, h := range hosts {
+			var c *smtp.Client
+			c, err = smtp.Dial(net.JoinHostPort(h, "25"))
+			if err != nil {
+				continue
+			}
+			err = deliver(c, hello, h, nil, from, byDom[d], msg)
+			c.Close()
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("mailer.sendDirect: %s: %w", d, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func deliver(c *smtp.Client, hello, host string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	if hello != "" {
+		if err := c.Hello(hello); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, t := range to {
+		if err := c.Rcpt(t); err != nil {
+			return err
+		}
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(msg); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
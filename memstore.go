@@ -6,6 +6,9 @@ package goatcounter
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net/url"
@@ -14,6 +17,7 @@ import (
 	"sync"
 	"time"
 
+	"zgo.at/goatcounter/v2/metrics"
 	"zgo.at/json"
 	"zgo.at/zdb"
 	"zgo.at/zlog"
@@ -41,6 +45,9 @@ type ms struct {
 	sessionHashes map[zint.Uint128]sessionKey         // sessionID → sessionKey
 	sessionPaths  map[zint.Uint128]map[int64]struct{} // SessionID → path_id
 	sessionSeen   map[zint.Uint128]int64              // SessionID → lastseen
+	sessionEntry  map[zint.Uint128]SessionEntry       // SessionID → entry page
+
+	visitorKey []byte // Secret for visitorHash()
 
 	testHook bool
 }
@@ -52,6 +59,7 @@ type storedSession struct {
 	Hashes   map[zint.Uint128]sessionKey         `json:"hashes"`
 	Paths    map[zint.Uint128]map[int64]struct{} `json:"paths"`
 	Seen     map[zint.Uint128]int64              `json:"seen"`
+	Entry    map[zint.Uint128]SessionEntry       `json:"entry"`
 }
 
 func (m *ms) Reset() {
@@ -62,6 +70,7 @@ func (m *ms) Reset() {
 	m.sessionHashes = make(map[zint.Uint128]sessionKey)
 	m.sessionPaths = make(map[zint.Uint128]map[int64]struct{})
 	m.sessionSeen = make(map[zint.Uint128]int64)
+	m.sessionEntry = make(map[zint.Uint128]SessionEntry)
 	TestSeqSession = zint.Uint128{TestSession[0], TestSession[1] + 1}
 }
 
@@ -79,6 +88,13 @@ func (m *ms) Init(db zdb.DB) error {
 	m.Reset()
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
+
+	key, err := LoadVisitorKey(zdb.WithDB(context.Background(), db))
+	if err != nil {
+		return err
+	}
+	m.visitorKey = key
+
 	defer func() {
 		err := db.Exec(context.Background(), `delete from store where key='session'`)
 		if err != nil {
@@ -87,7 +103,7 @@ func (m *ms) Init(db zdb.DB) error {
 	}()
 
 	var s []byte
-	err := db.Get(context.Background(), &s, `select value from store where key='session'`)
+	err = db.Get(context.Background(), &s, `select value from store where key='session'`)
 	if err != nil {
 		if zdb.ErrNoRows(err) {
 			return nil
@@ -115,6 +131,9 @@ func (m *ms) Init(db zdb.DB) error {
 	if stored.Seen != nil {
 		m.sessionSeen = stored.Seen
 	}
+	if stored.Entry != nil {
+		m.sessionEntry = stored.Entry
+	}
 	return nil
 }
 
@@ -127,6 +146,7 @@ func (m *ms) StoreSessions(db zdb.DB) {
 		Paths:    m.sessionPaths,
 		Seen:     m.sessionSeen,
 		Hashes:   m.sessionHashes,
+		Entry:    m.sessionEntry,
 	})
 	if err != nil {
 		zlog.Error(err)
@@ -144,6 +164,27 @@ func (m *ms) Append(hits ...Hit) {
 	m.hitMu.Lock()
 	m.hits = append(m.hits, hits...)
 	m.hitMu.Unlock()
+	metrics.Count("goatcounter_memstore_received_total", float64(len(hits)))
+}
+
+// Visible upgrades a prerendered pageview that isn't persisted yet to a regular
+// pageview, once the page became visible. It returns false if there is no such
+// pageview, in which case the visible pageview should be counted as a new one.
+func (m *ms) Visible(siteID int64, prerender string) bool {
+	if prerender == "" {
+		return false
+	}
+
+	m.hitMu.Lock()
+	defer m.hitMu.Unlock()
+	for i := range m.hits {
+		h := &m.hits[i]
+		if h.Site == siteID && h.Bot == BotClientPrerender && h.Prerender == prerender {
+			h.Bot, h.CreatedAt = 0, ztime.Now()
+			return true
+		}
+	}
+	return false
 }
 
 func (m *ms) SessionsLen() int {
@@ -158,29 +199,18 @@ func (m *ms) Len() int {
 	return len(m.hits)
 }
 
-var (
-	refspamSubdomains []string
-	refspamOnce       sync.Once
-)
-
-func isRefspam(host string) bool {
-	if _, ok := refspam[host]; ok {
-		return true
-	}
-
-	refspamOnce.Do(func() {
-		refspamSubdomains = make([]string, 0, len(refspam))
-		for v := range refspam {
-			refspamSubdomains = append(refspamSubdomains, "."+v)
-		}
-	})
-
-	for _, v := range refspamSubdomains {
-		if strings.HasSuffix(host, v) {
-			return true
+// CountSince counts the pageviews for the site that aren't persisted yet and
+// were created on or after t; bots aren't counted.
+func (m *ms) CountSince(siteID int64, t time.Time) int {
+	m.hitMu.RLock()
+	defer m.hitMu.RUnlock()
+	var n int
+	for _, h := range m.hits {
+		if h.Site == siteID && h.Bot == 0 && !h.CreatedAt.Before(t) {
+			n++
 		}
 	}
-	return false
+	return n
 }
 
 func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
@@ -188,6 +218,9 @@ func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
 		return nil, nil
 	}
 
+	start := time.Now()
+	defer func() { metrics.Observe("goatcounter_persist_seconds", time.Since(start)) }()
+
 	m.hitMu.Lock()
 	hits := make([]Hit, len(m.hits))
 	copy(hits, m.hits)
@@ -197,7 +230,7 @@ func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
 	newHits := make([]Hit, 0, len(hits))
 	ins := zdb.NewBulkInsert(ctx, "hits", []string{"site_id", "path_id", "ref_id",
 		"browser_id", "system_id", "size_id", "location", "language", "created_at", "bot",
-		"session", "first_visit"})
+		"session", "first_visit", "status"})
 	for _, h := range hits {
 		if m.processHit(ctx, &h) {
 			// Don't return hits that failed validation; otherwise cron will try to
@@ -206,12 +239,16 @@ func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
 
 			if !h.NoStore {
 				ins.Values(h.Site, h.PathID, h.RefID, h.BrowserID, h.SystemID, h.SizeID,
-					h.Location, h.Language, h.CreatedAt.Round(time.Second), h.Bot, h.Session, h.FirstVisit)
+					h.Location, h.Language, h.CreatedAt.Round(time.Second), h.Bot, h.Session, h.FirstVisit, h.Status)
 			}
 		}
 	}
 
-	return newHits, ins.Finish()
+	err := ins.Finish()
+	if err == nil {
+		metrics.Count("goatcounter_persist_pageviews_total", float64(len(newHits)))
+	}
+	return newHits, err
 }
 
 func (m *ms) processHit(ctx context.Context, h *Hit) bool {
@@ -223,15 +260,6 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 		return true
 	}
 
-	// Ignore spammers.
-	h.RefURL, _ = url.Parse(h.Ref)
-	if h.RefURL != nil {
-		if isRefspam(h.RefURL.Host) {
-			l.Debugf("refspam ignored: %q", h.RefURL.Host)
-			return false
-		}
-	}
-
 	var site Site
 	err := site.ByID(ctx, h.Site)
 	if err != nil {
@@ -242,6 +270,23 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 	if !site.Settings.Collect.Has(CollectHits) && h.Bot == 0 {
 		h.NoStore = true
 	}
+	// Redirects, errors, etc. from logfiles aren't pageviews; only count them
+	// in the status code stats.
+	pageview := StatusIsPageview(h.Status)
+	if !pageview {
+		h.NoStore = true
+	}
+
+	// Ignore or flag spammers.
+	h.RefURL, _ = url.Parse(h.Ref)
+	if h.RefURL != nil && isRefspam(h.RefURL.Host) {
+		if site.Settings.RefSpam != RefSpamFlag {
+			l.Debugf("refspam ignored: %q", h.RefURL.Host)
+			return false
+		}
+		h.Ref = h.RefURL.Host // Don't need the full URL for spam.
+		h.RefScheme = RefSchemeSpam
+	}
 
 	if !site.Settings.Collect.Has(CollectReferrer) {
 		h.Query = ""
@@ -260,9 +305,13 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 		return false
 	}
 
-	if h.Session.IsZero() && site.Settings.Collect.Has(CollectSession) {
+	if h.Session.IsZero() && pageview && site.Settings.Collect.Has(CollectSession) {
 		h.Session, h.FirstVisit = m.session(ctx, site.ID, h.PathID, h.UserSessionID, h.UserAgentHeader, h.RemoteAddr)
 	}
+	if pageview && !h.Event && h.Bot == 0 &&
+		site.Settings.Collect.Has(CollectSession) && site.Settings.Collect.Has(CollectVisitors) {
+		h.VisitorHash = m.visitorHash(site.ID, newSessionKey(site.ID, h.UserSessionID, h.UserAgentHeader, h.RemoteAddr))
+	}
 
 	if !site.Settings.Collect.Has(CollectSession) {
 		h.Session = zint.Uint128{}
@@ -297,6 +346,10 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 			h.Location = l.ISO3166_2
 		}
 	}
+	// Cities are stored per region, so also remove it if the region is.
+	if !site.Settings.Collect.Has(CollectLocationCity) || !strings.ContainsRune(h.Location, '-') {
+		h.City = ""
+	}
 
 	if h.Ignore() {
 		return false
@@ -308,6 +361,12 @@ func (m *ms) processHit(ctx context.Context, h *Hit) bool {
 		return false
 	}
 
+	// Events don't count as a pageview: a session with one pageview and some
+	// events is still a bounce.
+	if !h.Session.IsZero() && !h.Event && h.Bot == 0 {
+		h.SessionEntry = m.pageview(h.Session, h.PathID, h.CreatedAt)
+	}
+
 	return true
 }
 
@@ -339,6 +398,7 @@ func (m *ms) EvictSessions() {
 		delete(m.sessionPaths, id)
 		delete(m.sessionSeen, id)
 		delete(m.sessionHashes, id)
+		delete(m.sessionEntry, id)
 	}
 }
 
@@ -353,11 +413,23 @@ func (m *ms) SessionID() zint.Uint128 {
 
 var sessLog = zlog.Module("session")
 
-func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, ua, remoteAddr string) (zint.Uint128, zbool.Bool) {
-	sk := sessionKey(userSessionID)
+func newSessionKey(siteID int64, userSessionID, ua, remoteAddr string) sessionKey {
 	if userSessionID == "" {
-		sk = sessionKey(fmt.Sprintf("%s-%s-%d", ua, remoteAddr, siteID))
+		return sessionKey(fmt.Sprintf("%s-%s-%d", ua, remoteAddr, siteID))
 	}
+	return sessionKey(userSessionID)
+}
+
+// visitorHash gets a keyed hash of the session key for the unique visitor
+// sketches; the session key itself is never stored.
+func (m *ms) visitorHash(siteID int64, sk sessionKey) uint64 {
+	mac := hmac.New(sha256.New, m.visitorKey)
+	fmt.Fprintf(mac, "%d-%s", siteID, sk)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, ua, remoteAddr string) (zint.Uint128, zbool.Bool) {
+	sk := newSessionKey(siteID, userSessionID, ua, remoteAddr)
 
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
@@ -393,3 +465,15 @@ func (m *ms) session(ctx context.Context, siteID, pathID int64, userSessionID, u
 	}).Debug("MISS: created new")
 	return id, true
 }
+
+// pageview records a pageview for the session, returning the entry page and
+// number of pageviews so far.
+func (m *ms) pageview(id zint.Uint128, pathID int64, createdAt time.Time) SessionEntry {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	e := m.sessionEntry[id]
+	e.Add(pathID, createdAt)
+	m.sessionEntry[id] = e
+	return e
+}
@@ -164,3 +164,54 @@ func TestMemstoreCollect(t *testing.T) {
 		})
 	}
 }
+
+func TestMemstoreRefspam(t *testing.T) {
+	tests := []struct {
+		refSpam string
+		want    string
+	}{
+		{"", `
+			path    ref             ref_scheme
+			/legit  myadcash.com    h
+		`},
+		{RefSpamDrop, `
+			path    ref             ref_scheme
+			/legit  myadcash.com    h
+		`},
+		{RefSpamFlag, `
+			path    ref             ref_scheme
+			/spam   www.adcash.com  s
+			/legit  myadcash.com    h
+		`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.refSpam, func(t *testing.T) {
+			ctx := gctest.DB(t)
+
+			site := Site{Settings: SiteSettings{RefSpam: tt.refSpam}}
+			ctx = gctest.Site(ctx, t, &site, nil)
+
+			gctest.StoreHits(ctx, t, false, Hit{
+				Site: site.ID,
+				Path: "/spam",
+				Ref:  "https://www.adcash.com/buy",
+			}, Hit{
+				Site: site.ID,
+				Path: "/legit",
+				Ref:  "https://myadcash.com",
+			})
+
+			have := zdb.DumpString(ctx, `
+				select paths.path, refs.ref, refs.ref_scheme
+				from hits
+				join paths using (path_id)
+				left join refs using (ref_id)
+				order by hit_id
+			`)
+			if d := zdb.Diff(have, tt.want); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+}
@@ -125,3 +125,8 @@ func (t *Metric) Done() {
 func (t *Metric) AddTag(tag string) {
 	t.tag += "·" + tag
 }
+
+// Add records a duration that was measured elsewhere.
+func Add(tag string, d time.Duration) {
+	collected.add(tag, d)
+}
@@ -6,6 +6,7 @@ package metrics
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -46,3 +47,48 @@ test·x	15ms	15ms	15ms
 		t.Errorf("\nwant:\n%shave:\n%s", want, have)
 	}
 }
+
+func TestPrometheus(t *testing.T) {
+	Count("goatcounter_count_requests_total", 1, "method", "GET")
+	Count("goatcounter_count_requests_total", 2, "method", "GET")
+	Count("goatcounter_count_requests_total", 1, "method", "POST")
+	Observe("goatcounter_persist_seconds", 1500*time.Millisecond)
+	Observe("goatcounter_persist_seconds", 500*time.Millisecond)
+	Gauge("goatcounter_db_connections", func() float64 { return 4 }, "state", "in_use")
+
+	b := new(strings.Builder)
+	err := WritePrometheus(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{`
+# HELP goatcounter_count_requests_total Requests to /count, by HTTP method.
+# TYPE goatcounter_count_requests_total counter
+goatcounter_count_requests_total{method="GET"} 3
+goatcounter_count_requests_total{method="POST"} 1
+`, `
+# HELP goatcounter_db_connections Open database connections, by state.
+# TYPE goatcounter_db_connections gauge
+goatcounter_db_connections{state="in_use"} 4
+`, `
+# HELP goatcounter_persist_seconds Time to persist the memstore to the database.
+# TYPE goatcounter_persist_seconds summary
+goatcounter_persist_seconds_count 2
+goatcounter_persist_seconds_sum 2
+`}
+	for _, w := range want {
+		if !strings.Contains("\n"+b.String(), w) {
+			t.Errorf("\nwant:%s\nhave:\n%s", w, b)
+		}
+	}
+
+	t.Run("undocumented", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("no panic")
+			}
+		}()
+		Count("goatcounter_xxx_total", 1)
+	})
+}
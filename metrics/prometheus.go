@@ -0,0 +1,148 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics, as exposed with the -metrics flag. The names, types, and
+// labels are stable; update "goatcounter help metrics" when adding new ones.
+//
+// There are intentionally no labels for sites, as this can be a lot of series
+// and would expose the sites on the server.
+var promDesc = map[string]struct{ typ, help string }{
+	"goatcounter_http_requests_total":     {"counter", "HTTP requests, by status code."},
+	"goatcounter_count_requests_total":    {"counter", "Requests to /count, by HTTP method."},
+	"goatcounter_memstore_received_total": {"counter", "Pageviews added to the memstore, from /count and the API."},
+	"goatcounter_memstore_pageviews":      {"gauge", "Pageviews in the memstore that aren't persisted yet."},
+	"goatcounter_memstore_sessions":       {"gauge", "Sessions in the memstore."},
+	"goatcounter_persist_seconds":         {"summary", "Time to persist the memstore to the database."},
+	"goatcounter_persist_pageviews_total": {"counter", "Pageviews persisted to the database."},
+	"goatcounter_cron_task_seconds":       {"summary", "Time to run a background task."},
+	"goatcounter_cron_task_errors_total":  {"counter", "Background tasks that returned an error."},
+	"goatcounter_db_max_connections":      {"gauge", "Maximum number of open database connections; 0 is unlimited."},
+	"goatcounter_db_connections":          {"gauge", "Open database connections, by state."},
+	"goatcounter_db_wait_total":           {"counter", "Times a query waited for a free database connection."},
+	"goatcounter_db_wait_seconds_total":   {"counter", "Total time spent waiting for a free database connection."},
+}
+
+type promSeries struct {
+	name, labels string
+}
+
+var prom = struct {
+	sync.Mutex
+	values map[promSeries]float64
+	gauges map[promSeries]func() float64
+}{
+	values: make(map[promSeries]float64),
+	gauges: make(map[promSeries]func() float64),
+}
+
+func series(name string, labels []string) promSeries {
+	if _, ok := promDesc[name]; !ok {
+		panic(fmt.Sprintf("metrics: undocumented Prometheus metric %q", name))
+	}
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metrics: odd number of labels for %q: %q", name, labels))
+	}
+	if len(labels) == 0 {
+		return promSeries{name: name}
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return promSeries{name: name, labels: b.String()}
+}
+
+// Count adds n to a Prometheus counter; labels are as key, value pairs.
+func Count(name string, n float64, labels ...string) {
+	s := series(name, labels)
+	prom.Lock()
+	defer prom.Unlock()
+	prom.values[s] += n
+}
+
+// Observe records a duration for a Prometheus summary; labels are as key, value
+// pairs.
+func Observe(name string, d time.Duration, labels ...string) {
+	s := series(name, labels)
+	prom.Lock()
+	defer prom.Unlock()
+	prom.values[promSeries{s.name + "_sum", s.labels}] += d.Seconds()
+	prom.values[promSeries{s.name + "_count", s.labels}]++
+}
+
+// Gauge sets the function to get the current value of a Prometheus gauge (or a
+// counter that's kept elsewhere) when it's scraped; labels are as key, value
+// pairs.
+func Gauge(name string, f func() float64, labels ...string) {
+	s := series(name, labels)
+	prom.Lock()
+	defer prom.Unlock()
+	prom.gauges[s] = f
+}
+
+// WritePrometheus writes all metrics in the Prometheus text format.
+func WritePrometheus(w io.Writer) error {
+	prom.Lock()
+	byName := make(map[string][]string)
+	add := func(s promSeries, v float64) {
+		base := strings.TrimSuffix(strings.TrimSuffix(s.name, "_sum"), "_count")
+		if _, ok := promDesc[base]; !ok || promDesc[base].typ != "summary" {
+			base = s.name
+		}
+		byName[base] = append(byName[base],
+			s.name+s.labels+" "+strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	for s, v := range prom.values {
+		add(s, v)
+	}
+	gauges := make(map[promSeries]func() float64, len(prom.gauges))
+	for s, f := range prom.gauges {
+		gauges[s] = f
+	}
+	prom.Unlock()
+
+	// Don't hold the lock while getting the gauges, as they may take a while.
+	for s, f := range gauges {
+		add(s, f())
+	}
+
+	names := make([]string, 0, len(byName))
+	for n := range byName {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	b := bufio.NewWriter(w)
+	for _, n := range names {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", n, promDesc[n].help, n, promDesc[n].typ)
+		sort.Strings(byName[n])
+		for _, l := range byName[n] {
+			b.WriteString(l)
+			b.WriteByte('\n')
+		}
+	}
+	return b.Flush()
+}
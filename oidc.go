@@ -0,0 +1,78 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2/oidc"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+)
+
+type oidcState struct{ nonce, verifier string }
+
+// NewOIDCState creates a new state for an OpenID Connect login, which needs to
+// be completed within 15 minutes.
+func NewOIDCState(ctx context.Context) (state, nonce, verifier string) {
+	state, nonce, verifier = oidc.NewState(), oidc.NewState(), oidc.NewState()
+	cacheOIDC(ctx).SetDefault(state, oidcState{nonce, verifier})
+	return state, nonce, verifier
+}
+
+// UseOIDCState gets the nonce and PKCE verifier for the state.
+//
+// The state can only be used once.
+func UseOIDCState(ctx context.Context, state string) (nonce, verifier string, ok bool) {
+	c := cacheOIDC(ctx)
+	v, ok := c.Get(state)
+	if !ok {
+		return "", "", false
+	}
+	c.Delete(state)
+	s := v.(oidcState)
+	return s.nonce, s.verifier, true
+}
+
+// ByOIDC gets the user for an OpenID Connect login.
+//
+// Existing users are linked by email, which is only trusted if the provider
+// verified it. New users are created with the configured access if the email
+// domain is in the list of allowed domains.
+func (u *User) ByOIDC(ctx context.Context, c oidc.Claims) error {
+	if c.Email == "" || !c.EmailVerified {
+		return guru.New(403, "the identity provider didn't send a verified email address")
+	}
+
+	err := u.ByEmail(ctx, c.Email)
+	if err == nil {
+		if !u.EmailVerified {
+			err = u.VerifyEmail(ctx)
+			if err != nil {
+				return errors.Wrap(err, "User.ByOIDC")
+			}
+			u.EmailVerified = true
+		}
+		return nil
+	}
+	if !zdb.ErrNoRows(err) {
+		return errors.Wrap(err, "User.ByOIDC")
+	}
+
+	domain := strings.ToLower(c.Email[strings.LastIndexByte(c.Email, '@')+1:])
+	if !slices.Contains(Config(ctx).OIDCDomains, domain) {
+		return guru.Errorf(403, "there is no user for %s on this site", c.Email)
+	}
+
+	*u = User{
+		Email:         c.Email,
+		EmailVerified: true,
+		Access:        UserAccesses{"all": Config(ctx).OIDCAccess},
+	}
+	return errors.Wrap(u.Insert(ctx, true), "User.ByOIDC")
+}
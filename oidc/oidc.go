@@ -0,0 +1,437 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package oidc implements an OpenID Connect relying party with the
+// authorization code flow.
+//
+// This only implements what GoatCounter needs: the provider is configured with
+// discovery, clients authenticate with a client secret, and ID tokens must be
+// signed with RS256 or ES256, which is what every common provider (Keycloak,
+// Azure AD, Google, Okta, Authentik, Dex) uses by default.
+//
+// https://openid.net/specs/openid-connect-core-1_0.html
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors.
+var (
+	ErrIssuer    = errors.New("oidc: wrong issuer")
+	ErrAudience  = errors.New("oidc: wrong audience")
+	ErrExpired   = errors.New("oidc: ID token expired")
+	ErrNonce     = errors.New("oidc: wrong nonce")
+	ErrSignature = errors.New("oidc: invalid signature")
+)
+
+// Leeway for clock skew when checking the expiry time.
+const leeway = time.Minute
+
+// Provider is an OpenID Connect provider.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Client       *http.Client // Uses a client with a 10 second timeout if nil.
+
+	mu     sync.Mutex
+	meta   *metadata
+	keys   map[string]crypto.PublicKey
+	keysAt time.Time
+}
+
+type metadata struct {
+	Issuer        string   `json:"issuer"`
+	AuthEndpoint  string   `json:"authorization_endpoint"`
+	TokenEndpoint string   `json:"token_endpoint"`
+	JWKSURI       string   `json:"jwks_uri"`
+	TokenAuth     []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Claims are the claims from the ID token that we use.
+type Claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// New creates a new provider.
+//
+// The provider's configuration is loaded on first use, rather than here, so
+// that a provider being down doesn't prevent startup.
+func New(issuer, clientID, clientSecret string) *Provider {
+	return &Provider{
+		Issuer:       strings.TrimRight(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}
+}
+
+// NewState creates a new random value for the state, nonce, or PKCE verifier.
+func NewState() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (p *Provider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return p.do(req, dst)
+}
+
+func (p *Provider) do(req *http.Request, dst any) error {
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc: %w", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("oidc: reading %s: %w", req.URL, err)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("oidc: %s %s: %s: %s", req.Method, req.URL, resp.Status, b)
+	}
+	err = json.Unmarshal(b, dst)
+	if err != nil {
+		return fmt.Errorf("oidc: parsing response from %s: %w", req.URL, err)
+	}
+	return nil
+}
+
+// discover loads the provider metadata.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	var m metadata
+	err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &m)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(m.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("%w: discovery document has %q", ErrIssuer, m.Issuer)
+	}
+	if m.AuthEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+	p.meta = &m
+	return p.meta, nil
+}
+
+// AuthURL gets the URL to redirect the user to.
+//
+// The state, nonce, and verifier should be created with NewState() and stored
+// for the callback.
+func (p *Provider) AuthURL(ctx context.Context, redirectURI, state, nonce, verifier string) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	ch := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(ch[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(m.AuthEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange the authorization code for an ID token, and verify it.
+func (p *Provider) Exchange(ctx context.Context, redirectURI, code, nonce, verifier string) (Claims, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+	// client_secret_basic is the default if the provider doesn't list
+	// anything.
+	basic := len(m.TokenAuth) == 0 || slices.Contains(m.TokenAuth, "client_secret_basic")
+	if !basic {
+		form.Set("client_id", p.ClientID)
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	err = p.do(req, &tok)
+	if err != nil {
+		return Claims{}, err
+	}
+	if tok.IDToken == "" {
+		return Claims{}, errors.New("oidc: no id_token in token response")
+	}
+	return p.Verify(ctx, tok.IDToken, nonce)
+}
+
+// Verify an ID token and get the claims.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.New("oidc: malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodePart(parts[0], &header)
+	if err != nil {
+		return Claims{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("oidc: malformed signature: %w", err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+	if !verify(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return Claims{}, ErrSignature
+	}
+
+	var c struct {
+		Claims
+		Issuer   string   `json:"iss"`
+		Audience audience `json:"aud"`
+		AZP      string   `json:"azp"`
+		Expires  int64    `json:"exp"`
+		Nonce    string   `json:"nonce"`
+
+		// Azure AD and some others send this as a string.
+		EmailVerified any `json:"email_verified"`
+	}
+	err = decodePart(parts[1], &c)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	if strings.TrimRight(c.Issuer, "/") != p.Issuer {
+		return Claims{}, fmt.Errorf("%w: %q", ErrIssuer, c.Issuer)
+	}
+	if !slices.Contains(c.Audience, p.ClientID) || (len(c.Audience) > 1 && c.AZP != p.ClientID) {
+		return Claims{}, ErrAudience
+	}
+	if time.Unix(c.Expires, 0).Add(leeway).Before(time.Now()) {
+		return Claims{}, ErrExpired
+	}
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(nonce)) != 1 {
+		return Claims{}, ErrNonce
+	}
+	if c.Subject == "" {
+		return Claims{}, errors.New("oidc: no sub claim")
+	}
+
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		c.Claims.EmailVerified = v
+	case string:
+		c.Claims.EmailVerified = v == "true"
+	}
+	return c.Claims, nil
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		err := json.Unmarshal(b, &s)
+		*a = audience{s}
+		return err
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func decodePart(s string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("oidc: malformed ID token: %w", err)
+	}
+	err = json.Unmarshal(b, dst)
+	if err != nil {
+		return fmt.Errorf("oidc: malformed ID token: %w", err)
+	}
+	return nil
+}
+
+func verify(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	h := sha256.Sum256(signed)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, h[:], r, s)
+	}
+	return false
+}
+
+// key gets the signing key by ID; the keys are reloaded if the key isn't
+// found, as providers rotate their keys.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	// Don't hammer the provider with requests for unknown keys.
+	if time.Since(p.keysAt) < time.Minute {
+		return nil, fmt.Errorf("oidc: unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = p.getJSON(ctx, m.JWKSURI, &set)
+	if err != nil {
+		return nil, err
+	}
+	p.keys, p.keysAt = make(map[string]crypto.PublicKey), time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue // Unsupported key types are fine, as long as they're not used.
+		}
+		p.keys[k.Kid] = pub
+	}
+
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("oidc: unknown key %q", kid)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("oidc: invalid key %q", k.Kid)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("oidc: invalid key %q", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("oidc: unsupported curve %q", k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !pub.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("oidc: invalid key %q", k.Kid)
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,178 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter/v2/oidc"
+	"zgo.at/goatcounter/v2/oidc/oidctest"
+)
+
+func TestExchange(t *testing.T) {
+	ctx := context.Background()
+	srv := oidctest.New(t)
+
+	login := func(t *testing.T, p *oidc.Provider) (oidc.Claims, error) {
+		t.Helper()
+		state, nonce, verifier := oidc.NewState(), oidc.NewState(), oidc.NewState()
+		u, err := p.AuthURL(ctx, "https://example.com/callback", state, nonce, verifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, gotState := srv.Authorize(t, u)
+		if gotState != state {
+			t.Fatalf("state: %q", gotState)
+		}
+		return p.Exchange(ctx, "https://example.com/callback", code, nonce, verifier)
+	}
+
+	p := oidc.New(srv.URL, srv.ClientID, srv.ClientSecret)
+	srv.Claims = map[string]any{"sub": "1", "email": "user@example.com", "email_verified": true}
+	c, err := login(t, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject != "1" || c.Email != "user@example.com" || !c.EmailVerified {
+		t.Errorf("%#v", c)
+	}
+
+	t.Run("email_verified as string", func(t *testing.T) {
+		srv.Claims = map[string]any{"sub": "1", "email": "user@example.com", "email_verified": "true"}
+		c, err := login(t, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.EmailVerified {
+			t.Errorf("%#v", c)
+		}
+	})
+	t.Run("ES256", func(t *testing.T) {
+		srv.ES256 = true
+		defer func() { srv.ES256 = false }()
+		_, err := login(t, oidc.New(srv.URL, srv.ClientID, srv.ClientSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("wrong secret", func(t *testing.T) {
+		_, err := login(t, oidc.New(srv.URL, srv.ClientID, "wrong"))
+		if err == nil || !strings.Contains(err.Error(), "401") {
+			t.Fatal(err)
+		}
+	})
+	t.Run("wrong PKCE verifier", func(t *testing.T) {
+		u, err := p.AuthURL(ctx, "https://example.com/callback", "s", "n", oidc.NewState())
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _ := srv.Authorize(t, u)
+		_, err = p.Exchange(ctx, "https://example.com/callback", code, "n", oidc.NewState())
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	srv := oidctest.New(t)
+	p := oidc.New(srv.URL, srv.ClientID, srv.ClientSecret)
+
+	claims := func(mod func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":   srv.URL,
+			"aud":   srv.ClientID,
+			"sub":   "1",
+			"nonce": "n",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"ok", srv.Sign(t, claims(nil)), nil},
+		{"aud list", srv.Sign(t, claims(func(c map[string]any) {
+			c["aud"], c["azp"] = []string{"other", srv.ClientID}, srv.ClientID
+		})), nil},
+		{"wrong issuer", srv.Sign(t, claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })), oidc.ErrIssuer},
+		{"wrong aud", srv.Sign(t, claims(func(c map[string]any) { c["aud"] = "other" })), oidc.ErrAudience},
+		{"aud list without azp", srv.Sign(t, claims(func(c map[string]any) {
+			c["aud"] = []string{"other", srv.ClientID}
+		})), oidc.ErrAudience},
+		{"expired", srv.Sign(t, claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), oidc.ErrExpired},
+		{"wrong nonce", srv.Sign(t, claims(func(c map[string]any) { c["nonce"] = "x" })), oidc.ErrNonce},
+		{"bad signature", func() string {
+			tok := strings.Split(srv.Sign(t, claims(nil)), ".")
+			other := strings.Split(srv.Sign(t, claims(func(c map[string]any) { c["sub"] = "2" })), ".")
+			return tok[0] + "." + tok[1] + "." + other[2]
+		}(), oidc.ErrSignature},
+		{"alg none", "eyJhbGciOiJub25lIn0." + strings.Split(srv.Sign(t, claims(nil)), ".")[1] + ".", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Verify(ctx, tt.token, "n")
+			switch {
+			case tt.name == "ok" || tt.name == "aud list":
+				if err != nil {
+					t.Fatal(err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("wrong error: %v", err)
+				}
+			default:
+				if err == nil {
+					t.Fatal("no error")
+				}
+			}
+		})
+	}
+
+	t.Run("key rotation", func(t *testing.T) {
+		srv.Rotate(t)
+		_, err := p.Verify(ctx, srv.Sign(t, claims(nil)), "n")
+		if err == nil || !strings.Contains(err.Error(), "unknown key") {
+			t.Fatalf("should be rate-limited: %v", err)
+		}
+
+		p := oidc.New(srv.URL, srv.ClientID, srv.ClientSecret)
+		_, err = p.Verify(ctx, srv.Sign(t, claims(nil)), "n")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestAuthURL(t *testing.T) {
+	srv := oidctest.New(t)
+	p := oidc.New(srv.URL+"/", srv.ClientID, srv.ClientSecret)
+	u, err := p.AuthURL(context.Background(), "https://example.com/callback", "s", "n", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := pu.Query()
+	if q.Get("scope") != "openid email profile" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("client_id") != srv.ClientID || q.Get("redirect_uri") != "https://example.com/callback" {
+		t.Errorf("%s", u)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package oidctest provides an OpenID Connect provider for testing.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is an OpenID Connect provider.
+type Server struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+
+	// Claims to add to the ID token; the iss, aud, exp, and nonce are added
+	// automatically.
+	Claims map[string]any
+
+	// Sign with ES256 instead of RS256.
+	ES256 bool
+
+	mu    sync.Mutex
+	kid   int
+	rsa   *rsa.PrivateKey
+	ec    *ecdsa.PrivateKey
+	codes map[string]code
+}
+
+type code struct {
+	nonce, challenge, redirectURI string
+	claims                        map[string]any
+}
+
+// New starts a new provider, which is stopped when the test ends.
+func New(t testing.TB) *Server {
+	s := &Server{
+		ClientID:     "goatcounter",
+		ClientSecret: "secret",
+		codes:        make(map[string]code),
+	}
+	s.Rotate(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/auth", s.auth)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/jwks", s.jwks)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	s.URL = srv.URL
+	return s
+}
+
+// Rotate the signing keys.
+func (s *Server) Rotate(t testing.TB) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kid++
+	s.rsa, s.ec = rk, ek
+}
+
+// Authorize the request for the authorization URL, as if the user logged in,
+// returning the code and state from the redirect.
+func (s *Server) Authorize(t testing.TB, authURL string) (string, string) {
+	t.Helper()
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := c.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s", resp.Status)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+// Sign the claims as a JWT.
+func (s *Server) Sign(t testing.TB, claims map[string]any) string {
+	t.Helper()
+	tok, err := s.sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func (s *Server) sign(claims map[string]any) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alg := "RS256"
+	if s.ES256 {
+		alg = "ES256"
+	}
+	h, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": s.kidFor(alg)})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := enc(h) + "." + enc(c)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	if s.ES256 {
+		r, ss, err := ecdsa.Sign(rand.Reader, s.ec, sum[:])
+		if err != nil {
+			return "", err
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	} else {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsa, crypto.SHA256, sum[:])
+		if err != nil {
+			return "", err
+		}
+	}
+	return signed + "." + enc(sig), nil
+}
+
+func (s *Server) kidFor(alg string) string { return alg + "-" + strconv.Itoa(s.kid) }
+
+func enc(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/auth",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+	})
+}
+
+func (s *Server) auth(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", 400)
+		return
+	}
+
+	s.mu.Lock()
+	c := make([]byte, 16)
+	rand.Read(c)
+	cd := enc(c)
+	s.codes[cd] = code{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"), claims: s.Claims}
+	s.mu.Unlock()
+
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {cd}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != s.ClientID || secret != s.ClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, 401)
+		return
+	}
+
+	s.mu.Lock()
+	c, ok := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" ||
+		r.PostFormValue("redirect_uri") != c.redirectURI || enc(sum[:]) != c.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, 400)
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   s.URL,
+		"aud":   s.ClientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": c.nonce,
+	}
+	for k, v := range c.claims {
+		claims[k] = v
+	}
+	tok, err := s.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"access_token": "x",
+		"token_type":   "Bearer",
+		"id_token":     tok,
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := func(i *big.Int, l int) string { return enc(i.FillBytes(make([]byte, l))) }
+	writeJSON(w, map[string]any{"keys": []map[string]string{
+		{
+			"kty": "RSA", "use": "sig", "kid": s.kidFor("RS256"),
+			"n": enc(s.rsa.N.Bytes()), "e": enc(big.NewInt(int64(s.rsa.E)).Bytes()),
+		},
+		{
+			"kty": "EC", "use": "sig", "kid": s.kidFor("ES256"), "crv": "P-256",
+			"x": b(s.ec.X, 32), "y": b(s.ec.Y, 32),
+		},
+	}})
+}
@@ -0,0 +1,152 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"slices"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zslice"
+)
+
+// Paths, refs, browsers, and systems are only ever inserted; purges and the
+// data retention remove the pageviews and stats, but leave the rows that are no
+// longer used.
+type orphanTable struct {
+	table, column string
+	keep          int64    // Never delete this ID.
+	usedBy        []string // Tables referencing it, except hits.
+}
+
+var orphanTables = []orphanTable{
+	{"paths", "path_id", 0,
+		append(slices.Clone(statTables), "campaign_stats", "bot_stats", "hit_counts", "ref_counts")},
+	{"refs", "ref_id", 1, []string{"ref_counts", "location_ref_stats"}},
+	{"browsers", "browser_id", 0, []string{"browser_stats", "unknown_ua_stats"}},
+	{"systems", "system_id", 0, []string{"system_stats"}},
+}
+
+// OrphanTables lists the tables FindOrphans() and DeleteOrphans() work on.
+func OrphanTables() []string {
+	t := make([]string, 0, len(orphanTables))
+	for _, o := range orphanTables {
+		t = append(t, o.table)
+	}
+	return t
+}
+
+func getOrphanTable(table string) (orphanTable, error) {
+	for _, o := range orphanTables {
+		if o.table == table {
+			return o, nil
+		}
+	}
+	return orphanTable{}, errors.Errorf("unknown table: %q", table)
+}
+
+// FindOrphans checks at most limit rows in table with an ID after cursor, and
+// returns the IDs of the rows that aren't used by any pageview or stats. The
+// last checked ID is returned as the cursor for the next call; this is 0 if
+// there are no more rows.
+func FindOrphans(ctx context.Context, table string, cursor int64, limit int) ([]int64, int64, error) {
+	o, err := getOrphanTable(table)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "FindOrphans")
+	}
+
+	var ids []int64
+	err = zdb.Select(ctx, &ids, `/* FindOrphans */
+		select `+o.column+` from `+o.table+` where `+o.column+` > ? order by `+o.column+` limit ?`,
+		cursor, limit)
+	if err != nil || len(ids) == 0 {
+		return nil, 0, errors.Wrap(err, "FindOrphans")
+	}
+	last := ids[len(ids)-1]
+
+	orphans := slices.DeleteFunc(slices.Clone(ids), func(id int64) bool { return id == o.keep })
+	// Check hits last, as it's the largest table and has no index for this.
+	for _, t := range append(slices.Clone(o.usedBy), "hits") {
+		if len(orphans) == 0 {
+			break
+		}
+		var used []int64
+		err := zdb.Select(ctx, &used, `/* FindOrphans */
+			select distinct `+o.column+` from `+t+` where `+o.column+` in (?)`, orphans)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "FindOrphans")
+		}
+		orphans = zslice.Difference(orphans, used)
+	}
+	return orphans, last, nil
+}
+
+// DeleteOrphans deletes rows found with FindOrphans(), returning the number of
+// rows deleted.
+//
+// Rows that are used by any of the stats tables by now are kept: a new
+// pageview may have used the row since FindOrphans() was called. The hits
+// table isn't checked again, as the hits are stored together with the stats;
+// the caller should make sure no pageviews are being stored while this runs.
+//
+// The caches for the table are cleared, since they may have the deleted IDs.
+func DeleteOrphans(ctx context.Context, table string, ids []int64) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	o, err := getOrphanTable(table)
+	if err != nil {
+		return 0, errors.Wrap(err, "DeleteOrphans")
+	}
+
+	var deleted int
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		orphans := slices.DeleteFunc(slices.Clone(ids), func(id int64) bool { return id == o.keep })
+		for _, t := range o.usedBy {
+			if len(orphans) == 0 {
+				return nil
+			}
+			var used []int64
+			err := zdb.Select(ctx, &used, `/* DeleteOrphans */
+				select distinct `+o.column+` from `+t+` where `+o.column+` in (?)`, orphans)
+			if err != nil {
+				return err
+			}
+			orphans = zslice.Difference(orphans, used)
+		}
+		if len(orphans) == 0 {
+			return nil
+		}
+
+		err := zdb.Exec(ctx, `/* DeleteOrphans */
+			delete from `+o.table+` where `+o.column+` in (?)`, orphans)
+		if err != nil {
+			return err
+		}
+		deleted = len(orphans)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "DeleteOrphans")
+	}
+
+	if deleted > 0 {
+		switch o.table {
+		case "paths":
+			cachePaths(ctx).Flush()
+			cacheChangedTitles(ctx).Flush()
+		case "refs":
+			cacheRefs(ctx).Flush()
+		case "browsers":
+			cacheBrowsers(ctx).Flush()
+			cacheUA(ctx).Flush()
+		case "systems":
+			cacheSystems(ctx).Flush()
+			cacheUA(ctx).Flush()
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,166 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// OverviewDays is the number of days shown for every site in SiteOverviews.
+const OverviewDays = 30
+
+// SiteOverview is the summary of the recent traffic for one site.
+type SiteOverview struct {
+	Site *Site
+
+	// Visitors per day, in the user's timezone. The last day is today.
+	Stats []HitListStat
+
+	Max      int // Highest number of visitors on a single day.
+	Visitors int // Total number of visitors for all days.
+
+	TodayVisitors, TodayPageviews         int
+	YesterdayVisitors, YesterdayPageviews int
+
+	// Number of visitors in the last 7 days (including today), and the 7
+	// days before that.
+	ThisWeek, LastWeek int
+}
+
+// WeekChange gets the change in visitors compared to the previous week as a
+// percentage.
+//
+// This is +Inf if there were no visitors in the previous week.
+func (s SiteOverview) WeekChange() float64 {
+	switch {
+	case s.ThisWeek == 0 && s.LastWeek == 0:
+		return 0
+	case s.LastWeek == 0:
+		return math.Inf(1)
+	}
+	return float64(s.ThisWeek-s.LastWeek) / float64(s.LastWeek) * 100
+}
+
+// Inactive reports if this site had no visitors in the last 7 days.
+func (s SiteOverview) Inactive() bool {
+	return s.ThisWeek == 0
+}
+
+type SiteOverviews []SiteOverview
+
+// List the overview for all sites in this account, with the most visitors
+// first.
+//
+// Pageviews weren't stored before October 2026; see HitList.Views.
+func (o *SiteOverviews) List(ctx context.Context) error {
+	var sites Sites
+	err := sites.ForThisAccount(ctx, false)
+	if err != nil {
+		return errors.Wrap(err, "SiteOverviews.List")
+	}
+
+	var (
+		loc   = MustGetUser(ctx).Settings.Timezone.Loc()
+		today = ztime.Now().In(loc)
+		start = time.Date(today.Year(), today.Month(), today.Day()-OverviewDays+1, 0, 0, 0, 0, loc)
+	)
+
+	var counts []struct {
+		SiteID int64     `db:"site_id"`
+		Hour   time.Time `db:"hour"`
+		Total  int       `db:"total"`
+		Views  int       `db:"views"`
+	}
+	err = zdb.Select(ctx, &counts, "load:overview.List", map[string]any{
+		"sites": sites.IDs(),
+		"start": start.UTC(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "SiteOverviews.List")
+	}
+
+	var (
+		ov  = make(SiteOverviews, len(sites))
+		idx = make(map[int64]int, len(sites))
+	)
+	for i := range sites {
+		idx[sites[i].ID] = i
+		ov[i] = SiteOverview{Site: &sites[i], Stats: make([]HitListStat, OverviewDays)}
+		for j := range ov[i].Stats {
+			ov[i].Stats[j].Day = start.AddDate(0, 0, j).Format("2006-01-02")
+		}
+	}
+
+	// Count the calendar days rather than dividing the duration since start,
+	// which can be off by an hour around DST changes.
+	first := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	for _, c := range counts {
+		i, ok := idx[c.SiteID]
+		if !ok {
+			continue
+		}
+
+		y, m, d := c.Hour.In(loc).Date()
+		day := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Sub(first).Hours() / 24)
+		if day < 0 || day >= OverviewDays {
+			continue
+		}
+
+		s := &ov[i]
+		s.Stats[day].Daily += c.Total
+		s.Visitors += c.Total
+		switch day {
+		case OverviewDays - 1:
+			s.TodayVisitors += c.Total
+			s.TodayPageviews += c.Views
+		case OverviewDays - 2:
+			s.YesterdayVisitors += c.Total
+			s.YesterdayPageviews += c.Views
+		}
+		switch {
+		case day >= OverviewDays-7:
+			s.ThisWeek += c.Total
+		case day >= OverviewDays-14:
+			s.LastWeek += c.Total
+		}
+	}
+
+	for i := range ov {
+		for _, s := range ov[i].Stats {
+			ov[i].Max = max(ov[i].Max, s.Daily)
+		}
+	}
+	sort.SliceStable(ov, func(i, j int) bool { return ov[i].Visitors > ov[j].Visitors })
+
+	*o = ov
+	return nil
+}
+
+// Tagged gets the overviews for all sites with the given tag.
+func (o SiteOverviews) Tagged(tag string) SiteOverviews {
+	tagged := make(SiteOverviews, 0, len(o))
+	for _, s := range o {
+		if s.Site.HasTag(tag) {
+			tagged = append(tagged, s)
+		}
+	}
+	return tagged
+}
+
+// TagSummary gets the number of sites for every tag, sorted by tag name.
+func (o SiteOverviews) TagSummary() []TagCount {
+	sites := make(Sites, 0, len(o))
+	for _, s := range o {
+		sites = append(sites, *s.Site)
+	}
+	return sites.TagSummary()
+}
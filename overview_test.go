@@ -0,0 +1,57 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestSiteOverviewsList(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	site := MustGetSite(ctx)
+	other := Site{Code: "other", Parent: &site.ID}
+	err := other.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := ztime.Now()
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: now},
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: now},
+		Hit{Path: "/a", CreatedAt: now},
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: now.Add(-24 * time.Hour)},
+		Hit{Path: "/a", FirstVisit: true, CreatedAt: now.Add(-8 * 24 * time.Hour)},
+	)
+
+	var ov SiteOverviews
+	err = ov.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ov) != 2 {
+		t.Fatalf("len(ov) = %d", len(ov))
+	}
+
+	s := ov[0]
+	have := fmt.Sprintf("%s visitors=%d max=%d today=%d/%d yesterday=%d/%d week=%d/%d change=%.0f inactive=%t days=%d",
+		s.Site.Code, s.Visitors, s.Max, s.TodayVisitors, s.TodayPageviews, s.YesterdayVisitors, s.YesterdayPageviews,
+		s.ThisWeek, s.LastWeek, s.WeekChange(), s.Inactive(), len(s.Stats))
+	want := site.Code + " visitors=4 max=2 today=2/3 yesterday=1/1 week=3/1 change=200 inactive=false days=30"
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	if s := ov[1]; s.Site.Code != "other" || s.Visitors != 0 || !s.Inactive() || s.WeekChange() != 0 {
+		t.Errorf("wrong second site: %+v", s)
+	}
+}
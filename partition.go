@@ -0,0 +1,171 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// HitPartitionsAhead is the number of months for which partitions of the hits
+// table are created in advance.
+const HitPartitionsAhead = 3
+
+// HitsPartitioned reports if the hits table is partitioned; this is always
+// false on SQLite.
+func HitsPartitioned(ctx context.Context) (bool, error) {
+	if zdb.SQLDialect(ctx) != zdb.DialectPostgreSQL {
+		return false, nil
+	}
+	var kind []string
+	err := zdb.Select(ctx, &kind, `select cast(relkind as varchar) from pg_class
+		where relname = 'hits' and relnamespace = to_regnamespace(current_schema())`)
+	if err != nil {
+		return false, errors.Wrap(err, "HitsPartitioned")
+	}
+	return len(kind) > 0 && kind[0] == "p", nil
+}
+
+// PartitionHits converts the hits table to a table partitioned by month on
+// PostgreSQL, returning the names of the partitions that were created.
+//
+// This copies all pageviews and locks the hits table until it's done, which can
+// take a long time for large tables. Pageviews outside of any month partition
+// are stored in the "hits_default" partition.
+func PartitionHits(ctx context.Context) ([]string, error) {
+	if zdb.SQLDialect(ctx) != zdb.DialectPostgreSQL {
+		return nil, errors.New("PartitionHits: partitioning is only supported on PostgreSQL")
+	}
+	part, err := HitsPartitioned(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if part {
+		return nil, errors.New("PartitionHits: the hits table is already partitioned")
+	}
+
+	var names []string
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `lock table hits in access exclusive mode`)
+		if err != nil {
+			return err
+		}
+
+		var (
+			seq   string
+			first []time.Time
+		)
+		err = zdb.Get(ctx, &seq, `select coalesce(pg_get_serial_sequence('hits', 'hit_id'), '')`)
+		if err != nil {
+			return err
+		}
+		err = zdb.Select(ctx, &first, `select min(created_at) from hits having count(*) > 0`)
+		if err != nil {
+			return err
+		}
+
+		err = zdb.Exec(ctx, `
+			alter table hits rename to hits_unpartitioned;
+			alter index "hits#site_id#created_at" rename to "hits_unpartitioned#site_id#created_at";
+			create table hits (like hits_unpartitioned including defaults including constraints including identity)
+				partition by range (created_at);`)
+		if err != nil {
+			return err
+		}
+
+		// A serial column keeps using the old sequence, which needs to be
+		// moved before the old table is dropped; an identity column gets a new
+		// sequence, which needs to continue from the old one.
+		var newSeq string
+		err = zdb.Get(ctx, &newSeq, `select coalesce(pg_get_serial_sequence('hits', 'hit_id'), '')`)
+		if err != nil {
+			return err
+		}
+		if newSeq == seq && seq != "" {
+			err = zdb.Exec(ctx, `alter sequence `+seq+` owned by hits.hit_id`)
+		} else if newSeq != "" {
+			err = zdb.Exec(ctx, `select setval(?, coalesce((select max(hit_id) from hits_unpartitioned), 0) + 1, false)`, newSeq)
+		}
+		if err != nil {
+			return err
+		}
+
+		// The primary key of a partitioned table needs to include the
+		// partition key.
+		err = zdb.Exec(ctx, `
+			alter table hits add primary key (hit_id, created_at);
+			create index "hits#site_id#created_at" on hits(site_id, created_at desc);
+			create table hits_default partition of hits default;`)
+		if err != nil {
+			return err
+		}
+
+		start := ztime.Now().UTC()
+		if len(first) > 0 && first[0].Before(start) {
+			start = first[0].UTC()
+		}
+		names, err = createHitPartitions(ctx, start, HitPartitionsAhead)
+		if err != nil {
+			return err
+		}
+
+		return zdb.Exec(ctx, `
+			insert into hits overriding system value select * from hits_unpartitioned;
+			drop table hits_unpartitioned;
+			analyze hits;`)
+	})
+	return names, errors.Wrap(err, "PartitionHits")
+}
+
+// CreateHitPartitions creates the monthly partitions of the hits table for
+// this month up to and including the given number of months from now,
+// returning the names of the partitions that were created.
+//
+// This does nothing if the hits table isn't partitioned.
+func CreateHitPartitions(ctx context.Context, months int) ([]string, error) {
+	part, err := HitsPartitioned(ctx)
+	if err != nil || !part {
+		return nil, err
+	}
+	names, err := createHitPartitions(ctx, ztime.Now().UTC(), months)
+	return names, errors.Wrap(err, "CreateHitPartitions")
+}
+
+func createHitPartitions(ctx context.Context, start time.Time, months int) ([]string, error) {
+	var have []string
+	err := zdb.Select(ctx, &have, `
+		select c.relname from pg_inherits i
+		join pg_class c on c.oid = i.inhrelid
+		join pg_class p on p.oid = i.inhparent
+		where p.relname = 'hits'`)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		created []string
+		month   = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+		end     = ztime.Now().UTC().AddDate(0, months, 0)
+	)
+	for ; !month.After(end); month = month.AddDate(0, 1, 0) {
+		name := fmt.Sprintf("hits_%04d_%02d", month.Year(), month.Month())
+		if slices.Contains(have, name) {
+			continue
+		}
+		err := zdb.Exec(ctx, fmt.Sprintf(`create table %s partition of hits for values from ('%s') to ('%s')`,
+			name, month.Format(time.DateTime), month.AddDate(0, 1, 0).Format(time.DateTime)))
+		if err != nil {
+			return created, errors.Wrap(err, name)
+		}
+		created = append(created, name)
+	}
+	return created, nil
+}
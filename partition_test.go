@@ -0,0 +1,75 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+)
+
+func TestPartitionHits(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	if zdb.SQLDialect(ctx) != zdb.DialectPostgreSQL {
+		_, err := PartitionHits(ctx)
+		if err == nil {
+			t.Fatal("no error on SQLite")
+		}
+		names, err := CreateHitPartitions(ctx, 3)
+		if err != nil || len(names) != 0 {
+			t.Fatalf("%s; %v", err, names)
+		}
+		return
+	}
+
+	now := time.Now().UTC()
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/a", CreatedAt: now},
+		Hit{Path: "/b", CreatedAt: now.AddDate(-2, 0, 0)})
+
+	part, err := HitsPartitioned(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !part { // Already partitioned with the testpartition tag.
+		names, err := PartitionHits(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) < 24 {
+			t.Errorf("created %d partitions: %v", len(names), names)
+		}
+		if part, _ := HitsPartitioned(ctx); !part {
+			t.Fatal("not partitioned")
+		}
+	}
+
+	// Still continues the sequence.
+	gctest.StoreHits(ctx, t, false, Hit{Path: "/c", CreatedAt: now})
+	var n, ids int
+	err = zdb.Get(ctx, &n, `select count(*) from hits`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zdb.Get(ctx, &ids, `select count(distinct hit_id) from hits`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || ids != 3 {
+		t.Errorf("%d hits with %d IDs", n, ids)
+	}
+
+	names, err := CreateHitPartitions(ctx, HitPartitionsAhead+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Errorf("created %v", names)
+	}
+}
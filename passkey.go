@@ -0,0 +1,194 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2/webauthn"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zstd/znet"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
+)
+
+// Passkey is a WebAuthn credential for a user.
+type Passkey struct {
+	ID     int64 `db:"passkey_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"` // Always the account ID.
+	UserID int64 `db:"user_id" json:"-"`
+
+	Name         string `db:"name" json:"name"`
+	CredentialID []byte `db:"credential_id" json:"-"`
+	PublicKey    []byte `db:"public_key" json:"-"` // COSE_Key
+	SignCount    int64  `db:"sign_count" json:"-"`
+
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (p *Passkey) Defaults(ctx context.Context) {
+	p.SiteID = MustGetSite(ctx).IDOrParent()
+	if p.UserID == 0 {
+		p.UserID = GetUser(ctx).ID
+	}
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = ztime.Now()
+	}
+}
+
+func (p *Passkey) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", p.SiteID)
+	v.Required("user_id", p.UserID)
+	v.Required("name", p.Name)
+	v.Len("name", p.Name, 0, 100)
+	v.Required("credential_id", p.CredentialID)
+	v.Required("public_key", p.PublicKey)
+	return v.ErrorOrNil()
+}
+
+// Credential gets this passkey as a WebAuthn credential.
+func (p Passkey) Credential() webauthn.Credential {
+	return webauthn.Credential{ID: p.CredentialID, PublicKey: p.PublicKey, SignCount: uint32(p.SignCount)}
+}
+
+// Insert a new row.
+func (p *Passkey) Insert(ctx context.Context) error {
+	if p.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	p.Defaults(ctx)
+	err := p.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.ID, err = zdb.InsertID(ctx, "passkey_id",
+		`insert into passkeys (site_id, user_id, name, credential_id, public_key, sign_count, created_at) values (?)`,
+		[]any{p.SiteID, p.UserID, p.Name, p.CredentialID, p.PublicKey, p.SignCount, p.CreatedAt})
+	if err != nil {
+		if zdb.ErrUnique(err) {
+			return guru.New(400, "this passkey is already registered")
+		}
+		return errors.Wrap(err, "Passkey.Insert")
+	}
+	return nil
+}
+
+// UpdateUsed sets the signature counter and last used time.
+func (p *Passkey) UpdateUsed(ctx context.Context, signCount uint32) error {
+	if p.ID == 0 {
+		return errors.New("ID == 0")
+	}
+
+	p.SignCount, p.LastUsedAt = int64(signCount), ztype.Ptr(ztime.Now())
+	err := zdb.Exec(ctx, `update passkeys set sign_count=?, last_used_at=? where passkey_id=?`,
+		p.SignCount, p.LastUsedAt, p.ID)
+	return errors.Wrap(err, "Passkey.UpdateUsed")
+}
+
+// ByID gets a passkey for the current user by ID.
+func (p *Passkey) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, p, `/* Passkey.ByID */
+		select * from passkeys where passkey_id=$1 and site_id=$2 and user_id=$3`,
+		id, MustGetSite(ctx).IDOrParent(), GetUser(ctx).ID), "Passkey.ByID %d", id)
+}
+
+// ByCredentialID gets a passkey by the WebAuthn credential ID.
+func (p *Passkey) ByCredentialID(ctx context.Context, id []byte) error {
+	return errors.Wrap(zdb.Get(ctx, p, `/* Passkey.ByCredentialID */
+		select * from passkeys where credential_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).IDOrParent()), "Passkey.ByCredentialID")
+}
+
+func (p *Passkey) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* Passkey.Delete */ delete from passkeys where passkey_id=$1 and site_id=$2`,
+		p.ID, MustGetSite(ctx).IDOrParent())
+	return errors.Wrapf(err, "Passkey.Delete %d", p.ID)
+}
+
+type Passkeys []Passkey
+
+// ListUser lists all passkeys for a user.
+func (p *Passkeys) ListUser(ctx context.Context, userID int64) error {
+	return errors.Wrap(zdb.Select(ctx, p,
+		`select * from passkeys where site_id=$1 and user_id=$2 order by created_at asc`,
+		MustGetSite(ctx).IDOrParent(), userID), "Passkeys.ListUser")
+}
+
+// DeleteUser deletes all passkeys for a user.
+func (p *Passkeys) DeleteUser(ctx context.Context, userID int64) error {
+	err := zdb.Exec(ctx, `delete from passkeys where site_id=$1 and user_id=$2`,
+		MustGetSite(ctx).IDOrParent(), userID)
+	return errors.Wrap(err, "Passkeys.DeleteUser")
+}
+
+// CredentialIDs gets the WebAuthn credential IDs for all passkeys.
+func (p Passkeys) CredentialIDs() []webauthn.Bytes {
+	ids := make([]webauthn.Bytes, 0, len(p))
+	for _, pp := range p {
+		ids = append(ids, pp.CredentialID)
+	}
+	return ids
+}
+
+// RelyingParty gets the WebAuthn relying party for a host, which should be the
+// host the site is accessed on (with port, if any).
+//
+// Passkeys are bound to the domain, so passkeys registered on the
+// code.goatcounter.com domain can't be used on a custom domain and vice versa.
+func RelyingParty(host string) webauthn.RelyingParty {
+	rp := webauthn.RelyingParty{
+		ID:      znet.RemovePort(host),
+		Name:    "GoatCounter",
+		Origins: []string{"https://" + host},
+	}
+	// The browser only allows WebAuthn on secure contexts, so plain http is
+	// only possible for localhost.
+	switch rp.ID {
+	case "localhost", "127.0.0.1", "::1", "[::1]":
+		rp.Origins = append(rp.Origins, "http://"+host)
+	}
+	return rp
+}
+
+// Passkey challenge purposes.
+const (
+	PasskeyRegister = "register"
+	PasskeyLogin    = "login"
+	PasskeyMFA      = "mfa"
+)
+
+// NewPasskeyChallenge creates a new challenge for a ceremony, which needs to
+// be completed within 5 minutes.
+//
+// The userID is the user for which the challenge is valid, or 0 for
+// usernameless login.
+func NewPasskeyChallenge(ctx context.Context, purpose string, userID int64) webauthn.Bytes {
+	ch := webauthn.NewChallenge()
+	cachePasskeys(ctx).SetDefault(ch.String(), purpose+":"+strconv.FormatInt(userID, 10))
+	return ch
+}
+
+// UsePasskeyChallenge checks if a challenge is valid for the purpose and user.
+//
+// The challenge can only be used once.
+func UsePasskeyChallenge(ctx context.Context, ch webauthn.Bytes, purpose string, userID int64) bool {
+	c := cachePasskeys(ctx)
+	v, ok := c.Get(ch.String())
+	if !ok {
+		return false
+	}
+	c.Delete(ch.String())
+	return v.(string) == purpose+":"+strconv.FormatInt(userID, 10)
+}
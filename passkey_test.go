@@ -0,0 +1,32 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+)
+
+func TestRelyingParty(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"example.goatcounter.com", "[https://example.goatcounter.com]"},
+		{"stats.example.com:8081", "[https://stats.example.com:8081]"},
+		{"localhost:8081", "[https://localhost:8081 http://localhost:8081]"},
+		{"127.0.0.1", "[https://127.0.0.1 http://127.0.0.1]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			have := fmt.Sprint(RelyingParty(tt.host).Origins)
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ package goatcounter
 import (
 	"context"
 	"strconv"
+	"strings"
 
 	"zgo.at/errors"
 	"zgo.at/zcache"
@@ -140,11 +141,14 @@ func (p Path) updateTitle(ctx context.Context, currentTitle, newTitle string) er
 type Paths []Path
 
 // List all paths for a site.
-func (p *Paths) List(ctx context.Context, siteID, after int64, limit int) (bool, error) {
+//
+// If filter is not empty, only the paths with these IDs are selected.
+func (p *Paths) List(ctx context.Context, siteID, after int64, filter []int64, limit int) (bool, error) {
 	err := zdb.Select(ctx, p, "load:paths.List", map[string]any{
-		"site":  siteID,
-		"after": after,
-		"limit": limit + 1,
+		"site":   siteID,
+		"after":  after,
+		"filter": filter,
+		"limit":  limit + 1,
 	})
 	if err != nil {
 		return false, errors.Wrap(err, "Paths.List")
@@ -161,14 +165,36 @@ func (p *Paths) List(ctx context.Context, siteID, after int64, limit int) (bool,
 
 // PathFilter returns a list of IDs matching the path name.
 //
-// if matchTitle is true it will match the title as well.
+// A filter starting with a "/" matches the start of the path, which can use an
+// index and is a lot faster on sites with many paths. Anything else matches
+// anywhere in the path, and if matchTitle is true it will match the title as
+// well.
+//
+// A filter of "label:name" matches paths with pageviews from the bot allowlist
+// rule with that label, and "-label:name" matches all other paths; see
+// BotAllow.
 func PathFilter(ctx context.Context, filter string, matchTitle bool) ([]int64, error) {
-	var paths []int64
-	err := zdb.Select(ctx, &paths, "load:paths.PathFilter", map[string]any{
+	args := map[string]any{
 		"site":        MustGetSite(ctx).ID,
 		"filter":      "%" + filter + "%",
 		"match_title": matchTitle,
-	})
+		"prefix":      false,
+		"sqlite":      zdb.SQLDialect(ctx) == zdb.DialectSQLite,
+	}
+	if l, ok := strings.CutPrefix(filter, "label:"); ok {
+		args["label"] = strings.TrimSpace(l)
+	} else if l, ok := strings.CutPrefix(filter, "-label:"); ok {
+		args["label"], args["not_label"] = strings.TrimSpace(l), true
+	} else if strings.HasPrefix(filter, "/") {
+		p := strings.ToLower(filter)
+		args["filter"] = p + "%"
+		args["prefix"] = true
+		args["prefix_start"] = p
+		args["prefix_end"] = p[:len(p)-1] + string([]byte{p[len(p)-1] + 1})
+	}
+
+	var paths []int64
+	err := zdb.Select(ctx, &paths, "load:paths.PathFilter", args)
 	if err != nil {
 		return nil, errors.Wrap(err, "PathFilter")
 	}
@@ -180,3 +206,85 @@ func PathFilter(ctx context.Context, filter string, matchTitle bool) ([]int64, e
 	}
 	return paths, nil
 }
+
+// FoldPath normalizes the path component of p: lower-case it if lower is set,
+// and remove trailing slashes if slash is set. The query string is never
+// changed.
+func FoldPath(p string, lower, slash bool) string {
+	path, query, hasQuery := strings.Cut(p, "?")
+	if lower {
+		path = strings.ToLower(path)
+	}
+	if slash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	if hasQuery {
+		return path + "?" + query
+	}
+	return path
+}
+
+// FoldPaths applies the site's FoldPathCase and FoldPathSlash settings to all
+// existing paths.
+//
+// Paths that don't conflict with another path are renamed, and paths that do
+// are merged in to the existing path. This can't be undone.
+func FoldPaths(ctx context.Context) error {
+	site := MustGetSite(ctx)
+	if !site.Settings.FoldPathCase && !site.Settings.FoldPathSlash {
+		return nil
+	}
+
+	var paths Paths
+	err := zdb.Select(ctx, &paths, `/* FoldPaths */
+		select * from paths where site_id=$1 and event=0 order by path_id asc`, site.ID)
+	if err != nil {
+		return errors.Wrap(err, "FoldPaths")
+	}
+
+	byPath := make(map[string]Path, len(paths))
+	for _, p := range paths {
+		byPath[strings.ToLower(p.Path)] = p
+	}
+
+	var (
+		merge = make(map[int64][]int64)
+		order []int64
+	)
+	for _, p := range paths {
+		f := FoldPath(p.Path, site.Settings.FoldPathCase, site.Settings.FoldPathSlash)
+		if f == p.Path {
+			continue
+		}
+
+		if dst, ok := byPath[strings.ToLower(f)]; ok && dst.ID != p.ID {
+			if _, ok := merge[dst.ID]; !ok {
+				order = append(order, dst.ID)
+			}
+			merge[dst.ID] = append(merge[dst.ID], p.ID)
+			continue
+		}
+
+		err := zdb.Exec(ctx, `update paths set path=$1 where path_id=$2 and site_id=$3`,
+			f, p.ID, site.ID)
+		if err != nil {
+			return errors.Wrap(err, "FoldPaths")
+		}
+		p.Path = f
+		byPath[strings.ToLower(f)] = p
+	}
+
+	for _, dst := range order {
+		var hits Hits
+		err := hits.Merge(ctx, dst, merge[dst])
+		if err != nil {
+			return errors.Wrap(err, "FoldPaths")
+		}
+	}
+
+	site.ClearCache(ctx, true)
+	return nil
+}
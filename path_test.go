@@ -5,6 +5,8 @@
 package goatcounter_test
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
 	. "zgo.at/goatcounter/v2"
@@ -56,3 +58,137 @@ func TestPathsUpdateTitle(t *testing.T) {
 	}
 	wantTitle("new")
 }
+
+func TestFoldPath(t *testing.T) {
+	tests := []struct {
+		in           string
+		lower, slash bool
+		want         string
+	}{
+		{"/About/", false, false, "/About/"},
+		{"/About/", true, false, "/about/"},
+		{"/About/", false, true, "/About"},
+		{"/About/", true, true, "/about"},
+		{"/", true, true, "/"},
+		{"//", false, true, "/"},
+		{"/About/?Q=A/", true, true, "/about?Q=A/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have := FoldPath(tt.in, tt.lower, tt.slash)
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestFoldPaths(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	for _, p := range []string{"/About", "/x", "/x/", "/y/"} {
+		err := (&Path{Path: p}).GetOrInsert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	site := MustGetSite(ctx)
+	site.Settings.FoldPathCase, site.Settings.FoldPathSlash = true, true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = FoldPaths(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have []string
+	err = zdb.Select(ctx, &have, `select path from paths order by path`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/about", "/x", "/y"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	for _, p := range []Path{
+		{Path: "/Blog/one", Title: "First"},
+		{Path: "/blog/two", Title: "Second"},
+		{Path: "/about", Title: "About the blog"},
+		{Path: "/blog", Title: "Index"},
+		{Path: "/blogx"},
+	} {
+		err := p.GetOrInsert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filter     string
+		matchTitle bool
+		want       []string
+	}{
+		{"/blog/", false, []string{"/Blog/one", "/blog/two"}},
+		{"/blog", false, []string{"/blog", "/Blog/one", "/blog/two", "/blogx"}},
+		{"/BLOG/T", false, []string{"/blog/two"}},
+		{"/x", false, nil},
+		{"blog", false, []string{"/blog", "/Blog/one", "/blog/two", "/blogx"}},
+		{"blog", true, []string{"/about", "/blog", "/Blog/one", "/blog/two", "/blogx"}},
+		{"x", false, []string{"/blogx"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			ids, err := PathFilter(ctx, tt.filter, tt.matchTitle)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var have []string
+			err = zdb.Select(ctx, &have, `select path from paths where path_id in (:ids) order by lower(path)`,
+				map[string]any{"ids": ids})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkPathFilter(b *testing.B) {
+	ctx := gctest.DB(b)
+
+	site := MustGetSite(ctx)
+	ins := zdb.NewBulkInsert(ctx, "paths", []string{"site_id", "path", "title", "event"})
+	for i := 0; i < 100_000; i++ {
+		ins.Values(site.ID, fmt.Sprintf("/section-%d/page-%d", i%100, i), fmt.Sprintf("Page %d", i), 0)
+	}
+	err := ins.Finish()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, f := range []string{"/section-42/", "page-4242"} {
+		b.Run(f, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_, err := PathFilter(ctx, f, false)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
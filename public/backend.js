@@ -11,14 +11,15 @@
 		window.BASE_PATH         = $('#js-settings').attr('data-base-path') || ""
 		window.CSRF              = $('#js-settings').attr('data-csrf')
 		window.TZ_OFFSET         = parseInt($('#js-settings').attr('data-offset'), 10) || 0
+		window.WEEK_START        = parseInt($('#js-settings').attr('data-week-start'), 10) || 0
 		window.SITE_FIRST_HIT_AT = $('#js-settings').attr('data-first-hit-at') * 1000
 		window.USE_WEBSOCKET     = $('#js-settings').attr('data-websocket') === 'true'
 		window.WEBSOCKET         = undefined
 		if (!USER_SETTINGS.language)
 			USER_SETTINGS.language = 'en'
 
-		;[report_errors, bind_tooltip, bind_confirm, translate_calendar, onetime].forEach((f) => f.call())
-		;[page_dashboard, page_settings_main, page_user_pref, page_user_dashboard, page_bosmang]
+		;[report_errors, bind_tooltip, bind_confirm, bind_passkeys, translate_calendar, onetime].forEach((f) => f.call())
+		;[page_dashboard, page_path, page_overview, page_settings_main, page_user_pref, page_user_dashboard, page_bosmang]
 			.forEach((f) => document.body.id.match(new RegExp('^' + f.name.replace(/_/g, '-'))) && f.call())
 	})
 
@@ -70,6 +71,84 @@
 		})
 	}
 
+	// Register and sign in with passkeys (WebAuthn).
+	var bind_passkeys = function() {
+		var forms = $('#passkey-register, #passkey-login, #passkey-mfa')
+		if (!forms.length)
+			return
+		if (!window.PublicKeyCredential) {
+			forms.find('.passkey-unsupported').css('display', 'block')
+			forms.find('button, input').prop('disabled', true)
+			return
+		}
+
+		var from_b64 = (s) => Uint8Array.from(atob(s.replace(/-/g, '+').replace(/_/g, '/')), (c) => c.charCodeAt(0)).buffer,
+			to_b64   = (b) => btoa(String.fromCharCode(...new Uint8Array(b))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+
+		var post = function(url, data, success) {
+			jQuery.ajax({
+				url:     BASE_PATH + url,
+				method:  'POST',
+				data:    $.extend({csrf: CSRF}, data),
+				success: success,
+			})
+		}
+		var fail = function(err) {
+			// Cancelled by the user.
+			if (err.name === 'NotAllowedError' || err.name === 'AbortError')
+				return
+			alert(err.message || err)
+		}
+
+		// Get an assertion with navigator.credentials.get() and send it to url.
+		var get = function(url, data, opt) {
+			opt.challenge = from_b64(opt.challenge)
+			opt.allowCredentials.forEach((c) => c.id = from_b64(c.id))
+			navigator.credentials.get({publicKey: opt}).then((cred) => {
+				post(url, $.extend({}, data, {
+					'challenge':                    to_b64(opt.challenge),
+					'assertion.id':                 to_b64(cred.rawId),
+					'assertion.client_data':        to_b64(cred.response.clientDataJSON),
+					'assertion.authenticator_data': to_b64(cred.response.authenticatorData),
+					'assertion.signature':          to_b64(cred.response.signature),
+					'assertion.user_handle':        cred.response.userHandle ? to_b64(cred.response.userHandle) : '',
+				}), (data) => location.href = BASE_PATH + data.redirect)
+			}).catch(fail)
+		}
+
+		$('#passkey-register').on('submit', function(e) {
+			e.preventDefault()
+			var name = $(this).find('[name="name"]').val()
+			post('/user/passkey/register', {}, (opt) => {
+				opt.challenge = from_b64(opt.challenge)
+				opt.user.id   = from_b64(opt.user.id)
+				opt.excludeCredentials.forEach((c) => c.id = from_b64(c.id))
+				navigator.credentials.create({publicKey: opt}).then((cred) => {
+					post('/user/passkey/register/finish', {
+						name:               name,
+						challenge:          to_b64(opt.challenge),
+						client_data:        to_b64(cred.response.clientDataJSON),
+						attestation_object: to_b64(cred.response.attestationObject),
+					}, (data) => location.href = BASE_PATH + data.redirect)
+				}).catch(fail)
+			})
+		})
+
+		$('#passkey-login').on('submit', function(e) {
+			e.preventDefault()
+			post('/user/passkey/login', {}, (opt) => get('/user/passkey/login/finish', {}, opt))
+		})
+
+		$('#passkey-mfa').on('submit', function(e) {
+			e.preventDefault()
+			var data = {
+				loginmac:        $(this).find('[name="loginmac"]').val(),
+				user_logintoken: $(this).find('[name="user_logintoken"]').val(),
+			}
+			post('/user/passkey/mfa', data, (opt) => get('/user/passkey/mfa/finish', data, opt))
+		})
+	}
+
 	// Show custom tooltip on everything with a title attribute.
 	var bind_tooltip = function() {
 		var tip = $('<div id="tooltip"></div>')
@@ -160,6 +239,20 @@
 				$('#rnd-secret').trigger('click')
 		}).trigger('change')
 
+		// Preview what the data retention would remove.
+		$('#retention-preview').on('click', function(e) {
+			e.preventDefault()
+			jQuery.ajax({
+				url:     BASE_PATH + '/settings/main/retention-preview',
+				data:    {
+					data_retention:  $('[name="settings.data_retention"]').val(),
+					retention_mode:  $('[name="settings.retention_mode"]').val(),
+					daily_retention: $('[name="settings.daily_retention"]').val(),
+				},
+				success: function(data) { $('#retention-preview-result').html(data) },
+			})
+		})
+
 		// Update redirect link.
 		$('#settings-secret').on('change', function(e) {
 			$('#secret-url').val(`${location.protocol}//${location.host}${BASE_PATH}?access-token=${this.value}`)
@@ -251,6 +344,22 @@
 	}
 
 	var page_bosmang = function() {
+		$('#bosmang-filter').on('input', function() {
+			let f = this.value.toLowerCase()
+			$('.bosmang-filter tbody tr').each((_, tr) => $(tr).toggle(tr.innerText.toLowerCase().indexOf(f) > -1))
+		})
+
+		// Only select the rows that aren't filtered out.
+		$('.bosmang-bulk-all').on('click', function(e) {
+			e.stopPropagation()
+			$('.bosmang-filter tbody tr:visible input[name="sites"]').prop('checked', this.checked)
+		})
+		$('#bosmang-bulk').on('submit', function(e) {
+			var n = $('input[name="sites"][form="bosmang-bulk"]:checked').length
+			if (!confirm(`Run “${this.elements.action.value}” for ${n} sites?`))
+				e.preventDefault()
+		})
+
 		$('table.sort th').on('click', function(e) {
 			var th       = $(this),
 				num_sort = th.is('.n'),
@@ -30,6 +30,7 @@
 			s: [window.screen.width, window.screen.height, (window.devicePixelRatio || 1)],
 			b: is_bot(),
 			q: location.search,
+			pr: vars.prerender,
 		}
 
 		var rcb, pcb, tcb  // Save callbacks to apply later.
@@ -63,6 +64,16 @@
 			return 152
 		if (navigator.webdriver)
 			return 153
+		if (w.__pwInitScripts || w.__playwright__binding__ || w.domAutomation || w.domAutomationController)
+			return 154
+		// Regular browsers always have at least one language, and list the PDF
+		// viewer as plugins if it's enabled.
+		var n = navigator
+		if ((n.languages && n.languages.length === 0) || (n.pdfViewerEnabled && n.plugins && n.plugins.length === 0))
+			return 155
+		// Prerendered by the browser, and not (yet) seen by anyone.
+		if ('visibilityState' in d && d.visibilityState === 'prerender')
+			return 156
 		return 0
 	}
 
@@ -112,8 +123,6 @@
 
 	// Filter some requests that we (probably) don't want to count.
 	goatcounter.filter = function() {
-		if ('visibilityState' in document && document.visibilityState === 'prerender')
-			return 'visibilityState'
 		if (!goatcounter.allow_frame && location !== parent.location)
 			return 'frame'
 		if (!goatcounter.allow_local && location.hostname.match(/(localhost$|^127\.|^10\.|^172\.(1[6-9]|2[0-9]|3[0-1])\.|^192\.168\.|^0\.0\.0\.0$)/))
@@ -252,15 +261,22 @@
 		on_load(function() {
 			// 1. Page is visible, count request.
 			// 2. Page is not yet visible; wait until it switches to 'visible' and count.
+			//    Prerendered pages are counted as a bot right away, and the
+			//    backend upgrades that to a regular pageview once it's visible.
 			// See #487
 			if (!('visibilityState' in document) || document.visibilityState === 'visible')
 				goatcounter.count()
 			else {
+				var pr
+				if (document.visibilityState === 'prerender') {
+					pr = Math.random().toString(36).substr(2, 10)
+					goatcounter.count({prerender: pr})
+				}
 				var f = function(e) {
 					if (document.visibilityState !== 'visible')
 						return
 					document.removeEventListener('visibilitychange', f)
-					goatcounter.count()
+					goatcounter.count({prerender: pr})
 				}
 				document.addEventListener('visibilitychange', f)
 			}
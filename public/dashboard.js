@@ -8,11 +8,23 @@
 	// Set up the entire dashboard page.
 	var page_dashboard = function() {
 		;[dashboard_widgets, hdr_select_period, hdr_datepicker, hdr_filter, hdr_views, hdr_sites,
-			translate_locations, dashboard_loader, configure_widgets,
+			translate_locations, dashboard_loader, configure_widgets, download_widgets,
 		].forEach((f) => f.call())
 	}
 	window.page_dashboard = page_dashboard  // Directly setting window loses the name attr 🤷
 
+	// Set up the detail page for a single path.
+	var page_path = function() {
+		;[init_charts, draw_all_charts, hdr_select_period, hdr_datepicker].forEach((f) => f.call())
+	}
+	window.page_path = page_path
+
+	// Set up the overview of all sites.
+	var page_overview = function() {
+		;[init_charts, draw_all_charts, overview_filter].forEach((f) => f.call())
+	}
+	window.page_overview = page_overview
+
 	// Set up all the dashboard widget contents (but not the header).
 	var dashboard_widgets = function() {
 		;[init_charts, paginate_pages, load_refs, hchart_detail, ref_pages, bind_scale].forEach((f) => f.call())
@@ -81,6 +93,23 @@
 		})
 	}
 
+	// Download the widget data as CSV for the current period and filter.
+	var download_widgets = function() {
+		$('#dash-widgets').on('click', '.download-widget', function(e) {
+			e.preventDefault()
+			let wid = $(this).closest('[data-widget]').attr('data-widget')
+			location.href = BASE_PATH + '/load-widget/csv' + join_query(append_period({widget: wid}))
+		})
+	}
+
+	// Filter the sites on the overview page.
+	var overview_filter = function() {
+		$('#overview-filter').on('input', function() {
+			let f = this.value.toLowerCase()
+			$('.overview tbody tr').each((_, tr) => $(tr).toggle(tr.dataset.name.toLowerCase().indexOf(f) > -1))
+		})
+	}
+
 	// Get the Y-axis scale.
 	var get_original_scale = function() { return parseInt($('.count-list-pages').attr('data-max'), 0) }
 	var get_current_scale  = function() { return parseInt($('.count-list-pages').attr('data-scale'), 0) }
@@ -137,6 +166,7 @@
 		data['period-start'] = $('#period-start').val()
 		data['period-end']   = $('#period-end').val()
 		data['filter']       = $('#filter-paths').val()
+		data['group']        = $('#group').val()
 		return data
 	}
 
@@ -171,6 +201,10 @@
 			$('#hl-period').attr('disabled', false)
 			$('#dash-form').trigger('submit')
 		})
+		$('#group').on('change', function(e) {
+			$('#hl-period').attr('disabled', false)
+			$('#dash-form').trigger('submit')
+		})
 
 		$('#dash-select-period').on('click', 'button', function(e) {
 			e.preventDefault()
@@ -184,10 +218,7 @@
 				case 'half-year': start.setMonth(start.getMonth() - 6); break;
 				case 'year':      start.setFullYear(start.getFullYear() - 1); break;
 				case 'week-cur':
-					if (USER_SETTINGS.sunday_starts_week)
-						start.setDate(start.getDate() - start.getDay())
-					else
-						start.setDate(start.getDate() - start.getDay() + (start.getDay() ? 1 : -6))
+					start.setDate(start.getDate() - (7 + start.getDay() - WEEK_START) % 7)
 					end = new Date(start.getFullYear(), start.getMonth(), start.getDate() + 6)
 					break;
 				case 'month-cur':
@@ -263,7 +294,7 @@
 		var opts = {
 			toString: format_date_ymd,
 			parse:    get_date,
-			firstDay: USER_SETTINGS.sunday_starts_week ? 0 : 1,
+			firstDay: WEEK_START,
 			minDate:  new Date(SITE_FIRST_HIT_AT),
 			i18n: {
 				ariaLabel:     T('datepicker/keyboard'),
@@ -334,6 +365,7 @@
 						filter:    $('#filter-paths').val(),
 						daily:     $('#daily').is(':checked'),
 						period:    p,
+						group:     $('#group').val(),
 					},
 					success: () => {
 						done()
@@ -354,11 +386,26 @@
 
 		select.on('change', function() { window.location = this.value })
 
+		// Only show sites with the selected tag.
+		$('.sites-tag-select').on('change', function() {
+			let tag   = this.value,
+				match = (el) => tag === '' || (el.dataset.tags || '').split(', ').includes(tag),
+				first = true
+			select.find('option').each((_, o) => $(o).toggle(match(o)))
+			list.find('>span').each((_, s) => {
+				let m = match(s)
+				$(s).toggle(m).find('.sep').toggle(m && !first)
+				if (m)
+					first = false
+			})
+		})
+
 		// The sites-list has 'visibility: hidden' on initial load, so we can
 		// get the rendered width; only need to do this once as it won't change.
 		$(window).on('resize', function() {
 			var show_dropdown = list_width > $('nav.center').width() - $('#usermenu').width() -
-			                    $('.sites-header').width() - (15 * window.devicePixelRatio)
+			                    $('.sites-header').width() - ($('.sites-tag-select').outerWidth() || 0) -
+			                    (15 * window.devicePixelRatio)
 
 			select.css('display', show_dropdown ? 'inline-block' : 'none')
 			if (show_dropdown)
@@ -509,11 +556,14 @@
 			bar:  {color: style('chart-line')},
 			done: (chart) => {
 				// Show future as greyed out.
-				let last   = stats[stats.length - 1].day + (daily ? '' : ' 23:59:59'),
+				let l      = stats[stats.length - 1],
+					last   = (l.end || l.day) + (daily ? '' : ' 23:59:59'),
 					future = last > format_date_ymd(new Date()) + (daily ? '' : ' 23:59:59')
 				if (future) {
-					let dpr   = Math.max(1, window.devicePixelRatio || 1),
-						width = chart.barWidth() * ((get_date(last) - new Date()) / ((daily ? 86400 : 3600) * 1000))
+					// Grouped by week or month: scale to the number of days in the last bar.
+					let unit  = l.end ? (get_date(l.end) - get_date(l.day)) / 1000 + 86400 : (daily ? 86400 : 3600),
+						dpr   = Math.max(1, window.devicePixelRatio || 1),
+						width = chart.barWidth() * ((get_date(last) - new Date()) / (unit * 1000))
 					futureFrom = canvas.width/dpr - width - chart.pad()
 
 					ctx.fillStyle = '#ddd'
@@ -546,7 +596,9 @@
 
 			let title = '',
 				future = futureFrom && x >= futureFrom - 1
-			if (daily)
+			if (day.end)
+				title = `${format_date(day.day, true)} – ${format_date(day.end, true)}`
+			else if (daily)
 				title = `${format_date(day.day, true)}`
 			else
 				title = `${format_date(day.day, true)} ${un24(start)} – ${un24(end)}`
@@ -661,10 +713,12 @@
 
 	// Paginate the main path overview.
 	var paginate_pages = function() {
-		let sz = $('.pages-list tbody >tr').length
+		let sz    = $('.pages-list tbody >tr').length,
+			after = $('.pages-list').attr('data-after')
 		$('.pages-list >.load-btns .load-less').on('click', function(e) {
 			e.preventDefault()
 			$(`.pages-list tbody >tr:gt(${sz - 1})`).remove()
+			$('.pages-list').attr('data-after', after)
 			$(this).css('display', 'none')
 			$(this).prev('.load-more').css('display', 'inline')
 		})
@@ -681,12 +735,13 @@
 					data: append_period({
 						widget:    pages.attr('data-widget'),
 						daily:     $('#daily').is(':checked'),
-						exclude:   pages.find('.count-list-pages >tbody >tr').toArray().map((e) => e.dataset.id).join(','),
+						after:     pages.attr('data-after'),
 						max:       get_original_scale(),
 					}),
 					success: function(data) {
 						less.css('display', 'inline')
 						pages.find('.count-list-pages >tbody.pages').append(data.html)
+						pages.attr('data-after', data.after)
 
 						// Update scale in case it's higher than the previous maximum value.
 						if (data.max > get_original_scale()) {
@@ -787,7 +842,7 @@
 		// Paginate the horizontal charts.
 		$('.hcharts').on('click', '.load-less', function(e) {
 			e.preventDefault()
-			let rows = $(this).closest('.hchart').find('.rows'),
+			let rows = $(this).closest('.hchart').find('>.rows'),
 				sz   = rows.data('pagesize') || 6
 			rows.find(`>div:gt(${sz - 1})`).remove()
 			$(this).css('display', 'none')
@@ -34,8 +34,13 @@ var un24 = function(t) {
 		return (hour - 12) + t.substr(2) + ' pm'
 }
 
-// Format a number with a thousands separator. https://stackoverflow.com/a/2901298/660921
-var format_int = (n) => (n+'').replace(/\B(?=(\d{3})+(?!\d))/g, String.fromCharCode(USER_SETTINGS.number_format))
+// Format a number with a thousands separator, or in the format for the language
+// if there's no separator set. https://stackoverflow.com/a/2901298/660921
+var format_int = function(n) {
+	if (USER_SETTINGS.number_format === 0 && window.Intl && window.Intl.NumberFormat)
+		return new Intl.NumberFormat(USER_SETTINGS.language, {maximumFractionDigits: 20}).format(n)
+	return (n+'').replace(/\B(?=(\d{3})+(?!\d))/g, String.fromCharCode(USER_SETTINGS.number_format))
+}
 
 var months      = ['January', 'February', 'March', 'April', 'May', 'June', 'July', 'August', 'September', 'October', 'November', 'December'],
 	days        = ['Sunday', 'Monday', 'Tuesday', 'Wednesday', 'Thursday', 'Friday', 'Saturday'],
@@ -0,0 +1,250 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// Purge removes all pageviews in a date range, optionally only for some paths.
+//
+// The stats can't be decremented, as it's not known which visitors were
+// unique. The range is in whole days, so instead the raw pageviews are deleted
+// in batches, after which all the stats for these days are removed.
+//
+// The estimates for the unique visitors per week, month, etc. and some of the
+// bot stats aren't stored per path, and are only removed if there's no path
+// filter.
+type Purge struct {
+	ID     int64 `db:"purge_id" json:"id,readonly"`
+	SiteID int64 `db:"site_id" json:"site_id,readonly"`
+
+	// First and last day to purge (inclusive), in UTC.
+	Start time.Time `db:"start_day" json:"start"`
+	End   time.Time `db:"end_day" json:"end"`
+
+	// Only purge these paths; the default is to purge all paths.
+	Paths Ints `db:"paths" json:"paths"`
+
+	CreatedAt  time.Time  `db:"created_at" json:"created_at,readonly"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at,readonly"`
+
+	// Number of stored pageviews to delete, and the number deleted so far.
+	Total   int `db:"total" json:"total,readonly"`
+	Deleted int `db:"deleted" json:"deleted,readonly"`
+
+	// Any errors that may have occured.
+	Error *string `db:"error" json:"error,readonly"`
+}
+
+// PurgePreview is what a Purge would remove.
+type PurgePreview struct {
+	Days      int `json:"days"`      // Number of days with stats.
+	Pageviews int `json:"pageviews"` // Number of pageviews in the stats.
+	Stored    int `json:"stored"`    // Number of stored pageviews.
+}
+
+func (p *Purge) Defaults(ctx context.Context) {
+	p.SiteID = MustGetSite(ctx).ID
+	p.CreatedAt = ztime.Now()
+	p.Start = p.Start.UTC().Truncate(24 * time.Hour)
+	p.End = p.End.UTC().Truncate(24 * time.Hour)
+}
+
+func (p *Purge) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", p.SiteID)
+	if p.Start.IsZero() {
+		v.Append("start", "must be set")
+	}
+	if p.End.IsZero() {
+		v.Append("end", "must be set")
+	}
+	if p.End.Before(p.Start) {
+		v.Append("end", "must be after start")
+	}
+	return v.ErrorOrNil()
+}
+
+func (p *Purge) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, p,
+		`/* Purge.ByID */ select * from purges where purge_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "Purge.ByID %d", id)
+}
+
+func (p Purge) args() map[string]any {
+	return map[string]any{
+		"site":      p.SiteID,
+		"start":     p.Start.Format("2006-01-02 15:04:05"),
+		"end":       p.End.Add(24 * time.Hour).Format("2006-01-02 15:04:05"),
+		"start_day": p.Start.Format("2006-01-02"),
+		"end_day":   p.End.Format("2006-01-02"),
+		"paths":     []int64(p.Paths),
+		"filter":    len(p.Paths) > 0,
+	}
+}
+
+// Preview gets what the purge would remove.
+func (p Purge) Preview(ctx context.Context) (PurgePreview, error) {
+	var pp PurgePreview
+	err := zdb.Get(ctx, &pp, `/* Purge.Preview */
+		select
+			count(distinct substr(cast(hour as varchar), 1, 10)) as days,
+			coalesce(sum(views), 0)                             as pageviews
+		from hit_counts
+		where
+			site_id = :site and hour >= :start and hour < :end
+			{{:filter and path_id in (:paths)}}`, p.args())
+	if err != nil {
+		return pp, errors.Wrap(err, "Purge.Preview")
+	}
+
+	err = zdb.Get(ctx, &pp.Stored, `/* Purge.Preview */
+		select count(*) from hits
+		where
+			site_id = :site and created_at >= :start and created_at < :end
+			{{:filter and path_id in (:paths)}}`, p.args())
+	return pp, errors.Wrap(err, "Purge.Preview")
+}
+
+// Insert a new purge.
+func (p *Purge) Insert(ctx context.Context) error {
+	if p.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	p.Defaults(ctx)
+	err := p.Validate(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Purge.Insert")
+	}
+
+	p.ID, err = zdb.InsertID(ctx, "purge_id",
+		`insert into purges (site_id, start_day, end_day, paths, created_at) values (?, ?, ?, ?, ?)`,
+		p.SiteID, p.Start.Format("2006-01-02"), p.End.Format("2006-01-02"), p.Paths, p.CreatedAt)
+	if err != nil {
+		return errors.Wrap(err, "Purge.Insert")
+	}
+
+	// Run() is in the background without the user, so record it here.
+	Audit(ctx, AuditPageviewPurge, MustGetSite(ctx).Display(ctx), nil, map[string]any{
+		"start": p.Start.Format("2006-01-02"), "end": p.End.Format("2006-01-02"), "paths": p.Paths})
+	return nil
+}
+
+// Run the purge; the progress is stored in the purges table.
+func (p *Purge) Run(ctx context.Context) {
+	l := zlog.Module("purge").Field("id", p.ID)
+	l.Print("purge started")
+
+	err := p.run(ctx)
+	if err != nil {
+		l.Field("purge", p).Error(err)
+		err := zdb.Exec(ctx, `update purges set error=$1 where purge_id=$2`, err.Error(), p.ID)
+		if err != nil {
+			l.Error(err)
+		}
+		return
+	}
+
+	now := ztime.Now()
+	p.FinishedAt = &now
+	err = zdb.Exec(ctx, `update purges set finished_at=$1 where purge_id=$2`, p.FinishedAt, p.ID)
+	if err != nil {
+		l.Error(err)
+	}
+}
+
+func (p *Purge) run(ctx context.Context) error {
+	args := p.args()
+
+	err := zdb.Get(ctx, &p.Total, `/* Purge.run */
+		select count(*) from hits
+		where
+			site_id = :site and created_at >= :start and created_at < :end
+			{{:filter and path_id in (:paths)}}`, args)
+	if err != nil {
+		return errors.Wrap(err, "Purge.run")
+	}
+	err = zdb.Exec(ctx, `update purges set total=$1 where purge_id=$2`, p.Total, p.ID)
+	if err != nil {
+		return errors.Wrap(err, "Purge.run")
+	}
+
+	for {
+		var ids []int64
+		err := zdb.Select(ctx, &ids, `/* Purge.run */
+			select hit_id from hits
+			where
+				site_id = :site and created_at >= :start and created_at < :end
+				{{:filter and path_id in (:paths)}}
+			limit 5000`, args)
+		if err != nil {
+			return errors.Wrap(err, "Purge.run")
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		err = zdb.Exec(ctx, `delete from hits where site_id=? and hit_id in (?)`, p.SiteID, ids)
+		if err != nil {
+			return errors.Wrap(err, "Purge.run")
+		}
+		p.Deleted += len(ids)
+		err = zdb.Exec(ctx, `update purges set deleted=$1 where purge_id=$2`, p.Deleted, p.ID)
+		if err != nil {
+			return errors.Wrap(err, "Purge.run")
+		}
+
+		// Small amount of breathing space.
+		if !Config(ctx).Dev {
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+
+	return zdb.TX(ctx, func(ctx context.Context) error {
+		tables := append(statTables, "campaign_stats", "bot_stats")
+		if len(p.Paths) == 0 {
+			tables = append(tables, "visitor_sketches", "ua_block_stats", "bot_ua_stats")
+		}
+		for _, t := range tables {
+			err := zdb.Exec(ctx, `delete from `+t+`
+				where
+					site_id = :site and day >= :start_day and day <= :end_day
+					{{:filter and path_id in (:paths)}}`, args)
+			if err != nil {
+				return errors.Wrapf(err, "Purge.run: delete %s", t)
+			}
+		}
+		for _, t := range []string{"hit_counts", "ref_counts"} {
+			err := zdb.Exec(ctx, `delete from `+t+`
+				where
+					site_id = :site and hour >= :start and hour < :end
+					{{:filter and path_id in (:paths)}}`, args)
+			if err != nil {
+				return errors.Wrapf(err, "Purge.run: delete %s", t)
+			}
+		}
+
+		MustGetSite(ctx).ClearCache(ctx, true)
+		return nil
+	})
+}
+
+// Purges is a list of purges.
+type Purges []Purge
+
+// List the last 10 purges for this site.
+func (p *Purges) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, p, `/* Purges.List */
+		select * from purges where site_id=$1 order by created_at desc limit 10`,
+		MustGetSite(ctx).ID), "Purges.List")
+}
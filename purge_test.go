@@ -0,0 +1,155 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+)
+
+func TestPurge(t *testing.T) {
+	var (
+		dayTables = []string{"hit_stats", "system_stats", "browser_stats",
+			"location_stats", "language_stats", "size_stats", "device_stats",
+			"session_stats", "location_ref_stats", "campaign_stats", "visitor_sketches"}
+		hourTables = []string{"hit_counts", "ref_counts"}
+	)
+	// Dump all the stats for the days outside (or inside) the range; the lines
+	// are sorted as the row order isn't guaranteed.
+	dump := func(ctx context.Context, inside bool) string {
+		not := "not"
+		if inside {
+			not = ""
+		}
+		var lines []string
+		for _, t := range dayTables {
+			lines = append(lines, strings.Split(zdb.DumpString(ctx, `select '`+t+`' as t, * from `+t+`
+				where day `+not+` between '2026-03-02' and '2026-03-03'`), "\n")...)
+		}
+		for _, t := range hourTables {
+			lines = append(lines, strings.Split(zdb.DumpString(ctx, `select '`+t+`' as t, * from `+t+`
+				where `+not+` (hour >= '2026-03-02' and hour < '2026-03-04')`), "\n")...)
+		}
+		lines = append(lines, strings.Split(zdb.DumpString(ctx, `select 'hits' as t, * from hits
+			where `+not+` (created_at >= '2026-03-02' and created_at < '2026-03-04')`), "\n")...)
+		slices.Sort(lines)
+		return strings.Join(lines, "\n")
+	}
+
+	setup := func(t *testing.T) context.Context {
+		ctx := gctest.DB(t)
+
+		site := MustGetSite(ctx)
+		site.Settings.Collect.Set(CollectHits)
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var hits []Hit
+		for d := 1; d <= 4; d++ {
+			for _, p := range []string{"/a", "/b"} {
+				hits = append(hits,
+					Hit{Path: p, Ref: "https://example.com", FirstVisit: true, UserAgentHeader: "Mozilla/5.0 (X11; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0",
+						CreatedAt: time.Date(2026, 3, d, 10, 0, 0, 0, time.UTC)},
+					Hit{Path: p, CreatedAt: time.Date(2026, 3, d, 23, 59, 0, 0, time.UTC)})
+			}
+		}
+		gctest.StoreHits(ctx, t, false, hits...)
+		return ctx
+	}
+
+	run := func(t *testing.T, ctx context.Context, p Purge) Purge {
+		err := p.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Run(ctx)
+
+		var have Purge
+		err = have.ByID(ctx, p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.Error != nil || have.FinishedAt == nil {
+			t.Fatalf("error: %v; finished: %v", have.Error, have.FinishedAt)
+		}
+		return have
+	}
+
+	t.Run("all paths", func(t *testing.T) {
+		ctx := setup(t)
+		p := Purge{
+			Start: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC),
+			End:   time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC),
+		}
+
+		pp, err := p.Preview(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pp != (PurgePreview{Days: 2, Pageviews: 8, Stored: 8}) {
+			t.Errorf("preview: %#v", pp)
+		}
+
+		before := dump(ctx, false)
+		have := run(t, ctx, p)
+		if have.Total != 8 || have.Deleted != 8 {
+			t.Errorf("total: %d; deleted: %d", have.Total, have.Deleted)
+		}
+
+		if after := dump(ctx, false); after != before {
+			t.Errorf("days outside the range changed\nbefore:\n%s\nafter:\n%s", before, after)
+		}
+		if inside := dump(ctx, true); strings.Contains(inside, "2026-03-0") {
+			t.Errorf("days inside the range not removed:\n%s", inside)
+		}
+	})
+
+	t.Run("path filter", func(t *testing.T) {
+		ctx := setup(t)
+		var path Path
+		err := zdb.Get(ctx, &path, `select * from paths where path='/a'`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := dump(ctx, false)
+		have := run(t, ctx, Purge{
+			Start: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC),
+			End:   time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC),
+			Paths: Ints{path.ID},
+		})
+		if have.Total != 4 || have.Deleted != 4 {
+			t.Errorf("total: %d; deleted: %d", have.Total, have.Deleted)
+		}
+		if after := dump(ctx, false); after != before {
+			t.Errorf("days outside the range changed\nbefore:\n%s\nafter:\n%s", before, after)
+		}
+
+		var n int
+		err = zdb.Get(ctx, &n, `select count(*) from hit_counts where path_id != ? and hour >= '2026-03-02' and hour < '2026-03-04'`, path.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 4 {
+			t.Errorf("other paths: %d hit_counts; want 4", n)
+		}
+		err = zdb.Get(ctx, &n, `select count(*) from hit_counts where path_id = ? and hour >= '2026-03-02' and hour < '2026-03-04'`, path.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("filtered path: %d hit_counts; want 0", n)
+		}
+	})
+}
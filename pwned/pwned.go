@@ -0,0 +1,104 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package pwned checks passwords against the Pwned Passwords database.
+//
+// This uses the range API: only the first 5 characters of the SHA-1 hash are
+// sent, and the server responds with the suffixes of all hashes with that
+// prefix, so the password (or its full hash) never leaves the server.
+//
+// https://haveibeenpwned.com/API/v3#PwnedPasswords
+package pwned
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultURL is the URL for the range API; the hash prefix is appended.
+const DefaultURL = "https://api.pwnedpasswords.com/range/"
+
+// Checker checks passwords against the Pwned Passwords database.
+type Checker struct {
+	URL       string       // Uses DefaultURL if empty.
+	Client    *http.Client // Uses a client with a 3 second timeout if nil.
+	Threshold int          // Reject passwords seen at least this many times.
+}
+
+// New creates a new checker.
+func New(threshold int) *Checker {
+	return &Checker{Threshold: threshold}
+}
+
+func (c *Checker) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return &http.Client{Timeout: 3 * time.Second}
+}
+
+// Count gets the number of times this password appears in the database.
+func (c *Checker) Count(ctx context.Context, pwd string) (int, error) {
+	h := sha1.Sum([]byte(pwd))
+	hash := strings.ToUpper(hex.EncodeToString(h[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	u := c.URL
+	if u == "" {
+		u = DefaultURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u+prefix, nil)
+	if err != nil {
+		return 0, fmt.Errorf("pwned: %w", err)
+	}
+	// Pad the response with random entries, so the size of the response
+	// doesn't reveal the prefix.
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("pwned: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("pwned: %s: %s: %s", req.URL, resp.Status, b)
+	}
+
+	// Every line is "SUFFIX:COUNT"; padding entries have a count of 0.
+	scan := bufio.NewScanner(io.LimitReader(resp.Body, 4<<20))
+	for scan.Scan() {
+		s, n, ok := strings.Cut(strings.TrimSpace(scan.Text()), ":")
+		if !ok || !strings.EqualFold(s, suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, fmt.Errorf("pwned: invalid count %q: %w", n, err)
+		}
+		return count, nil
+	}
+	if err := scan.Err(); err != nil {
+		return 0, fmt.Errorf("pwned: reading %s: %w", req.URL, err)
+	}
+	return 0, nil
+}
+
+// Breached reports if this password appears at least Threshold times in the
+// database, and the number of times it appears.
+func (c *Checker) Breached(ctx context.Context, pwd string) (bool, int, error) {
+	n, err := c.Count(ctx, pwd)
+	if err != nil {
+		return false, 0, err
+	}
+	return c.Threshold > 0 && n >= c.Threshold, n, nil
+}
@@ -0,0 +1,82 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package pwned_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/v2/pwned"
+)
+
+type roundTrip func(*http.Request) (*http.Response, error)
+
+func (f roundTrip) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8.
+const rangeResp = "003D68EB55068C33ACE09247EE4C639306B:3\r\n" +
+	"1E4C9B93F3F0682250B6CF8331B7EE68FD8:9659365\r\n" +
+	"1E4C9B93F3F0682250B6CF8331B7EE68FD9:0\r\n" +
+	"011053FD0102E94D6AE2F8B83D76FAF94F6:1\r\n"
+
+func TestCount(t *testing.T) {
+	stub := func(status int, body string, err error) *http.Client {
+		return &http.Client{Transport: roundTrip(func(r *http.Request) (*http.Response, error) {
+			if r.URL.Path != "/range/5BAA6" {
+				t.Errorf("wrong path: %q", r.URL.Path)
+			}
+			if r.Header.Get("Add-Padding") != "true" {
+				t.Error("no Add-Padding header")
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: status, Status: strconv.Itoa(status) + " " + http.StatusText(status),
+				Body: io.NopCloser(strings.NewReader(body))}, nil
+		})}
+	}
+
+	tests := []struct {
+		name         string
+		client       *http.Client
+		threshold    int
+		want         int
+		wantBreached bool
+		wantErr      string
+	}{
+		{"found", stub(200, rangeResp, nil), 1, 9659365, true, ""},
+		{"below threshold", stub(200, rangeResp, nil), 10_000_000, 9659365, false, ""},
+		{"not found", stub(200, "003D68EB55068C33ACE09247EE4C639306B:3\r\n", nil), 1, 0, false, ""},
+		{"empty", stub(200, "", nil), 1, 0, false, ""},
+		{"status", stub(503, "oh noes", nil), 1, 0, false, "503"},
+		{"network", stub(0, "", errors.New("connection refused")), 1, 0, false, "connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := pwned.New(tt.threshold)
+			c.Client = tt.client
+
+			breached, n, err := c.Breached(context.Background(), "password")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want || breached != tt.wantBreached {
+				t.Errorf("got %d %t; want %d %t", n, breached, tt.want, tt.wantBreached)
+			}
+		})
+	}
+}
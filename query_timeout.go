@@ -0,0 +1,130 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/z18n"
+	"zgo.at/zdb"
+)
+
+var queryTimeout time.Duration
+
+// SetQueryTimeout sets the maximum time a single query in a ReadOnly() context
+// can take; 0 disables it.
+//
+// This only applies to reading the stats for the dashboard and API: storing
+// pageviews and migrations never use ReadOnly().
+func SetQueryTimeout(d time.Duration) { queryTimeout = d }
+
+// QueryTimeoutError is returned if a query in a ReadOnly() context took longer
+// than the timeout set with SetQueryTimeout().
+type QueryTimeoutError struct {
+	msg string
+	err error
+}
+
+func (e *QueryTimeoutError) Error() string { return e.msg }
+func (e *QueryTimeoutError) Unwrap() error { return e.err }
+func (e *QueryTimeoutError) Code() int     { return http.StatusServiceUnavailable }
+
+// timeoutDB sets a timeout on every query: this uses statement_timeout on
+// PostgreSQL and a context deadline for SQLite (and PostgreSQL, in case the
+// connection is stuck on something other than the query).
+//
+// Only Exec(), Get(), Select(), and InsertID() have a timeout; queries in
+// transactions don't.
+type timeoutDB struct {
+	zdb.DB
+	timeout time.Duration
+}
+
+// withQueryTimeout wraps db with the query timeout, if any. It's wrapped inside
+// the slowQueryDB so that the slow query log still sees the queries.
+func withQueryTimeout(db zdb.DB) zdb.DB {
+	if queryTimeout <= 0 {
+		return db
+	}
+	switch d := db.(type) {
+	case *timeoutDB:
+		return db
+	case *slowQueryDB:
+		if _, ok := d.DB.(*timeoutDB); ok {
+			return db
+		}
+		return &slowQueryDB{DB: &timeoutDB{DB: d.DB, timeout: queryTimeout}, threshold: d.threshold}
+	}
+	return &timeoutDB{DB: db, timeout: queryTimeout}
+}
+
+func (db *timeoutDB) Exec(ctx context.Context, query string, params ...any) error {
+	return db.run(ctx, func(ctx context.Context) error {
+		return zdb.Exec(ctx, query, params...)
+	})
+}
+
+func (db *timeoutDB) Get(ctx context.Context, dest any, query string, params ...any) error {
+	return db.run(ctx, func(ctx context.Context) error {
+		return zdb.Get(ctx, dest, query, params...)
+	})
+}
+
+func (db *timeoutDB) Select(ctx context.Context, dest any, query string, params ...any) error {
+	return db.run(ctx, func(ctx context.Context) error {
+		return zdb.Select(ctx, dest, query, params...)
+	})
+}
+
+func (db *timeoutDB) InsertID(ctx context.Context, idColumn, query string, params ...any) (int64, error) {
+	var id int64
+	err := db.run(ctx, func(ctx context.Context) error {
+		var err error
+		id, err = zdb.InsertID(ctx, idColumn, query, params...)
+		return err
+	})
+	return id, err
+}
+
+func (db *timeoutDB) run(ctx context.Context, fn func(context.Context) error) error {
+	tctx, cancel := context.WithTimeout(ctx, db.timeout)
+	defer cancel()
+
+	var err error
+	if db.DB.SQLDialect() == zdb.DialectPostgreSQL {
+		err = zdb.TX(zdb.WithDB(tctx, db.DB), func(ctx context.Context) error {
+			err := zdb.Exec(ctx, fmt.Sprintf(`set local statement_timeout = %d`, max(1, db.timeout.Milliseconds())))
+			if err != nil {
+				return err
+			}
+			return fn(ctx)
+		})
+	} else {
+		err = fn(zdb.WithDB(tctx, db.DB))
+	}
+	if err == nil || !isTimeout(tctx, err) {
+		return err
+	}
+	return &QueryTimeoutError{
+		err: err,
+		msg: z18n.T(ctx, "error/query-timeout|Loading the data took too long; try selecting a shorter date range or a more specific filter"),
+	}
+}
+
+func isTimeout(ctx context.Context, err error) bool {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) && pgErr.SQLState() == "57014" { // query_canceled
+		return true
+	}
+	return strings.Contains(err.Error(), "canceling statement due to statement timeout")
+}
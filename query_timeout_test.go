@@ -0,0 +1,61 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/errors"
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	ctx := gctest.DB(t)
+	primary := zdb.MustGetDB(ctx)
+
+	SetQueryTimeout(100 * time.Millisecond)
+	defer SetQueryTimeout(0)
+
+	// The SQLite one runs for a few seconds without the timeout.
+	slow := `with recursive r(i) as (select 1 union all select i+1 from r where i < 100000000) select count(*) from r`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		slow = `select pg_sleep(5)`
+	}
+
+	rctx := ReadOnly(ctx)
+	if zdb.MustGetDB(rctx) == primary {
+		t.Fatal("ReadOnly() doesn't set the timeout")
+	}
+	if zdb.MustGetDB(Primary(rctx)) != primary {
+		t.Fatal("Primary() doesn't use the primary")
+	}
+	if ReadOnly(rctx) != rctx {
+		t.Fatal("ReadOnly() wraps the timeout twice")
+	}
+
+	var n int
+	err := zdb.Get(rctx, &n, `select count(*) from sites`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = zdb.Get(rctx, &n, slow)
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("took %s", took)
+	}
+	var tErr *QueryTimeoutError
+	if !errors.As(err, &tErr) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+	if tErr.Code() != http.StatusServiceUnavailable || !strings.Contains(tErr.Error(), "shorter date range") {
+		t.Errorf("wrong error: %d %q", tErr.Code(), tErr.Error())
+	}
+}
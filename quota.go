@@ -0,0 +1,158 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// Site.QuotaAction values.
+const (
+	QuotaCount  = "count"  // Keep counting pageviews, only send a warning.
+	QuotaReject = "reject" // Reject pageviews at /count.
+)
+
+var QuotaActions = []string{QuotaCount, QuotaReject}
+
+// Warnings are sent when this percentage of the quota is used.
+var quotaWarnings = []int{100, 80}
+
+// QuotaPeriodStart gets the start of the quota period for the time t, which is
+// the first of the month in the site's timezone.
+func (s Site) QuotaPeriodStart(t time.Time) time.Time {
+	t = t.In(s.UserDefaults.Timezone.Loc())
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).UTC()
+}
+
+// QuotaUsage gets the pageviews in the current quota period.
+//
+// This is 0 if no pageviews were counted yet in this period, as QuotaUsed is
+// only reset once a new pageview comes in.
+func (s Site) QuotaUsage() int {
+	if s.QuotaPeriod == nil || !s.QuotaPeriod.Equal(s.QuotaPeriodStart(ztime.Now())) {
+		return 0
+	}
+	return s.QuotaUsed
+}
+
+// QuotaPercent gets the percentage of the quota that's used in the current
+// period.
+func (s Site) QuotaPercent() int {
+	if s.Quota == 0 {
+		return 0
+	}
+	return s.QuotaUsage() * 100 / s.Quota
+}
+
+// OverQuota reports if the quota for the current period is used up and new
+// pageviews should be rejected.
+func (s Site) OverQuota() bool {
+	return s.QuotaAction == QuotaReject && s.QuotaPercent() >= 100
+}
+
+// UpdateQuota updates the pageviews used in the current quota period, and
+// emails the site admins once 80% and 100% of the quota is used.
+//
+// This is a no-op if there is no quota.
+func (s *Site) UpdateQuota(ctx context.Context) error {
+	if s.Quota == 0 {
+		return nil
+	}
+
+	period := s.QuotaPeriodStart(ztime.Now())
+	if s.QuotaPeriod == nil || !s.QuotaPeriod.Equal(period) {
+		s.QuotaPeriod, s.QuotaWarned = &period, 0
+	}
+
+	err := zdb.Get(ctx, &s.QuotaUsed,
+		`select coalesce(sum(views), 0) from hit_counts where site_id=$1 and hour >= $2`,
+		s.ID, period)
+	if err != nil {
+		return errors.Wrap(err, "Site.UpdateQuota")
+	}
+
+	var warn int
+	for _, w := range quotaWarnings {
+		if s.QuotaWarned < w && s.QuotaUsed*100 >= s.Quota*w {
+			warn = w
+			break
+		}
+	}
+	if warn > 0 {
+		s.QuotaWarned = warn
+	}
+
+	err = zdb.Exec(ctx,
+		`update sites set quota_used=$1, quota_period=$2, quota_warned=$3 where site_id=$4`,
+		s.QuotaUsed, s.QuotaPeriod, s.QuotaWarned, s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.UpdateQuota")
+	}
+	s.ClearCache(ctx, false)
+
+	if warn > 0 {
+		s.sendQuotaWarning(ctx, warn)
+	}
+	return nil
+}
+
+// UpdateQuotaSettings sets the quota; this doesn't reset the current period.
+func (s *Site) UpdateQuotaSettings(ctx context.Context, quota int, action string) error {
+	if s.ID == 0 {
+		return errors.New("ID == 0")
+	}
+
+	v := NewValidate(ctx)
+	if quota < 0 {
+		v.Append("quota", "must be 0 or higher")
+	}
+	v.Include("quota_action", action, QuotaActions)
+	if v.HasErrors() {
+		return v
+	}
+
+	s.Quota, s.QuotaAction = quota, action
+	err := zdb.Exec(ctx, `update sites set quota=$1, quota_action=$2 where site_id=$3`,
+		s.Quota, s.QuotaAction, s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.UpdateQuotaSettings")
+	}
+	s.ClearCache(ctx, false)
+	return nil
+}
+
+func (s Site) sendQuotaWarning(ctx context.Context, percent int) {
+	l := zlog.Module("quota").Fields(zlog.F{"site": s.ID, "percent": percent})
+
+	var users Users
+	err := users.List(ctx, s.ID)
+	if err != nil {
+		l.Error(err)
+		return
+	}
+
+	subject := fmt.Sprintf("GoatCounter: %s has used %d%% of its monthly pageviews", s.Display(ctx), percent)
+	for _, u := range users {
+		if u.Access.For(s.ID).level() < AccessAdmin.level() || !u.Settings.Notify(NotifyAlerts) {
+			continue
+		}
+		err := blackmail.Send(subject,
+			blackmail.From("GoatCounter", Config(ctx).EmailFrom),
+			blackmail.To(u.Email),
+			blackmail.HeadersAutoreply(),
+			blackmail.BodyMustText(TplEmailQuota{ctx, s, u, percent}.Render))
+		if err != nil {
+			l.Error(err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"zgo.at/blackmail"
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/tz"
+	"zgo.at/zstd/ztime"
+)
+
+func TestQuota(t *testing.T) {
+	ztime.SetNow(t, "2026-06-15 12:00:00")
+
+	var user User
+	ctx := gctest.DB(t)
+	ctx = gctest.Site(ctx, t, &Site{
+		UserDefaults: UserSettings{Timezone: tz.MustNew("", "Asia/Makassar")},
+	}, &user)
+	Config(ctx).EmailFrom = "test@goatcounter.localhost.com"
+
+	buf := new(bytes.Buffer)
+	blackmail.DefaultMailer = blackmail.NewMailer(blackmail.ConnectWriter, blackmail.MailerOut(buf))
+
+	site := MustGetSite(ctx)
+	err := site.UpdateQuotaSettings(ctx, 10, QuotaReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(n int) {
+		t.Helper()
+		hits := make([]Hit, n)
+		for i := range hits {
+			hits[i] = Hit{CreatedAt: ztime.Now(), Path: "/a"}
+		}
+		gctest.StoreHits(ctx, t, false, hits...)
+		err := site.ByID(ctx, site.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(wantUsed, wantWarned int, wantOver bool, wantMail string) {
+		t.Helper()
+		if site.QuotaUsage() != wantUsed || site.QuotaWarned != wantWarned || site.OverQuota() != wantOver {
+			t.Errorf("used=%d warned=%d over=%t; want used=%d warned=%d over=%t",
+				site.QuotaUsage(), site.QuotaWarned, site.OverQuota(), wantUsed, wantWarned, wantOver)
+		}
+		mail := strings.ReplaceAll(buf.String(), "=\r\n", "")
+		buf.Reset()
+		if wantMail == "" && mail != "" {
+			t.Errorf("sent out email:\n%s", mail)
+		}
+		if wantMail != "" && !strings.Contains(mail, wantMail) {
+			t.Errorf("email doesn't contain %q:\n%s", wantMail, mail)
+		}
+	}
+
+	store(7)
+	check(7, 0, false, "")
+
+	store(1)
+	check(8, 80, false, "which is 80% of the quota")
+
+	store(1)
+	check(9, 80, false, "")
+
+	store(1)
+	check(10, 100, true, "which is 100% of the quota")
+
+	store(1)
+	check(11, 100, true, "")
+
+	// July 1st 00:30 in the site's timezone.
+	ztime.SetNow(t, "2026-06-30 16:30:00")
+	if have, want := site.QuotaPeriodStart(ztime.Now()), ztime.FromString("2026-06-30 16:00:00"); !have.Equal(want) {
+		t.Errorf("QuotaPeriodStart: %s; want %s", have, want)
+	}
+	check(0, 100, false, "")
+
+	store(1)
+	check(1, 0, false, "")
+
+	// Don't send anything if the user disabled alerts.
+	user.Settings.Notifications.Off = []string{NotifyAlerts}
+	err = user.Update(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store(7)
+	check(8, 80, false, "")
+}
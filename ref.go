@@ -6,9 +6,11 @@ package goatcounter
 
 import (
 	"context"
+	"net"
 	"net/url"
 	"strings"
 
+	"golang.org/x/net/publicsuffix"
 	"zgo.at/errors"
 	"zgo.at/zcache"
 	"zgo.at/zdb"
@@ -22,6 +24,13 @@ var (
 	RefSchemeOther     = ztype.Ptr("o")
 	RefSchemeGenerated = ztype.Ptr("g")
 	RefSchemeCampaign  = ztype.Ptr("c")
+	RefSchemeSpam      = ztype.Ptr("s")
+)
+
+// What to do with referrer spam; see SiteSettings.RefSpam.
+const (
+	RefSpamDrop = "drop"
+	RefSpamFlag = "flag"
 )
 
 var groups = map[string]string{
@@ -151,6 +160,29 @@ func (r *Ref) GetOrInsert(ctx context.Context) error {
 	return nil
 }
 
+// isURLRef reports if refs with this scheme are stored as a URL, rather than a
+// name.
+func isURLRef(scheme *string) bool {
+	return scheme != nil && (*scheme == *RefSchemeHTTP || *scheme == *RefSchemeSpam)
+}
+
+// refDomain gets the registrable domain for a host, e.g. "reddit.com" for
+// "old.reddit.com" and "example.co.uk" for "www.example.co.uk".
+//
+// The host is returned as-is if it has no registrable domain, such as IP
+// addresses and "localhost".
+func refDomain(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	d, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return d
+}
+
 func cleanRefURL(ref string, refURL *url.URL) (string, bool) {
 	// I'm not sure where these links are generated, but there are *a lot* of
 	// them.
@@ -0,0 +1,347 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zjson"
+)
+
+// RefPurge removes a referrer from the stats, for example for referrer spam or
+// an internal domain.
+type RefPurge struct {
+	// Referrer to purge, e.g. "example.com/page"; the scheme is ignored.
+	Ref string `json:"ref"`
+
+	// Purge all referrers for the registrable domain of Ref, rather than only
+	// Ref; e.g. "example.com" also matches "example.com/page" and
+	// "staging.example.com/page".
+	Domain bool `json:"domain"`
+
+	// Delete the pageviews, rather than keeping them without a referrer.
+	Delete bool `json:"delete"`
+}
+
+// RefPurgeDay is the number of visitors and pageviews from the referrer on a
+// day (in UTC).
+type RefPurgeDay struct {
+	Day       string `json:"day"`
+	Visitors  int    `json:"visitors"`
+	Pageviews int    `json:"pageviews"`
+}
+
+// RefPurgePreview is what RefPurge.Run would change.
+//
+// Pageviews only includes the period for which the pageviews are stored; the
+// stats only store the number of visitors.
+type RefPurgePreview struct {
+	Refs      []string      `json:"refs"`
+	Visitors  int           `json:"visitors"`
+	Pageviews int           `json:"pageviews"`
+	Days      []RefPurgeDay `json:"days"`
+}
+
+// Validate the purge, and normalize Ref.
+func (p *RefPurge) Validate(ctx context.Context) error {
+	ref := strings.TrimSpace(p.Ref)
+	if i := strings.Index(ref, "://"); i > -1 && !strings.Contains(ref[:i], "/") {
+		ref = ref[i+3:]
+	}
+	ref = strings.TrimPrefix(ref, "//")
+	if p.Domain {
+		host, _, _ := strings.Cut(ref, "/")
+		ref = refDomain(host)
+	}
+	p.Ref = strings.TrimSuffix(ref, "/")
+
+	v := NewValidate(ctx)
+	v.Required("ref", p.Ref)
+	v.UTF8("ref", p.Ref)
+	v.Len("ref", p.Ref, 0, 2048)
+	return v.ErrorOrNil()
+}
+
+// refs gets all refs matching the purge.
+func (p RefPurge) refs(ctx context.Context) ([]Ref, error) {
+	var (
+		refs []Ref
+		err  error
+	)
+	if p.Domain {
+		err = zdb.Select(ctx, &refs, `/* RefPurge.refs */
+			select * from refs where ref_id != 1 and lower(ref) like ? order by ref`,
+			"%"+strings.ToLower(p.Ref)+"%")
+		refs = slices.DeleteFunc(refs, func(r Ref) bool {
+			if isURLRef(r.RefScheme) {
+				host, _, _ := strings.Cut(r.Ref, "/")
+				return refDomain(host) != strings.ToLower(p.Ref)
+			}
+			return !strings.EqualFold(r.Ref, p.Ref)
+		})
+	} else {
+		err = zdb.Select(ctx, &refs, `/* RefPurge.refs */
+			select * from refs where ref_id != 1 and lower(ref) in (?) order by ref`,
+			[]string{strings.ToLower(p.Ref), strings.ToLower(p.Ref) + "/"})
+	}
+	return refs, errors.Wrap(err, "RefPurge.refs")
+}
+
+type refPurgeCount struct {
+	PathID int64     `db:"path_id"`
+	Hour   time.Time `db:"hour"`
+	Count  int       `db:"count"`
+}
+
+// counts gets the number of visitors from ref_counts and the number of
+// pageviews from hits per path and hour.
+func (p RefPurge) counts(ctx context.Context, refIDs []int64) ([]refPurgeCount, []refPurgeCount, error) {
+	site := MustGetSite(ctx).ID
+
+	var visitors []refPurgeCount
+	err := zdb.Select(ctx, &visitors, `/* RefPurge.counts */
+		select path_id, hour, sum(total) as count from ref_counts
+		where site_id = ? and ref_id in (?)
+		group by path_id, hour
+		order by hour`, site, refIDs)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "RefPurge.counts")
+	}
+
+	var hits []struct {
+		PathID    int64     `db:"path_id"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	err = zdb.Select(ctx, &hits, `/* RefPurge.counts */
+		select path_id, created_at from hits
+		where site_id = ? and bot = 0 and ref_id in (?)
+		order by created_at`, site, refIDs)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "RefPurge.counts")
+	}
+
+	var (
+		views []refPurgeCount
+		idx   = make(map[string]int)
+	)
+	for _, h := range hits {
+		hour := h.CreatedAt.UTC().Truncate(time.Hour)
+		k := strconv.FormatInt(h.PathID, 10) + hour.Format(time.DateTime)
+		if i, ok := idx[k]; ok {
+			views[i].Count++
+			continue
+		}
+		idx[k] = len(views)
+		views = append(views, refPurgeCount{PathID: h.PathID, Hour: hour, Count: 1})
+	}
+	return visitors, views, nil
+}
+
+// Preview gets what Run would change.
+func (p RefPurge) Preview(ctx context.Context) (RefPurgePreview, error) {
+	preview := RefPurgePreview{Refs: []string{}, Days: []RefPurgeDay{}}
+
+	refs, err := p.refs(ctx)
+	if err != nil || len(refs) == 0 {
+		return preview, errors.Wrap(err, "RefPurge.Preview")
+	}
+	refIDs := make([]int64, 0, len(refs))
+	for _, r := range refs {
+		preview.Refs = append(preview.Refs, r.Ref)
+		refIDs = append(refIDs, r.ID)
+	}
+
+	visitors, views, err := p.counts(ctx, refIDs)
+	if err != nil {
+		return preview, errors.Wrap(err, "RefPurge.Preview")
+	}
+
+	days := make(map[string]RefPurgeDay)
+	for _, v := range visitors {
+		d := days[v.Hour.Format(time.DateOnly)]
+		d.Visitors += v.Count
+		days[v.Hour.Format(time.DateOnly)] = d
+		preview.Visitors += v.Count
+	}
+	for _, v := range views {
+		d := days[v.Hour.Format(time.DateOnly)]
+		d.Pageviews += v.Count
+		days[v.Hour.Format(time.DateOnly)] = d
+		preview.Pageviews += v.Count
+	}
+	for day, d := range days {
+		d.Day = day
+		preview.Days = append(preview.Days, d)
+	}
+	slices.SortFunc(preview.Days, func(a, b RefPurgeDay) int { return strings.Compare(a.Day, b.Day) })
+	return preview, nil
+}
+
+// Run the purge.
+//
+// The matching referrers are replaced with an empty referrer, so the totals
+// remain the same. If Delete is set the pageviews are removed instead, and
+// the visitor and pageview counts are decremented. The other stats (browsers,
+// locations, etc.) aren't stored per referrer, and are left as-is.
+func (p RefPurge) Run(ctx context.Context) error {
+	refs, err := p.refs(ctx)
+	if err != nil || len(refs) == 0 {
+		return errors.Wrap(err, "RefPurge.Run")
+	}
+	refIDs := make([]int64, 0, len(refs))
+	for _, r := range refs {
+		refIDs = append(refIDs, r.ID)
+	}
+
+	return zdb.TX(ctx, func(ctx context.Context) error {
+		var err error
+		if p.Delete {
+			err = p.delete(ctx, refIDs)
+		} else {
+			err = p.reassign(ctx, refIDs)
+		}
+		if err != nil {
+			return errors.Wrap(err, "RefPurge.Run")
+		}
+
+		MustGetSite(ctx).ClearCache(ctx, true)
+		return nil
+	})
+}
+
+func (p RefPurge) reassign(ctx context.Context, refIDs []int64) error {
+	var (
+		site = MustGetSite(ctx).ID
+		args = map[string]any{"site": site, "refs": refIDs}
+		pg   = zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL
+	)
+
+	conflict := `on conflict(site_id, path_id, ref_id, hour)`
+	if pg {
+		conflict = `on conflict on constraint "ref_counts#site_id#path_id#ref_id#hour"`
+	}
+	err := zdb.Exec(ctx, `/* RefPurge.reassign */
+		insert into ref_counts (site_id, path_id, ref_id, hour, total)
+		select site_id, path_id, 1, hour, sum(total) from ref_counts
+		where site_id = :site and ref_id in (:refs)
+		group by site_id, path_id, hour `+conflict+` do update set
+			total = ref_counts.total + excluded.total`, args)
+	if err != nil {
+		return err
+	}
+
+	conflict = `on conflict(site_id, path_id, day, country, ref_id)`
+	if pg {
+		conflict = `on conflict on constraint "location_ref_stats#site_id#path_id#day#country#ref_id"`
+	}
+	err = zdb.Exec(ctx, `/* RefPurge.reassign */
+		insert into location_ref_stats (site_id, path_id, day, country, ref_id, count)
+		select site_id, path_id, day, country, 1, sum(count) from location_ref_stats
+		where site_id = :site and ref_id in (:refs)
+		group by site_id, path_id, day, country `+conflict+` do update set
+			count = location_ref_stats.count + excluded.count`, args)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range []string{"ref_counts", "location_ref_stats"} {
+		err := zdb.Exec(ctx, `delete from `+t+` where site_id = :site and ref_id in (:refs)`, args)
+		if err != nil {
+			return err
+		}
+	}
+	return zdb.Exec(ctx, `update hits set ref_id = 1 where site_id = :site and ref_id in (:refs)`, args)
+}
+
+func (p RefPurge) delete(ctx context.Context, refIDs []int64) error {
+	var (
+		site = MustGetSite(ctx).ID
+		args = map[string]any{"site": site, "refs": refIDs}
+	)
+
+	visitors, views, err := p.counts(ctx, refIDs)
+	if err != nil {
+		return err
+	}
+
+	type hourCount struct{ visitors, views int }
+	var (
+		hours = make(map[refPurgeCount]hourCount)
+		days  = make(map[refPurgeCount][]int)
+	)
+	for _, v := range visitors {
+		k := refPurgeCount{PathID: v.PathID, Hour: v.Hour.UTC()}
+		c := hours[k]
+		c.visitors += v.Count
+		hours[k] = c
+
+		d := refPurgeCount{PathID: v.PathID, Hour: k.Hour.Truncate(24 * time.Hour)}
+		if days[d] == nil {
+			days[d] = make([]int, 24)
+		}
+		days[d][k.Hour.Hour()] += v.Count
+	}
+	for _, v := range views {
+		k := refPurgeCount{PathID: v.PathID, Hour: v.Hour.UTC()}
+		c := hours[k]
+		c.views += v.Count
+		hours[k] = c
+	}
+
+	for k, c := range hours {
+		err := zdb.Exec(ctx, `/* RefPurge.delete */
+			update hit_counts set
+				total = case when total > :visitors then total - :visitors else 0 end,
+				views = case when views > :views    then views - :views    else 0 end
+			where site_id = :site and path_id = :path and hour = :hour`,
+			map[string]any{"site": site, "path": k.PathID, "hour": k.Hour.Format(time.DateTime),
+				"visitors": c.visitors, "views": c.views})
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, sub := range days {
+		day := k.Hour.Format(time.DateOnly)
+		var stats []string
+		err := zdb.Select(ctx, &stats, `/* RefPurge.delete */
+			select stats from hit_stats where site_id = ? and path_id = ? and day = ?`,
+			site, k.PathID, day)
+		if err != nil {
+			return err
+		}
+		if len(stats) == 0 {
+			continue
+		}
+
+		var counts []int
+		zjson.MustUnmarshal([]byte(stats[0]), &counts)
+		for i := range counts {
+			if i < len(sub) {
+				counts[i] = max(counts[i]-sub[i], 0)
+			}
+		}
+		err = zdb.Exec(ctx, `/* RefPurge.delete */
+			update hit_stats set stats = ? where site_id = ? and path_id = ? and day = ?`,
+			string(zjson.MustMarshal(counts)), site, k.PathID, day)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range []string{"ref_counts", "location_ref_stats", "hits"} {
+		err := zdb.Exec(ctx, `delete from `+t+` where site_id = :site and ref_id in (:refs)`, args)
+		if err != nil {
+			return errors.Wrapf(err, "delete %s", t)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestRefPurge(t *testing.T) {
+	setup := func(t *testing.T) context.Context {
+		ctx := gctest.DB(t)
+		ztime.SetNow(t, "2026-06-01 12:00:00")
+		gctest.StoreHits(ctx, t, false,
+			Hit{Path: "/x", Ref: "https://spam.example.com/a", FirstVisit: true, CreatedAt: ztime.Now().Add(-24 * time.Hour)},
+			Hit{Path: "/x", Ref: "https://spam.example.com/a", CreatedAt: ztime.Now().Add(-24 * time.Hour)},
+			Hit{Path: "/x", Ref: "https://example.com/page", FirstVisit: true},
+			Hit{Path: "/x", Ref: "https://example.org", FirstVisit: true},
+			Hit{Path: "/x", FirstVisit: true})
+		return ctx
+	}
+	dump := func(t *testing.T, ctx context.Context) string {
+		var (
+			refs           []string
+			visitors, hits int
+			counts         struct {
+				Total int `db:"total"`
+				Views int `db:"views"`
+			}
+			stats []string
+		)
+		err := zdb.Select(ctx, &refs, `select ref || ':' || sum(total) from ref_counts join refs using (ref_id) group by ref order by ref`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zdb.Get(ctx, &counts, `select sum(total) as total, sum(views) as views from hit_counts`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zdb.Select(ctx, &stats, `select stats from hit_stats order by day`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = zdb.Get(ctx, &hits, `select count(*) from hits`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range stats {
+			var st []int
+			zjson.MustUnmarshal([]byte(s), &st)
+			for _, n := range st {
+				visitors += n
+			}
+		}
+		return fmt.Sprintf("refs=%q total=%d views=%d hit_stats=%d hits=%d",
+			refs, counts.Total, counts.Views, visitors, hits)
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		tests := []struct {
+			in     RefPurge
+			want   string
+			hasErr bool
+		}{
+			{RefPurge{Ref: " https://example.com/page/ "}, "example.com/page", false},
+			{RefPurge{Ref: "//example.com"}, "example.com", false},
+			{RefPurge{Ref: "Hacker News"}, "Hacker News", false},
+			{RefPurge{Ref: "https://old.reddit.com/r/x", Domain: true}, "reddit.com", false},
+			{RefPurge{Ref: "https://"}, "", true},
+		}
+		for _, tt := range tests {
+			err := tt.in.Validate(ctx)
+			if tt.in.Ref != tt.want || (err != nil) != tt.hasErr {
+				t.Errorf("have: %q %v; want: %q", tt.in.Ref, err, tt.want)
+			}
+		}
+	})
+
+	t.Run("preview", func(t *testing.T) {
+		ctx := setup(t)
+
+		p := RefPurge{Ref: "example.com", Domain: true}
+		have, err := p.Preview(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{
+			"refs": ["example.com/page", "spam.example.com/a"],
+			"visitors": 2,
+			"pageviews": 3,
+			"days": [
+				{"day": "2026-05-31", "visitors": 1, "pageviews": 2},
+				{"day": "2026-06-01", "visitors": 1, "pageviews": 1}
+			]}`
+		if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+			t.Error(d)
+		}
+
+		p = RefPurge{Ref: "https://example.com/page/"}
+		err = p.Validate(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err = p.Preview(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(have.Refs, have.Visitors, have.Pageviews) != "[example.com/page] 1 1" {
+			t.Errorf("%#v", have)
+		}
+	})
+
+	t.Run("reassign", func(t *testing.T) {
+		ctx := setup(t)
+
+		err := (RefPurge{Ref: "spam.example.com/a"}).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `refs=[":2" "example.com/page:1" "example.org:1"] total=4 views=5 hit_stats=4 hits=5`
+		if have := dump(t, ctx); have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ctx := setup(t)
+
+		err := (RefPurge{Ref: "example.com", Domain: true, Delete: true}).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `refs=[":1" "example.org:1"] total=2 views=2 hit_stats=2 hits=2`
+		if have := dump(t, ctx); have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+	})
+}
@@ -0,0 +1,288 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+)
+
+// RefRule rewrites a referrer to a canonical name.
+//
+// The rule matches the referrer's host; Match is an exact (case-insensitive)
+// match, or a regular expression if it's surrounded by slashes (e.g.
+// "/^m\.(.+)$/"). Name can refer to regexp groups with $1, ${1}, etc.
+//
+// If the Name is a domain (i.e. contains a ".") only the host is replaced and
+// the path is kept, so that "m.example.com/page" is counted as
+// "example.com/page". Otherwise the referrer is grouped as just the name, like
+// "WhatsApp" for "com.whatsapp".
+type RefRule struct {
+	Match string
+	Name  string
+
+	re  *regexp.Regexp
+	err error
+}
+
+// RefRules is a list of RefRule, stored as one "match => name" rule per line.
+type RefRules []RefRule
+
+// Built-in rules; these are applied after the site and instance rules.
+//
+// The groups and hostAlias maps are applied before any rules, so there's no
+// need to add those here.
+var builtinRefRules = func() RefRules {
+	var r RefRules
+	r.Scan(`
+		com.google.android.apps.messaging  => Google Messages
+		com.facebook.katana                => Facebook
+		com.facebook.orca                  => Facebook Messenger
+		com.linkedin.android               => LinkedIn
+		com.discord                        => Discord
+		com.whatsapp                       => WhatsApp
+		/\.cdn\.ampproject\.org$/          => Google AMP cache
+		/^(?:m|mobile)\.(.+\..+)$/         => $1
+	`)
+	return r
+}()
+
+var (
+	refRulesInstance atomic.Pointer[RefRules]
+	refRulesMu       sync.Mutex
+	refRulesPath     string
+	refRulesMtime    time.Time
+)
+
+func (r RefRule) String() string { return r.Match + " => " + r.Name }
+
+func (r RefRule) isRegexp() bool {
+	return len(r.Match) > 1 && r.Match[0] == '/' && r.Match[len(r.Match)-1] == '/'
+}
+
+// apply this rule to the host, returning the canonical name if it matches.
+func (r RefRule) apply(host string) (string, bool) {
+	if !r.isRegexp() {
+		return r.Name, strings.EqualFold(host, r.Match)
+	}
+	if r.re == nil {
+		return "", false
+	}
+	m := r.re.FindStringSubmatchIndex(host)
+	if m == nil {
+		return "", false
+	}
+	return string(r.re.ExpandString(nil, r.Name, host, m)), true
+}
+
+func (l RefRules) String() string {
+	s := make([]string, 0, len(l))
+	for _, r := range l {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+func (l RefRules) Value() (driver.Value, error)  { return l.String(), nil }
+func (l RefRules) MarshalText() ([]byte, error)  { return []byte(l.String()), nil }
+func (l *RefRules) UnmarshalText(v []byte) error { return l.Scan(v) }
+
+// Scan the rules; this never returns an error, so that a bad rule doesn't
+// prevent loading the settings. Use Validate() to check the rules.
+func (l *RefRules) Scan(v any) error {
+	if v == nil {
+		return nil
+	}
+
+	lines := strings.Split(fmt.Sprintf("%s", v), "\n")
+	rules := make(RefRules, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		m, n, ok := strings.Cut(line, "=>")
+		r := RefRule{Match: strings.TrimSpace(m), Name: strings.TrimSpace(n)}
+		switch {
+		case !ok || r.Match == "" || r.Name == "":
+			r.err = fmt.Errorf("%q: must be as \"match => name\"", line)
+		case r.isRegexp():
+			r.re, r.err = regexp.Compile("(?i)" + r.Match[1:len(r.Match)-1])
+		}
+		rules = append(rules, r)
+	}
+	*l = rules
+	return nil
+}
+
+// Validate reports the first rule that failed to parse.
+func (l RefRules) Validate() error {
+	for _, r := range l {
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+// Canonical gets the canonical referrer for the ref, which is stored as
+// "host/path" without the scheme.
+//
+// This applies the first matching rule of the site rules, instance rules, and
+// built-in rules, in that order. The returned scheme is RefSchemeGenerated if
+// the ref was grouped as a name.
+func (l RefRules) Canonical(ref string, scheme *string) (string, *string, bool) {
+	if scheme == nil || (*scheme != *RefSchemeHTTP && *scheme != *RefSchemeOther) {
+		return ref, scheme, false
+	}
+
+	host, path, _ := strings.Cut(ref, "/")
+	for _, rules := range []*RefRules{&l, refRulesInstance.Load(), &builtinRefRules} {
+		if rules == nil {
+			continue
+		}
+		for _, r := range *rules {
+			if r.err != nil {
+				continue
+			}
+			name, ok := r.apply(host)
+			if !ok {
+				continue
+			}
+			if !strings.Contains(name, ".") {
+				return name, RefSchemeGenerated, true
+			}
+			if path != "" {
+				name += "/" + path
+			}
+			return name, scheme, name != ref
+		}
+	}
+	return ref, scheme, false
+}
+
+// InitRefRules sets the path to a file with instance-wide referrer rules, in
+// addition to the built-in rules. The file has one "match => name" rule per
+// line; see RefRule.
+//
+// Only the built-in rules are used if path is an empty string.
+func InitRefRules(path string) error {
+	refRulesMu.Lock()
+	defer refRulesMu.Unlock()
+	refRulesPath, refRulesMtime = path, time.Time{}
+	refRulesInstance.Store(nil)
+
+	if path == "" {
+		return nil
+	}
+	_, err := loadRefRules()
+	return err
+}
+
+// ReloadRefRules reloads the file set with InitRefRules() if it was modified
+// since it was loaded. It does nothing if there is no such file.
+func ReloadRefRules() (bool, error) {
+	refRulesMu.Lock()
+	defer refRulesMu.Unlock()
+	if refRulesPath == "" {
+		return false, nil
+	}
+	return loadRefRules()
+}
+
+func loadRefRules() (bool, error) {
+	st, err := os.Stat(refRulesPath)
+	if err != nil {
+		return false, errors.Wrap(err, "loadRefRules")
+	}
+	if st.ModTime().Equal(refRulesMtime) {
+		return false, nil
+	}
+
+	fp, err := os.ReadFile(refRulesPath)
+	if err != nil {
+		return false, errors.Wrap(err, "loadRefRules")
+	}
+	var rules RefRules
+	rules.Scan(fp)
+	if err := rules.Validate(); err != nil {
+		return false, errors.Wrapf(err, "loadRefRules: %s", refRulesPath)
+	}
+
+	refRulesInstance.Store(&rules)
+	refRulesMtime = st.ModTime()
+	return true, nil
+}
+
+// ApplyRefRules applies the current referrer rules to the existing ref_counts
+// stats for the site.
+//
+// The hits always retain the original referrer, but this can't be undone for
+// the stats: removing a rule later will only affect new pageviews.
+func ApplyRefRules(ctx context.Context) error {
+	site := MustGetSite(ctx)
+
+	var refs []Ref
+	err := zdb.Select(ctx, &refs, `
+		select ref_id, ref, ref_scheme from refs
+		where
+			ref_scheme in (:schemes) and
+			ref_id in (select distinct ref_id from ref_counts where site_id = :site)`,
+		map[string]any{
+			"site":    site.ID,
+			"schemes": []string{*RefSchemeHTTP, *RefSchemeOther},
+		})
+	if err != nil {
+		return errors.Wrap(err, "ApplyRefRules")
+	}
+
+	return zdb.TX(ctx, func(ctx context.Context) error {
+		for _, r := range refs {
+			name, scheme, ok := site.Settings.RefRules.Canonical(r.Ref, r.RefScheme)
+			if !ok {
+				continue
+			}
+			canon := Ref{Ref: name, RefScheme: scheme}
+			err := canon.GetOrInsert(ctx)
+			if err != nil {
+				return errors.Wrap(err, "ApplyRefRules")
+			}
+			if canon.ID == r.ID {
+				continue
+			}
+
+			conflict := `on conflict(site_id, path_id, ref_id, hour)`
+			if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+				conflict = `on conflict on constraint "ref_counts#site_id#path_id#ref_id#hour"`
+			}
+			err = zdb.Exec(ctx, `
+				insert into ref_counts (site_id, path_id, ref_id, hour, total)
+				select site_id, path_id, :new, hour, total from ref_counts
+				where site_id = :site and ref_id = :old `+conflict+` do update set
+					total = ref_counts.total + excluded.total`,
+				map[string]any{"site": site.ID, "old": r.ID, "new": canon.ID})
+			if err != nil {
+				return errors.Wrap(err, "ApplyRefRules")
+			}
+			err = zdb.Exec(ctx, `delete from ref_counts where site_id = :site and ref_id = :old`,
+				map[string]any{"site": site.ID, "old": r.ID})
+			if err != nil {
+				return errors.Wrap(err, "ApplyRefRules")
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,142 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestRefRulesCanonical(t *testing.T) {
+	var rules RefRules
+	rules.Scan(`
+		# Comment
+		/^(www|m)\.(example\.com)$/ => $2
+		com.example.app             => Example app
+		t.co                        => Twitter
+	`)
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref, scheme string
+		want        string
+		wantScheme  string
+		wantOK      bool
+	}{
+		{"www.example.com/page", "h", "example.com/page", "h", true},
+		{"m.example.com/page", "h", "example.com/page", "h", true},
+		{"example.com/page", "h", "example.com/page", "h", false},
+		{"notexample.com/page", "h", "notexample.com/page", "h", false},
+		{"com.example.app", "o", "Example app", "g", true},
+		{"T.co/abc", "h", "Twitter", "g", true},
+		{"t.co", "c", "t.co", "c", false},
+
+		// Built-in rules.
+		{"com.whatsapp", "o", "WhatsApp", "g", true},
+		{"www-example-org.cdn.ampproject.org/c/s/example.org", "h", "Google AMP cache", "g", true},
+		{"mobile.example.org/x", "h", "example.org/x", "h", true},
+		{"m.org", "h", "m.org", "h", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			have, haveScheme, haveOK := rules.Canonical(tt.ref, &tt.scheme)
+			if have != tt.want || *haveScheme != tt.wantScheme || haveOK != tt.wantOK {
+				t.Errorf("\nhave: %q %q %t\nwant: %q %q %t",
+					have, *haveScheme, haveOK, tt.want, tt.wantScheme, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRefRulesValidate(t *testing.T) {
+	tests := []struct {
+		in, wantErr string
+	}{
+		{"", ""},
+		{"a.com => b.com\n/x/ => y", ""},
+		{"a.com b.com", `"a.com b.com": must be as "match => name"`},
+		{"a.com =>", `"a.com =>": must be as "match => name"`},
+		{"/(/ => x", "missing closing )"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var rules RefRules
+			rules.Scan(tt.in)
+			if !ztest.ErrorContains(rules.Validate(), tt.wantErr) {
+				t.Errorf("\nhave: %v\nwant: %s", rules.Validate(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyRefRules(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/x", Ref: "https://www.example.com/a", FirstVisit: true},
+		Hit{Path: "/x", Ref: "https://example.com/a", FirstVisit: true},
+		Hit{Path: "/x", Ref: "https://example.org", FirstVisit: true})
+
+	site.Settings.RefRules.Scan(`/^www\.(.+)$/ => $1`)
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New hits use the rules, but store the original ref.
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/x", Ref: "https://www.example.org", FirstVisit: true})
+
+	have := zdb.DumpString(ctx, `select refs.ref from hits join refs using (ref_id) order by hit_id`)
+	want := `
+		ref
+		www.example.com/a
+		example.com/a
+		example.org
+		www.example.org`
+	if d := zdb.Diff(have, want); d != "" {
+		t.Error(d)
+	}
+
+	err = ApplyRefRules(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := ztime.NewRange(ztime.Now().Add(-1 * time.Hour)).To(ztime.Now().Add(1 * time.Hour))
+	var stats HitStats
+	err = stats.ListTopRefs(ctx, rng, nil, true, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = `{
+		"more": false,
+		"stats": [{
+			"name": "example.com/a",
+			"count": 2,
+			"ref_scheme": "h"
+		}, {
+			"name": "example.org",
+			"count": 2,
+			"ref_scheme": "h"
+		}]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(stats), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
@@ -62,7 +62,7 @@ func TestListTopRefs(t *testing.T) {
 
 	{
 		var have HitStats
-		err := have.ListTopRefs(ctx, rng, nil, 10, 0)
+		err := have.ListTopRefs(ctx, rng, nil, true, 10, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -86,7 +86,7 @@ func TestListTopRefs(t *testing.T) {
 
 	{
 		var have HitStats
-		err := have.ListTopRefs(ctx, rng, []int64{2}, 10, 0)
+		err := have.ListTopRefs(ctx, rng, []int64{2}, true, 10, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -104,3 +104,93 @@ func TestListTopRefs(t *testing.T) {
 		}
 	}
 }
+
+func TestListTopRefDomains(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	gctest.StoreHits(ctx, t, false,
+		Hit{Path: "/x", Ref: "https://www.reddit.com/r/golang", FirstVisit: true},
+		Hit{Path: "/x", Ref: "https://new.reddit.com/r/golang", FirstVisit: true},
+		Hit{Path: "/x", Ref: "https://reddit.com/r/programming", FirstVisit: true},
+		Hit{Path: "/y", Ref: "https://www.reddit.com/r/golang", FirstVisit: true},
+		Hit{Path: "/x", Ref: "https://example.co.uk/a", FirstVisit: true},
+		Hit{Path: "/x", Ref: "https://notreddit.com", FirstVisit: true},
+		Hit{Path: "/x", Query: "ref=reddit.com", FirstVisit: true})
+
+	rng := ztime.NewRange(ztime.Now().Add(-1 * time.Hour)).To(ztime.Now().Add(1 * time.Hour))
+
+	{
+		var have HitStats
+		err := have.ListTopRefDomains(ctx, rng, nil, true, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := `{
+			"more": false,
+			"stats": [{
+				"name": "reddit.com",
+				"count": 4,
+				"ref_scheme": "h"
+			}, {
+				"name": "example.co.uk",
+				"count": 1,
+				"ref_scheme": "h"
+			}, {
+				"name": "notreddit.com",
+				"count": 1,
+				"ref_scheme": "h"
+			}, {
+				"name": "reddit.com",
+				"count": 1,
+				"ref_scheme": "c"
+			}]
+		}`
+		if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+			t.Error(d)
+		}
+	}
+
+	{
+		var have HitStats
+		err := have.ListRefsByDomain(ctx, "reddit.com", rng, nil, true, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := `{
+			"more": false,
+			"stats": [{
+				"name": "www.reddit.com/r/golang",
+				"count": 2,
+				"ref_scheme": "h"
+			}, {
+				"name": "new.reddit.com/r/golang",
+				"count": 1,
+				"ref_scheme": "h"
+			}, {
+				"name": "reddit.com",
+				"count": 1,
+				"ref_scheme": "c"
+			}, {
+				"name": "reddit.com/r/programming",
+				"count": 1,
+				"ref_scheme": "h"
+			}]
+		}`
+		if d := ztest.Diff(zjson.MustMarshalString(have), want, ztest.DiffJSON); d != "" {
+			t.Error(d)
+		}
+	}
+
+	{
+		var have HitStats
+		err := have.ListRefsByDomain(ctx, "reddit.com", rng, nil, true, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !have.More || len(have.Stats) != 1 || have.Stats[0].Name != "new.reddit.com/r/golang" {
+			t.Errorf("wrong pagination: %s", zjson.MustMarshalString(have))
+		}
+	}
+}
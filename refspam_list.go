@@ -0,0 +1,105 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bufio"
+	"bytes"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zgo.at/errors"
+)
+
+var (
+	refspamList  atomic.Pointer[map[string]struct{}]
+	refspamMu    sync.Mutex
+	refspamPath  string
+	refspamMtime time.Time
+)
+
+// isRefspam reports if host or any of its parent domains is on the referrer
+// spam list.
+func isRefspam(host string) bool {
+	list := refspamList.Load()
+	if list == nil {
+		list = &refspam
+	}
+
+	for host != "" {
+		if _, ok := (*list)[host]; ok {
+			return true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return false
+}
+
+// InitRefspam sets the path to a file with extra domains to add to the
+// built-in referrer spam list.
+//
+// The file has one domain per line; blank lines and lines starting with # are
+// ignored. Subdomains of a listed domain are also treated as spam.
+//
+// Only the built-in list is used if path is an empty string.
+func InitRefspam(path string) error {
+	refspamMu.Lock()
+	defer refspamMu.Unlock()
+	refspamPath, refspamMtime = path, time.Time{}
+	refspamList.Store(nil)
+
+	if path == "" {
+		return nil
+	}
+	_, err := loadRefspam()
+	return err
+}
+
+// ReloadRefspam reloads the file set with InitRefspam() if it was modified
+// since it was loaded. It does nothing if there is no such file.
+func ReloadRefspam() (bool, error) {
+	refspamMu.Lock()
+	defer refspamMu.Unlock()
+	if refspamPath == "" {
+		return false, nil
+	}
+	return loadRefspam()
+}
+
+func loadRefspam() (bool, error) {
+	st, err := os.Stat(refspamPath)
+	if err != nil {
+		return false, errors.Wrap(err, "loadRefspam")
+	}
+	if st.ModTime().Equal(refspamMtime) {
+		return false, nil
+	}
+
+	fp, err := os.ReadFile(refspamPath)
+	if err != nil {
+		return false, errors.Wrap(err, "loadRefspam")
+	}
+
+	list := maps.Clone(refspam)
+	scan := bufio.NewScanner(bytes.NewReader(fp))
+	for scan.Scan() {
+		l := strings.ToLower(strings.TrimSpace(scan.Text()))
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		list[l] = struct{}{}
+	}
+	if err := scan.Err(); err != nil {
+		return false, errors.Wrapf(err, "loadRefspam: %s", refspamPath)
+	}
+
+	refspamList.Store(&list)
+	refspamMtime = st.ModTime()
+	return true, nil
+}
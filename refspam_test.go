@@ -5,6 +5,8 @@
 package goatcounter
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -24,8 +26,10 @@ func TestRefspam(t *testing.T) {
 		{"d.adcash.com", true},
 
 		{"dadcash.com", false},
+		{"adcash.com.example.com", false},
 		{"localhost.com", false},
 		{"asdlocalhost.com", false},
+		{"", false},
 	}
 
 	for _, tt := range tests {
@@ -38,9 +42,51 @@ func TestRefspam(t *testing.T) {
 	}
 }
 
-func BenchmarkRefspam(b *testing.B) {
-	isRefspam("notinthelist.com") // Run the sync.Once
+func TestRefspamExtra(t *testing.T) {
+	t.Cleanup(func() { InitRefspam("") })
+
+	tmp := filepath.Join(t.TempDir(), "refspam")
+	err := os.WriteFile(tmp, []byte("# Comment\n\nspam.example.com\n  Other.Example  \n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = InitRefspam(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
 
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"spam.example.com", true},
+		{"a.spam.example.com", true},
+		{"other.example", true},
+		{"adcash.com", true},
+
+		{"example.com", false},
+		{"nospam.example.com", false},
+		{"another.example", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got := isRefspam(tt.in)
+			if got != tt.want {
+				t.Errorf("\ngot:  %t\nwant: %t", got, tt.want)
+			}
+		})
+	}
+
+	reloaded, err := ReloadRefspam()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded {
+		t.Error("reloaded while the file didn't change")
+	}
+}
+
+func BenchmarkRefspam(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	v := false
@@ -0,0 +1,131 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// ReplicaCheck is how often the read-only replica is checked.
+const ReplicaCheck = 10 * time.Second
+
+// Replica is a read-only database replica, for the dashboard and API.
+type Replica struct {
+	db      zdb.DB
+	healthy atomic.Bool
+	checked atomic.Int64 // Last check as Unix time in nanoseconds.
+	lag     atomic.Int64 // Last measured lag as a time.Duration.
+}
+
+// ReplicaStatus is the status of the read-only replica.
+type ReplicaStatus struct {
+	Healthy bool    `json:"healthy"`
+	Lag     float64 `json:"lag_seconds"`
+	Checked string  `json:"checked"`
+}
+
+var (
+	keyReplica = &struct{ n string }{""}
+	keyPrimary = &struct{ n string }{""}
+)
+
+// WithReplica sets the read-only replica, which is used by ReadOnly().
+func WithReplica(ctx context.Context, db zdb.DB) context.Context {
+	r := &Replica{db: db}
+	r.healthy.Store(true)
+	return context.WithValue(ctx, keyReplica, r)
+}
+
+// GetReplica gets the read-only replica, or nil if there is none.
+func GetReplica(ctx context.Context) *Replica {
+	if r, ok := ctx.Value(keyReplica).(*Replica); ok {
+		return r
+	}
+	return nil
+}
+
+// ReadOnly gets a context that uses the read-only replica for queries if there
+// is one and it's up, or the primary database otherwise.
+//
+// This should only be used for reading the stats: the replica may be a few
+// seconds behind the primary, and it can't be written to. Queries are limited
+// to the timeout set with SetQueryTimeout().
+func ReadOnly(ctx context.Context) context.Context {
+	cur := zdb.MustGetDB(ctx)
+	db := cur
+	if r := GetReplica(ctx); r != nil && r.check(ctx, false) {
+		db = r.db
+	}
+	db = withQueryTimeout(db)
+	if db == cur {
+		return ctx
+	}
+	if ctx.Value(keyPrimary) == nil {
+		ctx = context.WithValue(ctx, keyPrimary, cur)
+	}
+	return zdb.WithDB(ctx, db)
+}
+
+// Primary gets a context that uses the primary database, for writing in a
+// request that otherwise uses ReadOnly().
+func Primary(ctx context.Context) context.Context {
+	if db, ok := ctx.Value(keyPrimary).(zdb.DB); ok {
+		return zdb.WithDB(ctx, db)
+	}
+	return ctx
+}
+
+// Status gets the status of the replica, checking it first.
+func (r *Replica) Status(ctx context.Context) ReplicaStatus {
+	healthy := r.check(ctx, true)
+	return ReplicaStatus{
+		Healthy: healthy,
+		Lag:     time.Duration(r.lag.Load()).Seconds(),
+		Checked: time.Unix(0, r.checked.Load()).UTC().Format(time.RFC3339),
+	}
+}
+
+// check reports if the replica is up and updates the lag, checking at most
+// every ReplicaCheck unless force is set.
+func (r *Replica) check(ctx context.Context, force bool) bool {
+	last := r.checked.Load()
+	if !force && time.Since(time.Unix(0, last)) < ReplicaCheck {
+		return r.healthy.Load()
+	}
+	if !r.checked.CompareAndSwap(last, time.Now().UnixNano()) { // Someone else is checking.
+		return r.healthy.Load()
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+	ctx = zdb.WithDB(ctx, r.db)
+
+	// The time since the last transaction was replayed; this is only an
+	// approximation as it will also increase if there are no writes on the
+	// primary, but GoatCounter writes every few seconds.
+	query := `select 0`
+	if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+		query = `select coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0)`
+	}
+	var lag float64
+	err := zdb.Get(ctx, &lag, query)
+	if err != nil {
+		if r.healthy.Swap(false) {
+			zlog.Module("replica").Errorf("read-only replica is down; using the primary: %s", err)
+		}
+		return false
+	}
+
+	r.lag.Store(int64(lag * float64(time.Second)))
+	if !r.healthy.Swap(true) {
+		zlog.Module("replica").Printf("read-only replica is up again")
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+)
+
+func TestReplica(t *testing.T) {
+	ctx := gctest.DBFile(t)
+	primary := zdb.MustGetDB(ctx)
+
+	if db := zdb.MustGetDB(ReadOnly(ctx)); db != primary {
+		t.Fatal("ReadOnly() without a replica doesn't use the primary")
+	}
+
+	ro, err := zdb.Connect(context.Background(), zdb.ConnectOptions{Connect: os.Getenv("GCTEST_CONNECT")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = WithReplica(ctx, ro)
+
+	rctx := ReadOnly(ctx)
+	if db := zdb.MustGetDB(rctx); db != ro {
+		t.Fatal("ReadOnly() doesn't use the replica")
+	}
+	if db := zdb.MustGetDB(Primary(rctx)); db != primary {
+		t.Fatal("Primary() doesn't use the primary")
+	}
+	var s Site
+	err = s.ByID(rctx, MustGetSite(ctx).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := GetReplica(ctx).Status(ctx); !st.Healthy || st.Lag < 0 {
+		t.Errorf("%#v", st)
+	}
+
+	// Fall back to the primary if the replica is down.
+	ro.Close()
+	if st := GetReplica(ctx).Status(ctx); st.Healthy {
+		t.Errorf("%#v", st)
+	}
+	if db := zdb.MustGetDB(ReadOnly(ctx)); db != primary {
+		t.Fatal("ReadOnly() doesn't fall back to the primary")
+	}
+}
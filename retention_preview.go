@@ -0,0 +1,219 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// RetentionDelay is how long the data retention waits before removing anything
+// after it was lowered, so that an accidental change can still be reverted.
+const RetentionDelay = 24 * time.Hour
+
+// Rough size of a row including the indexes, for estimating how much disk
+// space the data retention frees.
+const (
+	retentionHitSize  = 160
+	retentionStatSize = 60
+)
+
+// RetentionPreview is what the data retention would remove for a site.
+type RetentionPreview struct {
+	Days int    `json:"days"` // Effective data retention; 0 if data is kept forever.
+	Mode string `json:"mode"` // RetentionMode
+
+	// Number of pageviews that would be deleted or anonymized.
+	Pageviews int `json:"pageviews"`
+
+	// Number of stat rows that would be deleted; this is always 0 if the stats
+	// are kept, including for RetentionDownsample where the stats are rolled
+	// up.
+	StatRows int `json:"stat_rows"`
+
+	// Date of the oldest pageview or stats that would be removed, and the date
+	// before which everything is removed; both are nil if nothing would be
+	// removed. From may also be nil if the oldest date isn't known.
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+
+	// Rough estimate of the disk space freed, in bytes. Anonymizing the
+	// pageviews doesn't really free anything, and the database may not return
+	// the space to the filesystem until it's vacuumed.
+	Bytes int64 `json:"bytes"`
+}
+
+// SizeMB gets the estimated disk space in megabytes, for display.
+func (p RetentionPreview) SizeMB() string {
+	return strconv.FormatFloat(float64(p.Bytes)/1024/1024, 'f', 1, 64)
+}
+
+// RetentionPreview gets what the data retention would remove for this site
+// with the given settings, without changing anything.
+//
+// This counts what's removed by the next run of the data retention: for the
+// settings the site already has this is usually nothing.
+func (s Site) RetentionPreview(ctx context.Context, ss SiteSettings) (RetentionPreview, error) {
+	ss.Defaults(ctx)
+	p := RetentionPreview{Days: ss.EffectiveDataRetention(ctx), Mode: ss.RetentionMode}
+	if p.Days <= 0 {
+		return p, nil
+	}
+	ival := Interval(ctx, p.Days)
+
+	// Same conditions as AnonymizeOlderThan and DeleteHitsOlderThan.
+	anon := p.Mode == RetentionAnonymize
+	err := zdb.Get(ctx, &p.Pageviews, `/* Site.RetentionPreview */
+		select count(*) from hits where site_id = :site and created_at < `+ival+`
+		{{:anon and (session is not null or browser_id != 0 or system_id != 0 or length(location) > 2)}}`,
+		map[string]any{"site": s.ID, "anon": anon})
+	if err != nil {
+		return p, errors.Wrap(err, "Site.RetentionPreview")
+	}
+
+	var from []time.Time
+	if p.Pageviews > 0 {
+		err = zdb.Select(ctx, &from, `/* Site.RetentionPreview */
+			select created_at from hits where site_id = :site and created_at < `+ival+`
+			{{:anon and (session is not null or browser_id != 0 or system_id != 0 or length(location) > 2)}}
+			order by created_at asc limit 1`,
+			map[string]any{"site": s.ID, "anon": anon})
+		if err != nil {
+			return p, errors.Wrap(err, "Site.RetentionPreview")
+		}
+	}
+
+	if !ss.KeepsStats() {
+		for _, t := range append(statTables, "campaign_stats", "visitor_sketches") {
+			var n int
+			err := zdb.Get(ctx, &n, `select count(*) from `+t+` where site_id=$1 and day < `+ival, s.ID)
+			if err != nil {
+				return p, errors.Wrap(err, "Site.RetentionPreview: "+t)
+			}
+			p.StatRows += n
+		}
+		for _, t := range []string{"hit_counts", "ref_counts"} {
+			var n int
+			err := zdb.Get(ctx, &n, `select count(*) from `+t+` where site_id=$1 and hour < `+ival, s.ID)
+			if err != nil {
+				return p, errors.Wrap(err, "Site.RetentionPreview: "+t)
+			}
+			p.StatRows += n
+		}
+		if p.StatRows > 0 && len(from) == 0 {
+			err = zdb.Select(ctx, &from, `/* Site.RetentionPreview */
+				select hour from hit_counts where site_id=$1 and hour < `+ival+` order by hour asc limit 1`, s.ID)
+			if err != nil {
+				return p, errors.Wrap(err, "Site.RetentionPreview")
+			}
+		}
+	}
+
+	if p.Pageviews > 0 || p.StatRows > 0 {
+		to := ztime.Now().UTC().AddDate(0, 0, -p.Days)
+		p.To = &to
+		if len(from) > 0 {
+			f := from[0].UTC()
+			p.From = &f
+		}
+	}
+	if !anon {
+		p.Bytes = int64(p.Pageviews)*retentionHitSize + int64(p.StatRows)*retentionStatSize
+	}
+	return p, nil
+}
+
+// RetentionLowered reports if the data retention in ss removes more than in
+// old, either because it's shorter or because the mode removes more.
+func (ss SiteSettings) RetentionLowered(ctx context.Context, old SiteSettings) bool {
+	ss.Defaults(ctx)
+	old.Defaults(ctx)
+	n, o := ss.EffectiveDataRetention(ctx), old.EffectiveDataRetention(ctx)
+	if n <= 0 {
+		return false
+	}
+	if o <= 0 || n < o {
+		return true
+	}
+
+	// From least to most destructive.
+	rank := map[string]int{RetentionAnonymize: 0, RetentionAggregate: 1, RetentionDownsample: 2, RetentionAll: 3}
+	if rank[ss.RetentionMode] > rank[old.RetentionMode] {
+		return true
+	}
+	return ss.RetentionMode == RetentionDownsample &&
+		ss.EffectiveDailyRetention(ctx) < old.EffectiveDailyRetention(ctx)
+}
+
+func retentionDelayKey(siteID int64) string { return fmt.Sprintf("retention-delay:%d", siteID) }
+
+// DelayRetention delays the data retention for RetentionDelay if the data
+// retention in the site's settings removes more than in old, and emails the
+// admins about it.
+func (s *Site) DelayRetention(ctx context.Context, old SiteSettings) error {
+	if !s.Settings.RetentionLowered(ctx, old) {
+		return nil
+	}
+
+	until := ztime.Now().UTC().Add(RetentionDelay)
+	err := zdb.Exec(ctx, `insert into store (key, value) values (:k, :v)
+		on conflict (key) do update set value = excluded.value`,
+		map[string]any{"k": retentionDelayKey(s.ID), "v": until.Format(time.RFC3339)})
+	if err != nil {
+		return errors.Wrap(err, "Site.DelayRetention")
+	}
+
+	preview, err := s.RetentionPreview(ctx, s.Settings)
+	if err != nil {
+		return errors.Wrap(err, "Site.DelayRetention")
+	}
+
+	var users Users
+	err = users.BySite(ctx, s.IDOrParent())
+	if err != nil {
+		return errors.Wrap(err, "Site.DelayRetention")
+	}
+	l := zlog.Field("site", s.ID)
+	for _, u := range users.Admins() {
+		err := blackmail.Send(fmt.Sprintf("GoatCounter: the data retention for %s was changed", s.Display(ctx)),
+			blackmail.From("GoatCounter", Config(ctx).EmailFrom),
+			blackmail.To(u.Email),
+			blackmail.HeadersAutoreply(),
+			blackmail.BodyMustText(TplEmailRetentionDelay{ctx, *s, u, preview, until}.Render))
+		if err != nil {
+			l.Error(err)
+		}
+	}
+	return nil
+}
+
+// RetentionDelayedUntil gets the time until which the data retention is
+// delayed, or nil if it's not delayed.
+func (s Site) RetentionDelayedUntil(ctx context.Context) (*time.Time, error) {
+	var v []string
+	err := zdb.Select(ctx, &v, `select value from store where key = ?`, retentionDelayKey(s.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "Site.RetentionDelayedUntil")
+	}
+	if len(v) == 0 {
+		return nil, nil
+	}
+	until, err := time.Parse(time.RFC3339, v[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "Site.RetentionDelayedUntil")
+	}
+	if !ztime.Now().Before(until) {
+		return nil, nil
+	}
+	return &until, nil
+}
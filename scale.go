@@ -0,0 +1,77 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// Pixel density classes (window.devicePixelRatio), as stored in scale_stats.
+const (
+	Scale1x      = "1x"
+	Scale15x     = "1.5x"
+	Scale2x      = "2x"
+	Scale3x      = "3x"
+	ScaleUnknown = "unknown"
+)
+
+// ScaleClass gets the pixel density class from the scale in the size parameter.
+//
+// This is rounded down to the nearest class, so a scale of 1.25 is "1x" and
+// 2.625 is "2x"; everything from 3 and up is "3x".
+//
+// These are stored in scale_stats and used to backfill from the hits, so
+// changing them will make old and new data inconsistent. Don't.
+func ScaleClass(scale float64) string {
+	switch {
+	case scale >= 3:
+		return Scale3x
+	case scale >= 2:
+		return Scale2x
+	case scale >= 1.5:
+		return Scale15x
+	case scale > 0:
+		return Scale1x
+	default:
+		return ScaleUnknown
+	}
+}
+
+// ListScales lists the visitor count for every pixel density class.
+//
+// This always returns all classes, in a fixed order.
+func (h *HitStats) ListScales(ctx context.Context, rng ztime.Range, pathFilter []int64) error {
+	user := MustGetUser(ctx)
+	var rows []HitStat
+	err := zdb.Select(ctx, &rows, "load:hit_stats.ListScales", map[string]any{
+		"site":   MustGetSite(ctx).ID,
+		"start":  asUTCDate(user, rng.Start),
+		"end":    asUTCDate(user, rng.End),
+		"filter": pathFilter,
+	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListScales")
+	}
+
+	h.Stats = []HitStat{
+		{ID: Scale1x, Name: "1×"},
+		{ID: Scale15x, Name: "1.5×"},
+		{ID: Scale2x, Name: "2×"},
+		{ID: Scale3x, Name: "3×+"},
+		{ID: ScaleUnknown},
+	}
+	for _, r := range rows {
+		for i := range h.Stats {
+			if h.Stats[i].ID == r.ID {
+				h.Stats[i].Count += r.Count
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zbool"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztype"
+)
+
+// SessionPurge removes all pageviews for one or more sessions, for example for
+// a data subject request.
+//
+// The stored pageviews are deleted, and the stats they were counted in are
+// decremented. This is only possible for the stats that can be derived from the
+// stored pageviews; the city, label, unknown user-agent, and bot user-agent
+// stats and the estimates for the unique visitors per week, month, etc. aren't
+// changed. The device is only known if the screen size was stored.
+type SessionPurge struct {
+	// Session IDs, as in the export.
+	Sessions []string `json:"sessions"`
+
+	ids []zint.Uint128
+}
+
+// SessionPurgeResult is what SessionPurge.Run removed.
+type SessionPurgeResult struct {
+	Sessions  int `json:"sessions"`  // Number of sessions that had stored pageviews.
+	Pageviews int `json:"pageviews"` // Number of stored pageviews removed.
+}
+
+// Validate the purge, and parse the session IDs.
+func (p *SessionPurge) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("sessions", p.Sessions)
+	if len(p.Sessions) > 1000 {
+		v.Append("sessions", "can remove at most 1,000 sessions at once")
+	}
+
+	p.ids = make([]zint.Uint128, 0, len(p.Sessions))
+	for _, s := range p.Sessions {
+		id, err := zint.ParseUint128(strings.TrimSpace(s), 16)
+		if err != nil || id.IsZero() {
+			v.Append("sessions", fmt.Sprintf("invalid session ID: %q", s))
+			continue
+		}
+		if !slices.Contains(p.ids, id) {
+			p.ids = append(p.ids, id)
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+type sessionPurgeHit struct {
+	Hit
+	E    zbool.Bool `db:"event"`
+	R    string     `db:"ref"`
+	Size Floats     `db:"size"`
+}
+
+// Run the purge.
+func (p *SessionPurge) Run(ctx context.Context) (SessionPurgeResult, error) {
+	var res SessionPurgeResult
+	err := p.Validate(ctx)
+	if err != nil {
+		return res, errors.Wrap(err, "SessionPurge.Run")
+	}
+
+	site := MustGetSite(ctx)
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		var hits []sessionPurgeHit
+		err := zdb.Select(ctx, &hits, `/* SessionPurge.Run */
+			select
+				hits.*,
+				paths.event,
+				refs.ref,
+				refs.ref_scheme,
+				sizes.size
+			from hits
+			join paths using (path_id)
+			left join refs  using (ref_id)
+			left join sizes using (size_id)
+			where hits.site_id = ? and hits.session in (?)
+			order by hits.created_at asc, hits.hit_id asc`,
+			site.ID, p.ids)
+		if err != nil {
+			return err
+		}
+		if len(hits) == 0 {
+			return nil
+		}
+
+		d := sessionPurgeDecrements{site: site.ID, dec: make(map[string]*sessionPurgeDecrement)}
+		err = d.hits(ctx, site, hits)
+		if err != nil {
+			return err
+		}
+		d.sessions(hits)
+		err = d.exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]int64, 0, len(hits))
+		seen := make(map[zint.Uint128]struct{})
+		for _, h := range hits {
+			ids = append(ids, h.ID)
+			seen[h.Session] = struct{}{}
+		}
+		for c := range slices.Chunk(ids, 5000) {
+			err := zdb.Exec(ctx, `delete from hits where site_id=? and hit_id in (?)`, site.ID, c)
+			if err != nil {
+				return err
+			}
+		}
+		res.Sessions, res.Pageviews = len(seen), len(hits)
+
+		site.ClearCache(ctx, true)
+		return nil
+	})
+	if err != nil {
+		return res, errors.Wrap(err, "SessionPurge.Run")
+	}
+
+	// Don't store the session IDs: that would defeat the point.
+	Audit(ctx, AuditSessionPurge, site.Display(ctx), nil, res)
+	return res, nil
+}
+
+type sessionPurgeDecrement struct {
+	table, col string
+	keys       []any // Column name and value pairs.
+	n          int
+}
+
+type sessionPurgeDecrements struct {
+	site     int64
+	dec      map[string]*sessionPurgeDecrement
+	hitStats map[string]map[int64][]int // day → path_id → per-hour visitors
+}
+
+// add a decrement of n for col in the row identified by keys.
+func (d *sessionPurgeDecrements) add(table, col string, n int, keys ...any) {
+	k := table + "\x00" + col + "\x00" + fmt.Sprint(keys...)
+	if v, ok := d.dec[k]; ok {
+		v.n += n
+		return
+	}
+	d.dec[k] = &sessionPurgeDecrement{table: table, col: col, keys: keys, n: n}
+}
+
+// hits adds the decrements for all the stats that are stored per pageview,
+// mirroring what the cron.update* functions do.
+func (d *sessionPurgeDecrements) hits(ctx context.Context, site *Site, hits []sessionPurgeHit) error {
+	d.hitStats = make(map[string]map[int64][]int)
+	for _, h := range hits {
+		var (
+			t    = h.CreatedAt.UTC()
+			day  = t.Format("2006-01-02")
+			hour = t.Format("2006-01-02 15:00:00")
+		)
+		if h.Bot > 0 {
+			if StatusIsPageview(h.Status) {
+				d.add("bot_stats", "count", 1, "path_id", h.PathID, "day", day, "bot", h.Bot)
+			}
+			continue
+		}
+
+		d.add("hit_counts", "views", 1, "path_id", h.PathID, "hour", hour)
+		if h.Status != 0 {
+			d.add("status_stats", "count", 1, "path_id", h.PathID, "day", day, "status", h.Status)
+		}
+		if !h.FirstVisit {
+			continue
+		}
+
+		refID := h.RefID
+		if name, scheme, ok := site.Settings.RefRules.Canonical(h.R, h.RefScheme); ok {
+			canon := Ref{Ref: name, RefScheme: scheme}
+			err := canon.GetOrInsert(ctx)
+			if err != nil {
+				return err
+			}
+			refID = canon.ID
+		}
+		country, _, _ := strings.Cut(h.Location, "-")
+		var width int
+		var scale float64
+		if len(h.Size) > 0 {
+			width = int(h.Size[0])
+		}
+		if len(h.Size) > 2 {
+			scale = h.Size[2]
+		}
+
+		if d.hitStats[day] == nil {
+			d.hitStats[day] = make(map[int64][]int)
+		}
+		if d.hitStats[day][h.PathID] == nil {
+			d.hitStats[day][h.PathID] = make([]int, 24)
+		}
+		d.hitStats[day][h.PathID][t.Hour()] += 1
+
+		d.add("hit_counts", "total", 1, "path_id", h.PathID, "hour", hour)
+		d.add("ref_counts", "total", 1, "path_id", h.PathID, "ref_id", refID, "hour", hour)
+		d.add("browser_stats", "count", 1, "path_id", h.PathID, "day", day, "browser_id", h.BrowserID)
+		d.add("system_stats", "count", 1, "path_id", h.PathID, "day", day, "system_id", h.SystemID)
+		d.add("location_stats", "count", 1, "path_id", h.PathID, "day", day, "location", h.Location)
+		d.add("location_ref_stats", "count", 1, "path_id", h.PathID, "day", day, "country", country, "ref_id", refID)
+		d.add("language_stats", "count", 1, "path_id", h.PathID, "day", day, "language", ztype.Deref(h.Language, ""))
+		d.add("size_stats", "count", 1, "path_id", h.PathID, "day", day, "width", width)
+		d.add("scale_stats", "count", 1, "path_id", h.PathID, "day", day, "scale", ScaleClass(scale))
+		if width > 0 {
+			d.add("device_stats", "count", 1, "path_id", h.PathID, "day", day, "device", DeviceClass(width, ""))
+		}
+		if h.CampaignID != nil && *h.CampaignID != 0 {
+			d.add("campaign_stats", "count", 1, "path_id", h.PathID, "day", day, "campaign_id", *h.CampaignID, "ref", h.R)
+		}
+	}
+	return nil
+}
+
+// sessions adds the decrements for the session stats; these are stored on the
+// day and path the session started.
+func (d *sessionPurgeDecrements) sessions(hits []sessionPurgeHit) {
+	bySession := make(map[zint.Uint128][]sessionPurgeHit)
+	for _, h := range hits {
+		if h.Bot > 0 || h.E {
+			continue
+		}
+		bySession[h.Session] = append(bySession[h.Session], h)
+	}
+
+	for _, s := range bySession {
+		var (
+			first, last = s[0], s[len(s)-1]
+			day         = first.CreatedAt.UTC().Format("2006-01-02")
+			dur         = last.CreatedAt.Sub(first.CreatedAt)
+		)
+		d.add("session_stats", "sessions", 1, "path_id", first.PathID, "day", day)
+		d.add("session_stats", "pageviews", len(s), "path_id", first.PathID, "day", day)
+		d.add("session_stats", "duration", int(dur/time.Second), "path_id", first.PathID, "day", day)
+		if len(s) == 1 {
+			d.add("session_stats", "bounces", 1, "path_id", first.PathID, "day", day)
+		}
+		d.add("session_durations", "count", 1, "path_id", first.PathID, "day", day, "bucket", SessionDurationBucket(dur))
+		d.add("exit_stats", "exits", 1, "path_id", last.PathID, "day", day)
+	}
+}
+
+func (d *sessionPurgeDecrements) exec(ctx context.Context) error {
+	for _, v := range d.dec {
+		if v.n == 0 {
+			continue
+		}
+		var (
+			where = []string{"site_id = ?"}
+			args  = []any{v.n, v.n, d.site}
+		)
+		for i := 0; i < len(v.keys); i += 2 {
+			where = append(where, v.keys[i].(string)+" = ?")
+			args = append(args, v.keys[i+1])
+		}
+		err := zdb.Exec(ctx, `/* SessionPurge.exec */
+			update `+v.table+` set
+				`+v.col+` = case when `+v.col+` > ? then `+v.col+` - ? else 0 end
+			where `+strings.Join(where, " and "), args...)
+		if err != nil {
+			return errors.Wrapf(err, "decrement %s.%s", v.table, v.col)
+		}
+	}
+
+	for day, paths := range d.hitStats {
+		for pathID, sub := range paths {
+			var stats []string
+			err := zdb.Select(ctx, &stats, `/* SessionPurge.exec */
+				select stats from hit_stats where site_id = ? and path_id = ? and day = ?`,
+				d.site, pathID, day)
+			if err != nil {
+				return errors.Wrap(err, "decrement hit_stats")
+			}
+			if len(stats) == 0 {
+				continue
+			}
+
+			var counts []int
+			zjson.MustUnmarshal([]byte(stats[0]), &counts)
+			for i := range counts {
+				if i < len(sub) {
+					counts[i] = max(counts[i]-sub[i], 0)
+				}
+			}
+			err = zdb.Exec(ctx, `/* SessionPurge.exec */
+				update hit_stats set stats = ? where site_id = ? and path_id = ? and day = ?`,
+				string(zjson.MustMarshal(counts)), d.site, pathID, day)
+			if err != nil {
+				return errors.Wrap(err, "decrement hit_stats")
+			}
+		}
+	}
+	return nil
+}
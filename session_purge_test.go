@@ -0,0 +1,139 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+	"zgo.at/zstd/zjson"
+)
+
+func TestSessionPurge(t *testing.T) {
+	var (
+		sessA = zint.Uint128{1, 1}
+		sessB = zint.Uint128{1, 2}
+		ff    = "Mozilla/5.0 (X11; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0"
+		day   = func(d, h, m int) time.Time { return time.Date(2026, 3, d, h, m, 0, 0, time.UTC) }
+		a     = []Hit{
+			{Session: sessA, Path: "/a", FirstVisit: true, Ref: "https://example.com", UserAgentHeader: ff, Size: Floats{1920, 1080, 1}, Location: "NL", CreatedAt: day(1, 10, 0)},
+			{Session: sessA, Path: "/b", UserAgentHeader: ff, Size: Floats{1920, 1080, 1}, Location: "NL", CreatedAt: day(1, 10, 5)},
+			{Session: sessA, Path: "/a", UserAgentHeader: ff, Size: Floats{1920, 1080, 1}, Location: "NL", CreatedAt: day(1, 10, 20)},
+		}
+		other = []Hit{
+			{Session: sessB, Path: "/a", FirstVisit: true, Ref: "https://example.com", UserAgentHeader: ff, Size: Floats{400, 800, 2}, Location: "NL", CreatedAt: day(1, 10, 2)},
+			{Session: sessB, Path: "/a", UserAgentHeader: ff, Size: Floats{400, 800, 2}, Location: "NL", CreatedAt: day(1, 11, 0)},
+			{Path: "/b", FirstVisit: true, UserAgentHeader: ff, Location: "DE", CreatedAt: day(2, 9, 0)},
+		}
+	)
+
+	tables := map[string]string{
+		"hit_counts":         "total + views",
+		"ref_counts":         "total",
+		"browser_stats":      "count",
+		"system_stats":       "count",
+		"location_stats":     "count",
+		"location_ref_stats": "count",
+		"language_stats":     "count",
+		"size_stats":         "count",
+		"scale_stats":        "count",
+		"device_stats":       "count",
+		"status_stats":       "count",
+		"session_stats":      "sessions + pageviews + duration",
+		"session_durations":  "count",
+		"exit_stats":         "exits",
+		"hit_stats":          "",
+	}
+	// Dump all the stats, ignoring rows that are zero; the lines are sorted as
+	// the row order isn't guaranteed.
+	dump := func(ctx context.Context) string {
+		var lines []string
+		for tbl, expr := range tables {
+			where := expr + " > 0"
+			if tbl == "hit_stats" {
+				where = "stats != '" + string(zjson.MustMarshal(make([]int, 24))) + "'"
+			}
+			lines = append(lines, strings.Split(zdb.DumpString(ctx,
+				`select '`+tbl+`' as t, * from `+tbl+` where `+where), "\n")...)
+		}
+		lines = append(lines, strings.Split(zdb.DumpString(ctx,
+			`select path_id, ref_id, session, first_visit, created_at from hits`), "\n")...)
+		slices.Sort(lines)
+		return strings.Join(lines, "\n")
+	}
+	setup := func(t *testing.T, hits ...Hit) context.Context {
+		ctx := gctest.DB(t)
+		site := MustGetSite(ctx)
+		site.Settings.Collect.Set(CollectHits)
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gctest.StoreHits(ctx, t, false, hits...)
+		return ctx
+	}
+
+	var want string
+	t.Run("want", func(t *testing.T) {
+		want = dump(setup(t, slices.Clone(other)...))
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		ctx := setup(t, append(slices.Clone(a), slices.Clone(other)...)...)
+
+		p := SessionPurge{Sessions: []string{sessA.String(), " " + sessA.String()}}
+		res, err := p.Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != (SessionPurgeResult{Sessions: 1, Pageviews: 3}) {
+			t.Errorf("%#v", res)
+		}
+		if have := dump(ctx); have != want {
+			t.Errorf("\nhave:\n%s\n\nwant:\n%s", have, want)
+		}
+
+		var audit AuditEntries
+		err = zdb.Select(ctx, &audit, `select * from audit_entries where action = ?`, AuditSessionPurge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(audit) != 1 {
+			t.Fatalf("audit entries: %d", len(audit))
+		}
+		if j := string(zjson.MustMarshal(audit[0])); strings.Contains(j, sessA.String()) {
+			t.Errorf("session ID in audit entry: %s", j)
+		}
+
+		// Running it again shouldn't do anything.
+		res, err = p.Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != (SessionPurgeResult{}) {
+			t.Errorf("%#v", res)
+		}
+		if have := dump(ctx); have != want {
+			t.Errorf("\nhave:\n%s\n\nwant:\n%s", have, want)
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		for _, s := range [][]string{nil, {"nope"}, {zint.Uint128{}.String()}} {
+			p := SessionPurge{Sessions: s}
+			if err := p.Validate(ctx); err == nil {
+				t.Errorf("no error for %q", s)
+			}
+		}
+	})
+}
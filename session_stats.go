@@ -0,0 +1,254 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// SessionEntry records where a session started, and how many pageviews it had
+// so far.
+type SessionEntry struct {
+	PathID     int64     `json:"p"` // First path in this session.
+	ExitPathID int64     `json:"e"` // Last path in this session so far.
+	Start      time.Time `json:"s"` // Time of the first pageview.
+	Last       time.Time `json:"l"` // Time of the last pageview.
+	Pageviews  int       `json:"n"` // Number of pageviews, including the current one.
+
+	// Time and path of the last pageview before the current one; used to
+	// update the duration and exit stats.
+	PrevLast       time.Time `json:"-"`
+	PrevExitPathID int64     `json:"-"`
+}
+
+// Add a pageview to the session.
+func (e *SessionEntry) Add(pathID int64, createdAt time.Time) {
+	createdAt = createdAt.UTC()
+	if e.Pageviews == 0 {
+		e.PathID, e.Start, e.Last = pathID, createdAt, createdAt
+	}
+	if e.Last.IsZero() {
+		e.Last = e.Start
+	}
+
+	e.PrevLast, e.PrevExitPathID = e.Last, e.ExitPathID
+	if e.ExitPathID == 0 || !createdAt.Before(e.Last) {
+		e.ExitPathID = pathID
+	}
+	if createdAt.After(e.Last) {
+		e.Last = createdAt
+	}
+	e.Pageviews++
+}
+
+// Duration gets the session duration so far.
+func (e SessionEntry) Duration() time.Duration { return e.Last.Sub(e.Start) }
+
+// PrevDuration gets the session duration before the current pageview.
+func (e SessionEntry) PrevDuration() time.Duration { return e.PrevLast.Sub(e.Start) }
+
+// SessionDurationBuckets are the upper bounds for the session duration
+// histogram, in seconds. Anything longer is put in the last bucket.
+//
+// These values are stored in the database, so don't change them.
+var SessionDurationBuckets = []int{0, 10, 30, 60, 180, 600, 1800, 3600, 86400}
+
+// SessionDurationBucket gets the histogram bucket for this duration.
+func SessionDurationBucket(d time.Duration) int {
+	s := int(d / time.Second)
+	for _, b := range SessionDurationBuckets {
+		if s <= b {
+			return b
+		}
+	}
+	return SessionDurationBuckets[len(SessionDurationBuckets)-1]
+}
+
+// SessionStat are the session statistics for a single day.
+type SessionStat struct {
+	Day       string `db:"day" json:"day"`             // Day these statistics are for {date}.
+	Sessions  int    `db:"sessions" json:"sessions"`   // Number of sessions started on this day.
+	Bounces   int    `db:"bounces" json:"bounces"`     // Sessions with just one pageview.
+	Pageviews int    `db:"pageviews" json:"pageviews"` // Pageviews in these sessions, excluding events.
+	Duration  int    `db:"duration" json:"duration"`   // Total duration of these sessions, in seconds.
+
+	PagesPerVisit float64 `db:"-" json:"pages_per_visit"` // Pageviews ÷ sessions.
+}
+
+// SessionStats is a list of SessionStat
+type SessionStats []SessionStat
+
+// List the session statistics per day, optionally filtered to sessions that
+// started on one of the paths.
+func (s *SessionStats) List(ctx context.Context, rng ztime.Range, pathFilter []int64) error {
+	var st []struct {
+		Day       time.Time `db:"day"`
+		Sessions  int       `db:"sessions"`
+		Bounces   int       `db:"bounces"`
+		Pageviews int       `db:"pageviews"`
+		Duration  int       `db:"duration"`
+	}
+	err := zdb.Select(ctx, &st, `/* SessionStats.List */
+		select
+			day,
+			sum(sessions)  as sessions,
+			sum(bounces)   as bounces,
+			sum(pageviews) as pageviews,
+			sum(duration)  as duration
+		from session_stats
+		where
+			site_id = :site and day >= :start and day <= :end
+			{{:filter and path_id in (:filter)}}
+		group by day
+		order by day asc`, map[string]any{
+		"site":   MustGetSite(ctx).ID,
+		"start":  rng.Start.Format("2006-01-02"),
+		"end":    rng.End.Format("2006-01-02"),
+		"filter": pathFilter,
+	})
+	if err != nil {
+		return errors.Wrap(err, "SessionStats.List")
+	}
+
+	ss := make(SessionStats, 0, len(st))
+	for _, x := range st {
+		ss = append(ss, SessionStat{
+			Day:           x.Day.Format("2006-01-02"),
+			Sessions:      x.Sessions,
+			Bounces:       x.Bounces,
+			Pageviews:     x.Pageviews,
+			Duration:      x.Duration,
+			PagesPerVisit: pagesPerVisit(x.Sessions, x.Pageviews),
+		})
+	}
+	*s = ss
+	return nil
+}
+
+// CountSessions gets the number of sessions that started in this period on one
+// of the paths, and the number of sessions that ended on one of the paths.
+//
+// Without a pathFilter both are the same, as every session has exactly one
+// entry and exit.
+func CountSessions(ctx context.Context, rng ztime.Range, pathFilter []int64) (sessions, exits int, err error) {
+	var (
+		user = MustGetUser(ctx)
+		args = map[string]any{
+			"site":   MustGetSite(ctx).ID,
+			"start":  asUTCDate(user, rng.Start),
+			"end":    asUTCDate(user, rng.End),
+			"filter": pathFilter,
+		}
+	)
+	err = zdb.Get(ctx, &sessions, `/* CountSessions */
+		select coalesce(sum(sessions), 0) from session_stats
+		where
+			site_id = :site and day >= :start and day <= :end
+			{{:filter and path_id in (:filter)}}`, args)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "CountSessions")
+	}
+	err = zdb.Get(ctx, &exits, `/* CountSessions */
+		select coalesce(sum(exits), 0) from exit_stats
+		where
+			site_id = :site and day >= :start and day <= :end
+			{{:filter and path_id in (:filter)}}`, args)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "CountSessions")
+	}
+	return sessions, exits, nil
+}
+
+// SessionDuration is the average and median session duration.
+//
+// This is approximated from the time between the first and last pageview in a
+// session, so sessions with just one pageview have a duration of 0. The median
+// is interpolated from a histogram.
+type SessionDuration struct {
+	Average float64 `json:"average"` // Average duration in seconds.
+	Median  float64 `json:"median"`  // Median duration in seconds.
+}
+
+// GetSessionDuration gets the session duration for sessions that started in
+// this period, optionally filtered to sessions that started on one of the
+// paths.
+func GetSessionDuration(ctx context.Context, rng ztime.Range, pathFilter []int64) (SessionDuration, error) {
+	var (
+		site = MustGetSite(ctx)
+		args = map[string]any{
+			"site":   site.ID,
+			"start":  rng.Start.Format("2006-01-02"),
+			"end":    rng.End.Format("2006-01-02"),
+			"filter": pathFilter,
+		}
+		total struct {
+			Sessions int `db:"sessions"`
+			Duration int `db:"duration"`
+		}
+		buckets []struct {
+			Bucket int `db:"bucket"`
+			Count  int `db:"count"`
+		}
+	)
+	err := zdb.Get(ctx, &total, `/* GetSessionDuration */
+		select
+			coalesce(sum(sessions), 0) as sessions,
+			coalesce(sum(duration), 0) as duration
+		from session_stats
+		where
+			site_id = :site and day >= :start and day <= :end
+			{{:filter and path_id in (:filter)}}`, args)
+	if err != nil {
+		return SessionDuration{}, errors.Wrap(err, "GetSessionDuration")
+	}
+	if total.Sessions == 0 {
+		return SessionDuration{}, nil
+	}
+
+	err = zdb.Select(ctx, &buckets, `/* GetSessionDuration */
+		select bucket, sum(count) as count
+		from session_durations
+		where
+			site_id = :site and day >= :start and day <= :end
+			{{:filter and path_id in (:filter)}}
+		group by bucket
+		order by bucket asc`, args)
+	if err != nil {
+		return SessionDuration{}, errors.Wrap(err, "GetSessionDuration")
+	}
+
+	d := SessionDuration{Average: float64(total.Duration) / float64(total.Sessions)}
+
+	var n int
+	for _, b := range buckets {
+		n += max(b.Count, 0)
+	}
+	var (
+		half = float64(n) / 2
+		seen int
+	)
+	for _, b := range buckets {
+		c := max(b.Count, 0)
+		if c == 0 || float64(seen+c) < half {
+			seen += c
+			continue
+		}
+
+		var lower int
+		for i, x := range SessionDurationBuckets {
+			if x == b.Bucket && i > 0 {
+				lower = SessionDurationBuckets[i-1]
+			}
+		}
+		d.Median = float64(lower) + (half-float64(seen))/float64(c)*float64(b.Bucket-lower)
+		break
+	}
+	return d, nil
+}
@@ -15,11 +15,15 @@ import (
 	"time"
 	"unicode"
 
+	"golang.org/x/text/language"
+	"zgo.at/goatcounter/v2/locale"
 	"zgo.at/json"
 	"zgo.at/tz"
 	"zgo.at/z18n"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztime"
+	"zgo.at/ztpl/tplfunc"
 	"zgo.at/zvalidate"
 )
 
@@ -41,6 +45,8 @@ const (
 	CollectLanguage                      // 64
 	CollectSession                       // 128
 	CollectHits                          // 256
+	CollectLocationCity                  // 512
+	CollectVisitors                      // 1024
 )
 
 // UserSettings.EmailReport values.
@@ -55,6 +61,32 @@ const (
 var EmailReports = []int{EmailReportNever, EmailReportDaily, EmailReportWeekly,
 	EmailReportBiWeekly, EmailReportMonthly}
 
+// Types of email notifications that can be disabled with
+// UserSettings.Notifications.
+//
+// Emails that are needed to use the account or keep it secure (password resets
+// and changes, verifying or changing the email address, invitations) are
+// always sent. The email reports are set with UserSettings.EmailReports.
+const (
+	NotifyAlerts   = "alerts"   // Quota warnings and traffic alerts.
+	NotifyExports  = "exports"  // Export or import finished or failed.
+	NotifySecurity = "security" // Signing in with a backup code.
+)
+
+var NotifyTypes = []string{NotifyAlerts, NotifyExports, NotifySecurity}
+
+// What to remove after the data retention; see SiteSettings.RetentionMode.
+const (
+	RetentionAll        = "all"            // Remove everything.
+	RetentionAggregate  = "aggregate-only" // Remove the raw pageviews, but keep the stats.
+	RetentionAnonymize  = "anonymize"      // Anonymize the raw pageviews, and keep the stats.
+	RetentionDownsample = "downsample"     // Remove the raw pageviews, and roll up the stats per day and later per month.
+)
+
+// DailyRetentionDefault is the default number of days to keep the daily stats
+// for RetentionDownsample; see SiteSettings.DailyRetention.
+const DailyRetentionDefault = 730
+
 type (
 	// SiteSettings contains all the user-configurable settings for a site, with
 	// the exception of the domain settings.
@@ -65,18 +97,63 @@ type (
 		Secret         string         `json:"secret"`
 		AllowCounter   bool           `json:"allow_counter"`
 		AllowBosmang   bool           `json:"allow_bosmang"`
-		DataRetention  int            `json:"data_retention"`
+		DataRetention  int            `json:"data_retention"`  // 0 for instance default, -1 to keep forever.
+		BotRetention   int            `json:"bot_retention"`   // Days to keep the bot stats; 0 for BotRetentionDefault.
+		RetentionMode  string         `json:"retention_mode"`  // What to do after DataRetention; RetentionAll, RetentionAggregate, RetentionAnonymize, or RetentionDownsample.
+		DailyRetention int            `json:"daily_retention"` // Days to keep the daily stats for RetentionDownsample; 0 for DailyRetentionDefault.
 		Campaigns      Strings        `json:"-"`
 		IgnoreIPs      Strings        `json:"ignore_ips"`
+		IPBlock        IPBlock        `json:"ip_block"` // Flag as bot (BotIPBlock), rather than ignoring.
 		Collect        zint.Bitflag16 `json:"collect"`
 		CollectRegions Strings        `json:"collect_regions"`
 		AllowEmbed     Strings        `json:"allow_embed"`
+
+		// Widgets shown on the dashboard if it's viewed without logging in; an
+		// empty list means all widgets are shown.
+		PublicWidgets Strings `json:"public_widgets"`
+
+		// What to do with pageviews from a referrer on the spam list: "drop"
+		// doesn't count them at all, and "flag" counts them with the referrer
+		// marked as spam (RefSchemeSpam).
+		RefSpam string `json:"ref_spam"`
+
+		// Rules to rewrite referrers to a canonical name; these are applied
+		// before the instance-wide and built-in rules.
+		RefRules RefRules `json:"ref_rules"`
+
+		// Flag pageviews with a matching User-Agent header as a bot
+		// (BotUABlock), in addition to the isbot detection.
+		UABlock UABlock `json:"ua_block"`
+
+		// Count pageviews that match as regular pageviews with a label, even
+		// if they're detected as a bot. The IPBlock and UABlock take
+		// precedence.
+		BotAllow BotAllow `json:"bot_allow"`
+
+		// Custom screen width buckets for the sizes widget; the default
+		// buckets are used if this is empty.
+		SizeBuckets SizeBuckets `json:"size_buckets"`
+
+		// Lower-case the path and remove trailing slashes before the query
+		// string when collecting pageviews; see FoldPath().
+		FoldPathCase  bool `json:"fold_path_case"`
+		FoldPathSlash bool `json:"fold_path_slash"`
+	}
+
+	// AccountDefaults are the settings and dashboard defaults that new sites
+	// in an account start with.
+	//
+	// This is stored as JSON in the database.
+	AccountDefaults struct {
+		Settings     SiteSettings `json:"settings"`
+		UserDefaults UserSettings `json:"user_defaults"`
 	}
 
 	// UserSettings are all user preferences.
 	UserSettings struct {
 		TwentyFourHours       bool      `json:"twenty_four_hours"`
-		SundayStartsWeek      bool      `json:"sunday_starts_week"`
+		SundayStartsWeek      bool      `json:"sunday_starts_week"` // Deprecated: use FirstDayOfWeek.
+		FirstDayOfWeek        string    `json:"first_day_of_week"`  // "saturday", "sunday", "monday", or "" for the language default.
 		Language              string    `json:"language"`
 		DateFormat            string    `json:"date_format"`
 		NumberFormat          rune      `json:"number_format"`
@@ -87,6 +164,35 @@ type (
 		FewerNumbers          bool      `json:"fewer_numbers"`
 		FewerNumbersLockUntil time.Time `json:"fewer_numbers_lock_until"`
 		Theme                 string    `json:"theme"`
+
+		// Remember the last-used path filter on the dashboard for every site,
+		// instead of using the filter from the default view.
+		RememberFilter bool `json:"remember_filter"`
+
+		// Email notifications.
+		Notifications Notifications `json:"notifications"`
+
+		// When to send the email reports, in the user's timezone. The weekday
+		// is used for weekly reports ("" for the first day of the week), and
+		// the day of the month for monthly reports (0 for the first day).
+		EmailReportWeekday  string `json:"email_report_weekday"`
+		EmailReportMonthday int    `json:"email_report_monthday"`
+		EmailReportHour     int    `json:"email_report_hour"`
+
+		// Don't email the reports if they're delivered to a webhook.
+		EmailReportsWebhookOnly bool `json:"email_reports_webhook_only"`
+
+		// Send one digest with a section for every site in the account,
+		// instead of a report for just the account's site. Sites in
+		// EmailReportsExclude are left out of the digest.
+		EmailReportsDigest  bool    `json:"email_reports_digest"`
+		EmailReportsExclude []int64 `json:"email_reports_exclude"`
+	}
+
+	// Notifications are the email notification preferences. All notifications
+	// are enabled by default.
+	Notifications struct {
+		Off []string `json:"off"` // Disabled notification types (NotifyTypes).
 	}
 
 	// Widgets is a list of widgets to be printed, in order.
@@ -103,6 +209,9 @@ type (
 		OptionsFunc func(context.Context) [][2]string
 		Validate    func(*zvalidate.Validator, any)
 		Value       any
+
+		// Range for "number" settings; out of range values are clamped.
+		Min, Max float64
 	}
 
 	// Views for the dashboard; these settings apply to all widget and are
@@ -113,9 +222,20 @@ type (
 		Filter string `json:"filter"`
 		Daily  bool   `json:"daily"`
 		Period string `json:"period"` // "week", "week-cur", or n days: "8"
+		Group  string `json:"group"`  // "day", "week", "month", or "" for automatic grouping.
 	}
 )
 
+// ViewPeriods are the named periods for View.Period; it can also be a number of
+// days.
+var ViewPeriods = []string{"day", "week", "month", "quarter", "half-year", "year", "week-cur", "month-cur"}
+
+// Range for the number of rows to load in widgets.
+const minWidgetLimit, maxWidgetLimit = 5, 100
+
+// All widget names, in the default order.
+var widgetNames = []string{"pages", "totalpages", "toprefs", "channels", "campaigns", "browsers", "systems", "locations", "languages", "sizes", "devices", "scales", "statuscodes", "entries", "exits"}
+
 // Default widgets for new sites.
 //
 // This *must* return a list of all configurable widgets; even if it's off by
@@ -125,7 +245,7 @@ type (
 func defaultWidgets(ctx context.Context) Widgets {
 	s := defaultWidgetSettings(ctx)
 	w := Widgets{}
-	for _, n := range []string{"pages", "totalpages", "toprefs", "campaigns", "browsers", "systems", "locations", "languages", "sizes"} {
+	for _, n := range widgetNames {
 		w = append(w, map[string]any{"n": n, "s": s[n].getMap()})
 	}
 	return w
@@ -140,18 +260,16 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
 				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
 				Value: float64(10),
-				Validate: func(v *zvalidate.Validator, val any) {
-					v.Range("limit_pages", int64(val.(float64)), 1, 100)
-				},
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
 			},
 			"limit_refs": WidgetSetting{
 				Type:  "number",
 				Label: z18n.T(ctx, "widget-setting/label/ref-page-size|Referrers page size"),
 				Help:  z18n.T(ctx, "widget-setting/help/ref-page-size|Number of referrers to load when clicking on a path"),
 				Value: float64(10),
-				Validate: func(v *zvalidate.Validator, val any) {
-					v.Range("limit_pages", int64(val.(float64)), 1, 100)
-				},
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
 			},
 			// "compare": WidgetSetting{
 			// 	Type:  "select",
@@ -179,6 +297,22 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 					v.Include("style", val.(string), []string{"line", "bar", "text"})
 				},
 			},
+			"sort": WidgetSetting{
+				Type:  "select",
+				Label: z18n.T(ctx, "widget-setting/label/sort|Sort by"),
+				Help:  z18n.T(ctx, "widget-setting/help/sort|Order of the paths"),
+				Value: SortVisitors,
+				Options: [][2]string{
+					[2]string{SortVisitors, z18n.T(ctx, "widget-settings/sort-visitors|Most visitors")},
+					[2]string{SortViews, z18n.T(ctx, "widget-settings/sort-views|Most pageviews")},
+					[2]string{SortPath, z18n.T(ctx, "widget-settings/sort-path|Path, alphabetically")},
+					[2]string{SortNew, z18n.T(ctx, "widget-settings/sort-new|Recently first seen")},
+					[2]string{SortTrending, z18n.T(ctx, "widget-settings/sort-trending|Trending (growth compared to the previous period)")},
+				},
+				Validate: func(v *zvalidate.Validator, val any) {
+					v.Include("sort", val.(string), Sorts)
+				},
+			},
 		},
 		"totalpages": map[string]WidgetSetting{
 			"align": WidgetSetting{
@@ -213,10 +347,34 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
 				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
 				Value: float64(6),
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
+			},
+			"sort": WidgetSetting{
+				Type:  "select",
+				Label: z18n.T(ctx, "widget-setting/label/sort|Sort by"),
+				Help:  z18n.T(ctx, "widget-setting/help/sort-refs|Order of the referrers"),
+				Value: SortVisitors,
+				Options: [][2]string{
+					[2]string{SortVisitors, z18n.T(ctx, "widget-settings/sort-visitors|Most visitors")},
+					[2]string{SortTrending, z18n.T(ctx, "widget-settings/sort-trending|Trending (growth compared to the previous period)")},
+				},
 				Validate: func(v *zvalidate.Validator, val any) {
-					v.Range("limit", int64(val.(float64)), 1, 20)
+					v.Include("sort", val.(string), []string{SortVisitors, SortTrending})
 				},
 			},
+			"group-domain": WidgetSetting{
+				Type:  "checkbox",
+				Label: z18n.T(ctx, "widget-setting/label/group-domain|Group by domain"),
+				Help:  z18n.T(ctx, "widget-setting/help/group-domain|Group referrers by domain (e.g. all reddit.com links as one); click a domain to show the full referrers. Can't be combined with sorting by trending"),
+				Value: false,
+			},
+			"hide-spam": WidgetSetting{
+				Type:  "checkbox",
+				Label: z18n.T(ctx, "widget-setting/label/hide-spam|Hide flagged spam"),
+				Help:  z18n.T(ctx, "widget-setting/help/hide-spam|Don't show referrers flagged as spam; this only applies if the site is set to flag referrer spam rather than drop it"),
+				Value: true,
+			},
 			"key": WidgetSetting{Hidden: true},
 		},
 		"browsers": map[string]WidgetSetting{
@@ -225,8 +383,21 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
 				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
 				Value: float64(6),
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
+			},
+			"group": WidgetSetting{
+				Type:  "select",
+				Label: z18n.T(ctx, "widget-setting/label/browser-group|Group by"),
+				Help:  z18n.T(ctx, "widget-setting/help/browser-group|Group browsers by name, major version, or full version; clicking a row shows the next level"),
+				Value: BrowserGroupName,
+				Options: [][2]string{
+					[2]string{BrowserGroupName, z18n.T(ctx, "widget-settings/browser-group-name|Browser")},
+					[2]string{BrowserGroupMajor, z18n.T(ctx, "widget-settings/browser-group-major|Browser and major version")},
+					[2]string{BrowserGroupFull, z18n.T(ctx, "widget-settings/browser-group-full|Full version")},
+				},
 				Validate: func(v *zvalidate.Validator, val any) {
-					v.Range("limit", int64(val.(float64)), 1, 20)
+					v.Include("group", val.(string), BrowserGroups)
 				},
 			},
 			"key": WidgetSetting{Hidden: true},
@@ -237,25 +408,62 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
 				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
 				Value: float64(6),
-				Validate: func(v *zvalidate.Validator, val any) {
-					v.Range("limit", int64(val.(float64)), 1, 20)
-				},
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
 			},
 			"key": WidgetSetting{Hidden: true},
 		},
 		"sizes": map[string]WidgetSetting{
 			"key": WidgetSetting{Hidden: true},
 		},
-		"locations": map[string]WidgetSetting{
+		"channels": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
+				Value: float64(6),
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
+			},
+			"key": WidgetSetting{Hidden: true},
+		},
+		"devices": map[string]WidgetSetting{},
+		"scales":  map[string]WidgetSetting{},
+		"statuscodes": map[string]WidgetSetting{
 			"limit": WidgetSetting{
 				Type:  "number",
 				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
 				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
 				Value: float64(6),
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
+			},
+			"key": WidgetSetting{
+				Type:  "select",
+				Label: z18n.T(ctx, "widget-setting/label/status-show|Show"),
+				Help:  z18n.T(ctx, "widget-setting/help/status-show|Show the paths for a status code or class instead of the overview"),
+				Value: "",
+				Options: [][2]string{
+					[2]string{"", z18n.T(ctx, "widget-settings/status-classes|All status classes")},
+					[2]string{"3xx", z18n.T(ctx, "widget-settings/status-3xx|Redirects (3xx)")},
+					[2]string{"404", z18n.T(ctx, "widget-settings/status-404|Top 404 paths")},
+					[2]string{"4xx", z18n.T(ctx, "widget-settings/status-4xx|Client errors (4xx)")},
+					[2]string{"5xx", z18n.T(ctx, "widget-settings/status-5xx|Server errors (5xx)")},
+				},
 				Validate: func(v *zvalidate.Validator, val any) {
-					v.Range("limit", int64(val.(float64)), 1, 20)
+					v.Include("key", val.(string), []string{"", "3xx", "404", "4xx", "5xx"})
 				},
 			},
+		},
+		"locations": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
+				Value: float64(6),
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
+			},
 			"key": WidgetSetting{
 				Type:  "select",
 				Label: z18n.T(ctx, "widget-setting/label/regions|Show regions"),
@@ -282,9 +490,28 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
 				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
 				Value: float64(6),
-				Validate: func(v *zvalidate.Validator, val any) {
-					v.Range("limit", int64(val.(float64)), 1, 20)
-				},
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
+			},
+		},
+		"entries": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
+				Value: float64(6),
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
+			},
+		},
+		"exits": map[string]WidgetSetting{
+			"limit": WidgetSetting{
+				Type:  "number",
+				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
+				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
+				Value: float64(6),
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
 			},
 		},
 		"campaigns": map[string]WidgetSetting{
@@ -293,9 +520,8 @@ func defaultWidgetSettings(ctx context.Context) map[string]WidgetSettings {
 				Label: z18n.T(ctx, "widget-setting/label/page-size|Page size"),
 				Help:  z18n.T(ctx, "widget-setting/help/page-size|Number of pages to load"),
 				Value: float64(6),
-				Validate: func(v *zvalidate.Validator, val any) {
-					v.Range("limit", int64(val.(float64)), 1, 20)
-				},
+				Min:   minWidgetLimit,
+				Max:   maxWidgetLimit,
 			},
 			"key": WidgetSetting{Hidden: true},
 		},
@@ -314,6 +540,17 @@ func (ss *SiteSettings) Scan(v any) error {
 		return fmt.Errorf("SiteSettings.Scan: unsupported type: %T", v)
 	}
 }
+func (d AccountDefaults) Value() (driver.Value, error) { return json.Marshal(d) }
+func (d *AccountDefaults) Scan(v any) error {
+	switch vv := v.(type) {
+	case []byte:
+		return json.Unmarshal(vv, d)
+	case string:
+		return json.Unmarshal([]byte(vv), d)
+	default:
+		return fmt.Errorf("AccountDefaults.Scan: unsupported type: %T", v)
+	}
+}
 func (ss UserSettings) String() string               { return string(zjson.MustMarshal(ss)) }
 func (ss UserSettings) Value() (driver.Value, error) { return json.Marshal(ss) }
 func (ss *UserSettings) Scan(v any) error {
@@ -346,8 +583,17 @@ func (ss *SiteSettings) Defaults(ctx context.Context) {
 	if ss.Public == "" {
 		ss.Public = "private"
 	}
+	if ss.RefSpam == "" {
+		ss.RefSpam = RefSpamDrop
+	}
+	if ss.RetentionMode == "" {
+		ss.RetentionMode = RetentionAll
+	}
 	if ss.Collect == 0 {
-		ss.Collect = CollectReferrer | CollectUserAgent | CollectScreenSize | CollectLocation | CollectLocationRegion | CollectSession
+		ss.Collect = CollectReferrer | CollectUserAgent | CollectScreenSize | CollectLocation | CollectLocationRegion | CollectSession | CollectVisitors
+	}
+	if ss.Collect.Has(CollectLocationCity) { // Cities are shown per region.
+		ss.Collect |= CollectLocationRegion
 	}
 	if ss.Collect.Has(CollectLocationRegion) { // Collecting region without country makes no sense.
 		ss.Collect |= CollectLocation
@@ -366,15 +612,43 @@ func (ss *SiteSettings) Validate(ctx context.Context) error {
 		v.Contains("secret", ss.Secret, []*unicode.RangeTable{zvalidate.AlphaNumeric}, nil)
 	}
 
-	if ss.DataRetention > 0 {
-		v.Range("data_retention", int64(ss.DataRetention), 31, 0)
+	v.Include("ref_spam", ss.RefSpam, []string{RefSpamDrop, RefSpamFlag})
+	if err := ss.RefRules.Validate(); err != nil {
+		v.Append("ref_rules", err.Error())
+	}
+	if err := ss.IPBlock.Validate(); err != nil {
+		v.Append("ip_block", err.Error())
 	}
+	if err := ss.UABlock.Validate(); err != nil {
+		v.Append("ua_block", err.Error())
+	}
+	if err := ss.BotAllow.Validate(); err != nil {
+		v.Append("bot_allow", err.Error())
+	}
+	if err := ss.SizeBuckets.Validate(); err != nil {
+		v.Append("size_buckets", err.Error())
+	}
+	switch c := Config(ctx); {
+	case ss.DataRetention < -1:
+		v.Append("data_retention", "must be -1, 0, or a number of days")
+	case ss.DataRetention == -1 && c.DataRetentionMax > 0:
+		v.Append("data_retention", fmt.Sprintf("data can be kept for at most %d days", c.DataRetentionMax))
+	case ss.DataRetention > 0:
+		v.Range("data_retention", int64(ss.DataRetention), int64(max(31, c.DataRetentionMin)), int64(c.DataRetentionMax))
+	}
+
+	v.Range("bot_retention", int64(ss.BotRetention), 0, BotRetentionMax)
+	v.Include("retention_mode", ss.RetentionMode, []string{RetentionAll, RetentionAggregate, RetentionAnonymize, RetentionDownsample})
+	v.Range("daily_retention", int64(ss.DailyRetention), 0, 100*365)
 
 	if len(ss.IgnoreIPs) > 0 {
 		for _, ip := range ss.IgnoreIPs {
 			v.IP("ignore_ips", ip)
 		}
 	}
+	for _, w := range ss.PublicWidgets {
+		v.Include("public_widgets", w, widgetNames)
+	}
 	if len(ss.AllowEmbed) > 0 {
 		for _, d := range ss.AllowEmbed {
 			if d == "*" {
@@ -388,6 +662,98 @@ func (ss *SiteSettings) Validate(ctx context.Context) error {
 	return v.ErrorOrNil()
 }
 
+// EffectiveDataRetention gets the number of days data is kept for, after
+// applying the instance default and limits. 0 means data is kept forever.
+func (ss SiteSettings) EffectiveDataRetention(ctx context.Context) int {
+	c := Config(ctx)
+	d := ss.DataRetention
+	switch {
+	case d == 0:
+		d = c.DataRetention
+	case d < 0:
+		d = 0
+	}
+	if c.DataRetentionMax > 0 && (d == 0 || d > c.DataRetentionMax) {
+		d = c.DataRetentionMax
+	}
+	if d > 0 && d < c.DataRetentionMin {
+		d = c.DataRetentionMin
+	}
+	return d
+}
+
+// EffectiveBotRetention gets the number of days the bot stats are kept for;
+// this is never longer than the data retention.
+func (ss SiteSettings) EffectiveBotRetention(ctx context.Context) int {
+	d := ss.BotRetention
+	if d <= 0 {
+		d = BotRetentionDefault
+	}
+	if dr := ss.EffectiveDataRetention(ctx); dr > 0 && d > dr {
+		d = dr
+	}
+	return d
+}
+
+// EffectiveDailyRetention gets the number of days the daily stats are kept for
+// with RetentionDownsample; this is never shorter than the data retention.
+func (ss SiteSettings) EffectiveDailyRetention(ctx context.Context) int {
+	d := ss.DailyRetention
+	if d <= 0 {
+		d = DailyRetentionDefault
+	}
+	return max(d, ss.EffectiveDataRetention(ctx))
+}
+
+// KeepsStats reports if the stats are kept forever, and only the raw pageviews
+// are removed or anonymized after the data retention.
+func (ss SiteSettings) KeepsStats() bool {
+	return ss.RetentionMode == RetentionAggregate || ss.RetentionMode == RetentionAnonymize ||
+		ss.RetentionMode == RetentionDownsample
+}
+
+// DownsampleCutoffs gets the dates before which the stats are rolled up per day
+// and per month, or nil if the stats aren't downsampled.
+//
+// The daily cutoff is always at the start of a day, and the monthly one at the
+// start of a month, in UTC.
+func (ss SiteSettings) DownsampleCutoffs(ctx context.Context) (daily, monthly *time.Time) {
+	if ss.RetentionMode != RetentionDownsample {
+		return nil, nil
+	}
+	d := ss.EffectiveDataRetention(ctx)
+	if d == 0 {
+		return nil, nil
+	}
+	now := ztime.Now().UTC()
+	dd := ztime.StartOf(now.AddDate(0, 0, -d), ztime.Day)
+	mm := ztime.StartOf(now.AddDate(0, 0, -ss.EffectiveDailyRetention(ctx)), ztime.Month)
+	return &dd, &mm
+}
+
+// DataRetentionCutoff gets the date before which all data is removed, or nil
+// if data is kept forever.
+//
+// This is always nil if KeepsStats() is true; use RawDataCutoff() to get the
+// date before which the raw pageviews are removed or anonymized.
+func (ss SiteSettings) DataRetentionCutoff(ctx context.Context) *time.Time {
+	if ss.KeepsStats() {
+		return nil
+	}
+	return ss.RawDataCutoff(ctx)
+}
+
+// RawDataCutoff gets the date before which the raw pageviews are removed or
+// anonymized, or nil if they're kept forever.
+func (ss SiteSettings) RawDataCutoff(ctx context.Context) *time.Time {
+	d := ss.EffectiveDataRetention(ctx)
+	if d == 0 {
+		return nil
+	}
+	t := ztime.Now().AddDate(0, 0, -d)
+	return &t
+}
+
 func (ss SiteSettings) CanView(token string) bool {
 	return ss.Public == "public" || (ss.Public == "secret" && token == ss.Secret)
 }
@@ -396,6 +762,12 @@ func (ss SiteSettings) IsPublic() bool {
 	return ss.Public == "public"
 }
 
+// PublicWidget reports if the widget can be shown to users who aren't logged
+// in. The internal "totalcount" widget is always allowed.
+func (ss SiteSettings) PublicWidget(name string) bool {
+	return len(ss.PublicWidgets) == 0 || name == "totalcount" || slices.Contains(ss.PublicWidgets, name)
+}
+
 type CollectFlag struct {
 	Label, Help string
 	Flag        zint.Bitflag16
@@ -414,6 +786,11 @@ func (ss SiteSettings) CollectFlags(ctx context.Context) []CollectFlag {
 			Help:  z18n.T(ctx, "data-collect/help/sessions|%[Track unique visitors] for up to 8 hours; if you disable this then someone pressing e.g. F5 to reload the page will just show as 2 pageviews instead of 1.", z18n.Tag("a", fmt.Sprintf(`href="%s/help/sessions"`, Config(ctx).BasePath))),
 			Flag:  CollectSession,
 		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/visitors|Unique visitors per period"),
+			Help:  z18n.T(ctx, "data-collect/help/visitors|Estimate the number of unique visitors for a week, month, etc. so that someone visiting on several days is counted once. This stores an anonymous statistical summary per day from which individual visitors can’t be recovered. Requires sessions."),
+			Flag:  CollectVisitors,
+		},
 		{
 			Label: z18n.T(ctx, "data-collect/label/referrer|Referrer"),
 			Help:  z18n.T(ctx, "data-collect/help/referrer|Referer header and campaign parameters."),
@@ -439,6 +816,11 @@ func (ss SiteSettings) CollectFlags(ctx context.Context) []CollectFlag {
 			Help:  z18n.T(ctx, "data-collect/help/region|Region, for example Texas, Bali, etc. The details for this differ per country."),
 			Flag:  CollectLocationRegion,
 		},
+		{
+			Label: z18n.T(ctx, "data-collect/label/city|City"),
+			Help:  z18n.T(ctx, "data-collect/help/city|City name, for example Austin, Denpasar, etc. This requires a GeoIP City database, which needs to be configured by the server administrator."),
+			Flag:  CollectLocationCity,
+		},
 		{
 			Label: z18n.T(ctx, "data-collect/label/language|Language"),
 			Help:  z18n.T(ctx, "data-collect/help/language|Supported languages from Accept-Language."),
@@ -454,6 +836,14 @@ func (s *WidgetSettings) Set(k string, v any) {
 	ss[k] = m
 }
 
+// clamp n to the Min and Max for this setting, if set.
+func (s WidgetSetting) clamp(n float64) float64 {
+	if s.Max == 0 {
+		return n
+	}
+	return min(max(n, s.Min), s.Max)
+}
+
 func (s WidgetSettings) getMap() map[string]any {
 	m := make(map[string]any)
 	for k, v := range s {
@@ -525,9 +915,9 @@ func (w Widget) SetSetting(ctx context.Context, widget, setting, value string) e
 	}
 	switch def.Type {
 	case "number":
-		n, _ := strconv.Atoi(value)
-		if n > 0 {
-			s[setting] = float64(n)
+		n, err := strconv.Atoi(value)
+		if err == nil {
+			s[setting] = def.clamp(float64(n))
 		}
 	case "checkbox":
 		s[setting] = value == "on"
@@ -561,6 +951,11 @@ func (w Widget) GetSettings(ctx context.Context) WidgetSettings {
 		for k, v := range s.(map[string]any) {
 			if v != nil {
 				d := def[k]
+				// Stored settings may be out of range if they were saved before
+				// the Min and Max were added.
+				if n, ok := v.(float64); ok && d.Type == "number" {
+					v = d.clamp(n)
+				}
 				d.Value = v
 				def[k] = d
 			}
@@ -596,6 +991,78 @@ func (v Views) Get(name string) (View, int) {
 	return View{}, -1
 }
 
+// Regions where the week starts on Saturday or Sunday, rather than Monday; from
+// the CLDR "firstDay" data.
+var (
+	saturdayRegions = []string{"AE", "AF", "BH", "DJ", "DZ", "EG", "IQ", "IR",
+		"JO", "KW", "LY", "OM", "QA", "SD", "SY"}
+	sundayRegions = []string{"AG", "AS", "BD", "BR", "BS", "BT", "BW", "BZ", "CA",
+		"CO", "DM", "DO", "ET", "GT", "GU", "HK", "HN", "ID", "IL", "IN", "JM",
+		"JP", "KE", "KH", "KR", "LA", "MH", "MM", "MO", "MT", "MX", "MZ", "NI",
+		"NP", "PA", "PE", "PH", "PK", "PR", "PT", "PY", "SA", "SG", "SV", "TH",
+		"TT", "TW", "UM", "US", "VE", "VI", "WS", "YE", "ZA", "ZW"}
+)
+
+// WeekStart gets the first day of the week.
+//
+// This is FirstDayOfWeek if it's set, and the default for the user's language
+// otherwise.
+func (ss UserSettings) WeekStart() time.Weekday {
+	switch ss.FirstDayOfWeek {
+	case "saturday":
+		return time.Saturday
+	case "sunday":
+		return time.Sunday
+	case "monday":
+		return time.Monday
+	}
+	if ss.SundayStartsWeek {
+		return time.Sunday
+	}
+	if ss.Language == "" {
+		return time.Monday
+	}
+
+	region, _ := language.Make(ss.Language).Region()
+	switch {
+	case slices.Contains(saturdayRegions, region.String()):
+		return time.Saturday
+	case slices.Contains(sundayRegions, region.String()):
+		return time.Sunday
+	}
+	return time.Monday
+}
+
+var weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// ReportWeekday gets the day of the week to send weekly reports on.
+//
+// This is EmailReportWeekday if it's set, and WeekStart() otherwise.
+func (ss UserSettings) ReportWeekday() time.Weekday {
+	if i := slices.Index(weekdays, ss.EmailReportWeekday); i > -1 {
+		return time.Weekday(i)
+	}
+	return ss.WeekStart()
+}
+
+// StartOfWeek gets the first day of the week t is in; the time is unchanged.
+func (ss UserSettings) StartOfWeek(t time.Time) time.Time {
+	return t.AddDate(0, 0, -int((7+t.Weekday()-ss.WeekStart())%7))
+}
+
+func (d *AccountDefaults) Defaults(ctx context.Context) {
+	d.Settings.Defaults(ctx)
+	d.UserDefaults.Defaults(ctx)
+	d.Settings.Secret = ""
+}
+
+func (d *AccountDefaults) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Sub("settings", "", d.Settings.Validate(ctx))
+	v.Sub("user_defaults", "", d.UserDefaults.Validate(ctx))
+	return v.ErrorOrNil()
+}
+
 func (ss *UserSettings) Defaults(ctx context.Context) {
 	if ss.Language == "" {
 		ss.Language = "en-GB"
@@ -603,9 +1070,6 @@ func (ss *UserSettings) Defaults(ctx context.Context) {
 	if ss.DateFormat == "" {
 		ss.DateFormat = "2 Jan ’06"
 	}
-	if ss.NumberFormat == 0 {
-		ss.NumberFormat = 0x202f
-	}
 	if ss.Timezone == nil {
 		ss.Timezone = tz.UTC
 	}
@@ -618,11 +1082,55 @@ func (ss *UserSettings) Defaults(ctx context.Context) {
 	}
 }
 
+// Notify reports if emails for this notification type should be sent.
+func (ss UserSettings) Notify(kind string) bool {
+	return !slices.Contains(ss.Notifications.Off, kind)
+}
+
+// InDigest reports if the site is in the email digest.
+func (ss UserSettings) InDigest(siteID int64) bool {
+	return !slices.Contains(ss.EmailReportsExclude, siteID)
+}
+
+// FormatNumber formats a number with the thousands separator from
+// NumberFormat, or in the format for the language if it's 0.
+func (ss UserSettings) FormatNumber(n any) string {
+	if ss.NumberFormat == 0 {
+		return locale.Get(ss.Language).Number(n)
+	}
+	return tplfunc.Number(n, ss.NumberFormat)
+}
+
+// FormatDate formats a date with DateFormat in the user's timezone, using the
+// month and day names for the language. The time is added if withTime is set.
+func (ss UserSettings) FormatDate(t time.Time, withTime bool) string {
+	var (
+		l = locale.Get(ss.Language)
+		d = l.Date(t.In(ss.Timezone.Loc()), ss.DateFormat)
+	)
+	if withTime {
+		d += " " + ss.FormatTime(t)
+	}
+	return d
+}
+
+// FormatTime formats the time of t in the user's timezone.
+func (ss UserSettings) FormatTime(t time.Time) string {
+	return locale.Get(ss.Language).Time(t.In(ss.Timezone.Loc()), ss.TwentyFourHours)
+}
+
 func (ss *UserSettings) Validate(ctx context.Context) error {
 	v := NewValidate(ctx)
 
 	for i, w := range ss.Widgets {
-		for _, s := range w.GetSettings(ctx) {
+		for k, s := range w.GetSettings(ctx) {
+			// Clamp numbers rather than erroring out; it's not very useful to
+			// reject "page size: 200" when we can just use the maximum.
+			if sm, ok := w["s"].(map[string]any); ok && s.Type == "number" {
+				if n, ok := sm[k].(float64); ok {
+					sm[k] = s.clamp(n)
+				}
+			}
 			if s.Validate == nil {
 				continue
 			}
@@ -632,15 +1140,27 @@ func (ss *UserSettings) Validate(ctx context.Context) error {
 		}
 	}
 
-	if _, i := ss.Views.Get("default"); i == -1 || len(ss.Views) != 1 {
+	if view, i := ss.Views.Get("default"); i == -1 || len(ss.Views) != 1 {
 		v.Append("views", z18n.T(ctx, "view not set"))
+	} else {
+		v.Include("views.group", view.Group, []string{"", "day", GroupWeek, GroupMonth})
+		if _, err := strconv.ParseFloat(view.Period, 64); err != nil {
+			v.Include("views.period", view.Period, ViewPeriods)
+		}
 	}
 
 	if !slices.Contains(EmailReports, ss.EmailReports.Int()) {
 		v.Append("email_reports", "invalid value")
 	}
+	for _, n := range ss.Notifications.Off {
+		v.Include("notifications.off", n, NotifyTypes)
+	}
+	v.Include("email_report_weekday", ss.EmailReportWeekday, append([]string{""}, weekdays...))
+	v.Range("email_report_monthday", int64(ss.EmailReportMonthday), 0, 28)
+	v.Range("email_report_hour", int64(ss.EmailReportHour), 0, 23)
 
 	v.Include("theme", ss.Theme, []string{"", "light", "dark"})
+	v.Include("first_day_of_week", ss.FirstDayOfWeek, []string{"", "saturday", "sunday", "monday"})
 
 	return v.ErrorOrNil()
 }
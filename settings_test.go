@@ -0,0 +1,50 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+)
+
+func TestWidgetClamp(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"20", float64(20)},
+		{"0", float64(5)},
+		{"-3", float64(5)},
+		{"500", float64(100)},
+		{"", float64(10)}, // Default
+		{"x", float64(10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			w := NewWidget("pages")
+			err := w.SetSetting(ctx, "pages", "limit_pages", tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := w.GetSetting(ctx, "limit_pages"); have != tt.want {
+				t.Errorf("have %v; want %v", have, tt.want)
+			}
+		})
+	}
+
+	t.Run("stored", func(t *testing.T) {
+		w := Widget{"n": "pages", "s": map[string]any{"limit_pages": float64(1000), "limit_refs": float64(1)}}
+		if have := w.GetSetting(ctx, "limit_pages"); have != float64(100) {
+			t.Errorf("limit_pages: %v", have)
+		}
+		if have := w.GetSetting(ctx, "limit_refs"); have != float64(5) {
+			t.Errorf("limit_refs: %v", have)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// ShareLink gives read-only access to the dashboard for anyone who has the
+// link, without having to log in.
+type ShareLink struct {
+	ID     int64 `db:"share_link_id" json:"-"`
+	SiteID int64 `db:"site_id" json:"-"`
+	UserID int64 `db:"user_id" json:"-"`
+
+	Name  string `db:"name" json:"name"`
+	Token string `db:"token" json:"-"`
+
+	// Always apply this path filter on the dashboard.
+	Filter string `db:"filter" json:"filter"`
+
+	// Link no longer works after this time; nil means it never expires.
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at"`
+	CreatedAt time.Time  `db:"created_at" json:"-"`
+}
+
+// WithShareLink adds the share link to the context.
+func WithShareLink(ctx context.Context, l *ShareLink) context.Context {
+	return context.WithValue(ctx, keyShareLink, l)
+}
+
+// GetShareLink gets the share link the dashboard is viewed with, or nil if it's
+// not viewed with a share link.
+func GetShareLink(ctx context.Context) *ShareLink {
+	l, _ := ctx.Value(keyShareLink).(*ShareLink)
+	return l
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (l *ShareLink) Defaults(ctx context.Context) {
+	l.SiteID = MustGetSite(ctx).ID
+	if l.UserID == 0 {
+		l.UserID = GetUser(ctx).ID
+	}
+	if l.Token == "" {
+		l.Token = zcrypto.Secret256()
+	}
+	if l.CreatedAt.IsZero() {
+		l.CreatedAt = ztime.Now()
+	}
+}
+
+func (l *ShareLink) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("name", l.Name)
+	v.Required("site_id", l.SiteID)
+	v.Required("user_id", l.UserID)
+	v.Required("token", l.Token)
+	v.Len("filter", l.Filter, 0, 500)
+	if l.ExpiresAt != nil && l.ExpiresAt.Before(ztime.Now()) {
+		v.Append("expires_at", "must be in the future")
+	}
+	return v.ErrorOrNil()
+}
+
+// Expired reports if this link has expired.
+func (l ShareLink) Expired() bool {
+	return l.ExpiresAt != nil && !l.ExpiresAt.After(ztime.Now())
+}
+
+// Insert a new row.
+func (l *ShareLink) Insert(ctx context.Context) error {
+	if l.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	l.Defaults(ctx)
+	err := l.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.ID, err = zdb.InsertID(ctx, "share_link_id",
+		`insert into share_links (site_id, user_id, name, token, filter, expires_at, created_at) values (?)`,
+		[]any{l.SiteID, l.UserID, l.Name, l.Token, l.Filter, l.ExpiresAt, l.CreatedAt})
+	return errors.Wrap(err, "ShareLink.Insert")
+}
+
+func (l *ShareLink) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, l, `/* ShareLink.ByID */
+		select * from share_links where share_link_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "ShareLink.ByID %d", id)
+}
+
+// ByToken gets a share link by the token. This will also return expired links.
+func (l *ShareLink) ByToken(ctx context.Context, token string) error {
+	return errors.Wrap(zdb.Get(ctx, l,
+		`/* ShareLink.ByToken */ select * from share_links where token=$1 and site_id=$2`,
+		token, MustGetSite(ctx).ID), "ShareLink.ByToken")
+}
+
+func (l *ShareLink) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* ShareLink.Delete */ delete from share_links where share_link_id=$1 and site_id=$2`,
+		l.ID, MustGetSite(ctx).ID)
+	return errors.Wrapf(err, "ShareLink.Delete %d", l.ID)
+}
+
+type ShareLinks []ShareLink
+
+// List all share links for this site.
+func (l *ShareLinks) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, l,
+		`select * from share_links where site_id=$1 order by created_at desc`,
+		MustGetSite(ctx).ID), "ShareLinks.List")
+}
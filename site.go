@@ -8,14 +8,20 @@ import (
 	"context"
 	"fmt"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
+	"zgo.at/blackmail"
 	"zgo.at/errors"
 	"zgo.at/guru"
+	"zgo.at/json"
 	"zgo.at/zdb"
+	"zgo.at/zlog"
 	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/zjson"
 	"zgo.at/zstd/znet"
 	"zgo.at/zstd/zslice"
 	"zgo.at/zstd/zstring"
@@ -30,8 +36,18 @@ var reserved = []string{
 	"stat", "stats",
 }
 
+// SiteRestoreWindow is how long a deleted site can be restored before it's
+// permanently deleted, and SitePurgeWarning is how long before that an email
+// is sent about it.
+const (
+	SiteRestoreWindow = 14 * 24 * time.Hour
+	SitePurgeWarning  = 7 * 24 * time.Hour
+)
+
 var statTables = []string{"hit_stats", "system_stats", "browser_stats",
-	"location_stats", "language_stats", "size_stats"}
+	"location_stats", "city_stats", "language_stats", "size_stats", "device_stats",
+	"status_stats", "session_stats", "session_durations", "exit_stats", "unknown_ua_stats",
+	"location_ref_stats", "scale_stats", "label_stats"}
 
 type Site struct {
 	ID     int64  `db:"site_id" json:"id,readonly"`
@@ -60,13 +76,49 @@ type Site struct {
 	// pageview.
 	ReceivedData bool `db:"received_data" json:"received_data"`
 
-	// {omitdoc}
-	Notes string `db:"notes" json:"-"`
+	// Tags to organize sites in larger accounts, e.g. "client-x". Tags are
+	// lower-case and can't contain spaces or commas. They're only used for
+	// filtering and have no effect on the data.
+	Tags Strings `db:"tags" json:"tags"`
+
+	// Free-form notes about this site.
+	Notes string `db:"notes" json:"notes"`
 
 	State      string     `db:"state" json:"state"`
 	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
 	UpdatedAt  *time.Time `db:"updated_at" json:"updated_at"`
 	FirstHitAt time.Time  `db:"first_hit_at" json:"first_hit_at"`
+
+	// Monthly pageview quota, set by the instance admin; 0 means there is no
+	// quota. QuotaAction is what to do once it's reached: keep counting or
+	// reject new pageviews.
+	Quota       int    `db:"quota" json:"quota,readonly"`
+	QuotaAction string `db:"quota_action" json:"quota_action,readonly"`
+
+	// Pageviews in the current quota period.
+	QuotaUsed int `db:"quota_used" json:"quota_used,readonly"`
+
+	// Counting was disabled by the instance admin at this time; pageviews are
+	// rejected until it's enabled again.
+	DisabledAt *time.Time `db:"disabled_at" json:"disabled_at,readonly"`
+
+	// {omitdoc} Start of the period QuotaUsed is for, and the highest
+	// percentage a warning was sent for in that period.
+	QuotaPeriod *time.Time `db:"quota_period" json:"-"`
+	// {omitdoc}
+	QuotaWarned int `db:"quota_warned" json:"-"`
+
+	// {omitdoc} When the site was deleted, and the code and cname it had before
+	// that so it can be restored.
+	DeletedAt    *time.Time `db:"deleted_at" json:"-"`
+	DeletedCode  string     `db:"deleted_code" json:"-"`
+	DeletedCname *string    `db:"deleted_cname" json:"-"`
+	// {omitdoc} Email about the permanent deletion was sent.
+	DeletedWarned bool `db:"deleted_warned" json:"-"`
+
+	// {omitdoc} Settings new sites in this account start with; only used on
+	// the account's site, and nil if there are no defaults.
+	AccountDefaults *AccountDefaults `db:"account_defaults" json:"-"`
 }
 
 // ClearCache clears the  cache for this site.
@@ -104,11 +156,104 @@ func (s *Site) Defaults(ctx context.Context) {
 	}
 
 	s.LinkDomain = strings.TrimRight(s.LinkDomain, "/")
+	s.Tags = NormalizeTags(s.Tags)
+	s.Notes = strings.TrimSpace(s.Notes)
 
 	s.Settings.Defaults(ctx)
 	s.UserDefaults.Defaults(ctx)
 }
 
+// MaxSiteTags is the maximum number of tags per site, and MaxTagLen the
+// maximum length of a single tag.
+const (
+	MaxSiteTags = 20
+	MaxTagLen   = 50
+)
+
+// NormalizeTags normalizes a list of tags: tags are trimmed and lower-cased,
+// spaces and commas are replaced with a "-", tags longer than MaxTagLen are
+// cut, and duplicates and empty tags are removed.
+func NormalizeTags(tags []string) Strings {
+	norm := make(Strings, 0, len(tags))
+	for _, t := range tags {
+		t = strings.Join(strings.FieldsFunc(strings.ToLower(t), func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}), "-")
+		if r := []rune(t); len(r) > MaxTagLen {
+			t = string(r[:MaxTagLen])
+		}
+		if t != "" && !slices.Contains(norm, t) {
+			norm = append(norm, t)
+		}
+	}
+	return norm
+}
+
+// HasTag reports if this site has the given tag.
+func (s Site) HasTag(tag string) bool {
+	return slices.Contains(s.Tags, tag)
+}
+
+// CopySettings copies the settings and dashboard defaults (widgets, views) from
+// src, for creating a new site that's set up like an existing one.
+//
+// The custom domain (Cname, LinkDomain), the secret for viewing the dashboard,
+// and the quota are specific to a site and are never copied. Pageviews, API
+// tokens, and users aren't copied either; use Parent to share users.
+func (s *Site) CopySettings(src Site) {
+	s.copySettings(src.Settings, src.UserDefaults)
+}
+
+// ApplyAccountDefaults sets the settings and dashboard defaults from the
+// defaults of account, if it has any.
+//
+// This only copies the values; changing the defaults later doesn't change
+// sites that were already created.
+func (s *Site) ApplyAccountDefaults(account Site) {
+	if account.AccountDefaults != nil {
+		s.copySettings(account.AccountDefaults.Settings, account.AccountDefaults.UserDefaults)
+	}
+}
+
+func (s *Site) copySettings(settings SiteSettings, userDefaults UserSettings) {
+	// Copy through JSON so that no slices or maps are shared with the source.
+	s.Settings, s.UserDefaults = SiteSettings{}, UserSettings{}
+	json.Unmarshal(zjson.MustMarshal(settings), &s.Settings)
+	json.Unmarshal(zjson.MustMarshal(userDefaults), &s.UserDefaults)
+
+	s.Settings.Secret = ""
+	if s.Settings.Public == "secret" {
+		s.Settings.Public = "private"
+	}
+}
+
+// UpdateAccountDefaults sets the defaults for new sites in this account; use
+// nil to remove them.
+func (s *Site) UpdateAccountDefaults(ctx context.Context, d *AccountDefaults) error {
+	if s.ID == 0 {
+		return errors.New("ID == 0")
+	}
+	if s.Parent != nil {
+		return errors.New("Site.UpdateAccountDefaults: not an account")
+	}
+	if d != nil {
+		d.Defaults(ctx)
+		err := d.Validate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := zdb.Exec(ctx, `update sites set account_defaults=?, updated_at=? where site_id=?`,
+		d, ztime.Now(), s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.UpdateAccountDefaults")
+	}
+	s.AccountDefaults = d
+	s.ClearCache(ctx, false)
+	return nil
+}
+
 var noUnderscore = time.Date(2020, 03, 20, 0, 0, 0, 0, time.UTC)
 
 // Validate the object.
@@ -126,6 +271,10 @@ func (s *Site) Validate(ctx context.Context) error {
 	v.Required("state", s.State)
 	v.Include("state", s.State, States)
 	v.URL("link_domain", s.LinkDomain)
+	v.Len("notes", s.Notes, 0, 5000)
+	if len(s.Tags) > MaxSiteTags {
+		v.Append("tags", "can have at most %d tags", MaxSiteTags)
+	}
 
 	v.Sub("settings", "", s.Settings.Validate(ctx))
 	v.Sub("user_defaults", "", s.UserDefaults.Validate(ctx))
@@ -186,15 +335,15 @@ func (s *Site) Insert(ctx context.Context) error {
 	}
 
 	s.ID, err = zdb.InsertID(ctx, "site_id", `insert into sites (
-		parent, code, cname, link_domain, settings, user_defaults, created_at, first_hit_at, cname_setup_at) values (?)`,
-		[]any{s.Parent, s.Code, s.Cname, s.LinkDomain, s.Settings, s.UserDefaults, s.CreatedAt, s.CreatedAt, s.CnameSetupAt})
+		parent, code, cname, link_domain, settings, user_defaults, tags, notes, created_at, first_hit_at, cname_setup_at) values (?)`,
+		[]any{s.Parent, s.Code, s.Cname, s.LinkDomain, s.Settings, s.UserDefaults, s.Tags, s.Notes, s.CreatedAt, s.CreatedAt, s.CnameSetupAt})
 	if err != nil && zdb.ErrUnique(err) {
 		return guru.New(400, "this site already exists: code or domain must be unique")
 	}
 	return errors.Wrap(err, "Site.Insert")
 }
 
-// Update existing site. Sets settings, cname, link_domain.
+// Update existing site. Sets settings, cname, link_domain, tags, notes.
 func (s *Site) Update(ctx context.Context) error {
 	if s.ID == 0 {
 		return errors.New("ID == 0")
@@ -206,8 +355,8 @@ func (s *Site) Update(ctx context.Context) error {
 	}
 
 	err = zdb.Exec(ctx,
-		`update sites set settings=?, user_defaults=?, cname=?, link_domain=?, updated_at=? where site_id=?`,
-		s.Settings, s.UserDefaults, s.Cname, s.LinkDomain, s.UpdatedAt, s.ID)
+		`update sites set settings=?, user_defaults=?, cname=?, link_domain=?, tags=?, notes=?, updated_at=? where site_id=?`,
+		s.Settings, s.UserDefaults, s.Cname, s.LinkDomain, s.Tags, s.Notes, s.UpdatedAt, s.ID)
 	if err != nil {
 		return errors.Wrap(err, "Site.Update")
 	}
@@ -356,13 +505,17 @@ func (s *Site) Delete(ctx context.Context, deleteChildren bool) error {
 		}
 
 		// Update the site code so people can delete a site and then immediately
-		// re-create a new site with the same name.
-		q := `update sites set state=$1, updated_at=$2, code=random(), cname=null where site_id=$3 or parent=$3`
+		// re-create a new site with the same name. The old code and cname are
+		// kept so the site can be restored.
+		rnd := "random()"
 		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
-			q = `update sites set state=$1, updated_at=$2, code=gen_random_uuid(), cname=null where site_id=$3 or parent=$3`
+			rnd = "gen_random_uuid()"
 		}
 		t := ztime.Now()
-		err := zdb.Exec(ctx, q, StateDeleted, t, s.ID)
+		err := zdb.Exec(ctx, `update sites set
+				state=$1, updated_at=$2, deleted_at=$2, deleted_code=code, deleted_cname=cname, deleted_warned=0,
+				code=`+rnd+`, cname=null
+			where site_id=$3 or parent=$3`, StateDeleted, t, s.ID)
 		if err != nil {
 			return errors.Wrap(err, "Site.Delete")
 		}
@@ -371,25 +524,144 @@ func (s *Site) Delete(ctx context.Context, deleteChildren bool) error {
 
 		s.ID = 0
 		s.UpdatedAt = &t
+		s.DeletedAt = &t
 		s.State = StateDeleted
 		return nil
 	})
 }
 
-func (s Site) Undelete(ctx context.Context, id int64) error {
-	s.State = StateActive
-	s.ID = id
-	err := zdb.Exec(ctx, `update sites set state = ? where site_id = ?`, StateActive, id)
+// PurgeAt gets the time a deleted site will be permanently deleted.
+func (s Site) PurgeAt() time.Time {
+	if s.DeletedAt == nil {
+		return ztime.Now()
+	}
+	return s.DeletedAt.Add(SiteRestoreWindow)
+}
+
+// WarnPurge emails the admins of the account that this deleted site will be
+// permanently deleted soon.
+func (s *Site) WarnPurge(ctx context.Context) error {
+	if s.State != StateDeleted || s.DeletedWarned {
+		return nil
+	}
+	l := zlog.Module("vacuum").Fields(zlog.F{"site_id": s.ID})
+
+	var users Users
+	err := users.BySite(ctx, s.IDOrParent())
+	if err != nil {
+		return errors.Wrap(err, "Site.WarnPurge")
+	}
+
+	// The account may be deleted as well, in which case there's no settings
+	// page to restore it from.
+	var account *Site
+	if s.Parent != nil {
+		var a Site
+		err := a.ByIDState(ctx, *s.Parent, StateActive)
+		if err != nil && !zdb.ErrNoRows(err) {
+			return errors.Wrap(err, "Site.WarnPurge")
+		}
+		if err == nil {
+			account = &a
+		}
+	}
+
+	subject := fmt.Sprintf("GoatCounter: %s will be permanently deleted in %d days",
+		s.DisplayDeleted(ctx), int(SitePurgeWarning.Hours()/24))
+	for _, u := range users.Admins() {
+		err := blackmail.Send(subject,
+			blackmail.From("GoatCounter", Config(ctx).EmailFrom),
+			blackmail.To(u.Email),
+			blackmail.HeadersAutoreply(),
+			blackmail.BodyMustText(TplEmailSitePurge{ctx, *s, account, u}.Render))
+		if err != nil {
+			l.Error(err)
+		}
+	}
+
+	s.DeletedWarned = true
+	err = zdb.Exec(ctx, `update sites set deleted_warned=1 where site_id=$1`, s.ID)
+	return errors.Wrap(err, "Site.WarnPurge")
+}
+
+// Restore a soft-deleted site, restoring the code and cname it had before it
+// was deleted.
+func (s *Site) Restore(ctx context.Context) error {
+	if s.ID == 0 {
+		return errors.New("ID == 0")
+	}
+	if s.State != StateDeleted {
+		return guru.New(400, "this site isn't deleted")
+	}
+
+	code := s.Code
+	if s.DeletedCode != "" { // Deleted before the old code was recorded.
+		code = s.DeletedCode
+	}
+	n, err := (Site{ID: s.ID, Code: code}).Exists(ctx)
+	if err == nil && n == 0 && s.DeletedCname != nil {
+		n, err = (Site{ID: s.ID, Cname: s.DeletedCname}).Exists(ctx)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Site.Restore")
+	}
+	if n > 0 {
+		return guru.New(400, "a new site with the same name was added since this site was deleted")
+	}
+
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		// Update first, so this will wait on the row lock if the site is
+		// being vacuumed right now, and then do nothing.
+		err := zdb.Exec(ctx, `update sites set
+				state=$1, updated_at=$2, code=$3, cname=$4,
+				deleted_at=null, deleted_code='', deleted_cname=null, deleted_warned=0
+			where site_id=$5 and state=$6`,
+			StateActive, ztime.Now(), code, s.DeletedCname, s.ID, StateDeleted)
+		if err != nil {
+			return err
+		}
+
+		var ok int
+		err = zdb.Get(ctx, &ok, `select count(*) from sites where site_id=$1 and state=$2`, s.ID, StateActive)
+		if err != nil {
+			return err
+		}
+		if ok == 0 {
+			return guru.New(404, "this site was already permanently deleted")
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("Site.Undelete %d: %w", id, err)
+		return errors.Wrap(err, "Site.Restore")
+	}
+
+	s.ClearCache(ctx, true)
+	return errors.Wrap(s.ByID(ctx, s.ID), "Site.Restore")
+}
+
+// SetDisabled disables or enables counting for this site. This is set by the
+// instance admin, for example for abusive sites.
+func (s *Site) SetDisabled(ctx context.Context, disabled bool) error {
+	if s.ID == 0 {
+		return errors.New("ID == 0")
 	}
 
+	var t *time.Time
+	if disabled {
+		now := ztime.Now()
+		t = &now
+	}
+	err := zdb.Exec(ctx, `update sites set disabled_at=$1 where site_id=$2`, t, s.ID)
+	if err != nil {
+		return errors.Wrap(err, "Site.SetDisabled")
+	}
+	s.DisabledAt = t
 	s.ClearCache(ctx, false)
-	return errors.Wrap(s.ByID(ctx, id), "Site.Undelete")
+	return nil
 }
 
 // Exists checks if this site already exists, based on either the Cname or Code
-// field.
+// field. The Cname is also checked against the additional domains of all sites.
 func (s Site) Exists(ctx context.Context) (int64, error) {
 	var (
 		id     int64
@@ -397,7 +669,11 @@ func (s Site) Exists(ctx context.Context) (int64, error) {
 		params = []any{s.Code, s.ID}
 	)
 	if s.Cname != nil {
-		query = `select site_id from sites where lower(cname) = lower($1) and site_id != $2 limit 1`
+		query = `
+			select site_id from sites where lower(cname) = lower($1) and site_id != $2
+			union
+			select site_id from site_domains where lower(domain) = lower($1)
+			limit 1`
 		params = []any{s.Cname, s.ID}
 	}
 
@@ -456,6 +732,13 @@ func (s *Site) ByHost(ctx context.Context, host string) error {
 		err := zdb.Get(ctx, s,
 			`/* Site.ByHost */ select * from sites where lower(cname)=lower($1) and state=$2`,
 			znet.RemovePort(host), StateActive)
+		if zdb.ErrNoRows(err) {
+			err = zdb.Get(ctx, s, `/* Site.ByHost */
+				select sites.* from site_domains
+				join sites using (site_id)
+				where lower(site_domains.domain)=lower($1) and sites.state=$2`,
+				znet.RemovePort(host), StateActive)
+		}
 		if err != nil {
 			return errors.Wrap(err, "site.ByHost: from custom domain")
 		}
@@ -488,22 +771,44 @@ func (s *Site) Find(ctx context.Context, ident string) error {
 	return errors.Wrap(s.ByHost(ctx, ident), "Site.Find")
 }
 
+// SubSite is a site in the site switcher; Name is the code or cname.
+type SubSite struct {
+	Name string  `db:"name"`
+	Tags Strings `db:"tags"`
+}
+
+type SubSites []SubSite
+
+// Tags gets all tags of the sites, sorted by name.
+func (s SubSites) Tags() []string {
+	var tags []string
+	for _, ss := range s {
+		for _, t := range ss.Tags {
+			if !slices.Contains(tags, t) {
+				tags = append(tags, t)
+			}
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
 // ListSubs lists all subsites, including the current site and parent.
-func (s *Site) ListSubs(ctx context.Context) ([]string, error) {
+func (s *Site) ListSubs(ctx context.Context) (SubSites, error) {
 	col := "cname"
 	if Config(ctx).GoatcounterCom {
 		col = "code"
 	}
-	var codes []string
-	err := zdb.Select(ctx, &codes, `/* Site.ListSubs */
-		select `+col+` from sites
+	var subs SubSites
+	err := zdb.Select(ctx, &subs, `/* Site.ListSubs */
+		select `+col+` as name, tags from sites
 		where state=$1 and (parent=$2 or site_id=$2) or (
 			parent  = (select parent from sites where site_id=$2) or
 			site_id = (select parent from sites where site_id=$2)
 		) and state=$1
 		order by code
 		`, StateActive, s.ID)
-	return codes, errors.Wrap(err, "Site.ListSubs")
+	return subs, errors.Wrap(err, "Site.ListSubs")
 }
 
 // Domain gets the global default domain, or this site's configured custom
@@ -523,6 +828,16 @@ func (s Site) Display(ctx context.Context) string {
 	return fmt.Sprintf("%s.%s", s.Code, znet.RemovePort(Config(ctx).Domain))
 }
 
+// DisplayDeleted is like Display, but uses the code and cname the site had
+// before it was deleted.
+func (s Site) DisplayDeleted(ctx context.Context) string {
+	if s.DeletedCode == "" {
+		return s.Display(ctx)
+	}
+	s.Code, s.Cname = s.DeletedCode, s.DeletedCname
+	return s.Display(ctx)
+}
+
 // URL to this site, without the scheme.
 func (s Site) SchemelessURL(ctx context.Context) string {
 	if s.Cname != nil && s.CnameSetupAt != nil {
@@ -566,7 +881,7 @@ func (s Site) IDOrParent() int64 {
 // user intact.
 func (s Site) DeleteAll(ctx context.Context) error {
 	return zdb.TX(ctx, func(ctx context.Context) error {
-		for _, t := range append(statTables, "campaign_stats", "hit_counts", "ref_counts", "hits", "paths") {
+		for _, t := range append(statTables, "campaign_stats", "visitor_sketches", "ua_block_stats", "bot_stats", "bot_ua_stats", "hit_counts", "ref_counts", "hits", "paths") {
 			err := zdb.Exec(ctx, `delete from `+t+` where site_id=:id`, map[string]any{"id": s.ID})
 			if err != nil {
 				return errors.Wrap(err, "Site.DeleteAll: delete "+t)
@@ -578,6 +893,66 @@ func (s Site) DeleteAll(ctx context.Context) error {
 	})
 }
 
+// AnonymizeOlderThan anonymizes at most limit pageviews older than the given
+// number of days, returning the number of pageviews that were anonymized.
+//
+// This removes the session, browser, system, and the location beyond the
+// country. The path, title, referrer, first visit, and time are kept.
+func (s Site) AnonymizeOlderThan(ctx context.Context, days, limit int) (int, error) {
+	if days < 14 {
+		return 0, errors.Errorf("days must be at least 14: %d", days)
+	}
+
+	var ids []int64
+	err := zdb.Select(ctx, &ids, `/* Site.AnonymizeOlderThan */
+		select hit_id from hits
+		where
+			site_id = ? and created_at < `+Interval(ctx, days)+` and
+			(session is not null or browser_id != 0 or system_id != 0 or length(location) > 2)
+		limit ?`, s.ID, limit)
+	if err != nil || len(ids) == 0 {
+		return 0, errors.Wrap(err, "Site.AnonymizeOlderThan")
+	}
+
+	err = zdb.Exec(ctx, `/* Site.AnonymizeOlderThan */
+		update hits set
+			session = null, browser_id = 0, system_id = 0, location = substr(location, 1, 2)
+		where site_id = ? and hit_id in (?)`, s.ID, ids)
+	if err != nil {
+		return 0, errors.Wrap(err, "Site.AnonymizeOlderThan")
+	}
+	return len(ids), nil
+}
+
+// DeleteHitsOlderThan deletes at most limit raw pageviews older than the given
+// number of days, returning the number of pageviews that were deleted.
+//
+// The stats are left as-is; use DeleteOlderThan to remove those.
+func (s Site) DeleteHitsOlderThan(ctx context.Context, days, limit int) (int, error) {
+	if days < 14 {
+		return 0, errors.Errorf("days must be at least 14: %d", days)
+	}
+
+	var ids []int64
+	err := zdb.Select(ctx, &ids, `/* Site.DeleteHitsOlderThan */
+		select hit_id from hits where site_id = ? and created_at < `+Interval(ctx, days)+` limit ?`,
+		s.ID, limit)
+	if err != nil || len(ids) == 0 {
+		return 0, errors.Wrap(err, "Site.DeleteHitsOlderThan")
+	}
+
+	err = zdb.Exec(ctx, `/* Site.DeleteHitsOlderThan */
+		delete from hits where site_id = ? and hit_id in (?)`, s.ID, ids)
+	if err != nil {
+		return 0, errors.Wrap(err, "Site.DeleteHitsOlderThan")
+	}
+	return len(ids), nil
+}
+
+// DeleteOlderThan deletes all pageviews older than the given number of days.
+//
+// Only the raw pageviews are deleted if the site's RetentionMode is
+// RetentionAggregate or RetentionDownsample; the stats are kept.
 func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 	if days < 14 {
 		return errors.Errorf("days must be at least 14: %d", days)
@@ -586,6 +961,11 @@ func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 	return zdb.TX(ctx, func(ctx context.Context) error {
 		ival := Interval(ctx, days)
 
+		if s.Settings.RetentionMode == RetentionAggregate || s.Settings.RetentionMode == RetentionDownsample {
+			err := zdb.Exec(ctx, `delete from hits where site_id=$1 and created_at < `+ival, s.ID)
+			return errors.Wrap(err, "Site.DeleteOlderThan: delete hits")
+		}
+
 		var pathIDs []int64
 		err := zdb.Select(ctx, &pathIDs, `/* Site.DeleteOlderThan */
 			select path_id from hit_counts where site_id=$1 and hour < `+ival+` group by path_id`, s.ID)
@@ -593,7 +973,7 @@ func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
 			return errors.Wrap(err, "Site.DeleteOlderThan: get paths")
 		}
 
-		for _, t := range append(statTables, "campaign_stats") {
+		for _, t := range append(statTables, "campaign_stats", "visitor_sketches") {
 			err := zdb.Exec(ctx, `delete from `+t+` where site_id=$1 and day < `+ival, s.ID)
 			if err != nil {
 				return errors.Wrap(err, "Site.DeleteOlderThan: delete "+t)
@@ -689,21 +1069,75 @@ func (s *Sites) ForThisAccount(ctx context.Context, excludeCurrent bool) error {
 	return nil
 }
 
-// ContainsCNAME reports if there is a site with this CNAME set.
+// Tagged gets all sites with the given tag.
+func (s Sites) Tagged(tag string) Sites {
+	tagged := make(Sites, 0, len(s))
+	for _, ss := range s {
+		if ss.HasTag(tag) {
+			tagged = append(tagged, ss)
+		}
+	}
+	return tagged
+}
+
+// TagCount is the number of sites with a tag.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// TagSummary gets the number of sites for every tag, sorted by tag name.
+func (s Sites) TagSummary() []TagCount {
+	counts := make(map[string]int)
+	for _, ss := range s {
+		for _, t := range ss.Tags {
+			counts[t]++
+		}
+	}
+	sum := make([]TagCount, 0, len(counts))
+	for t, n := range counts {
+		sum = append(sum, TagCount{Tag: t, Count: n})
+	}
+	slices.SortFunc(sum, func(a, b TagCount) int { return strings.Compare(a.Tag, b.Tag) })
+	return sum
+}
+
+// ContainsCNAME reports if there is a site with this CNAME or additional domain
+// set.
 func (s *Sites) ContainsCNAME(ctx context.Context, cname string) (bool, error) {
 	var ok bool
 	err := zdb.Get(ctx, &ok, `/* Sites.ContainsCNAME */
-		select 1 from sites where lower(cname)=lower($1) limit 1`, cname)
+		select 1 from sites where lower(cname)=lower($1)
+		union
+		select 1 from site_domains where lower(domain)=lower($1)
+		limit 1`, cname)
 	return ok, errors.Wrapf(err, "Sites.ContainsCNAME for %q", cname)
 }
 
-// OldSoftDeleted finds all sites which have been soft-deleted more than a week
-// ago.
+// OldSoftDeleted finds all sites which have been soft-deleted longer than
+// SiteRestoreWindow ago.
 func (s *Sites) OldSoftDeleted(ctx context.Context) error {
-	err := zdb.Select(ctx, s, `select * from sites where state=$1`, StateDeleted)
+	err := zdb.Select(ctx, s, `select * from sites where state=$1 and deleted_at <= $2`,
+		StateDeleted, ztime.Now().Add(-SiteRestoreWindow))
 	return errors.Wrap(err, "Sites.OldSoftDeleted")
 }
 
+// PendingPurge finds all soft-deleted sites that will be permanently deleted
+// within SitePurgeWarning, and for which no email was sent yet.
+func (s *Sites) PendingPurge(ctx context.Context) error {
+	err := zdb.Select(ctx, s, `select * from sites where state=$1 and deleted_warned=0 and deleted_at <= $2`,
+		StateDeleted, ztime.Now().Add(-SiteRestoreWindow+SitePurgeWarning))
+	return errors.Wrap(err, "Sites.PendingPurge")
+}
+
+// ListDeleted lists all soft-deleted sites in this account that can still be
+// restored.
+func (s *Sites) ListDeleted(ctx context.Context) error {
+	err := zdb.Select(ctx, s, `select * from sites where parent=$1 and state=$2 order by deleted_at desc`,
+		MustGetAccount(ctx).ID, StateDeleted)
+	return errors.Wrap(err, "Sites.ListDeleted")
+}
+
 // Find sites: by ID if ident is a number, or by host if it's not.
 func (s *Sites) Find(ctx context.Context, ident []string) error {
 	ids, strs := splitIntStr(ident)
@@ -0,0 +1,158 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
+)
+
+// Status of a custom domain.
+const (
+	DomainPending  = "pending"  // Not checked yet.
+	DomainDNSError = "dns"      // Doesn't point to this server.
+	DomainNoCert   = "no-cert"  // DNS is okay, but there's no certificate (yet).
+	DomainExpiring = "expiring" // Certificate expires in less than a week.
+	DomainOK       = "ok"
+)
+
+// SiteDomain is an additional custom domain for a site, on top of the main one
+// in Site.Cname. Every domain gets an ACME certificate from the renewACME cron
+// task, which also updates the status.
+type SiteDomain struct {
+	ID     int64  `db:"site_domain_id" json:"id,readonly"`
+	SiteID int64  `db:"site_id" json:"-"`
+	Domain string `db:"domain" json:"domain"`
+
+	// Status as of the last check.
+	DNSOK       bool       `db:"dns_ok" json:"dns_ok,readonly"`
+	CertExpires *time.Time `db:"cert_expires" json:"cert_expires,readonly"`
+	CheckedAt   *time.Time `db:"checked_at" json:"checked_at,readonly"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at,readonly"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (d *SiteDomain) Defaults(ctx context.Context) {
+	if d.SiteID == 0 {
+		d.SiteID = MustGetSite(ctx).ID
+	}
+	d.Domain = strings.ToLower(strings.TrimSpace(d.Domain))
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = ztime.Now()
+	}
+}
+
+func (d *SiteDomain) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", d.SiteID)
+	v.Required("domain", d.Domain)
+	v.Len("domain", d.Domain, 4, 255)
+	v.Domain("domain", d.Domain)
+	if Config(ctx).GoatcounterCom && strings.HasSuffix(d.Domain, Config(ctx).Domain) {
+		v.Append("domain", "cannot end with %q", Config(ctx).Domain)
+	}
+
+	if !v.HasErrors() {
+		exists, err := (Site{Cname: &d.Domain}).Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			v.Append("domain", "already exists")
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Status gets the status as of the last check; this is one of the Domain*
+// constants.
+func (d SiteDomain) Status() string {
+	switch {
+	case d.CheckedAt == nil:
+		return DomainPending
+	case !d.DNSOK:
+		return DomainDNSError
+	case d.CertExpires == nil:
+		return DomainNoCert
+	case d.CertExpires.Before(ztime.Now().Add(7 * 24 * time.Hour)):
+		return DomainExpiring
+	default:
+		return DomainOK
+	}
+}
+
+// Insert a new row.
+func (d *SiteDomain) Insert(ctx context.Context) error {
+	if d.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	d.Defaults(ctx)
+	err := d.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.ID, err = zdb.InsertID(ctx, "site_domain_id",
+		`insert into site_domains (site_id, domain, created_at) values (?)`,
+		[]any{d.SiteID, d.Domain, d.CreatedAt})
+	if err != nil {
+		return errors.Wrap(err, "SiteDomain.Insert")
+	}
+	cacheSitesHost(ctx).Flush()
+	return nil
+}
+
+// ByID gets a domain for the current site.
+func (d *SiteDomain) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, d, `/* SiteDomain.ByID */
+		select * from site_domains where site_domain_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "SiteDomain.ByID %d", id)
+}
+
+// UpdateStatus records the result of checking the DNS and certificate.
+func (d *SiteDomain) UpdateStatus(ctx context.Context, dnsOK bool, certExpires *time.Time) error {
+	d.DNSOK, d.CertExpires, d.CheckedAt = dnsOK, certExpires, ztype.Ptr(ztime.Now())
+	err := zdb.Exec(ctx, `update site_domains set dns_ok=$1, cert_expires=$2, checked_at=$3 where site_domain_id=$4`,
+		d.DNSOK, d.CertExpires, d.CheckedAt, d.ID)
+	return errors.Wrapf(err, "SiteDomain.UpdateStatus %d", d.ID)
+}
+
+// Delete this domain. The certificate is removed by the renewACME cron task.
+func (d *SiteDomain) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* SiteDomain.Delete */ delete from site_domains where site_domain_id=$1 and site_id=$2`,
+		d.ID, MustGetSite(ctx).ID)
+	if err != nil {
+		return errors.Wrapf(err, "SiteDomain.Delete %d", d.ID)
+	}
+	cacheSitesHost(ctx).Flush()
+	return nil
+}
+
+type SiteDomains []SiteDomain
+
+// List all domains for this site.
+func (d *SiteDomains) List(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, d,
+		`/* SiteDomains.List */ select * from site_domains where site_id=$1 order by domain`,
+		MustGetSite(ctx).ID), "SiteDomains.List")
+}
+
+// UnscopedList lists the domains for all active sites.
+func (d *SiteDomains) UnscopedList(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, d, `/* SiteDomains.UnscopedList */
+		select site_domains.* from site_domains
+		join sites using (site_id)
+		where sites.state=$1
+		order by site_domain_id`,
+		StateActive), "SiteDomains.UnscopedList")
+}
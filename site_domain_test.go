@@ -0,0 +1,98 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
+)
+
+func TestSiteDomain(t *testing.T) {
+	ctx := gctest.DB(t)
+	site := MustGetSite(ctx)
+
+	d := SiteDomain{Domain: "Stats.Example.com"}
+	err := d.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Domain != "stats.example.com" {
+		t.Errorf("not normalized: %q", d.Domain)
+	}
+	if d.Status() != DomainPending {
+		t.Errorf("status: %q", d.Status())
+	}
+
+	{ // Resolves to the site.
+		var s Site
+		err := s.ByHost(ctx, "stats.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ID != site.ID {
+			t.Errorf("wrong site: %d", s.ID)
+		}
+
+		var sites Sites
+		ok, err := sites.ContainsCNAME(ctx, "stats.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("ContainsCNAME false")
+		}
+	}
+
+	{ // Already in use, as an additional domain or the main cname.
+		other := Site{Code: "other", Cname: ztype.Ptr("other.example.com")}
+		err := other.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dom := range []string{"stats.example.com", "other.example.com"} {
+			err := (&SiteDomain{Domain: dom}).Insert(ctx)
+			if err == nil {
+				t.Errorf("no error for %q", dom)
+			}
+		}
+
+		err = (&Site{Code: "third", Cname: ztype.Ptr("stats.example.com")}).Insert(ctx)
+		if err == nil {
+			t.Error("no error for cname that's an additional domain")
+		}
+	}
+
+	{ // Status.
+		err := d.UpdateStatus(ctx, true, ztype.Ptr(ztime.Now().Add(60*24*time.Hour)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Status() != DomainOK {
+			t.Errorf("status: %q", d.Status())
+		}
+		err = d.UpdateStatus(ctx, true, ztype.Ptr(ztime.Now().Add(2*24*time.Hour)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Status() != DomainExpiring {
+			t.Errorf("status: %q", d.Status())
+		}
+	}
+
+	err = d.Delete(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Site
+	err = s.ByHost(ctx, "stats.example.com")
+	if err == nil {
+		t.Error("still resolves after delete")
+	}
+}
@@ -8,10 +8,15 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	. "zgo.at/goatcounter/v2"
 	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/tz"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztype"
 	"zgo.at/zvalidate"
 )
 
@@ -107,3 +112,284 @@ func TestSiteValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestSiteCopySettings(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	tpl := Site{
+		Parent:     &MustGetSite(ctx).ID,
+		Cname:      ztype.Ptr("tpl.example.com"),
+		LinkDomain: "example.com",
+		Settings: SiteSettings{
+			Public:        "secret",
+			Secret:        "hunter2hunter2",
+			AllowCounter:  true,
+			DataRetention: 60,
+			IgnoreIPs:     Strings{"192.0.2.1"},
+			Collect:       CollectReferrer | CollectSession,
+		},
+		UserDefaults: UserSettings{
+			Widgets:  Widgets{NewWidget("pages"), NewWidget("browsers")},
+			Timezone: tz.MustNew("", "Asia/Makassar"),
+		},
+	}
+	err := tpl.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tpl.ByID(ctx, tpl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp := Site{Parent: &MustGetSite(ctx).ID, Cname: ztype.Ptr("copy.example.com")}
+	cp.CopySettings(tpl)
+	err = cp.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have Site
+	err = have.ByID(ctx, cp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have.Cname == nil || *have.Cname != "copy.example.com" || have.LinkDomain != "" {
+		t.Errorf("domain was copied: %v %q", have.Cname, have.LinkDomain)
+	}
+
+	want := tpl.Settings
+	want.Public, want.Secret = "private", ""
+	if d := ztest.Diff(zjson.MustMarshalString(have.Settings), zjson.MustMarshalString(want), ztest.DiffJSON); d != "" {
+		t.Error("settings:\n" + d)
+	}
+	if d := ztest.Diff(zjson.MustMarshalString(have.UserDefaults), zjson.MustMarshalString(tpl.UserDefaults), ztest.DiffJSON); d != "" {
+		t.Error("user_defaults:\n" + d)
+	}
+
+	// Make sure nothing is shared with the original.
+	cp.Settings.IgnoreIPs[0] = "192.0.2.2"
+	if tpl.Settings.IgnoreIPs[0] != "192.0.2.1" {
+		t.Error("IgnoreIPs shared with original")
+	}
+}
+
+func TestSiteAccountDefaults(t *testing.T) {
+	ctx := gctest.DB(t)
+	account := MustGetAccount(ctx)
+
+	newSite := func(t *testing.T, cname string) Site {
+		t.Helper()
+		s := Site{Parent: &account.ID, Cname: ztype.Ptr(cname)}
+		s.ApplyAccountDefaults(*account)
+		err := s.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.ByID(ctx, s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	before := newSite(t, "before.example.com")
+	wita := tz.MustNew("", "Asia/Makassar")
+
+	err := account.UpdateAccountDefaults(ctx, &AccountDefaults{
+		Settings: SiteSettings{
+			IgnoreIPs: Strings{"192.0.2.1"},
+			Collect:   CollectReferrer | CollectSession,
+		},
+		UserDefaults: UserSettings{
+			Widgets:  Widgets{NewWidget("pages"), NewWidget("browsers")},
+			Timezone: wita,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = account.ByID(ctx, account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.AccountDefaults == nil {
+		t.Fatal("AccountDefaults not stored")
+	}
+
+	after := newSite(t, "after.example.com")
+
+	if len(after.Settings.IgnoreIPs) != 1 || after.Settings.IgnoreIPs[0] != "192.0.2.1" ||
+		after.Settings.Collect != CollectReferrer|CollectSession {
+		t.Errorf("settings not applied: %s", after.Settings)
+	}
+	if after.UserDefaults.Timezone.String() != wita.String() || len(after.UserDefaults.Widgets) != 2 {
+		t.Errorf("user_defaults not applied: %s", after.UserDefaults)
+	}
+
+	// Existing sites aren't changed.
+	err = before.ByID(ctx, before.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before.Settings.IgnoreIPs) != 0 || before.UserDefaults.Timezone.String() == wita.String() {
+		t.Errorf("existing site changed:\n%s\n%s", before.Settings, before.UserDefaults)
+	}
+
+	// Removing the defaults.
+	err = account.UpdateAccountDefaults(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = account.ByID(ctx, account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.AccountDefaults != nil {
+		t.Errorf("not removed: %v", account.AccountDefaults)
+	}
+	if s := newSite(t, "removed.example.com"); len(s.Settings.IgnoreIPs) != 0 {
+		t.Errorf("defaults still applied: %s", s.Settings)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want Strings
+	}{
+		{nil, Strings{}},
+		{[]string{"", " "}, Strings{}},
+		{[]string{" Client-X ", "client-x", "blog"}, Strings{"client-x", "blog"}},
+		{[]string{"two words", "a,b"}, Strings{"two-words", "a-b"}},
+		{[]string{strings.Repeat("ü", 60)}, Strings{strings.Repeat("ü", MaxTagLen)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.in), func(t *testing.T) {
+			have := NormalizeTags(tt.in)
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestSiteTags(t *testing.T) {
+	ctx := gctest.DB(t)
+	account := MustGetAccount(ctx)
+
+	for i, tags := range []Strings{{"Client-X", "blog"}, {"client-x"}, nil} {
+		s := Site{Parent: &account.ID, Cname: ztype.Ptr(fmt.Sprintf("tag%d.example.com", i)), Tags: tags}
+		err := s.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sites Sites
+	err := sites.ForThisAccount(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := len(sites.Tagged("client-x")); have != 2 {
+		t.Errorf("Tagged: %d", have)
+	}
+	have := sites.TagSummary()
+	want := []TagCount{{"blog", 1}, {"client-x", 2}}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+
+	s := sites.Tagged("blog")[0]
+	s.Tags, s.Notes = Strings{"other"}, " Some notes "
+	err = s.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ByID(ctx, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Tags, Strings{"other"}) || s.Notes != "Some notes" {
+		t.Errorf("%#v %q", s.Tags, s.Notes)
+	}
+
+	s.Tags = make(Strings, MaxSiteTags+1)
+	for i := range s.Tags {
+		s.Tags[i] = fmt.Sprintf("t%d", i)
+	}
+	err = s.Update(ctx)
+	if err == nil || !strings.Contains(err.Error(), "at most") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestSiteRestore(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	s := Site{Parent: &MustGetSite(ctx).ID, Code: "restore-me"}
+	err := s.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := s.ID
+	err = s.Delete(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted Sites
+	err = deleted.ListDeleted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != id || deleted[0].DeletedCode != "restore-me" {
+		t.Fatalf("wrong deleted list: %v", deleted)
+	}
+	if have := deleted[0].DisplayDeleted(ctx); !strings.HasPrefix(have, "restore-me.") {
+		t.Errorf("DisplayDeleted: %q", have)
+	}
+
+	// Not old enough to vacuum yet.
+	var old Sites
+	err = old.OldSoftDeleted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 0 {
+		t.Errorf("OldSoftDeleted: %v", old)
+	}
+
+	err = deleted[0].Restore(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have Site
+	err = have.ByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Code != "restore-me" || have.State != StateActive || have.DeletedAt != nil {
+		t.Errorf("wrong site after restore: %#v", have)
+	}
+
+	// Code was re-used after deleting.
+	err = have.Delete(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&Site{Parent: &MustGetSite(ctx).ID, Code: "restore-me"}).Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted = nil
+	err = deleted.ListDeleted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deleted[0].Restore(ctx)
+	if err == nil {
+		t.Fatal("no error restoring site with re-used code")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
+)
+
+// SiteTransferExpire is how long a site transfer can be accepted.
+const SiteTransferExpire = 7 * 24 * time.Hour
+
+// SiteTransfer moves a site to another account; it needs to be accepted by an
+// owner of the other account.
+//
+// There are no plans or other per-account limits: the only limit is the quota,
+// which is stored on the site and moves with it. So there's nothing to check
+// on the receiving account.
+type SiteTransfer struct {
+	ID        int64 `db:"site_transfer_id" json:"-"`
+	SiteID    int64 `db:"site_id" json:"-"`    // Site that's transferred.
+	AccountID int64 `db:"account_id" json:"-"` // Account it's transferred from.
+	UserID    int64 `db:"user_id" json:"-"`    // Started by.
+
+	// Email of an owner of the account the site is transferred to.
+	Email string `db:"email" json:"email"`
+	Token string `db:"token" json:"-"`
+
+	// Set once the transfer is accepted; it can only be used once.
+	AcceptedAt *time.Time `db:"accepted_at" json:"accepted_at"`
+	ExpiresAt  time.Time  `db:"expires_at" json:"expires_at"`
+	CreatedAt  time.Time  `db:"created_at" json:"-"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (t *SiteTransfer) Defaults(ctx context.Context) {
+	t.AccountID = MustGetSite(ctx).IDOrParent()
+	if t.UserID == 0 {
+		t.UserID = GetUser(ctx).ID
+	}
+	if t.Token == "" {
+		t.Token = zcrypto.Secret192()
+	}
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = ztime.Now()
+	}
+	if t.ExpiresAt.IsZero() {
+		t.ExpiresAt = t.CreatedAt.Add(SiteTransferExpire)
+	}
+}
+
+func (t *SiteTransfer) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", t.SiteID)
+	v.Required("account_id", t.AccountID)
+	v.Required("user_id", t.UserID)
+	v.Required("token", t.Token)
+	v.Required("email", t.Email)
+	v.Len("email", t.Email, 5, 255)
+	v.Email("email", t.Email)
+
+	if t.ID == 0 && t.SiteID > 0 {
+		var s Site
+		err := s.ByID(ctx, t.SiteID)
+		if err != nil && !zdb.ErrNoRows(err) {
+			return err
+		}
+		switch {
+		case zdb.ErrNoRows(err) || s.IDOrParent() != t.AccountID:
+			v.Append("site_id", "no such site")
+		case s.Parent == nil:
+			v.Append("site_id", "can't transfer the main site of an account")
+		}
+
+		var n int
+		err = zdb.Get(ctx, &n, `select count(*) from site_transfers
+			where site_id=$1 and accepted_at is null and expires_at > $2`,
+			t.SiteID, ztime.Now())
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			v.Append("site_id", "already has a pending transfer")
+		}
+	}
+
+	// Don't check if Email is an owner of another account here, as that would
+	// reveal which addresses have an account; the email just isn't sent.
+	return v.ErrorOrNil()
+}
+
+// Expired reports if this transfer has expired.
+func (t SiteTransfer) Expired() bool {
+	return !t.ExpiresAt.After(ztime.Now())
+}
+
+// Targets gets all accounts the site can be transferred to: those where Email
+// is an owner, other than the account the site is in now.
+func (t SiteTransfer) Targets(ctx context.Context) (Sites, error) {
+	var users Users
+	err := users.ByEmail(ctx, t.Email)
+	if err != nil {
+		return nil, errors.Wrap(err, "SiteTransfer.Targets")
+	}
+
+	var targets Sites
+	for _, u := range users.Owners() {
+		if u.Site == t.AccountID {
+			continue
+		}
+		var s Site
+		err := s.ByID(ctx, u.Site)
+		if err != nil {
+			if zdb.ErrNoRows(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "SiteTransfer.Targets")
+		}
+		targets = append(targets, s)
+	}
+	return targets, nil
+}
+
+// Insert a new row.
+func (t *SiteTransfer) Insert(ctx context.Context) error {
+	if t.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	t.Defaults(ctx)
+	err := t.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	t.ID, err = zdb.InsertID(ctx, "site_transfer_id",
+		`insert into site_transfers (site_id, account_id, user_id, email, token, expires_at, created_at) values (?)`,
+		[]any{t.SiteID, t.AccountID, t.UserID, t.Email, t.Token, t.ExpiresAt, t.CreatedAt})
+	return errors.Wrap(err, "SiteTransfer.Insert")
+}
+
+// ByID gets a transfer from this account.
+func (t *SiteTransfer) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, t, `/* SiteTransfer.ByID */
+		select * from site_transfers where site_transfer_id=$1 and account_id=$2`,
+		id, MustGetSite(ctx).IDOrParent()), "SiteTransfer.ByID %d", id)
+}
+
+// ByToken gets a transfer by the token. This will also return expired and
+// accepted transfers.
+func (t *SiteTransfer) ByToken(ctx context.Context, token string) error {
+	return errors.Wrap(zdb.Get(ctx, t,
+		`/* SiteTransfer.ByToken */ select * from site_transfers where token=$1`,
+		token), "SiteTransfer.ByToken")
+}
+
+// Accept this transfer, moving the site to the current account.
+//
+// The current user must be an owner with the email the transfer was sent to.
+// Users of the old account lose access, and share links for the site are
+// removed as they were created by the old account.
+func (t *SiteTransfer) Accept(ctx context.Context) (*Site, error) {
+	if t.AcceptedAt != nil {
+		return nil, guru.New(403, "this transfer has already been accepted")
+	}
+	if t.Expired() {
+		return nil, guru.New(403, "this transfer has expired")
+	}
+
+	var (
+		user    = MustGetUser(ctx)
+		account = MustGetAccount(ctx)
+	)
+	if !user.AccessOwner() || !strings.EqualFold(user.Email, t.Email) {
+		return nil, guru.Errorf(403, "this transfer can only be accepted by %s", t.Email)
+	}
+	if account.ID == t.AccountID {
+		return nil, guru.New(400, "this site is already in this account")
+	}
+
+	var site Site
+	err := site.ByID(ctx, t.SiteID)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return nil, guru.New(404, "this site no longer exists")
+		}
+		return nil, errors.Wrap(err, "SiteTransfer.Accept")
+	}
+	if site.Parent == nil || *site.Parent != t.AccountID {
+		return nil, guru.New(403, "this site was moved to another account")
+	}
+
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		// Mark as accepted first, so the transfer can't be used twice if two
+		// requests come in at the same time.
+		t.AcceptedAt = ztype.Ptr(ztime.Now())
+		var n int
+		err := zdb.Get(ctx, &n, `select count(*) from site_transfers where site_transfer_id=$1 and accepted_at is null`, t.ID)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return guru.New(403, "this transfer has already been accepted")
+		}
+		err = zdb.Exec(ctx, `update site_transfers set accepted_at=$1 where site_transfer_id=$2`, t.AcceptedAt, t.ID)
+		if err != nil {
+			return err
+		}
+
+		site.Parent = &account.ID
+		err = zdb.Exec(ctx, `update sites set parent=$1, updated_at=$2 where site_id=$3`,
+			site.Parent, ztime.Now(), site.ID)
+		if err != nil {
+			return err
+		}
+
+		// Remove per-site access from the old account's users.
+		var users Users
+		err = users.BySite(ctx, t.AccountID)
+		if err != nil {
+			return err
+		}
+		k := strconv.FormatInt(site.ID, 10)
+		for _, u := range users {
+			if _, ok := u.Access[k]; !ok {
+				continue
+			}
+			delete(u.Access, k)
+			err := zdb.Exec(ctx, `update users set access=$1 where user_id=$2`, u.Access, u.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = zdb.Exec(ctx, `delete from share_links where site_id=$1`, site.ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `delete from site_transfers where site_id=$1 and accepted_at is null`, site.ID)
+	})
+	if err != nil {
+		t.AcceptedAt = nil
+		return nil, errors.Wrap(err, "SiteTransfer.Accept")
+	}
+
+	site.ClearCache(ctx, true)
+	return &site, nil
+}
+
+// Delete (cancel) this transfer.
+func (t *SiteTransfer) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* SiteTransfer.Delete */ delete from site_transfers where site_transfer_id=$1 and account_id=$2`,
+		t.ID, MustGetSite(ctx).IDOrParent())
+	return errors.Wrapf(err, "SiteTransfer.Delete %d", t.ID)
+}
+
+type SiteTransfers []SiteTransfer
+
+// ListPending lists all transfers from this account that haven't been accepted
+// yet, including expired ones.
+func (t *SiteTransfers) ListPending(ctx context.Context) error {
+	return errors.Wrap(zdb.Select(ctx, t,
+		`select * from site_transfers where account_id=$1 and accepted_at is null order by created_at desc`,
+		MustGetSite(ctx).IDOrParent()), "SiteTransfers.ListPending")
+}
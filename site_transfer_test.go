@@ -0,0 +1,162 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/ztime"
+	"zgo.at/zstd/ztype"
+)
+
+func TestSiteTransfer(t *testing.T) {
+	// Returns the context for the account the site is transferred from, the
+	// account it's transferred to, and the transfer.
+	setup := func(t *testing.T) (context.Context, context.Context, SiteTransfer) {
+		t.Helper()
+		ctx := gctest.DB(t)
+
+		child := Site{Code: "child", Parent: ztype.Ptr(MustGetSite(ctx).ID)}
+		err := child.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := gctest.Site(ctx, t, nil, &User{Email: "other@example.com"})
+
+		tr := SiteTransfer{SiteID: child.ID, Email: "other@example.com"}
+		err = tr.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx, other, tr
+	}
+
+	t.Run("accept", func(t *testing.T) {
+		ctx, other, tr := setup(t)
+
+		s, err := tr.Accept(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Parent == nil || *s.Parent != MustGetSite(other).ID {
+			t.Errorf("wrong parent: %v", s.Parent)
+		}
+
+		var got Site
+		err = got.ByID(ctx, tr.SiteID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Parent == nil || *got.Parent != MustGetSite(other).ID {
+			t.Errorf("wrong parent in DB: %v", got.Parent)
+		}
+
+		var pending SiteTransfers
+		err = pending.ListPending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("still pending: %v", pending)
+		}
+	})
+
+	t.Run("reuse", func(t *testing.T) {
+		_, other, tr := setup(t)
+		stale := tr
+
+		_, err := tr.Accept(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tr.Accept(other)
+		if err == nil {
+			t.Fatal("accepted twice")
+		}
+		_, err = stale.Accept(other)
+		if err == nil {
+			t.Fatal("accepted twice with stale transfer")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, other, tr := setup(t)
+
+		ztime.SetNow(t, ztime.Now().Add(SiteTransferExpire+time.Minute).Format("2006-01-02 15:04:05"))
+		if !tr.Expired() {
+			t.Fatal("not expired")
+		}
+		_, err := tr.Accept(other)
+		if err == nil {
+			t.Fatal("accepted expired transfer")
+		}
+	})
+
+	t.Run("wrong user", func(t *testing.T) {
+		ctx, _, tr := setup(t)
+		third := gctest.Site(ctx, t, nil, &User{Email: "third@example.com"})
+
+		_, err := tr.Accept(third)
+		if err == nil {
+			t.Fatal("accepted by wrong user")
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		ctx := gctest.DB(t)
+
+		tests := []struct {
+			tr   SiteTransfer
+			want string
+		}{
+			// Main site of the account.
+			{SiteTransfer{SiteID: MustGetSite(ctx).ID, Email: "other@example.com"}, "site_id"},
+			// Invalid email.
+			{SiteTransfer{SiteID: MustGetSite(ctx).ID, Email: "nobody"}, "email"},
+		}
+		gctest.Site(ctx, t, nil, &User{Email: "other@example.com"})
+
+		for _, tt := range tests {
+			t.Run("", func(t *testing.T) {
+				err := tt.tr.Insert(ctx)
+				if err == nil {
+					t.Fatal("no error")
+				}
+				if !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("wrong error: %s", err)
+				}
+			})
+		}
+	})
+
+	t.Run("no account", func(t *testing.T) {
+		ctx := gctest.DB(t)
+		child := Site{Code: "child", Parent: ztype.Ptr(MustGetSite(ctx).ID)}
+		err := child.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Accepted so it doesn't reveal if the address has an account, but
+		// there's nobody to send it to.
+		tr := SiteTransfer{SiteID: child.ID, Email: "nobody@example.com"}
+		err = tr.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets, err := tr.Targets(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(targets) != 0 {
+			t.Errorf("targets: %v", targets)
+		}
+	})
+}
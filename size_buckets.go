@@ -0,0 +1,160 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SizeBucket is a named group of screen widths, for the sizes widget.
+//
+// Below is the exclusive upper bound in CSS pixels; it's 0 for the last bucket,
+// which has all widths from the previous bound and up.
+type SizeBucket struct {
+	Below int
+	Name  string
+
+	err error
+}
+
+// SizeBuckets is an ordered list of SizeBucket, stored as one "<width name" per
+// line, e.g.:
+//
+//	<640  Phone
+//	<1024 Tablet
+//	≥1024 Desktop
+//
+// The last line may be just the name. An empty list uses the default buckets.
+//
+// Only the screen widths are stored in size_stats, and the buckets are applied
+// when listing the stats, so changing them applies to all existing stats.
+type SizeBuckets []SizeBucket
+
+func (b SizeBucket) String() string {
+	if b.Below == 0 {
+		return b.Name
+	}
+	return "<" + strconv.Itoa(b.Below) + " " + b.Name
+}
+
+func (l SizeBuckets) String() string {
+	s := make([]string, 0, len(l))
+	for _, b := range l {
+		s = append(s, b.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+func (l SizeBuckets) Value() (driver.Value, error)  { return l.String(), nil }
+func (l SizeBuckets) MarshalText() ([]byte, error)  { return []byte(l.String()), nil }
+func (l *SizeBuckets) UnmarshalText(v []byte) error { return l.Scan(v) }
+
+// Scan the buckets; this never returns an error, so that a bad bucket doesn't
+// prevent loading the settings. Use Validate() to check the buckets.
+func (l *SizeBuckets) Scan(v any) error {
+	if v == nil {
+		return nil
+	}
+
+	var (
+		lines   = strings.Split(fmt.Sprintf("%s", v), "\n")
+		buckets = make(SizeBuckets, 0, len(lines))
+		prev    int
+	)
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var b SizeBucket
+		switch {
+		case line[0] == '<':
+			w, n, _ := strings.Cut(strings.TrimSpace(line[1:]), " ")
+			b.Name = strings.TrimSpace(n)
+			var err error
+			b.Below, err = strconv.Atoi(w)
+			if err != nil || b.Below <= 0 {
+				b.err = fmt.Errorf("%q: invalid width %q", line, w)
+			}
+			prev = b.Below
+		case strings.HasPrefix(line, "≥"), strings.HasPrefix(line, ">="):
+			line = strings.TrimLeft(line, "≥>=")
+			w, n, _ := strings.Cut(strings.TrimSpace(line), " ")
+			b.Name = strings.TrimSpace(n)
+			if x, err := strconv.Atoi(w); err != nil || x != prev {
+				b.err = fmt.Errorf("%q: must be the same as the previous width (%d)", line, prev)
+			}
+		default:
+			b.Name = line
+		}
+		if b.err == nil && b.Name == "" {
+			b.err = fmt.Errorf("%q: must be as \"<width name\"", line)
+		}
+		buckets = append(buckets, b)
+	}
+	*l = buckets
+	return nil
+}
+
+// Validate the buckets: the widths must be ascending, the names unique, and
+// only the last bucket can be without an upper bound.
+func (l SizeBuckets) Validate() error {
+	if len(l) == 0 {
+		return nil
+	}
+
+	var (
+		prev  int
+		names = make(map[string]struct{})
+	)
+	for i, b := range l {
+		if b.err != nil {
+			return b.err
+		}
+		if _, ok := names[strings.ToLower(b.Name)]; ok {
+			return fmt.Errorf("%q: name used more than once", b.Name)
+		}
+		names[strings.ToLower(b.Name)] = struct{}{}
+
+		last := i == len(l)-1
+		switch {
+		case last && b.Below != 0:
+			return fmt.Errorf("%q: the last bucket must have no width, or \"≥%d\"", b.String(), b.Below)
+		case !last && b.Below == 0:
+			return fmt.Errorf("%q: only the last bucket can have no width", b.String())
+		case !last && b.Below <= prev:
+			return fmt.Errorf("%q: widths must be ascending", b.String())
+		}
+		prev = b.Below
+	}
+	return nil
+}
+
+// bucket gets the bucket for this screen width; the width must be >0.
+func (l SizeBuckets) bucket(width int) int {
+	for i, b := range l {
+		if b.Below == 0 || width < b.Below {
+			return i
+		}
+	}
+	return len(l) - 1
+}
+
+// bounds gets the lower (inclusive) and upper (exclusive) widths for the
+// bucket with the given name; the upper bound is 0 for the last bucket.
+func (l SizeBuckets) bounds(name string) (int, int, bool) {
+	var prev int
+	for _, b := range l {
+		if b.Name == name {
+			return prev, b.Below, true
+		}
+		prev = b.Below
+	}
+	return 0, 0, false
+}
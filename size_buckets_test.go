@@ -0,0 +1,94 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zstd/zjson"
+	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
+)
+
+func TestSizeBucketsValidate(t *testing.T) {
+	tests := []struct {
+		in, want, wantErr string
+	}{
+		{"", "", ""},
+		{"<640 Phone\n<1024 Tablet\n≥1024 Desktop", "<640 Phone\n<1024 Tablet\nDesktop", ""},
+		{"  <640 Phone\n\n# Comment\n  Rest  ", "<640 Phone\nRest", ""},
+		{"<640 Phone\n>=640 Rest", "<640 Phone\nRest", ""},
+
+		{"<640 Phone", "", `"<640 Phone": the last bucket must have no width, or "≥640"`},
+		{"<640 Phone\nTablet\nDesktop", "", `"Tablet": only the last bucket can have no width`},
+		{"<1024 Tablet\n<640 Phone\nDesktop", "", `"<640 Phone": widths must be ascending`},
+		{"<640 Phone\n<1024 Phone\nDesktop", "", `"Phone": name used more than once`},
+		{"<640 Phone\n≥1000 Desktop", "", `"1000 Desktop": must be the same as the previous width (640)`},
+		{"<x Phone\nDesktop", "", `"<x Phone": invalid width "x"`},
+		{"<640\nDesktop", "", `"<640": must be as "<width name"`},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var b SizeBuckets
+			b.Scan(tt.in)
+			err := b.Validate()
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr == "" && b.String() != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSizeBucketsList(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	now := ztime.Now()
+	for _, w := range []float64{0, 300, 639, 640, 1023, 1024, 3000} {
+		gctest.StoreHits(ctx, t, false, Hit{CreatedAt: now, Size: []float64{w, 0, 1}, FirstVisit: true})
+	}
+
+	site := MustGetSite(ctx)
+	site.Settings.SizeBuckets.Scan("<640 Phone\n<1024 Tablet\n≥1024 Desktop")
+
+	var s HitStats
+	err := s.ListSizes(ctx, ztime.NewRange(now).To(now), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+		"more": false,
+		"stats": [
+			{"count": 2, "id": "Phone",   "name": "Phone"},
+			{"count": 2, "id": "Tablet",  "name": "Tablet"},
+			{"count": 2, "id": "Desktop", "name": "Desktop"},
+			{"count": 1, "id": "unknown", "name": ""}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(s), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+
+	s = HitStats{}
+	err = s.ListSize(ctx, "Tablet", ztime.NewRange(now).To(now), nil, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{
+		"more": false,
+		"stats": [
+			{"count": 1, "name": "↔︎ 1023px"},
+			{"count": 1, "name": "↔︎ 640px"}
+		]
+	}`
+	if d := ztest.Diff(zjson.MustMarshalString(s), want, ztest.DiffJSON); d != "" {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/goatcounter/v2/metrics"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/ztime"
+)
+
+// SlowQuery is a query that took longer than the slow query threshold; queries
+// are grouped by the normalized SQL.
+type SlowQuery struct {
+	Query  string        // Normalized SQL, without parameters.
+	Caller string        // Caller of the last slow run, from WithQueryCaller().
+	Count  int           // Number of slow runs.
+	Max    time.Duration // Longest run.
+	Total  time.Duration // Total of all slow runs.
+	Last   time.Time     // Last slow run.
+}
+
+var (
+	keyQueryCaller = &struct{ n string }{""}
+
+	slowQueries = struct {
+		sync.Mutex
+		m map[string]*SlowQuery
+	}{m: make(map[string]*SlowQuery)}
+
+	reSlowString = regexp.MustCompile(`'(?:[^']|'')*'`)
+	reSlowNumber = regexp.MustCompile(`(^|[^\w$])\d+(\.\d+)?\b`)
+	reSlowSpace  = regexp.MustCompile(`\s+`)
+)
+
+// WithQueryCaller sets the name of what's running queries, such as the widget
+// or endpoint, which is recorded for slow queries.
+func WithQueryCaller(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, keyQueryCaller, name)
+}
+
+// GetQueryCaller gets the caller set with WithQueryCaller(), or "" if there is
+// none.
+func GetQueryCaller(ctx context.Context) string {
+	n, _ := ctx.Value(keyQueryCaller).(string)
+	return n
+}
+
+type slowQueryDB struct {
+	zdb.DB
+	threshold time.Duration
+}
+
+// NewSlowQueryDB returns a DB that logs queries that take longer than
+// threshold, and records them for ListSlowQueries(). The db is returned as-is if
+// threshold is 0.
+//
+// Only Exec(), Get(), Select(), and InsertID() are timed; queries in
+// transactions aren't.
+func NewSlowQueryDB(db zdb.DB, threshold time.Duration) zdb.DB {
+	if threshold <= 0 {
+		return db
+	}
+	return &slowQueryDB{DB: db, threshold: threshold}
+}
+
+func (db *slowQueryDB) Exec(ctx context.Context, query string, params ...any) error {
+	start := time.Now()
+	err := db.DB.Exec(ctx, query, params...)
+	db.record(ctx, query, time.Since(start))
+	return err
+}
+
+func (db *slowQueryDB) Get(ctx context.Context, dest any, query string, params ...any) error {
+	start := time.Now()
+	err := db.DB.Get(ctx, dest, query, params...)
+	db.record(ctx, query, time.Since(start))
+	return err
+}
+
+func (db *slowQueryDB) Select(ctx context.Context, dest any, query string, params ...any) error {
+	start := time.Now()
+	err := db.DB.Select(ctx, dest, query, params...)
+	db.record(ctx, query, time.Since(start))
+	return err
+}
+
+func (db *slowQueryDB) InsertID(ctx context.Context, idColumn, query string, params ...any) (int64, error) {
+	start := time.Now()
+	id, err := db.DB.InsertID(ctx, idColumn, query, params...)
+	db.record(ctx, query, time.Since(start))
+	return id, err
+}
+
+func (db *slowQueryDB) record(ctx context.Context, query string, took time.Duration) {
+	if took < db.threshold {
+		return
+	}
+
+	var (
+		caller = GetQueryCaller(ctx)
+		q      = normalizeQuery(query)
+	)
+	zlog.Module("slow-query").Fields(zlog.F{
+		"caller": caller,
+		"took":   took.Round(time.Millisecond).String(),
+	}).Printf("slow query: %s", q)
+
+	tag := "slow-query"
+	if caller != "" {
+		tag += "·" + caller
+	}
+	metrics.Add(tag, took)
+
+	slowQueries.Lock()
+	defer slowQueries.Unlock()
+	s, ok := slowQueries.m[q]
+	if !ok {
+		s = &SlowQuery{Query: q}
+		slowQueries.m[q] = s
+	}
+	s.Caller = caller
+	s.Count++
+	s.Total += took
+	s.Last = ztime.Now()
+	if took > s.Max {
+		s.Max = took
+	}
+}
+
+// normalizeQuery replaces literal strings and numbers with "?" and collapses
+// whitespace, so that queries only differing in their parameters are grouped.
+// Placeholders such as $1 are kept.
+func normalizeQuery(query string) string {
+	query = reSlowString.ReplaceAllString(query, "?")
+	query = reSlowNumber.ReplaceAllString(query, "${1}?")
+	return strings.TrimSpace(reSlowSpace.ReplaceAllString(query, " "))
+}
+
+// ListSlowQueries lists all slow queries since startup, sorted by the given
+// column: "count", "max", or "total".
+func ListSlowQueries(by string) []SlowQuery {
+	slowQueries.Lock()
+	l := make([]SlowQuery, 0, len(slowQueries.m))
+	for _, s := range slowQueries.m {
+		l = append(l, *s)
+	}
+	slowQueries.Unlock()
+
+	sort.Slice(l, func(i, j int) bool {
+		switch by {
+		case "count":
+			if l[i].Count != l[j].Count {
+				return l[i].Count > l[j].Count
+			}
+		case "total":
+			if l[i].Total != l[j].Total {
+				return l[i].Total > l[j].Total
+			}
+		}
+		if l[i].Max != l[j].Max {
+			return l[i].Max > l[j].Max
+		}
+		return l[i].Query < l[j].Query
+	})
+	return l
+}
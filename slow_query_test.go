@@ -0,0 +1,51 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+	"time"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/zdb"
+)
+
+func TestSlowQueryDB(t *testing.T) {
+	ctx := gctest.DB(t)
+	db := zdb.MustGetDB(ctx)
+
+	if NewSlowQueryDB(db, 0) != db {
+		t.Fatal("wrapped DB with a threshold of 0")
+	}
+
+	ctx = zdb.WithDB(ctx, NewSlowQueryDB(db, time.Nanosecond))
+	ctx = WithQueryCaller(ctx, "test:slow")
+
+	var n int
+	err := zdb.Get(ctx, &n, "select   count(*)\n\tfrom sites where site_id > 42 and cname <> 'x''y'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zdb.Get(ctx, &n, "select count(*) from sites where site_id > 43 and cname <> 'z'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "select count(*) from sites where site_id > ? and cname <> ?"
+	var found bool
+	for _, q := range ListSlowQueries("count") {
+		if q.Query != want {
+			continue
+		}
+		found = true
+		if q.Count != 2 || q.Caller != "test:slow" || q.Max == 0 || q.Total < q.Max {
+			t.Errorf("wrong values: %+v", q)
+		}
+	}
+	if !found {
+		t.Fatalf("%q not in list:\n%v", want, ListSlowQueries("max"))
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/z18n"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// StatusIsPageview reports if a hit with this HTTP status code should be
+// counted as a pageview.
+//
+// Only hits imported from logfiles have a status code; 0 means there isn't one
+// (e.g. from the JavaScript integration). Redirects, errors, etc. are only
+// counted in status_stats and aren't stored in the hits table.
+func StatusIsPageview(status int) bool {
+	return status == 0 || (status >= 200 && status <= 299) || status == 304
+}
+
+// StatusClass gets the class for the status code, e.g. "4xx" for 404.
+func StatusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func statusClassName(ctx context.Context, class string) string {
+	switch class {
+	case "1xx":
+		return z18n.T(ctx, "label/status-1xx|Informational")
+	case "2xx":
+		return z18n.T(ctx, "label/status-2xx|Success")
+	case "3xx":
+		return z18n.T(ctx, "label/status-3xx|Redirect")
+	case "4xx":
+		return z18n.T(ctx, "label/status-4xx|Client error")
+	case "5xx":
+		return z18n.T(ctx, "label/status-5xx|Server error")
+	}
+	return ""
+}
+
+// HasStatusStats reports if there are any status code stats for the site.
+func HasStatusStats(ctx context.Context) (bool, error) {
+	var n int
+	err := zdb.Get(ctx, &n, `select count(*) from (
+		select 1 from status_stats where site_id = :site limit 1
+	) x`, map[string]any{"site": MustGetSite(ctx).ID})
+	return n > 0, errors.Wrap(err, "HasStatusStats")
+}
+
+// ListStatusClasses lists the number of requests for every status class (2xx,
+// 3xx, etc.), ordered by class.
+func (h *HitStats) ListStatusClasses(ctx context.Context, rng ztime.Range, pathFilter []int64) error {
+	user := MustGetUser(ctx)
+	var rows []struct {
+		Status int `db:"status"`
+		Count  int `db:"count"`
+	}
+	err := zdb.Select(ctx, &rows, "load:hit_stats.ListStatusClasses", map[string]any{
+		"site":   MustGetSite(ctx).ID,
+		"start":  asUTCDate(user, rng.Start),
+		"end":    asUTCDate(user, rng.End),
+		"filter": pathFilter,
+	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListStatusClasses")
+	}
+
+	h.Stats = h.Stats[:0]
+	for _, r := range rows { // Ordered by status.
+		c := StatusClass(r.Status)
+		if len(h.Stats) == 0 || h.Stats[len(h.Stats)-1].ID != c {
+			h.Stats = append(h.Stats, HitStat{ID: c, Name: c + " " + statusClassName(ctx, c)})
+		}
+		h.Stats[len(h.Stats)-1].Count += r.Count
+	}
+	return nil
+}
+
+// ListStatus lists the paths for a status class (e.g. "4xx") or a single status
+// code (e.g. "404").
+//
+// For a class the name is "status path" (e.g. "404 /missing"), and for a
+// status code it's just the path.
+func (h *HitStats) ListStatus(ctx context.Context, id string, rng ztime.Range, pathFilter []int64, limit, offset int) error {
+	var minStatus, maxStatus int
+	if c, ok := strings.CutSuffix(id, "xx"); ok {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 || n > 5 {
+			return errors.Errorf("HitStats.ListStatus: invalid value for id: %#v", id)
+		}
+		minStatus, maxStatus = n*100, n*100+99
+	} else {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 100 || n > 599 {
+			return errors.Errorf("HitStats.ListStatus: invalid value for id: %#v", id)
+		}
+		minStatus, maxStatus = n, n
+	}
+
+	user := MustGetUser(ctx)
+	var rows []struct {
+		Status int    `db:"status"`
+		Path   string `db:"path"`
+		Count  int    `db:"count"`
+	}
+	err := zdb.Select(ctx, &rows, "load:hit_stats.ListStatus", map[string]any{
+		"site":   MustGetSite(ctx).ID,
+		"start":  asUTCDate(user, rng.Start),
+		"end":    asUTCDate(user, rng.End),
+		"filter": pathFilter,
+		"min":    minStatus,
+		"max":    maxStatus,
+		"limit":  limit + 1,
+		"offset": offset,
+	})
+	if err != nil {
+		return errors.Wrap(err, "HitStats.ListStatus")
+	}
+	if len(rows) > limit {
+		h.More = true
+		rows = rows[:len(rows)-1]
+	}
+
+	h.Stats = make([]HitStat, 0, len(rows))
+	for _, r := range rows {
+		name := r.Path
+		if minStatus != maxStatus {
+			name = fmt.Sprintf("%d %s", r.Status, r.Path)
+		}
+		h.Stats = append(h.Stats, HitStat{Name: name, Count: r.Count})
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/boombuler/barcode/qr"
 	"github.com/russross/blackfriday/v2"
 	"zgo.at/errors"
+	"zgo.at/goatcounter/v2/locale"
 	"zgo.at/z18n"
 	"zgo.at/zhttp"
 	"zgo.at/zlog"
@@ -52,6 +53,9 @@ func init() {
 		return time.Since(t).Round(time.Second)
 	})
 
+	tplfunc.Add("seconds", func(s float64) time.Duration {
+		return (time.Duration(s) * time.Second).Round(time.Second)
+	})
 	tplfunc.Add("round_duration", func(d time.Duration) time.Duration {
 		if d < time.Millisecond {
 			return d
@@ -215,6 +219,7 @@ func init() {
 			{href: "export", label: "Export format"},
 			{href: "sessions", label: "Sessions and visitors"},
 			{href: "api", label: "API"},
+			{href: "webhooks", label: "Report webhooks"},
 			{href: "faq", label: "FAQ"},
 			{href: "translating", label: "Translating GoatCounter"}}},
 		{label: "Legal", items: []x{
@@ -287,16 +292,7 @@ func init() {
 	})
 
 	tplfunc.Add("dformat", func(t time.Time, withTime bool, u User) string {
-		f := u.Settings.DateFormat
-		if withTime {
-			if u.Settings.TwentyFourHours {
-				f += " 15:04"
-			} else {
-				f += " 03:04"
-			}
-		}
-
-		return t.In(u.Settings.Timezone.Loc()).Format(f)
+		return u.Settings.FormatDate(t, withTime)
 	})
 
 	tplfunc.Add("path_id", func(p string) string {
@@ -312,10 +308,10 @@ func init() {
 		if fmt == "" {
 			fmt = "2006-01-02"
 		}
-		return t.In(u.Settings.Timezone.Loc()).Format(fmt)
+		return locale.Get(u.Settings.Language).Date(t.In(u.Settings.Timezone.Loc()), fmt)
 	})
 	tplfunc.Add("nformat", func(n any, u User) string {
-		return tplfunc.Number(n, u.Settings.NumberFormat)
+		return u.Settings.FormatNumber(n)
 	})
 
 	tplfunc.Add("totp_barcode", func(email, s string) template.HTML {
@@ -467,6 +463,19 @@ func HorizontalChart(ctx context.Context, stats HitStats, total int, link, pagin
 				`<sup class="go"><a rel="noopener" target="_blank" href="http://%s">visit</a></sup>`,
 				name)
 		}
+		if s.RefScheme != nil && string(*s.RefScheme) == *RefSchemeSpam {
+			visit = `<sup class="spam"><i>` + z18n.T(ctx, "spam-paren|(spam)") + `</i></sup>`
+		}
+		if s.Growth != nil {
+			switch {
+			case s.New:
+				visit += `<sup class="trend"><i>` + z18n.T(ctx, "new-paren|(new)") + `</i></sup>`
+			case *s.Growth > 0:
+				visit += fmt.Sprintf(`<sup class="trend plus">+%d%%</sup>`, *s.Growth)
+			case *s.Growth < 0:
+				visit += fmt.Sprintf(`<sup class="trend minus">–%d%%</sup>`, -*s.Growth)
+			}
+		}
 
 		if strings.HasPrefix(name, "twitter.com/search?q=") {
 			if i := strings.LastIndex(name, "t.co%2F"); i > -1 {
@@ -487,7 +496,7 @@ func HorizontalChart(ctx context.Context, stats HitStats, total int, link, pagin
 
 		ncol := ""
 		if !user.Settings.FewerNumbers {
-			ncol = tplfunc.Number(s.Count, user.Settings.NumberFormat)
+			ncol = user.Settings.FormatNumber(s.Count)
 		}
 
 		id := s.ID
@@ -539,12 +548,47 @@ type (
 		Site    Site
 		User    User
 	}
+	TplEmailChangeConfirm struct { // Sent to the new address.
+		Context context.Context
+		Site    Site
+		Change  EmailChange
+	}
+	TplEmailChangeNotify struct { // Sent to the old address.
+		Context context.Context
+		Site    Site
+		Change  EmailChange
+	}
+	TplEmailBackupCode struct {
+		Context   context.Context
+		Site      Site
+		User      User
+		Remaining int
+	}
+	TplEmailPasswordChanged struct {
+		Context context.Context
+		Site    Site
+		User    User
+	}
 	TplEmailAddUser struct {
 		Context context.Context
 		Site    Site
 		NewUser User
 		AddedBy string
 	}
+	TplEmailInvite struct {
+		Context   context.Context
+		Site      Site
+		Invite    Invite
+		InvitedBy string
+		Existing  bool
+	}
+	TplEmailSiteTransfer struct {
+		Context   context.Context
+		Site      Site // Site that's transferred.
+		Account   Site // Account it's transferred to.
+		Transfer  SiteTransfer
+		StartedBy string
+	}
 	TplEmailImportError struct {
 		Context context.Context
 		Error   error
@@ -561,6 +605,47 @@ type (
 		Rows    int
 		Errors  *errors.Group
 	}
+	TplEmailQuota struct {
+		Context context.Context
+		Site    Site
+		User    User
+		Percent int
+	}
+	TplEmailSitePurge struct {
+		Context context.Context
+		Site    Site
+		Account *Site // nil if the account is deleted as well.
+		User    User
+	}
+	TplEmailAlert struct {
+		Context  context.Context
+		Site     Site
+		User     User
+		Rule     AlertRule
+		Check    AlertCheck
+		Test     bool
+		Resolved bool
+	}
+	TplEmailWebhookDisabled struct {
+		Context context.Context
+		Site    Site
+		User    User
+		Webhook Webhook
+		Error   string
+	}
+	TplEmailSiteWarning struct {
+		Context context.Context
+		Site    Site
+		User    User
+		Message string // Uses a generic message if empty.
+	}
+	TplEmailRetentionDelay struct {
+		Context context.Context
+		Site    Site
+		User    User
+		Preview RetentionPreview
+		Until   time.Time
+	}
 )
 
 var tplE = ztpl.ExecuteBytes
@@ -570,6 +655,27 @@ func (t TplEmailForgotSite) Render() ([]byte, error)    { return tplE("email_for
 func (t TplEmailPasswordReset) Render() ([]byte, error) { return tplE("email_password_reset.gotxt", t) }
 func (t TplEmailVerify) Render() ([]byte, error)        { return tplE("email_verify.gotxt", t) }
 func (t TplEmailAddUser) Render() ([]byte, error)       { return tplE("email_adduser.gotxt", t) }
+func (t TplEmailChangeConfirm) Render() ([]byte, error) { return tplE("email_change_confirm.gotxt", t) }
+func (t TplEmailChangeNotify) Render() ([]byte, error)  { return tplE("email_change_notify.gotxt", t) }
+func (t TplEmailBackupCode) Render() ([]byte, error)    { return tplE("email_backup_code.gotxt", t) }
+func (t TplEmailInvite) Render() ([]byte, error)        { return tplE("email_invite.gotxt", t) }
+func (t TplEmailSiteTransfer) Render() ([]byte, error)  { return tplE("email_site_transfer.gotxt", t) }
 func (t TplEmailImportError) Render() ([]byte, error)   { return tplE("email_import_error.gotxt", t) }
 func (t TplEmailExportDone) Render() ([]byte, error)    { return tplE("email_export_done.gotxt", t) }
 func (t TplEmailImportDone) Render() ([]byte, error)    { return tplE("email_import_done.gotxt", t) }
+func (t TplEmailQuota) Render() ([]byte, error)         { return tplE("email_quota.gotxt", t) }
+func (t TplEmailSitePurge) Render() ([]byte, error)     { return tplE("email_site_purge.gotxt", t) }
+func (t TplEmailSiteWarning) Render() ([]byte, error)   { return tplE("email_site_warning.gotxt", t) }
+func (t TplEmailAlert) Render() ([]byte, error)         { return tplE("email_alert.gotxt", t) }
+
+func (t TplEmailWebhookDisabled) Render() ([]byte, error) {
+	return tplE("email_webhook_disabled.gotxt", t)
+}
+
+func (t TplEmailRetentionDelay) Render() ([]byte, error) {
+	return tplE("email_retention_delay.gotxt", t)
+}
+
+func (t TplEmailPasswordChanged) Render() ([]byte, error) {
+	return tplE("email_password_changed.gotxt", t)
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"zgo.at/errors"
 	. "zgo.at/goatcounter/v2"
@@ -25,6 +26,7 @@ func TestTpl(t *testing.T) {
 	ctx := gctest.Context(nil)
 	site := Site{Code: "example"}
 	user := User{Email: "a@example.com", EmailToken: sp("T-EMAIL"), LoginRequest: sp("T-LOGIN-REQ")}
+	deletedAt := time.Date(2020, 6, 18, 14, 42, 0, 0, time.UTC)
 
 	files, _ := fs.Sub(os.DirFS(zgo.ModuleRoot()), "tpl")
 	err := ztpl.Init(files)
@@ -51,6 +53,22 @@ func TestTpl(t *testing.T) {
 		{TplEmailImportDone{ctx, site, 42, errors.NewGroup(10)}},
 		{TplEmailImportDone{ctx, site, 42, errs}},
 		{TplEmailAddUser{ctx, site, user, "foo@example.com"}},
+		{TplEmailChangeConfirm{ctx, site, EmailChange{Email: "new@example.com", OldEmail: "a@example.com", Token: "asd", ExpiresAt: deletedAt}}},
+		{TplEmailChangeNotify{ctx, site, EmailChange{Email: "new@example.com", OldEmail: "a@example.com", CancelToken: "zxc", ExpiresAt: deletedAt}}},
+		{TplEmailBackupCode{ctx, site, user, 9}},
+		{TplEmailBackupCode{ctx, site, user, 0}},
+		{TplEmailPasswordChanged{ctx, site, user}},
+		{TplEmailInvite{ctx, site, Invite{Token: "asd", Email: "new@example.com"}, "foo@example.com", false}},
+		{TplEmailInvite{ctx, site, Invite{Token: "asd", Email: "new@example.com"}, "foo@example.com", true}},
+		{TplEmailQuota{ctx, Site{Cname: sp("example.com"), Quota: 1000, QuotaUsed: 812, QuotaAction: QuotaReject}, user, 80}},
+		{TplEmailQuota{ctx, Site{Cname: sp("example.com"), Quota: 1000, QuotaUsed: 1002, QuotaAction: QuotaCount}, user, 100}},
+		{TplEmailSitePurge{ctx, Site{Code: "1234", DeletedCode: "example", DeletedAt: &deletedAt, State: StateDeleted}, &site, user}},
+		{TplEmailSitePurge{ctx, Site{Code: "1234", DeletedCode: "example", DeletedAt: &deletedAt, State: StateDeleted}, nil, user}},
+		{TplEmailSiteWarning{ctx, site, user, ""}},
+		{TplEmailSiteWarning{ctx, site, user, "Please stop sending spam referrers."}},
+		{TplEmailRetentionDelay{ctx, site, user, RetentionPreview{Days: 31, Mode: RetentionAll, Pageviews: 42, StatRows: 12, From: &deletedAt, To: &deletedAt}, deletedAt}},
+		{TplEmailRetentionDelay{ctx, site, user, RetentionPreview{Days: 31, Mode: RetentionAnonymize}, deletedAt}},
+		{TplEmailSiteTransfer{ctx, Site{Cname: sp("example.com")}, site, SiteTransfer{Token: "asd", Email: "new@example.com"}, "foo@example.com"}},
 
 		{TplEmailExportDone{ctx, site, user, Export{
 			ID:        2,
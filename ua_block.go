@@ -0,0 +1,159 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// BotUABlock is the bot code for pageviews that matched the site's User-Agent
+// blocklist. This is outside the range isbot uses, so they can be told apart
+// from pageviews that were detected as a bot.
+const BotUABlock = 100
+
+// UABlockRule flags requests as a bot by the User-Agent header.
+//
+// The Pattern is a case-insensitive substring, or a regular expression if it's
+// surrounded by slashes (e.g. "/^Monitor\/[0-9]+$/").
+type UABlockRule struct {
+	Pattern string
+
+	re  *regexp.Regexp
+	err error
+}
+
+// UABlock is a list of UABlockRule, stored as one pattern per line.
+type UABlock []UABlockRule
+
+// User-Agent headers of common browsers; patterns that match any of these are
+// rejected, as they would flag a lot of regular visitors as bots.
+var uaBlockBrowsers = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Safari/537.36 Edg/128.0.0.0",
+	"Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Safari/605.1.15",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Mobile/15E148 Safari/604.1",
+	"Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Mobile Safari/537.36",
+}
+
+func (r UABlockRule) String() string { return r.Pattern }
+
+func (r UABlockRule) isRegexp() bool {
+	return len(r.Pattern) > 1 && r.Pattern[0] == '/' && r.Pattern[len(r.Pattern)-1] == '/'
+}
+
+func (r UABlockRule) match(ua string) bool {
+	if r.err != nil {
+		return false
+	}
+	if r.re != nil {
+		return r.re.MatchString(ua)
+	}
+	return strings.Contains(strings.ToLower(ua), strings.ToLower(r.Pattern))
+}
+
+func (l UABlock) String() string {
+	s := make([]string, 0, len(l))
+	for _, r := range l {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+func (l UABlock) Value() (driver.Value, error)  { return l.String(), nil }
+func (l UABlock) MarshalText() ([]byte, error)  { return []byte(l.String()), nil }
+func (l *UABlock) UnmarshalText(v []byte) error { return l.Scan(v) }
+
+// Scan the rules; this never returns an error, so that a bad rule doesn't
+// prevent loading the settings. Use Validate() to check the rules.
+func (l *UABlock) Scan(v any) error {
+	if v == nil {
+		return nil
+	}
+
+	lines := strings.Split(fmt.Sprintf("%s", v), "\n")
+	rules := make(UABlock, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		r := UABlockRule{Pattern: line}
+		switch {
+		case r.isRegexp():
+			r.re, r.err = regexp.Compile("(?i)" + r.Pattern[1:len(r.Pattern)-1])
+		case len(line) < 3:
+			r.err = fmt.Errorf("%q: must be at least 3 characters", line)
+		}
+		if r.err == nil {
+			for _, b := range uaBlockBrowsers {
+				if r.match(b) {
+					r.err = fmt.Errorf("%q: matches regular browsers such as %q", line, b)
+					break
+				}
+			}
+		}
+		rules = append(rules, r)
+	}
+	*l = rules
+	return nil
+}
+
+// Validate reports the first rule that failed to parse.
+func (l UABlock) Validate() error {
+	for _, r := range l {
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+// Match gets the first pattern that matches the User-Agent header.
+func (l UABlock) Match(ua string) (string, bool) {
+	if ua == "" {
+		return "", false
+	}
+	for _, r := range l {
+		if r.match(ua) {
+			return r.Pattern, true
+		}
+	}
+	return "", false
+}
+
+// UABlockCounts gets the number of pageviews every rule in the User-Agent
+// blocklist matched in the last 7 days (including today), keyed by the
+// pattern.
+func UABlockCounts(ctx context.Context) (map[string]int, error) {
+	var rows []struct {
+		Rule  string `db:"rule"`
+		Count int    `db:"count"`
+	}
+	err := zdb.Select(ctx, &rows, `/* UABlockCounts */
+		select rule, sum(count) as count from ua_block_stats
+		where site_id = $1 and day >= $2
+		group by rule`,
+		MustGetSite(ctx).ID, ztime.Now().Add(-6*24*time.Hour).Format("2006-01-02"))
+	if err != nil {
+		return nil, errors.Wrap(err, "UABlockCounts")
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, r := range rows {
+		counts[r.Rule] = r.Count
+	}
+	return counts, nil
+}
@@ -0,0 +1,79 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/zstd/ztest"
+)
+
+func TestUABlockMatch(t *testing.T) {
+	var rules UABlock
+	rules.Scan(`
+		# Comment
+		SyntheticMonitor
+		/^acme-probe\/[0-9.]+$/
+		/\bHeadlessChrome\b/
+	`)
+	if err := rules.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ua, want string
+	}{
+		{"Mozilla/5.0 (compatible; SyntheticMonitor/2.1; +https://example.com)", "SyntheticMonitor"},
+		{"mozilla/5.0 (compatible; syntheticmonitor/2.1)", "SyntheticMonitor"},
+		{"acme-probe/1.4.2", `/^acme-probe\/[0-9.]+$/`},
+		{"ACME-Probe/1.4", `/^acme-probe\/[0-9.]+$/`},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/128.0.0.0 Safari/537.36", `/\bHeadlessChrome\b/`},
+
+		// Regular browsers must never match.
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Safari/537.36", ""},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0", ""},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Mobile/15E148 Safari/604.1", ""},
+		{"acme-probe/1.4 (compatible)", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ua, func(t *testing.T) {
+			have, ok := rules.Match(tt.ua)
+			if have != tt.want || ok != (tt.want != "") {
+				t.Errorf("\nhave: %q %t\nwant: %q", have, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestUABlockValidate(t *testing.T) {
+	tests := []struct {
+		in, wantErr string
+	}{
+		{"", ""},
+		{"SyntheticMonitor\n/^probe/", ""},
+		{"/(/", "missing closing )"},
+		{"ab", `"ab": must be at least 3 characters`},
+
+		// Would block regular browsers.
+		{"Mozilla", `"Mozilla": matches regular browsers`},
+		{"safari", `"safari": matches regular browsers`},
+		{"/.*/", `"/.*/": matches regular browsers`},
+		{"//", `"//": matches regular browsers`},
+		{"/Chrome\\/[0-9]+/", `matches regular browsers`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var rules UABlock
+			rules.Scan(tt.in)
+			if !ztest.ErrorContains(rules.Validate(), tt.wantErr) {
+				t.Errorf("\nhave: %v\nwant: %s", rules.Validate(), tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/ztime"
+)
+
+// UAOverride sets the browser for User-Agent headers that the parser doesn't
+// recognize, or recognizes wrong.
+//
+// Pattern is a substring of the User-Agent, or a regular expression if it's
+// surrounded by slashes (e.g. "/Foo/(\d+)/"). Browser and Version can refer to
+// regexp groups with $1, ${1}, etc.
+//
+// Overrides are set for the entire instance, and always take precedence over
+// the parser. They're stored in the database, so they don't depend on the
+// parser version.
+type UAOverride struct {
+	ID        int64     `db:"ua_override_id" json:"-"`
+	Pattern   string    `db:"pattern" json:"pattern"`
+	Browser   string    `db:"browser" json:"browser"`
+	Version   string    `db:"version" json:"version"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+
+	re *regexp.Regexp
+}
+
+func (o UAOverride) isRegexp() bool {
+	return len(o.Pattern) > 1 && o.Pattern[0] == '/' && o.Pattern[len(o.Pattern)-1] == '/'
+}
+
+func (o *UAOverride) compile() error {
+	if !o.isRegexp() || o.re != nil {
+		return nil
+	}
+	var err error
+	o.re, err = regexp.Compile(o.Pattern[1 : len(o.Pattern)-1])
+	return err
+}
+
+// apply this override to the User-Agent, returning the browser name and
+// version if it matches.
+func (o UAOverride) apply(ua string) (string, string, bool) {
+	if !o.isRegexp() {
+		return o.Browser, o.Version, o.Pattern != "" && strings.Contains(ua, o.Pattern)
+	}
+	if o.re == nil {
+		return "", "", false
+	}
+	m := o.re.FindStringSubmatchIndex(ua)
+	if m == nil {
+		return "", "", false
+	}
+	return string(o.re.ExpandString(nil, o.Browser, ua, m)),
+		string(o.re.ExpandString(nil, o.Version, ua, m)), true
+}
+
+func (o *UAOverride) Defaults(ctx context.Context) {
+	o.Pattern = strings.TrimSpace(o.Pattern)
+	o.Browser = strings.TrimSpace(o.Browser)
+	o.Version = strings.TrimSpace(o.Version)
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = ztime.Now()
+	}
+}
+
+func (o *UAOverride) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("pattern", o.Pattern)
+	v.Required("browser", o.Browser)
+	v.Len("pattern", o.Pattern, 0, 512)
+	v.Len("browser", o.Browser, 0, 100)
+	v.Len("version", o.Version, 0, 100)
+	if err := o.compile(); err != nil {
+		v.Append("pattern", err.Error())
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new override.
+//
+// This doesn't update the existing stats; use ApplyUAOverrides() for that.
+func (o *UAOverride) Insert(ctx context.Context) error {
+	if o.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	o.Defaults(ctx)
+	err := o.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	o.ID, err = zdb.InsertID(ctx, "ua_override_id",
+		`insert into ua_overrides (pattern, browser, version, created_at) values (?)`,
+		[]any{o.Pattern, o.Browser, o.Version, o.CreatedAt})
+	if err != nil {
+		return errors.Wrap(err, "UAOverride.Insert")
+	}
+	clearUAOverrides(ctx)
+	return nil
+}
+
+// Delete this override.
+//
+// Existing stats the override was applied to aren't changed.
+func (o *UAOverride) Delete(ctx context.Context) error {
+	err := zdb.Exec(ctx,
+		`/* UAOverride.Delete */ delete from ua_overrides where ua_override_id=$1`, o.ID)
+	if err != nil {
+		return errors.Wrapf(err, "UAOverride.Delete %d", o.ID)
+	}
+	clearUAOverrides(ctx)
+	return nil
+}
+
+type UAOverrides []UAOverride
+
+// List all overrides, in the order they're applied.
+func (l *UAOverrides) List(ctx context.Context) error {
+	err := zdb.Select(ctx, l, `select * from ua_overrides order by ua_override_id`)
+	if err != nil {
+		return errors.Wrap(err, "UAOverrides.List")
+	}
+	for i := range *l {
+		(*l)[i].compile() // Validated on insert.
+	}
+	return nil
+}
+
+// Apply the first matching override to the User-Agent.
+func (l UAOverrides) Apply(ua string) (string, string, bool) {
+	for _, o := range l {
+		if b, v, ok := o.apply(ua); ok {
+			return b, v, true
+		}
+	}
+	return "", "", false
+}
+
+// loadUAOverrides gets the overrides from the cache, loading them from the
+// database if needed.
+func loadUAOverrides(ctx context.Context) (UAOverrides, error) {
+	if c, ok := cacheUAOverride(ctx).Get(""); ok {
+		return c.(UAOverrides), nil
+	}
+
+	var l UAOverrides
+	err := l.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cacheUAOverride(ctx).SetDefault("", l)
+	return l, nil
+}
+
+// Clear the cached overrides and User-Agents, so that new hits use the
+// changed overrides.
+func clearUAOverrides(ctx context.Context) {
+	cacheUAOverride(ctx).Flush()
+	cacheUA(ctx).Flush()
+}
+
+// UnknownUA is a User-Agent header the browser wasn't detected for.
+type UnknownUA struct {
+	UserAgent string `db:"user_agent"`
+	Count     int    `db:"count"`
+}
+
+type UnknownUAs []UnknownUA
+
+// List the most frequent User-Agent headers without a detected browser, for
+// all sites.
+func (l *UnknownUAs) List(ctx context.Context, limit int) error {
+	err := zdb.Select(ctx, l, `/* UnknownUAs.List */
+		select user_agent, sum(count) as count
+		from unknown_ua_stats
+		group by user_agent
+		order by count desc, user_agent
+		limit :limit`,
+		map[string]any{"limit": limit})
+	return errors.Wrap(err, "UnknownUAs.List")
+}
+
+// ApplyUAOverrides applies the current overrides to the existing browser
+// stats, for all sites.
+//
+// Only stats for User-Agents that weren't recognized can be updated, as the
+// User-Agent isn't stored for other hits.
+func ApplyUAOverrides(ctx context.Context) error {
+	overrides, err := loadUAOverrides(ctx)
+	if err != nil || len(overrides) == 0 {
+		return errors.Wrap(err, "ApplyUAOverrides")
+	}
+
+	var uas []string
+	err = zdb.Select(ctx, &uas, `select distinct user_agent from unknown_ua_stats`)
+	if err != nil {
+		return errors.Wrap(err, "ApplyUAOverrides")
+	}
+
+	return errors.Wrap(zdb.TX(ctx, func(ctx context.Context) error {
+		conflict := `on conflict(site_id, path_id, day, browser_id)`
+		if zdb.SQLDialect(ctx) == zdb.DialectPostgreSQL {
+			conflict = `on conflict on constraint "browser_stats#site_id#path_id#day#browser_id"`
+		}
+
+		for _, ua := range uas {
+			name, version, ok := overrides.Apply(ua)
+			if !ok {
+				continue
+			}
+			var browser Browser
+			err := browser.GetOrInsert(ctx, name, version)
+			if err != nil {
+				return err
+			}
+
+			var rows []struct {
+				SiteID    int64     `db:"site_id"`
+				PathID    int64     `db:"path_id"`
+				Day       time.Time `db:"day"`
+				BrowserID int64     `db:"browser_id"`
+				Count     int       `db:"count"`
+			}
+			err = zdb.Select(ctx, &rows, `
+				select site_id, path_id, day, browser_id, count from unknown_ua_stats
+				where user_agent = ?`, ua)
+			if err != nil {
+				return err
+			}
+			for _, r := range rows {
+				p := map[string]any{"site": r.SiteID, "path": r.PathID, "day": r.Day.Format("2006-01-02"),
+					"old": r.BrowserID, "new": browser.ID, "count": r.Count}
+				err := zdb.Exec(ctx, `
+					insert into browser_stats (site_id, path_id, day, browser_id, count)
+					values (:site, :path, :day, :new, :count) `+conflict+` do update set
+						count = browser_stats.count + excluded.count`, p)
+				if err != nil {
+					return err
+				}
+				err = zdb.Exec(ctx, `
+					update browser_stats set count = count - :count
+					where site_id = :site and path_id = :path and day = :day and browser_id = :old`, p)
+				if err != nil {
+					return err
+				}
+				err = zdb.Exec(ctx, `
+					delete from browser_stats
+					where site_id = :site and path_id = :path and day = :day and browser_id = :old and count <= 0`, p)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = zdb.Exec(ctx, `delete from unknown_ua_stats where user_agent = ?`, ua)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}), "ApplyUAOverrides")
+}
@@ -24,6 +24,7 @@ import (
 	"zgo.at/zstd/zcrypto"
 	"zgo.at/zstd/ztime"
 	"zgo.at/zstd/ztype"
+	"zgo.at/zvalidate"
 )
 
 const totpSecretLen = 16
@@ -43,8 +44,6 @@ type User struct {
 	OpenAt        *time.Time   `db:"open_at" json:"open_at,readonly"`
 	ResetAt       *time.Time   `db:"reset_at" json:"reset_at,readonly"`
 	LoginRequest  *string      `db:"login_request" json:"-"`
-	LoginToken    *string      `db:"login_token" json:"-"`
-	Token         *string      `db:"csrf_token" json:"-"`
 	EmailToken    *string      `db:"email_token" json:"-"`
 	Settings      UserSettings `db:"settings" json:"settings"`
 
@@ -53,6 +52,17 @@ type User struct {
 
 	CreatedAt time.Time  `db:"created_at" json:"created_at,readonly"`
 	UpdatedAt *time.Time `db:"updated_at" json:"updated_at,readonly"`
+
+	// Set when logged in from a LoginSession: the session ID, cookie value,
+	// and CSRF token. The cookie value is only set on Login, as only the hash
+	// is stored.
+	LoginSession int64   `db:"-" json:"-"`
+	LoginToken   *string `db:"-" json:"-"`
+	Token        *string `db:"-" json:"-"`
+
+	// Site the access is checked for; this is set when loading the user with
+	// the site in the context. The access for "all" is used if it's 0.
+	accessSite int64
 }
 
 // Defaults sets fields to default values, unless they're already set.
@@ -87,9 +97,7 @@ func (u *User) Validate(ctx context.Context, validatePassword bool) error {
 	v.Required("email", u.Email)
 	v.Len("email", u.Email, 5, 255)
 	v.Email("email", u.Email)
-	if len(u.Access) == 0 {
-		v.Append("access", "must be set")
-	}
+	u.Access.validate(&v)
 
 	if validatePassword {
 		sp := string(u.Password)
@@ -98,6 +106,16 @@ func (u *User) Validate(ctx context.Context, validatePassword bool) error {
 		if len(sp) < 8 || len(sp) > 50 {
 			v.Append("password", "must be between 8 and 50 bytes")
 		}
+
+		if p := Config(ctx).Pwned; p != nil && !v.HasErrors() {
+			breached, n, err := p.Breached(ctx, sp)
+			switch {
+			case err != nil: // Don't prevent signups if the API is down.
+				zlog.Module("pwned").Printf("not checking password: %s", err)
+			case breached:
+				v.Append("password", "appeared %d times in data breaches; use a different password", n)
+			}
+		}
 	}
 
 	v.Sub("settings", "", u.Settings.Validate(ctx))
@@ -180,6 +198,9 @@ func (u *User) Delete(ctx context.Context, lastAdmin bool) error {
 		if err != nil {
 			return errors.Wrap(err, "User.Delete")
 		}
+		if o := admins.Owners(); len(o) == 1 && o[0].ID == u.ID {
+			return fmt.Errorf("can't delete last owner for site %d", u.Site)
+		}
 		admins = admins.Admins()
 		if len(admins) == 1 && admins[0].ID == u.ID {
 			return fmt.Errorf("can't delete last admin user for site %d", u.Site)
@@ -191,8 +212,40 @@ func (u *User) Delete(ctx context.Context, lastAdmin bool) error {
 		return errors.Wrap(err, "User.Delete")
 	}
 
-	err = zdb.Exec(ctx, `delete from users where user_id=? and site_id=?`,
-		u.ID, account.ID)
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from passkeys where user_id=? and site_id=?`,
+			u.ID, account.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from email_changes where user_id=? and site_id=?`,
+			u.ID, account.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from backup_codes where user_id=? and site_id=?`,
+			u.ID, account.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from webhook_deliveries where webhook_id in (
+			select webhook_id from webhooks where user_id=? and site_id=?)`,
+			u.ID, account.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from webhooks where user_id=? and site_id=?`,
+			u.ID, account.ID)
+		if err != nil {
+			return err
+		}
+		err = zdb.Exec(ctx, `delete from alert_rules where user_id=?`, u.ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `delete from users where user_id=? and site_id=?`,
+			u.ID, account.ID)
+	})
 	return errors.Wrap(err, "User.Delete")
 }
 
@@ -262,7 +315,12 @@ func (u *User) UpdatePassword(ctx context.Context, pwd string) error {
 	err = zdb.Exec(ctx,
 		`update users set password=$1, updated_at=$2 where user_id=$3`,
 		u.Password, u.UpdatedAt, u.ID)
-	return errors.Wrap(err, "User.UpdatePassword")
+	if err != nil {
+		return errors.Wrap(err, "User.UpdatePassword")
+	}
+
+	// The old password may have been compromised.
+	return u.LogoutOthers(ctx)
 }
 
 // CorrectPassword verifies that this password is correct.
@@ -295,6 +353,7 @@ func (u *User) ByEmailToken(ctx context.Context, key string) error {
 func (u *User) ByID(ctx context.Context, id int64) error {
 	err := zdb.Get(ctx, u, `select * from users where user_id=? and site_id=?`,
 		id, MustGetSite(ctx).IDOrParent())
+	u.accessSite = MustGetSite(ctx).ID
 	return errors.Wrap(err, "User.ByID")
 }
 
@@ -351,20 +410,73 @@ func (u *User) ByToken(ctx context.Context, token string) error {
 		return sql.ErrNoRows
 	}
 
+	var ls LoginSession
+	err := ls.ByToken(ctx, token)
+	if err == nil && ls.MFAPending {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return errors.Wrap(err, "User.ByToken")
+	}
 	return errors.Wrap(zdb.Get(ctx, u,
-		`select * from users where login_token=$1`, token),
+		`select * from users where user_id=$1 and site_id=$2`, ls.UserID, ls.SiteID),
 		"User.ByToken")
 }
 
-// ByTokenAndSite gets a user by login token.
+// ByTokenAndSite gets a user by login token, and updates the last seen time of
+// the session.
 func (u *User) ByTokenAndSite(ctx context.Context, token string) error {
 	if token == "" {
 		return sql.ErrNoRows
 	}
 
-	return errors.Wrap(zdb.Get(ctx, u,
-		`select * from users where login_token=$1 and site_id=$2`,
-		token, MustGetSite(ctx).IDOrParent()), "User.ByTokenAndSite")
+	var ls LoginSession
+	err := ls.ByToken(ctx, token)
+	if err == nil && (ls.MFAPending || ls.SiteID != MustGetSite(ctx).IDOrParent()) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return errors.Wrap(err, "User.ByTokenAndSite")
+	}
+
+	u.accessSite = MustGetSite(ctx).ID
+	err = zdb.Get(ctx, u, `select * from users where user_id=$1 and site_id=$2`, ls.UserID, ls.SiteID)
+	if err != nil {
+		return errors.Wrap(err, "User.ByTokenAndSite")
+	}
+	u.LoginSession, u.Token = ls.ID, &ls.CSRFToken
+
+	err = ls.UpdateSeen(ctx)
+	if err != nil {
+		zlog.Error(err)
+	}
+	return nil
+}
+
+// ByMFAToken gets a user by login token for a session that's waiting for
+// multi-factor auth.
+func (u *User) ByMFAToken(ctx context.Context, token string) error {
+	if token == "" {
+		return sql.ErrNoRows
+	}
+
+	var ls LoginSession
+	err := ls.ByToken(ctx, token)
+	if err == nil && (!ls.MFAPending || ls.SiteID != MustGetSite(ctx).IDOrParent() ||
+		ls.CreatedAt.Before(ztime.Now().Add(-MFAExpire))) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return errors.Wrap(err, "User.ByMFAToken")
+	}
+
+	u.accessSite = MustGetSite(ctx).ID
+	err = zdb.Get(ctx, u, `select * from users where user_id=$1 and site_id=$2`, ls.UserID, ls.SiteID)
+	if err != nil {
+		return errors.Wrap(err, "User.ByMFAToken")
+	}
+	u.LoginSession, u.LoginToken, u.Token = ls.ID, &token, &ls.CSRFToken
+	return nil
 }
 
 // RequestReset generates a new password reset key.
@@ -392,7 +504,10 @@ func (u *User) EnableTOTP(ctx context.Context) error {
 		return errors.Wrap(err, "User.EnableTOTP")
 	}
 	u.TOTPEnabled = zbool.Bool(true)
-	return nil
+
+	// Sessions from before MFA was enabled may have been created by someone
+	// else with the password.
+	return u.LogoutOthers(ctx)
 }
 
 func (u *User) DisableTOTP(ctx context.Context) error {
@@ -404,9 +519,15 @@ func (u *User) DisableTOTP(ctx context.Context) error {
 		return errors.Wrap(err, "User.DisableTOTP")
 	}
 
-	err = zdb.Exec(ctx, `update users set
-		totp_enabled=0, totp_secret=$1 where user_id=$2 and site_id=$3`,
-		secret, u.ID, MustGetSite(ctx).IDOrParent())
+	err = zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `update users set
+			totp_enabled=0, totp_secret=$1 where user_id=$2 and site_id=$3`,
+			secret, u.ID, MustGetSite(ctx).IDOrParent())
+		if err != nil {
+			return err
+		}
+		return (&BackupCodes{}).DeleteUser(ctx, u.ID)
+	})
 	if err != nil {
 		return errors.Wrap(err, "User.DisableTOTP")
 	}
@@ -415,26 +536,57 @@ func (u *User) DisableTOTP(ctx context.Context) error {
 	return nil
 }
 
-// Login a user; create a new key, CSRF token, and reset the request date.
-func (u *User) Login(ctx context.Context) error {
+// Login a user; create a new session, and reset the request date.
+//
+// The userAgent and ip are stored so people can recognize the session.
+func (u *User) Login(ctx context.Context, userAgent, ip string) error {
+	return u.login(ctx, userAgent, ip, false)
+}
+
+// LoginMFA creates a new session for a user which can't be used until
+// VerifyMFA is called.
+func (u *User) LoginMFA(ctx context.Context, userAgent, ip string) error {
+	return u.login(ctx, userAgent, ip, true)
+}
+
+func (u *User) login(ctx context.Context, userAgent, ip string, mfaPending bool) error {
 	if u.ID == 0 {
 		return errors.New("u.ID == 0")
 	}
 
-	u.Token = ztype.Ptr(zcrypto.Secret256())
-	if u.LoginToken == nil || *u.LoginToken == "" {
-		s := ztime.Now().Format("20060102") + "-" + zcrypto.Secret256()
-		u.LoginToken = &s
+	ls, token, err := newLoginSession(ctx, u, userAgent, ip, mfaPending)
+	if err != nil {
+		return errors.Wrap(err, "User.Login")
+	}
+	u.LoginSession, u.LoginToken, u.Token = ls.ID, &token, &ls.CSRFToken
+	if mfaPending {
+		return nil
 	}
+	return errors.Wrap(u.setLoginAt(ctx), "User.Login")
+}
+
+// VerifyMFA marks the session created with LoginMFA as verified.
+func (u *User) VerifyMFA(ctx context.Context) error {
+	if u.LoginSession == 0 {
+		return errors.New("u.LoginSession == 0")
+	}
+
+	err := zdb.Exec(ctx, `update login_sessions set mfa_pending=0 where login_session_id=$1 and user_id=$2`,
+		u.LoginSession, u.ID)
+	if err != nil {
+		return errors.Wrap(err, "User.VerifyMFA")
+	}
+	return errors.Wrap(u.setLoginAt(ctx), "User.VerifyMFA")
+}
 
+func (u *User) setLoginAt(ctx context.Context) error {
+	u.LoginRequest = nil
 	u.LoginAt = ztype.Ptr(ztime.Now())
 	u.OpenAt = ztype.Ptr(ztime.Now())
-	err := zdb.Exec(ctx, `update users set
-			login_request=null, login_token=?, csrf_token=?, login_at=?, open_at=?
+	return zdb.Exec(ctx, `update users set
+			login_request=null, login_at=?, open_at=?
 			where user_id = ? and site_id = ?`,
-		u.LoginToken, u.Token, u.LoginAt, u.OpenAt,
-		u.ID, MustGetSite(ctx).IDOrParent())
-	return errors.Wrap(err, "User.Login")
+		u.LoginAt, u.OpenAt, u.ID, u.Site)
 }
 
 func (u *User) UpdateOpenAt(ctx context.Context) error {
@@ -453,21 +605,34 @@ func (u *User) UpdateOpenAt(ctx context.Context) error {
 	return errors.Wrap(err, "User.UpdateOpenAt")
 }
 
-// Logout a user.
+// Logout a user; this only deletes the current session.
 func (u *User) Logout(ctx context.Context) error {
 	if u.ID == 0 {
 		return errors.New("u.ID == 0")
 	}
 
-	u.LoginToken = nil
+	ls := LoginSession{ID: u.LoginSession, SiteID: u.Site}
+	u.LoginSession, u.LoginToken, u.Token = 0, nil, nil
 	u.LoginRequest = nil
 	u.LoginAt = nil
-	err := zdb.Exec(ctx,
-		`update users set login_token=null, login_request=null where user_id=$1 and site_id=$2`,
-		u.ID, MustGetSite(ctx).IDOrParent())
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := ls.Delete(ctx)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `update users set login_request=null where user_id=$1 and site_id=$2`,
+			u.ID, u.Site)
+	})
 	return errors.Wrap(err, "User.Logout")
 }
 
+// LogoutOthers deletes all sessions for this user, except the current one (if
+// any).
+func (u *User) LogoutOthers(ctx context.Context) error {
+	return errors.Wrap((&LoginSessions{}).DeleteUser(ctx, u.Site, u.ID, u.LoginSession),
+		"User.LogoutOthers")
+}
+
 // CSRFToken gets the CSRF token.
 func (u *User) CSRFToken() string {
 	if u.Token == nil {
@@ -476,25 +641,22 @@ func (u *User) CSRFToken() string {
 	return *u.Token
 }
 
+// Role gets the access for the site the user was loaded for, or for all sites
+// if it's not loaded for a site.
+func (u User) Role() UserAccess { return u.Access.For(u.accessSite) }
+
 // HasAccess checks if this user has access to this site for the permission.
 func (u User) HasAccess(check UserAccess) bool {
-	switch check {
-	default:
-		return false
-	case AccessSuperuser:
+	if check == AccessSuperuser {
 		return u.Access["all"] == AccessSuperuser
-	case AccessAdmin:
-		return u.Access["all"] == AccessSuperuser || u.Access["all"] == AccessAdmin
-	case AccessSettings:
-		return u.Access["all"] == AccessSuperuser || u.Access["all"] == AccessAdmin || u.Access["all"] == AccessSettings
-	case AccessReadOnly:
-		return u.Access["all"] == AccessSuperuser || u.Access["all"] == AccessAdmin || u.Access["all"] == AccessSettings || u.Access["all"] == AccessReadOnly
 	}
+	return check.level() > 0 && u.Role().level() >= check.level()
 }
 
-func (u User) AccessSuperuser() bool { return u.Access["all"] == AccessSuperuser }
-func (u User) AccessAdmin() bool     { return u.AccessSuperuser() || u.Access["all"] == AccessAdmin }
-func (u User) AccessSettings() bool  { return u.AccessAdmin() || u.Access["all"] == AccessSettings }
+func (u User) AccessSuperuser() bool { return u.HasAccess(AccessSuperuser) }
+func (u User) AccessOwner() bool     { return u.HasAccess(AccessOwner) }
+func (u User) AccessAdmin() bool     { return u.HasAccess(AccessAdmin) }
+func (u User) AccessSettings() bool  { return u.HasAccess(AccessSettings) }
 
 // EmailReportRange gets the time range of the next report to send out.
 //
@@ -502,12 +664,17 @@ func (u User) AccessSettings() bool  { return u.AccessAdmin() || u.Access["all"]
 // report we take LastReportAt, go to the start and end of the period, and if
 // the endDate > now then send out a new report and set LastReportAt.
 //
-// The cronjob will send the report if the current date is after the end date.
+// Weekly reports start on the day they're sent on, so the report has the
+// seven days before it's sent.
+//
+// The cronjob will send the report if the current date is after
+// EmailReportSendAt().
 func (u User) EmailReportRange() ztime.Range {
 	var (
 		start, end ztime.Time
 		lastReport = ztime.Time{u.LastReportAt.In(u.Settings.Timezone.Loc())}
-		week       = ztime.Week(u.Settings.SundayStartsWeek)
+		day        = lastReport.StartOf(ztime.Day).Time
+		week       = ztime.Time{day.AddDate(0, 0, -int((7+day.Weekday()-u.Settings.ReportWeekday())%7))}
 	)
 	switch u.Settings.EmailReports.Int() {
 	case EmailReportNever:
@@ -517,13 +684,13 @@ func (u User) EmailReportRange() ztime.Range {
 		start, end = lastReport.StartOf(ztime.Day), lastReport.EndOf(ztime.Day)
 
 	case EmailReportBiWeekly:
-		start, end = lastReport.StartOf(week), lastReport.EndOf(week).AddPeriod(1, week)
+		start, end = week, ztime.Time{week.AddDate(0, 0, 13)}.EndOf(ztime.Day)
 
 	case EmailReportMonthly:
 		start, end = lastReport.StartOf(ztime.Month), lastReport.EndOf(ztime.Month)
 
 	case EmailReportWeekly:
-		start, end = lastReport.StartOf(week), lastReport.EndOf(week)
+		start, end = week, ztime.Time{week.AddDate(0, 0, 6)}.EndOf(ztime.Day)
 	default:
 		zlog.Errorf("invalid EmailReports value for user %d: %d", u.ID, u.Settings.EmailReports.Int())
 		return ztime.Range{}
@@ -532,6 +699,27 @@ func (u User) EmailReportRange() ztime.Range {
 	return ztime.NewRange(start.Time.Truncate(time.Second)).To(end.Time.Truncate(time.Second))
 }
 
+// EmailReportSendAt gets the time to send the next report: EmailReportHour on
+// the day after the end of EmailReportRange(), or EmailReportMonthday for
+// monthly reports.
+//
+// This is the zero time if reports are disabled.
+func (u User) EmailReportSendAt() time.Time {
+	rng := u.EmailReportRange()
+	if rng.IsZero() {
+		return time.Time{}
+	}
+
+	var (
+		next    = rng.End.In(u.Settings.Timezone.Loc()).Add(time.Second)
+		y, m, d = next.Date()
+	)
+	if u.Settings.EmailReports.Int() == EmailReportMonthly && u.Settings.EmailReportMonthday > 1 {
+		d += u.Settings.EmailReportMonthday - 1
+	}
+	return time.Date(y, m, d, u.Settings.EmailReportHour, 0, 0, 0, next.Location())
+}
+
 func (u User) EmailShort() string {
 	local, _, ok := strings.Cut(u.Email, "@")
 	if ok {
@@ -553,11 +741,22 @@ func (u *Users) List(ctx context.Context, siteID int64) error {
 		`select * from users where site_id=$1`, s.IDOrParent()), "Users.List")
 }
 
-// Admins returns just the admins and superusers in this user list.
+// Admins returns just the admins, owners, and superusers in this user list.
 func (u Users) Admins() Users {
 	n := make(Users, 0, len(u))
 	for _, uu := range u {
-		if uu.AccessSuperuser() || uu.AccessAdmin() {
+		if uu.Access["all"].level() >= AccessAdmin.level() {
+			n = append(n, uu)
+		}
+	}
+	return n
+}
+
+// Owners returns just the owners and superusers in this user list.
+func (u Users) Owners() Users {
+	n := make(Users, 0, len(u))
+	for _, uu := range u {
+		if uu.Access["all"].level() >= AccessOwner.level() {
 			n = append(n, uu)
 		}
 	}
@@ -599,26 +798,50 @@ func (u *Users) IDs() []int64 {
 }
 
 type (
+	// UserAccesses is the access per site; the "all" key is the access for all
+	// sites in the account, and can be overridden for a site with the site ID
+	// as the key.
 	UserAccesses map[string]UserAccess
 	UserAccess   string
 )
 
+// User roles, from least to most access.
 const (
-	AccessReadOnly  UserAccess = "r"
-	AccessSettings  UserAccess = "s"
-	AccessAdmin     UserAccess = "a"
-	AccessSuperuser UserAccess = "*"
+	AccessReadOnly  UserAccess = "r" // Viewer: dashboard only.
+	AccessSettings  UserAccess = "s" // Editor: site settings, but not users or sites.
+	AccessAdmin     UserAccess = "a" // Admin: everything, except deleting the account.
+	AccessOwner     UserAccess = "o" // Owner: everything.
+	AccessSuperuser UserAccess = "*" // Owner, and can change server settings.
 )
 
+func (u UserAccess) level() int {
+	switch u {
+	case AccessReadOnly:
+		return 1
+	case AccessSettings:
+		return 2
+	case AccessAdmin:
+		return 3
+	case AccessOwner:
+		return 4
+	case AccessSuperuser:
+		return 5
+	default:
+		return 0
+	}
+}
+
 // TODO: this is not translated.
 func (u UserAccess) String() string {
 	switch u {
 	case AccessReadOnly:
-		return "read only"
+		return "viewer"
 	case AccessSettings:
-		return "settings"
+		return "editor"
 	case AccessAdmin:
 		return "admin"
+	case AccessOwner:
+		return "owner"
 	case AccessSuperuser:
 		return "superuser"
 	default:
@@ -626,6 +849,42 @@ func (u UserAccess) String() string {
 	}
 }
 
+func (u UserAccesses) validate(v *zvalidate.Validator) {
+	if len(u) == 0 || u["all"] == "" {
+		v.Append("access", "must be set")
+	}
+	for k, a := range u {
+		if a.level() == 0 {
+			v.Append("access", fmt.Sprintf("unknown value for %q: %q", k, a))
+			continue
+		}
+		if k == "all" {
+			continue
+		}
+		if _, err := strconv.ParseInt(k, 10, 64); err != nil {
+			v.Append("access", fmt.Sprintf("not a site ID: %q", k))
+		}
+		if a.level() > AccessSettings.level() {
+			v.Append("access", fmt.Sprintf("%q: can only be set for all sites", a))
+		}
+	}
+}
+
+// For gets the access for a site.
+//
+// Only the viewer and editor roles can be set per site; owners and superusers
+// always have access to all sites.
+func (u UserAccesses) For(siteID int64) UserAccess {
+	all := u["all"]
+	if all.level() >= AccessOwner.level() {
+		return all
+	}
+	if a, ok := u[strconv.FormatInt(siteID, 10)]; ok {
+		return a
+	}
+	return all
+}
+
 // Value implements the SQL Value function to determine what to store in the DB.
 func (u UserAccesses) Value() (driver.Value, error) { return json.Marshal(u) }
 
@@ -19,6 +19,10 @@ type UserAgent struct {
 	Isbot     uint8
 	BrowserID int64
 	SystemID  int64
+
+	// No browser was detected; these are stored in unknown_ua_stats so that
+	// overrides can be added later. See UAOverride.
+	Unknown bool
 }
 
 func (p *UserAgent) GetOrInsert(ctx context.Context) error {
@@ -35,8 +39,16 @@ func (p *UserAgent) GetOrInsert(ctx context.Context) error {
 		browser Browser
 		system  System
 	)
+	overrides, err := loadUAOverrides(ctx)
+	if err != nil {
+		return errors.Wrap(err, "UserAgent.GetOrInsert")
+	}
+	if name, version, ok := overrides.Apply(p.UserAgent); ok {
+		ua.BrowserName, ua.BrowserVersion = name, version
+	}
+	p.Unknown = ua.BrowserName == ""
 
-	err := browser.GetOrInsert(ctx, ua.BrowserName, ua.BrowserVersion)
+	err = browser.GetOrInsert(ctx, ua.BrowserName, ua.BrowserVersion)
 	if err != nil {
 		return errors.Wrap(err, "UserAgent.GetOrInsert")
 	}
@@ -87,6 +99,29 @@ func (b *Browser) GetOrInsert(ctx context.Context, name, version string) error {
 	return nil
 }
 
+// Normalized system versions, by system name and version as stored.
+//
+// Some systems report a version that's frozen or ambiguous, so the stored
+// version doesn't mean what it says. This is applied when listing the stats,
+// so changes here also apply to existing data.
+var systemVersions = map[string]map[string]string{
+	// Safari and Chrome freeze the version at 10.15.7 since macOS 11.
+	"macOS": {"10.15": "10.15+"},
+	// Windows 11 reports itself as NT 10.0, same as Windows 10.
+	"Windows": {"10": "10/11"},
+	// Chrome's reduced User-Agent always sends "Android 10; K".
+	"Android": {"10": "10+"},
+}
+
+// NormalizeSystemVersion normalizes a system version with the systemVersions
+// table, returning the version as-is if there's nothing to normalize.
+func NormalizeSystemVersion(name, version string) string {
+	if v, ok := systemVersions[name][version]; ok {
+		return v
+	}
+	return version
+}
+
 type System struct {
 	ID      int64  `db:"system_id"`
 	Name    string `db:"name"`
@@ -14,6 +14,7 @@ import (
 	"zgo.at/isbot"
 	"zgo.at/zdb"
 	"zgo.at/zstd/ztest"
+	"zgo.at/zstd/ztime"
 )
 
 func TestUserAgentGetOrInsert(t *testing.T) {
@@ -94,3 +95,79 @@ func TestUserAgentGetOrInsert(t *testing.T) {
 		`)
 	}
 }
+
+func TestUAOverride(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	const unknown = "Mozilla/5.0 (X11; Linux x86_64) MyBrowser/1.2"
+	now := ztime.Now()
+	gctest.StoreHits(ctx, t, false,
+		Hit{CreatedAt: now, FirstVisit: true, UserAgentHeader: unknown},
+		Hit{CreatedAt: now, FirstVisit: true, UserAgentHeader: unknown},
+		Hit{CreatedAt: now, FirstVisit: false, UserAgentHeader: unknown})
+
+	var uas UnknownUAs
+	err := uas.List(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uas) != 1 || uas[0].UserAgent != unknown || uas[0].Count != 2 {
+		t.Fatalf("wrong unknown UAs: %#v", uas)
+	}
+
+	for _, o := range []UAOverride{
+		{Pattern: `/MyBrowser/([\d.]+)/`, Browser: "MyBrowser", Version: "$1"},
+		{Pattern: "Firefox/79", Browser: "NotFirefox"},
+	} {
+		err := o.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	{
+		err := (&UAOverride{Pattern: "/(/", Browser: "x"}).Insert(ctx)
+		if !ztest.ErrorContains(err, "pattern: error parsing regexp") {
+			t.Errorf("wrong error: %v", err)
+		}
+	}
+
+	err = ApplyUAOverrides(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+		name       version  count
+		MyBrowser  1.2      2`
+	out := zdb.DumpString(ctx, `
+		select browsers.name, browsers.version, sum(count) as count from browser_stats
+		join browsers using (browser_id)
+		group by browsers.name, browsers.version`)
+	if d := ztest.Diff(out, want, ztest.DiffNormalizeWhitespace); d != "" {
+		t.Error(d)
+	}
+
+	uas = UnknownUAs{}
+	err = uas.List(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uas) != 0 {
+		t.Errorf("unknown UAs not removed: %#v", uas)
+	}
+
+	// Overrides take precedence over the parser for new hits.
+	ua := UserAgent{UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0"}
+	err = ua.GetOrInsert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b Browser
+	err = zdb.Get(ctx, &b, `select * from browsers where browser_id = ?`, ua.BrowserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Name != "NotFirefox" || ua.Unknown {
+		t.Errorf("wrong browser: %#v %#v", b, ua)
+	}
+}
@@ -5,10 +5,16 @@
 package goatcounter_test
 
 import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+	"zgo.at/goatcounter/v2/pwned"
 	"zgo.at/tz"
 	"zgo.at/zstd/zint"
 	"zgo.at/zstd/ztime"
@@ -71,6 +77,32 @@ func TestUserEmailReportRange(t *testing.T) {
 				Timezone:     wita,
 			},
 		}, ztime.FromString("2019-06-17 16:00:00"), ztime.FromString("2019-06-18 15:59:59")},
+
+		// Week crosses a month boundary; 2019-07-02 is a Tuesday.
+		{goatcounter.User{
+			LastReportAt: time.Date(2019, 7, 2, 14, 42, 0, 0, time.UTC),
+			Settings: goatcounter.UserSettings{
+				FirstDayOfWeek: "monday",
+				EmailReports:   zint.Int(goatcounter.EmailReportWeekly),
+				Timezone:       tz.UTC,
+			},
+		}, ztime.FromString("2019-07-01 00:00:00"), ztime.FromString("2019-07-07 23:59:59")},
+		{goatcounter.User{
+			LastReportAt: time.Date(2019, 7, 2, 14, 42, 0, 0, time.UTC),
+			Settings: goatcounter.UserSettings{
+				FirstDayOfWeek: "sunday",
+				EmailReports:   zint.Int(goatcounter.EmailReportWeekly),
+				Timezone:       tz.UTC,
+			},
+		}, ztime.FromString("2019-06-30 00:00:00"), ztime.FromString("2019-07-06 23:59:59")},
+		{goatcounter.User{
+			LastReportAt: time.Date(2019, 7, 2, 14, 42, 0, 0, time.UTC),
+			Settings: goatcounter.UserSettings{
+				FirstDayOfWeek: "saturday",
+				EmailReports:   zint.Int(goatcounter.EmailReportBiWeekly),
+				Timezone:       tz.UTC,
+			},
+		}, ztime.FromString("2019-06-29 00:00:00"), ztime.FromString("2019-07-12 23:59:59")},
 	}
 
 	for _, tt := range tests {
@@ -85,3 +117,68 @@ func TestUserEmailReportRange(t *testing.T) {
 		})
 	}
 }
+
+func TestUserSettingsWeekStart(t *testing.T) {
+	tests := []struct {
+		settings goatcounter.UserSettings
+		want     time.Weekday
+	}{
+		{goatcounter.UserSettings{Language: "en-GB"}, time.Monday},
+		{goatcounter.UserSettings{Language: "en-US"}, time.Sunday},
+		{goatcounter.UserSettings{Language: "ja-JP"}, time.Sunday},
+		{goatcounter.UserSettings{Language: "ar-EG"}, time.Saturday},
+		{goatcounter.UserSettings{Language: "nl-NL"}, time.Monday},
+		{goatcounter.UserSettings{Language: "en-GB", SundayStartsWeek: true}, time.Sunday},
+		{goatcounter.UserSettings{Language: "en-US", FirstDayOfWeek: "monday"}, time.Monday},
+		{goatcounter.UserSettings{Language: "en-GB", FirstDayOfWeek: "saturday"}, time.Saturday},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.settings.Language+tt.settings.FirstDayOfWeek, func(t *testing.T) {
+			have := tt.settings.WeekStart()
+			if have != tt.want {
+				t.Errorf("have: %s; want: %s", have, tt.want)
+			}
+		})
+	}
+}
+
+type roundTrip func(*http.Request) (*http.Response, error)
+
+func (f roundTrip) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestUserPwned(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8.
+	var down bool
+	p := pwned.New(10)
+	p.Client = &http.Client{Transport: roundTrip(func(r *http.Request) (*http.Response, error) {
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(
+			"1E4C9B93F3F0682250B6CF8331B7EE68FD8:9659365\r\n" +
+				"9DEA4B7E97D7C1EA9B3B6EA2E2C8B0F1D3A:0\r\n"))}, nil
+	})}
+	goatcounter.Config(ctx).Pwned = p
+
+	u := goatcounter.User{Email: "new@example.com", Access: goatcounter.UserAccesses{"all": goatcounter.AccessReadOnly}}
+	u.Password = []byte("password")
+	err := u.Insert(ctx, false)
+	if err == nil || !strings.Contains(err.Error(), "data breaches") {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	u.Password = []byte("correct horse battery staple")
+	err = u.Insert(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	down = true
+	err = u.UpdatePassword(ctx, "password")
+	if err != nil {
+		t.Fatalf("didn't fail open: %s", err)
+	}
+}
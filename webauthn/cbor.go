@@ -0,0 +1,176 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// decodeCBOR decodes a single CBOR item from b and returns the rest.
+//
+// This only supports what's needed for WebAuthn: integers, byte and text
+// strings, arrays, maps, tags (which are ignored), and simple values. Indefinite
+// lengths aren't supported as CTAP2 requires the canonical encoding.
+//
+// Integers are returned as int64, maps as map[any]any.
+func decodeCBOR(b []byte) (any, []byte, error) {
+	return decodeCBORDepth(b, 0)
+}
+
+func decodeCBORDepth(b []byte, depth int) (any, []byte, error) {
+	if depth > 16 {
+		return nil, nil, fmt.Errorf("cbor: nested too deep")
+	}
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+	}
+
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		case 25:
+			if len(b) < 2 {
+				return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+			}
+			return float64(float16(binary.BigEndian.Uint16(b))), b[2:], nil
+		case 26:
+			if len(b) < 4 {
+				return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), b[4:], nil
+		case 27:
+			if len(b) < 8 {
+				return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+		default:
+			return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24:
+		if len(b) < 1 {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		n, b = uint64(b[0]), b[1:]
+	case info == 25:
+		if len(b) < 2 {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		n, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26:
+		if len(b) < 4 {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		n, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27:
+		if len(b) < 8 {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		n, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor: integer overflow")
+		}
+		return int64(n), b, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("cbor: integer overflow")
+		}
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if n > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		if major == 3 {
+			return string(b[:n]), b[n:], nil
+		}
+		return append([]byte{}, b[:n]...), b[n:], nil
+	case 4:
+		if n > uint64(len(b)) { // Every item is at least one byte.
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		arr := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var (
+				v   any
+				err error
+			)
+			v, b, err = decodeCBORDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, b, nil
+	case 5:
+		if n > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		m := make(map[any]any, n)
+		for i := uint64(0); i < n; i++ {
+			var (
+				k, v any
+				err  error
+			)
+			k, b, err = decodeCBORDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+			}
+			v, b, err = decodeCBORDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	case 6: // Tag; just return the tagged value.
+		return decodeCBORDepth(b, depth+1)
+	}
+	panic("unreachable")
+}
+
+func float16(h uint16) float32 {
+	var (
+		sign = uint32(h>>15) << 31
+		exp  = uint32(h>>10) & 0x1f
+		frac = uint32(h) & 0x3ff
+	)
+	switch exp {
+	case 0:
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | frac<<13)
+}
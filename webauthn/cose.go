@@ -0,0 +1,119 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms we support.
+//
+// https://www.iana.org/assignments/cose/cose.xhtml#algorithms
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms is the list of supported algorithms, in order of preference.
+var Algorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters.
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // Or "n" for RSA.
+	coseX   = -2 // Or "e" for RSA.
+	coseY   = -3
+)
+
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parsePublicKey parses a COSE_Key.
+func parsePublicKey(cose []byte) (publicKey, error) {
+	v, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return publicKey{}, err
+	}
+	if len(rest) > 0 {
+		return publicKey{}, fmt.Errorf("trailing data after public key")
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return publicKey{}, fmt.Errorf("public key is not a map")
+	}
+
+	var (
+		kty, _ = m[int64(coseKty)].(int64)
+		alg, _ = m[int64(coseAlg)].(int64)
+	)
+	switch {
+	case kty == 2 && alg == AlgES256: // EC2
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return publicKey{}, fmt.Errorf("invalid P-256 key")
+		}
+		// Use ecdh to validate that the point is on the curve.
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return publicKey{}, fmt.Errorf("invalid P-256 key: %w", err)
+		}
+		return publicKey{alg: alg, key: &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+
+	case kty == 1 && alg == AlgEdDSA: // OKP
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, fmt.Errorf("invalid Ed25519 key")
+		}
+		return publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+
+	case kty == 3 && alg == AlgRS256: // RSA
+		n, _ := m[int64(coseCrv)].([]byte)
+		e, _ := m[int64(coseX)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return publicKey{}, fmt.Errorf("invalid RSA key")
+		}
+		var ee int
+		for _, b := range e {
+			ee = ee<<8 | int(b)
+		}
+		return publicKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: ee}}, nil
+
+	default:
+		return publicKey{}, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+	}
+}
+
+// verify the signature of data.
+func (k publicKey) verify(data, sig []byte) bool {
+	switch k.alg {
+	case AlgES256:
+		h := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(k.key.(*ecdsa.PublicKey), h[:], sig)
+	case AlgEdDSA:
+		return ed25519.Verify(k.key.(ed25519.PublicKey), data, sig)
+	case AlgRS256:
+		h := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(k.key.(*rsa.PublicKey), crypto.SHA256, h[:], sig) == nil
+	}
+	return false
+}
@@ -0,0 +1,360 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package webauthn implements the server side of the WebAuthn registration and
+// authentication ceremonies.
+//
+// This only implements what GoatCounter needs: attestation is always "none"
+// (the attestation statement is never verified, so we don't trust anything
+// about the authenticator), and only the ES256, EdDSA, and RS256 algorithms are
+// supported, which covers every authenticator in common use.
+//
+// https://www.w3.org/TR/webauthn-2/
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Bytes is a []byte which is encoded as base64url in JSON and forms, as is the
+// convention for WebAuthn.
+type Bytes []byte
+
+func (b Bytes) String() string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func (b Bytes) MarshalText() ([]byte, error) { return []byte(b.String()), nil }
+
+func (b *Bytes) UnmarshalText(v []byte) error {
+	var err error
+	*b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(string(v), "="))
+	return err
+}
+
+// NewChallenge creates a new random challenge.
+func NewChallenge() Bytes {
+	c := make(Bytes, 32)
+	_, err := rand.Read(c)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Errors.
+var (
+	ErrChallenge    = errors.New("webauthn: wrong challenge")
+	ErrOrigin       = errors.New("webauthn: wrong origin")
+	ErrRPID         = errors.New("webauthn: wrong relying party ID")
+	ErrUserPresent  = errors.New("webauthn: user not present")
+	ErrUserVerified = errors.New("webauthn: user not verified")
+	ErrSignature    = errors.New("webauthn: invalid signature")
+	ErrSignCount    = errors.New("webauthn: signature counter didn't increase; authenticator may be cloned")
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+)
+
+// RelyingParty is the website.
+type RelyingParty struct {
+	ID      string   // Domain, without scheme or port.
+	Name    string   // Display name.
+	Origins []string // Allowed origins: scheme and host, with port if any.
+}
+
+// Credential is a registered public key credential.
+type Credential struct {
+	ID        Bytes
+	PublicKey Bytes // COSE_Key
+	SignCount uint32
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (rp RelyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	var cd clientData
+	err := json.Unmarshal(raw, &cd)
+	if err != nil {
+		return fmt.Errorf("webauthn: parsing clientDataJSON: %w", err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("webauthn: wrong type %q in clientDataJSON", cd.Type)
+	}
+	c, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(c, challenge) != 1 {
+		return ErrChallenge
+	}
+	if !slices.Contains(rp.Origins, cd.Origin) {
+		return fmt.Errorf("%w: %q", ErrOrigin, cd.Origin)
+	}
+	return nil
+}
+
+type authData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	credID    []byte
+	publicKey []byte
+}
+
+func parseAuthData(b []byte) (authData, error) {
+	if len(b) < 37 {
+		return authData{}, fmt.Errorf("webauthn: authenticator data too short")
+	}
+	ad := authData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	b = b[37:]
+
+	if ad.flags&flagAttested != 0 {
+		if len(b) < 18 {
+			return authData{}, fmt.Errorf("webauthn: attested credential data too short")
+		}
+		l := int(binary.BigEndian.Uint16(b[16:18])) // Skip 16-byte AAGUID.
+		b = b[18:]
+		if len(b) < l {
+			return authData{}, fmt.Errorf("webauthn: credential ID too short")
+		}
+		ad.credID, b = b[:l], b[l:]
+
+		_, rest, err := decodeCBOR(b)
+		if err != nil {
+			return authData{}, fmt.Errorf("webauthn: credential public key: %w", err)
+		}
+		ad.publicKey, b = b[:len(b)-len(rest)], rest
+	}
+	if ad.flags&flagExtensions != 0 {
+		_, rest, err := decodeCBOR(b)
+		if err != nil {
+			return authData{}, fmt.Errorf("webauthn: extensions: %w", err)
+		}
+		b = rest
+	}
+	if len(b) > 0 {
+		return authData{}, fmt.Errorf("webauthn: trailing data in authenticator data")
+	}
+	return ad, nil
+}
+
+func (rp RelyingParty) verifyAuthData(ad authData, requireUV bool) error {
+	h := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, h[:]) {
+		return ErrRPID
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return ErrUserPresent
+	}
+	if requireUV && ad.flags&flagUserVerified == 0 {
+		return ErrUserVerified
+	}
+	return nil
+}
+
+// Register verifies the response of navigator.credentials.create() and returns
+// the new credential.
+func (rp RelyingParty) Register(challenge, clientDataJSON, attestationObject []byte) (Credential, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return Credential{}, fmt.Errorf("webauthn: attestationObject: %w", err)
+	}
+	att, ok := v.(map[any]any)
+	if !ok {
+		return Credential{}, fmt.Errorf("webauthn: attestationObject is not a map")
+	}
+	raw, ok := att["authData"].([]byte)
+	if !ok {
+		return Credential{}, fmt.Errorf("webauthn: no authData in attestationObject")
+	}
+
+	ad, err := parseAuthData(raw)
+	if err != nil {
+		return Credential{}, err
+	}
+	err = rp.verifyAuthData(ad, false)
+	if err != nil {
+		return Credential{}, err
+	}
+	if ad.flags&flagAttested == 0 {
+		return Credential{}, fmt.Errorf("webauthn: no attested credential data")
+	}
+	if len(ad.credID) == 0 || len(ad.credID) > 1023 {
+		return Credential{}, fmt.Errorf("webauthn: invalid credential ID length %d", len(ad.credID))
+	}
+	_, err = parsePublicKey(ad.publicKey)
+	if err != nil {
+		return Credential{}, fmt.Errorf("webauthn: %w", err)
+	}
+
+	return Credential{ID: ad.credID, PublicKey: ad.publicKey, SignCount: ad.signCount}, nil
+}
+
+// Assertion is the response of navigator.credentials.get().
+type Assertion struct {
+	ID                Bytes `json:"id"`
+	ClientDataJSON    Bytes `json:"client_data"`
+	AuthenticatorData Bytes `json:"authenticator_data"`
+	Signature         Bytes `json:"signature"`
+	UserHandle        Bytes `json:"user_handle"`
+}
+
+// Login verifies an assertion for the credential, returning the new signature
+// counter which should be stored.
+//
+// If requireUV is set the authenticator must have verified the user (e.g. with
+// a PIN or biometrics), which is needed if it's used as the only factor.
+func (rp RelyingParty) Login(challenge []byte, cred Credential, a Assertion, requireUV bool) (uint32, error) {
+	if !bytes.Equal(cred.ID, a.ID) {
+		return 0, fmt.Errorf("webauthn: wrong credential")
+	}
+	err := rp.verifyClientData(a.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthData(a.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	err = rp.verifyAuthData(ad, requireUV)
+	if err != nil {
+		return 0, err
+	}
+
+	pk, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, fmt.Errorf("webauthn: %w", err)
+	}
+	h := sha256.Sum256(a.ClientDataJSON)
+	if !pk.verify(append(append([]byte{}, a.AuthenticatorData...), h[:]...), a.Signature) {
+		return 0, ErrSignature
+	}
+
+	// Authenticators that don't support a counter always send 0.
+	if (ad.signCount > 0 || cred.SignCount > 0) && ad.signCount <= cred.SignCount {
+		return 0, ErrSignCount
+	}
+	return ad.signCount, nil
+}
+
+type (
+	// CreationOptions are the options for navigator.credentials.create().
+	CreationOptions struct {
+		Challenge              Bytes               `json:"challenge"`
+		RP                     rpEntity            `json:"rp"`
+		User                   userEntity          `json:"user"`
+		PubKeyCredParams       []credParam         `json:"pubKeyCredParams"`
+		ExcludeCredentials     []credDescriptor    `json:"excludeCredentials"`
+		AuthenticatorSelection authenticatorSelect `json:"authenticatorSelection"`
+		Attestation            string              `json:"attestation"`
+		Timeout                int                 `json:"timeout"`
+	}
+
+	// RequestOptions are the options for navigator.credentials.get().
+	RequestOptions struct {
+		Challenge        Bytes            `json:"challenge"`
+		RPID             string           `json:"rpId"`
+		AllowCredentials []credDescriptor `json:"allowCredentials"`
+		UserVerification string           `json:"userVerification"`
+		Timeout          int              `json:"timeout"`
+	}
+
+	rpEntity struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	userEntity struct {
+		ID          Bytes  `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	credParam struct {
+		Type string `json:"type"`
+		Alg  int64  `json:"alg"`
+	}
+	credDescriptor struct {
+		Type string `json:"type"`
+		ID   Bytes  `json:"id"`
+	}
+	authenticatorSelect struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	}
+)
+
+func descriptors(ids []Bytes) []credDescriptor {
+	d := make([]credDescriptor, 0, len(ids))
+	for _, id := range ids {
+		d = append(d, credDescriptor{Type: "public-key", ID: id})
+	}
+	return d
+}
+
+// CreationOptions gets the options to register a new credential.
+//
+// The userID is stored on the authenticator and sent back as the user handle
+// on login; it shouldn't contain any personal information. The credentials in
+// exclude are already registered for this user.
+func (rp RelyingParty) CreationOptions(challenge, userID Bytes, userName string, exclude []Bytes) CreationOptions {
+	params := make([]credParam, 0, len(Algorithms))
+	for _, a := range Algorithms {
+		params = append(params, credParam{Type: "public-key", Alg: a})
+	}
+	return CreationOptions{
+		Challenge:          challenge,
+		RP:                 rpEntity{ID: rp.ID, Name: rp.Name},
+		User:               userEntity{ID: userID, Name: userName, DisplayName: userName},
+		PubKeyCredParams:   params,
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: authenticatorSelect{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+		Timeout:     300_000,
+	}
+}
+
+// RequestOptions gets the options to login with a credential.
+//
+// If allow is empty then the browser will ask the user to select one of the
+// discoverable credentials for this site (usernameless login).
+func (rp RelyingParty) RequestOptions(challenge Bytes, allow []Bytes, requireUV bool) RequestOptions {
+	uv := "preferred"
+	if requireUV {
+		uv = "required"
+	}
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: uv,
+		Timeout:          300_000,
+	}
+}
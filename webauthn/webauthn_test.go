@@ -0,0 +1,138 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package webauthn_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"zgo.at/goatcounter/v2/webauthn"
+	"zgo.at/goatcounter/v2/webauthn/webauthntest"
+)
+
+var rp = webauthn.RelyingParty{
+	ID:      "example.com",
+	Name:    "Example",
+	Origins: []string{"https://example.com"},
+}
+
+func register(t *testing.T, a *webauthntest.Authenticator) webauthn.Credential {
+	t.Helper()
+	ch := webauthn.NewChallenge()
+	cd, att := a.Create(rp.CreationOptions(ch, webauthn.Bytes("user-1"), "user@example.com", nil), "https://example.com")
+	cred, err := rp.Register(ch, cd, att)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cred
+}
+
+func TestRegister(t *testing.T) {
+	a := webauthntest.New()
+	cred := register(t, a)
+	if !bytes.Equal(cred.ID, a.ID) {
+		t.Errorf("wrong ID: %s", cred.ID)
+	}
+	if !bytes.Equal(cred.PublicKey, a.PublicKey()) {
+		t.Errorf("wrong public key")
+	}
+
+	t.Run("wrong challenge", func(t *testing.T) {
+		cd, att := a.Create(rp.CreationOptions(webauthn.NewChallenge(), nil, "", nil), "https://example.com")
+		_, err := rp.Register(webauthn.NewChallenge(), cd, att)
+		if !errors.Is(err, webauthn.ErrChallenge) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("wrong origin", func(t *testing.T) {
+		ch := webauthn.NewChallenge()
+		cd, att := a.Create(rp.CreationOptions(ch, nil, "", nil), "https://evil.example.com")
+		_, err := rp.Register(ch, cd, att)
+		if !errors.Is(err, webauthn.ErrOrigin) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("wrong rp", func(t *testing.T) {
+		ch := webauthn.NewChallenge()
+		opt := rp.CreationOptions(ch, nil, "", nil)
+		opt.RP.ID = "evil.example.com"
+		cd, att := a.Create(opt, "https://example.com")
+		_, err := rp.Register(ch, cd, att)
+		if !errors.Is(err, webauthn.ErrRPID) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("garbage", func(t *testing.T) {
+		ch := webauthn.NewChallenge()
+		cd, _ := a.Create(rp.CreationOptions(ch, nil, "", nil), "https://example.com")
+		for _, att := range [][]byte{nil, {0xa1}, {0xff, 0xff}, {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}} {
+			_, err := rp.Register(ch, cd, att)
+			if err == nil {
+				t.Errorf("no error for %x", att)
+			}
+		}
+	})
+}
+
+func TestLogin(t *testing.T) {
+	a := webauthntest.New()
+	cred := register(t, a)
+
+	ch := webauthn.NewChallenge()
+	n, err := rp.Login(ch, cred, a.Get(rp.RequestOptions(ch, nil, true), "https://example.com"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("sign count: %d", n)
+	}
+	cred.SignCount = n
+
+	t.Run("replay", func(t *testing.T) {
+		ch := webauthn.NewChallenge()
+		as := a.Get(rp.RequestOptions(ch, nil, true), "https://example.com")
+		_, err := rp.Login(webauthn.NewChallenge(), cred, as, true)
+		if !errors.Is(err, webauthn.ErrChallenge) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("cloned", func(t *testing.T) {
+		ch := webauthn.NewChallenge()
+		a.SignCount = 0
+		_, err := rp.Login(ch, cred, a.Get(rp.RequestOptions(ch, nil, true), "https://example.com"), true)
+		if !errors.Is(err, webauthn.ErrSignCount) {
+			t.Fatal(err)
+		}
+		a.SignCount = 10
+	})
+	t.Run("not verified", func(t *testing.T) {
+		a.NoUserVerified = true
+		defer func() { a.NoUserVerified = false }()
+
+		ch := webauthn.NewChallenge()
+		_, err := rp.Login(ch, cred, a.Get(rp.RequestOptions(ch, nil, true), "https://example.com"), true)
+		if !errors.Is(err, webauthn.ErrUserVerified) {
+			t.Fatal(err)
+		}
+
+		// Fine as second factor.
+		ch = webauthn.NewChallenge()
+		_, err = rp.Login(ch, cred, a.Get(rp.RequestOptions(ch, nil, false), "https://example.com"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		other := webauthntest.New()
+		other.ID = a.ID
+		other.SignCount = 100
+		ch := webauthn.NewChallenge()
+		_, err := rp.Login(ch, cred, other.Get(rp.RequestOptions(ch, nil, true), "https://example.com"), true)
+		if !errors.Is(err, webauthn.ErrSignature) {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+// Package webauthntest provides a software authenticator for testing.
+package webauthntest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"zgo.at/goatcounter/v2/webauthn"
+)
+
+// Authenticator is a software authenticator with a single ES256 credential.
+type Authenticator struct {
+	ID        webauthn.Bytes
+	UserID    webauthn.Bytes
+	SignCount uint32
+
+	// Flags to set; UserVerified defaults to true.
+	NoUserPresent, NoUserVerified bool
+
+	key *ecdsa.PrivateKey
+}
+
+// New creates a new authenticator.
+func New() *Authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	id := make(webauthn.Bytes, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	return &Authenticator{ID: id, key: key}
+}
+
+func (a *Authenticator) clientData(typ, origin string, challenge webauthn.Bytes) []byte {
+	j, err := json.Marshal(map[string]any{
+		"type":      typ,
+		"challenge": challenge.String(),
+		"origin":    origin,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return j
+}
+
+func (a *Authenticator) authData(rpID string, attested bool) []byte {
+	var flags byte
+	if !a.NoUserPresent {
+		flags |= 0x01
+	}
+	if !a.NoUserVerified {
+		flags |= 0x04
+	}
+	if attested {
+		flags |= 0x40
+	}
+
+	h := sha256.Sum256([]byte(rpID))
+	b := append([]byte{}, h[:]...)
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint32(b, a.SignCount)
+	if attested {
+		b = append(b, make([]byte, 16)...) // AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.ID)))
+		b = append(b, a.ID...)
+		b = append(b, a.PublicKey()...)
+	}
+	return b
+}
+
+// PublicKey gets the COSE_Key for the credential.
+func (a *Authenticator) PublicKey() []byte {
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return encode(map[int64]any{1: int64(2), 3: int64(webauthn.AlgES256), -1: int64(1), -2: x, -3: y})
+}
+
+// Create a new credential; returns the clientDataJSON and attestationObject.
+func (a *Authenticator) Create(opt webauthn.CreationOptions, origin string) ([]byte, []byte) {
+	a.UserID = opt.User.ID
+	att := encode(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(opt.RP.ID, true),
+	})
+	return a.clientData("webauthn.create", origin, opt.Challenge), att
+}
+
+// Get an assertion; this increments the signature counter.
+func (a *Authenticator) Get(opt webauthn.RequestOptions, origin string) webauthn.Assertion {
+	a.SignCount++
+	var (
+		cd = a.clientData("webauthn.get", origin, opt.Challenge)
+		ad = a.authData(opt.RPID, false)
+		h  = sha256.Sum256(cd)
+	)
+	sum := sha256.Sum256(append(append([]byte{}, ad...), h[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return webauthn.Assertion{
+		ID:                a.ID,
+		ClientDataJSON:    cd,
+		AuthenticatorData: ad,
+		Signature:         sig,
+		UserHandle:        a.UserID,
+	}
+}
+
+// encode a value as CBOR; only supports the types we need.
+func encode(v any) []byte {
+	var b bytes.Buffer
+	encodeTo(&b, v)
+	return b.Bytes()
+}
+
+func head(b *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		b.WriteByte(major<<5 | byte(n))
+	case n <= 0xff:
+		b.Write([]byte{major<<5 | 24, byte(n)})
+	case n <= 0xffff:
+		b.WriteByte(major<<5 | 25)
+		b.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		b.WriteByte(major<<5 | 26)
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func encodeTo(b *bytes.Buffer, v any) {
+	switch vv := v.(type) {
+	case int64:
+		if vv < 0 {
+			head(b, 1, uint64(-1-vv))
+		} else {
+			head(b, 0, uint64(vv))
+		}
+	case []byte:
+		head(b, 2, uint64(len(vv)))
+		b.Write(vv)
+	case string:
+		head(b, 3, uint64(len(vv)))
+		b.WriteString(vv)
+	case map[string]any:
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		head(b, 5, uint64(len(vv)))
+		for _, k := range keys {
+			encodeTo(b, k)
+			encodeTo(b, vv[k])
+		}
+	case map[int64]any:
+		keys := make([]int64, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		head(b, 5, uint64(len(vv)))
+		for _, k := range keys {
+			encodeTo(b, k)
+			encodeTo(b, vv[k])
+		}
+	default:
+		panic(fmt.Sprintf("webauthntest.encode: unsupported type %T", v))
+	}
+}
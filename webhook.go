@@ -0,0 +1,293 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zcrypto"
+	"zgo.at/zstd/ztime"
+)
+
+// WebhookMaxFailures is the number of failed deliveries in a row after which a
+// webhook is disabled.
+const WebhookMaxFailures = 5
+
+// WebhookSignatureHeader is the header with the HMAC-SHA256 signature of the
+// request body, as "sha256=<hex>".
+const WebhookSignatureHeader = "X-Goatcounter-Signature"
+
+// Webhook receives the reports as a JSON POST request, as an alternative to
+// email reports.
+type Webhook struct {
+	ID     int64 `db:"webhook_id" json:"-"`
+	SiteID int64 `db:"site_id" json:"-"` // Always the account ID.
+	UserID int64 `db:"user_id" json:"-"`
+
+	URL    string `db:"url" json:"url"`
+	Secret string `db:"secret" json:"-"` // Key for the HMAC signature.
+
+	// Number of failed deliveries in a row; the webhook is disabled once this
+	// reaches WebhookMaxFailures.
+	Failures   int        `db:"failures" json:"-"`
+	DisabledAt *time.Time `db:"disabled_at" json:"disabled_at"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (w *Webhook) Defaults(ctx context.Context) {
+	w.SiteID = MustGetSite(ctx).IDOrParent()
+	if w.UserID == 0 {
+		w.UserID = GetUser(ctx).ID
+	}
+	if w.Secret == "" {
+		w.Secret = zcrypto.Secret256()
+	}
+	if w.CreatedAt.IsZero() {
+		w.CreatedAt = ztime.Now()
+	}
+}
+
+func (w *Webhook) Validate(ctx context.Context) error {
+	v := NewValidate(ctx)
+	v.Required("site_id", w.SiteID)
+	v.Required("user_id", w.UserID)
+	v.Required("secret", w.Secret)
+	v.Required("url", w.URL)
+	v.Len("url", w.URL, 0, 2048)
+	v.URL("url", w.URL)
+	if !strings.HasPrefix(w.URL, "https://") && !strings.HasPrefix(w.URL, "http://") {
+		v.Append("url", "must start with https:// or http://")
+	}
+	if u, err := url.Parse(w.URL); err == nil && u.Hostname() != "" && !webhookHostAllowed(ctx, u.Hostname()) {
+		v.Append("url", "can't send webhooks to a local or private network address")
+	}
+	return v.ErrorOrNil()
+}
+
+var webhookAllowPrivate bool
+
+// SetWebhookAllowPrivate sets if webhooks can be sent to loopback, private, and
+// link-local addresses. This is disabled by default, as any user could use it
+// to make requests to the server's network.
+func SetWebhookAllowPrivate(v bool) { webhookAllowPrivate = v }
+
+// WebhookAddrAllowed reports if webhooks can be sent to this address.
+//
+// This is checked when connecting, so it can't be bypassed with DNS records
+// that change after the webhook was added.
+func WebhookAddrAllowed(addr netip.Addr) bool {
+	if webhookAllowPrivate {
+		return true
+	}
+	addr = addr.Unmap()
+	return addr.IsValid() && !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsUnspecified() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast()
+}
+
+// webhookHostAllowed reports if all addresses for host are allowed. This allows
+// hosts that can't be resolved, as that may be a temporary DNS error; the
+// address is checked again when sending the webhook.
+func webhookHostAllowed(ctx context.Context, host string) bool {
+	if webhookAllowPrivate {
+		return true
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return WebhookAddrAllowed(addr)
+	}
+	if h := strings.ToLower(strings.TrimSuffix(host, ".")); h == "localhost" || strings.HasSuffix(h, ".localhost") {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return true
+	}
+	for _, a := range addrs {
+		if !WebhookAddrAllowed(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// Insert a new row.
+func (w *Webhook) Insert(ctx context.Context) error {
+	if w.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	w.Defaults(ctx)
+	err := w.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	w.ID, err = zdb.InsertID(ctx, "webhook_id",
+		`insert into webhooks (site_id, user_id, url, secret, created_at) values (?)`,
+		[]any{w.SiteID, w.UserID, w.URL, w.Secret, w.CreatedAt})
+	return errors.Wrap(err, "Webhook.Insert")
+}
+
+// ByID gets a webhook by ID for the current user.
+func (w *Webhook) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.Get(ctx, w, `/* Webhook.ByID */
+		select * from webhooks where webhook_id=$1 and user_id=$2 and site_id=$3`,
+		id, MustGetUser(ctx).ID, MustGetSite(ctx).IDOrParent()), "Webhook.ByID %d", id)
+}
+
+func (w *Webhook) Delete(ctx context.Context) error {
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `delete from webhook_deliveries where webhook_id=$1`, w.ID)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `/* Webhook.Delete */ delete from webhooks where webhook_id=$1 and site_id=$2`,
+			w.ID, w.SiteID)
+	})
+	return errors.Wrapf(err, "Webhook.Delete %d", w.ID)
+}
+
+// Enable a disabled webhook, resetting the failure count.
+func (w *Webhook) Enable(ctx context.Context) error {
+	err := zdb.Exec(ctx, `update webhooks set failures=0, disabled_at=null where webhook_id=$1`, w.ID)
+	if err != nil {
+		return errors.Wrapf(err, "Webhook.Enable %d", w.ID)
+	}
+	w.Failures, w.DisabledAt = 0, nil
+	return nil
+}
+
+// Disabled reports if this webhook was disabled after too many failures.
+func (w Webhook) Disabled() bool { return w.DisabledAt != nil }
+
+// Sign the request body, returning the value for the WebhookSignatureHeader.
+func (w Webhook) Sign(body []byte) string {
+	m := hmac.New(sha256.New, []byte(w.Secret))
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// Delivered records a delivery attempt; status is the HTTP status code, or 0
+// if there was no response.
+//
+// A failed delivery increments the failure count, and this reports if the
+// webhook was disabled because of it.
+func (w *Webhook) Delivered(ctx context.Context, status, attempts int, deliveryErr error) (bool, error) {
+	d := WebhookDelivery{
+		SiteID:    w.SiteID,
+		WebhookID: w.ID,
+		Status:    status,
+		Attempts:  attempts,
+		CreatedAt: ztime.Now(),
+	}
+	if deliveryErr != nil {
+		d.Error = deliveryErr.Error()
+		if len(d.Error) > 500 {
+			d.Error = d.Error[:500]
+		}
+		w.Failures++
+	} else {
+		w.Failures = 0
+	}
+	disabled := w.Failures >= WebhookMaxFailures && w.DisabledAt == nil
+	if disabled {
+		w.DisabledAt = &d.CreatedAt
+	}
+
+	err := zdb.TX(ctx, func(ctx context.Context) error {
+		err := zdb.Exec(ctx, `insert into webhook_deliveries (site_id, webhook_id, status, error, attempts, created_at)
+			values (?, ?, ?, ?, ?, ?)`, d.SiteID, d.WebhookID, d.Status, d.Error, d.Attempts, d.CreatedAt)
+		if err != nil {
+			return err
+		}
+		// Only keep the most recent deliveries.
+		err = zdb.Exec(ctx, `delete from webhook_deliveries where webhook_id=? and webhook_delivery_id not in (
+			select webhook_delivery_id from webhook_deliveries where webhook_id=?
+			order by created_at desc, webhook_delivery_id desc limit ?)`,
+			w.ID, w.ID, webhookKeepDeliveries)
+		if err != nil {
+			return err
+		}
+		return zdb.Exec(ctx, `update webhooks set failures=$1, disabled_at=$2 where webhook_id=$3`,
+			w.Failures, w.DisabledAt, w.ID)
+	})
+	return disabled, errors.Wrapf(err, "Webhook.Delivered %d", w.ID)
+}
+
+type Webhooks []Webhook
+
+// ListUser lists all webhooks for a user, including disabled ones.
+func (w *Webhooks) ListUser(ctx context.Context, user User) error {
+	return errors.Wrap(zdb.Select(ctx, w, `/* Webhooks.ListUser */
+		select * from webhooks where user_id=$1 and site_id=$2 order by webhook_id`,
+		user.ID, user.Site), "Webhooks.ListUser")
+}
+
+// Active gets all webhooks that aren't disabled.
+func (w Webhooks) Active() Webhooks {
+	active := make(Webhooks, 0, len(w))
+	for _, ww := range w {
+		if !ww.Disabled() {
+			active = append(active, ww)
+		}
+	}
+	return active
+}
+
+// Number of deliveries to keep in the log for every webhook.
+const webhookKeepDeliveries = 20
+
+// WebhookDelivery is an entry in the delivery log of a webhook.
+type WebhookDelivery struct {
+	ID        int64 `db:"webhook_delivery_id" json:"-"`
+	SiteID    int64 `db:"site_id" json:"-"`
+	WebhookID int64 `db:"webhook_id" json:"-"`
+
+	Status    int       `db:"status" json:"status"` // HTTP status; 0 if there was no response.
+	Error     string    `db:"error" json:"error"`   // Empty if it was delivered.
+	Attempts  int       `db:"attempts" json:"attempts"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type WebhookDeliveries []WebhookDelivery
+
+// List the most recent deliveries for the webhooks.
+func (d *WebhookDeliveries) List(ctx context.Context, hooks Webhooks) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(hooks))
+	for _, h := range hooks {
+		ids = append(ids, h.ID)
+	}
+	return errors.Wrap(zdb.Select(ctx, d, `/* WebhookDeliveries.List */
+		select * from webhook_deliveries where webhook_id in (?)
+		order by created_at desc, webhook_delivery_id desc`, ids), "WebhookDeliveries.List")
+}
+
+// For gets all deliveries for a webhook.
+func (d WebhookDeliveries) For(webhookID int64) WebhookDeliveries {
+	var r WebhookDeliveries
+	for _, dd := range d {
+		if dd.WebhookID == webhookID {
+			r = append(r, dd)
+		}
+	}
+	return r
+}
@@ -0,0 +1,56 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+
+	. "zgo.at/goatcounter/v2"
+	"zgo.at/goatcounter/v2/gctest"
+)
+
+func TestWebhookValidate(t *testing.T) {
+	ctx := gctest.DB(t)
+
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{"https://192.0.2.1/hook", ""},
+		{"http://[2001:db8::1]:8080/hook", ""},
+		{"ftp://192.0.2.1/hook", "must start with https:// or http://"},
+		{"http://127.0.0.1/hook", "local or private network address"},
+		{"http://[::1]/hook", "local or private network address"},
+		{"http://[::ffff:10.0.0.1]/hook", "local or private network address"},
+		{"http://192.168.1.1/hook", "local or private network address"},
+		{"http://169.254.169.254/latest/meta-data", "local or private network address"},
+		{"http://0.0.0.0/hook", "local or private network address"},
+		{"http://localhost:8080/hook", "local or private network address"},
+		{"http://app.localhost./hook", "local or private network address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			w := Webhook{SiteID: 1, UserID: 1, Secret: "x", URL: tt.url}
+			err := w.Validate(ctx)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	SetWebhookAllowPrivate(true)
+	defer SetWebhookAllowPrivate(false)
+	w := Webhook{SiteID: 1, UserID: 1, Secret: "x", URL: "http://127.0.0.1/hook"}
+	if err := w.Validate(ctx); err != nil {
+		t.Errorf("with SetWebhookAllowPrivate: %v", err)
+	}
+}
@@ -7,6 +7,7 @@ package widgets
 import (
 	"context"
 	"html/template"
+	"strings"
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/z18n"
@@ -20,6 +21,7 @@ type Browsers struct {
 	s      goatcounter.WidgetSettings
 
 	Limit  int
+	Group  string
 	Detail string
 	Stats  goatcounter.HitStats
 }
@@ -40,6 +42,9 @@ func (w *Browsers) SetSettings(s goatcounter.WidgetSettings) {
 	if x := s["limit"].Value; x != nil {
 		w.Limit = int(x.(float64))
 	}
+	if x := s["group"].Value; x != nil {
+		w.Group = x.(string)
+	}
 	if x := s["key"].Value; x != nil {
 		w.Detail = x.(string)
 	}
@@ -47,15 +52,23 @@ func (w *Browsers) SetSettings(s goatcounter.WidgetSettings) {
 }
 
 func (w *Browsers) GetData(ctx context.Context, a Args) (more bool, err error) {
-	if w.Detail != "" {
-		err = w.Stats.ListBrowser(ctx, w.Detail, a.Rng, a.PathFilter, w.Limit, a.Offset)
-	} else {
-		err = w.Stats.ListBrowsers(ctx, a.Rng, a.PathFilter, w.Limit, a.Offset)
-	}
+	err = w.Stats.ListBrowserVersions(ctx, w.Group, w.Detail, a.Rng, a.PathFilter, w.Limit, a.Offset)
 	w.loaded = true
 	return w.Stats.More, err
 }
 
+// Rows link to the next level: name → major version → full version.
+func (w Browsers) hasSubMenu() bool {
+	switch w.Group {
+	case goatcounter.BrowserGroupFull:
+		return false
+	case goatcounter.BrowserGroupMajor:
+		return w.Detail == ""
+	default:
+		return !strings.Contains(w.Detail, "/")
+	}
+}
+
 func (w Browsers) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
 	return "_dashboard_hchart.gohtml", struct {
 		Context      context.Context
@@ -71,7 +84,7 @@ func (w Browsers) RenderHTML(ctx context.Context, shared SharedData) (string, an
 		TotalUTC     int
 		Stats        goatcounter.HitStats
 		Detail       string
-	}{ctx, goatcounter.Config(ctx).BasePath, w.id, true, shared.RowsOnly, w.Detail == "", w.loaded, w.err,
+	}{ctx, goatcounter.Config(ctx).BasePath, w.id, true, shared.RowsOnly, w.hasSubMenu(), w.loaded, w.err,
 		isCol(ctx, goatcounter.CollectUserAgent), z18n.T(ctx, "header/browsers|Browsers"),
 		shared.TotalUTC, w.Stats, w.Detail}
 }
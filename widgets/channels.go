@@ -0,0 +1,91 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Channels struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+	total  int
+
+	Limit  int
+	Detail string
+	Stats  goatcounter.HitStats
+}
+
+func (w Channels) Name() string                         { return "channels" }
+func (w Channels) Type() string                         { return "hchart" }
+func (w Channels) Label(ctx context.Context) string     { return z18n.T(ctx, "label/channels|Channels") }
+func (w *Channels) SetHTML(h template.HTML)             { w.html = h }
+func (w Channels) HTML() template.HTML                  { return w.html }
+func (w *Channels) SetErr(h error)                      { w.err = h }
+func (w Channels) Err() error                           { return w.err }
+func (w Channels) ID() int                              { return w.id }
+func (w Channels) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *Channels) SetSettings(s goatcounter.WidgetSettings) {
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+	if x := s["key"].Value; x != nil {
+		w.Detail = x.(string)
+	}
+	w.s = s
+}
+
+func (w *Channels) GetData(ctx context.Context, a Args) (more bool, err error) {
+	// Referrals from the site's own domain and spam aren't counted (same as
+	// the referrers widget), so we can't use TotalUTC for the percentages.
+	var channels goatcounter.HitStats
+	err = channels.ListChannels(ctx, a.Rng, a.PathFilter)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range channels.Stats {
+		w.total += s.Count
+	}
+
+	if w.Detail != "" {
+		err = w.Stats.ListChannel(ctx, w.Detail, a.Rng, a.PathFilter, w.Limit, a.Offset)
+	} else {
+		w.Stats = channels
+	}
+	w.loaded = true
+	return w.Stats.More, err
+}
+
+func (w Channels) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	header := z18n.T(ctx, "header/channels|Channels")
+	if w.Detail != "" {
+		header += " – " + goatcounter.ChannelName(ctx, w.Detail)
+	}
+
+	return "_dashboard_hchart.gohtml", struct {
+		Context      context.Context
+		Base         string
+		ID           int
+		CanConfigure bool
+		RowsOnly     bool
+		HasSubMenu   bool
+		Loaded       bool
+		Err          error
+		IsCollected  bool
+		Header       string
+		TotalUTC     int
+		Stats        goatcounter.HitStats
+		Detail       string
+	}{ctx, goatcounter.Config(ctx).BasePath, w.id, false, shared.RowsOnly, w.Detail == "", w.loaded, w.err,
+		isCol(ctx, goatcounter.CollectReferrer), header, w.total, w.Stats, w.Detail}
+}
@@ -0,0 +1,126 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"strconv"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/v2"
+)
+
+// Number of rows to load at a time when writing CSV.
+const csvBatch = 1000
+
+// CanCSV reports if the widget's data can be downloaded with CSV().
+func CanCSV(w Widget) bool {
+	_, _, ok := csvStats(w)
+	_, isPages := w.(*Pages)
+	return ok || isPages
+}
+
+// CSV writes all data for the widget as CSV, rather than just the configured
+// number of rows.
+//
+// The data is loaded csvBatch rows at a time, and every batch is flushed to fp
+// as soon as it's loaded.
+func CSV(ctx context.Context, w Widget, a Args, fp io.Writer) error {
+	c := csv.NewWriter(fp)
+	flush := func() error {
+		c.Flush()
+		if f, ok := fp.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+		return c.Error()
+	}
+
+	if p, ok := w.(*Pages); ok {
+		c.Write([]string{"path", "title", "event", "visitors", "pageviews"})
+
+		opts := goatcounter.HitListOpts{Sort: p.Sort}
+		for {
+			var pages goatcounter.HitLists
+			_, more, err := pages.List(ctx, a.Rng, a.PathFilter, opts, csvBatch, true)
+			if err != nil {
+				return errors.Wrap(err, "widgets.CSV")
+			}
+			for _, h := range pages {
+				c.Write([]string{h.Path, h.Title, strconv.FormatBool(bool(h.Event)),
+					strconv.Itoa(h.Count), strconv.Itoa(h.Views)})
+			}
+			if err := flush(); err != nil {
+				return errors.Wrap(err, "widgets.CSV")
+			}
+			if !more {
+				return nil
+			}
+			opts.After = pages.Cursor(opts.Sort)
+		}
+	}
+
+	stats, limit, ok := csvStats(w)
+	if !ok {
+		return errors.Errorf("widgets.CSV: can't download %q as CSV", w.Name())
+	}
+	*limit = csvBatch
+
+	c.Write([]string{"name", "visitors"})
+	for {
+		*stats = goatcounter.HitStats{}
+		more, err := w.GetData(ctx, a)
+		if err != nil {
+			return errors.Wrap(err, "widgets.CSV")
+		}
+		for _, s := range stats.Stats {
+			name := s.Name
+			if name == "" {
+				name = s.ID
+			}
+			c.Write([]string{name, strconv.Itoa(s.Count)})
+		}
+		if err := flush(); err != nil {
+			return errors.Wrap(err, "widgets.CSV")
+		}
+		if !more || len(stats.Stats) == 0 {
+			return nil
+		}
+		a.Offset += len(stats.Stats)
+	}
+}
+
+func csvStats(w Widget) (*goatcounter.HitStats, *int, bool) {
+	switch ww := w.(type) {
+	case *TopRefs:
+		return &ww.TopRefs, &ww.Limit, true
+	case *Channels:
+		return &ww.Stats, &ww.Limit, true
+	case *Campaigns:
+		return &ww.Stats, &ww.Limit, true
+	case *Browsers:
+		return &ww.Stats, &ww.Limit, true
+	case *Systems:
+		return &ww.Stats, &ww.Limit, true
+	case *Sizes:
+		return &ww.Stats, &ww.Limit, true
+	case *Devices:
+		return &ww.Stats, new(int), true // Always a fixed number of rows.
+	case *Scales:
+		return &ww.Stats, new(int), true
+	case *StatusCodes:
+		return &ww.Stats, &ww.Limit, true
+	case *Locations:
+		return &ww.Stats, &ww.Limit, true
+	case *Languages:
+		return &ww.Stats, &ww.Limit, true
+	case *Entries:
+		return &ww.Stats, &ww.Limit, true
+	case *Exits:
+		return &ww.Stats, &ww.Limit, true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,64 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Devices struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Stats goatcounter.HitStats
+}
+
+func (w Devices) Name() string                         { return "devices" }
+func (w Devices) Type() string                         { return "hchart" }
+func (w Devices) Label(ctx context.Context) string     { return z18n.T(ctx, "label/device-stats|Devices") }
+func (w *Devices) SetHTML(h template.HTML)             { w.html = h }
+func (w Devices) HTML() template.HTML                  { return w.html }
+func (w *Devices) SetErr(h error)                      { w.err = h }
+func (w Devices) Err() error                           { return w.err }
+func (w Devices) ID() int                              { return w.id }
+func (w Devices) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *Devices) SetSettings(s goatcounter.WidgetSettings) { w.s = s }
+
+func (w *Devices) GetData(ctx context.Context, a Args) (more bool, err error) {
+	err = w.Stats.ListDevices(ctx, a.Rng, a.PathFilter)
+	w.loaded = true
+	return false, err
+}
+
+func (w Devices) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	var total int
+	for _, s := range w.Stats.Stats {
+		total += s.Count
+	}
+
+	return "_dashboard_devices.gohtml", struct {
+		Context      context.Context
+		Base         string
+		ID           int
+		CanConfigure bool
+		RowsOnly     bool
+		Loaded       bool
+		Err          error
+		IsCollected  bool
+		Header       string
+		Total        int
+		Stats        goatcounter.HitStats
+	}{ctx, goatcounter.Config(ctx).BasePath, w.id, false, shared.RowsOnly, w.loaded, w.err,
+		isCol(ctx, goatcounter.CollectScreenSize) || isCol(ctx, goatcounter.CollectUserAgent),
+		z18n.T(ctx, "header/devices|Devices"), total, w.Stats}
+}
@@ -0,0 +1,74 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Entries struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Limit int
+	Total int
+	Stats goatcounter.HitStats
+}
+
+func (w Entries) Name() string { return "entries" }
+func (w Entries) Type() string { return "hchart" }
+func (w Entries) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/entry-pages|Entry pages")
+}
+func (w *Entries) SetHTML(h template.HTML)             { w.html = h }
+func (w Entries) HTML() template.HTML                  { return w.html }
+func (w *Entries) SetErr(h error)                      { w.err = h }
+func (w Entries) Err() error                           { return w.err }
+func (w Entries) ID() int                              { return w.id }
+func (w Entries) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *Entries) SetSettings(s goatcounter.WidgetSettings) {
+	w.s = s
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+}
+
+func (w *Entries) GetData(ctx context.Context, a Args) (more bool, err error) {
+	err = w.Stats.ListEntryPages(ctx, a.Rng, a.PathFilter, w.Limit, a.Offset)
+	if err == nil {
+		w.Total, _, err = goatcounter.CountSessions(ctx, a.Rng, a.PathFilter)
+	}
+	w.loaded = true
+	return w.Stats.More, err
+}
+
+func (w Entries) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	header := z18n.T(ctx, "header/entry-pages|Entry pages")
+
+	return "_dashboard_hchart.gohtml", struct {
+		Context      context.Context
+		Base         string
+		ID           int
+		CanConfigure bool
+		RowsOnly     bool
+		HasSubMenu   bool
+		Loaded       bool
+		Err          error
+		IsCollected  bool
+		Header       string
+		TotalUTC     int
+		Stats        goatcounter.HitStats
+	}{ctx, goatcounter.Config(ctx).BasePath, w.id, true, shared.RowsOnly, false, w.loaded, w.err,
+		isCol(ctx, goatcounter.CollectSession),
+		header, w.Total, w.Stats}
+}
@@ -0,0 +1,74 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Exits struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Limit int
+	Total int
+	Stats goatcounter.HitStats
+}
+
+func (w Exits) Name() string { return "exits" }
+func (w Exits) Type() string { return "hchart" }
+func (w Exits) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/exit-pages|Exit pages")
+}
+func (w *Exits) SetHTML(h template.HTML)             { w.html = h }
+func (w Exits) HTML() template.HTML                  { return w.html }
+func (w *Exits) SetErr(h error)                      { w.err = h }
+func (w Exits) Err() error                           { return w.err }
+func (w Exits) ID() int                              { return w.id }
+func (w Exits) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *Exits) SetSettings(s goatcounter.WidgetSettings) {
+	w.s = s
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+}
+
+func (w *Exits) GetData(ctx context.Context, a Args) (more bool, err error) {
+	err = w.Stats.ListExitPages(ctx, a.Rng, a.PathFilter, w.Limit, a.Offset)
+	if err == nil {
+		_, w.Total, err = goatcounter.CountSessions(ctx, a.Rng, a.PathFilter)
+	}
+	w.loaded = true
+	return w.Stats.More, err
+}
+
+func (w Exits) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	header := z18n.T(ctx, "header/exit-pages|Exit pages")
+
+	return "_dashboard_hchart.gohtml", struct {
+		Context      context.Context
+		Base         string
+		ID           int
+		CanConfigure bool
+		RowsOnly     bool
+		HasSubMenu   bool
+		Loaded       bool
+		Err          error
+		IsCollected  bool
+		Header       string
+		TotalUTC     int
+		Stats        goatcounter.HitStats
+	}{ctx, goatcounter.Config(ctx).BasePath, w.id, true, shared.RowsOnly, false, w.loaded, w.err,
+		isCol(ctx, goatcounter.CollectSession),
+		header, w.Total, w.Stats}
+}
@@ -7,6 +7,7 @@ package widgets
 import (
 	"context"
 	"html/template"
+	"strings"
 
 	"zgo.at/goatcounter/v2"
 	"zgo.at/z18n"
@@ -22,6 +23,10 @@ type Locations struct {
 	Limit  int
 	Detail string
 	Stats  goatcounter.HitStats
+
+	// Top paths and referrers for the country in Detail.
+	Paths goatcounter.HitStats
+	Refs  goatcounter.HitStats
 }
 
 func (w Locations) Name() string { return "locations" }
@@ -47,8 +52,16 @@ func (w *Locations) SetSettings(s goatcounter.WidgetSettings) {
 }
 
 func (w *Locations) GetData(ctx context.Context, a Args) (more bool, err error) {
-	if w.Detail != "" {
+	if strings.ContainsRune(w.Detail, '-') {
+		err = w.Stats.ListCities(ctx, w.Detail, a.Rng, a.PathFilter, w.Limit, a.Offset)
+	} else if w.Detail != "" {
 		err = w.Stats.ListLocation(ctx, w.Detail, a.Rng, a.PathFilter, w.Limit, a.Offset)
+		if err == nil && a.Offset == 0 {
+			err = w.Paths.ListLocationPaths(ctx, w.Detail, a.Rng, a.PathFilter, 10, 0)
+		}
+		if err == nil && a.Offset == 0 {
+			err = w.Refs.ListLocationRefs(ctx, w.Detail, a.Rng, a.PathFilter, 5, 0)
+		}
 	} else {
 		err = w.Stats.ListLocations(ctx, a.Rng, a.PathFilter, w.Limit, a.Offset)
 	}
@@ -65,9 +78,16 @@ func (w Locations) RenderHTML(ctx context.Context, shared SharedData) (string, a
 			w.err = err
 		}
 		header = z18n.T(ctx, "header/locations-for|Locations for %(country)", l.CountryName)
+		if l.Region != "" {
+			header = z18n.T(ctx, "header/locations-for-region|Locations for %(region)", l.RegionName)
+		}
 	}
 
-	return "_dashboard_hchart.gohtml", struct {
+	// Countries link to regions, and regions to cities if they're collected.
+	hasSubMenu := w.Detail == "" ||
+		(!strings.ContainsRune(w.Detail, '-') && isCol(ctx, goatcounter.CollectLocationCity))
+
+	return "_dashboard_locations.gohtml", struct {
 		Context      context.Context
 		Base         string
 		ID           int
@@ -81,6 +101,9 @@ func (w Locations) RenderHTML(ctx context.Context, shared SharedData) (string, a
 		TotalUTC     int
 		Stats        goatcounter.HitStats
 		Detail       string
-	}{ctx, goatcounter.Config(ctx).BasePath, w.id, true, shared.RowsOnly, w.Detail == "", w.loaded, w.err,
-		isCol(ctx, goatcounter.CollectLocation), header, shared.TotalUTC, w.Stats, w.Detail}
+		Paths        goatcounter.HitStats
+		Refs         goatcounter.HitStats
+	}{ctx, goatcounter.Config(ctx).BasePath, w.id, true, shared.RowsOnly, hasSubMenu, w.loaded, w.err,
+		isCol(ctx, goatcounter.CollectLocation), header, shared.TotalUTC, w.Stats, w.Detail,
+		w.Paths, w.Refs}
 }
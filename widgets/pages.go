@@ -32,8 +32,10 @@ type Pages struct {
 	Pages            goatcounter.HitLists
 	Refs             goatcounter.HitStats
 	Max              int
-	Exclude          []int64
+	Sort             string
+	After            string
 	Diff             []float64
+	Duration         goatcounter.SessionDuration
 }
 
 func (w Pages) Name() string                         { return "pages" }
@@ -60,11 +62,17 @@ func (w *Pages) SetSettings(s goatcounter.WidgetSettings) {
 	if x := s["style"].Value; x != nil {
 		w.Style = x.(string)
 	}
+	if x := s["sort"].Value; x != nil {
+		w.Sort = x.(string)
+	}
 }
 
 func (w *Pages) GetData(ctx context.Context, a Args) (bool, error) {
 	if w.RefsForPath > 0 {
 		err := w.Refs.ListRefsByPathID(ctx, w.RefsForPath, a.Rng, w.LimitRefs, a.Offset)
+		if err == nil && a.Offset == 0 && isCol(ctx, goatcounter.CollectSession) {
+			w.Duration, err = goatcounter.GetSessionDuration(ctx, a.Rng, []int64{w.RefsForPath})
+		}
 		return w.Refs.More, err
 	}
 
@@ -82,8 +90,12 @@ func (w *Pages) GetData(ctx context.Context, a Args) (bool, error) {
 	}
 
 	var err error
-	w.Display, w.More, err = w.Pages.List(ctx, a.Rng, a.PathFilter, w.Exclude, w.Limit, a.Daily)
+	w.Display, w.More, err = w.Pages.List(ctx, a.Rng, a.PathFilter,
+		goatcounter.HitListOpts{Sort: w.Sort, After: w.After}, w.Limit, a.Daily)
 	errs.Append(err)
+	if a.Group != "" {
+		w.Pages.Group(a.Group, goatcounter.MustGetUser(ctx).Settings.WeekStart())
+	}
 
 	if !goatcounter.MustGetUser(ctx).Settings.FewerNumbers {
 		w.Diff, err = w.Pages.Diff(ctx, a.Rng, a.Rng)
@@ -112,10 +124,11 @@ func (w Pages) RenderHTML(ctx context.Context, shared SharedData) (string, any)
 			Loaded  bool
 			Err     error
 
-			Refs  goatcounter.HitStats
-			Count int
+			Refs     goatcounter.HitStats
+			Count    int
+			Duration goatcounter.SessionDuration
 		}{ctx, shared.Site, shared.User, w.id, w.loaded, w.err,
-			w.Refs, shared.Total}
+			w.Refs, shared.Total, w.Duration}
 	}
 
 	t := "_dashboard_pages"
@@ -161,6 +174,7 @@ func (w Pages) RenderHTML(ctx context.Context, shared SharedData) (string, any)
 		Context context.Context
 		Site    *goatcounter.Site
 		User    *goatcounter.User
+		Base    string
 
 		ID          int
 		Loaded      bool
@@ -178,15 +192,19 @@ func (w Pages) RenderHTML(ctx context.Context, shared SharedData) (string, any)
 		MorePages    bool
 
 		Style    string
+		Cursor   string
 		Refs     goatcounter.HitStats
 		ShowRefs int64
 		Diff     []float64
+
+		ShowBounce bool
 	}{
-		ctx, shared.Site, shared.User,
+		ctx, shared.Site, shared.User, goatcounter.Config(ctx).BasePath,
 		w.id, w.loaded, w.err, w.Pages, shared.Args.Rng, shared.Args.Daily,
 		shared.Args.ForcedDaily, 1, w.Max,
 		w.Display, shared.Total, shared.TotalEvents, w.More,
-		w.Style, w.Refs, shared.Args.ShowRefs,
+		w.Style, w.Pages.Cursor(w.Sort), w.Refs, shared.Args.ShowRefs,
 		w.Diff,
+		isCol(ctx, goatcounter.CollectSession),
 	}
 }
@@ -0,0 +1,62 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type Scales struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+
+	Stats goatcounter.HitStats
+}
+
+func (w Scales) Name() string { return "scales" }
+func (w Scales) Type() string { return "hchart" }
+func (w Scales) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/scale-stats|Pixel density")
+}
+func (w *Scales) SetHTML(h template.HTML)                  { w.html = h }
+func (w Scales) HTML() template.HTML                       { return w.html }
+func (w *Scales) SetErr(h error)                           { w.err = h }
+func (w Scales) Err() error                                { return w.err }
+func (w Scales) ID() int                                   { return w.id }
+func (w Scales) Settings() goatcounter.WidgetSettings      { return w.s }
+func (w *Scales) SetSettings(s goatcounter.WidgetSettings) { w.s = s }
+
+func (w *Scales) GetData(ctx context.Context, a Args) (more bool, err error) {
+	err = w.Stats.ListScales(ctx, a.Rng, a.PathFilter)
+	w.loaded = true
+	return false, err
+}
+
+func (w Scales) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+	return "_dashboard_hchart.gohtml", struct {
+		Context      context.Context
+		Base         string
+		ID           int
+		CanConfigure bool
+		RowsOnly     bool
+		HasSubMenu   bool
+		Loaded       bool
+		Err          error
+		IsCollected  bool
+		Header       string
+		TotalUTC     int
+		Stats        goatcounter.HitStats
+		Detail       string
+	}{ctx, goatcounter.Config(ctx).BasePath, w.id, false, shared.RowsOnly, false, w.loaded, w.err,
+		isCol(ctx, goatcounter.CollectScreenSize), z18n.T(ctx, "header/scales|Pixel density"),
+		shared.TotalUTC, w.Stats, ""}
+}
@@ -0,0 +1,94 @@
+// Copyright © Martin Tournoij – This file is part of GoatCounter and published
+// under the terms of a slightly modified EUPL v1.2 license, which can be found
+// in the LICENSE file or at https://license.goatcounter.com
+
+package widgets
+
+import (
+	"context"
+	"html/template"
+
+	"zgo.at/goatcounter/v2"
+	"zgo.at/z18n"
+)
+
+type StatusCodes struct {
+	id     int
+	loaded bool
+	err    error
+	html   template.HTML
+	s      goatcounter.WidgetSettings
+	total  int
+
+	Limit  int
+	Detail string
+	Stats  goatcounter.HitStats
+}
+
+func (w StatusCodes) Name() string { return "statuscodes" }
+func (w StatusCodes) Type() string { return "hchart" }
+func (w StatusCodes) Label(ctx context.Context) string {
+	return z18n.T(ctx, "label/status-stats|Status codes")
+}
+func (w *StatusCodes) SetHTML(h template.HTML)             { w.html = h }
+func (w StatusCodes) HTML() template.HTML                  { return w.html }
+func (w *StatusCodes) SetErr(h error)                      { w.err = h }
+func (w StatusCodes) Err() error                           { return w.err }
+func (w StatusCodes) ID() int                              { return w.id }
+func (w StatusCodes) Settings() goatcounter.WidgetSettings { return w.s }
+
+func (w *StatusCodes) SetSettings(s goatcounter.WidgetSettings) {
+	if x := s["limit"].Value; x != nil {
+		w.Limit = int(x.(float64))
+	}
+	if x := s["key"].Value; x != nil {
+		w.Detail = x.(string)
+	}
+	w.s = s
+}
+
+func (w *StatusCodes) GetData(ctx context.Context, a Args) (more bool, err error) {
+	// This counts requests rather than visitors, so we can't use TotalUTC for
+	// the percentages.
+	var classes goatcounter.HitStats
+	err = classes.ListStatusClasses(ctx, a.Rng, a.PathFilter)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range classes.Stats {
+		w.total += s.Count
+	}
+
+	if w.Detail != "" {
+		err = w.Stats.ListStatus(ctx, w.Detail, a.Rng, a.PathFilter, w.Limit, a.Offset)
+	} else {
+		w.Stats = classes
+	}
+	w.loaded = true
+	return w.Stats.More, err
+}
+
+func (w StatusCodes) RenderHTML(ctx context.Context, shared SharedData) (string, any) {
+
+	header := z18n.T(ctx, "header/status-codes|Status codes")
+	if w.Detail != "" {
+		header += " – " + w.Detail
+	}
+
+	return "_dashboard_hchart.gohtml", struct {
+		Context      context.Context
+		Base         string
+		ID           int
+		CanConfigure bool
+		RowsOnly     bool
+		HasSubMenu   bool
+		Loaded       bool
+		Err          error
+		IsCollected  bool
+		Header       string
+		TotalUTC     int
+		Stats        goatcounter.HitStats
+		Detail       string
+	}{ctx, goatcounter.Config(ctx).BasePath, w.id, false, shared.RowsOnly, w.Detail == "", w.loaded, w.err,
+		true, header, w.total, w.Stats, w.Detail}
+}
@@ -19,9 +19,12 @@ type TopRefs struct {
 	html   template.HTML
 	s      goatcounter.WidgetSettings
 
-	Limit   int
-	Ref     string
-	TopRefs goatcounter.HitStats
+	Limit       int
+	Ref         string
+	Sort        string
+	HideSpam    bool
+	GroupDomain bool
+	TopRefs     goatcounter.HitStats
 }
 
 func (w TopRefs) Name() string                         { return "toprefs" }
@@ -41,14 +44,29 @@ func (w *TopRefs) SetSettings(s goatcounter.WidgetSettings) {
 	if x := s["key"].Value; x != nil {
 		w.Ref = x.(string)
 	}
+	if x := s["sort"].Value; x != nil {
+		w.Sort = x.(string)
+	}
+	if x := s["hide-spam"].Value; x != nil {
+		w.HideSpam = x.(bool)
+	}
+	if x := s["group-domain"].Value; x != nil {
+		w.GroupDomain = x.(bool)
+	}
 	w.s = s
 }
 
 func (w *TopRefs) GetData(ctx context.Context, a Args) (more bool, err error) {
-	if w.Ref != "" {
+	if w.GroupDomain && w.Ref != "" {
+		err = w.TopRefs.ListRefsByDomain(ctx, w.Ref, a.Rng, a.PathFilter, w.HideSpam, w.Limit, a.Offset)
+	} else if w.Ref != "" {
 		err = w.TopRefs.ListTopRef(ctx, w.Ref, a.Rng, a.PathFilter, w.Limit, a.Offset)
+	} else if w.GroupDomain {
+		err = w.TopRefs.ListTopRefDomains(ctx, a.Rng, a.PathFilter, w.HideSpam, w.Limit, a.Offset)
+	} else if w.Sort == goatcounter.SortTrending {
+		err = w.TopRefs.ListTopRefsTrending(ctx, a.Rng, a.PathFilter, w.HideSpam, w.Limit, a.Offset)
 	} else {
-		err = w.TopRefs.ListTopRefs(ctx, a.Rng, a.PathFilter, w.Limit, a.Offset)
+		err = w.TopRefs.ListTopRefs(ctx, a.Rng, a.PathFilter, w.HideSpam, w.Limit, a.Offset)
 	}
 	w.loaded = true
 	return w.TopRefs.More, err
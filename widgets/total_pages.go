@@ -53,6 +53,10 @@ func (w *TotalPages) SetSettings(s goatcounter.WidgetSettings) {
 
 func (w *TotalPages) GetData(ctx context.Context, a Args) (more bool, err error) {
 	w.Max, err = w.Total.Totals(ctx, a.Rng, a.PathFilter, a.Daily, w.NoEvents)
+	if err == nil && a.Group != "" {
+		w.Total.Group(a.Group, goatcounter.MustGetUser(ctx).Settings.WeekStart())
+		w.Max = max(w.Total.Max, 10)
+	}
 	w.loaded = true
 	return false, err
 }
@@ -91,11 +95,22 @@ func (w TotalPages) RenderHTML(ctx context.Context, shared SharedData) (string,
 
 		Total       int
 		TotalEvents int
+		Sessions    int
+		BounceRate  float64
+		Duration    goatcounter.SessionDuration
+		Visitors    int
+
+		PagesPerVisit float64
+		Filtered      bool
 
 		Style string
 	}{ctx, shared.Site, shared.User, w.id, w.loaded, w.err,
 		w.Align, w.NoEvents,
 		w.Total, shared.Args.Daily, w.Max,
-		shared.Total, shared.TotalEvents,
+		shared.Total, shared.TotalEvents, shared.Sessions,
+		goatcounter.TotalCount{Sessions: shared.Sessions, Bounces: shared.Bounces}.BounceRate(),
+		shared.Duration, shared.Visitors,
+		goatcounter.TotalCount{Sessions: shared.Sessions, Pageviews: shared.Pageviews}.PagesPerVisit(),
+		len(shared.Args.PathFilter) > 0,
 		w.Style}
 }
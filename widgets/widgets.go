@@ -39,6 +39,9 @@ type (
 		Daily       bool
 		ForcedDaily bool
 		ShowRefs    int64
+
+		// Group the charts by week or month; Daily is always set if this is.
+		Group string
 	}
 
 	// SharedData gets passed to every widget.
@@ -51,6 +54,11 @@ type (
 		Total       int
 		TotalUTC    int
 		TotalEvents int
+		Sessions    int
+		Bounces     int
+		Pageviews   int
+		Duration    goatcounter.SessionDuration
+		Visitors    int
 	}
 )
 
@@ -134,10 +142,16 @@ func ListAllWidgets() List {
 		NewWidget("browsers", 0),
 		NewWidget("locations", 0),
 		NewWidget("languages", 0),
+		NewWidget("entries", 0),
+		NewWidget("exits", 0),
 		NewWidget("pages", 0),
 		NewWidget("sizes", 0),
+		NewWidget("devices", 0),
+		NewWidget("scales", 0),
+		NewWidget("statuscodes", 0),
 		NewWidget("systems", 0),
 		NewWidget("toprefs", 0),
+		NewWidget("channels", 0),
 		NewWidget("campaigns", 0),
 		NewWidget("totalpages", 0),
 	}
@@ -154,6 +168,8 @@ func NewWidget(name string, id int) Widget {
 		return &TotalPages{id: id}
 	case "toprefs":
 		return &TopRefs{id: id}
+	case "channels":
+		return &Channels{id: id}
 	case "campaigns":
 		return &Campaigns{id: id}
 	case "browsers":
@@ -162,10 +178,20 @@ func NewWidget(name string, id int) Widget {
 		return &Systems{id: id}
 	case "sizes":
 		return &Sizes{id: id}
+	case "devices":
+		return &Devices{id: id}
+	case "scales":
+		return &Scales{id: id}
+	case "statuscodes":
+		return &StatusCodes{id: id}
 	case "locations":
 		return &Locations{id: id}
 	case "languages":
 		return &Languages{id: id}
+	case "entries":
+		return &Entries{id: id}
+	case "exits":
+		return &Exits{id: id}
 	}
 	zlog.Errorf("unknown widget: %q", name)
 	return &Dummy{}